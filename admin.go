@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// adminConfig holds *config.Admin for the current config.
+var adminConfig atomic.Value
+
+var adminMux = newAdminMux()
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/console", serveConsole)
+	mux.HandleFunc("/admin/console/run", serveConsoleRun)
+	mux.HandleFunc("/admin/processes", serveProcesses)
+	mux.HandleFunc("/admin/kill", serveKill)
+	mux.HandleFunc("/admin/users/", serveUserQueries)
+	mux.HandleFunc("/-/config", serveConfig)
+	mux.HandleFunc("/-/reload", serveReload)
+	mux.HandleFunc("/-/cache/purge", serveCachePurge)
+	mux.HandleFunc("/-/clusters/", serveClusterNodes)
+	return mux
+}
+
+// adminOpsPaths contains operational admin endpoints, which share `/-/`
+// prefix with other chproxy endpoints. Paths ending with `/` match subtrees.
+var adminOpsPaths = []string{
+	"/-/config",
+	"/-/reload",
+	"/-/cache/purge",
+	"/-/clusters/",
+}
+
+// isAdminPath returns true if path must be served by admin handler.
+func isAdminPath(path string) bool {
+	if strings.HasPrefix(path, "/admin/") {
+		return true
+	}
+	for _, p := range adminOpsPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAdmin checks access to admin endpoints and serves them.
+func serveAdmin(rw http.ResponseWriter, r *http.Request) {
+	cfg := adminConfig.Load().(*config.Admin)
+	if len(cfg.User) == 0 {
+		err := fmt.Errorf("%q: admin endpoints are disabled", r.RemoteAddr)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	if !cfg.AllowedNetworks.Contains(r.RemoteAddr) {
+		err := fmt.Errorf("connections to admin endpoints are not allowed from %s", r.RemoteAddr)
+		rw.Header().Set("Connection", "close")
+		respondWith(rw, err, http.StatusForbidden)
+		return
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(cfg.User)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(cfg.Password)) != 1 {
+		err := fmt.Errorf("%q: invalid username or password for admin user %q", r.RemoteAddr, user)
+		rw.Header().Set("WWW-Authenticate", `Basic realm="chproxy admin"`)
+		respondWith(rw, err, http.StatusUnauthorized)
+		return
+	}
+	adminMux.ServeHTTP(rw, r)
+}
+
+// serveAdminListener serves admin endpoints on the dedicated listener.
+func serveAdminListener(cfg config.Admin) {
+	ln := newListener(cfg.ListenAddr)
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		setClientAddr(r)
+		if !isAdminPath(r.URL.Path) {
+			err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+			respondWith(rw, err, http.StatusNotFound)
+			return
+		}
+		serveAdmin(rw, r)
+	})
+	log.Infof("Serving admin endpoints on %q", cfg.ListenAddr)
+	tc := config.TimeoutCfg{
+		ReadTimeout: config.Duration(time.Minute),
+		IdleTimeout: config.Duration(10 * time.Minute),
+	}
+	if err := listenAndServe(ln, h, tc); err != nil {
+		log.Fatalf("admin server error on %q: %s", cfg.ListenAddr, err)
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestServeAdminAccess(t *testing.T) {
+	defer adminConfig.Store(&config.Admin{})
+
+	testCases := []struct {
+		name     string
+		cfg      *config.Admin
+		user     string
+		password string
+		expected int
+	}{
+		{
+			name:     "disabled",
+			cfg:      &config.Admin{},
+			user:     "admin",
+			password: "qwerty",
+			expected: http.StatusNotFound,
+		},
+		{
+			name: "not allowed network",
+			cfg: &config.Admin{
+				User:            "admin",
+				Password:        "qwerty",
+				AllowedNetworks: config.Networks{getNetwork("10.0.0.1")},
+			},
+			user:     "admin",
+			password: "qwerty",
+			expected: http.StatusForbidden,
+		},
+		{
+			name: "wrong password",
+			cfg: &config.Admin{
+				User:     "admin",
+				Password: "qwerty",
+			},
+			user:     "admin",
+			password: "foobar",
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name: "ok",
+			cfg: &config.Admin{
+				User:     "admin",
+				Password: "qwerty",
+			},
+			user:     "admin",
+			password: "qwerty",
+			expected: http.StatusOK,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			adminConfig.Store(tc.cfg)
+			req := httptest.NewRequest("GET", "/admin/console", nil)
+			req.SetBasicAuth(tc.user, tc.password)
+			rw := httptest.NewRecorder()
+			serveAdmin(rw, req)
+			if rw.Code != tc.expected {
+				t.Fatalf("unexpected status code: %d; expected: %d; response: %q", rw.Code, tc.expected, rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestServeHTTPAdminListenerNetworks(t *testing.T) {
+	adminConfig.Store(&config.Admin{
+		User:     "admin",
+		Password: "qwerty",
+	})
+	defer adminConfig.Store(&config.Admin{})
+
+	l := &config.HTTP{
+		AllowedNetworks: config.Networks{getNetwork("10.0.0.1")},
+	}
+	f := func(remoteAddr string, expected int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/admin/console", nil)
+		req = req.WithContext(context.WithValue(req.Context(), listenerContextKey{}, l))
+		req.RemoteAddr = remoteAddr
+		req.SetBasicAuth("admin", "qwerty")
+		rw := httptest.NewRecorder()
+		serveHTTP(rw, req)
+		if rw.Code != expected {
+			t.Fatalf("unexpected status code from %s: %d; expected: %d; response: %q", remoteAddr, rw.Code, expected, rw.Body.String())
+		}
+	}
+	f("127.0.0.1:1234", http.StatusForbidden)
+	f("10.0.0.1:1234", http.StatusOK)
+}
+
+func TestConsoleRun(t *testing.T) {
+	p, err := getProxy(goodCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	origProxy := proxy
+	proxy = p
+	defer func() { proxy = origProxy }()
+
+	rw := httptest.NewRecorder()
+	serveConsole(rw, httptest.NewRequest("GET", "/admin/console", nil))
+	if !strings.Contains(rw.Body.String(), "<option>default</option>") {
+		t.Fatalf("console page must contain user %q; got: %q", "default", rw.Body.String())
+	}
+
+	run := func(body string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/admin/console/run", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rw := httptest.NewRecorder()
+		serveConsoleRun(rw, req)
+		return rw
+	}
+
+	// fakeServer treats request body as response delay.
+	rw = run(`{"user":"default","query":"1ms"}`, "Origin", "http://example.com")
+
+	var res consoleResult
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot parse console response %q: %s", rw.Body.String(), err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Response, okResponse) {
+		t.Fatalf("unexpected console result: %+v", res)
+	}
+	if res.Trace == nil {
+		t.Fatalf("expected trace in console result: %+v", res)
+	}
+	if res.Trace.User != "default" || res.Trace.Cluster != "cluster" || res.Trace.ClusterUser != "web" {
+		t.Fatalf("unexpected routing decision: %+v", res.Trace)
+	}
+	if res.Trace.Cache != "disabled" {
+		t.Fatalf("unexpected cache status: %q; expected: %q", res.Trace.Cache, "disabled")
+	}
+
+	rw = run(`{"user":"unknown","query":"1ms"}`)
+	if !strings.Contains(rw.Body.String(), `unknown user \"unknown\"`) {
+		t.Fatalf("unexpected response for unknown user: %q", rw.Body.String())
+	}
+
+	// Forms may be submitted cross-site, so they are rejected.
+	rw = run(`user=default&query=1ms`, "Content-Type", "application/x-www-form-urlencoded")
+	if rw.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("unexpected status code for form request: %d; response: %q", rw.Code, rw.Body.String())
+	}
+	rw = run(`{"user":"default","query":"1ms"}`, "Origin", "http://evil.com")
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status code for cross-origin request: %d; response: %q", rw.Code, rw.Body.String())
+	}
+	rw = run(`{"user":"default","query":"1ms"}`, "Referer", "http://evil.com/console")
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status code for cross-origin request: %d; response: %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestServeProcesses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if !strings.Contains(string(body), "system.processes") {
+			fmt.Fprintln(rw, "Ok.")
+			return
+		}
+		if user, password, _ := r.BasicAuth(); user != "kill-user" || password != "kill-password" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintln(rw, `{"meta": [], "data": [{"query_id": "foo", "user": "web", "elapsed": 1.5, "query": "SELECT 1"}], "rows": 1}`)
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			Nodes:             []string{addr.Host, "127.0.0.1:1"},
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			KillQueryUser:     config.KillQueryUser{Name: "kill-user", Password: "kill-password"},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	origProxy := proxy
+	proxy = p
+	defer func() { proxy = origProxy }()
+
+	rw := httptest.NewRecorder()
+	serveProcesses(rw, httptest.NewRequest("GET", "/admin/processes", nil))
+	var res []nodeProcesses
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot parse processes response %q: %s", rw.Body.String(), err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("unexpected number of nodes: %d; expected: %d", len(res), 2)
+	}
+	if res[0].Node != addr.Host || len(res[0].Processes) != 1 || res[0].Processes[0]["query_id"] != "foo" {
+		t.Fatalf("unexpected processes for %q: %+v", addr.Host, res[0])
+	}
+	if res[1].Node != "127.0.0.1:1" || len(res[1].Error) == 0 {
+		t.Fatalf("expected error for unreachable node; got %+v", res[1])
+	}
+
+	rw = httptest.NewRecorder()
+	serveProcesses(rw, httptest.NewRequest("GET", "/admin/processes?cluster=unknown", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code for unknown cluster: %d; expected: %d", rw.Code, http.StatusNotFound)
+	}
+}
+
+func TestServeKill(t *testing.T) {
+	var mu sync.Mutex
+	var killed []string
+	newNode := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			if strings.HasPrefix(string(body), "KILL QUERY") {
+				mu.Lock()
+				killed = append(killed, r.Host+": "+string(body))
+				mu.Unlock()
+			}
+			fmt.Fprintln(rw, "Ok.")
+		}))
+	}
+	srv1, srv2 := newNode(), newNode()
+	defer srv1.Close()
+	defer srv2.Close()
+	addr1, _ := url.Parse(srv1.URL)
+	addr2, _ := url.Parse(srv2.URL)
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			Nodes:             []string{addr1.Host, addr2.Host},
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	origProxy := proxy
+	proxy = p
+	defer func() { proxy = origProxy }()
+
+	kill := func(form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/admin/kill", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		serveKill(rw, req)
+		return rw
+	}
+	checkKilled := func(expected ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		sort.Strings(killed)
+		if strings.Join(killed, "\n") != strings.Join(expected, "\n") {
+			t.Fatalf("unexpected killed queries: %q; expected: %q", killed, expected)
+		}
+		killed = nil
+	}
+
+	rw := kill(url.Values{"query_id": []string{"foo'bar"}})
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code for unknown query_id: %d; expected: %d", rw.Code, http.StatusNotFound)
+	}
+
+	rw = kill(url.Values{"query_id": []string{"foo'bar"}, "cluster": []string{"cluster"}})
+	var res []nodeKill
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot parse kill response %q: %s", rw.Body.String(), err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("unexpected kill response: %+v", res)
+	}
+	expected := []string{
+		addr1.Host + `: KILL QUERY WHERE query_id = 'foo\'bar'`,
+		addr2.Host + `: KILL QUERY WHERE query_id = 'foo\'bar'`,
+	}
+	sort.Strings(expected)
+	checkKilled(expected...)
+
+	// Queries running behind chproxy are killed on their node only.
+	h := p.clusters["cluster"].replicas[0].hosts[1]
+	p.running.hosts["18DEF7F9FEAE7254"] = h
+	rw = kill(url.Values{"query_id": []string{"18DEF7F9FEAE7254"}})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d; response: %q", rw.Code, rw.Body.String())
+	}
+	checkKilled(h.addr.Host + ": KILL QUERY WHERE query_id = '18DEF7F9FEAE7254'")
+}
+
+func TestServeUserQueries(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			Nodes:             []string{"localhost:8123"},
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	origProxy := proxy
+	proxy = p
+	defer func() { proxy = origProxy }()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		rw := httptest.NewRecorder()
+		serveUserQueries(rw, req)
+		return rw
+	}
+
+	if rw := get("/admin/users/default/queries"); rw.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code %d for disabled query history; expected %d", rw.Code, http.StatusNotFound)
+	}
+
+	cfg.Server.Admin.QueryHistory = config.QueryHistory{Size: 2}
+	addr, _ := url.Parse(fakeServer.URL)
+	cfg.Clusters[0].Nodes = []string{addr.Host}
+	if err := p.applyConfig(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// fakeServer expects query durations in request bodies.
+	for _, q := range []string{"1ms", "2ms", "3ms"} {
+		req := httptest.NewRequest("POST", fakeServer.URL, strings.NewReader(q))
+		if resp := makeCustomRequest(p, req); resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %d; expected %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	rw := get("/admin/users/default/queries")
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d; expected %d", rw.Code, http.StatusOK)
+	}
+	var entries []queryHistoryEntry
+	if err := json.Unmarshal(rw.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("cannot parse response %q: %s", rw.Body.String(), err)
+	}
+	if len(entries) != 2 || entries[0].Query != "3ms" || entries[1].Query != "2ms" {
+		t.Fatalf("unexpected entries: %+v; expected the two most recent queries", entries)
+	}
+	if entries[0].User != "default" || entries[0].StatusCode != http.StatusOK || len(entries[0].QueryID) == 0 {
+		t.Fatalf("unexpected entry: %+v", entries[0])
+	}
+
+	if rw := get("/admin/users/default/queries?limit=1"); !strings.Contains(rw.Body.String(), "3ms") ||
+		strings.Contains(rw.Body.String(), "2ms") {
+		t.Fatalf("unexpected response for limit=1: %q", rw.Body.String())
+	}
+	if rw := get("/admin/users/unknown/queries"); strings.TrimSpace(rw.Body.String()) != "[]" {
+		t.Fatalf("unexpected response for unknown user: %q", rw.Body.String())
+	}
+	if rw := get("/admin/users/default"); rw.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code %d; expected %d", rw.Code, http.StatusNotFound)
+	}
+}
+
+func TestIsAdminPath(t *testing.T) {
+	f := func(path string, expected bool) {
+		t.Helper()
+		if isAdminPath(path) != expected {
+			t.Fatalf("unexpected isAdminPath(%q); expected %v", path, expected)
+		}
+	}
+	f("/admin/console", true)
+	f("/-/config", true)
+	f("/-/config/foo", false)
+	f("/-/reload", true)
+	f("/-/cache/purge", true)
+	f("/-/clusters/cluster/nodes", true)
+	f("/-/cache/stats", false)
+	f("/-/cache/peer", false)
+	f("/", false)
+}
+
+func TestServeConfig(t *testing.T) {
+	prev, prevAppliedTime := runningConfig, configAppliedTime
+	defer func() {
+		runningConfig, configAppliedTime = prev, prevAppliedTime
+		lastReloadTime, lastReloadErr = time.Time{}, nil
+	}()
+
+	f := func(expectedCode int) configStatus {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/-/config", nil)
+		rw := httptest.NewRecorder()
+		serveConfig(rw, req)
+		if rw.Code != expectedCode {
+			t.Fatalf("unexpected status code: %d; expected: %d; response: %q", rw.Code, expectedCode, rw.Body.String())
+		}
+		var st configStatus
+		if expectedCode == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &st); err != nil {
+				t.Fatalf("cannot parse response %q: %s", rw.Body.String(), err)
+			}
+		}
+		return st
+	}
+
+	runningConfig = nil
+	f(http.StatusServiceUnavailable)
+
+	runningConfig = &config.Config{
+		Users: []config.User{{Name: "default", Password: "qwerty", ToCluster: "cluster", ToUser: "web"}},
+	}
+	configAppliedTime = time.Now()
+	st := f(http.StatusOK)
+	if st.LastReload != nil {
+		t.Fatalf("unexpected last reload status: %+v", st.LastReload)
+	}
+	if !strings.Contains(st.Config, "name: default") || strings.Contains(st.Config, "qwerty") {
+		t.Fatalf("unexpected config:\n%s", st.Config)
+	}
+	if len(st.Checksum) != 64 || st.AppliedAt.IsZero() {
+		t.Fatalf("unexpected config status: %+v", st)
+	}
+
+	lastReloadTime, lastReloadErr = time.Now(), fmt.Errorf("cannot load config")
+	st = f(http.StatusOK)
+	if st.LastReload == nil || st.LastReload.Success || st.LastReload.Error != "cannot load config" {
+		t.Fatalf("unexpected last reload status: %+v", st.LastReload)
+	}
+}
+
+func TestServeReload(t *testing.T) {
+	prevConfigFile := *configFile
+	defer func() {
+		*configFile = prevConfigFile
+		runningConfig, configAppliedTime = nil, time.Time{}
+		lastReloadTime, lastReloadErr = time.Time{}, nil
+	}()
+
+	f := func(method string, expectedCode int) string {
+		t.Helper()
+		req := httptest.NewRequest(method, "/-/reload", nil)
+		rw := httptest.NewRecorder()
+		serveReload(rw, req)
+		if rw.Code != expectedCode {
+			t.Fatalf("unexpected status code: %d; expected: %d; response: %q", rw.Code, expectedCode, rw.Body.String())
+		}
+		return rw.Body.String()
+	}
+
+	*configFile = "testdata/http.yml"
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	runningConfig = cfg
+	f("GET", http.StatusMethodNotAllowed)
+	resp := f("POST", http.StatusOK)
+	if !strings.Contains(resp, `"success": true`) {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+	if runningConfig == cfg {
+		t.Fatalf("the config must be reloaded")
+	}
+
+	*configFile = "testdata/foobar.yml"
+	resp = f("POST", http.StatusInternalServerError)
+	if !strings.Contains(resp, "error while reloading config") {
+		t.Fatalf("unexpected response: %q", resp)
+	}
+}
+
+func TestServeClusterNodes(t *testing.T) {
+	newNode := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(rw, okResponse)
+		}))
+	}
+	srv1, srv2 := newNode(), newNode()
+	defer srv1.Close()
+	defer srv2.Close()
+	addr1, _ := url.Parse(srv1.URL)
+	addr2, _ := url.Parse(srv2.URL)
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			Nodes:             []string{addr1.Host},
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer close(p.reloadSignal)
+	origProxy := proxy
+	proxy = p
+	defer func() { proxy = origProxy }()
+	adminConfig.Store(&config.Admin{
+		User:     "admin",
+		Password: "qwerty",
+	})
+	defer adminConfig.Store(&config.Admin{})
+
+	// Requests are served by the shared listener in order to verify
+	// that all the methods reach admin handler.
+	f := func(method, path string, form url.Values, expectedCode int) []clusterNode {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("admin", "qwerty")
+		rw := httptest.NewRecorder()
+		serveHTTP(rw, req)
+		if rw.Code != expectedCode {
+			t.Fatalf("unexpected status code: %d; expected: %d; response: %q", rw.Code, expectedCode, rw.Body.String())
+		}
+		var nodes []clusterNode
+		if expectedCode == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &nodes); err != nil {
+				t.Fatalf("cannot parse response %q: %s", rw.Body.String(), err)
+			}
+		}
+		return nodes
+	}
+	nodesPath := "/-/clusters/cluster/nodes"
+
+	f("GET", "/-/clusters/foobar/nodes", nil, http.StatusNotFound)
+	f("GET", "/-/clusters/cluster/foobar", nil, http.StatusNotFound)
+	f("PUT", nodesPath, nil, http.StatusMethodNotAllowed)
+	f("DELETE", "/", nil, http.StatusMethodNotAllowed)
+	nodes := f("GET", nodesPath, nil, http.StatusOK)
+	if len(nodes) != 1 || nodes[0].Node != addr1.Host || nodes[0].Replica != "default" {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	f("POST", nodesPath, url.Values{"node": []string{"foobar"}}, http.StatusBadRequest)
+	f("POST", nodesPath, url.Values{"node": []string{addr1.Host}}, http.StatusConflict)
+	f("POST", nodesPath, url.Values{"node": []string{addr2.Host}, "replica": []string{"foobar"}}, http.StatusNotFound)
+	nodes = f("POST", nodesPath, url.Values{"node": []string{addr2.Host}}, http.StatusOK)
+	if len(nodes) != 2 || nodes[1].Node != addr2.Host {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	// Wait for the heartbeat of the added node.
+	c := p.clusters["cluster"]
+	h2 := c.getHostByAddr(addr2.Host)
+	for i := 0; !h2.isActive(); i++ {
+		if i > 100 {
+			t.Fatalf("the added node must become active")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nodes = f("POST", nodesPath+"/"+addr1.Host+"/drain", nil, http.StatusOK)
+	if !nodes[0].Draining || nodes[1].Draining {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	for i := 0; i < 10; i++ {
+		if h := c.getHost(); h != h2 {
+			t.Fatalf("drained node %q mustn't receive queries", h.addr.Host)
+		}
+	}
+	nodes = f("DELETE", nodesPath+"/"+addr1.Host+"/drain", nil, http.StatusOK)
+	if nodes[0].Draining {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+
+	f("DELETE", nodesPath+"/foobar:123", nil, http.StatusNotFound)
+	nodes = f("DELETE", nodesPath+"/"+addr2.Host, nil, http.StatusOK)
+	if len(nodes) != 1 || nodes[0].Node != addr1.Host {
+		t.Fatalf("unexpected nodes: %+v", nodes)
+	}
+	f("DELETE", nodesPath+"/"+addr1.Host, nil, http.StatusConflict)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// cachePurge is the response of `/-/cache/purge`.
+type cachePurge struct {
+	Cache   string `json:"cache"`
+	Removed int    `json:"removed"`
+}
+
+// serveCachePurge removes entries from the cache passed in `cache` arg
+// and broadcasts the purge to other instances via `cache_pubsub`.
+//
+// Entries are identified by `key` args. All the cache entries
+// are removed if `key` args are missing.
+func serveCachePurge(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.FormValue("cache")
+	if len(name) == 0 {
+		err := fmt.Errorf("%q: missing `cache`", r.RemoteAddr)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	keys := r.Form["key"]
+
+	proxy.lock.RLock()
+	c := proxy.caches[name]
+	ps := proxy.cachePubSub
+	proxy.lock.RUnlock()
+	if c == nil {
+		err := fmt.Errorf("%q: unknown cache %q", r.RemoteAddr, name)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	n, err := c.Purge(keys...)
+	if err != nil {
+		err = fmt.Errorf("%q: %s", r.RemoteAddr, err)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	log.Infof("%q: admin purged %d entries from cache %q", r.RemoteAddr, n, name)
+	ps.publish(&cachePurgeEvent{
+		Cache: name,
+		Keys:  keys,
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(&cachePurge{Cache: name, Removed: n}); err != nil {
+		log.Errorf("cannot write cache purge response: %s", err)
+	}
+}
+
+// applyCachePurge applies the purge received from another chproxy instance.
+func (rp *reverseProxy) applyCachePurge(ev *cachePurgeEvent) {
+	if len(ev.Tables) > 0 {
+		rp.invalidateCaches(ev.Tables)
+		return
+	}
+	rp.lock.RLock()
+	c := rp.caches[ev.Cache]
+	rp.lock.RUnlock()
+	if c == nil {
+		// The cache isn't configured on this instance.
+		return
+	}
+	n, err := c.Purge(ev.Keys...)
+	if err != nil {
+		log.Errorf("cannot apply cache purge received from another instance: %s", err)
+		return
+	}
+	log.Debugf("purged %d entries from cache %q on behalf of another instance", n, ev.Cache)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// configStatus is the response of `/-/config`.
+type configStatus struct {
+	// AppliedAt is the time when the config has been applied.
+	AppliedAt time.Time `json:"applied_at"`
+
+	// Checksum is SHA-256 of Config, so configs of multiple
+	// instances may be compared.
+	Checksum string `json:"checksum"`
+
+	// MaxResponseTime is derived from `max_execution_time`
+	// and `max_queue_time` of users and cluster users.
+	MaxResponseTime string `json:"max_response_time"`
+
+	// WriteTimeouts contains `write_timeout` of listeners.
+	WriteTimeouts map[string]string `json:"write_timeouts"`
+
+	// Warnings contains non-fatal problems found in Config.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// LastReload describes the last reload attempt.
+	// It is nil if the config hasn't been reloaded yet.
+	LastReload *reloadStatus `json:"last_reload,omitempty"`
+
+	// Config is the applied config in YAML with redacted secrets.
+	Config string `json:"config"`
+}
+
+type reloadStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// serveConfig returns the currently applied config and the status
+// of the last config reload.
+func serveConfig(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	writeConfigStatus(rw, r)
+}
+
+// serveReload reloads the config the same way as on SIGHUP.
+//
+// The status of the applied config is returned on success.
+func serveReload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	log.Infof("%q: config reload is requested. Going to reload config %s ...", r.RemoteAddr, *configFile)
+	if err := reloadConfig(); err != nil {
+		err = fmt.Errorf("%q: error while reloading config: %s", r.RemoteAddr, err)
+		respondWith(rw, err, http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Reloading config %s: successful", *configFile)
+	writeConfigStatus(rw, r)
+}
+
+func writeConfigStatus(rw http.ResponseWriter, r *http.Request) {
+	configLock.Lock()
+	cfg := runningConfig
+	st := configStatus{
+		AppliedAt: configAppliedTime,
+	}
+	if !lastReloadTime.IsZero() {
+		st.LastReload = &reloadStatus{
+			Time:    lastReloadTime,
+			Success: lastReloadErr == nil,
+		}
+		if lastReloadErr != nil {
+			st.LastReload.Error = lastReloadErr.Error()
+		}
+	}
+	configLock.Unlock()
+	if cfg == nil {
+		err := fmt.Errorf("%q: config isn't applied yet", r.RemoteAddr)
+		respondWith(rw, err, http.StatusServiceUnavailable)
+		return
+	}
+	st.MaxResponseTime = cfg.MaxResponseTime().String()
+	st.WriteTimeouts = make(map[string]string)
+	for i, l := range cfg.Server.HTTP.AllListeners() {
+		if len(l.ListenAddr) > 0 {
+			st.WriteTimeouts[strings.TrimPrefix(httpListenerPath(i), "server.")] = l.WriteTimeout.String()
+		}
+	}
+	if len(cfg.Server.HTTPS.ListenAddr) > 0 {
+		st.WriteTimeouts["https"] = cfg.Server.HTTPS.WriteTimeout.String()
+	}
+	st.Warnings = cfg.Warnings()
+	st.Config = cfg.RedactedString()
+	sum := sha256.Sum256([]byte(st.Config))
+	st.Checksum = hex.EncodeToString(sum[:])
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(st)
+}
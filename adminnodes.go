@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// clusterNode is an item of `/-/clusters/<name>/nodes` response.
+type clusterNode struct {
+	Replica        string `json:"replica"`
+	Node           string `json:"node"`
+	Healthy        bool   `json:"healthy"`
+	Draining       bool   `json:"draining"`
+	RunningQueries uint32 `json:"running_queries"`
+}
+
+// serveClusterNodes manages nodes of the running cluster:
+//
+//	GET    /-/clusters/<name>/nodes               lists nodes
+//	POST   /-/clusters/<name>/nodes               adds `node` to `replica`
+//	DELETE /-/clusters/<name>/nodes/<node>        removes the node
+//	POST   /-/clusters/<name>/nodes/<node>/drain  drains the node
+//	DELETE /-/clusters/<name>/nodes/<node>/drain  undrains the node
+//
+// Drained nodes don't receive new queries, while already running
+// queries are finished. Changes are kept until the next config reload.
+//
+// Nodes are returned on success.
+func serveClusterNodes(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/-/clusters/"), "/")
+	if len(parts) < 2 || len(parts) > 4 || parts[1] != "nodes" || (len(parts) == 4 && parts[3] != "drain") {
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	rp := proxy
+
+	// configLock serializes node changes with each other and with
+	// config reloads, which replace reloadSignal.
+	rp.configLock.Lock()
+	defer rp.configLock.Unlock()
+
+	rp.lock.RLock()
+	c := rp.clusters[parts[0]]
+	rp.lock.RUnlock()
+	if c == nil {
+		err := fmt.Errorf("%q: unknown cluster %q", r.RemoteAddr, parts[0])
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	var status int
+	var err error
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+	case len(parts) == 2 && r.Method == http.MethodPost:
+		status, err = rp.addClusterNode(c, r.FormValue("replica"), r.FormValue("node"))
+	case len(parts) == 3 && r.Method == http.MethodDelete:
+		status, err = removeClusterNode(c, parts[2])
+	case len(parts) == 4 && (r.Method == http.MethodPost || r.Method == http.MethodDelete):
+		status, err = drainClusterNode(c, parts[2], r.Method == http.MethodPost)
+	default:
+		status, err = http.StatusMethodNotAllowed, fmt.Errorf("unsupported method %q", r.Method)
+	}
+	if err != nil {
+		err = fmt.Errorf("%q: cluster %q: %s", r.RemoteAddr, c.name, err)
+		respondWith(rw, err, status)
+		return
+	}
+	if r.Method != http.MethodGet {
+		log.Infof("%q: %s %s: successful", r.RemoteAddr, r.Method, r.URL.Path)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(getClusterNodes(c)); err != nil {
+		log.Errorf("cannot write cluster nodes response: %s", err)
+	}
+}
+
+func getClusterNodes(c *cluster) []clusterNode {
+	var nodes []clusterNode
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			nodes = append(nodes, clusterNode{
+				Replica:        r.name,
+				Node:           h.addr.Host,
+				Healthy:        atomic.LoadUint32(&h.active) == 1,
+				Draining:       atomic.LoadUint32(&h.draining) == 1,
+				RunningQueries: h.counter.load(),
+			})
+		}
+	}
+	return nodes
+}
+
+// addClusterNode adds the node to the replica of c and starts its heartbeat.
+//
+// replica may be empty if c has a single replica.
+func (rp *reverseProxy) addClusterNode(c *cluster, replicaName, node string) (int, error) {
+	if c.discovery != nil {
+		return http.StatusConflict, fmt.Errorf("nodes are managed by discovery")
+	}
+	if len(node) == 0 {
+		return http.StatusBadRequest, fmt.Errorf("missing `node`")
+	}
+	if _, _, err := net.SplitHostPort(node); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid `node` %q: %s", node, err)
+	}
+	var r *replica
+	switch {
+	case len(replicaName) > 0:
+		for _, tmpR := range c.replicas {
+			if tmpR.name == replicaName {
+				r = tmpR
+				break
+			}
+		}
+		if r == nil {
+			return http.StatusNotFound, fmt.Errorf("unknown replica %q", replicaName)
+		}
+	case len(c.replicas) == 1:
+		r = c.replicas[0]
+	default:
+		return http.StatusBadRequest, fmt.Errorf("missing `replica`")
+	}
+	if c.getHostByAddr(node) != nil {
+		return http.StatusConflict, fmt.Errorf("node %q already exists", node)
+	}
+	hosts := r.getHosts()
+	newHosts, err := newNodes([]string{node}, hosts[0].addr.Scheme, r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	h := newHosts[0]
+	// hosts mustn't be modified, since it may be in use.
+	newHosts = make([]*host, 0, len(hosts)+1)
+	newHosts = append(newHosts, hosts...)
+	r.setHosts(append(newHosts, h))
+
+	stopCh := rp.reloadSignal
+	rp.reloadWG.Add(1)
+	go func() {
+		h.runHeartbeat(stopCh)
+		rp.reloadWG.Done()
+	}()
+	return 0, nil
+}
+
+// removeClusterNode removes the node from c and stops its heartbeat.
+//
+// Queries running on the node are finished.
+func removeClusterNode(c *cluster, node string) (int, error) {
+	if c.discovery != nil {
+		return http.StatusConflict, fmt.Errorf("nodes are managed by discovery")
+	}
+	h := c.getHostByAddr(node)
+	if h == nil {
+		return http.StatusNotFound, fmt.Errorf("unknown node %q", node)
+	}
+	r := h.replica
+	hosts := r.getHosts()
+	if len(hosts) == 1 {
+		return http.StatusConflict, fmt.Errorf("cannot remove the last node %q of replica %q", node, r.name)
+	}
+	newHosts := make([]*host, 0, len(hosts)-1)
+	for _, tmpH := range hosts {
+		if tmpH != h {
+			newHosts = append(newHosts, tmpH)
+		}
+	}
+	r.setHosts(newHosts)
+
+	close(h.removeCh)
+	hostHealth.Delete(prometheus.Labels{
+		"cluster":      c.name,
+		"replica":      r.name,
+		"cluster_node": h.addr.Host,
+	})
+	return 0, nil
+}
+
+// drainClusterNode stops or resumes sending new queries to the node.
+func drainClusterNode(c *cluster, node string, drain bool) (int, error) {
+	h := c.getHostByAddr(node)
+	if h == nil {
+		return http.StatusNotFound, fmt.Errorf("unknown node %q", node)
+	}
+	var v uint32
+	if drain {
+		v = 1
+	}
+	atomic.StoreUint32(&h.draining, v)
+	return 0, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+)
+
+// getAffinityKey returns the key for choosing the node
+// by `consistent_hash` policy.
+//
+// Requests in the same ClickHouse session share the key, while other
+// requests are keyed by the normalized query, so repeated queries hit
+// warm OS page cache and mark cache on the same node.
+func getAffinityKey(req *http.Request) (string, error) {
+	if sid := req.URL.Query().Get("session_id"); len(sid) > 0 {
+		return "session_id=" + sid, nil
+	}
+	q, truncated, err := peekQuery(req, maxTenantQuerySize)
+	if err != nil {
+		return "", fmt.Errorf("cannot read query: %s", err)
+	}
+	nq, _ := normalizeQuery(q, truncated)
+	return nq, nil
+}
+
+// routeByAffinity routes the request to the cluster node chosen
+// by rendezvous hashing of the affinity key.
+//
+// Only active nodes are considered, so the key moves to other nodes
+// while its node is unavailable and returns back after recovery.
+func (s *scope) routeByAffinity(req *http.Request) error {
+	if s.cluster.loadBalancing != "consistent_hash" {
+		return nil
+	}
+	key, err := getAffinityKey(req)
+	if err != nil {
+		return err
+	}
+	h := s.cluster.getHostByKey(key)
+	if h != nil && h != s.host {
+		s.setHost(h)
+	}
+	return nil
+}
+
+// getHostByKey returns the active cluster host with the highest
+// hash of key and host address among replicas with the best priority.
+//
+// nil is returned if there are no active hosts.
+func (c *cluster) getHostByKey(key string) *host {
+	var best *host
+	var bestWeight uint64
+	prio := c.activePriority()
+	for _, r := range c.replicas {
+		if r.priority != prio {
+			continue
+		}
+		for _, h := range r.getHosts() {
+			if !h.isActive() {
+				continue
+			}
+			hash := fnv.New64a()
+			hash.Write([]byte(h.addr.Host))
+			hash.Write([]byte{0})
+			hash.Write([]byte(key))
+			if w := mix64(hash.Sum64()); best == nil || w > bestWeight {
+				best = h
+				bestWeight = w
+			}
+		}
+	}
+	return best
+}
+
+// mix64 spreads bits of fnv hash, since its high bits barely depend
+// on the trailing bytes of the key.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
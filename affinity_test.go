@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetAffinityKey(t *testing.T) {
+	f := func(req1, req2 string, equal bool) {
+		t.Helper()
+		r1 := httptest.NewRequest("POST", "http://localhost/?"+req1, strings.NewReader("select 1"))
+		r2 := httptest.NewRequest("GET", "http://localhost/?"+req2, nil)
+		k1, err := getAffinityKey(r1)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		k2, err := getAffinityKey(r2)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if (k1 == k2) != equal {
+			t.Fatalf("unexpected keys equality for %q and %q: %q vs %q", req1, req2, k1, k2)
+		}
+	}
+
+	f("", "query="+url.QueryEscape("SELECT  1 -- dashboard"), true)
+	f("", "query="+url.QueryEscape("SELECT 2"), false)
+	f("session_id=abc", "session_id=abc&query="+url.QueryEscape("SELECT 2"), true)
+	f("session_id=abc", "session_id=def&query=1", false)
+}
+
+func TestGetHostByKey(t *testing.T) {
+	c := &cluster{
+		name:          "default",
+		loadBalancing: "consistent_hash",
+	}
+	for _, addrs := range [][]string{{"127.0.0.1", "127.0.0.2"}, {"127.0.0.3", "127.0.0.4"}} {
+		r := &replica{cluster: c}
+		for _, addr := range addrs {
+			r.hosts = append(r.hosts, &host{
+				addr:    &url.URL{Host: addr},
+				active:  1,
+				replica: r,
+			})
+		}
+		c.replicas = append(c.replicas, r)
+	}
+
+	keys := []string{"SELECT 1", "SELECT 2", "SELECT 3", "SELECT 4", "SELECT 5", "SELECT 6", "SELECT 7", "SELECT 8"}
+	hosts := make(map[string]*host)
+	seen := make(map[*host]bool)
+	for _, k := range keys {
+		h := c.getHostByKey(k)
+		if h == nil {
+			t.Fatalf("expecting non-nil host for %q", k)
+		}
+		if h2 := c.getHostByKey(k); h2 != h {
+			t.Fatalf("got distinct hosts %q and %q for %q", h.addr.Host, h2.addr.Host, k)
+		}
+		hosts[k] = h
+		seen[h] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("expecting keys to be spread among hosts; got %d hosts", len(seen))
+	}
+
+	// Only keys of the unavailable host must move to other hosts.
+	down := hosts[keys[0]]
+	atomic.StoreUint32(&down.active, 0)
+	for _, k := range keys {
+		h := c.getHostByKey(k)
+		if h == down {
+			t.Fatalf("unavailable host %q returned for %q", h.addr.Host, k)
+		}
+		if hosts[k] != down && h != hosts[k] {
+			t.Fatalf("key %q moved from %q to %q", k, hosts[k].addr.Host, h.addr.Host)
+		}
+	}
+
+	for _, r := range c.replicas {
+		for _, h := range r.hosts {
+			atomic.StoreUint32(&h.active, 0)
+		}
+	}
+	if h := c.getHostByKey(keys[0]); h != nil {
+		t.Fatalf("expecting nil host when all the hosts are unavailable; got %q", h.addr.Host)
+	}
+}
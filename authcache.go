@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// authenticator verifies user credentials via external auth backend.
+type authenticator interface {
+	authenticate(name, password string) (bool, error)
+}
+
+// userResolver maps credentials of external auth backend users
+// to chproxy users.
+//
+// Empty name is returned for invalid credentials.
+type userResolver interface {
+	resolve(name, password string) (string, error)
+}
+
+// authCache caches decisions made by authenticators, so auth backends
+// aren't hit on each request.
+//
+// Credentials aren't stored in the cache - only their hashes.
+type authCache struct {
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]authCacheEntry
+}
+
+type authCacheEntry struct {
+	ok       bool
+	user     string
+	deadline time.Time
+}
+
+// newAuthCache returns auth cache for the given cfg.
+//
+// nil is returned if caching is disabled.
+func newAuthCache(cfg config.AuthCache) *authCache {
+	if cfg.MaxEntries == 0 {
+		return nil
+	}
+	return &authCache{
+		positiveTTL: time.Duration(cfg.PositiveTTL),
+		negativeTTL: time.Duration(cfg.NegativeTTL),
+		maxEntries:  cfg.MaxEntries,
+		entries:     make(map[[sha256.Size]byte]authCacheEntry),
+	}
+}
+
+// authenticate returns cached decision for the given credentials
+// or obtains it from a.
+//
+// Errors from a aren't cached.
+func (ac *authCache) authenticate(a authenticator, name, password string) (bool, error) {
+	if ac == nil {
+		return a.authenticate(name, password)
+	}
+	e, err := ac.get("auth", name, password, func() (authCacheEntry, error) {
+		ok, err := a.authenticate(name, password)
+		return authCacheEntry{ok: ok}, err
+	})
+	return e.ok, err
+}
+
+// resolve returns cached chproxy user name for the given credentials
+// or obtains it from r.
+//
+// Errors from r aren't cached.
+func (ac *authCache) resolve(r userResolver, name, password string) (string, error) {
+	if ac == nil {
+		return r.resolve(name, password)
+	}
+	e, err := ac.get("resolve", name, password, func() (authCacheEntry, error) {
+		user, err := r.resolve(name, password)
+		return authCacheEntry{ok: len(user) > 0, user: user}, err
+	})
+	return e.user, err
+}
+
+// get returns cached entry for the given credentials of the backend
+// kind or obtains it via f.
+func (ac *authCache) get(kind, name, password string, f func() (authCacheEntry, error)) (authCacheEntry, error) {
+	key := sha256.Sum256([]byte(kind + "\x00" + name + "\x00" + password))
+	now := time.Now()
+
+	ac.mu.Lock()
+	e, found := ac.entries[key]
+	ac.mu.Unlock()
+	if found && now.Before(e.deadline) {
+		authCacheHit.Inc()
+		return e, nil
+	}
+	authCacheMiss.Inc()
+
+	e, err := f()
+	if err != nil {
+		return e, err
+	}
+	ttl := ac.negativeTTL
+	if e.ok {
+		ttl = ac.positiveTTL
+	}
+	if ttl <= 0 {
+		return e, nil
+	}
+
+	e.deadline = now.Add(ttl)
+	ac.mu.Lock()
+	if len(ac.entries) >= ac.maxEntries {
+		ac.evict(now)
+	}
+	ac.entries[key] = e
+	ac.mu.Unlock()
+	return e, nil
+}
+
+// evict removes expired entries. An arbitrary entry is removed
+// if there are no expired entries.
+//
+// ac.mu must be held by the caller.
+func (ac *authCache) evict(now time.Time) {
+	for k, e := range ac.entries {
+		if !now.Before(e.deadline) {
+			delete(ac.entries, k)
+		}
+	}
+	if len(ac.entries) < ac.maxEntries {
+		return
+	}
+	for k := range ac.entries {
+		delete(ac.entries, k)
+		return
+	}
+}
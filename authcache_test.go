@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+type testAuthenticator struct {
+	password string
+	calls    int
+	err      error
+}
+
+func (ta *testAuthenticator) authenticate(name, password string) (bool, error) {
+	ta.calls++
+	return password == ta.password, ta.err
+}
+
+func TestAuthCache(t *testing.T) {
+	ac := newAuthCache(config.AuthCache{
+		PositiveTTL: config.Duration(time.Minute),
+		NegativeTTL: config.Duration(time.Minute),
+		MaxEntries:  10,
+	})
+	ta := &testAuthenticator{password: "secret"}
+	for i := 0; i < 3; i++ {
+		if ok, err := ac.authenticate(ta, "foo", "secret"); err != nil || !ok {
+			t.Fatalf("unexpected result: %v, %v; expected successful authentication", ok, err)
+		}
+		if ok, err := ac.authenticate(ta, "foo", "wrong"); err != nil || ok {
+			t.Fatalf("unexpected result: %v, %v; expected failed authentication", ok, err)
+		}
+	}
+	if ta.calls != 2 {
+		t.Fatalf("unexpected number of authenticator calls: %d; expected: %d", ta.calls, 2)
+	}
+}
+
+func TestAuthCacheDisabled(t *testing.T) {
+	ac := newAuthCache(config.AuthCache{})
+	if ac != nil {
+		t.Fatalf("auth cache must be disabled for empty config")
+	}
+	ta := &testAuthenticator{password: "secret"}
+	for i := 0; i < 3; i++ {
+		if ok, err := ac.authenticate(ta, "foo", "secret"); err != nil || !ok {
+			t.Fatalf("unexpected result: %v, %v; expected successful authentication", ok, err)
+		}
+	}
+	if ta.calls != 3 {
+		t.Fatalf("unexpected number of authenticator calls: %d; expected: %d", ta.calls, 3)
+	}
+}
+
+func TestAuthCacheErrors(t *testing.T) {
+	ac := newAuthCache(config.AuthCache{
+		PositiveTTL: config.Duration(time.Minute),
+		NegativeTTL: config.Duration(time.Minute),
+		MaxEntries:  10,
+	})
+	ta := &testAuthenticator{err: fmt.Errorf("backend is unavailable")}
+	for i := 0; i < 2; i++ {
+		if _, err := ac.authenticate(ta, "foo", "secret"); err == nil {
+			t.Fatalf("expected error from authenticator")
+		}
+	}
+	if ta.calls != 2 {
+		t.Fatalf("errors mustn't be cached; authenticator calls: %d; expected: %d", ta.calls, 2)
+	}
+}
+
+func TestAuthCacheMaxEntries(t *testing.T) {
+	ac := newAuthCache(config.AuthCache{
+		PositiveTTL: config.Duration(time.Minute),
+		NegativeTTL: config.Duration(time.Minute),
+		MaxEntries:  5,
+	})
+	ta := &testAuthenticator{password: "secret"}
+	for i := 0; i < 20; i++ {
+		if _, err := ac.authenticate(ta, fmt.Sprintf("user%d", i), "secret"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if n := len(ac.entries); n > 5 {
+		t.Fatalf("unexpected number of cached entries: %d; expected at most %d", n, 5)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchQuery is a query with its relative weight in the queries mix.
+type benchQuery struct {
+	query  string
+	weight int
+}
+
+// benchmark fires a mix of queries at the target.
+type benchmark struct {
+	target   *url.URL
+	user     string
+	password string
+
+	queries     []benchQuery
+	totalWeight int
+
+	concurrency int
+	duration    time.Duration
+
+	client *http.Client
+}
+
+// benchResult contains benchmark stats.
+type benchResult struct {
+	elapsed   time.Duration
+	errors    int
+	latencies []time.Duration
+}
+
+// runBench implements `chproxy bench` command.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "", "Target URL of chproxy or ClickHouse node, for example http://chproxy:9090")
+	user := fs.String("user", "", "User name for the target")
+	password := fs.String("password", "", "User password for the target")
+	query := fs.String("query", "", "Query to send. Either -query or -queries must be set")
+	queriesFile := fs.String("queries", "", "File with queries mix. Each line contains a query with optional weight prefix separated by tab, for example \"10\\tSELECT 1\"")
+	concurrency := fs.Int("concurrency", 10, "Number of concurrent requests")
+	duration := fs.Duration("duration", 10*time.Second, "Benchmark duration")
+	fs.Parse(args)
+
+	if len(*target) == 0 {
+		return fmt.Errorf("-target must be set")
+	}
+	u, err := url.Parse(*target)
+	if err != nil {
+		return fmt.Errorf("cannot parse -target %q: %s", *target, err)
+	}
+	if *concurrency <= 0 {
+		return fmt.Errorf("-concurrency must be positive")
+	}
+	if *duration <= 0 {
+		return fmt.Errorf("-duration must be positive")
+	}
+
+	var queries []benchQuery
+	switch {
+	case len(*query) > 0 && len(*queriesFile) > 0:
+		return fmt.Errorf("-query cannot be simultaneously set with -queries")
+	case len(*query) > 0:
+		queries = []benchQuery{{query: *query, weight: 1}}
+	case len(*queriesFile) > 0:
+		f, err := os.Open(*queriesFile)
+		if err != nil {
+			return err
+		}
+		queries, err = parseBenchQueries(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot parse -queries %q: %s", *queriesFile, err)
+		}
+	default:
+		return fmt.Errorf("either -query or -queries must be set")
+	}
+
+	b := newBenchmark(u, queries)
+	b.user = *user
+	b.password = *password
+	b.concurrency = *concurrency
+	b.duration = *duration
+	fmt.Printf("Running benchmark against %q for %s with %d concurrent requests...\n", *target, *duration, *concurrency)
+	fmt.Print(b.run())
+	return nil
+}
+
+// parseBenchQueries reads queries mix from r.
+//
+// Empty lines and lines starting with `#` are skipped.
+func parseBenchQueries(r io.Reader) ([]benchQuery, error) {
+	var queries []benchQuery
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		q := benchQuery{query: line, weight: 1}
+		if n := strings.IndexByte(line, '\t'); n > 0 {
+			if w, err := strconv.Atoi(line[:n]); err == nil {
+				if w <= 0 {
+					return nil, fmt.Errorf("weight must be positive; got %d for query %q", w, line[n+1:])
+				}
+				q.query = strings.TrimSpace(line[n+1:])
+				q.weight = w
+			}
+		}
+		queries = append(queries, q)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no queries found")
+	}
+	return queries, nil
+}
+
+func newBenchmark(target *url.URL, queries []benchQuery) *benchmark {
+	b := &benchmark{
+		target:      target,
+		queries:     queries,
+		concurrency: 1,
+		duration:    time.Second,
+		client:      &http.Client{},
+	}
+	for _, q := range queries {
+		b.totalWeight += q.weight
+	}
+	return b
+}
+
+// nextQuery returns random query from the mix according to query weights.
+func (b *benchmark) nextQuery(rnd *rand.Rand) string {
+	n := rnd.Intn(b.totalWeight)
+	for _, q := range b.queries {
+		if n < q.weight {
+			return q.query
+		}
+		n -= q.weight
+	}
+	panic("BUG: query weights are inconsistent")
+}
+
+func (b *benchmark) run() *benchResult {
+	var mu sync.Mutex
+	res := &benchResult{}
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(b.duration)
+	for i := 0; i < b.concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			var errors int
+			var latencies []time.Duration
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				if err := b.send(b.nextQuery(rnd)); err != nil {
+					errors++
+					continue
+				}
+				latencies = append(latencies, time.Since(t))
+			}
+			mu.Lock()
+			res.errors += errors
+			res.latencies = append(res.latencies, latencies...)
+			mu.Unlock()
+		}(start.UnixNano() + int64(i))
+	}
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	sort.Slice(res.latencies, func(i, j int) bool {
+		return res.latencies[i] < res.latencies[j]
+	})
+	return res
+}
+
+func (b *benchmark) send(query string) error {
+	req, err := http.NewRequest(http.MethodPost, b.target.String(), strings.NewReader(query))
+	if err != nil {
+		return err
+	}
+	if len(b.user) > 0 {
+		req.SetBasicAuth(b.user, b.password)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// percentile returns latency for the given percentile p in the range [0..100].
+//
+// latencies must be sorted.
+func (br *benchResult) percentile(p float64) time.Duration {
+	if len(br.latencies) == 0 {
+		return 0
+	}
+	n := int(float64(len(br.latencies))*p/100+0.5) - 1
+	if n < 0 {
+		n = 0
+	}
+	if n >= len(br.latencies) {
+		n = len(br.latencies) - 1
+	}
+	return br.latencies[n]
+}
+
+func (br *benchResult) String() string {
+	succeeded := len(br.latencies)
+	total := succeeded + br.errors
+	var rps float64
+	if br.elapsed > 0 {
+		rps = float64(total) / br.elapsed.Seconds()
+	}
+	var bb bytes.Buffer
+	fmt.Fprintf(&bb, "Requests: %d; errors: %d; elapsed: %s; rps: %.2f\n", total, br.errors, br.elapsed, rps)
+	fmt.Fprintf(&bb, "Latency percentiles of successful requests:\n")
+	for _, p := range []float64{50, 90, 99, 99.9, 100} {
+		fmt.Fprintf(&bb, "  %5.1f%%: %s\n", p, br.percentile(p))
+	}
+	return bb.String()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseBenchQueries(t *testing.T) {
+	data := "# comment\n\nSELECT 1\n10\tSELECT 2\n"
+	queries, err := parseBenchQueries(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []benchQuery{
+		{query: "SELECT 1", weight: 1},
+		{query: "SELECT 2", weight: 10},
+	}
+	if len(queries) != len(expected) {
+		t.Fatalf("unexpected queries: %v; expected: %v", queries, expected)
+	}
+	for i := range expected {
+		if queries[i] != expected[i] {
+			t.Fatalf("unexpected query #%d: %v; expected: %v", i, queries[i], expected[i])
+		}
+	}
+
+	if _, err := parseBenchQueries(strings.NewReader("-1\tSELECT 1")); err == nil {
+		t.Fatalf("expected error for negative weight")
+	}
+	if _, err := parseBenchQueries(strings.NewReader("# no queries")); err == nil {
+		t.Fatalf("expected error for empty queries")
+	}
+}
+
+func TestBenchmarkRun(t *testing.T) {
+	var requests, failed uint32
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		if user, _, _ := r.BasicAuth(); user != "web" {
+			atomic.AddUint32(&failed, 1)
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b := newBenchmark(u, []benchQuery{{query: "SELECT 1", weight: 1}})
+	b.user = "web"
+	b.concurrency = 2
+	b.duration = 50 * time.Millisecond
+	res := b.run()
+	if len(res.latencies) == 0 {
+		t.Fatalf("expected successful requests")
+	}
+	if res.errors != 0 || failed != 0 {
+		t.Fatalf("unexpected errors: %d", res.errors)
+	}
+	if int(requests) != len(res.latencies) {
+		t.Fatalf("unexpected number of requests: %d; expected: %d", len(res.latencies), requests)
+	}
+	if res.percentile(50) > res.percentile(100) {
+		t.Fatalf("unexpected percentiles: p50 %s > p100 %s", res.percentile(50), res.percentile(100))
+	}
+	if !strings.Contains(res.String(), "errors: 0") {
+		t.Fatalf("unexpected report: %q", res.String())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// errRequestBodyTooLarge is returned when reading request body exceeding
+// `max_request_body_size`.
+var errRequestBodyTooLarge = errors.New("request body is too large")
+
+// getMaxRequestBodySizeWithErrMsg returns the maximum size of the request
+// body for the proxied query.
+//
+// Zero is returned if the size isn't limited.
+func (s *scope) getMaxRequestBodySizeWithErrMsg() (int64, error) {
+	var (
+		limit       int64
+		limitErrMsg error
+	)
+	if s.user.maxRequestBodySize > 0 {
+		limit = s.user.maxRequestBodySize
+		limitErrMsg = fmt.Errorf("`max_request_body_size` for user %q exceeded: %d bytes", s.user.name, limit)
+	}
+	if limit == 0 || (s.clusterUser.maxRequestBodySize > 0 && s.clusterUser.maxRequestBodySize < limit) {
+		limit = s.clusterUser.maxRequestBodySize
+		limitErrMsg = fmt.Errorf("`max_request_body_size` for cluster user %q exceeded: %d bytes", s.clusterUser.name, limit)
+	}
+	return limit, limitErrMsg
+}
+
+// limitRequestBody returns an error if req has Content-Length exceeding
+// `max_request_body_size`. Otherwise req.Body is wrapped, so reading
+// it beyond the limit returns errRequestBodyTooLarge.
+func (s *scope) limitRequestBody(req *http.Request) error {
+	limit, limitErrMsg := s.getMaxRequestBodySizeWithErrMsg()
+	if limit == 0 || req.Body == nil {
+		return nil
+	}
+	if req.ContentLength > limit {
+		return limitErrMsg
+	}
+	req.Body = &limitedReadCloser{
+		ReadCloser: req.Body,
+		remaining:  limit,
+	}
+	return nil
+}
+
+// limitedReadCloser returns errRequestBodyTooLarge if the wrapped
+// ReadCloser contains more than the given number of bytes.
+type limitedReadCloser struct {
+	io.ReadCloser
+
+	remaining int64
+}
+
+func (lrc *limitedReadCloser) Read(p []byte) (int, error) {
+	if lrc.remaining <= 0 {
+		// Check whether the body contains more data.
+		var b [1]byte
+		n, err := lrc.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, errRequestBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > lrc.remaining {
+		p = p[:lrc.remaining]
+	}
+	n, err := lrc.ReadCloser.Read(p)
+	lrc.remaining -= int64(n)
+	return n, err
+}
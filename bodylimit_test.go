@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestMaxRequestBodySize(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			return
+		}
+		w.Write([]byte("Ok.\n"))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name:               "web",
+						MaxRequestBodySize: 200,
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:               "default",
+				ToCluster:          "cluster",
+				ToUser:             "web",
+				MaxRequestBodySize: 100,
+			},
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(body string, chunked bool, expectedStatus int, expectedResponse string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", srv.URL, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		resp := makeCustomRequest(p, req)
+		b := bbToString(t, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d; response: %q", resp.StatusCode, expectedStatus, b)
+		}
+		if !strings.Contains(b, expectedResponse) {
+			t.Fatalf("unexpected response %q; expecting %q", b, expectedResponse)
+		}
+	}
+
+	f("INSERT INTO t FORMAT CSV\n1,2", false, http.StatusOK, "Ok.")
+	f("INSERT INTO t FORMAT CSV\n1,2", true, http.StatusOK, "Ok.")
+
+	// Requests with too large Content-Length mustn't be proxied.
+	atomic.StoreInt32(&requests, 0)
+	f("INSERT INTO t FORMAT CSV\n"+strings.Repeat("1,2\n", 100), false,
+		http.StatusRequestEntityTooLarge, "`max_request_body_size` for user \"default\" exceeded: 100 bytes")
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Fatalf("unexpected number of proxied requests: %d; expecting 0", n)
+	}
+
+	// Streamed requests are aborted as soon as the limit is exceeded.
+	f("INSERT INTO t FORMAT CSV\n"+strings.Repeat("1,2\n", 100), true,
+		http.StatusRequestEntityTooLarge, "`max_request_body_size` for user \"default\" exceeded: 100 bytes")
+
+	// The limit applies to queries sent to /validate.
+	for _, chunked := range []bool{false, true} {
+		req := httptest.NewRequest("POST", "http://localhost"+validatePath, strings.NewReader("SELECT "+strings.Repeat("1,", 100)))
+		if chunked {
+			req.ContentLength = -1
+		}
+		rw := httptest.NewRecorder()
+		p.serveValidate(rw, req)
+		if rw.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("unexpected status code %d for /validate; expecting %d; response: %q", rw.Code, http.StatusRequestEntityTooLarge, rw.Body.String())
+		}
+	}
+
+	// The lowest limit is applied.
+	cfg.Users[0].MaxRequestBodySize = 1000
+	if err := p.applyConfig(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f("INSERT INTO t FORMAT CSV\n"+strings.Repeat("1,2\n", 100), false,
+		http.StatusRequestEntityTooLarge, "`max_request_body_size` for cluster user \"web\" exceeded: 200 bytes")
+}
@@ -2,13 +2,13 @@ package cache
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -26,26 +26,90 @@ import (
 const cacheVersion = 2
 
 // Cache represents a file cache.
+//
+// Cached responses may be stored in S3-compatible object storage
+// instead of files. Temporary files are created in dir then.
+//
+// The most recently used responses may be additionally kept in memory.
 type Cache struct {
 	// Name is cache name.
 	Name string
 
+	// SharedWithAllUsers is set if cached responses may be served
+	// to all the users of the cache. Otherwise responses are isolated
+	// per user namespace.
+	SharedWithAllUsers bool
+
+	// InvalidateOnWrites is set if cached responses must be purged
+	// when the tables they read are modified.
+	InvalidateOnWrites bool
+
 	dir       string
+	s3        *s3Storage
+	mem       *memCache
 	maxSize   uint64
 	expire    time.Duration
 	graceTime time.Duration
 
+	// staleIfError is the duration after expiration during which
+	// expired entries may be served on errors.
+	staleIfError time.Duration
+
+	// maxWait is the maximum duration requests wait for the entry
+	// fetched by a concurrent request.
+	maxWait time.Duration
+
+	// Responses outside [minPayloadSize ... maxPayloadSize] and responses
+	// fetched faster than minQueryDuration aren't cached.
+	// Zero values mean no limits.
+	minPayloadSize   int64
+	maxPayloadSize   int64
+	minQueryDuration time.Duration
+
+	// errors keeps responses with deterministic errors if set.
+	errors *errorCache
+
+	// idx tracks entries, so the cache size is known without
+	// scanning the storage.
+	idx *index
+
+	// evictionPolicy is either "lru" or "lfu".
+	evictionPolicy string
+
+	// Entries are evicted when the cache size exceeds highWatermark
+	// until the size drops below lowWatermark.
+	highWatermark uint64
+	lowWatermark  uint64
+
+	// evictLock prevents concurrent evictions of the same entries.
+	evictLock sync.Mutex
+
+	// fsync is set if cached files must be flushed to disk
+	// before they are renamed from temporary files.
+	fsync bool
+
+	// detectStreamExceptions is set if responses must be checked
+	// for ClickHouse exceptions written in the middle of streaming.
+	detectStreamExceptions bool
+
 	pendingEntries     map[string]pendingEntry
 	pendingEntriesLock sync.Mutex
 
 	stats Stats
 
+	// oldestModTime is the modification time in unix nanoseconds
+	// of the oldest item found during the last cache cleaning.
+	oldestModTime int64
+
 	wg     sync.WaitGroup
 	stopCh chan struct{}
 }
 
 type pendingEntry struct {
 	deadline time.Time
+
+	// done is closed when the entry is stored or its fetching fails.
+	done chan struct{}
 }
 
 // Stats represents cache stats
@@ -53,8 +117,35 @@ type Stats struct {
 	// Size is the cache size in bytes.
 	Size uint64
 
+	// MaxSize is the maximum cache size in bytes.
+	MaxSize uint64
+
 	// Items is the number of items in the cache.
 	Items uint64
+
+	// Hits is the number of responses served from the cache.
+	Hits uint64
+
+	// Misses is the number of lookups for missing or expired responses.
+	Misses uint64
+
+	// Expired is the number of lookups for expired responses.
+	Expired uint64
+
+	// Stale is the number of expired responses served on errors.
+	Stale uint64
+
+	// Evictions is the number of items removed from the cache
+	// in order to keep its size under MaxSize.
+	Evictions uint64
+
+	// OldestItemAge is the age of the oldest item found
+	// during the last cache cleaning.
+	OldestItemAge time.Duration
+
+	// ReclaimedTempBytes is the size of temporary files left
+	// by crashed or killed process, which were removed on start.
+	ReclaimedTempBytes uint64
 }
 
 // Key is the key for use in the cache.
@@ -91,6 +182,25 @@ type Key struct {
 
 	// UserParamsHash must contain hashed value of users params
 	UserParamsHash uint32
+
+	// QuotaKey must contain `quota_key` query arg
+	QuotaKey string
+
+	// Extra must contain the string returned by the cache keyer extension
+	Extra string
+
+	// Params must contain params and headers included into the key
+	// according to `key` section of cache config
+	Params string
+
+	// UserNamespace must identify users sharing cached responses
+	// unless the cache is shared with all the users.
+	UserNamespace string
+
+	// CredentialsHash must contain hash of ClickHouse credentials
+	// if they are passed through from the client, so cached responses
+	// are served only to clients with the same credentials.
+	CredentialsHash string
 }
 
 // String returns string representation of the key.
@@ -98,6 +208,23 @@ func (k *Key) String() string {
 	s := fmt.Sprintf("V%d; Query=%q; AcceptEncoding=%q; DefaultFormat=%q; Database=%q; Compress=%q; EnableHTTPCompression=%q; Namespace=%q; MaxResultRows=%q; Extremes=%q; ResultOverflowMode=%q; UserParams=%d",
 		cacheVersion, k.Query, k.AcceptEncoding, k.DefaultFormat, k.Database, k.Compress, k.EnableHTTPCompression, k.Namespace,
 		k.MaxResultRows, k.Extremes, k.ResultOverflowMode, k.UserParamsHash)
+	if len(k.QuotaKey) > 0 {
+		// QuotaKey is appended only if set, so keys for requests
+		// without quota_key remain unchanged.
+		s += fmt.Sprintf("; QuotaKey=%q", k.QuotaKey)
+	}
+	if len(k.Extra) > 0 {
+		s += fmt.Sprintf("; Extra=%q", k.Extra)
+	}
+	if len(k.Params) > 0 {
+		s += fmt.Sprintf("; Params=%q", k.Params)
+	}
+	if len(k.UserNamespace) > 0 {
+		s += fmt.Sprintf("; UserNamespace=%q", k.UserNamespace)
+	}
+	if len(k.CredentialsHash) > 0 {
+		s += fmt.Sprintf("; Credentials=%q", k.CredentialsHash)
+	}
 	h := sha256.Sum256([]byte(s))
 
 	// The first 16 bytes of the hash should be enough
@@ -113,8 +240,17 @@ var cachefileRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
 // The returned stats is approximate.
 func (c *Cache) Stats() Stats {
 	var s Stats
-	s.Size = atomic.LoadUint64(&c.stats.Size)
-	s.Items = atomic.LoadUint64(&c.stats.Items)
+	s.Size, s.Items = c.idx.stats()
+	s.MaxSize = c.maxSize
+	s.Hits = atomic.LoadUint64(&c.stats.Hits)
+	s.Misses = atomic.LoadUint64(&c.stats.Misses)
+	s.Expired = atomic.LoadUint64(&c.stats.Expired)
+	s.Stale = atomic.LoadUint64(&c.stats.Stale)
+	s.Evictions = atomic.LoadUint64(&c.stats.Evictions)
+	s.ReclaimedTempBytes = atomic.LoadUint64(&c.stats.ReclaimedTempBytes)
+	if mt := atomic.LoadInt64(&c.oldestModTime); mt > 0 {
+		s.OldestItemAge = time.Since(time.Unix(0, mt))
+	}
 	return s
 }
 
@@ -140,21 +276,87 @@ func New(cfg config.Cache) (*Cache, error) {
 		graceTime = 0
 	}
 
+	maxWait := time.Duration(cfg.MaxWaitForConcurrentFetch)
+	if maxWait == 0 {
+		maxWait = graceTime
+	}
+	if maxWait < 0 {
+		// Disable waiting for concurrent fetches.
+		maxWait = 0
+	}
+
+	evictionPolicy := cfg.EvictionPolicy
+	if len(evictionPolicy) == 0 {
+		evictionPolicy = "lru"
+	}
+	highWatermark := cfg.HighWatermark
+	if highWatermark == 0 {
+		highWatermark = 1
+	}
+	lowWatermark := cfg.LowWatermark
+	if lowWatermark == 0 {
+		lowWatermark = 0.9 * highWatermark
+	}
+
 	c := &Cache{
-		Name: cfg.Name,
+		Name:               cfg.Name,
+		SharedWithAllUsers: cfg.SharedWithAllUsers,
+		InvalidateOnWrites: cfg.InvalidateOnWrites,
 
 		dir:       cfg.Dir,
 		maxSize:   uint64(cfg.MaxSize),
 		expire:    time.Duration(cfg.Expire),
 		graceTime: graceTime,
 
+		staleIfError: time.Duration(cfg.StaleIfError),
+		maxWait:      maxWait,
+
+		minPayloadSize:   int64(cfg.MinPayloadSize),
+		maxPayloadSize:   int64(cfg.MaxPayloadSize),
+		minQueryDuration: time.Duration(cfg.MinQueryDuration),
+
+		errors: newErrorCache(time.Duration(cfg.ErrorTTL), cfg.CachedErrorCodes),
+
+		evictionPolicy: evictionPolicy,
+		highWatermark:  uint64(highWatermark * float64(cfg.MaxSize)),
+		lowWatermark:   uint64(lowWatermark * float64(cfg.MaxSize)),
+
+		fsync: cfg.Fsync,
+
+		detectStreamExceptions: cfg.DetectStreamExceptions,
+
 		pendingEntries: make(map[string]pendingEntry),
 		stopCh:         make(chan struct{}),
 	}
 
+	if len(cfg.S3.Bucket) > 0 {
+		s3, err := newS3Storage(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		c.s3 = s3
+	}
+	if cfg.MemSize > 0 {
+		c.mem = newMemCache(uint64(cfg.MemSize))
+	}
+
 	if err := os.MkdirAll(c.dir, 0700); err != nil {
 		return nil, fmt.Errorf("cannot create %q: %s", c.dir, err)
 	}
+	if acquireDir(c.dir) {
+		// Temporary files of other caches with the same dir
+		// mustn't be removed during config reload.
+		size, err := c.removeTempFiles()
+		if err != nil {
+			releaseDir(c.dir)
+			return nil, err
+		}
+		if size > 0 {
+			log.Infof("cache %q: removed orphaned temporary files of size %d from %q", c.Name, size, c.dir)
+		}
+		c.stats.ReclaimedTempBytes = size
+	}
+	c.idx = acquireIndex(c)
 
 	c.wg.Add(1)
 	go func() {
@@ -182,6 +384,8 @@ func (c *Cache) Close() {
 	log.Debugf("cache %q: stopping", c.Name)
 	close(c.stopCh)
 	c.wg.Wait()
+	releaseIndex(c.idx)
+	releaseDir(c.dir)
 	log.Debugf("cache %q: stopped", c.Name)
 }
 
@@ -199,10 +403,10 @@ func (c *Cache) cleaner() {
 	for {
 		select {
 		case <-time.After(time.Second):
-			// Clean cache only on cache size overflow.
-			stats := c.Stats()
-			if stats.Size > c.maxSize {
-				c.clean()
+			// Evict entries only when the size crosses the high watermark.
+			size, _ := c.idx.stats()
+			if size > c.highWatermark {
+				c.evict()
 			}
 		case <-forceCleanCh:
 			// Forcibly clean cache from expired items.
@@ -214,89 +418,216 @@ func (c *Cache) cleaner() {
 	}
 }
 
+// clean removes expired entries and evicts entries if the cache size
+// exceeds the high watermark.
+//
+// Entries are found in the index, so the storage isn't scanned.
 func (c *Cache) clean() {
 	currentTime := time.Now()
 
-	log.Debugf("cache %q: start cleaning dir %q", c.Name, c.dir)
+	log.Debugf("cache %q: start cleaning %s", c.Name, c.location())
+
+	c.errors.removeExpired()
 
 	// Remove cached files after a graceTime from their expiration,
 	// so they may be served until they are substituted with fresh files.
+	// Keep them for staleIfError if it is longer, so they may be served
+	// on errors.
 	expire := c.expire + c.graceTime
+	if c.staleIfError > c.graceTime {
+		expire = c.expire + c.staleIfError
+	}
 
-	// Calculate total cache size and remove expired files.
-	var totalSize uint64
-	var totalItems uint64
 	var removedSize uint64
 	var removedItems uint64
-	err := walkDir(c.dir, func(fi os.FileInfo) {
-		mt := fi.ModTime()
-		fs := uint64(fi.Size())
-		if currentTime.Sub(mt) > expire {
-			fn := c.fileInfoPath(fi)
-			err := os.Remove(fn)
-			if err == nil {
-				removedSize += fs
-				removedItems++
-				return
+	var oldestModTime int64
+	for _, it := range c.idx.items() {
+		if currentTime.Sub(it.modTime) > expire {
+			if err := c.remove(it.name); err != nil {
+				log.Errorf("cache %q: cannot remove %q: %s", c.Name, c.entryPath(it.name), err)
+				continue
 			}
-			log.Errorf("cache %q: cannot remove file %q: %s", c.Name, fn, err)
-			// Return skipped intentionally.
+			removedSize += uint64(it.size)
+			removedItems++
+			continue
+		}
+		if n := it.modTime.UnixNano(); oldestModTime == 0 || n < oldestModTime {
+			oldestModTime = n
 		}
-		totalSize += fs
-		totalItems++
-	})
-	if err != nil {
-		log.Errorf("cache %q: %s", c.Name, err)
-		return
 	}
+	atomic.StoreInt64(&c.oldestModTime, oldestModTime)
 
-	loopsCount := 0
-
-	// Use dedicated random generator instead of global one from math/rand,
-	// since the global generator is slow due to locking.
-	//
-	// Seed the generator with the current time in order to randomize
-	// set of files to be removed below.
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	for totalSize > c.maxSize && loopsCount < 3 {
-		// Remove some files in order to reduce cache size.
-		excessSize := totalSize - c.maxSize
-		p := int32(float64(excessSize) / float64(totalSize) * 100)
-		// Remove +10% over totalSize.
-		p += 10
-		err := walkDir(c.dir, func(fi os.FileInfo) {
-			if rnd.Int31n(100) > p {
-				return
-			}
+	size, _ := c.idx.stats()
+	if size > c.highWatermark {
+		c.evict()
+	}
 
-			fs := uint64(fi.Size())
-			fn := c.fileInfoPath(fi)
-			if err := os.Remove(fn); err != nil {
-				log.Errorf("cache %q: cannot remove file %q: %s", c.Name, fn, err)
-				return
-			}
-			removedSize += fs
-			removedItems++
-			totalSize -= fs
-			totalItems--
-		})
-		if err != nil {
-			log.Errorf("cache %q: %s", c.Name, err)
-			return
+	size, items := c.idx.stats()
+	log.Debugf("cache %q: final size %d; final items %d; removed expired size %d; removed expired items %d",
+		c.Name, size, items, removedSize, removedItems)
+
+	log.Debugf("cache %q: finish cleaning %s", c.Name, c.location())
+}
+
+// evict removes entries according to the eviction policy
+// until the cache size drops below the low watermark.
+func (c *Cache) evict() {
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	items := c.idx.items()
+	sortForEviction(items, c.evictionPolicy)
+
+	var removedSize uint64
+	var removedItems uint64
+	for _, it := range items {
+		size, _ := c.idx.stats()
+		if size <= c.lowWatermark {
+			break
+		}
+		if err := c.remove(it.name); err != nil {
+			log.Errorf("cache %q: cannot remove %q: %s", c.Name, c.entryPath(it.name), err)
+			continue
 		}
+		atomic.AddUint64(&c.stats.Evictions, 1)
+		removedSize += uint64(it.size)
+		removedItems++
+	}
+	log.Debugf("cache %q: evicted %d items of size %d according to %q policy",
+		c.Name, removedItems, removedSize, c.evictionPolicy)
+}
+
+// location returns the description of the cache storage for logs.
+func (c *Cache) location() string {
+	if c.s3 != nil {
+		return c.s3.String()
+	}
+	return fmt.Sprintf("dir %q", c.dir)
+}
 
-		// This should protect from infinite loop.
-		loopsCount++
+// walk calls f on all the cache entries.
+func (c *Cache) walk(f func(name string, size int64, modTime time.Time)) error {
+	if c.s3 != nil {
+		return c.s3.walk(f)
+	}
+	return walkDir(c.dir, func(fi os.FileInfo) {
+		f(fi.Name(), fi.Size(), fi.ModTime())
+	})
+}
+
+// remove deletes the cache entry with the given name.
+func (c *Cache) remove(name string) error {
+	c.mem.remove(name)
+	var err error
+	if c.s3 != nil {
+		err = c.s3.remove(name)
+	} else {
+		err = os.Remove(filepath.Join(c.dir, name))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	c.idx.remove(name)
+	return nil
+}
+
+// entry is a cache entry opened for reading.
+type entry struct {
+	io.ReadCloser
+
+	// name is the entry location for error messages.
+	name    string
+	size    int64
+	modTime time.Time
 
-	atomic.StoreUint64(&c.stats.Size, totalSize)
-	atomic.StoreUint64(&c.stats.Items, totalItems)
+	// statusCode and header are set for cached error responses.
+	statusCode int
+	header     http.Header
+}
+
+// open opens the cache entry with the given name.
+//
+// The entry is read from memory if it is there. Otherwise it is read
+// from the storage and is kept in memory if it fits.
+//
+// The returned error satisfies os.IsNotExist if there is no such entry.
+func (c *Cache) open(name string) (*entry, error) {
+	if e := c.mem.get(name); e != nil {
+		if time.Since(e.modTime) <= c.expire {
+			c.idx.touch(name, e.size, e.modTime)
+			return e, nil
+		}
+		// The expired entry may be already substituted in the storage.
+		c.mem.remove(name)
+	}
+	e, err := c.openStorage(name)
+	if os.IsNotExist(err) {
+		// The entry may be removed by another chproxy instance
+		// sharing the storage.
+		c.idx.remove(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.idx.touch(name, e.size, e.modTime)
+	if !c.mem.fits(e.size) {
+		return e, nil
+	}
+	data, err := ioutil.ReadAll(e)
+	e.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cache %q: cannot read %q: %s", c.Name, e.name, err)
+	}
+	c.mem.put(name, data, e.modTime)
+	return &entry{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(data)),
+		name:       e.name,
+		size:       int64(len(data)),
+		modTime:    e.modTime,
+	}, nil
+}
 
-	log.Debugf("cache %q: final size %d; final items %d; removed size %d; removed items %d",
-		c.Name, totalSize, totalItems, removedSize, removedItems)
+// openStorage opens the cache entry with the given name in the storage.
+func (c *Cache) openStorage(name string) (*entry, error) {
+	if c.s3 != nil {
+		e, err := c.s3.get(name)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cache %q: %s", c.Name, err)
+		}
+		return e, err
+	}
+	fp := filepath.Join(c.dir, name)
+	f, err := os.Open(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("cache %q: cannot open %q: %s", c.Name, fp, err)
+	}
+	e, err := newFileEntry(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cache %q: %s", c.Name, err)
+	}
+	return e, nil
+}
 
-	log.Debugf("cache %q: finish cleaning dir %q", c.Name, c.dir)
+// newFileEntry returns entry for reading f from the current position.
+func newFileEntry(f *os.File) (*entry, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat %q: %s", f.Name(), err)
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine the current position in %q: %s", f.Name(), err)
+	}
+	return &entry{
+		ReadCloser: f,
+		name:       f.Name(),
+		size:       fi.Size() - off,
+		modTime:    fi.ModTime(),
+	}, nil
 }
 
 // walkDir calls f on all the cache files in the given dir.
@@ -337,34 +668,230 @@ func walkDir(dir string, f func(fi os.FileInfo)) error {
 //
 // Returns ErrMissing if the response isn't found in the cache.
 func (c *Cache) WriteTo(rw http.ResponseWriter, key *Key) error {
-	return c.writeTo(rw, key, http.StatusOK)
+	err := c.writeTo(rw, key, http.StatusOK)
+	switch err {
+	case nil:
+		atomic.AddUint64(&c.stats.Hits, 1)
+	case ErrMissing:
+		atomic.AddUint64(&c.stats.Misses, 1)
+	}
+	return err
 }
 
 func (c *Cache) writeTo(rw http.ResponseWriter, key *Key, statusCode int) error {
-	f, err := c.get(key)
+	e, err := c.get(key)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer e.Close()
 
-	if err := sendResponseFromFile(rw, f, c.expire, statusCode); err != nil {
+	expire := c.expire
+	if e.statusCode != 0 {
+		// The cached error response.
+		for k, v := range e.header {
+			rw.Header()[k] = v
+		}
+		expire = 0
+		statusCode = e.statusCode
+	}
+	if err := sendResponse(rw, e, expire, statusCode); err != nil {
 		return fmt.Errorf("cache %q: %s", c.Name, err)
 	}
 
 	return nil
 }
 
-func (c *Cache) get(key *Key) (*os.File, error) {
-	fp := c.filepath(key)
+// WriteStaleTo writes cached response for the given key to rw even if
+// it is expired, but no longer than `stale_if_error` ago.
+//
+// Returns ErrMissing if there is no such response.
+func (c *Cache) WriteStaleTo(rw http.ResponseWriter, key *Key) error {
+	if c.staleIfError <= 0 {
+		return ErrMissing
+	}
+	e, err := c.open(key.String())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrMissing
+		}
+		return err
+	}
+	defer e.Close()
+
+	if time.Since(e.modTime) > c.expire+c.staleIfError {
+		return ErrMissing
+	}
+	atomic.AddUint64(&c.stats.Stale, 1)
+	if err := sendResponse(rw, e, c.expire, http.StatusOK); err != nil {
+		return fmt.Errorf("cache %q: %s", c.Name, err)
+	}
+	return nil
+}
+
+// maxEntryHeaderSize is the allowance for response headers
+// stored in raw cache entries besides the payload.
+const maxEntryHeaderSize = 64 * 1024
+
+// ReadEntry returns raw cache entry for the given key
+// and the time the entry has been cached.
+//
+// key must be obtained via Key.String. The returned entry may be stored
+// in another cache via StoreEntry. The caller must close the returned entry.
+//
+// Returns ErrMissing if the entry isn't found in the cache or is expired.
+func (c *Cache) ReadEntry(key string) (io.ReadCloser, time.Time, error) {
+	if !cachefileRegexp.MatchString(key) {
+		return nil, time.Time{}, fmt.Errorf("cache %q: invalid key %q", c.Name, key)
+	}
+	e, err := c.open(key)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, ErrMissing
+		}
+		return nil, time.Time{}, err
+	}
+	if time.Since(e.modTime) > c.expire {
+		e.Close()
+		return nil, time.Time{}, ErrMissing
+	}
+	return e, e.modTime, nil
+}
+
+// MaxEntrySize returns the maximum size of raw cache entries,
+// which may be passed to StoreEntry.
+func (c *Cache) MaxEntrySize() int64 {
+	if c.maxPayloadSize > 0 {
+		return c.maxPayloadSize + maxEntryHeaderSize
+	}
+	return int64(c.maxSize)
+}
+
+// StoreEntry stores raw cache entry obtained via ReadEntry
+// under the given key.
+//
+// modTime must contain the time the entry has been cached at,
+// so the entry expires at the same time as the original entry.
+// S3 objects get the upload time though, so entries stored in S3
+// may outlive the original entry by up to `expire`.
+//
+// Returns ErrMissing if the entry is already expired.
+func (c *Cache) StoreEntry(key string, r io.Reader, modTime time.Time) error {
+	if !cachefileRegexp.MatchString(key) {
+		return fmt.Errorf("cache %q: invalid key %q", c.Name, key)
+	}
+	if time.Since(modTime) > c.expire {
+		return ErrMissing
+	}
+	f, err := ioutil.TempFile(c.dir, tmpFilePrefix)
+	if err != nil {
+		return fmt.Errorf("cache %q: cannot create temporary file in %q: %s", c.Name, c.dir, err)
+	}
+	fn := f.Name()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot write entry to %q: %s", c.Name, fn, err)
+	}
+	fp := c.entryPath(key)
+	if c.s3 != nil {
+		err := c.s3.put(key, f, n)
+		f.Close()
+		os.Remove(fn)
+		if err != nil {
+			return fmt.Errorf("cache %q: cannot store entry %q: %s", c.Name, fp, err)
+		}
+		c.mem.remove(key)
+		c.errors.remove(key)
+		c.idx.add(key, n, time.Now(), nil)
+		c.unregisterPendingEntry(fp)
+		return nil
+	}
+	if err := c.syncFile(f); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot sync %q: %s", c.Name, fn, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot close %q: %s", c.Name, fn, err)
+	}
+	if err := os.Chtimes(fn, modTime, modTime); err != nil {
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot set modification time of %q: %s", c.Name, fn, err)
+	}
+	if err := os.Rename(fn, fp); err != nil {
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot rename %q to %q: %s", c.Name, fn, fp, err)
+	}
+	if err := c.syncDir(); err != nil {
+		log.Errorf("cache %q: cannot sync %q: %s", c.Name, c.dir, err)
+	}
+	c.mem.remove(key)
+	c.errors.remove(key)
+	c.idx.add(key, n, modTime, nil)
+	c.unregisterPendingEntry(fp)
+	return nil
+}
+
+// Purge removes entries with the given keys from the cache
+// and returns the number of removed entries.
+//
+// All the entries are removed if no keys are given.
+func (c *Cache) Purge(keys ...string) (int, error) {
+	for _, key := range keys {
+		if !cachefileRegexp.MatchString(key) {
+			return 0, fmt.Errorf("cache %q: invalid key %q", c.Name, key)
+		}
+	}
+	if len(keys) == 0 {
+		for _, it := range c.idx.items() {
+			keys = append(keys, it.name)
+		}
+		c.errors.clear()
+	}
+	var n int
+	for _, key := range keys {
+		c.errors.remove(key)
+		if !c.idx.contains(key) {
+			continue
+		}
+		if err := c.remove(key); err != nil {
+			return n, fmt.Errorf("cache %q: cannot remove %q: %s", c.Name, c.entryPath(key), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// PurgeTags removes entries with tags matching the given func
+// and returns the number of removed entries.
+func (c *Cache) PurgeTags(match func(tag string) bool) (int, error) {
+	var n int
+	for _, name := range c.idx.taggedNames(match) {
+		if err := c.remove(name); err != nil {
+			return n, fmt.Errorf("cache %q: cannot remove %q: %s", c.Name, c.entryPath(name), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (c *Cache) get(key *Key) (*entry, error) {
+	name := key.String()
+	fp := c.entryPath(name)
 
 	startTime := time.Now()
 
 again:
-	f, err := os.Open(fp)
+	if e := c.errors.get(name); e != nil {
+		return e, nil
+	}
+	e, err := c.open(name)
 	if err != nil {
 		if !os.IsNotExist(err) {
 			// Unexpected error.
-			return nil, fmt.Errorf("cache %q: cannot open %q: %s", c.Name, fp, err)
+			return nil, err
 		}
 
 		// The entry doesn't exist. Signal the caller that it must
@@ -374,48 +901,52 @@ again:
 		}
 
 		// The entry has been already requested in a concurrent request.
-		if time.Since(startTime) > c.graceTime {
-			// The entry didn't appear during graceTime.
+		wait := c.maxWait - time.Since(startTime)
+		if wait <= 0 {
+			// The entry didn't appear during maxWait.
 			// Let the caller creating it.
 			return nil, ErrMissing
 		}
 
-		// Wait for graceTime in the hope the entry will appear
-		// in the cache.
+		// Wait until the concurrent request stores the entry
+		// in the cache, so the entry is shared among requests.
 		//
 		// This should protect from thundering herd problem when
 		// a single slow query is executed from concurrent requests.
-		d := 100 * time.Millisecond
-		if d > c.graceTime {
-			d = c.graceTime
+		// If the concurrent request fails, then one of waiting
+		// requests fetches the entry.
+		if done := c.pendingEntryDone(fp); done != nil {
+			t := time.NewTimer(wait)
+			select {
+			case <-done:
+			case <-t.C:
+			}
+			t.Stop()
 		}
-		time.Sleep(d)
 		goto again
 	}
 
-	fi, err := f.Stat()
-	if err != nil {
-		f.Close()
-		return nil, fmt.Errorf("cache %q: cannot stat %q: %s", c.Name, fp, err)
-	}
-	mt := fi.ModTime()
-	age := time.Since(mt)
+	age := time.Since(e.modTime)
 	if age > c.expire {
 		if age > c.expire+c.graceTime || c.registerPendingEntry(fp) {
-			f.Close()
+			e.Close()
+			atomic.AddUint64(&c.stats.Expired, 1)
 			return nil, ErrMissing
 		}
 		// Serve expired file in the hope it will be substituted
 		// with the fresh file during graceTime.
 	}
-	return f, nil
+	return e, nil
 }
 
 // ErrMissing is returned when the entry isn't found in the cache.
 var ErrMissing = errors.New("missing cache entry")
 
+// registerPendingEntry returns true if the caller must fetch the entry
+// for the given path. Otherwise the entry is being fetched
+// by a concurrent request.
 func (c *Cache) registerPendingEntry(path string) bool {
-	if c.graceTime <= 0 {
+	if c.maxWait <= 0 {
 		return true
 	}
 
@@ -423,29 +954,47 @@ func (c *Cache) registerPendingEntry(path string) bool {
 	_, exists := c.pendingEntries[path]
 	if !exists {
 		c.pendingEntries[path] = pendingEntry{
-			deadline: time.Now().Add(c.graceTime),
+			deadline: time.Now().Add(c.maxWait),
+			done:     make(chan struct{}),
 		}
 	}
 	c.pendingEntriesLock.Unlock()
 	return !exists
 }
 
+// pendingEntryDone returns the channel, which is closed when
+// the pending entry for the given path is done.
+//
+// nil is returned if there is no such pending entry.
+func (c *Cache) pendingEntryDone(path string) <-chan struct{} {
+	c.pendingEntriesLock.Lock()
+	pe, ok := c.pendingEntries[path]
+	c.pendingEntriesLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return pe.done
+}
+
 func (c *Cache) unregisterPendingEntry(path string) {
-	if c.graceTime <= 0 {
+	if c.maxWait <= 0 {
 		return
 	}
 
 	c.pendingEntriesLock.Lock()
-	delete(c.pendingEntries, path)
+	if pe, ok := c.pendingEntries[path]; ok {
+		close(pe.done)
+		delete(c.pendingEntries, path)
+	}
 	c.pendingEntriesLock.Unlock()
 }
 
 func (c *Cache) pendingEntriesCleaner() {
-	if c.graceTime <= 0 {
+	if c.maxWait <= 0 {
 		return
 	}
 
-	d := c.graceTime
+	d := c.maxWait
 	if d < 100*time.Millisecond {
 		d = 100 * time.Millisecond
 	}
@@ -461,6 +1010,7 @@ func (c *Cache) pendingEntriesCleaner() {
 		c.pendingEntriesLock.Lock()
 		for path, pe := range c.pendingEntries {
 			if currentTime.After(pe.deadline) {
+				close(pe.done)
 				delete(c.pendingEntries, path)
 			}
 		}
@@ -475,12 +1025,15 @@ func (c *Cache) pendingEntriesCleaner() {
 }
 
 func (c *Cache) filepath(key *Key) string {
-	k := key.String()
-	return filepath.Join(c.dir, k)
+	return c.entryPath(key.String())
 }
 
-func (c *Cache) fileInfoPath(fi os.FileInfo) string {
-	return filepath.Join(c.dir, fi.Name())
+// entryPath returns the location of the entry with the given name.
+func (c *Cache) entryPath(name string) string {
+	if c.s3 != nil {
+		return c.s3.objectPath(name)
+	}
+	return filepath.Join(c.dir, name)
 }
 
 // NewResponseWriter wraps rw into cached response writer
@@ -491,15 +1044,16 @@ func (c *Cache) fileInfoPath(fi os.FileInfo) string {
 // Commit or Rollback must be called on the returned response writer
 // after it is no longer needed.
 func (c *Cache) NewResponseWriter(rw http.ResponseWriter, key *Key) (*ResponseWriter, error) {
-	f, err := ioutil.TempFile(c.dir, "tmp")
+	f, err := ioutil.TempFile(c.dir, tmpFilePrefix)
 	if err != nil {
 		return nil, fmt.Errorf("cache %q: cannot create temporary file in %q: %s", c.Name, c.dir, err)
 	}
 	return &ResponseWriter{
 		ResponseWriter: rw,
 
-		key: key,
-		c:   c,
+		key:       key,
+		c:         c,
+		startTime: time.Now(),
 
 		tmpFile: f,
 		bw:      bufio.NewWriter(f),
@@ -516,11 +1070,26 @@ type ResponseWriter struct {
 	headersCaptured bool
 	statusCode      int
 
-	key *Key
-	c   *Cache
+	key       *Key
+	c         *Cache
+	startTime time.Time
 
 	tmpFile *os.File      // temporary file for response streaming
 	bw      *bufio.Writer // buffered writer for the temporary file
+
+	// size is the size of the response body written so far.
+	size int64
+
+	// passthrough is set when the response exceeds `max_payload_size`.
+	// The response is written directly to the wrapped response writer then.
+	passthrough bool
+
+	// tail contains the last written bytes if `detect_stream_exceptions`
+	// is enabled.
+	tail []byte
+
+	// tags are attached to the stored response.
+	tags []string
 }
 
 func (rw *ResponseWriter) captureHeaders() error {
@@ -557,6 +1126,12 @@ func (rw *ResponseWriter) WriteHeader(statusCode int) {
 	// It will be called explicitly in Commit / Rollback.
 }
 
+// SetTags sets tags for the response, so it may be purged
+// via PurgeTags after it is stored.
+func (rw *ResponseWriter) SetTags(tags []string) {
+	rw.tags = tags
+}
+
 // StatusCode returns captured status code from WriteHeader.
 func (rw *ResponseWriter) StatusCode() int {
 	if rw.statusCode == 0 {
@@ -567,15 +1142,119 @@ func (rw *ResponseWriter) StatusCode() int {
 
 // Write writes b into rw.
 func (rw *ResponseWriter) Write(b []byte) (int, error) {
+	if rw.passthrough {
+		return rw.ResponseWriter.Write(b)
+	}
 	if err := rw.captureHeaders(); err != nil {
 		return 0, err
 	}
-	return rw.bw.Write(b)
+	if max := rw.c.maxPayloadSize; max > 0 && rw.size+int64(len(b)) > max && rw.StatusCode() == http.StatusOK {
+		// The response is too big for caching, so stop buffering it.
+		if err := rw.startPassthrough(); err != nil {
+			return 0, err
+		}
+		return rw.ResponseWriter.Write(b)
+	}
+	n, err := rw.bw.Write(b)
+	rw.size += int64(n)
+	if rw.c.detectStreamExceptions {
+		rw.tail = appendTail(rw.tail, b[:n])
+	}
+	return n, err
+}
+
+// startPassthrough sends the buffered part of the response
+// to the wrapped response writer and drops the temporary file,
+// so the rest of the response is written directly.
+func (rw *ResponseWriter) startPassthrough() error {
+	fp := rw.c.filepath(rw.key)
+	defer rw.c.unregisterPendingEntry(fp)
+	fn := rw.tmpFile.Name()
+	defer func() {
+		rw.tmpFile.Close()
+		os.Remove(fn)
+	}()
+
+	log.Debugf("cache %q: response for %q exceeds `max_payload_size` %d; it won't be cached", rw.c.Name, fp, rw.c.maxPayloadSize)
+	rw.passthrough = true
+	if err := rw.bw.Flush(); err != nil {
+		return fmt.Errorf("cache %q: cannot flush data into %q: %s", rw.c.Name, fn, err)
+	}
+	if _, err := rw.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cache %q: cannot seek to the beginning of %q: %s", rw.c.Name, fn, err)
+	}
+	h := rw.Header()
+	for _, k := range []string{"Content-Type", "Content-Encoding"} {
+		v, err := readHeader(rw.tmpFile)
+		if err != nil {
+			return fmt.Errorf("cache %q: cannot read %s from %q: %s", rw.c.Name, k, fn, err)
+		}
+		if len(v) > 0 {
+			h.Set(k, v)
+		}
+	}
+	rw.ResponseWriter.WriteHeader(rw.StatusCode())
+	if _, err := io.Copy(rw.ResponseWriter, rw.tmpFile); err != nil {
+		return fmt.Errorf("cache %q: cannot send %q to client: %s", rw.c.Name, fn, err)
+	}
+	return nil
+}
+
+// streamException returns the code of ClickHouse exception written
+// at the end of successful response if `detect_stream_exceptions` is enabled.
+//
+// Compressed responses aren't checked.
+func (rw *ResponseWriter) streamException() (string, bool) {
+	if !rw.c.detectStreamExceptions || rw.StatusCode() != http.StatusOK {
+		return "", false
+	}
+	if len(rw.Header().Get("Content-Encoding")) > 0 {
+		return "", false
+	}
+	return findStreamException(rw.tail)
+}
+
+// shouldStore returns false if the response mustn't be cached
+// due to `min_payload_size` or `min_query_duration`.
+func (rw *ResponseWriter) shouldStore() bool {
+	if min := rw.c.minPayloadSize; min > 0 && rw.size < min {
+		log.Debugf("cache %q: response size %d is smaller than `min_payload_size` %d; it won't be cached", rw.c.Name, rw.size, min)
+		return false
+	}
+	if min := rw.c.minQueryDuration; min > 0 {
+		if d := time.Since(rw.startTime); d < min {
+			log.Debugf("cache %q: response is fetched in %s, which is faster than `min_query_duration` %s; it won't be cached", rw.c.Name, d, min)
+			return false
+		}
+	}
+	return true
 }
 
 // Commit stores the response to the cache and writes it
 // to the wrapped response writer.
+//
+// The response isn't stored if it doesn't satisfy `min_payload_size`,
+// `max_payload_size` or `min_query_duration` of the cache.
+// The response ending with ClickHouse exception is sent with 500 status code
+// if `detect_stream_exceptions` is enabled.
 func (rw *ResponseWriter) Commit() error {
+	if rw.passthrough {
+		// The response has been already sent.
+		return nil
+	}
+	if code, ok := rw.streamException(); ok {
+		// ClickHouse failed after the response status has been sent.
+		// Do not cache the truncated response and do not send it
+		// as successful.
+		log.Errorf("cache %q: response for %q contains ClickHouse exception with code %s; it won't be cached",
+			rw.c.Name, rw.c.filepath(rw.key), code)
+		rw.Header().Set(exceptionCodeHeader, code)
+		rw.statusCode = http.StatusInternalServerError
+		return rw.Rollback()
+	}
+	if !rw.shouldStore() {
+		return rw.Rollback()
+	}
 	fp := rw.c.filepath(rw.key)
 	defer rw.c.unregisterPendingEntry(fp)
 	fn := rw.tmpFile.Name()
@@ -592,15 +1271,21 @@ func (rw *ResponseWriter) Commit() error {
 		return fmt.Errorf("cache %q: cannot flush data into %q: %s", rw.c.Name, fn, err)
 	}
 
-	// Update cache stats.
 	fi, err := rw.tmpFile.Stat()
 	if err != nil {
 		os.Remove(fn)
 		return fmt.Errorf("cache %q: cannot stat %q: %s", rw.c.Name, fn, err)
 	}
-	fs := uint64(fi.Size())
-	atomic.AddUint64(&rw.c.stats.Size, fs)
-	atomic.AddUint64(&rw.c.stats.Items, 1)
+
+	if rw.c.s3 != nil {
+		return rw.commitS3(fi.Size())
+	}
+
+	if err := rw.c.syncFile(rw.tmpFile); err != nil {
+		rw.tmpFile.Close()
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: cannot sync %q: %s", rw.c.Name, fn, err)
+	}
 
 	if err := rw.tmpFile.Close(); err != nil {
 		os.Remove(fn)
@@ -608,15 +1293,58 @@ func (rw *ResponseWriter) Commit() error {
 	}
 
 	if err := os.Rename(fn, fp); err != nil {
+		os.Remove(fn)
 		return fmt.Errorf("cache %q: cannot rename %q to %q: %s", rw.c.Name, fn, fp, err)
 	}
+	if err := rw.c.syncDir(); err != nil {
+		log.Errorf("cache %q: cannot sync %q: %s", rw.c.Name, rw.c.dir, err)
+	}
+	rw.c.mem.remove(rw.key.String())
+	rw.c.errors.remove(rw.key.String())
+	rw.c.idx.add(rw.key.String(), fi.Size(), fi.ModTime(), rw.tags)
 
 	return rw.c.writeTo(rw.ResponseWriter, rw.key, rw.StatusCode())
 }
 
+// commitS3 uploads the response from the temporary file to S3
+// and sends it to the wrapped response writer from the file,
+// so it isn't downloaded back.
+//
+// The response is sent even if it cannot be uploaded.
+func (rw *ResponseWriter) commitS3(size int64) error {
+	fn := rw.tmpFile.Name()
+	defer func() {
+		rw.tmpFile.Close()
+		os.Remove(fn)
+	}()
+
+	if err := rw.c.s3.put(rw.key.String(), rw.tmpFile, size); err != nil {
+		log.Errorf("cache %q: cannot store %q: %s", rw.c.Name, rw.c.filepath(rw.key), err)
+	} else {
+		rw.c.idx.add(rw.key.String(), size, time.Now(), rw.tags)
+	}
+	rw.c.mem.remove(rw.key.String())
+	rw.c.errors.remove(rw.key.String())
+
+	if _, err := rw.tmpFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("cache %q: cannot seek to the beginning of %q: %s", rw.c.Name, fn, err)
+	}
+	e, err := newFileEntry(rw.tmpFile)
+	if err != nil {
+		return fmt.Errorf("cache %q: %s", rw.c.Name, err)
+	}
+	if err := sendResponse(rw.ResponseWriter, e, rw.c.expire, rw.StatusCode()); err != nil {
+		return fmt.Errorf("cache %q: %s", rw.c.Name, err)
+	}
+	return nil
+}
+
 // Rollback writes the response to the wrapped response writer and discards
 // it from the cache.
 func (rw *ResponseWriter) Rollback() error {
+	if rw.passthrough {
+		return nil
+	}
 	fp := rw.c.filepath(rw.key)
 	defer rw.c.unregisterPendingEntry(fp)
 	fn := rw.tmpFile.Name()
@@ -639,7 +1367,25 @@ func (rw *ResponseWriter) Rollback() error {
 		return fmt.Errorf("cache %q: cannot seek to the beginning of %q: %s", rw.c.Name, fn, err)
 	}
 
-	if err := sendResponseFromFile(rw.ResponseWriter, rw.tmpFile, 0, rw.StatusCode()); err != nil {
+	e, err := newFileEntry(rw.tmpFile)
+	if err != nil {
+		rw.tmpFile.Close()
+		os.Remove(fn)
+		return fmt.Errorf("cache %q: %s", rw.c.Name, err)
+	}
+	if rw.c.errors.cacheable(rw.StatusCode(), rw.Header(), e.size) {
+		// Keep the deterministic error in memory, so the failing query
+		// isn't sent to ClickHouse during `error_ttl`.
+		data, err := ioutil.ReadAll(e)
+		if err != nil {
+			rw.tmpFile.Close()
+			os.Remove(fn)
+			return fmt.Errorf("cache %q: cannot read %q: %s", rw.c.Name, fn, err)
+		}
+		rw.c.errors.put(rw.key.String(), data, rw.StatusCode(), rw.Header().Get(exceptionCodeHeader))
+		e.ReadCloser = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	if err := sendResponse(rw.ResponseWriter, e, 0, rw.StatusCode()); err != nil {
 		rw.tmpFile.Close()
 		os.Remove(fn)
 		return fmt.Errorf("cache %q: %s", rw.c.Name, err)
@@ -655,45 +1401,52 @@ func (rw *ResponseWriter) Rollback() error {
 	return nil
 }
 
-// sendResponseFromFile sends response to rw from f.
+// Discard discards the response without writing it
+// to the wrapped response writer.
+func (rw *ResponseWriter) Discard() error {
+	if rw.passthrough {
+		return nil
+	}
+	fp := rw.c.filepath(rw.key)
+	defer rw.c.unregisterPendingEntry(fp)
+	fn := rw.tmpFile.Name()
+
+	rw.tmpFile.Close()
+	if err := os.Remove(fn); err != nil {
+		return fmt.Errorf("cache %q: cannot remove %q: %s", rw.c.Name, fn, err)
+	}
+	return nil
+}
+
+// sendResponse sends response to rw from e.
 //
 // Sets 'Cache-Control: max-age' header if expire > 0.
 // Sets the given response status code.
-func sendResponseFromFile(rw http.ResponseWriter, f *os.File, expire time.Duration, statusCode int) error {
+func sendResponse(rw http.ResponseWriter, e *entry, expire time.Duration, statusCode int) error {
 	h := rw.Header()
 
-	ct, err := readHeader(f)
+	ct, err := readHeader(e)
 	if err != nil {
-		return fmt.Errorf("cannot read Content-Type from %q: %s", f.Name(), err)
+		return fmt.Errorf("cannot read Content-Type from %q: %s", e.name, err)
 	}
 	if len(ct) > 0 {
 		h.Set("Content-Type", ct)
 	}
-	ce, err := readHeader(f)
+	ce, err := readHeader(e)
 	if err != nil {
-		return fmt.Errorf("cannot read Content-Encoding from %q: %s", f.Name(), err)
+		return fmt.Errorf("cannot read Content-Encoding from %q: %s", e.name, err)
 	}
 	if len(ce) > 0 {
 		h.Set("Content-Encoding", ce)
 	}
 
 	// Determine Content-Length
-	off, err := f.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return fmt.Errorf("cannot determine the current position in %q: %s", f.Name(), err)
-	}
-	fi, err := f.Stat()
-	if err != nil {
-		return fmt.Errorf("cannot stat %q: %s", f.Name(), err)
-	}
-	fs := fi.Size()
-	cl := fs - off
+	cl := e.size - int64(len(ct)+len(ce)+8)
 	h.Set("Content-Length", fmt.Sprintf("%d", cl))
 
 	// Set 'Cache-Control: max-age' on non-temporary file
 	if expire > 0 {
-		mt := fi.ModTime()
-		age := time.Since(mt)
+		age := time.Since(e.modTime)
 		left := expire - age
 		if left > 0 {
 			leftSeconds := uint(left / time.Second)
@@ -702,8 +1455,8 @@ func sendResponseFromFile(rw http.ResponseWriter, f *os.File, expire time.Durati
 	}
 
 	rw.WriteHeader(statusCode)
-	if _, err := io.Copy(rw, f); err != nil {
-		return fmt.Errorf("cannot send %q to client: %s", f.Name(), err)
+	if _, err := io.Copy(rw, e); err != nil {
+		return fmt.Errorf("cannot send %q to client: %s", e.name, err)
 	}
 	return nil
 }
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -95,6 +97,42 @@ func TestKeyString(t *testing.T) {
 			},
 			expected: "0e043f23ccd1b9039b33623b3b7c114a",
 		},
+		{
+			key: &Key{
+				Query:          []byte("SELECT 1 FROM system.numbers LIMIT 10"),
+				AcceptEncoding: "gzip",
+				DefaultFormat:  "JSON",
+				Database:       "foobar",
+				Compress:       "1",
+				Namespace:      "ns123",
+				QuotaKey:       "customer1",
+			},
+			expected: "e28b23033f1eaf7bdf012b591147f33c",
+		},
+		{
+			key: &Key{
+				Query:          []byte("SELECT 1 FROM system.numbers LIMIT 10"),
+				AcceptEncoding: "gzip",
+				DefaultFormat:  "JSON",
+				Database:       "foobar",
+				Compress:       "1",
+				Namespace:      "ns123",
+				Extra:          "shard1",
+			},
+			expected: "32571fd6d2e0596b8a691ef57f644aa2",
+		},
+		{
+			key: &Key{
+				Query:           []byte("SELECT 1 FROM system.numbers LIMIT 10"),
+				AcceptEncoding:  "gzip",
+				DefaultFormat:   "JSON",
+				Database:        "foobar",
+				Compress:        "1",
+				Namespace:       "ns123",
+				CredentialsHash: "c0ffee",
+			},
+			expected: "218a74eedd018d0989bf5de00da77004",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -327,6 +365,97 @@ func TestPendingEntries(t *testing.T) {
 	}
 }
 
+func TestConcurrentFetch(t *testing.T) {
+	if err := os.RemoveAll(testDir + "/concurrent"); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:                      "concurrent",
+		Dir:                       testDir + "/concurrent",
+		MaxSize:                   1e6,
+		Expire:                    config.Duration(time.Minute),
+		GraceTime:                 config.Duration(-1),
+		MaxWaitForConcurrentFetch: config.Duration(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT concurrent fetch"),
+	}
+	value := "value for concurrent fetch"
+
+	// The first request fetches the entry.
+	if err := c.WriteTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	const waiters = 5
+	ch := make(chan error, waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			trw := &testResponseWriter{}
+			if err := c.WriteTo(trw, key); err != nil {
+				ch <- fmt.Errorf("error in WriteTo: %s", err)
+				return
+			}
+			if string(trw.b) != value {
+				ch <- fmt.Errorf("unexpected response sent to client: %q; expecting %q", trw.b, value)
+				return
+			}
+			ch <- nil
+		}()
+	}
+	select {
+	case err := <-ch:
+		t.Fatalf("the waiting request prematurely finished and returned err: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The failed fetch wakes up a single waiting request,
+	// which fetches the entry instead.
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if err := crw.Rollback(); err != nil {
+		t.Fatalf("cannot rollback response: %s", err)
+	}
+	select {
+	case err := <-ch:
+		if err == nil {
+			t.Fatalf("expecting error for the request fetching the entry")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the waiting request must be woken up")
+	}
+
+	// The stored entry is shared among the rest of waiting requests
+	// without waiting for max_wait_for_concurrent_fetch.
+	crw, err = c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, value); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+	for i := 0; i < waiters-1; i++ {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the waiting request must get the stored entry")
+		}
+	}
+}
+
 func TestCacheRollback(t *testing.T) {
 	c := newTestCache(t)
 	defer c.Close()
@@ -372,6 +501,152 @@ func TestCacheRollback(t *testing.T) {
 	}
 }
 
+func TestCacheWriteStaleTo(t *testing.T) {
+	c, err := New(config.Cache{
+		Name:         "stale",
+		Dir:          testDir + "/stale",
+		MaxSize:      1e6,
+		Expire:       config.Duration(time.Minute),
+		GraceTime:    config.Duration(-1),
+		StaleIfError: config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT 1 stale entry"),
+	}
+	trw := &testResponseWriter{}
+	if err := c.WriteStaleTo(trw, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "stale value"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+
+	// Expire the entry.
+	fp := c.filepath(key)
+	mt := time.Now().Add(-10 * time.Minute)
+	if err := os.Chtimes(fp, mt, mt); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	// The failed response must be discarded.
+	crw, err = c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "error"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Discard(); err != nil {
+		t.Fatalf("cannot discard response: %s", err)
+	}
+
+	if err := c.WriteStaleTo(trw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "stale value" {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, "stale value")
+	}
+
+	// The entry is too old for serving on errors.
+	mt = time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(fp, mt, mt); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.WriteStaleTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
+
+func TestCacheReadStoreEntry(t *testing.T) {
+	c := newTestCache(t)
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT 1 cache entry transfer"),
+	}
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	crw.Header().Set("Content-Type", "text/plain")
+	if _, err := io.WriteString(crw, "transferred value"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+
+	entry, modTime, err := c.ReadEntry(key.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer entry.Close()
+
+	c1, err := New(config.Cache{
+		Name:    "peer",
+		Dir:     testDir + "/peer",
+		MaxSize: 1e6,
+		Expire:  config.Duration(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	if err := c1.StoreEntry(key.String(), entry, modTime); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, storedModTime, err := c1.ReadEntry(key.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !storedModTime.Equal(modTime) {
+		t.Fatalf("unexpected modification time: %s; expecting %s", storedModTime, modTime)
+	}
+	expiredKey := &Key{
+		Query: []byte("SELECT 1 expired entry"),
+	}
+	if err := c1.StoreEntry(expiredKey.String(), strings.NewReader("foobar"), time.Now().Add(-time.Hour)); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	trw := &testResponseWriter{}
+	if err := c1.WriteTo(trw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "transferred value" {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, "transferred value")
+	}
+	if ct := trw.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("unexpected Content-Type: %q; expecting %q", ct, "text/plain")
+	}
+
+	missingKey := &Key{
+		Query: []byte("SELECT 1 missing entry"),
+	}
+	if _, _, err := c1.ReadEntry(missingKey.String()); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	if _, _, err := c1.ReadEntry("../foobar"); err == nil {
+		t.Fatalf("expecting error for invalid key")
+	}
+}
+
 func TestCacheClean(t *testing.T) {
 	cfg := config.Cache{
 		Name:    "foobar",
@@ -424,11 +699,311 @@ func TestCacheClean(t *testing.T) {
 	if stats.Items > 1000 {
 		t.Fatalf("cache items %d cannot exceed %d", stats.Items, 1000)
 	}
+	if stats.Evictions == 0 || stats.Evictions+stats.Items < 1000 {
+		t.Fatalf("unexpected evictions: %d; expecting at least %d", stats.Evictions, 1000-stats.Items)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	if err := os.RemoveAll(testDir + "/stats"); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:         "stats",
+		Dir:          testDir + "/stats",
+		MaxSize:      1e6,
+		Expire:       config.Duration(time.Minute),
+		GraceTime:    config.Duration(-1),
+		StaleIfError: config.Duration(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	put := func(key *Key, age time.Duration) {
+		t.Helper()
+		crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+		if err != nil {
+			t.Fatalf("cannot create response writer: %s", err)
+		}
+		if _, err := io.WriteString(crw, "value"); err != nil {
+			t.Fatalf("cannot send response to cache: %s", err)
+		}
+		if err := crw.Commit(); err != nil {
+			t.Fatalf("cannot commit response to cache: %s", err)
+		}
+		mt := time.Now().Add(-age)
+		if err := os.Chtimes(c.filepath(key), mt, mt); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	fresh := &Key{
+		Query: []byte("SELECT fresh stats"),
+	}
+	expired := &Key{
+		Query: []byte("SELECT expired stats"),
+	}
+	if err := c.WriteTo(&testResponseWriter{}, fresh); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	put(fresh, 30*time.Second)
+	put(expired, 10*time.Minute)
+	if err := c.WriteTo(&testResponseWriter{}, fresh); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, expired); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	if err := c.WriteStaleTo(&testResponseWriter{}, expired); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.clean()
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Expired != 1 || stats.Stale != 1 || stats.Evictions != 0 {
+		t.Fatalf("unexpected stats: %+v; expecting 1 hit, 2 misses, 1 expired, 1 stale and no evictions", stats)
+	}
+	if stats.Items != 2 || stats.MaxSize != 1e6 {
+		t.Fatalf("unexpected stats: %+v; expecting 2 items and max size 1e6", stats)
+	}
+	if stats.OldestItemAge < 10*time.Minute || stats.OldestItemAge > 11*time.Minute {
+		t.Fatalf("unexpected oldest item age: %s; expecting 10m", stats.OldestItemAge)
+	}
+}
+
+func TestCachePayloadLimits(t *testing.T) {
+	dir := testDir + "/payload"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:           "payload",
+		Dir:            dir,
+		MaxSize:        1e6,
+		Expire:         config.Duration(time.Minute),
+		MinPayloadSize: 5,
+		MaxPayloadSize: 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f := func(query string, chunks []string, expectedCached bool) {
+		t.Helper()
+		key := &Key{
+			Query: []byte(query),
+		}
+		trw := &testResponseWriter{}
+		crw, err := c.NewResponseWriter(trw, key)
+		if err != nil {
+			t.Fatalf("cannot create response writer: %s", err)
+		}
+		crw.Header().Set("Content-Type", "text/plain")
+		for _, chunk := range chunks {
+			if _, err := io.WriteString(crw, chunk); err != nil {
+				t.Fatalf("cannot send response to cache: %s", err)
+			}
+		}
+		if err := crw.Commit(); err != nil {
+			t.Fatalf("cannot commit response to cache: %s", err)
+		}
+		expected := strings.Join(chunks, "")
+		if string(trw.b) != expected {
+			t.Fatalf("unexpected response: %q; expecting %q", trw.b, expected)
+		}
+		if ct := trw.Header().Get("Content-Type"); ct != "text/plain" {
+			t.Fatalf("unexpected Content-Type: %q; expecting %q", ct, "text/plain")
+		}
+		err = c.WriteTo(&testResponseWriter{}, key)
+		if expectedCached && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !expectedCached && err != ErrMissing {
+			t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+		}
+	}
+
+	f("SELECT tiny", []string{"abc"}, false)
+	f("SELECT medium", []string{"0123456789", "01234"}, true)
+	f("SELECT huge", []string{"0123456789", "0123456789", "0123456789"}, false)
+
+	// Temporary files of streamed responses must be removed.
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read cache dir: %s", err)
+	}
+	if len(fis) != 1 {
+		t.Fatalf("unexpected number of files in the cache dir: %d; expecting 1", len(fis))
+	}
+}
+
+func TestCacheTempFiles(t *testing.T) {
+	dir := testDir + "/tmpfiles"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("cannot create cache dir: %s", err)
+	}
+	// Simulate temporary files left by a crashed process.
+	for _, name := range []string{"tmp123", "tmp456", indexFilename + ".tmp"} {
+		if err := ioutil.WriteFile(dir+"/"+name, make([]byte, 100), 0600); err != nil {
+			t.Fatalf("cannot create temporary file: %s", err)
+		}
+	}
+	cfg := config.Cache{
+		Name:      "tmpfiles",
+		Dir:       dir,
+		MaxSize:   1e6,
+		Expire:    config.Duration(time.Minute),
+		GraceTime: config.Duration(-1),
+		Fsync:     true,
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+	if n := c.Stats().ReclaimedTempBytes; n != 300 {
+		t.Fatalf("unexpected reclaimed bytes: %d; expecting 300", n)
+	}
+
+	key := &Key{
+		Query: []byte("SELECT synced"),
+	}
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "value"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+
+	// Temporary files of caches sharing the dir mustn't be removed
+	// during config reload.
+	c2, err := New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	c2.Close()
+	if n := c2.Stats().ReclaimedTempBytes; n != 0 {
+		t.Fatalf("unexpected reclaimed bytes: %d; expecting 0", n)
+	}
+
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("cannot read cache dir: %s", err)
+	}
+	for _, fi := range fis {
+		if isTempFile(fi.Name()) {
+			t.Fatalf("unexpected temporary file %q", fi.Name())
+		}
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	dir := testDir + "/purge"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:      "purge",
+		Dir:       dir,
+		MaxSize:   1e6,
+		Expire:    config.Duration(time.Minute),
+		GraceTime: config.Duration(-1),
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+
+	keys := make([]*Key, 3)
+	for i := range keys {
+		keys[i] = &Key{
+			Query: []byte(fmt.Sprintf("SELECT %d", i)),
+		}
+		storeTestEntry(t, c, keys[i], "value")
+	}
+
+	if _, err := c.Purge("../foo"); err == nil {
+		t.Fatalf("expecting error for invalid key")
+	}
+	n, err := c.Purge(keys[0].String(), keys[0].String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of purged entries: %d; expecting 1", n)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, keys[0]); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, keys[1]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if n, err = c.Purge(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of purged entries: %d; expecting 2", n)
+	}
+	if items := c.Stats().Items; items != 0 {
+		t.Fatalf("unexpected number of items after purge: %d", items)
+	}
+}
+
+func TestCacheMinQueryDuration(t *testing.T) {
+	c, err := New(config.Cache{
+		Name:             "duration",
+		Dir:              testDir + "/duration",
+		MaxSize:          1e6,
+		Expire:           config.Duration(time.Minute),
+		MinQueryDuration: config.Duration(50 * time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f := func(query string, d time.Duration, expectedErr error) {
+		t.Helper()
+		key := &Key{
+			Query: []byte(query),
+		}
+		crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+		if err != nil {
+			t.Fatalf("cannot create response writer: %s", err)
+		}
+		time.Sleep(d)
+		if _, err := io.WriteString(crw, "value"); err != nil {
+			t.Fatalf("cannot send response to cache: %s", err)
+		}
+		if err := crw.Commit(); err != nil {
+			t.Fatalf("cannot commit response to cache: %s", err)
+		}
+		if err := c.WriteTo(&testResponseWriter{}, key); err != expectedErr {
+			t.Fatalf("unexpected error: %v; expecting %v", err, expectedErr)
+		}
+	}
+	f("SELECT instant", 0, ErrMissing)
+	f("SELECT slow", 60*time.Millisecond, nil)
 }
 
 type testResponseWriter struct {
-	h http.Header
-	b []byte
+	h          http.Header
+	b          []byte
+	statusCode int
 }
 
 func (trw *testResponseWriter) Write(p []byte) (int, error) {
@@ -443,7 +1018,9 @@ func (trw *testResponseWriter) Header() http.Header {
 	return trw.h
 }
 
-func (trw *testResponseWriter) WriteHeader(statusCode int) {}
+func (trw *testResponseWriter) WriteHeader(statusCode int) {
+	trw.statusCode = statusCode
+}
 
 func newTestCache(t *testing.T) *Cache {
 	t.Helper()
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// exceptionCodeHeader contains ClickHouse exception code of failed responses.
+const exceptionCodeHeader = "X-ClickHouse-Exception-Code"
+
+// maxErrorItems limits the number of error responses kept in memory.
+const maxErrorItems = 10000
+
+// maxErrorItemSize limits the size of a single error response kept in memory.
+const maxErrorItemSize = 64 * 1024
+
+// errorCache keeps responses with deterministic ClickHouse errors
+// such as syntax errors or missing tables for a short ttl,
+// so a failing query isn't repeatedly sent to ClickHouse.
+type errorCache struct {
+	ttl   time.Duration
+	codes map[string]bool
+
+	lock  sync.Mutex
+	items map[string]*errorItem
+}
+
+type errorItem struct {
+	// data has the same format as cache files.
+	data []byte
+
+	statusCode int
+	code       string
+	modTime    time.Time
+}
+
+// newErrorCache returns nil if errors mustn't be cached.
+func newErrorCache(ttl time.Duration, codes []int) *errorCache {
+	if ttl <= 0 {
+		return nil
+	}
+	ec := &errorCache{
+		ttl:   ttl,
+		codes: make(map[string]bool, len(codes)),
+		items: make(map[string]*errorItem),
+	}
+	for _, code := range codes {
+		ec.codes[strconv.Itoa(code)] = true
+	}
+	return ec
+}
+
+// cacheable returns true if the response with the given status code
+// and headers may be cached.
+func (ec *errorCache) cacheable(statusCode int, h http.Header, size int64) bool {
+	if ec == nil || statusCode == http.StatusOK || size > maxErrorItemSize {
+		return false
+	}
+	return ec.codes[h.Get(exceptionCodeHeader)]
+}
+
+// get returns the error response with the given name
+// if it isn't expired yet.
+func (ec *errorCache) get(name string) *entry {
+	if ec == nil {
+		return nil
+	}
+	ec.lock.Lock()
+	it, ok := ec.items[name]
+	if ok && time.Since(it.modTime) > ec.ttl {
+		delete(ec.items, name)
+		ok = false
+	}
+	ec.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	h := make(http.Header)
+	h.Set(exceptionCodeHeader, it.code)
+	return &entry{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(it.data)),
+		name:       "error:" + name,
+		size:       int64(len(it.data)),
+		modTime:    it.modTime,
+		statusCode: it.statusCode,
+		header:     h,
+	}
+}
+
+// put keeps the error response with the given name for ttl.
+//
+// The response isn't kept if there are too many error responses.
+func (ec *errorCache) put(name string, data []byte, statusCode int, code string) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	if len(ec.items) >= maxErrorItems {
+		ec.removeExpiredLocked()
+		if len(ec.items) >= maxErrorItems {
+			return
+		}
+	}
+	ec.items[name] = &errorItem{
+		data:       data,
+		statusCode: statusCode,
+		code:       code,
+		modTime:    time.Now(),
+	}
+}
+
+// remove drops the error response with the given name.
+func (ec *errorCache) remove(name string) {
+	if ec == nil {
+		return
+	}
+	ec.lock.Lock()
+	delete(ec.items, name)
+	ec.lock.Unlock()
+}
+
+// clear drops all the error responses.
+func (ec *errorCache) clear() {
+	if ec == nil {
+		return
+	}
+	ec.lock.Lock()
+	ec.items = make(map[string]*errorItem)
+	ec.lock.Unlock()
+}
+
+// removeExpired drops all the expired error responses.
+func (ec *errorCache) removeExpired() {
+	if ec == nil {
+		return
+	}
+	ec.lock.Lock()
+	ec.removeExpiredLocked()
+	ec.lock.Unlock()
+}
+
+func (ec *errorCache) removeExpiredLocked() {
+	for name, it := range ec.items {
+		if time.Since(it.modTime) > ec.ttl {
+			delete(ec.items, name)
+		}
+	}
+}
+
+// streamExceptionTailSize is the number of the last response bytes
+// checked for ClickHouse exceptions.
+const streamExceptionTailSize = 16 * 1024
+
+// streamExceptionMarker wraps exceptions written in the middle of streaming
+// by newer ClickHouse versions.
+var streamExceptionMarker = []byte("__exception__")
+
+var streamExceptionRegexp = regexp.MustCompile(`Code: (\d+)\. DB::Exception:`)
+
+// appendTail appends b to tail, so tail contains
+// at least streamExceptionTailSize last bytes of the response.
+func appendTail(tail, b []byte) []byte {
+	if len(b) >= streamExceptionTailSize {
+		return append(tail[:0], b[len(b)-streamExceptionTailSize:]...)
+	}
+	tail = append(tail, b...)
+	if len(tail) > 2*streamExceptionTailSize {
+		// Shift the tail instead of growing it.
+		tail = append(tail[:0], tail[len(tail)-streamExceptionTailSize:]...)
+	}
+	return tail
+}
+
+// findStreamException returns the code of ClickHouse exception
+// at the end of the response.
+//
+// ClickHouse writes the exception into the response body if the query
+// fails after the response status has been sent.
+func findStreamException(tail []byte) (string, bool) {
+	tail = bytes.TrimRight(tail, " \t\r\n")
+	ms := streamExceptionRegexp.FindAllSubmatchIndex(tail, -1)
+	if len(ms) == 0 {
+		return "", false
+	}
+	m := ms[len(ms)-1]
+	code := string(tail[m[2]:m[3]])
+	if bytes.HasSuffix(tail, streamExceptionMarker) {
+		return code, true
+	}
+	// The exception must be on the last line, which may be followed
+	// only by closing brackets in JSON formats.
+	rest := tail[m[1]:]
+	n := bytes.IndexByte(rest, '\n')
+	if n < 0 {
+		return code, true
+	}
+	if len(bytes.Trim(rest[n:], " \t\r\n}]")) > 0 {
+		return "", false
+	}
+	return code, true
+}
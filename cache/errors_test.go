@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCacheErrors(t *testing.T) {
+	if err := os.RemoveAll(testDir + "/errors"); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:             "errors",
+		Dir:              testDir + "/errors",
+		MaxSize:          1e6,
+		Expire:           config.Duration(time.Hour),
+		GraceTime:        config.Duration(-1),
+		ErrorTTL:         config.Duration(time.Minute),
+		CachedErrorCodes: []int{62},
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+
+	fail := func(key *Key, code string) {
+		t.Helper()
+		trw := &testResponseWriter{}
+		crw, err := c.NewResponseWriter(trw, key)
+		if err != nil {
+			t.Fatalf("cannot create response writer: %s", err)
+		}
+		crw.Header().Set("X-ClickHouse-Exception-Code", code)
+		crw.WriteHeader(http.StatusBadRequest)
+		if _, err := io.WriteString(crw, "Code: "+code+". DB::Exception"); err != nil {
+			t.Fatalf("cannot send response to cache: %s", err)
+		}
+		if err := crw.Rollback(); err != nil {
+			t.Fatalf("cannot rollback response: %s", err)
+		}
+		if trw.statusCode != http.StatusBadRequest {
+			t.Fatalf("unexpected status code: %d; expecting %d", trw.statusCode, http.StatusBadRequest)
+		}
+	}
+
+	syntaxErr := &Key{
+		Query: []byte("SELECT FROM"),
+	}
+	fail(syntaxErr, "62")
+	trw := &testResponseWriter{}
+	if err := c.WriteTo(trw, syntaxErr); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "Code: 62. DB::Exception" || trw.statusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected cached error: %d %q", trw.statusCode, trw.b)
+	}
+	if code := trw.Header().Get("X-ClickHouse-Exception-Code"); code != "62" {
+		t.Fatalf("unexpected exception code: %q; expecting %q", code, "62")
+	}
+
+	// Errors with other codes aren't cached.
+	timeoutErr := &Key{
+		Query: []byte("SELECT sleep"),
+	}
+	fail(timeoutErr, "159")
+	if err := c.WriteTo(&testResponseWriter{}, timeoutErr); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	// Expired errors aren't served.
+	c.errors.lock.Lock()
+	c.errors.items[syntaxErr.String()].modTime = time.Now().Add(-2 * time.Minute)
+	c.errors.lock.Unlock()
+	if err := c.WriteTo(&testResponseWriter{}, syntaxErr); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	// Successful responses substitute cached errors.
+	fail(syntaxErr, "62")
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, syntaxErr)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "fixed"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+	trw = &testResponseWriter{}
+	if err := c.WriteTo(trw, syntaxErr); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "fixed" {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, "fixed")
+	}
+}
+
+func TestFindStreamException(t *testing.T) {
+	f := func(tail, expectedCode string, expectedOK bool) {
+		t.Helper()
+		code, ok := findStreamException([]byte(tail))
+		if code != expectedCode || ok != expectedOK {
+			t.Fatalf("unexpected result for %q: %q, %v; expecting %q, %v", tail, code, ok, expectedCode, expectedOK)
+		}
+	}
+	f("1\t2\n3\t4\n", "", false)
+	f("1\t2\n3\tCode: 241. DB::Exception: Memory limit exceeded\n", "241", true)
+	f("1\t2\nCode: 241. DB::Exception: Memory limit exceeded (version 23.8)\n", "241", true)
+	f("{\"data\": [\n\t],\n\t\"exception\": \"Code: 159. DB::Exception: Timeout exceeded\"\n}\n", "159", true)
+	f("1\nCode: 241. DB::Exception: x\n__exception__\n", "241", true)
+	f("Code: 62. DB::Exception: Syntax error\n2\n3\n", "", false)
+}
+
+func TestCacheStreamException(t *testing.T) {
+	if err := os.RemoveAll(testDir + "/stream-exceptions"); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	c, err := New(config.Cache{
+		Name:                   "stream-exceptions",
+		Dir:                    testDir + "/stream-exceptions",
+		MaxSize:                1e6,
+		Expire:                 config.Duration(time.Hour),
+		GraceTime:              config.Duration(-1),
+		DetectStreamExceptions: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT number FROM numbers(1e10)"),
+	}
+	trw := &testResponseWriter{}
+	crw, err := c.NewResponseWriter(trw, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if _, err := io.WriteString(crw, "12345\n"); err != nil {
+			t.Fatalf("cannot send response to cache: %s", err)
+		}
+	}
+	if _, err := io.WriteString(crw, "Code: 241. DB::Exception: Memory limit exceeded\n"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response: %s", err)
+	}
+	if trw.statusCode != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d; expecting %d", trw.statusCode, http.StatusInternalServerError)
+	}
+	if code := trw.Header().Get("X-ClickHouse-Exception-Code"); code != "241" {
+		t.Fatalf("unexpected exception code: %q; expecting %q", code, "241")
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
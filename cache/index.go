@@ -0,0 +1,362 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// indexFilename is the name of the file in the cache dir
+// the index is persisted to on cache closing.
+//
+// It mustn't match cachefileRegexp.
+const indexFilename = "chproxy-index"
+
+// indexHeader is the first line of the index file.
+const indexHeader = "chproxy cache index v1"
+
+// index keeps sizes and access times of cache entries in memory,
+// so the cache size is tracked accurately and entries are evicted
+// without scanning the storage.
+//
+// The index is shared among caches with the same location,
+// since old and new caches use the same storage during config reload.
+type index struct {
+	location string
+	file     string
+	refs     int
+
+	lock    sync.Mutex
+	size    uint64
+	entries map[string]*indexEntry
+
+	// tagged contains names of entries per tag.
+	tagged map[string]map[string]struct{}
+}
+
+type indexEntry struct {
+	size    int64
+	modTime time.Time
+
+	// atime and hits are used by eviction policies.
+	atime time.Time
+	hits  uint64
+
+	// tags are used for purging entries depending on tagged objects.
+	tags []string
+}
+
+var (
+	indexesLock sync.Mutex
+	indexes     = make(map[string]*index)
+)
+
+// acquireIndex returns the index for the cache c.
+//
+// The index is loaded from the index file in the cache dir if it exists.
+// Otherwise it is built in background by walking the storage.
+// releaseIndex must be called when the index is no longer needed.
+func acquireIndex(c *Cache) *index {
+	location := c.location()
+
+	indexesLock.Lock()
+	defer indexesLock.Unlock()
+	if idx, ok := indexes[location]; ok {
+		idx.refs++
+		return idx
+	}
+	idx := &index{
+		location: location,
+		file:     filepath.Join(c.dir, indexFilename),
+		refs:     1,
+		entries:  make(map[string]*indexEntry),
+		tagged:   make(map[string]map[string]struct{}),
+	}
+	indexes[location] = idx
+
+	err := idx.load()
+	if err == nil {
+		log.Debugf("cache %q: loaded %d entries from %q", c.Name, len(idx.entries), idx.file)
+		return idx
+	}
+	if !os.IsNotExist(err) {
+		log.Errorf("cache %q: cannot load index: %s; rebuilding it", c.Name, err)
+	}
+	go func() {
+		startTime := time.Now()
+		err := c.walk(func(name string, size int64, modTime time.Time) {
+			// Entries added during the walk are more recent.
+			idx.addIfMissing(name, size, modTime)
+		})
+		if err != nil {
+			log.Errorf("cache %q: cannot build index: %s", c.Name, err)
+			return
+		}
+		log.Debugf("cache %q: built index for %s in %s", c.Name, location, time.Since(startTime))
+	}()
+	return idx
+}
+
+// releaseIndex persists the index to the index file
+// if it is no longer used by caches.
+func releaseIndex(idx *index) {
+	indexesLock.Lock()
+	idx.refs--
+	last := idx.refs == 0
+	if last {
+		delete(indexes, idx.location)
+	}
+	indexesLock.Unlock()
+
+	if !last {
+		return
+	}
+	if err := idx.save(); err != nil {
+		log.Errorf("cannot save cache index for %s: %s", idx.location, err)
+	}
+}
+
+// load reads the index from the index file and removes the file,
+// so the index is rebuilt if the process crashes before saving it.
+func (idx *index) load() error {
+	f, err := os.Open(idx.file)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(idx.file)
+	}()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != indexHeader {
+		return fmt.Errorf("unexpected header in %q", idx.file)
+	}
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	for sc.Scan() {
+		var name string
+		var size, modTime, atime int64
+		var hits uint64
+		if _, err := fmt.Sscanf(sc.Text(), "%s %d %d %d %d", &name, &size, &modTime, &atime, &hits); err != nil {
+			return fmt.Errorf("cannot parse %q in %q: %s", sc.Text(), idx.file, err)
+		}
+		// The optional sixth field contains comma-separated escaped tags.
+		var tags []string
+		if fields := strings.Fields(sc.Text()); len(fields) > 5 {
+			for _, s := range strings.Split(fields[5], ",") {
+				tag, err := url.QueryUnescape(s)
+				if err != nil {
+					return fmt.Errorf("cannot parse tag %q in %q: %s", s, idx.file, err)
+				}
+				tags = append(tags, tag)
+			}
+		}
+		idx.entries[name] = &indexEntry{
+			size:    size,
+			modTime: time.Unix(0, modTime),
+			atime:   time.Unix(0, atime),
+			hits:    hits,
+		}
+		idx.size += uint64(size)
+		idx.setTagsLocked(name, tags)
+	}
+	return sc.Err()
+}
+
+// save writes the index to the index file.
+func (idx *index) save() error {
+	tmp := idx.file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	fmt.Fprintln(bw, indexHeader)
+	idx.lock.Lock()
+	for name, e := range idx.entries {
+		fmt.Fprintf(bw, "%s %d %d %d %d", name, e.size, e.modTime.UnixNano(), e.atime.UnixNano(), e.hits)
+		for i, tag := range e.tags {
+			if i == 0 {
+				bw.WriteByte(' ')
+			} else {
+				bw.WriteByte(',')
+			}
+			bw.WriteString(url.QueryEscape(tag))
+		}
+		bw.WriteByte('\n')
+	}
+	idx.lock.Unlock()
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write %q: %s", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot close %q: %s", tmp, err)
+	}
+	return os.Rename(tmp, idx.file)
+}
+
+// add puts the entry with the given name and tags to the index
+// substituting the previous entry with the same name.
+func (idx *index) add(name string, size int64, modTime time.Time, tags []string) {
+	idx.lock.Lock()
+	idx.removeLocked(name)
+	idx.entries[name] = &indexEntry{
+		size:    size,
+		modTime: modTime,
+		atime:   time.Now(),
+	}
+	idx.size += uint64(size)
+	idx.setTagsLocked(name, tags)
+	idx.lock.Unlock()
+}
+
+func (idx *index) setTagsLocked(name string, tags []string) {
+	idx.entries[name].tags = tags
+	for _, tag := range tags {
+		names := idx.tagged[tag]
+		if names == nil {
+			names = make(map[string]struct{})
+			idx.tagged[tag] = names
+		}
+		names[name] = struct{}{}
+	}
+}
+
+func (idx *index) addIfMissing(name string, size int64, modTime time.Time) {
+	idx.lock.Lock()
+	if _, ok := idx.entries[name]; !ok {
+		idx.entries[name] = &indexEntry{
+			size:    size,
+			modTime: modTime,
+			atime:   modTime,
+		}
+		idx.size += uint64(size)
+	}
+	idx.lock.Unlock()
+}
+
+// touch registers access to the entry with the given name.
+//
+// size and modTime are updated, since the entry may be substituted
+// by another chproxy instance sharing the storage.
+func (idx *index) touch(name string, size int64, modTime time.Time) {
+	idx.lock.Lock()
+	e, ok := idx.entries[name]
+	if !ok {
+		e = &indexEntry{}
+		idx.entries[name] = e
+	}
+	idx.size += uint64(size) - uint64(e.size)
+	e.size = size
+	e.modTime = modTime
+	e.atime = time.Now()
+	e.hits++
+	idx.lock.Unlock()
+}
+
+// remove drops the entry with the given name from the index.
+func (idx *index) remove(name string) {
+	idx.lock.Lock()
+	idx.removeLocked(name)
+	idx.lock.Unlock()
+}
+
+func (idx *index) removeLocked(name string) {
+	e, ok := idx.entries[name]
+	if !ok {
+		return
+	}
+	idx.size -= uint64(e.size)
+	delete(idx.entries, name)
+	for _, tag := range e.tags {
+		names := idx.tagged[tag]
+		delete(names, name)
+		if len(names) == 0 {
+			delete(idx.tagged, tag)
+		}
+	}
+}
+
+// taggedNames returns names of entries with tags matching the given func.
+func (idx *index) taggedNames(match func(tag string) bool) []string {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	var a []string
+	seen := make(map[string]bool)
+	for tag, names := range idx.tagged {
+		if !match(tag) {
+			continue
+		}
+		for name := range names {
+			if !seen[name] {
+				seen[name] = true
+				a = append(a, name)
+			}
+		}
+	}
+	return a
+}
+
+// contains returns true if the entry with the given name is indexed.
+func (idx *index) contains(name string) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	_, ok := idx.entries[name]
+	return ok
+}
+
+// stats returns the total size and the number of entries.
+func (idx *index) stats() (uint64, uint64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.size, uint64(len(idx.entries))
+}
+
+// indexItem is a copy of indexEntry for processing outside the lock.
+type indexItem struct {
+	name string
+	indexEntry
+}
+
+// items returns copies of all the index entries.
+func (idx *index) items() []indexItem {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	items := make([]indexItem, 0, len(idx.entries))
+	for name, e := range idx.entries {
+		items = append(items, indexItem{
+			name:       name,
+			indexEntry: *e,
+		})
+	}
+	return items
+}
+
+// sortForEviction sorts items in the order of eviction
+// according to the given policy.
+func sortForEviction(items []indexItem, policy string) {
+	if policy == "lfu" {
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].hits != items[j].hits {
+				return items[i].hits < items[j].hits
+			}
+			return items[i].atime.Before(items[j].atime)
+		})
+		return
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].atime.Before(items[j].atime)
+	})
+}
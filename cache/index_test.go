@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCacheEvictionPolicy(t *testing.T) {
+	f := func(policy, evicted string) {
+		t.Helper()
+		dir := testDir + "/eviction-" + policy
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatalf("cannot remove cache dir: %s", err)
+		}
+		c, err := New(config.Cache{
+			Name:           policy,
+			Dir:            dir,
+			MaxSize:        1e6,
+			Expire:         config.Duration(time.Hour),
+			GraceTime:      config.Duration(-1),
+			EvictionPolicy: policy,
+		})
+		if err != nil {
+			t.Fatalf("cannot create cache: %s", err)
+		}
+		defer c.Close()
+
+		keys := make(map[string]*Key)
+		for _, name := range []string{"a", "b", "c"} {
+			keys[name] = &Key{
+				Query: []byte("SELECT " + name),
+			}
+			storeTestEntry(t, c, keys[name], "value "+name)
+		}
+		// `a` is the least recently used entry, while `b` and `c`
+		// are used more frequently.
+		for _, name := range []string{"b", "c", "b", "c", "a"} {
+			if err := c.WriteTo(&testResponseWriter{}, keys[name]); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+
+		// Leave room only for two entries.
+		size, items := c.idx.stats()
+		if items != 3 {
+			t.Fatalf("unexpected number of items: %d; expecting 3", items)
+		}
+		c.highWatermark = size - 1
+		c.lowWatermark = size - 1
+		c.evict()
+
+		if _, items := c.idx.stats(); items != 2 {
+			t.Fatalf("unexpected number of items after eviction: %d; expecting 2", items)
+		}
+		if err := c.WriteTo(&testResponseWriter{}, keys[evicted]); err != ErrMissing {
+			t.Fatalf("unexpected error for %q: %v; expecting %s", evicted, err, ErrMissing)
+		}
+		if stats := c.Stats(); stats.Evictions != 1 {
+			t.Fatalf("unexpected evictions: %d; expecting 1", stats.Evictions)
+		}
+	}
+	f("lru", "b")
+	f("lfu", "a")
+}
+
+func TestCacheIndex(t *testing.T) {
+	dir := testDir + "/index"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	cfg := config.Cache{
+		Name:      "index",
+		Dir:       dir,
+		MaxSize:   1e6,
+		Expire:    config.Duration(time.Hour),
+		GraceTime: config.Duration(-1),
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+
+	// Overwritten entries must be accounted only once.
+	key := &Key{
+		Query: []byte("SELECT overwritten"),
+	}
+	storeTestEntry(t, c, key, "short")
+	storeTestEntry(t, c, key, "much longer value")
+	fi, err := os.Stat(c.filepath(key))
+	if err != nil {
+		t.Fatalf("cannot stat cached file: %s", err)
+	}
+	stats := c.Stats()
+	if stats.Items != 1 || stats.Size != uint64(fi.Size()) {
+		t.Fatalf("unexpected stats: %+v; expecting 1 item of size %d", stats, fi.Size())
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.idx.lock.Lock()
+	hits := c.idx.entries[key.String()].hits
+	c.idx.lock.Unlock()
+	if hits == 0 {
+		t.Fatalf("hits must be registered")
+	}
+	c.Close()
+
+	// The index must be persisted on close and loaded on start.
+	indexFile := filepath.Join(dir, indexFilename)
+	if _, err := os.Stat(indexFile); err != nil {
+		t.Fatalf("cannot stat index file: %s", err)
+	}
+	c, err = New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+	if _, err := os.Stat(indexFile); !os.IsNotExist(err) {
+		t.Fatalf("index file must be removed after loading; got %v", err)
+	}
+	stats = c.Stats()
+	if stats.Items != 1 || stats.Size != uint64(fi.Size()) {
+		t.Fatalf("unexpected stats after restart: %+v; expecting 1 item of size %d", stats, fi.Size())
+	}
+	c.idx.lock.Lock()
+	loadedHits := c.idx.entries[key.String()].hits
+	c.idx.lock.Unlock()
+	if loadedHits != hits {
+		t.Fatalf("unexpected hits after restart: %d; expecting %d", loadedHits, hits)
+	}
+}
+
+func TestCachePurgeTags(t *testing.T) {
+	dir := testDir + "/purge-tags"
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("cannot remove cache dir: %s", err)
+	}
+	cfg := config.Cache{
+		Name:      "purge-tags",
+		Dir:       dir,
+		MaxSize:   1e6,
+		Expire:    config.Duration(time.Hour),
+		GraceTime: config.Duration(-1),
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	store := func(query string, tags ...string) *Key {
+		t.Helper()
+		key := &Key{
+			Query: []byte(query),
+		}
+		crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+		if err != nil {
+			t.Fatalf("cannot create response writer: %s", err)
+		}
+		crw.SetTags(tags)
+		if _, err := io.WriteString(crw, "value"); err != nil {
+			t.Fatalf("cannot send response to cache: %s", err)
+		}
+		if err := crw.Commit(); err != nil {
+			t.Fatalf("cannot commit response to cache: %s", err)
+		}
+		return key
+	}
+	hits := store("SELECT hits", "db.hits")
+	join := store("SELECT join", "db.hits", "db.visits, with spaces")
+	other := store("SELECT other")
+	c.Close()
+
+	// Tags must survive restart.
+	c, err = New(cfg)
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+	n, err := c.PurgeTags(func(tag string) bool {
+		return tag == "db.visits, with spaces"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of purged entries: %d; expecting 1", n)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, join); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	n, err = c.PurgeTags(func(tag string) bool {
+		return tag == "db.hits"
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of purged entries: %d; expecting 1", n)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, hits); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, other); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func storeTestEntry(t *testing.T, c *Cache, key *Key, value string) {
+	t.Helper()
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, value); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+}
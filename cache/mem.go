@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// memCache keeps the most recently used cache entries in memory,
+// so hot responses aren't read from the underlying storage.
+type memCache struct {
+	maxSize uint64
+
+	// maxItemSize limits the size of a single entry, so huge responses
+	// don't evict all the hot entries.
+	maxItemSize uint64
+
+	lock  sync.Mutex
+	size  uint64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type memItem struct {
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func newMemCache(maxSize uint64) *memCache {
+	return &memCache{
+		maxSize:     maxSize,
+		maxItemSize: maxSize / 8,
+		lru:         list.New(),
+		items:       make(map[string]*list.Element),
+	}
+}
+
+// get returns the entry with the given name if it is in memory.
+func (m *memCache) get(name string) *entry {
+	if m == nil {
+		return nil
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.items[name]
+	if !ok {
+		return nil
+	}
+	m.lru.MoveToFront(e)
+	it := e.Value.(*memItem)
+	return &entry{
+		ReadCloser: ioutil.NopCloser(bytes.NewReader(it.data)),
+		name:       "memory:" + name,
+		size:       int64(len(it.data)),
+		modTime:    it.modTime,
+	}
+}
+
+// fits returns true if the entry of the given size may be kept in memory.
+func (m *memCache) fits(size int64) bool {
+	return m != nil && size >= 0 && uint64(size) <= m.maxItemSize
+}
+
+// put keeps data of the entry with the given name in memory
+// evicting the least recently used entries if needed.
+func (m *memCache) put(name string, data []byte, modTime time.Time) {
+	if !m.fits(int64(len(data))) {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.removeLocked(name)
+	it := &memItem{
+		name:    name,
+		data:    data,
+		modTime: modTime,
+	}
+	m.items[name] = m.lru.PushFront(it)
+	m.size += uint64(len(data))
+	for m.size > m.maxSize {
+		m.removeLocked(m.lru.Back().Value.(*memItem).name)
+	}
+}
+
+// remove drops the entry with the given name from memory.
+func (m *memCache) remove(name string) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	m.removeLocked(name)
+	m.lock.Unlock()
+}
+
+func (m *memCache) removeLocked(name string) {
+	e, ok := m.items[name]
+	if !ok {
+		return
+	}
+	m.lru.Remove(e)
+	delete(m.items, name)
+	m.size -= uint64(len(e.Value.(*memItem).data))
+}
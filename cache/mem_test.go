@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestMemCacheLRU(t *testing.T) {
+	m := newMemCache(80)
+	mt := time.Now()
+	m.put("a", make([]byte, 10), mt)
+	m.put("b", make([]byte, 10), mt)
+	m.put("huge", make([]byte, 11), mt)
+	if m.get("huge") != nil {
+		t.Fatalf("entries exceeding maxItemSize mustn't be kept")
+	}
+	for _, name := range []string{"c", "d", "e", "f", "g"} {
+		// Touch `a`, so it isn't evicted.
+		if m.get("a") == nil {
+			t.Fatalf("missing recently used entry %q", "a")
+		}
+		m.put(name, make([]byte, 10), mt)
+	}
+	if m.size != 70 {
+		t.Fatalf("unexpected size: %d; expecting 70", m.size)
+	}
+	m.put("h", make([]byte, 10), mt)
+	m.put("i", make([]byte, 10), mt)
+	if m.get("b") != nil {
+		t.Fatalf("the least recently used entry %q must be evicted", "b")
+	}
+	if m.get("a") == nil {
+		t.Fatalf("missing recently used entry %q", "a")
+	}
+	if m.size != 80 {
+		t.Fatalf("unexpected size: %d; expecting 80", m.size)
+	}
+	m.remove("a")
+	if m.get("a") != nil || m.size != 70 {
+		t.Fatalf("entry %q must be removed", "a")
+	}
+}
+
+func TestCacheMemSize(t *testing.T) {
+	c, err := New(config.Cache{
+		Name:      "mem",
+		Dir:       testDir + "/mem",
+		MaxSize:   1e6,
+		MemSize:   1e5,
+		Expire:    config.Duration(time.Minute),
+		GraceTime: config.Duration(-1),
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT dashboard"),
+	}
+	crw, err := c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "hot value"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+
+	// The response must be served from memory after the file is removed.
+	if err := os.Remove(c.filepath(key)); err != nil {
+		t.Fatalf("cannot remove cached file: %s", err)
+	}
+	trw := &testResponseWriter{}
+	if err := c.WriteTo(trw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "hot value" {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, "hot value")
+	}
+
+	// The new response must substitute the response in memory.
+	crw, err = c.NewResponseWriter(&testResponseWriter{}, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	if _, err := io.WriteString(crw, "new value"); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+	trw = &testResponseWriter{}
+	if err := c.WriteTo(trw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != "new value" {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, "new value")
+	}
+
+	// Removed entries must be removed from memory.
+	if err := c.remove(key.String()); err != nil {
+		t.Fatalf("cannot remove entry: %s", err)
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+}
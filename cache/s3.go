@@ -0,0 +1,430 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// s3Storage stores cache entries in S3-compatible object storage.
+//
+// Requests are signed with AWS Signature Version 4 if credentials are set.
+// Bucket is addressed in the path style, so storages without
+// virtual-hosted buckets such as MinIO are supported.
+type s3Storage struct {
+	endpoint *url.URL
+	region   string
+	bucket   string
+	prefix   string
+
+	accessKeyID     string
+	secretAccessKey string
+
+	partSize int64
+
+	client *http.Client
+}
+
+func newS3Storage(cfg config.CacheS3) (*s3Storage, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `s3.endpoint` %q: %s", cfg.Endpoint, err)
+	}
+	if len(cfg.Bucket) == 0 {
+		return nil, fmt.Errorf("`s3.bucket` cannot be empty")
+	}
+	partSize := int64(cfg.PartSize)
+	if partSize <= 0 {
+		partSize = 64 << 20
+	}
+	return &s3Storage{
+		endpoint: u,
+		region:   cfg.Region,
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
+
+		partSize: partSize,
+
+		// The client has no timeout, since huge responses
+		// may be streamed for a long time.
+		client: &http.Client{},
+	}, nil
+}
+
+// String returns the location of s in the form `s3://bucket/prefix`.
+func (s *s3Storage) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+// objectPath returns the location of the object for the given name.
+func (s *s3Storage) objectPath(name string) string {
+	return s.String() + name
+}
+
+// get returns the entry with the given name.
+//
+// The returned error satisfies os.IsNotExist if there is no such entry.
+func (s *s3Storage) get(name string) (*entry, error) {
+	resp, err := s.do("GET", s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3ResponseError(resp)
+	}
+	mt, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot parse Last-Modified of %q: %s", s.objectPath(name), err)
+	}
+	return &entry{
+		ReadCloser: resp.Body,
+		name:       s.objectPath(name),
+		size:       resp.ContentLength,
+		modTime:    mt,
+	}, nil
+}
+
+// put uploads size bytes from r under the given name.
+//
+// Entries exceeding partSize are uploaded in multiple parts,
+// so they are streamed from r without buffering in memory.
+func (s *s3Storage) put(name string, r io.ReaderAt, size int64) error {
+	key := s.prefix + name
+	if size <= s.partSize {
+		resp, err := s.do("PUT", key, nil, io.NewSectionReader(r, 0, size), size)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3ResponseError(resp)
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	uploadID, err := s.createMultipartUpload(key)
+	if err != nil {
+		return err
+	}
+	var parts []s3Part
+	for off := int64(0); off < size; off += s.partSize {
+		n := s.partSize
+		if off+n > size {
+			n = size - off
+		}
+		part := s3Part{PartNumber: len(parts) + 1}
+		if part.ETag, err = s.uploadPart(key, uploadID, part.PartNumber, io.NewSectionReader(r, off, n), n); err != nil {
+			s.abortMultipartUpload(key, uploadID)
+			return err
+		}
+		parts = append(parts, part)
+	}
+	if err := s.completeMultipartUpload(key, uploadID, parts); err != nil {
+		s.abortMultipartUpload(key, uploadID)
+		return err
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *s3Storage) createMultipartUpload(key string) (string, error) {
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", s3ResponseError(resp)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("cannot parse response for multipart upload of %q: %s", key, err)
+	}
+	if len(result.UploadID) == 0 {
+		return "", fmt.Errorf("missing UploadId in response for multipart upload of %q", key)
+	}
+	return result.UploadID, nil
+}
+
+func (s *s3Storage) uploadPart(key, uploadID string, partNumber int, r io.Reader, size int64) (string, error) {
+	args := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	resp, err := s.do("PUT", key, args, r, size)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", s3ResponseError(resp)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if len(etag) == 0 {
+		return "", fmt.Errorf("missing ETag in response for part %d of %q", partNumber, key)
+	}
+	return etag, nil
+}
+
+func (s *s3Storage) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("cannot marshal parts of %q: %s", key, err)
+	}
+	resp, err := s.do("POST", key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	defer resp.Body.Close()
+	// The upload may fail after the response status is sent,
+	// so the error is returned in the response body.
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response for completing upload of %q: %s", key, err)
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		return fmt.Errorf("cannot complete upload of %q: %s", key, b)
+	}
+	return nil
+}
+
+func (s *s3Storage) abortMultipartUpload(key, uploadID string) {
+	resp, err := s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, 0)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
+
+// remove deletes the entry with the given name.
+func (s *s3Storage) remove(name string) error {
+	resp, err := s.do("DELETE", s.prefix+name, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		resp.Body.Close()
+		return nil
+	default:
+		return s3ResponseError(resp)
+	}
+}
+
+// walk calls f on all the entries under the prefix.
+func (s *s3Storage) walk(f func(name string, size int64, modTime time.Time)) error {
+	args := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.prefix},
+	}
+	for {
+		resp, err := s.do("GET", "", args, nil, 0)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s3ResponseError(resp)
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot parse list of objects in %s: %s", s, err)
+		}
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, s.prefix)
+			if !cachefileRegexp.MatchString(name) {
+				// Skip foreign objects
+				continue
+			}
+			f(name, obj.Size, obj.LastModified)
+		}
+		if !result.IsTruncated || len(result.NextContinuationToken) == 0 {
+			return nil
+		}
+		args.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends signed request for the given object key to the storage.
+//
+// The bucket is requested if key is empty.
+func (s *s3Storage) do(method, key string, args url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if len(key) > 0 {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(args)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request to %s: %s", s, err)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send request to %s: %s", s, err)
+	}
+	return resp, nil
+}
+
+// sign signs req with AWS Signature Version 4.
+//
+// The payload isn't signed, so it may be streamed.
+func (s *s3Storage) sign(req *http.Request, t time.Time) {
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if len(s.accessKeyID) == 0 {
+		return
+	}
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+// s3CanonicalQuery returns query string with sorted and escaped args
+// as required by AWS Signature Version 4.
+func s3CanonicalQuery(args url.Values) string {
+	if len(args) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range args[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape escapes s according to RFC 3986.
+//
+// Slashes are escaped only if escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3ResponseError returns error with the status and the beginning
+// of the body of unexpected resp. The resp body is closed.
+func s3ResponseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected status code %d for %s %s: %s",
+		resp.StatusCode, resp.Request.Method, resp.Request.URL.Path, bytes.TrimSpace(b))
+}
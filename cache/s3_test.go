@@ -0,0 +1,251 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// fakeS3 is in-memory S3-compatible storage supporting requests
+// sent by s3Storage.
+type fakeS3 struct {
+	lock    sync.Mutex
+	objects map[string]*fakeS3Object
+	uploads map[string]map[int][]byte
+
+	// multipartUploads is the number of completed multipart uploads.
+	multipartUploads int
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string]*fakeS3Object),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (s *fakeS3) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/bucket") {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	args := r.URL.Query()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.Method == "GET" && len(key) == 0:
+		s.list(rw, args.Get("prefix"))
+	case r.Method == "GET":
+		obj, ok := s.objects[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		rw.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+		rw.Write(obj.data)
+	case r.Method == "PUT" && len(args.Get("uploadId")) > 0:
+		parts, ok := s.uploads[args.Get("uploadId")]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(args.Get("partNumber"))
+		parts[n], _ = ioutil.ReadAll(r.Body)
+		rw.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("etag%d", n)))
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[key] = &fakeS3Object{data: data, modTime: time.Now()}
+	case r.Method == "POST" && args["uploads"] != nil:
+		id := fmt.Sprintf("upload%d", len(s.uploads))
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(rw, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "POST":
+		parts, ok := s.uploads[args.Get("uploadId")]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var complete struct {
+			Parts []s3Part `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data []byte
+		for _, p := range complete.Parts {
+			data = append(data, parts[p.PartNumber]...)
+		}
+		delete(s.uploads, args.Get("uploadId"))
+		s.objects[key] = &fakeS3Object{data: data, modTime: time.Now()}
+		s.multipartUploads++
+		fmt.Fprint(rw, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE":
+		delete(s.objects, key)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *fakeS3) list(rw http.ResponseWriter, prefix string) {
+	var keys []string
+	for k := range s.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	fmt.Fprint(rw, "<ListBucketResult>")
+	for _, k := range keys {
+		obj := s.objects[k]
+		fmt.Fprintf(rw, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			k, len(obj.data), obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"))
+	}
+	fmt.Fprint(rw, "<IsTruncated>false</IsTruncated></ListBucketResult>")
+}
+
+func TestCacheS3(t *testing.T) {
+	s := newFakeS3()
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	c, err := New(config.Cache{
+		Name:    "s3",
+		Dir:     testDir + "/s3",
+		MaxSize: 1e6,
+		Expire:  config.Duration(time.Minute),
+		S3: config.CacheS3{
+			Endpoint:        srv.URL,
+			Region:          "us-east-1",
+			Bucket:          "bucket",
+			Prefix:          "chproxy/",
+			AccessKeyID:     "test-key",
+			SecretAccessKey: "test-secret",
+			PartSize:        16,
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot create cache: %s", err)
+	}
+	defer c.Close()
+
+	key := &Key{
+		Query: []byte("SELECT huge report"),
+	}
+	if err := c.WriteTo(&testResponseWriter{}, key); err != ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, ErrMissing)
+	}
+
+	value := strings.Repeat("report row\n", 10)
+	trw := &testResponseWriter{}
+	crw, err := c.NewResponseWriter(trw, key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	crw.Header().Set("Content-Type", "text/tab-separated-values")
+	if _, err := io.WriteString(crw, value); err != nil {
+		t.Fatalf("cannot send response to cache: %s", err)
+	}
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response to cache: %s", err)
+	}
+	if string(trw.b) != value {
+		t.Fatalf("unexpected response: %q; expecting %q", trw.b, value)
+	}
+	if s.multipartUploads != 1 {
+		t.Fatalf("unexpected number of multipart uploads: %d; expecting 1", s.multipartUploads)
+	}
+	if _, ok := s.objects["chproxy/"+key.String()]; !ok {
+		t.Fatalf("missing object for %q", key.String())
+	}
+
+	trw = &testResponseWriter{}
+	if err := c.WriteTo(trw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(trw.b) != value {
+		t.Fatalf("unexpected cached response: %q; expecting %q", trw.b, value)
+	}
+	if ct := trw.Header().Get("Content-Type"); ct != "text/tab-separated-values" {
+		t.Fatalf("unexpected Content-Type: %q", ct)
+	}
+	if cl := trw.Header().Get("Content-Length"); cl != strconv.Itoa(len(value)) {
+		t.Fatalf("unexpected Content-Length: %q; expecting %d", cl, len(value))
+	}
+
+	// Entries are copied between caches via ReadEntry and StoreEntry.
+	r, modTime, err := c.ReadEntry(key.String())
+	if err != nil {
+		t.Fatalf("cannot read entry: %s", err)
+	}
+	entry, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("cannot read entry: %s", err)
+	}
+	key2 := &Key{
+		Query: []byte("SELECT small report"),
+	}
+	if err := c.StoreEntry(key2.String(), bytes.NewReader(entry[:20]), modTime); err != nil {
+		t.Fatalf("cannot store entry: %s", err)
+	}
+	if len(s.objects) != 2 {
+		t.Fatalf("unexpected number of objects: %d; expecting 2", len(s.objects))
+	}
+
+	// Expired entries are removed by the cleaner.
+	s.lock.Lock()
+	s.objects["foreign"] = &fakeS3Object{modTime: time.Now().Add(-time.Hour)}
+	s.lock.Unlock()
+	c.idx.lock.Lock()
+	c.idx.entries[key2.String()].modTime = time.Now().Add(-time.Hour)
+	c.idx.lock.Unlock()
+	c.clean()
+	if _, ok := s.objects["chproxy/"+key2.String()]; ok {
+		t.Fatalf("expired object must be removed")
+	}
+	if _, ok := s.objects["foreign"]; !ok {
+		t.Fatalf("foreign object must be kept")
+	}
+	stats := c.Stats()
+	if stats.Items != 1 || stats.Size != uint64(len(entry)) {
+		t.Fatalf("unexpected stats: %+v; expecting 1 item of size %d", stats, len(entry))
+	}
+}
+
+func TestS3Escape(t *testing.T) {
+	f := func(s string, escapeSlash bool, expected string) {
+		t.Helper()
+		if got := s3Escape(s, escapeSlash); got != expected {
+			t.Fatalf("unexpected escaped %q: %q; expecting %q", s, got, expected)
+		}
+	}
+	f("/bucket/chproxy/0123abc", false, "/bucket/chproxy/0123abc")
+	f("a b+c~d/e", false, "a%20b%2Bc~d/e")
+	f("a b+c~d/e", true, "a%20b%2Bc~d%2Fe")
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// tmpFilePrefix is the prefix of temporary files, which are renamed
+// to cache files when responses are completely written.
+//
+// It mustn't match cachefileRegexp.
+const tmpFilePrefix = "tmp"
+
+var (
+	dirsLock sync.Mutex
+	dirs     = make(map[string]int)
+)
+
+// acquireDir registers the usage of dir by a cache.
+//
+// true is returned if dir isn't used by other caches, so temporary files
+// in dir may be safely removed.
+func acquireDir(dir string) bool {
+	dirsLock.Lock()
+	defer dirsLock.Unlock()
+	dirs[dir]++
+	return dirs[dir] == 1
+}
+
+func releaseDir(dir string) {
+	dirsLock.Lock()
+	defer dirsLock.Unlock()
+	dirs[dir]--
+	if dirs[dir] == 0 {
+		delete(dirs, dir)
+	}
+}
+
+// isTempFile returns true if name is the name of temporary file
+// written by a cache.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tmpFilePrefix) || name == indexFilename+".tmp"
+}
+
+// removeTempFiles removes temporary files left in the cache dir
+// by crashed or killed process and returns their total size.
+func (c *Cache) removeTempFiles() (uint64, error) {
+	fis, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read %q: %s", c.dir, err)
+	}
+	var size uint64
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !isTempFile(fi.Name()) {
+			continue
+		}
+		fn := filepath.Join(c.dir, fi.Name())
+		if err := os.Remove(fn); err != nil {
+			log.Errorf("cache %q: cannot remove temporary file %q: %s", c.Name, fn, err)
+			continue
+		}
+		size += uint64(fi.Size())
+	}
+	return size, nil
+}
+
+// syncFile flushes f contents to disk if `fsync` is enabled,
+// so the file isn't truncated after power loss.
+func (c *Cache) syncFile(f *os.File) error {
+	if !c.fsync {
+		return nil
+	}
+	return f.Sync()
+}
+
+// syncDir flushes the cache dir to disk if `fsync` is enabled,
+// so renamed files survive power loss.
+func (c *Cache) syncDir() error {
+	if !c.fsync {
+		return nil
+	}
+	d, err := os.Open(c.dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	d.Close()
+	return err
+}
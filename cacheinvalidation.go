@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writeStatements contains statements modifying table data.
+var writeStatements = map[string]bool{
+	"INSERT": true, "ALTER": true, "TRUNCATE": true, "DELETE": true,
+}
+
+// getReadTables returns tables read by the query q for tagging
+// its cached response.
+//
+// Tables are returned in the form `db.table` if the database is known
+// and `table` otherwise. Tables without database belong to the given
+// database. Tables read via views, dictionaries and table functions
+// aren't followed.
+func getReadTables(q []byte, database string) []string {
+	refs := analyzeQuery(q, false)
+	var tables []string
+	seen := make(map[string]bool)
+	for _, o := range refs.objects {
+		if len(o.name) == 0 {
+			continue
+		}
+		if len(o.database) == 0 {
+			o.database = database
+		}
+		t := o.String()
+		if !seen[t] {
+			seen[t] = true
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// getWrittenTables returns the table modified by the query from req
+// in the same form as getReadTables.
+//
+// nil is returned if the query doesn't modify table data.
+func getWrittenTables(req *http.Request) ([]string, error) {
+	q, truncated, err := peekQuery(req, maxTenantQuerySize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read query: %s", err)
+	}
+	if !writeStatements[queryStatement(q)] {
+		return nil, nil
+	}
+	refs := analyzeQuery(q, truncated)
+	if len(refs.objects) == 0 || len(refs.objects[0].name) == 0 {
+		return nil, nil
+	}
+	// The modified table goes first in supported statements.
+	o := refs.objects[0]
+	if len(o.database) == 0 {
+		o.database = req.URL.Query().Get("database")
+	}
+	return []string{o.String()}, nil
+}
+
+// tablesMatcher returns a func matching tags of cached responses
+// read from the given modified tables.
+//
+// Tables without database match tables with the same name
+// in all the databases, while responses for queries without database
+// are matched by tables with the same name in any database.
+func tablesMatcher(tables []string) func(tag string) bool {
+	return func(tag string) bool {
+		tagTable := tag
+		if n := strings.IndexByte(tag, '.'); n >= 0 {
+			tagTable = tag[n+1:]
+		}
+		for _, t := range tables {
+			table := t
+			if n := strings.IndexByte(t, '.'); n >= 0 {
+				table = t[n+1:]
+			}
+			switch {
+			case t == tag:
+				return true
+			case t == table || tag == tagTable:
+				// The database of either table is unknown.
+				if table == tagTable {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// invalidateCaches purges responses read from the given tables
+// from caches with `invalidate_on_writes`.
+func (rp *reverseProxy) invalidateCaches(tables []string) {
+	rp.lock.RLock()
+	caches := rp.caches
+	rp.lock.RUnlock()
+
+	match := tablesMatcher(tables)
+	for _, c := range caches {
+		if !c.InvalidateOnWrites {
+			continue
+		}
+		n, err := c.PurgeTags(match)
+		if n > 0 {
+			cacheInvalidatedItems.With(prometheus.Labels{"cache": c.Name}).Add(float64(n))
+			log.Debugf("cache %q: invalidated %d entries after modification of %q", c.Name, n, tables)
+		}
+		if err != nil {
+			log.Errorf("cannot invalidate entries after modification of %q: %s", tables, err)
+		}
+	}
+}
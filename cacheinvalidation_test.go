@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestGetReadTables(t *testing.T) {
+	f := func(q, database string, expected ...string) {
+		t.Helper()
+		tables := getReadTables([]byte(q), database)
+		if !reflect.DeepEqual(tables, expected) {
+			t.Fatalf("unexpected tables for %q: %q; expecting %q", q, tables, expected)
+		}
+	}
+	f("SELECT 1", "")
+	f("SELECT count() FROM hits", "", "hits")
+	f("SELECT count() FROM hits", "stats", "stats.hits")
+	f("SELECT * FROM db.hits JOIN visits USING id WHERE id IN (SELECT id FROM db.hits)", "stats", "db.hits", "stats.visits")
+}
+
+func TestGetWrittenTables(t *testing.T) {
+	f := func(q, params string, expected ...string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://chproxy/?"+params, strings.NewReader(q))
+		tables, err := getWrittenTables(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(tables, expected) {
+			t.Fatalf("unexpected tables for %q: %q; expecting %q", q, tables, expected)
+		}
+	}
+	f("SELECT count() FROM hits", "")
+	f("INSERT INTO hits FORMAT TSV\n1\t2\n", "", "hits")
+	f("INSERT INTO db.hits SELECT * FROM db.staging", "", "db.hits")
+	f("INSERT INTO hits VALUES (1, 2)", "database=stats", "stats.hits")
+	f("ALTER TABLE db.hits DELETE WHERE id = 1", "", "db.hits")
+	f("TRUNCATE TABLE hits", "database=stats", "stats.hits")
+	f("DELETE FROM db.hits WHERE id = 1", "", "db.hits")
+	f("ALTER USER foo IDENTIFIED BY 'bar'", "")
+}
+
+func TestTablesMatcher(t *testing.T) {
+	f := func(tables []string, tag string, expected bool) {
+		t.Helper()
+		if ok := tablesMatcher(tables)(tag); ok != expected {
+			t.Fatalf("unexpected match of %q by %q: %v; expecting %v", tag, tables, ok, expected)
+		}
+	}
+	f([]string{"db.hits"}, "db.hits", true)
+	f([]string{"db.hits"}, "hits", true)
+	f([]string{"db.hits"}, "other.hits", false)
+	f([]string{"db.hits"}, "db.visits", false)
+	f([]string{"hits"}, "other.hits", true)
+	f([]string{"hits"}, "visits", false)
+	f([]string{"db.visits", "db.hits"}, "db.hits", true)
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		if strings.HasPrefix(string(body), "INSERT") {
+			return
+		}
+		fmt.Fprintf(w, "response %d", atomic.AddInt32(&n, 1))
+	}))
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "chproxy-cache-invalidation")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newConfiguredProxy(&config.Config{
+		Caches: []config.Cache{
+			{
+				Name:               "dashboards",
+				Dir:                dir,
+				MaxSize:            config.ByteSize(1 << 20),
+				Expire:             config.Duration(time.Minute),
+				GraceTime:          config.Duration(-1),
+				InvalidateOnWrites: true,
+			},
+		},
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{strings.TrimPrefix(srv.URL, "http://")},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "dashboard",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Cache:     "dashboards",
+			},
+			{
+				Name:      "writer",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	query := func(user, q, expected string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", srv.URL+"?user="+user+"&database=stats", strings.NewReader(q))
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, http.StatusOK)
+		}
+		if body := bbToString(t, resp.Body); body != expected {
+			t.Fatalf("unexpected response body for %q: %q; expecting %q", q, body, expected)
+		}
+	}
+	query("dashboard", "SELECT count() FROM hits", "response 1")
+	query("dashboard", "SELECT count() FROM visits", "response 2")
+	query("dashboard", "SELECT count() FROM hits", "response 1")
+
+	// Responses reading the modified table must be purged.
+	query("writer", "INSERT INTO stats.hits FORMAT TSV\n1\n", "")
+	query("dashboard", "SELECT count() FROM hits", "response 3")
+	query("dashboard", "SELECT count() FROM visits", "response 2")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// cacheKeyPolicy builds custom parts of cache keys according
+// to the `key` section of cache config.
+type cacheKeyPolicy struct {
+	includeParams  []string
+	excludeParams  []string
+	includeHeaders []string
+	normalizeQuery bool
+}
+
+// newCacheKeyPolicy returns cache key policy for the given cfg.
+//
+// nil is returned if cache keys aren't customized.
+func newCacheKeyPolicy(cfg config.CacheKey) *cacheKeyPolicy {
+	if len(cfg.IncludeParams) == 0 && len(cfg.IncludeHeaders) == 0 && !cfg.NormalizeQuery {
+		return nil
+	}
+	ckp := &cacheKeyPolicy{
+		includeParams:  cfg.IncludeParams,
+		excludeParams:  cfg.ExcludeParams,
+		normalizeQuery: cfg.NormalizeQuery,
+	}
+	for _, h := range cfg.IncludeHeaders {
+		ckp.includeHeaders = append(ckp.includeHeaders, http.CanonicalHeaderKey(h))
+	}
+	sort.Strings(ckp.includeHeaders)
+	return ckp
+}
+
+// query returns the query for use in cache key.
+//
+// See normalizeQuery for the normalized query format.
+func (ckp *cacheKeyPolicy) query(q []byte) []byte {
+	if ckp == nil || !ckp.normalizeQuery {
+		return skipLeadingComments(q)
+	}
+	nq, _ := normalizeQuery(q, false)
+	return []byte(nq)
+}
+
+// cacheKeyIgnoredParams are never included into cache keys.
+//
+// The query is already in the key, while credentials mustn't be there.
+var cacheKeyIgnoredParams = map[string]bool{
+	"query":    true,
+	"user":     true,
+	"password": true,
+}
+
+// params returns the string with params and headers included
+// into cache key.
+//
+// An empty string is returned if there are no such params and headers.
+func (ckp *cacheKeyPolicy) params(params url.Values, header http.Header) string {
+	if ckp == nil {
+		return ""
+	}
+	var names []string
+	for name := range params {
+		if !cacheKeyIgnoredParams[name] && matchParam(ckp.includeParams, name) && !matchParam(ckp.excludeParams, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%q=%q;", name, params[name])
+	}
+	for _, name := range ckp.includeHeaders {
+		if values, ok := header[name]; ok {
+			fmt.Fprintf(&buf, "%q:%q;", name, values)
+		}
+	}
+	return buf.String()
+}
+
+// matchParam returns true if name matches one of patterns.
+//
+// A trailing `*` in pattern matches any suffix.
+func matchParam(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, p[:len(p)-1]) {
+				return true
+			}
+			continue
+		}
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
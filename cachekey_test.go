@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCacheKeyPolicy(t *testing.T) {
+	if ckp := newCacheKeyPolicy(config.CacheKey{}); ckp != nil {
+		t.Fatalf("expecting nil policy for empty config")
+	}
+	var nilPolicy *cacheKeyPolicy
+	if q := string(nilPolicy.query([]byte("-- comment\nselect 1"))); q != "select 1" {
+		t.Fatalf("unexpected query for nil policy: %q", q)
+	}
+	if p := nilPolicy.params(url.Values{"param_x": {"1"}}, nil); p != "" {
+		t.Fatalf("unexpected params for nil policy: %q", p)
+	}
+
+	ckp := newCacheKeyPolicy(config.CacheKey{
+		IncludeParams:  []string{"param_*", "max_threads", "password"},
+		ExcludeParams:  []string{"param_request_id"},
+		IncludeHeaders: []string{"x-tenant"},
+	})
+	params := url.Values{
+		"param_b":          {"2"},
+		"param_a":          {"1"},
+		"param_request_id": {"abc"},
+		"max_threads":      {"4"},
+		"query_id":         {"q1"},
+		"password":         {"secret"},
+	}
+	header := http.Header{
+		"X-Tenant":   {"acme"},
+		"User-Agent": {"curl"},
+	}
+	expected := `"max_threads"=["4"];"param_a"=["1"];"param_b"=["2"];"X-Tenant":["acme"];`
+	if p := ckp.params(params, header); p != expected {
+		t.Fatalf("unexpected params: %q; expecting %q", p, expected)
+	}
+
+	// Irrelevant params mustn't affect the key.
+	params.Set("query_id", "q2")
+	params.Set("param_request_id", "def")
+	header.Set("User-Agent", "browser")
+	if p := ckp.params(params, header); p != expected {
+		t.Fatalf("unexpected params: %q; expecting %q", p, expected)
+	}
+	if q := string(ckp.query([]byte("select 1"))); q != "select 1" {
+		t.Fatalf("query mustn't be normalized: %q", q)
+	}
+
+	ckp = newCacheKeyPolicy(config.CacheKey{
+		NormalizeQuery: true,
+	})
+	q1 := ckp.query([]byte("/* dashboard */ select count( * )\n\tfrom t  where s = 'a  b'"))
+	q2 := ckp.query([]byte("SELECT count(*) FROM t WHERE s = 'a  b' -- refreshed"))
+	if string(q1) != string(q2) {
+		t.Fatalf("normalized queries must be equal; got %q and %q", q1, q2)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Vertamedia/chproxy/cache"
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cachePeerPath is the path for serving cache entries to peers.
+const cachePeerPath = "/-/cache/peer"
+
+// cachePeerSecretHeader is the header containing the secret shared among peers.
+const cachePeerSecretHeader = "X-Chproxy-Peer-Secret"
+
+// cachePeerReplicas is the number of points per peer on the hash ring.
+//
+// Multiple points per peer provide uniform distribution of keys.
+const cachePeerReplicas = 64
+
+// cachePeers distributes cache entries among chproxy instances
+// via consistent hashing.
+type cachePeers struct {
+	self   string
+	secret string
+	client *http.Client
+
+	// ring is sorted by hash.
+	ring []cachePeerPoint
+}
+
+type cachePeerPoint struct {
+	hash uint32
+	url  string
+}
+
+// newCachePeers returns cache peers for the given cfg.
+//
+// nil is returned if peering isn't configured.
+func newCachePeers(cfg config.CachePeers) *cachePeers {
+	if len(cfg.URLs) == 0 {
+		return nil
+	}
+	cp := &cachePeers{
+		self:   cfg.Self,
+		secret: cfg.Secret,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout),
+		},
+	}
+	for _, u := range cfg.URLs {
+		for i := 0; i < cachePeerReplicas; i++ {
+			cp.ring = append(cp.ring, cachePeerPoint{
+				hash: hashString(u + "#" + strconv.Itoa(i)),
+				url:  u,
+			})
+		}
+	}
+	sort.Slice(cp.ring, func(i, j int) bool {
+		return cp.ring[i].hash < cp.ring[j].hash
+	})
+	return cp
+}
+
+func hashString(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
+
+// owner returns url of the peer owning the given key.
+func (cp *cachePeers) owner(key string) string {
+	h := hashString(key)
+	i := sort.Search(len(cp.ring), func(i int) bool {
+		return cp.ring[i].hash >= h
+	})
+	if i == len(cp.ring) {
+		i = 0
+	}
+	return cp.ring[i].url
+}
+
+// isOwner returns true if the current instance owns the given key.
+func (cp *cachePeers) isOwner(key string) bool {
+	return cp.owner(key) == cp.self
+}
+
+func (cp *cachePeers) entryURL(c *cache.Cache, key string) string {
+	params := url.Values{}
+	params.Set("cache", c.Name)
+	params.Set("key", key)
+	return cp.owner(key) + cachePeerPath + "?" + params.Encode()
+}
+
+// fetch fetches the entry with the given key from the owning peer
+// and stores it in c.
+//
+// Returns cache.ErrMissing if the current instance owns the key
+// or the owning peer has no such entry.
+func (cp *cachePeers) fetch(c *cache.Cache, key string) error {
+	if cp.isOwner(key) {
+		return cache.ErrMissing
+	}
+	labels := prometheus.Labels{"cache": c.Name}
+	req, err := http.NewRequest("GET", cp.entryURL(c, key), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(cachePeerSecretHeader, cp.secret)
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		cachePeerErrors.With(labels).Inc()
+		return fmt.Errorf("cannot fetch cache entry from peer: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		cachePeerMiss.With(labels).Inc()
+		return cache.ErrMissing
+	default:
+		cachePeerErrors.With(labels).Inc()
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d from peer: %q", resp.StatusCode, body)
+	}
+	// The entry keeps its age on the owning peer,
+	// so it isn't served after it expires there.
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		cachePeerErrors.With(labels).Inc()
+		return fmt.Errorf("cannot parse Last-Modified of cache entry from peer: %s", err)
+	}
+	if err := c.StoreEntry(key, resp.Body, modTime); err != nil {
+		if err == cache.ErrMissing {
+			cachePeerMiss.With(labels).Inc()
+			return err
+		}
+		cachePeerErrors.With(labels).Inc()
+		return err
+	}
+	cachePeerHit.With(labels).Inc()
+	return nil
+}
+
+// push sends the entry with the given key from c to the owning peer.
+func (cp *cachePeers) push(c *cache.Cache, key string) {
+	if cp.isOwner(key) {
+		return
+	}
+	entry, modTime, err := c.ReadEntry(key)
+	if err != nil {
+		if err != cache.ErrMissing {
+			log.Errorf("cannot read cache entry for pushing to peer: %s", err)
+		}
+		return
+	}
+	defer entry.Close()
+
+	req, err := http.NewRequest("POST", cp.entryURL(c, key), entry)
+	if err != nil {
+		log.Errorf("cannot create request for pushing cache entry to peer: %s", err)
+		return
+	}
+	req.Header.Set(cachePeerSecretHeader, cp.secret)
+	req.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		cachePeerErrors.With(prometheus.Labels{"cache": c.Name}).Inc()
+		log.Errorf("cannot push cache entry to peer: %s", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		cachePeerErrors.With(prometheus.Labels{"cache": c.Name}).Inc()
+		log.Errorf("unexpected status code %d from peer while pushing cache entry", resp.StatusCode)
+	}
+}
+
+// serveCachePeer serves cache entries to peers.
+//
+// GET returns the entry, while POST stores the entry pushed by a peer.
+// The time the entry has been cached is passed in `Last-Modified` header.
+func (rp *reverseProxy) serveCachePeer(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get("cache")
+	key := req.URL.Query().Get("key")
+
+	rp.lock.RLock()
+	c := rp.caches[name]
+	cp := rp.cachePeers[name]
+	rp.lock.RUnlock()
+
+	if c == nil || cp == nil {
+		err := fmt.Errorf("%q: peering isn't configured for cache %q", req.RemoteAddr, name)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	secret := req.Header.Get(cachePeerSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(cp.secret)) != 1 {
+		err := fmt.Errorf("%q: invalid peer secret for cache %q", req.RemoteAddr, name)
+		respondWith(rw, err, http.StatusForbidden)
+		return
+	}
+
+	if req.Method == http.MethodPost {
+		modTime, err := http.ParseTime(req.Header.Get("Last-Modified"))
+		if err != nil {
+			err = fmt.Errorf("%q: cannot parse Last-Modified of cache entry: %s", req.RemoteAddr, err)
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		body := http.MaxBytesReader(rw, req.Body, c.MaxEntrySize())
+		// Expired entries are silently dropped.
+		if err := c.StoreEntry(key, body, modTime); err != nil && err != cache.ErrMissing {
+			respondWith(rw, err, http.StatusBadRequest)
+		}
+		return
+	}
+
+	entry, modTime, err := c.ReadEntry(key)
+	if err == cache.ErrMissing {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	defer entry.Close()
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(rw, entry); err != nil {
+		log.Errorf("%q: cannot send cache entry to peer: %s", req.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/cache"
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCachePeersOwner(t *testing.T) {
+	cp := newCachePeers(config.CachePeers{
+		Self: "http://10.0.0.1:9090",
+		URLs: []string{"http://10.0.0.1:9090", "http://10.0.0.2:9090", "http://10.0.0.3:9090"},
+	})
+	owners := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := (&cache.Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}).String()
+		owner := cp.owner(key)
+		if owner != cp.owner(key) {
+			t.Fatalf("owner must be stable for the key %q", key)
+		}
+		owners[owner]++
+	}
+	for _, u := range []string{"http://10.0.0.1:9090", "http://10.0.0.2:9090", "http://10.0.0.3:9090"} {
+		if owners[u] < 500 {
+			t.Fatalf("too few keys owned by %q: %d out of 3000", u, owners[u])
+		}
+	}
+}
+
+func TestCachePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-cache-peers")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rp1, rp2 := &reverseProxy{}, &reverseProxy{}
+	srv1 := httptest.NewServer(http.HandlerFunc(rp1.serveCachePeer))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(http.HandlerFunc(rp2.serveCachePeer))
+	defer srv2.Close()
+
+	newPeer := func(rp *reverseProxy, self, secret string) (*cache.Cache, *cachePeers) {
+		c, err := cache.New(config.Cache{
+			Name:    "peered",
+			Dir:     filepath.Join(dir, filepath.Base(self)),
+			MaxSize: 1e6,
+			Expire:  config.Duration(time.Minute),
+		})
+		if err != nil {
+			t.Fatalf("cannot create cache: %s", err)
+		}
+		cp := newCachePeers(config.CachePeers{
+			Self:    self,
+			URLs:    []string{srv1.URL, srv2.URL},
+			Secret:  secret,
+			Timeout: config.Duration(time.Second),
+		})
+		rp.caches = map[string]*cache.Cache{"peered": c}
+		rp.cachePeers = map[string]*cachePeers{"peered": cp}
+		return c, cp
+	}
+	c1, cp1 := newPeer(rp1, srv1.URL, "secret")
+	defer c1.Close()
+	c2, _ := newPeer(rp2, srv2.URL, "secret")
+	defer c2.Close()
+
+	// Find the key owned by the second peer.
+	var key *cache.Key
+	for i := 0; ; i++ {
+		key = &cache.Key{Query: []byte(fmt.Sprintf("SELECT %d", i))}
+		if cp1.owner(key.String()) == srv2.URL {
+			break
+		}
+	}
+
+	if err := cp1.fetch(c1, key.String()); err != cache.ErrMissing {
+		t.Fatalf("unexpected error: %v; expecting %s", err, cache.ErrMissing)
+	}
+
+	// Responses cached by the first peer must be pushed to the owner.
+	crw, err := c1.NewResponseWriter(httptest.NewRecorder(), key)
+	if err != nil {
+		t.Fatalf("cannot create response writer: %s", err)
+	}
+	io.WriteString(crw, "cached value")
+	if err := crw.Commit(); err != nil {
+		t.Fatalf("cannot commit response: %s", err)
+	}
+	cp1.push(c1, key.String())
+
+	rw := httptest.NewRecorder()
+	if err := c2.WriteTo(rw, key); err != nil {
+		t.Fatalf("the entry must be pushed to the owning peer: %s", err)
+	}
+	if rw.Body.String() != "cached value" {
+		t.Fatalf("unexpected response: %q; expecting %q", rw.Body.String(), "cached value")
+	}
+
+	// The entry must be fetched from the owner by other peers.
+	c3, cp3 := newPeer(&reverseProxy{}, srv1.URL+"/other", "secret")
+	defer c3.Close()
+	cp3.self = srv1.URL
+	if err := cp3.fetch(c3, key.String()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rw = httptest.NewRecorder()
+	if err := c3.WriteTo(rw, key); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rw.Body.String() != "cached value" {
+		t.Fatalf("unexpected response: %q; expecting %q", rw.Body.String(), "cached value")
+	}
+
+	// Fetched entries must keep their age on the owner.
+	entry, modTime, err := c2.ReadEntry(key.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entry.Close()
+	entry, fetchedModTime, err := c3.ReadEntry(key.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	entry.Close()
+	if !fetchedModTime.Equal(modTime.Truncate(time.Second)) {
+		t.Fatalf("unexpected modification time of fetched entry: %s; expecting %s", fetchedModTime, modTime)
+	}
+
+	post := func(key string, body io.Reader, modTime time.Time) int {
+		t.Helper()
+		req, err := http.NewRequest("POST", cp1.entryURL(c1, key), body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		req.Header.Set(cachePeerSecretHeader, "secret")
+		req.Header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Expired entries mustn't be stored.
+	expiredKey := &cache.Key{Query: []byte("SELECT expired")}
+	if code := post(expiredKey.String(), strings.NewReader("foobar"), time.Now().Add(-time.Hour)); code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", code)
+	}
+	for _, c := range []*cache.Cache{c1, c2} {
+		if _, _, err := c.ReadEntry(expiredKey.String()); err != cache.ErrMissing {
+			t.Fatalf("unexpected error: %v; expecting %s", err, cache.ErrMissing)
+		}
+	}
+
+	// Entries exceeding the cache size must be rejected.
+	bigKey := &cache.Key{Query: []byte("SELECT big")}
+	if code := post(bigKey.String(), bytes.NewReader(make([]byte, 2e6)), time.Now()); code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d; expecting %d", code, http.StatusBadRequest)
+	}
+
+	// Peers with invalid secret must be rejected.
+	c4, cp4 := newPeer(&reverseProxy{}, srv1.URL+"/invalid", "invalid secret")
+	defer c4.Close()
+	cp4.self = srv1.URL
+	if err := cp4.fetch(c4, key.String()); err == nil || err == cache.ErrMissing {
+		t.Fatalf("expected error for invalid secret; got %v", err)
+	}
+}
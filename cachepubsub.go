@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// cachePubSubRetryInterval is the interval between attempts
+// to re-subscribe to the purge channel after errors.
+const cachePubSubRetryInterval = 5 * time.Second
+
+// cachePubSub broadcasts cache purges among chproxy instances
+// via Redis channel, so instances with local caches don't serve
+// entries purged on other instances.
+type cachePubSub struct {
+	client  *redisClient
+	channel string
+
+	// instanceID distinguishes purges of this instance
+	// from purges of other instances.
+	instanceID string
+}
+
+// cachePurgeEvent is the message sent to the purge channel.
+type cachePurgeEvent struct {
+	Instance string `json:"instance"`
+	Cache    string `json:"cache,omitempty"`
+
+	// Keys contains keys of the purged entries.
+	// All the cache entries are purged if Keys and Tables are empty.
+	Keys []string `json:"keys,omitempty"`
+
+	// Tables contains modified tables. Entries depending on them
+	// are purged from all the caches with `invalidate_on_writes`.
+	Tables []string `json:"tables,omitempty"`
+}
+
+// newCachePubSub returns cache pubsub for the given cfg.
+//
+// nil is returned if cache pubsub isn't configured.
+func newCachePubSub(cfg config.CachePubSub) *cachePubSub {
+	if len(cfg.RedisAddr) == 0 {
+		return nil
+	}
+	return &cachePubSub{
+		client:     newRedisClient(cfg.RedisAddr, cfg.RedisPassword, 0, time.Duration(cfg.Timeout)),
+		channel:    cfg.Channel,
+		instanceID: newInstanceID(),
+	}
+}
+
+// publish broadcasts the purge to other instances.
+func (ps *cachePubSub) publish(ev *cachePurgeEvent) {
+	if ps == nil {
+		return
+	}
+	ev.Instance = ps.instanceID
+	data, err := json.Marshal(ev)
+	if err != nil {
+		panic(fmt.Sprintf("BUG: cannot marshal cache purge event: %s", err))
+	}
+	if _, err := ps.client.doInt("PUBLISH", ps.channel, string(data)); err != nil {
+		cachePubSubErrors.Inc()
+		log.Errorf("cannot publish cache purge to redis channel %q: %s", ps.channel, err)
+	}
+}
+
+// run calls purge for purges received from other instances
+// until stopCh is closed.
+//
+// Purges published while the subscription is broken are lost,
+// so the affected entries live until they expire.
+func (ps *cachePubSub) run(stopCh <-chan struct{}, purge func(ev *cachePurgeEvent)) {
+	for {
+		err := ps.client.subscribe(ps.channel, stopCh, func(msg []byte) {
+			var ev cachePurgeEvent
+			if err := json.Unmarshal(msg, &ev); err != nil {
+				cachePubSubErrors.Inc()
+				log.Errorf("cannot parse cache purge event %q: %s", msg, err)
+				return
+			}
+			if ev.Instance == ps.instanceID {
+				// The purge is already applied locally.
+				return
+			}
+			purge(&ev)
+		})
+		if err == nil {
+			return
+		}
+		cachePubSubErrors.Inc()
+		log.Errorf("cannot receive cache purges from redis channel %q: %s; retrying in %s",
+			ps.channel, err, cachePubSubRetryInterval)
+		select {
+		case <-time.After(cachePubSubRetryInterval):
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// Close closes connections to Redis.
+func (ps *cachePubSub) Close() {
+	ps.client.Close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/cache"
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCachePubSub(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.close()
+
+	dir, err := ioutil.TempDir("", "chproxy-cache-pubsub")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Two proxies with local caches emulate two chproxy instances.
+	newProxy := func(dir string) *reverseProxy {
+		t.Helper()
+		p, err := newConfiguredProxy(&config.Config{
+			Caches: []config.Cache{
+				{
+					Name:      "dashboards",
+					Dir:       dir,
+					MaxSize:   config.ByteSize(1 << 20),
+					Expire:    config.Duration(time.Minute),
+					GraceTime: config.Duration(-1),
+				},
+			},
+			CachePubSub: config.CachePubSub{
+				RedisAddr: fr.addr(),
+				Channel:   "chproxy:cache-purge",
+				Timeout:   config.Duration(time.Second),
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return p
+	}
+	p1 := newProxy(dir + "/1")
+	defer close(p1.reloadSignal)
+	p2 := newProxy(dir + "/2")
+	defer close(p2.reloadSignal)
+
+	waitFor := func(msg string, f func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !f() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout while waiting for %s", msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor("subscriptions", func() bool {
+		fr.mu.Lock()
+		defer fr.mu.Unlock()
+		return len(fr.subscribers["chproxy:cache-purge"]) == 2
+	})
+
+	key := &cache.Key{
+		Query: []byte("SELECT 1"),
+	}
+	for _, p := range []*reverseProxy{p1, p2} {
+		crw, err := p.caches["dashboards"].NewResponseWriter(httptest.NewRecorder(), key)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := io.WriteString(crw, "1"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := crw.Commit(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	origProxy := proxy
+	proxy = p1
+	defer func() { proxy = origProxy }()
+	purge := func(form url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/-/cache/purge", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		serveCachePurge(rw, req)
+		return rw
+	}
+
+	rw := purge(url.Values{"cache": {"unknown"}})
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code for unknown cache: %d; expected: %d", rw.Code, http.StatusNotFound)
+	}
+
+	rw = purge(url.Values{"cache": {"dashboards"}, "key": {key.String()}})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d; response: %q", rw.Code, rw.Body.String())
+	}
+	var res cachePurge
+	if err := json.Unmarshal(rw.Body.Bytes(), &res); err != nil {
+		t.Fatalf("cannot parse purge response %q: %s", rw.Body.String(), err)
+	}
+	if res.Removed != 1 {
+		t.Fatalf("unexpected number of removed entries: %d; expected: 1", res.Removed)
+	}
+
+	// The purge must be applied by the other instance.
+	waitFor("purge on the other instance", func() bool {
+		return p2.caches["dashboards"].Stats().Items == 0
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/Vertamedia/chproxy/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cacheStatsPath is the path for serving stats of all the caches.
+const cacheStatsPath = "/-/cache/stats"
+
+// cacheStatus is an item of `/-/cache/stats` response.
+type cacheStatus struct {
+	Name    string `json:"name"`
+	Size    uint64 `json:"size"`
+	MaxSize uint64 `json:"max_size"`
+	Items   uint64 `json:"items"`
+
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Expired   uint64 `json:"expired"`
+	Stale     uint64 `json:"stale"`
+	Evictions uint64 `json:"evictions"`
+
+	// OldestItemAge is the age of the oldest item in seconds.
+	OldestItemAge float64 `json:"oldest_item_age"`
+
+	// ReclaimedTempBytes is the size of temporary files left
+	// by crashed process, which were removed on start.
+	ReclaimedTempBytes uint64 `json:"reclaimed_temp_bytes"`
+}
+
+// cacheStats returns stats of all the caches sorted by cache name.
+//
+// Counters are reset on config reload, since caches are re-created.
+func (rp *reverseProxy) cacheStats() []cacheStatus {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+
+	st := make([]cacheStatus, 0, len(rp.caches))
+	for _, c := range rp.caches {
+		st = append(st, newCacheStatus(c.Name, c.Stats()))
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	return st
+}
+
+func newCacheStatus(name string, s cache.Stats) cacheStatus {
+	return cacheStatus{
+		Name:          name,
+		Size:          s.Size,
+		MaxSize:       s.MaxSize,
+		Items:         s.Items,
+		Hits:          s.Hits,
+		Misses:        s.Misses,
+		Expired:       s.Expired,
+		Stale:         s.Stale,
+		Evictions:     s.Evictions,
+		OldestItemAge: s.OldestItemAge.Seconds(),
+
+		ReclaimedTempBytes: s.ReclaimedTempBytes,
+	}
+}
+
+// serveCacheStats returns stats of all the caches in JSON.
+func (rp *reverseProxy) serveCacheStats(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	enc.Encode(rp.cacheStats())
+}
+
+var (
+	cacheExpiredDesc = prometheus.NewDesc(
+		"cache_expired_total",
+		"The amount of lookups for expired cache entries",
+		[]string{"cache"}, nil,
+	)
+	cacheEvictionsDesc = prometheus.NewDesc(
+		"cache_evictions_total",
+		"The amount of cache entries removed in order to keep cache size under max_size",
+		[]string{"cache"}, nil,
+	)
+	cacheReclaimedTempBytesDesc = prometheus.NewDesc(
+		"cache_reclaimed_temp_bytes_total",
+		"The size of orphaned temporary files removed on cache start",
+		[]string{"cache"}, nil,
+	)
+)
+
+// cacheCollector exports counters maintained by caches.
+type cacheCollector struct{}
+
+// Describe implements prometheus.Collector.
+func (cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheExpiredDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheReclaimedTempBytesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, st := range proxy.cacheStats() {
+		ch <- prometheus.MustNewConstMetric(cacheExpiredDesc, prometheus.CounterValue, float64(st.Expired), st.Name)
+		ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(st.Evictions), st.Name)
+		ch <- prometheus.MustNewConstMetric(cacheReclaimedTempBytesDesc, prometheus.CounterValue, float64(st.ReclaimedTempBytes), st.Name)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestServeCacheStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, okResponse)
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chproxy-cache-stats")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newConfiguredProxy(&config.Config{
+		Caches: []config.Cache{
+			{
+				Name:    "shortterm",
+				Dir:     dir + "/shortterm",
+				MaxSize: config.ByteSize(1 << 20),
+				Expire:  config.Duration(time.Minute),
+			},
+			{
+				Name:    "longterm",
+				Dir:     dir + "/longterm",
+				MaxSize: config.ByteSize(1 << 30),
+				Expire:  config.Duration(time.Hour),
+			},
+		},
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Cache:     "shortterm",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", srv.URL, strings.NewReader("SELECT 1"))
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, http.StatusOK)
+		}
+	}
+
+	req := httptest.NewRequest("GET", cacheStatsPath, nil)
+	rw := httptest.NewRecorder()
+	p.serveCacheStats(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d; expected: %d; response: %q", rw.Code, http.StatusOK, rw.Body.String())
+	}
+	var st []cacheStatus
+	if err := json.Unmarshal(rw.Body.Bytes(), &st); err != nil {
+		t.Fatalf("cannot parse response %q: %s", rw.Body.String(), err)
+	}
+	if len(st) != 2 || st[0].Name != "longterm" || st[1].Name != "shortterm" {
+		t.Fatalf("unexpected cache stats: %+v; expecting stats of `longterm` and `shortterm` caches", st)
+	}
+	if st[0].MaxSize != 1<<30 || st[0].Hits != 0 || st[0].Misses != 0 {
+		t.Fatalf("unexpected `longterm` cache stats: %+v", st[0])
+	}
+	if st[1].MaxSize != 1<<20 || st[1].Hits != 1 || st[1].Misses != 1 || st[1].Items != 1 {
+		t.Fatalf("unexpected `shortterm` cache stats: %+v; expecting 1 hit, 1 miss and 1 item", st[1])
+	}
+
+	req = httptest.NewRequest("POST", cacheStatsPath, nil)
+	rw = httptest.NewRecorder()
+	p.serveCacheStats(rw, req)
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status code: %d; expected: %d", rw.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Vertamedia/chproxy/cache"
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/extension"
+)
+
+// checkConfig verifies cfg may be applied by reverseProxy.applyConfig.
+//
+// Unlike applyConfig, it doesn't initialize components with side effects
+// such as caches, Vault credentials, recorders and hooks, so it may be used
+// for validating configs before deploy. Users, clusters and param groups
+// are initialized in order to verify references between them.
+func checkConfig(cfg *config.Config) error {
+	for _, path := range cfg.Extensions.Plugins {
+		if err := extension.LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+
+	clusters, err := newClusters(cfg.Clusters)
+	if err != nil {
+		return err
+	}
+
+	// Caches aren't initialized, since they create directories.
+	// Users refer to them only by names.
+	caches := make(map[string]*cache.Cache, len(cfg.Caches))
+	cacheKeyers := make(map[string]extension.CacheKeyer)
+	for _, cc := range cfg.Caches {
+		if _, ok := caches[cc.Name]; ok {
+			return fmt.Errorf("duplicate config for cache %q", cc.Name)
+		}
+		caches[cc.Name] = &cache.Cache{Name: cc.Name}
+		if len(cc.Keyer) > 0 {
+			k := extension.GetCacheKeyer(cc.Keyer)
+			if k == nil {
+				return fmt.Errorf("unknown `keyer` %q for cache %q", cc.Keyer, cc.Name)
+			}
+			cacheKeyers[cc.Name] = k
+		}
+	}
+
+	params := make(map[string]*paramsRegistry, len(cfg.ParamGroups))
+	for _, p := range cfg.ParamGroups {
+		if _, ok := params[p.Name]; ok {
+			return fmt.Errorf("duplicate config for ParamGroups %q", p.Name)
+		}
+		params[p.Name], err = newParamsRegistry(p.Params)
+		if err != nil {
+			return fmt.Errorf("cannot initialize params %q: %s", p.Name, err)
+		}
+	}
+
+	if _, err := newJWTVerifier(cfg.JWT); err != nil {
+		return err
+	}
+	if _, err := newLDAPAuthenticator(cfg.Auth.LDAP); err != nil {
+		return err
+	}
+
+	profile := &usersProfile{
+		cfg:         cfg.Users,
+		clusters:    clusters,
+		caches:      caches,
+		cachePeers:  make(map[string]*cachePeers),
+		params:      params,
+		cacheKeyers: cacheKeyers,
+	}
+	_, err = profile.newUsers()
+	return err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policies for compressing responses set via `compression` user option.
+const (
+	// compressionPassthrough forwards compression negotiation of the client
+	// to ClickHouse and passes compressed responses untouched.
+	compressionPassthrough = "passthrough"
+
+	// compressionUpstream requests compressed responses from ClickHouse
+	// and decompresses them for clients not accepting gzip.
+	compressionUpstream = "upstream"
+
+	// compressionProxy requests uncompressed responses from ClickHouse
+	// and compresses them for clients accepting gzip.
+	compressionProxy = "proxy"
+
+	// compressionDisabled disables response compression.
+	compressionDisabled = "disabled"
+)
+
+// applyCompression adjusts compression negotiation of req and params
+// according to the user compression policy.
+func (s *scope) applyCompression(req *http.Request, params url.Values) {
+	switch s.user.compression {
+	case compressionUpstream:
+		params.Set("enable_http_compression", "1")
+		if acceptsGzip(req) {
+			req.Header.Set("Accept-Encoding", "gzip")
+		} else {
+			// http.Transport requests gzip and transparently decompresses
+			// the response if Accept-Encoding isn't set.
+			req.Header.Del("Accept-Encoding")
+		}
+	case compressionProxy:
+		s.compressResponse = acceptsGzip(req)
+		params.Del("enable_http_compression")
+		req.Header.Del("Accept-Encoding")
+	case compressionDisabled:
+		params.Del("enable_http_compression")
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// acceptsGzip returns true if the client accepts gzip-compressed responses.
+func acceptsGzip(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		v = strings.TrimSpace(v)
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			if strings.TrimSpace(v[i+1:]) == "q=0" {
+				continue
+			}
+			v = strings.TrimSpace(v[:i])
+		}
+		if v == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter compresses successful uncompressed responses.
+//
+// Close must be called after the response is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+
+	zw          *gzip.Writer
+	wroteHeader bool
+}
+
+func (gw *gzipResponseWriter) WriteHeader(statusCode int) {
+	if gw.wroteHeader {
+		return
+	}
+	gw.wroteHeader = true
+	h := gw.Header()
+	if statusCode == http.StatusOK && len(h.Get("Content-Encoding")) == 0 {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.zw = gzip.NewWriter(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.wroteHeader {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.zw == nil {
+		return gw.ResponseWriter.Write(b)
+	}
+	return gw.zw.Write(b)
+}
+
+// Close flushes the compressed response.
+func (gw *gzipResponseWriter) Close() error {
+	if gw.zw == nil {
+		return nil
+	}
+	return gw.zw.Close()
+}
+
+// CloseNotify implements http.CloseNotifier
+func (gw *gzipResponseWriter) CloseNotify() <-chan bool {
+	// The gw.ResponseWriter must implement http.CloseNotifier
+	return gw.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
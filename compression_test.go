@@ -0,0 +1,131 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCompressionPolicy(t *testing.T) {
+	// The server emulates ClickHouse compressing responses only if
+	// `enable_http_compression=1` is passed.
+	var upstreamCompressed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		upstreamCompressed = r.URL.Query().Get("enable_http_compression") == "1" &&
+			strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+		if !upstreamCompressed {
+			fmt.Fprint(w, "response")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		fmt.Fprint(zw, "response")
+		zw.Close()
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(compression, acceptEncoding, enableHTTPCompression string, expectedUpstreamCompressed, expectedCompressed bool) {
+		t.Helper()
+		p, err := newConfiguredProxy(&config.Config{
+			Clusters: []config.Cluster{
+				{
+					Name:   "cluster",
+					Scheme: "http",
+					Nodes:  []string{addr.Host},
+					ClusterUsers: []config.ClusterUser{
+						{
+							Name: "web",
+						},
+					},
+					HeartBeatInterval: config.Duration(time.Minute),
+				},
+			},
+			Users: []config.User{
+				{
+					Name:        "default",
+					ToCluster:   "cluster",
+					ToUser:      "web",
+					Compression: compression,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		uri := fmt.Sprintf("%s?enable_http_compression=%s", srv.URL, enableHTTPCompression)
+		req := httptest.NewRequest("POST", uri, strings.NewReader("SELECT 1"))
+		if len(acceptEncoding) > 0 {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, http.StatusOK)
+		}
+		if upstreamCompressed != expectedUpstreamCompressed {
+			t.Fatalf("unexpected upstream compression: %v; expecting %v", upstreamCompressed, expectedUpstreamCompressed)
+		}
+		compressed := resp.Header.Get("Content-Encoding") == "gzip"
+		if compressed != expectedCompressed {
+			t.Fatalf("unexpected response compression: %v; expecting %v", compressed, expectedCompressed)
+		}
+		body := resp.Body
+		if compressed {
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatalf("cannot decompress response: %s", err)
+			}
+		}
+		if s := bbToString(t, body); s != "response" {
+			t.Fatalf("unexpected response %q; expecting %q", s, "response")
+		}
+	}
+
+	f("", "gzip", "1", true, true)
+	f("", "gzip", "0", false, false)
+	f("passthrough", "", "1", true, false)
+
+	f("upstream", "", "0", true, false)
+	f("upstream", "gzip, deflate", "0", true, true)
+
+	f("proxy", "gzip", "1", false, true)
+	f("proxy", "gzip;q=0", "1", false, false)
+	f("proxy", "", "0", false, false)
+
+	f("disabled", "gzip", "1", false, false)
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	f := func(acceptEncoding string, expected bool) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "http://localhost", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		if acceptsGzip(req) != expected {
+			t.Fatalf("unexpected result for %q; expecting %v", acceptEncoding, expected)
+		}
+	}
+	f("", false)
+	f("gzip", true)
+	f("deflate, gzip;q=0.5", true)
+	f("gzip;q=0", false)
+	f("br", false)
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -34,6 +40,9 @@ type Config struct {
 	// Whether to print debug logs
 	LogDebug bool `yaml:"log_debug,omitempty"`
 
+	// Optional configuration for limiting repetitive error logs
+	ErrorLogSampling ErrorLogSampling `yaml:"error_log_sampling,omitempty"`
+
 	// Whether to ignore security warnings
 	HackMePlease bool `yaml:"hack_me_please,omitempty"`
 
@@ -43,18 +52,85 @@ type Config struct {
 
 	ParamGroups []ParamGroup `yaml:"param_groups,omitempty"`
 
+	// Optional continuous profiling configuration
+	Profiling Profiling `yaml:"profiling,omitempty"`
+
+	// Optional configuration for recording proxied requests
+	Recording Recording `yaml:"recording,omitempty"`
+
+	// Optional configuration for SPIFFE workload identity
+	SPIFFE SPIFFE `yaml:"spiffe,omitempty"`
+
+	// Optional configuration for caching decisions of external auth backends
+	AuthCache AuthCache `yaml:"auth_cache,omitempty"`
+
+	// Optional configuration for enforcing limits across chproxy instances
+	SharedLimiter SharedLimiter `yaml:"shared_limiter,omitempty"`
+
+	// Optional configuration for broadcasting cache purges
+	// among chproxy instances
+	CachePubSub CachePubSub `yaml:"cache_pubsub,omitempty"`
+
+	// Optional default settings for users and cluster users
+	Defaults Defaults `yaml:"defaults,omitempty"`
+
+	// Named bundles of user settings
+	Profiles []Profile `yaml:"profiles,omitempty"`
+
+	// External processes inspecting and modifying proxied requests
+	Hooks []Hook `yaml:"hooks,omitempty"`
+
+	// Optional configuration for Go extensions
+	Extensions Extensions `yaml:"extensions,omitempty"`
+
+	// Optional Vault server storing credentials of cluster users
+	Vault Vault `yaml:"vault,omitempty"`
+
+	// Optional configuration for verifying JWT bearer tokens
+	JWT JWT `yaml:"jwt,omitempty"`
+
+	// Optional external backends for authenticating users
+	Auth Auth `yaml:"auth,omitempty"`
+
+	// Optional configuration for session tokens issued by `/session` endpoint
+	Sessions Sessions `yaml:"sessions,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 
 	networkReg map[string]Networks
+
+	// maxResponseTime is derived from limits of users and cluster users
+	maxResponseTime time.Duration
+
+	// warnings contains non-fatal problems found in the config
+	warnings []string
 }
 
 // String implements the Stringer interface
 func (c *Config) String() string {
+	b, err := yaml.Marshal(c.withRawPasswords())
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// RedactedString returns the config in YAML with secrets
+// substituted by `***`, so it may be shown to operators.
+func (c *Config) RedactedString() string {
 	b, err := yaml.Marshal(c)
 	if err != nil {
 		panic(err)
 	}
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal(b, &root); err != nil {
+		panic(err)
+	}
+	redactSecrets(root)
+	if b, err = yaml.Marshal(root); err != nil {
+		panic(err)
+	}
 	return string(b)
 }
 
@@ -66,6 +142,9 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if err := c.applyDefaults(); err != nil {
+		return err
+	}
 	if len(c.Users) == 0 {
 		return fmt.Errorf("`users` must contain at least 1 user")
 	}
@@ -76,18 +155,126 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("neither HTTP nor HTTPS not configured")
 	}
 	if len(c.Server.HTTPS.ListenAddr) > 0 {
-		if len(c.Server.HTTPS.Autocert.CacheDir) == 0 && len(c.Server.HTTPS.CertFile) == 0 && len(c.Server.HTTPS.KeyFile) == 0 {
+		if len(c.Server.HTTPS.Autocert.CacheDir) == 0 && len(c.Server.HTTPS.CertFile) == 0 && len(c.Server.HTTPS.KeyFile) == 0 && !c.Server.HTTPS.SPIFFE {
 			return fmt.Errorf("configuration `https` is missing. " +
 				"Must be specified `https.cache_dir` for autocert " +
-				"OR `https.key_file` and `https.cert_file` for already existing certs")
+				"OR `https.key_file` and `https.cert_file` for already existing certs " +
+				"OR `https.spiffe` for SPIFFE workload identity")
 		}
 		if len(c.Server.HTTPS.Autocert.CacheDir) > 0 {
 			c.Server.HTTP.ForceAutocertHandler = true
 		}
 	}
+	if err := c.checkSPIFFE(); err != nil {
+		return err
+	}
+	for _, u := range c.Users {
+		if len(u.CertNames) > 0 && (len(c.Server.HTTPS.ClientCAFile) == 0 || len(c.Server.HTTPS.ListenAddr) == 0) {
+			return fmt.Errorf("`https.client_ca_file` must be set if `user.cert_names` is set for %q", u.Name)
+		}
+	}
+	for _, u := range c.Users {
+		if u.AllowJWT && len(c.JWT.JWKSURL) == 0 && len(c.JWT.KeyFile) == 0 {
+			return fmt.Errorf("`jwt` section must be configured if `user.allow_jwt` is set for %q", u.Name)
+		}
+	}
+	for _, m := range c.Auth.LDAP.GroupMappings {
+		found := false
+		for _, u := range c.Users {
+			if u.Name == m.User {
+				if u.IsWildcarded {
+					return fmt.Errorf("wildcarded user %q cannot be used in `auth.ldap.group_mappings`", m.User)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown `auth.ldap.group_mappings.user` %q", m.User)
+		}
+	}
+	for _, cl := range c.Clusters {
+		for _, cu := range cl.ClusterUsers {
+			if len(cu.VaultSecret) > 0 && len(c.Vault.Address) == 0 {
+				return fmt.Errorf("`vault` section must be configured if `cluster.user.vault_secret` is set for %q", cu.Name)
+			}
+		}
+	}
 	return checkOverflow(c.XXX, "config")
 }
 
+// applyDefaults applies c.Profiles and c.Defaults to users,
+// clusters and cluster users.
+//
+// User settings take precedence over profile settings, while profile
+// settings take precedence over defaults.
+//
+// Queue settings are validated after applying defaults, since they may
+// be partially set via profiles and defaults.
+func (c *Config) applyDefaults() error {
+	profiles := make(map[string]*Profile, len(c.Profiles))
+	for i := range c.Profiles {
+		p := &c.Profiles[i]
+		if _, ok := profiles[p.Name]; ok {
+			return fmt.Errorf("duplicate `profiles.name` %q", p.Name)
+		}
+		profiles[p.Name] = p
+	}
+	for i := range c.Users {
+		u := &c.Users[i]
+		if len(u.UserGroup) > 0 {
+			if len(u.Profile) > 0 && u.Profile != u.UserGroup {
+				return fmt.Errorf("`user_group` %q and `profile` %q cannot be simultaneously set for %q",
+					u.UserGroup, u.Profile, u.Name)
+			}
+			u.Profile = u.UserGroup
+		}
+		if len(u.Profile) > 0 {
+			p, ok := profiles[u.Profile]
+			if !ok {
+				return fmt.Errorf("unknown `profile` %q for %q", u.Profile, u.Name)
+			}
+			p.Settings.apply(u)
+		}
+		c.Defaults.User.apply(u)
+		if u.MaxQueueTime > 0 && u.MaxQueueSize == 0 {
+			return fmt.Errorf("`max_queue_size` must be set if `max_queue_time` is set for %q", u.Name)
+		}
+		if u.DenyHTTP && u.DenyHTTPS {
+			return fmt.Errorf("`deny_http` and `deny_https` cannot be simultaneously set to `true` for %q", u.Name)
+		}
+	}
+	for i := range c.Clusters {
+		c.Defaults.Cluster.apply(&c.Clusters[i])
+		for j := range c.Clusters[i].ClusterUsers {
+			cu := &c.Clusters[i].ClusterUsers[j]
+			c.Defaults.ClusterUser.apply(cu)
+			if cu.MaxQueueTime > 0 && cu.MaxQueueSize == 0 {
+				return fmt.Errorf("`max_queue_size` must be set if `max_queue_time` is set for %q", cu.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) checkSPIFFE() error {
+	spiffeConfigured := len(c.SPIFFE.CertFile) > 0
+	if c.Server.HTTPS.SPIFFE && !spiffeConfigured {
+		return fmt.Errorf("`spiffe` section must be configured if `https.spiffe` is set")
+	}
+	for _, cl := range c.Clusters {
+		if cl.SPIFFE && !spiffeConfigured {
+			return fmt.Errorf("`spiffe` section must be configured if `cluster.spiffe` is set for %q", cl.Name)
+		}
+	}
+	for _, u := range c.Users {
+		if len(u.SPIFFEIDs) > 0 && (!c.Server.HTTPS.SPIFFE || len(c.Server.HTTPS.ListenAddr) == 0) {
+			return fmt.Errorf("`https.spiffe` must be set if `user.spiffe_ids` is set for %q", u.Name)
+		}
+	}
+	return nil
+}
+
 // Server describes configuration of proxy server
 // These settings are immutable and can't be reloaded without restart
 type Server struct {
@@ -100,6 +287,36 @@ type Server struct {
 	// Optional metrics handler configuration
 	Metrics Metrics `yaml:"metrics,omitempty"`
 
+	// Optional admin endpoints configuration
+	// Admin endpoints are disabled if omitted
+	Admin Admin `yaml:"admin,omitempty"`
+
+	// Maximum number of concurrently proxied requests.
+	// Protects the proxy itself from overload before per-user
+	// limits are applied.
+	// if omitted or zero - no limits would be applied
+	MaxConcurrentRequests uint32 `yaml:"max_concurrent_requests,omitempty"`
+
+	// Maximum number of requests waiting for their chance to be proxied
+	// when MaxConcurrentRequests is reached.
+	// if omitted or zero - excess requests are rejected immediately
+	MaxQueueSize uint32 `yaml:"max_queue_size,omitempty"`
+
+	// Maximum duration the request may wait in the queue.
+	// This option makes sense only if MaxQueueSize is set.
+	// By default requests wait for up to 10 seconds in the queue.
+	MaxQueueTime Duration `yaml:"max_queue_time,omitempty"`
+
+	// Soft limit for the memory used by the proxy.
+	// Requests, which must wait in queues, are rejected
+	// while the memory usage exceeds 90% of the limit.
+	// if omitted or zero - no limits would be applied
+	MaxMemoryUsage ByteSize `yaml:"max_memory_usage,omitempty"`
+
+	// Optional configuration for client addresses passed
+	// by load balancers in front of the proxy
+	ProxyHeaders ProxyHeaders `yaml:"proxy_headers,omitempty"`
+
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -110,6 +327,12 @@ func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
+	if s.MaxQueueSize > 0 && s.MaxConcurrentRequests == 0 {
+		return fmt.Errorf("`server.max_concurrent_requests` must be set if `server.max_queue_size` is set")
+	}
+	if s.MaxQueueTime > 0 && s.MaxQueueSize == 0 {
+		return fmt.Errorf("`server.max_queue_size` must be set if `server.max_queue_time` is set")
+	}
 	return checkOverflow(s.XXX, "server")
 }
 
@@ -121,9 +344,14 @@ type TimeoutCfg struct {
 	ReadTimeout Duration `yaml:"read_timeout,omitempty"`
 
 	// WriteTimeout is the maximum duration before timing out writes of the response.
-	// Default is largest MaxExecutionTime + MaxQueueTime value from Users or Clusters
+	// Default is MaxResponseTime + 1m
 	WriteTimeout Duration `yaml:"write_timeout,omitempty"`
 
+	// MaxResponseTime is the maximum duration of responding to a request.
+	// It is used for deriving WriteTimeout if the latter isn't set.
+	// Default is largest MaxExecutionTime + MaxQueueTime value from Users or Clusters
+	MaxResponseTime Duration `yaml:"max_response_time,omitempty"`
+
 	// IdleTimeout is the maximum amount of time to wait for the next request.
 	// Default is 10m
 	IdleTimeout Duration `yaml:"idle_timeout,omitempty"`
@@ -131,6 +359,9 @@ type TimeoutCfg struct {
 
 // HTTP describes configuration for server to listen HTTP connections
 type HTTP struct {
+	// Optional name of the listener used in logs
+	Name string `yaml:"name,omitempty"`
+
 	// TCP address to listen to for http
 	ListenAddr string `yaml:"listen_addr"`
 
@@ -144,14 +375,41 @@ type HTTP struct {
 	// Whether to support Autocert handler for http-01 challenge
 	ForceAutocertHandler bool
 
+	// Whether to accept unencrypted HTTP/2 connections with prior knowledge
+	// along with HTTP/1.x connections.
+	// Requires chproxy built with Go 1.24 or newer
+	H2C bool `yaml:"h2c,omitempty"`
+
+	// User for requests without credentials accepted by the listener.
+	// Such requests are authorized as this user without password check,
+	// so the listener must be limited by `allowed_networks`.
+	// By default requests without credentials are treated as `default` user requests.
+	DefaultUser string `yaml:"default_user,omitempty"`
+
+	// Whether requests without credentials must be rejected
+	RequireAuth bool `yaml:"require_auth,omitempty"`
+
 	TimeoutCfg `yaml:",inline"`
 
+	// Additional listeners if `http` is configured as a list.
+	// The first listener of the list is described by HTTP itself.
+	ExtraListeners []HTTP `yaml:"-"`
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
+//
+// `http` may be either a single listener or a list of listeners.
 func (c *HTTP) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	if _, ok := v.([]interface{}); ok {
+		return c.unmarshalListeners(unmarshal)
+	}
 	type plain HTTP
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
@@ -162,9 +420,64 @@ func (c *HTTP) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if c.IdleTimeout == 0 {
 		c.IdleTimeout = Duration(time.Minute * 10)
 	}
+	if len(c.DefaultUser) > 0 && c.RequireAuth {
+		return fmt.Errorf("`default_user` and `require_auth` cannot be set simultaneously for http listener on %q", c.ListenAddr)
+	}
 	return checkOverflow(c.XXX, "http")
 }
 
+func (c *HTTP) unmarshalListeners(unmarshal func(interface{}) error) error {
+	var listeners []HTTP
+	if err := unmarshal(&listeners); err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return fmt.Errorf("`http` must contain at least 1 listener")
+	}
+	addrs := make(map[string]bool, len(listeners))
+	names := make(map[string]bool, len(listeners))
+	for _, l := range listeners {
+		if len(l.ListenAddr) == 0 {
+			return fmt.Errorf("`listen_addr` must be set for each `http` listener")
+		}
+		if addrs[l.ListenAddr] {
+			return fmt.Errorf("duplicate `http.listen_addr` %q", l.ListenAddr)
+		}
+		addrs[l.ListenAddr] = true
+		if len(l.Name) == 0 {
+			continue
+		}
+		if names[l.Name] {
+			return fmt.Errorf("duplicate `http.name` %q", l.Name)
+		}
+		names[l.Name] = true
+	}
+	*c = listeners[0]
+	c.ExtraListeners = listeners[1:]
+	return nil
+}
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (c HTTP) MarshalYAML() (interface{}, error) {
+	type plain HTTP
+	if len(c.ExtraListeners) == 0 {
+		return plain(c), nil
+	}
+	listeners := make([]plain, 0, len(c.ExtraListeners)+1)
+	for _, l := range c.AllListeners() {
+		listeners = append(listeners, plain(l))
+	}
+	return listeners, nil
+}
+
+// AllListeners returns configs of all the http listeners
+// starting from the first one.
+func (c HTTP) AllListeners() []HTTP {
+	first := c
+	first.ExtraListeners = nil
+	return append([]HTTP{first}, c.ExtraListeners...)
+}
+
 // HTTPS describes configuration for server to listen HTTPS connections
 // It can be autocert with letsencrypt
 // or custom certificate
@@ -179,6 +492,28 @@ type HTTPS struct {
 
 	Autocert Autocert `yaml:"autocert,omitempty"`
 
+	// Whether to use SPIFFE X.509-SVID as the server certificate
+	// and to verify client certificates against the SPIFFE trust bundle.
+	// Requires `spiffe` section
+	SPIFFE bool `yaml:"spiffe,omitempty"`
+
+	// Whether to negotiate HTTP/2 with clients via ALPN
+	HTTP2 bool `yaml:"http2,omitempty"`
+
+	// Path to PEM file with CA certificates for verifying client certificates.
+	// Verified client certificates may authorize users via `cert_names`
+	ClientCAFile string `yaml:"client_ca_file,omitempty"`
+
+	// Whether to reject connections without valid client certificate.
+	// Requires ClientCAFile
+	RequireClientCert bool `yaml:"require_client_cert,omitempty"`
+
+	// TLS protocol settings such as versions and cipher suites
+	TLS TLS `yaml:"tls,omitempty"`
+
+	// Headers such as HSTS added to all the responses
+	SecurityHeaders SecurityHeaders `yaml:"security_headers,omitempty"`
+
 	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
 
 	// List of networks that access is allowed from
@@ -216,15 +551,63 @@ func (c *HTTPS) UnmarshalYAML(unmarshal func(interface{}) error) error {
 				"Otherwise, certificates will be impossible to generate")
 		}
 	}
+	if c.SPIFFE && (len(c.Autocert.CacheDir) > 0 || len(c.CertFile) > 0) {
+		return fmt.Errorf("it is forbidden to specify `https.spiffe` with certificate or `https.autocert` at the same time. Choose one way")
+	}
+	if c.SPIFFE && len(c.ClientCAFile) > 0 {
+		return fmt.Errorf("`https.client_ca_file` cannot be set together with `https.spiffe`, since client SVIDs are verified against the SPIFFE trust bundle")
+	}
+	if c.RequireClientCert && len(c.ClientCAFile) == 0 {
+		return fmt.Errorf("`https.client_ca_file` must be set if `https.require_client_cert` is set")
+	}
 	if len(c.CertFile) > 0 && len(c.KeyFile) == 0 {
 		return fmt.Errorf("`https.key_file` must be specified")
 	}
 	if len(c.KeyFile) > 0 && len(c.CertFile) == 0 {
 		return fmt.Errorf("`https.cert_file` must be specified")
 	}
+	if t := c.TLS; len(t.CAFile) > 0 || len(t.CertFile) > 0 || len(t.ServerName) > 0 || t.InsecureSkipVerify {
+		return fmt.Errorf("`https.tls` may contain only protocol settings; " +
+			"`ca_file`, `cert_file`, `key_file`, `server_name` and `insecure_skip_verify` are allowed only for clusters")
+	}
 	return checkOverflow(c.XXX, "https")
 }
 
+// SecurityHeaders describes headers added to responses of https listener
+type SecurityHeaders struct {
+	// Max age for Strict-Transport-Security header
+	// if omitted or zero - the header isn't sent
+	HSTSMaxAge Duration `yaml:"hsts_max_age,omitempty"`
+
+	// Whether to add includeSubDomains and preload directives
+	// to Strict-Transport-Security header
+	HSTSIncludeSubdomains bool `yaml:"hsts_include_subdomains,omitempty"`
+	HSTSPreload           bool `yaml:"hsts_preload,omitempty"`
+
+	// Arbitrary headers such as X-Content-Type-Options
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (sh *SecurityHeaders) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SecurityHeaders
+	if err := unmarshal((*plain)(sh)); err != nil {
+		return err
+	}
+	if sh.HSTSMaxAge == 0 && (sh.HSTSIncludeSubdomains || sh.HSTSPreload) {
+		return fmt.Errorf("`security_headers.hsts_max_age` must be set if `hsts_include_subdomains` or `hsts_preload` is set")
+	}
+	for k := range sh.Headers {
+		if strings.EqualFold(k, "Strict-Transport-Security") {
+			return fmt.Errorf("`security_headers.headers` cannot contain %q; use `hsts_max_age` instead", k)
+		}
+	}
+	return checkOverflow(sh.XXX, "security_headers")
+}
+
 // Autocert configuration via letsencrypt
 // It requires port :80 to be open
 // see https://community.letsencrypt.org/t/2018-01-11-update-regarding-acme-tls-sni-and-shared-hosting-infrastructure/50188
@@ -249,6 +632,135 @@ func (c *Autocert) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(c.XXX, "autocert")
 }
 
+// TLS describes TLS protocol settings
+type TLS struct {
+	// Minimum and maximum TLS versions: `1.0`, `1.1` or `1.2`
+	// if omitted - Go defaults are used
+	MinVersion string `yaml:"min_version,omitempty"`
+	MaxVersion string `yaml:"max_version,omitempty"`
+
+	// List of enabled cipher suites, for example `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`
+	// if omitted - Go defaults are used
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+
+	// List of elliptic curves in preference order:
+	// `P256`, `P384`, `P521` or `X25519`
+	// if omitted - defaults are used
+	CurvePreferences []string `yaml:"curve_preferences,omitempty"`
+
+	// The options below may be set only for connections to cluster nodes.
+
+	// Path to PEM file with CA certificates for verifying cluster nodes
+	// if omitted - system CA certificates are used
+	CAFile string `yaml:"ca_file,omitempty"`
+
+	// Certificate and key files presented to cluster nodes
+	CertFile string `yaml:"cert_file,omitempty"`
+	KeyFile  string `yaml:"key_file,omitempty"`
+
+	// Server name for SNI and for verifying node certificates
+	// if omitted - node host is used
+	ServerName string `yaml:"server_name,omitempty"`
+
+	// Whether to skip verification of node certificates
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+
+	// Parsed MinVersion, MaxVersion, CipherSuites and CurvePreferences
+	MinVersionID       uint16        `yaml:"-"`
+	MaxVersionID       uint16        `yaml:"-"`
+	CipherSuiteIDs     []uint16      `yaml:"-"`
+	CurvePreferenceIDs []tls.CurveID `yaml:"-"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+	}
+
+	tlsCipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_RC4_128_SHA":                tls.TLS_RSA_WITH_RC4_128_SHA,
+		"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_RC4_128_SHA":        tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_RC4_128_SHA":          tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+		"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+
+	tlsCurves = map[string]tls.CurveID{
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+		"X25519": tls.X25519,
+	}
+)
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (t *TLS) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLS
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+	if len(t.MinVersion) > 0 {
+		v, ok := tlsVersions[t.MinVersion]
+		if !ok {
+			return fmt.Errorf("`tls.min_version` must be `1.0`, `1.1` or `1.2`, got %q instead", t.MinVersion)
+		}
+		t.MinVersionID = v
+	}
+	if len(t.MaxVersion) > 0 {
+		v, ok := tlsVersions[t.MaxVersion]
+		if !ok {
+			return fmt.Errorf("`tls.max_version` must be `1.0`, `1.1` or `1.2`, got %q instead", t.MaxVersion)
+		}
+		t.MaxVersionID = v
+	}
+	if t.MinVersionID > 0 && t.MaxVersionID > 0 && t.MinVersionID > t.MaxVersionID {
+		return fmt.Errorf("`tls.min_version` cannot be greater than `tls.max_version`")
+	}
+	for _, name := range t.CipherSuites {
+		id, ok := tlsCipherSuites[name]
+		if !ok {
+			return fmt.Errorf("unknown `tls.cipher_suites` item %q", name)
+		}
+		t.CipherSuiteIDs = append(t.CipherSuiteIDs, id)
+	}
+	for _, name := range t.CurvePreferences {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return fmt.Errorf("unknown `tls.curve_preferences` item %q", name)
+		}
+		t.CurvePreferenceIDs = append(t.CurvePreferenceIDs, id)
+	}
+	if len(t.CertFile) > 0 && len(t.KeyFile) == 0 {
+		return fmt.Errorf("`tls.key_file` must be specified")
+	}
+	if len(t.KeyFile) > 0 && len(t.CertFile) == 0 {
+		return fmt.Errorf("`tls.cert_file` must be specified")
+	}
+	return checkOverflow(t.XXX, "tls")
+}
+
 // Metrics describes configuration to access metrics endpoint
 type Metrics struct {
 	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
@@ -271,327 +783,2454 @@ func (c *Metrics) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return checkOverflow(c.XXX, "metrics")
 }
 
-// Cluster describes CH cluster configuration
-// The simplest configuration consists of:
-// 	 cluster description - see <remote_servers> section in CH config.xml
-// 	 and users - see <users> section in CH users.xml
-type Cluster struct {
-	// Name of ClickHouse cluster
-	Name string `yaml:"name"`
+// ProxyHeaders describes configuration for obtaining client addresses
+// from `X-Forwarded-For` and `X-Real-IP` headers
+type ProxyHeaders struct {
+	NetworksOrGroups NetworksOrGroups `yaml:"trusted_proxies,omitempty"`
 
-	// Scheme: `http` or `https`; would be applied to all nodes
-	// default value is `http`
-	Scheme string `yaml:"scheme,omitempty"`
+	// List of networks of proxies trusted to pass client addresses
+	// Each list item could be IP address or subnet mask
+	// if omitted or zero - the headers are ignored
+	TrustedProxies Networks `yaml:"-"`
 
-	// Nodes contains cluster nodes.
-	//
-	// Either Nodes or Replicas must be set, but not both.
-	Nodes []string `yaml:"nodes,omitempty"`
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
 
-	// Replicas contains replicas.
-	//
-	// Either Replicas or Nodes must be set, but not both.
-	Replicas []Replica `yaml:"replicas,omitempty"`
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ph *ProxyHeaders) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ProxyHeaders
+	if err := unmarshal((*plain)(ph)); err != nil {
+		return err
+	}
+	return checkOverflow(ph.XXX, "proxy_headers")
+}
 
-	// ClusterUsers - list of ClickHouse users
-	ClusterUsers []ClusterUser `yaml:"users"`
+// Profiling describes configuration for continuous profiling.
+// Profiles are periodically collected and written to Dir
+// and/or pushed to PushURL.
+// These settings are immutable and can't be reloaded without restart
+type Profiling struct {
+	// Interval between profiles collection
+	// if omitted or zero - interval will be set to 1m
+	Interval Duration `yaml:"interval,omitempty"`
 
-	// KillQueryUser - user configuration for killing timed out queries.
-	// By default timed out queries are killed under `default` user.
-	KillQueryUser KillQueryUser `yaml:"kill_query_user,omitempty"`
+	// Duration of CPU profile collection
+	// if omitted or zero - duration will be set to 10s
+	CPUDuration Duration `yaml:"cpu_duration,omitempty"`
 
-	// HeartBeatInterval is an interval of checking
-	// all cluster nodes for availability
-	// if omitted or zero - interval will be set to 5s
-	HeartBeatInterval Duration `yaml:"heartbeat_interval,omitempty"`
+	// Path to directory where profiles are written
+	Dir string `yaml:"dir,omitempty"`
+
+	// Profiles in Dir older than Retention are removed
+	// if omitted or zero - retention will be set to 24h
+	Retention Duration `yaml:"retention,omitempty"`
+
+	// URL of Pyroscope server profiles are pushed to
+	PushURL string `yaml:"push_url,omitempty"`
+
+	// Application name used for pushed profiles
+	// if omitted - `chproxy` is used
+	AppName string `yaml:"app_name,omitempty"`
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	*c = defaultCluster
-	type plain Cluster
-	if err := unmarshal((*plain)(c)); err != nil {
+func (p *Profiling) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Profiling
+	if err := unmarshal((*plain)(p)); err != nil {
 		return err
 	}
-	if len(c.Name) == 0 {
-		return fmt.Errorf("`cluster.name` cannot be empty")
+	if len(p.Dir) == 0 && len(p.PushURL) == 0 {
+		return fmt.Errorf("either `profiling.dir` or `profiling.push_url` must be set")
 	}
-	if len(c.Nodes) == 0 && len(c.Replicas) == 0 {
-		return fmt.Errorf("either `cluster.nodes` or `cluster.replicas` must be set for %q", c.Name)
+	if len(p.PushURL) > 0 {
+		u, err := url.Parse(p.PushURL)
+		if err != nil {
+			return fmt.Errorf("cannot parse `profiling.push_url` %q: %s", p.PushURL, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("`profiling.push_url` scheme must be `http` or `https`, got %q instead", u.Scheme)
+		}
 	}
-	if len(c.Nodes) > 0 && len(c.Replicas) > 0 {
-		return fmt.Errorf("`cluster.nodes` cannot be simultaneously set with `cluster.replicas` for %q", c.Name)
+	if p.Interval == 0 {
+		p.Interval = Duration(time.Minute)
 	}
-	if len(c.ClusterUsers) == 0 {
-		return fmt.Errorf("`cluster.users` must contain at least 1 user for %q", c.Name)
+	if p.CPUDuration == 0 {
+		p.CPUDuration = Duration(10 * time.Second)
 	}
-	if c.Scheme != "http" && c.Scheme != "https" {
-		return fmt.Errorf("`cluster.scheme` must be `http` or `https`, got %q instead for %q", c.Scheme, c.Name)
+	if p.CPUDuration >= p.Interval {
+		return fmt.Errorf("`profiling.cpu_duration` must be less than `profiling.interval`")
 	}
-	if c.HeartBeatInterval == 0 {
-		c.HeartBeatInterval = Duration(time.Second * 5)
+	if p.Retention == 0 {
+		p.Retention = Duration(24 * time.Hour)
 	}
-	return checkOverflow(c.XXX, fmt.Sprintf("cluster %q", c.Name))
+	if len(p.AppName) == 0 {
+		p.AppName = "chproxy"
+	}
+	return checkOverflow(p.XXX, "profiling")
 }
 
-// Replica contains ClickHouse replica configuration.
-type Replica struct {
-	// Name is replica name.
-	Name string `yaml:"name"`
+// Recording describes configuration for recording proxied requests,
+// which may be replayed later via `chproxy replay` command.
+//
+// Only sanitized requests are recorded - credentials and params,
+// which aren't proxied to ClickHouse, are dropped.
+type Recording struct {
+	// Path to the file where requests are recorded
+	File string `yaml:"file"`
 
-	// Nodes contains replica nodes.
-	Nodes []string `yaml:"nodes"`
+	// Requests with bodies exceeding MaxQuerySize aren't recorded
+	// if omitted or zero - 64Kb is used
+	MaxQuerySize ByteSize `yaml:"max_query_size,omitempty"`
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (r *Replica) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain Replica
+func (r *Recording) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Recording
 	if err := unmarshal((*plain)(r)); err != nil {
 		return err
 	}
-	if len(r.Name) == 0 {
-		return fmt.Errorf("`replica.name` cannot be empty")
+	if len(r.File) == 0 {
+		return fmt.Errorf("`recording.file` must be specified")
 	}
-	if len(r.Nodes) == 0 {
-		return fmt.Errorf("`replica.nodes` cannot be empty for %q", r.Name)
+	if r.MaxQuerySize == 0 {
+		r.MaxQuerySize = 64 << 10
 	}
-	return checkOverflow(r.XXX, fmt.Sprintf("replica %q", r.Name))
+	return checkOverflow(r.XXX, "recording")
 }
 
-// KillQueryUser - user configuration for killing timed out queries.
-type KillQueryUser struct {
-	// User name
-	Name string `yaml:"name"`
+// SPIFFE describes configuration for SPIFFE workload identity.
+// X.509-SVID and trust bundle are read from files, which are kept
+// up to date by SPIFFE helper connected to the Workload API socket.
+// These settings are immutable and can't be reloaded without restart
+type SPIFFE struct {
+	// Path to the file with X.509-SVID certificate chain
+	CertFile string `yaml:"cert_file"`
 
-	// User password to access CH with basic auth
-	Password string `yaml:"password,omitempty"`
+	// Path to the file with X.509-SVID private key
+	KeyFile string `yaml:"key_file"`
+
+	// Path to the file with trust bundle certificates
+	BundleFile string `yaml:"bundle_file"`
+
+	// Interval for re-reading the files in order to pick up rotated SVIDs
+	// if omitted or zero - interval will be set to 10s
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (u *KillQueryUser) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain KillQueryUser
-	if err := unmarshal((*plain)(u)); err != nil {
+func (s *SPIFFE) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SPIFFE
+	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
-	if len(u.Name) == 0 {
-		return fmt.Errorf("`cluster.kill_query_user.name` must be specified")
+	if len(s.CertFile) == 0 || len(s.KeyFile) == 0 || len(s.BundleFile) == 0 {
+		return fmt.Errorf("`spiffe.cert_file`, `spiffe.key_file` and `spiffe.bundle_file` must be specified")
+	}
+	if s.RefreshInterval == 0 {
+		s.RefreshInterval = Duration(10 * time.Second)
+	}
+	return checkOverflow(s.XXX, "spiffe")
+}
+
+// AuthCache describes configuration for caching authentication
+// decisions made by external auth backends
+type AuthCache struct {
+	// Duration for caching successful authentication
+	// if omitted or zero - 1m is used
+	PositiveTTL Duration `yaml:"positive_ttl,omitempty"`
+
+	// Duration for caching failed authentication
+	// if omitted or zero - 10s is used
+	NegativeTTL Duration `yaml:"negative_ttl,omitempty"`
+
+	// Maximum number of cached decisions
+	// if omitted or zero - 10000 is used
+	MaxEntries int `yaml:"max_entries,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ac *AuthCache) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain AuthCache
+	if err := unmarshal((*plain)(ac)); err != nil {
+		return err
+	}
+	if ac.PositiveTTL == 0 {
+		ac.PositiveTTL = Duration(time.Minute)
+	}
+	if ac.NegativeTTL == 0 {
+		ac.NegativeTTL = Duration(10 * time.Second)
+	}
+	if ac.MaxEntries < 0 {
+		return fmt.Errorf("`auth_cache.max_entries` cannot be negative")
+	}
+	if ac.MaxEntries == 0 {
+		ac.MaxEntries = 10000
+	}
+	return checkOverflow(ac.XXX, "auth_cache")
+}
+
+// ErrorLogSampling describes configuration for limiting repetitive
+// error logs
+type ErrorLogSampling struct {
+	// Maximum number of errors logged at the same place during the interval.
+	// The remaining errors are summarized at the end of the interval
+	// if omitted or zero - 10 is used
+	Burst int `yaml:"burst,omitempty"`
+
+	// Interval for counting and summarizing errors
+	// if omitted or zero - 1m is used
+	Interval Duration `yaml:"interval,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (els *ErrorLogSampling) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ErrorLogSampling
+	if err := unmarshal((*plain)(els)); err != nil {
+		return err
+	}
+	if els.Burst < 0 {
+		return fmt.Errorf("`error_log_sampling.burst` cannot be negative")
+	}
+	if els.Burst == 0 {
+		els.Burst = 10
+	}
+	if els.Interval == 0 {
+		els.Interval = Duration(time.Minute)
+	}
+	return checkOverflow(els.XXX, "error_log_sampling")
+}
+
+// SharedLimiter describes configuration for enforcing limits
+// globally across chproxy instances via Redis
+type SharedLimiter struct {
+	// Address of Redis server, for example `redis.local:6379`
+	RedisAddr string `yaml:"redis_addr"`
+
+	// Optional password for Redis AUTH.
+	// `${VAR}` references are substituted with environment variable values
+	RedisPassword string `yaml:"redis_password,omitempty"`
+
+	// Redis database number
+	RedisDB int `yaml:"redis_db,omitempty"`
+
+	// Prefix for keys stored in Redis
+	// if omitted - `chproxy:` is used
+	KeyPrefix string `yaml:"key_prefix,omitempty"`
+
+	// Timeout for Redis operations. Local limits are applied
+	// if Redis doesn't respond in time
+	// if omitted or zero - 1s is used
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// Whether to coordinate `max_concurrent_queries` of cluster users
+	// across chproxy instances
+	CoordinateConcurrentQueries bool `yaml:"coordinate_concurrent_queries,omitempty"`
+
+	// Duration after which query slots of crashed instances are released.
+	// Must exceed the maximum query duration
+	// if omitted or zero - 1h is used
+	QueryLease Duration `yaml:"query_lease,omitempty"`
+
+	// RedisPassword value from the config file
+	rawRedisPassword string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (sl *SharedLimiter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SharedLimiter
+	if err := unmarshal((*plain)(sl)); err != nil {
+		return err
+	}
+	if len(sl.RedisAddr) == 0 {
+		return fmt.Errorf("`shared_limiter.redis_addr` must be specified")
+	}
+	if sl.RedisDB < 0 {
+		return fmt.Errorf("`shared_limiter.redis_db` cannot be negative")
+	}
+	if len(sl.KeyPrefix) == 0 {
+		sl.KeyPrefix = "chproxy:"
+	}
+	if sl.Timeout == 0 {
+		sl.Timeout = Duration(time.Second)
+	}
+	if sl.QueryLease == 0 {
+		sl.QueryLease = Duration(time.Hour)
+	}
+	return checkOverflow(sl.XXX, "shared_limiter")
+}
+
+// CachePubSub describes Redis channel for broadcasting cache purges
+// among chproxy instances with local caches
+type CachePubSub struct {
+	// Address of Redis server, for example `redis.local:6379`
+	RedisAddr string `yaml:"redis_addr"`
+
+	// Optional password for Redis AUTH.
+	// `${VAR}` references are substituted with environment variable values
+	RedisPassword string `yaml:"redis_password,omitempty"`
+
+	// Redis channel for purge events
+	// if omitted - `chproxy:cache-purge` is used
+	Channel string `yaml:"channel,omitempty"`
+
+	// Timeout for publishing purge events and for connecting to Redis
+	// if omitted or zero - 1s is used
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// RedisPassword value from the config file
+	rawRedisPassword string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ps *CachePubSub) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CachePubSub
+	if err := unmarshal((*plain)(ps)); err != nil {
+		return err
+	}
+	if len(ps.RedisAddr) == 0 {
+		return fmt.Errorf("`cache_pubsub.redis_addr` must be specified")
+	}
+	if len(ps.Channel) == 0 {
+		ps.Channel = "chproxy:cache-purge"
+	}
+	if ps.Timeout == 0 {
+		ps.Timeout = Duration(time.Second)
+	}
+	return checkOverflow(ps.XXX, "cache_pubsub")
+}
+
+// Vault describes HashiCorp Vault server storing credentials of cluster users
+type Vault struct {
+	// Vault server address, for example `https://vault.local:8200`
+	Address string `yaml:"address"`
+
+	// Token for accessing Vault.
+	// `${VAR}` references are substituted with environment variable values
+	Token string `yaml:"token,omitempty"`
+
+	// Path to file containing the token, for example Vault agent sink.
+	// The file is re-read before each request to Vault.
+	// Cannot be set together with Token
+	TokenFile string `yaml:"token_file,omitempty"`
+
+	// Vault Enterprise namespace
+	Namespace string `yaml:"namespace,omitempty"`
+
+	// Path to PEM file with CA certificates for verifying Vault server
+	// if omitted - system CA certificates are used
+	CAFile string `yaml:"ca_file,omitempty"`
+
+	// Interval for re-reading secrets without leases such as KV secrets
+	// if omitted or zero - interval will be set to 5m
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+
+	// Timeout for requests to Vault
+	// if omitted or zero - timeout will be set to 10s
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// Token value from the config file
+	rawToken string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (v *Vault) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Vault
+	if err := unmarshal((*plain)(v)); err != nil {
+		return err
+	}
+	if len(v.Address) == 0 {
+		return fmt.Errorf("`vault.address` must be specified")
+	}
+	if len(v.Token) > 0 && len(v.TokenFile) > 0 {
+		return fmt.Errorf("`vault.token` and `vault.token_file` cannot be set simultaneously")
+	}
+	if len(v.Token) == 0 && len(v.TokenFile) == 0 {
+		return fmt.Errorf("either `vault.token` or `vault.token_file` must be specified")
+	}
+	if v.RefreshInterval == 0 {
+		v.RefreshInterval = Duration(5 * time.Minute)
+	}
+	if v.Timeout == 0 {
+		v.Timeout = Duration(10 * time.Second)
+	}
+	return checkOverflow(v.XXX, "vault")
+}
+
+// Defaults describes default settings for users, clusters and cluster users.
+//
+// Defaults are applied to settings, which are omitted or zero.
+type Defaults struct {
+	// Default settings for `users`
+	User UserDefaults `yaml:"user,omitempty"`
+
+	// Default settings for `clusters`
+	Cluster ClusterDefaults `yaml:"cluster,omitempty"`
+
+	// Default settings for `users` of all the clusters
+	ClusterUser ClusterUserDefaults `yaml:"cluster_user,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (d *Defaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Defaults
+	if err := unmarshal((*plain)(d)); err != nil {
+		return err
+	}
+	return checkOverflow(d.XXX, "defaults")
+}
+
+// UserDefaults describes default settings for users
+//
+// Fields have the same meaning as the corresponding User fields.
+type UserDefaults struct {
+	MaxConcurrentQueries uint32   `yaml:"max_concurrent_queries,omitempty"`
+	MaxExecutionTime     Duration `yaml:"max_execution_time,omitempty"`
+	ReqPerMin            uint32   `yaml:"requests_per_minute,omitempty"`
+	MaxQueueSize         uint32   `yaml:"max_queue_size,omitempty"`
+	MaxQueueTime         Duration `yaml:"max_queue_time,omitempty"`
+	Cache                string   `yaml:"cache,omitempty"`
+	CacheKeyNamespace    string   `yaml:"cache_key_namespace,omitempty"`
+	Params               string   `yaml:"params,omitempty"`
+
+	// Access restrictions. Lists set on the user level replace the lists
+	// set here, while `deny_http` and `deny_https` apply if they are set
+	// either on the user level or here
+	NetworksOrGroups   NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+	DenyHTTP           bool             `yaml:"deny_http,omitempty"`
+	DenyHTTPS          bool             `yaml:"deny_https,omitempty"`
+	AllowedPaths       []string         `yaml:"allowed_paths,omitempty"`
+	DeniedStatements   []string         `yaml:"denied_statements,omitempty"`
+	DatabasePrefix     string           `yaml:"database_prefix,omitempty"`
+	AllowedDatabases   []string         `yaml:"allowed_databases,omitempty"`
+	AllowedTables      []string         `yaml:"allowed_tables,omitempty"`
+	DeniedTables       []string         `yaml:"denied_tables,omitempty"`
+	AllowQueryPatterns []string         `yaml:"allow_query_patterns,omitempty"`
+	DenyQueryPatterns  []string         `yaml:"deny_query_patterns,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ud *UserDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain UserDefaults
+	if err := unmarshal((*plain)(ud)); err != nil {
+		return err
+	}
+	if err := ud.validate(); err != nil {
+		return err
+	}
+	return checkOverflow(ud.XXX, "defaults.user")
+}
+
+// validate checks settings, which may be inherited by users.
+//
+// It is called explicitly for settings inlined into profiles,
+// since their UnmarshalYAML isn't called.
+func (ud *UserDefaults) validate() error {
+	if err := checkAllowedPaths(ud.AllowedPaths); err != nil {
+		return err
+	}
+	if err := checkDeniedStatements(ud.DeniedStatements); err != nil {
+		return err
+	}
+	if len(ud.DatabasePrefix) > 0 && len(ud.AllowedDatabases) > 0 {
+		return fmt.Errorf("`database_prefix` and `allowed_databases` cannot be set simultaneously")
+	}
+	for _, db := range ud.AllowedDatabases {
+		if len(db) == 0 {
+			return fmt.Errorf("`allowed_databases` cannot contain empty names")
+		}
+	}
+	if err := checkTablePatterns("allowed_tables", ud.AllowedTables); err != nil {
+		return err
+	}
+	if err := checkTablePatterns("denied_tables", ud.DeniedTables); err != nil {
+		return err
+	}
+	for _, p := range append(append([]string{}, ud.AllowQueryPatterns...), ud.DenyQueryPatterns...) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("cannot parse query pattern %q: %s", p, err)
+		}
+	}
+	return nil
+}
+
+func (ud UserDefaults) apply(u *User) {
+	if u.MaxConcurrentQueries == 0 {
+		u.MaxConcurrentQueries = ud.MaxConcurrentQueries
+	}
+	if u.MaxExecutionTime == 0 {
+		u.MaxExecutionTime = ud.MaxExecutionTime
+	}
+	if u.ReqPerMin == 0 {
+		u.ReqPerMin = ud.ReqPerMin
+	}
+	if u.MaxQueueSize == 0 {
+		u.MaxQueueSize = ud.MaxQueueSize
+	}
+	if u.MaxQueueTime == 0 {
+		u.MaxQueueTime = ud.MaxQueueTime
+	}
+	if len(u.Cache) == 0 {
+		u.Cache = ud.Cache
+	}
+	if len(u.CacheKeyNamespace) == 0 {
+		u.CacheKeyNamespace = ud.CacheKeyNamespace
+	}
+	if len(u.Params) == 0 {
+		u.Params = ud.Params
+	}
+	if len(u.NetworksOrGroups) == 0 {
+		u.NetworksOrGroups = ud.NetworksOrGroups
+	}
+	u.DenyHTTP = u.DenyHTTP || ud.DenyHTTP
+	u.DenyHTTPS = u.DenyHTTPS || ud.DenyHTTPS
+	if len(u.AllowedPaths) == 0 {
+		u.AllowedPaths = ud.AllowedPaths
+	}
+	if len(u.DeniedStatements) == 0 {
+		u.DeniedStatements = ud.DeniedStatements
+	}
+	// `database_prefix` and `allowed_databases` are mutually exclusive,
+	// so they are inherited together.
+	if len(u.DatabasePrefix) == 0 && len(u.AllowedDatabases) == 0 {
+		u.DatabasePrefix = ud.DatabasePrefix
+		u.AllowedDatabases = ud.AllowedDatabases
+	}
+	if len(u.AllowedTables) == 0 {
+		u.AllowedTables = ud.AllowedTables
+	}
+	if len(u.DeniedTables) == 0 {
+		u.DeniedTables = ud.DeniedTables
+	}
+	if len(u.AllowQueryPatterns) == 0 {
+		u.AllowQueryPatterns = ud.AllowQueryPatterns
+	}
+	if len(u.DenyQueryPatterns) == 0 {
+		u.DenyQueryPatterns = ud.DenyQueryPatterns
+	}
+}
+
+// checkTablePatterns checks `db.table` patterns of the given option.
+func checkTablePatterns(option string, patterns []string) error {
+	for _, p := range patterns {
+		n := strings.IndexByte(p, '.')
+		if n <= 0 || n == len(p)-1 {
+			return fmt.Errorf("`%s` pattern %q must have the form `db.table`", option, p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("cannot parse `%s` pattern %q: %s", option, p, err)
+		}
+	}
+	return nil
+}
+
+// statementKinds contains values allowed in `denied_statements`.
+//
+// `SELECT`, `INSERT` and `DDL` stand for statement classes,
+// while the rest are the leading keywords of statements.
+var statementKinds = map[string]bool{
+	"SELECT": true, "INSERT": true, "DDL": true,
+	"CREATE": true, "DROP": true, "ALTER": true, "RENAME": true,
+	"TRUNCATE": true, "ATTACH": true, "DETACH": true, "EXCHANGE": true,
+	"OPTIMIZE": true, "CHECK": true, "DESCRIBE": true, "DESC": true,
+	"EXISTS": true, "SHOW": true, "USE": true, "SET": true, "EXPLAIN": true,
+	"WATCH": true, "DELETE": true, "KILL": true, "SYSTEM": true,
+	"GRANT": true, "REVOKE": true,
+}
+
+// checkDeniedStatements checks `denied_statements` of users.
+func checkDeniedStatements(stmts []string) error {
+	for _, stmt := range stmts {
+		if !statementKinds[strings.ToUpper(stmt)] {
+			return fmt.Errorf("`denied_statements` contains unsupported statement %q", stmt)
+		}
+	}
+	return nil
+}
+
+// checkAllowedPaths checks `allowed_paths` of users.
+func checkAllowedPaths(paths []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("`allowed_paths` must start with `/`, got %q instead", p)
+		}
+		if p == "/metrics" || p == "/favicon.ico" || p == "/validate" || p == "/session" || strings.HasPrefix(p, "/admin/") || strings.HasPrefix(p, "/-/") {
+			return fmt.Errorf("`allowed_paths` cannot contain path %q reserved by chproxy", p)
+		}
+	}
+	return nil
+}
+
+// Profile describes named bundle of user settings.
+//
+// Users referencing the profile via `profile` inherit its settings
+// unless they are overridden on the user level.
+type Profile struct {
+	// Name of the profile for referencing from users
+	Name string `yaml:"name"`
+
+	// Settings inherited by users
+	Settings UserDefaults `yaml:",inline"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (p *Profile) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Profile
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	if len(p.Name) == 0 {
+		return fmt.Errorf("`profile.name` cannot be empty")
+	}
+	if err := p.Settings.validate(); err != nil {
+		return fmt.Errorf("%s for profile %q", err, p.Name)
+	}
+	return checkOverflow(p.XXX, fmt.Sprintf("profile %q", p.Name))
+}
+
+// ClusterUserDefaults describes default settings for cluster users
+//
+// Fields have the same meaning as the corresponding ClusterUser fields.
+type ClusterUserDefaults struct {
+	MaxConcurrentQueries uint32   `yaml:"max_concurrent_queries,omitempty"`
+	MaxExecutionTime     Duration `yaml:"max_execution_time,omitempty"`
+	ReqPerMin            uint32   `yaml:"requests_per_minute,omitempty"`
+	MaxQueueSize         uint32   `yaml:"max_queue_size,omitempty"`
+	MaxQueueTime         Duration `yaml:"max_queue_time,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cud *ClusterUserDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ClusterUserDefaults
+	if err := unmarshal((*plain)(cud)); err != nil {
+		return err
+	}
+	return checkOverflow(cud.XXX, "defaults.cluster_user")
+}
+
+func (cud ClusterUserDefaults) apply(cu *ClusterUser) {
+	if cu.MaxConcurrentQueries == 0 {
+		cu.MaxConcurrentQueries = cud.MaxConcurrentQueries
+	}
+	if cu.MaxExecutionTime == 0 {
+		cu.MaxExecutionTime = cud.MaxExecutionTime
+	}
+	if cu.ReqPerMin == 0 {
+		cu.ReqPerMin = cud.ReqPerMin
+	}
+	if cu.MaxQueueSize == 0 {
+		cu.MaxQueueSize = cud.MaxQueueSize
+	}
+	if cu.MaxQueueTime == 0 {
+		cu.MaxQueueTime = cud.MaxQueueTime
+	}
+}
+
+// ClusterDefaults describes default settings for clusters
+//
+// Fields have the same meaning as the corresponding Cluster fields.
+type ClusterDefaults struct {
+	HeartBeatInterval Duration `yaml:"heartbeat_interval,omitempty"`
+	DNSCacheTTL       Duration `yaml:"dns_cache_ttl,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cd *ClusterDefaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ClusterDefaults
+	if err := unmarshal((*plain)(cd)); err != nil {
+		return err
+	}
+	return checkOverflow(cd.XXX, "defaults.cluster")
+}
+
+func (cd ClusterDefaults) apply(c *Cluster) {
+	if c.HeartBeatInterval == 0 {
+		c.HeartBeatInterval = cd.HeartBeatInterval
+	}
+	if c.DNSCacheTTL == 0 {
+		c.DNSCacheTTL = cd.DNSCacheTTL
+	}
+	if c.HeartBeatInterval == 0 {
+		c.HeartBeatInterval = Duration(time.Second * 5)
+	}
+}
+
+// Admin describes configuration to access admin endpoints
+type Admin struct {
+	// Optional TCP address of the dedicated listener for admin endpoints
+	// if omitted - admin endpoints are served by `http` and `https` listeners
+	ListenAddr string `yaml:"listen_addr,omitempty"`
+
+	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+
+	// List of networks that access is allowed from
+	// Each list item could be IP address or subnet mask
+	// if omitted or zero - no limits would be applied
+	AllowedNetworks Networks `yaml:"-"`
+
+	// User name to access admin endpoints with basic auth
+	User string `yaml:"user"`
+
+	// User password to access admin endpoints with basic auth.
+	// `${VAR}` references are substituted with environment variable values
+	Password string `yaml:"password"`
+
+	// Optional configuration for keeping recent queries per user
+	QueryHistory QueryHistory `yaml:"query_history,omitempty"`
+
+	// Password value from the config file
+	rawPassword string
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Admin) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Admin
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+	if len(a.User) == 0 || len(a.Password) == 0 {
+		return fmt.Errorf("`admin.user` and `admin.password` must be specified")
+	}
+	return checkOverflow(a.XXX, "admin")
+}
+
+// QueryHistory describes configuration for keeping recent queries per user,
+// which are served via `/admin/users/<name>/queries`.
+type QueryHistory struct {
+	// The number of recent queries kept per user
+	// if omitted or zero - 100 is used
+	Size int `yaml:"size,omitempty"`
+
+	// Optional path to the file for persisting the history across restarts
+	File string `yaml:"file,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (qh *QueryHistory) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain QueryHistory
+	if err := unmarshal((*plain)(qh)); err != nil {
+		return err
+	}
+	if qh.Size < 0 {
+		return fmt.Errorf("`query_history.size` cannot be negative")
+	}
+	if qh.Size == 0 {
+		qh.Size = 100
+	}
+	return checkOverflow(qh.XXX, "query_history")
+}
+
+// Cluster describes CH cluster configuration
+// The simplest configuration consists of:
+// 	 cluster description - see <remote_servers> section in CH config.xml
+// 	 and users - see <users> section in CH users.xml
+type Cluster struct {
+	// Name of ClickHouse cluster
+	Name string `yaml:"name"`
+
+	// Scheme: `http` or `https`; would be applied to all nodes
+	// default value is `http`
+	Scheme string `yaml:"scheme,omitempty"`
+
+	// Nodes contains cluster nodes.
+	//
+	// Either Nodes or Replicas must be set, but not both.
+	Nodes []string `yaml:"nodes,omitempty"`
+
+	// Replicas contains replicas.
+	//
+	// Either Replicas or Nodes must be set, but not both.
+	Replicas []Replica `yaml:"replicas,omitempty"`
+
+	// ClusterUsers - list of ClickHouse users
+	ClusterUsers []ClusterUser `yaml:"users"`
+
+	// KillQueryUser - user configuration for killing timed out queries.
+	// By default timed out queries are killed under `default` user.
+	KillQueryUser KillQueryUser `yaml:"kill_query_user,omitempty"`
+
+	// HeartBeatInterval is an interval of checking
+	// all cluster nodes for availability
+	// if omitted or zero - `defaults.cluster.heartbeat_interval` or 5s is used
+	HeartBeatInterval Duration `yaml:"heartbeat_interval,omitempty"`
+
+	// Proxy - optional egress proxy for connections to cluster nodes.
+	// By default proxy is taken from HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables.
+	Proxy Proxy `yaml:"proxy,omitempty"`
+
+	// SourceAddr is a local IP address or network interface name
+	// used for outgoing connections to cluster nodes
+	// if omitted - the address is chosen by the OS
+	SourceAddr string `yaml:"source_addr,omitempty"`
+
+	// DNSCacheTTL is the duration for caching resolved addresses
+	// of cluster nodes. Cached addresses are resolved again
+	// as soon as connections to them start failing.
+	// if omitted or zero - addresses are resolved on each connection
+	DNSCacheTTL Duration `yaml:"dns_cache_ttl,omitempty"`
+
+	// Artificial faults injected into requests to the cluster.
+	// Must be used only for resilience testing
+	FaultInjection FaultInjection `yaml:"fault_injection,omitempty"`
+
+	// Whether to present SPIFFE X.509-SVID as the client certificate
+	// to cluster nodes and to verify nodes against the SPIFFE trust bundle.
+	// Requires `https` scheme and `spiffe` section
+	SPIFFE bool `yaml:"spiffe,omitempty"`
+
+	// TLS protocol settings for connections to cluster nodes.
+	// Makes sense only for `https` scheme
+	TLS TLS `yaml:"tls,omitempty"`
+
+	// Whether to negotiate HTTP/2 with cluster nodes via ALPN.
+	// Nodes without HTTP/2 support are accessed via HTTP/1.1.
+	// Requires `https` scheme and chproxy built with Go 1.13 or newer
+	HTTP2 bool `yaml:"http2,omitempty"`
+
+	// Name of the registered router extension choosing cluster nodes
+	// for requests instead of the default load balancing
+	Router string `yaml:"router,omitempty"`
+
+	// Policy for choosing replicas and hosts for requests:
+	// `least_loaded`, `round_robin`, `random` or `consistent_hash`.
+	// By default `least_loaded` is used
+	LoadBalancing string `yaml:"load_balancing,omitempty"`
+
+	// Name of the replica receiving requests while it is available
+	// regardless of replica priorities, for example the replica
+	// in the same datacenter as chproxy
+	PreferReplica string `yaml:"prefer_replica,omitempty"`
+
+	// Discovery of cluster nodes: `dns`, `consul`, `etcd` or `zookeeper`.
+	// Nodes are DNS names, Consul service names, etcd key prefixes
+	// or ZooKeeper paths of ClickHouse cluster discovery, which are
+	// periodically resolved into node addresses
+	Discovery string `yaml:"discovery,omitempty"`
+
+	// Interval for re-resolving node names with `discovery`
+	// if omitted or zero - 30s is used
+	DiscoveryInterval Duration `yaml:"discovery_interval,omitempty"`
+
+	// Consul, etcd or ZooKeeper server for `discovery`
+	DiscoveryServer DiscoveryServer `yaml:"discovery_server,omitempty"`
+
+	// Retries of requests failed due to connection errors
+	// to cluster nodes
+	Retry Retry `yaml:"retry,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = defaultCluster
+	type plain Cluster
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Name) == 0 {
+		return fmt.Errorf("`cluster.name` cannot be empty")
+	}
+	if len(c.Nodes) == 0 && len(c.Replicas) == 0 {
+		return fmt.Errorf("either `cluster.nodes` or `cluster.replicas` must be set for %q", c.Name)
+	}
+	if len(c.Nodes) > 0 && len(c.Replicas) > 0 {
+		return fmt.Errorf("`cluster.nodes` cannot be simultaneously set with `cluster.replicas` for %q", c.Name)
+	}
+	if len(c.ClusterUsers) == 0 {
+		return fmt.Errorf("`cluster.users` must contain at least 1 user for %q", c.Name)
+	}
+	if c.Scheme != "http" && c.Scheme != "https" {
+		return fmt.Errorf("`cluster.scheme` must be `http` or `https`, got %q instead for %q", c.Scheme, c.Name)
+	}
+	if c.SPIFFE && c.Scheme != "https" {
+		return fmt.Errorf("`cluster.scheme` must be `https` if `cluster.spiffe` is set for %q", c.Name)
+	}
+	if c.SPIFFE && (len(c.TLS.CAFile) > 0 || len(c.TLS.CertFile) > 0) {
+		return fmt.Errorf("`cluster.tls.ca_file` and `cluster.tls.cert_file` cannot be set together with `cluster.spiffe` for %q", c.Name)
+	}
+	if c.HTTP2 && c.Scheme != "https" {
+		return fmt.Errorf("`cluster.scheme` must be `https` if `cluster.http2` is set for %q", c.Name)
+	}
+	switch c.LoadBalancing {
+	case "", "least_loaded", "round_robin", "random", "consistent_hash":
+	default:
+		return fmt.Errorf("`cluster.load_balancing` must be `least_loaded`, `round_robin`, `random` or `consistent_hash`, got %q instead for %q", c.LoadBalancing, c.Name)
+	}
+	switch c.Discovery {
+	case "", "dns":
+		if len(c.DiscoveryServer.Address) > 0 {
+			return fmt.Errorf("`cluster.discovery_server` may be set only for `consul`, `etcd` and `zookeeper` discovery for %q", c.Name)
+		}
+	case "consul", "etcd", "zookeeper":
+		if len(c.DiscoveryServer.Address) == 0 {
+			return fmt.Errorf("`cluster.discovery_server.address` must be set for %s discovery for %q", c.Discovery, c.Name)
+		}
+		if err := c.DiscoveryServer.validateAddress(c.Discovery); err != nil {
+			return fmt.Errorf("%s for %q", err, c.Name)
+		}
+	default:
+		return fmt.Errorf("`cluster.discovery` must be `dns`, `consul`, `etcd` or `zookeeper`, got %q instead for %q", c.Discovery, c.Name)
+	}
+	if c.DiscoveryServer.NodePort != 0 && c.Discovery != "zookeeper" {
+		return fmt.Errorf("`cluster.discovery_server.node_port` may be set only for `zookeeper` discovery for %q", c.Name)
+	}
+	if c.DiscoveryInterval > 0 && len(c.Discovery) == 0 {
+		return fmt.Errorf("`cluster.discovery_interval` requires `cluster.discovery` for %q", c.Name)
+	}
+	if len(c.PreferReplica) > 0 {
+		found := false
+		for _, r := range c.Replicas {
+			if r.Name == c.PreferReplica {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("`cluster.prefer_replica` %q must be one of `cluster.replicas` for %q", c.PreferReplica, c.Name)
+		}
+	}
+	return checkOverflow(c.XXX, fmt.Sprintf("cluster %q", c.Name))
+}
+
+// DiscoveryServer describes Consul, etcd or ZooKeeper server used
+// for discovery of cluster nodes.
+type DiscoveryServer struct {
+	// URL of the server, for example `http://127.0.0.1:8500` for Consul
+	// or `http://127.0.0.1:2379` for etcd.
+	// Comma-separated `host:port` list for ZooKeeper, for example
+	// `zk1:2181,zk2:2181,zk3:2181`
+	Address string `yaml:"address,omitempty"`
+
+	// Consul ACL token, etcd auth token or ZooKeeper digest
+	// credentials in the `user:password` form
+	Token string `yaml:"token,omitempty"`
+
+	// Consul datacenter; the datacenter of the agent is used by default
+	Datacenter string `yaml:"datacenter,omitempty"`
+
+	// HTTP port of ClickHouse nodes discovered via ZooKeeper,
+	// since ClickHouse registers nodes with their TCP port.
+	// if omitted or zero - 8123 is used for `http` scheme
+	// and 8443 for `https` scheme
+	NodePort int `yaml:"node_port,omitempty"`
+
+	// Token value from the config file
+	rawToken string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ds *DiscoveryServer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain DiscoveryServer
+	if err := unmarshal((*plain)(ds)); err != nil {
+		return err
+	}
+	if ds.NodePort < 0 || ds.NodePort > 65535 {
+		return fmt.Errorf("`discovery_server.node_port` must be in the range [0..65535], got %d", ds.NodePort)
+	}
+	return checkOverflow(ds.XXX, "discovery_server")
+}
+
+// validateAddress checks whether the address is valid for the given discovery.
+func (ds DiscoveryServer) validateAddress(discovery string) error {
+	if discovery == "zookeeper" {
+		for _, addr := range strings.Split(ds.Address, ",") {
+			if _, _, err := net.SplitHostPort(strings.TrimSpace(addr)); err != nil {
+				return fmt.Errorf("cannot parse `discovery_server.address` %q: %s", addr, err)
+			}
+		}
+		return nil
+	}
+	u, err := url.Parse(ds.Address)
+	if err != nil {
+		return fmt.Errorf("cannot parse `discovery_server.address` %q: %s", ds.Address, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("`discovery_server.address` scheme must be `http` or `https`, got %q instead", u.Scheme)
+	}
+	return nil
+}
+
+// Proxy describes egress proxy configuration for connections
+// to cluster nodes.
+type Proxy struct {
+	// URL of the proxy, for example `http://proxy.local:3128`
+	// or `socks5://bastion.local:1080`.
+	URL string `yaml:"url,omitempty"`
+
+	// User name for proxy authentication
+	User string `yaml:"user,omitempty"`
+
+	// User password for proxy authentication
+	Password string `yaml:"password,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (p *Proxy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Proxy
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	if len(p.URL) == 0 {
+		return fmt.Errorf("`cluster.proxy.url` must be specified")
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return fmt.Errorf("cannot parse `cluster.proxy.url` %q: %s", p.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return fmt.Errorf("`cluster.proxy.url` scheme must be `http`, `https` or `socks5`, got %q instead", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("`cluster.proxy.url` %q must contain host", p.URL)
+	}
+	if len(p.Password) > 0 && len(p.User) == 0 {
+		return fmt.Errorf("`cluster.proxy.user` must be specified if `cluster.proxy.password` is set")
+	}
+	if len(p.User) > 0 && u.User != nil {
+		return fmt.Errorf("`cluster.proxy.user` cannot be simultaneously set with credentials in `cluster.proxy.url`")
+	}
+	return checkOverflow(p.XXX, "proxy")
+}
+
+// FaultInjection describes artificial faults injected into requests.
+// It is intended for verifying client retry behavior and alerting
+// in staging environments, so it mustn't be used in production.
+type FaultInjection struct {
+	// Percentage of requests delayed by Delay
+	DelayPercent float64 `yaml:"delay_percent,omitempty"`
+
+	// Artificial latency added to the delayed requests
+	Delay Duration `yaml:"delay,omitempty"`
+
+	// Percentage of requests responded with ErrorStatusCode
+	// instead of proxying them
+	ErrorPercent float64 `yaml:"error_percent,omitempty"`
+
+	// Status code for the failed requests
+	// if omitted or zero - 503 is used
+	ErrorStatusCode int `yaml:"error_status_code,omitempty"`
+
+	// Percentage of requests with abruptly closed connections
+	DropPercent float64 `yaml:"drop_percent,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (fi *FaultInjection) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain FaultInjection
+	if err := unmarshal((*plain)(fi)); err != nil {
+		return err
+	}
+	percents := map[string]float64{
+		"delay_percent": fi.DelayPercent,
+		"error_percent": fi.ErrorPercent,
+		"drop_percent":  fi.DropPercent,
+	}
+	for name, p := range percents {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("`fault_injection.%s` must be in the range [0..100], got %v instead", name, p)
+		}
+	}
+	if fi.DelayPercent > 0 && fi.Delay == 0 {
+		return fmt.Errorf("`fault_injection.delay` must be set if `fault_injection.delay_percent` is set")
+	}
+	if fi.ErrorStatusCode == 0 {
+		fi.ErrorStatusCode = 503
+	}
+	if fi.ErrorStatusCode < 500 || fi.ErrorStatusCode > 599 {
+		return fmt.Errorf("`fault_injection.error_status_code` must be in the range [500..599], got %d instead", fi.ErrorStatusCode)
+	}
+	return checkOverflow(fi.XXX, "fault_injection")
+}
+
+// Retry describes retries of requests, which failed due to connection
+// errors to cluster nodes, on other cluster nodes
+type Retry struct {
+	// Maximum number of retries per request
+	// if omitted or zero - requests aren't retried
+	MaxRetries int `yaml:"max_retries,omitempty"`
+
+	// Maximum ratio of retries to requests to the cluster during BudgetInterval.
+	// It prevents from finishing off a degraded cluster by retry storms
+	// if omitted or zero - 0.1 is used
+	BudgetRatio float64 `yaml:"budget_ratio,omitempty"`
+
+	// Number of retries allowed during BudgetInterval regardless of BudgetRatio,
+	// so requests may be retried under low load
+	// if omitted or zero - 10 is used
+	BudgetMinRetries int `yaml:"budget_min_retries,omitempty"`
+
+	// Interval for the retry budget
+	// if omitted or zero - 10s is used
+	BudgetInterval Duration `yaml:"budget_interval,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *Retry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Retry
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if r.MaxRetries < 0 {
+		return fmt.Errorf("`retry.max_retries` cannot be negative")
+	}
+	if r.BudgetRatio < 0 || r.BudgetRatio > 1 {
+		return fmt.Errorf("`retry.budget_ratio` must be in the range [0..1], got %v instead", r.BudgetRatio)
+	}
+	if r.BudgetRatio == 0 {
+		r.BudgetRatio = 0.1
+	}
+	if r.BudgetMinRetries < 0 {
+		return fmt.Errorf("`retry.budget_min_retries` cannot be negative")
+	}
+	if r.BudgetMinRetries == 0 {
+		r.BudgetMinRetries = 10
+	}
+	if r.BudgetInterval == 0 {
+		r.BudgetInterval = Duration(10 * time.Second)
+	}
+	return checkOverflow(r.XXX, "retry")
+}
+
+// Replica contains ClickHouse replica configuration.
+type Replica struct {
+	// Name is replica name.
+	Name string `yaml:"name"`
+
+	// Nodes contains replica nodes.
+	Nodes []string `yaml:"nodes"`
+
+	// Priority of the replica; replicas with lower values are preferred.
+	// Replicas with higher values receive requests only if all the
+	// replicas with lower values are unavailable
+	Priority int `yaml:"priority,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *Replica) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Replica
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if len(r.Name) == 0 {
+		return fmt.Errorf("`replica.name` cannot be empty")
+	}
+	if len(r.Nodes) == 0 {
+		return fmt.Errorf("`replica.nodes` cannot be empty for %q", r.Name)
+	}
+	if r.Priority < 0 {
+		return fmt.Errorf("`replica.priority` cannot be negative for %q", r.Name)
+	}
+	return checkOverflow(r.XXX, fmt.Sprintf("replica %q", r.Name))
+}
+
+// KillQueryUser - user configuration for killing timed out queries.
+type KillQueryUser struct {
+	// User name
+	Name string `yaml:"name"`
+
+	// User password to access CH with basic auth
+	Password string `yaml:"password,omitempty"`
+
+	// Path to file containing the password.
+	// Cannot be set together with Password
+	PasswordFile string `yaml:"password_file,omitempty"`
+
+	// Password value from the config file
+	rawPassword string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (u *KillQueryUser) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain KillQueryUser
+	if err := unmarshal((*plain)(u)); err != nil {
+		return err
+	}
+	if len(u.Name) == 0 {
+		return fmt.Errorf("`cluster.kill_query_user.name` must be specified")
+	}
+	if len(u.Password) > 0 && len(u.PasswordFile) > 0 {
+		return fmt.Errorf("`cluster.kill_query_user.password` and `cluster.kill_query_user.password_file` cannot be set simultaneously")
 	}
 	return checkOverflow(u.XXX, "kill_query_user")
 }
 
-// User describes list of allowed users
-// which requests will be proxied to ClickHouse
-type User struct {
-	// User name
+// User describes list of allowed users
+// which requests will be proxied to ClickHouse
+type User struct {
+	// User name
+	Name string `yaml:"name"`
+
+	// Whether Name is a regular expression matched against
+	// the whole incoming user name.
+	// Requests from all the matching users share the user settings and limits,
+	// while the incoming user name is forwarded to ClickHouse as `quota_key`
+	NameIsRegexp bool `yaml:"name_is_regexp,omitempty"`
+
+	// Whether Name is a pattern with `*` wildcards matched against
+	// the incoming user name.
+	// Requests from the matching users are proxied with their own
+	// credentials, which are verified by ClickHouse, while sharing
+	// the user settings and limits
+	IsWildcarded bool `yaml:"is_wildcarded,omitempty"`
+
+	// User password to access proxy with basic auth
+	Password string `yaml:"password,omitempty"`
+
+	// Path to file containing the password.
+	// Cannot be set together with Password
+	PasswordFile string `yaml:"password_file,omitempty"`
+
+	// Previous user passwords, which are still accepted
+	// during credentials rotation
+	PreviousPasswords []string `yaml:"previous_passwords,omitempty"`
+
+	// Password and PreviousPasswords values from the config file
+	rawPassword          string
+	rawPreviousPasswords []string
+
+	// ToCluster is the name of cluster where requests
+	// will be proxied
+	ToCluster string `yaml:"to_cluster,omitempty"`
+
+	// ToClusters contains weighted clusters holding the same data,
+	// among which requests are spread.
+	// Either ToCluster or ToClusters may be set, but not both
+	ToClusters []ClusterTarget `yaml:"to_clusters,omitempty"`
+
+	// Route maps statement classes (`select`, `insert`, `ddl` and `other`)
+	// to clusters, where queries of these classes are proxied instead
+	// of ToCluster or ToClusters
+	Route map[string]string `yaml:"route,omitempty"`
+
+	// AllowedClusters contains clusters, which may be chosen
+	// via `X-Chproxy-Cluster` request header
+	AllowedClusters []string `yaml:"allowed_clusters,omitempty"`
+
+	// MirrorToCluster is the name of cluster, where user queries
+	// are asynchronously duplicated with discarded responses
+	MirrorToCluster string `yaml:"mirror_to_cluster,omitempty"`
+
+	// Percentage of queries duplicated to MirrorToCluster
+	// if omitted or zero - all the queries are duplicated
+	MirrorPercent float64 `yaml:"mirror_percent,omitempty"`
+
+	// ToUser is the name of cluster_user from cluster's ToCluster
+	// whom credentials will be used for proxying request to CH
+	ToUser string `yaml:"to_user"`
+
+	// Maximum number of concurrently running queries for user
+	// if omitted or zero - no limits would be applied
+	MaxConcurrentQueries uint32 `yaml:"max_concurrent_queries,omitempty"`
+
+	// Maximum duration of query execution for user
+	// if omitted or zero - no limits would be applied
+	MaxExecutionTime Duration `yaml:"max_execution_time,omitempty"`
+
+	// Maximum duration without new response bytes from ClickHouse.
+	// The query is killed when the limit is exceeded
+	// if omitted or zero - no limits would be applied
+	MaxIdleTime Duration `yaml:"max_idle_time,omitempty"`
+
+	// Maximum number of requests per minute for user
+	// if omitted or zero - no limits would be applied
+	ReqPerMin uint32 `yaml:"requests_per_minute,omitempty"`
+
+	// Maximum number of queries waiting for execution in the queue
+	// if omitted or zero - queries are executed without waiting
+	// in the queue
+	MaxQueueSize uint32 `yaml:"max_queue_size,omitempty"`
+
+	// Maximum duration the query may wait in the queue
+	// if omitted or zero - 10s duration is used
+	MaxQueueTime Duration `yaml:"max_queue_time,omitempty"`
+
+	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+
+	// List of networks that access is allowed from
+	// Each list item could be IP address or subnet mask
+	// if omitted or zero - no limits would be applied
+	AllowedNetworks Networks `yaml:"-"`
+
+	// Whether to deny http connections for this user
+	DenyHTTP bool `yaml:"deny_http,omitempty"`
+
+	// Whether to deny https connections for this user
+	DenyHTTPS bool `yaml:"deny_https,omitempty"`
+
+	// Whether to allow CORS requests for this user
+	AllowCORS bool `yaml:"allow_cors,omitempty"`
+
+	// Policy for CORS requests of this user.
+	// Cannot be set together with AllowCORS
+	CORS CORS `yaml:"cors,omitempty"`
+
+	// Name of Cache configuration to use for responses of this user
+	Cache string `yaml:"cache,omitempty"`
+
+	// Users with the same namespace share cached responses
+	// if omitted - responses are shared with users without namespace
+	CacheKeyNamespace string `yaml:"cache_key_namespace,omitempty"`
+
+	// Whether the user may force a fresh response or skip the cache
+	// for a single request via `Cache-Control` or `X-Chproxy-Cache` headers
+	AllowCacheControl bool `yaml:"allow_cache_control,omitempty"`
+
+	// Name of ParamGroup to use
+	Params string `yaml:"params,omitempty"`
+
+	// Name of Profile to inherit settings from
+	Profile string `yaml:"profile,omitempty"`
+
+	// Alias for Profile for describing role-based access
+	UserGroup string `yaml:"user_group,omitempty"`
+
+	// Artificial faults injected into requests of this user.
+	// Must be used only for resilience testing
+	FaultInjection FaultInjection `yaml:"fault_injection,omitempty"`
+
+	// List of SPIFFE ID patterns for authorizing clients without password.
+	// Requests over https without credentials, which present
+	// client SVID with matching SPIFFE ID, are executed as this user.
+	// Patterns are matched via path.Match
+	SPIFFEIDs []string `yaml:"spiffe_ids,omitempty"`
+
+	// List of patterns for authorizing clients by certificates without password.
+	// Requests over https without credentials, which present client
+	// certificate with CN or DNS/email SAN matching one of patterns,
+	// are executed as this user.
+	// Patterns are matched via path.Match
+	CertNames []string `yaml:"cert_names,omitempty"`
+
+	// Prefix of databases accessible by the user.
+	// Queries referencing other databases are rejected
+	DatabasePrefix string `yaml:"database_prefix,omitempty"`
+
+	// Databases accessible by the user.
+	// Queries referencing other databases are rejected
+	AllowedDatabases []string `yaml:"allowed_databases,omitempty"`
+
+	// Patterns of tables accessible by the user in the form `db.table`.
+	// Patterns are matched via path.Match
+	AllowedTables []string `yaml:"allowed_tables,omitempty"`
+
+	// Patterns of tables inaccessible by the user in the form `db.table`.
+	// Patterns are matched via path.Match
+	DeniedTables []string `yaml:"denied_tables,omitempty"`
+
+	// Statements the user cannot execute such as `DDL`, `SYSTEM` or `KILL`.
+	// Statement classes `SELECT`, `INSERT` and `DDL` may be used
+	DeniedStatements []string `yaml:"denied_statements,omitempty"`
+
+	// Regexps for the normalized query. Queries not matching
+	// any of these regexps are rejected if the list is set
+	AllowQueryPatterns []string `yaml:"allow_query_patterns,omitempty"`
+
+	// Regexps for the normalized query. Queries matching
+	// any of these regexps are rejected
+	DenyQueryPatterns []string `yaml:"deny_query_patterns,omitempty"`
+
+	// Quota key forwarded to ClickHouse instead of the client's `quota_key`
+	QuotaKey string `yaml:"quota_key,omitempty"`
+
+	// Additional ClickHouse paths the user may access via chproxy
+	// such as `/ping` or `/play`. Only `/` is allowed by default
+	AllowedPaths []string `yaml:"allowed_paths,omitempty"`
+
+	// Name of the registered authenticator extension verifying
+	// user credentials instead of `password`
+	Authenticator string `yaml:"authenticator,omitempty"`
+
+	// Whether the user may authenticate via JWT bearer token
+	// with the claim from `jwt.user_claim` matching the user name.
+	// Users without password may authenticate only via JWT
+	AllowJWT bool `yaml:"allow_jwt,omitempty"`
+
+	// Maximum size of the response sent to the user.
+	// The response is aborted and the query is killed when the limit is crossed
+	// if omitted or zero - no limits would be applied
+	MaxResponseSize ByteSize `yaml:"max_response_size,omitempty"`
+
+	// Maximum size of the request body sent by the user.
+	// Larger requests are rejected with `413 Request Entity Too Large`
+	// if omitted or zero - no limits would be applied
+	MaxRequestBodySize ByteSize `yaml:"max_request_body_size,omitempty"`
+
+	// Maximum number of rows read by the query according to
+	// `X-ClickHouse-Progress` and `X-ClickHouse-Summary` response headers.
+	// The response is aborted and the query is killed when the limit is crossed
+	// if omitted or zero - no limits would be applied
+	MaxReadRows uint64 `yaml:"max_read_rows,omitempty"`
+
+	// Policy for compressing responses: `passthrough`, `upstream`,
+	// `proxy` or `disabled`
+	// if omitted - `passthrough` is used
+	Compression string `yaml:"compression,omitempty"`
+
+	// Priority of user queries: 1 is the highest priority.
+	// Queued requests with higher priority are started first and the priority
+	// is passed to ClickHouse as `priority` setting. Clients may lower
+	// the priority via `priority` query arg.
+	// if omitted or zero - queries have no priority
+	Priority uint64 `yaml:"priority,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (u *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain User
+	if err := unmarshal((*plain)(u)); err != nil {
+		return err
+	}
+
+	if len(u.Name) == 0 {
+		return fmt.Errorf("`user.name` cannot be empty")
+	}
+
+	if u.NameIsRegexp {
+		if _, err := regexp.Compile(u.Name); err != nil {
+			return fmt.Errorf("cannot parse `user.name` regexp %q: %s", u.Name, err)
+		}
+	}
+
+	if u.IsWildcarded {
+		if !strings.Contains(u.Name, "*") {
+			return fmt.Errorf("`user.name` must contain `*` if `is_wildcarded` is set for %q", u.Name)
+		}
+		if u.NameIsRegexp {
+			return fmt.Errorf("`is_wildcarded` and `name_is_regexp` cannot be set simultaneously for %q", u.Name)
+		}
+		if len(u.Password) > 0 || len(u.PasswordFile) > 0 || len(u.Authenticator) > 0 || u.AllowJWT {
+			return fmt.Errorf("wildcarded user %q cannot have `password`, `password_file`, `authenticator` or `allow_jwt`, "+
+				"since its credentials are verified by ClickHouse", u.Name)
+		}
+	}
+
+	if len(u.ToUser) == 0 {
+		return fmt.Errorf("`user.to_user` cannot be empty for %q", u.Name)
+	}
+
+	if len(u.ToCluster) == 0 && len(u.ToClusters) == 0 {
+		return fmt.Errorf("either `user.to_cluster` or `user.to_clusters` must be set for %q", u.Name)
+	}
+
+	if len(u.ToCluster) > 0 && len(u.ToClusters) > 0 {
+		return fmt.Errorf("`user.to_cluster` and `user.to_clusters` cannot be set simultaneously for %q", u.Name)
+	}
+
+	clusters := make(map[string]bool, len(u.ToClusters))
+	hasPrimary := false
+	for _, ct := range u.ToClusters {
+		if clusters[ct.Name] {
+			return fmt.Errorf("duplicate cluster %q in `user.to_clusters` for %q", ct.Name, u.Name)
+		}
+		clusters[ct.Name] = true
+		if !ct.Fallback {
+			hasPrimary = true
+		}
+	}
+	if len(u.ToClusters) > 0 && !hasPrimary {
+		return fmt.Errorf("`user.to_clusters` must contain at least a single cluster without `fallback` for %q", u.Name)
+	}
+
+	for class, cluster := range u.Route {
+		switch class {
+		case "select", "insert", "ddl", "other":
+		default:
+			return fmt.Errorf("unknown statement class %q in `user.route` for %q; must be `select`, `insert`, `ddl` or `other`", class, u.Name)
+		}
+		if len(cluster) == 0 {
+			return fmt.Errorf("`user.route.%s` cannot be empty for %q", class, u.Name)
+		}
+	}
+
+	if u.MirrorPercent < 0 || u.MirrorPercent > 100 {
+		return fmt.Errorf("`user.mirror_percent` must be in the range [0..100] for %q", u.Name)
+	}
+	if u.MirrorPercent > 0 && len(u.MirrorToCluster) == 0 {
+		return fmt.Errorf("`user.mirror_percent` requires `user.mirror_to_cluster` for %q", u.Name)
+	}
+
+	if u.AllowCORS && len(u.CORS.AllowedOrigins) > 0 {
+		return fmt.Errorf("`allow_cors` and `cors` cannot be set simultaneously for %q", u.Name)
+	}
+
+	if u.DenyHTTP && u.DenyHTTPS {
+		return fmt.Errorf("`deny_http` and `deny_https` cannot be simultaneously set to `true` for %q", u.Name)
+	}
+
+	if len(u.Password) > 0 && len(u.PasswordFile) > 0 {
+		return fmt.Errorf("`password` and `password_file` cannot be set simultaneously for %q", u.Name)
+	}
+
+	if len(u.PreviousPasswords) > 0 && len(u.Password) == 0 && len(u.PasswordFile) == 0 {
+		return fmt.Errorf("`password` must be set if `previous_passwords` is set for %q", u.Name)
+	}
+
+	if len(u.Authenticator) > 0 && (len(u.Password) > 0 || len(u.PasswordFile) > 0) {
+		return fmt.Errorf("`password` and `authenticator` cannot be set simultaneously for %q", u.Name)
+	}
+
+	switch u.Compression {
+	case "", "passthrough", "upstream", "proxy", "disabled":
+	default:
+		return fmt.Errorf("`compression` must be one of `passthrough`, `upstream`, `proxy` or `disabled`, got %q instead for %q", u.Compression, u.Name)
+	}
+
+	if err := checkAllowedPaths(u.AllowedPaths); err != nil {
+		return fmt.Errorf("%s for %q", err, u.Name)
+	}
+
+	if len(u.DatabasePrefix) > 0 && len(u.AllowedDatabases) > 0 {
+		return fmt.Errorf("`database_prefix` and `allowed_databases` cannot be set simultaneously for %q", u.Name)
+	}
+	for _, db := range u.AllowedDatabases {
+		if len(db) == 0 {
+			return fmt.Errorf("`allowed_databases` cannot contain empty names for %q", u.Name)
+		}
+	}
+	if err := checkTablePatterns("allowed_tables", u.AllowedTables); err != nil {
+		return fmt.Errorf("%s for %q", err, u.Name)
+	}
+	if err := checkTablePatterns("denied_tables", u.DeniedTables); err != nil {
+		return fmt.Errorf("%s for %q", err, u.Name)
+	}
+	if err := checkDeniedStatements(u.DeniedStatements); err != nil {
+		return fmt.Errorf("%s for %q", err, u.Name)
+	}
+	for _, p := range append(append([]string{}, u.AllowQueryPatterns...), u.DenyQueryPatterns...) {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("cannot parse query pattern %q for %q: %s", p, u.Name, err)
+		}
+	}
+
+	for _, name := range u.CertNames {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("cannot parse `cert_names` pattern %q for %q: %s", name, u.Name, err)
+		}
+	}
+
+	for _, id := range u.SPIFFEIDs {
+		if !strings.HasPrefix(id, "spiffe://") {
+			return fmt.Errorf("`spiffe_ids` must start with `spiffe://`, got %q instead for %q", id, u.Name)
+		}
+		if _, err := path.Match(id, ""); err != nil {
+			return fmt.Errorf("cannot parse `spiffe_ids` pattern %q for %q: %s", id, u.Name, err)
+		}
+	}
+
+	return checkOverflow(u.XXX, fmt.Sprintf("user %q", u.Name))
+}
+
+// CORS describes policy for cross-origin requests
+type CORS struct {
+	// List of origins allowed to send requests, for example `https://tabix.io`.
+	// Each item may contain shell file name patterns, for example
+	// `https://*.example.com`. `*` allows all the origins
+	AllowedOrigins []string `yaml:"allowed_origins,omitempty"`
+
+	// List of allowed methods: `GET` or `POST`
+	// if omitted - both methods are allowed
+	AllowedMethods []string `yaml:"allowed_methods,omitempty"`
+
+	// List of request headers allowed in cross-origin requests
+	AllowedHeaders []string `yaml:"allowed_headers,omitempty"`
+
+	// List of response headers exposed to cross-origin requests
+	ExposedHeaders []string `yaml:"exposed_headers,omitempty"`
+
+	// Duration for caching preflight responses by browsers
+	// if omitted or zero - browser defaults are used
+	MaxAge Duration `yaml:"max_age,omitempty"`
+
+	// Whether to allow requests with credentials such as cookies
+	// and BasicAuth headers
+	AllowCredentials bool `yaml:"allow_credentials,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *CORS) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CORS
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.AllowedOrigins) == 0 {
+		return fmt.Errorf("`cors.allowed_origins` cannot be empty")
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("`cors.allow_credentials` cannot be set if `cors.allowed_origins` contains `*`")
+			}
+			continue
+		}
+		if _, err := path.Match(o, ""); err != nil {
+			return fmt.Errorf("cannot parse `cors.allowed_origins` pattern %q: %s", o, err)
+		}
+	}
+	for _, m := range c.AllowedMethods {
+		if m != "GET" && m != "POST" {
+			return fmt.Errorf("`cors.allowed_methods` must contain only `GET` or `POST`, got %q instead", m)
+		}
+	}
+	return checkOverflow(c.XXX, "cors")
+}
+
+// ClusterTarget describes a weighted cluster from `user.to_clusters`.
+type ClusterTarget struct {
+	// Name of the cluster
 	Name string `yaml:"name"`
 
-	// User password to access proxy with basic auth
-	Password string `yaml:"password,omitempty"`
+	// Weight of the cluster. Requests are spread among clusters
+	// proportionally to their weights
+	// if omitted or zero - 1 is used
+	Weight uint32 `yaml:"weight,omitempty"`
+
+	// Whether the cluster is a standby cluster receiving requests
+	// only if all the nodes of non-fallback clusters are unavailable
+	Fallback bool `yaml:"fallback,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ct *ClusterTarget) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ClusterTarget
+	if err := unmarshal((*plain)(ct)); err != nil {
+		return err
+	}
+	if len(ct.Name) == 0 {
+		return fmt.Errorf("`to_clusters.name` cannot be empty")
+	}
+	if ct.Weight == 0 {
+		ct.Weight = 1
+	}
+	return checkOverflow(ct.XXX, fmt.Sprintf("to_clusters %q", ct.Name))
+}
+
+// NetworkGroups describes a named Networks lists
+type NetworkGroups struct {
+	// Name of the group
+	Name string `yaml:"name"`
+
+	// List of networks
+	// Each list item could be IP address or subnet mask
+	Networks Networks `yaml:"networks"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ng *NetworkGroups) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain NetworkGroups
+	if err := unmarshal((*plain)(ng)); err != nil {
+		return err
+	}
+	if len(ng.Name) == 0 {
+		return fmt.Errorf("`network_group.name` must be specified")
+	}
+	if len(ng.Networks) == 0 {
+		return fmt.Errorf("`network_group.networks` must contain at least one network")
+	}
+	return checkOverflow(ng.XXX, fmt.Sprintf("network_group %q", ng.Name))
+}
+
+// NetworksOrGroups is a list of strings with names of NetworkGroups
+// or just Networks
+type NetworksOrGroups []string
+
+// Cache describes configuration options for caching
+// responses from CH clusters
+type Cache struct {
+	// Name of configuration for further assign
+	Name string `yaml:"name"`
+
+	// Path to directory where cached files will be saved.
+	// Only temporary files are saved there if `s3` is set
+	Dir string `yaml:"dir"`
+
+	// Whether cached files are flushed to disk before they are renamed
+	// from temporary files, so they survive power loss
+	Fsync bool `yaml:"fsync,omitempty"`
+
+	// Maximum total size of all cached to Dir files
+	// If size is exceeded - files are evicted according
+	// to EvictionPolicy until total size becomes normal
+	MaxSize ByteSize `yaml:"max_size"`
+
+	// Policy for evicting cached responses: "lru" or "lfu"
+	// if omitted - "lru" is used
+	EvictionPolicy string `yaml:"eviction_policy,omitempty"`
+
+	// Fraction of MaxSize after which cached responses are evicted
+	// if omitted or zero - 1 is used
+	HighWatermark float64 `yaml:"high_watermark,omitempty"`
+
+	// Fraction of MaxSize down to which cached responses are evicted
+	// if omitted or zero - 0.9 of HighWatermark is used
+	LowWatermark float64 `yaml:"low_watermark,omitempty"`
+
+	// Expiration period for cached response
+	// Files which are older than expiration period will be deleted
+	// on new request and re-cached
+	Expire Duration `yaml:"expire,omitempty"`
+
+	// Grace duration before the expired entry is deleted from the cache.
+	GraceTime Duration `yaml:"grace_time,omitempty"`
+
+	// Maximum duration requests wait for the response fetched
+	// by a concurrent request with the identical query
+	// if omitted or zero - GraceTime is used
+	// if negative - requests don't wait for concurrent fetches
+	MaxWaitForConcurrentFetch Duration `yaml:"max_wait_for_concurrent_fetch,omitempty"`
+
+	// Duration after expiration during which the expired entry
+	// is served instead of errors when ClickHouse fails
+	// if omitted or zero - expired entries aren't served on errors
+	StaleIfError Duration `yaml:"stale_if_error,omitempty"`
+
+	// Optional peering with caches of other chproxy instances
+	Peers CachePeers `yaml:"peers,omitempty"`
+
+	// Optional S3-compatible object storage for cached responses
+	// if omitted - responses are cached in Dir
+	S3 CacheS3 `yaml:"s3,omitempty"`
+
+	// Maximum total size of the most recently used responses
+	// kept in memory in front of the storage
+	// if omitted or zero - responses aren't kept in memory
+	MemSize ByteSize `yaml:"mem_size,omitempty"`
+
+	// Name of the registered cache keyer extension extending cache keys
+	Keyer string `yaml:"keyer,omitempty"`
+
+	// Optional customization of cache keys
+	Key CacheKey `yaml:"key,omitempty"`
+
+	// Optional queries executed on start and on schedule
+	// in order to fill the cache
+	Warmup CacheWarmup `yaml:"warmup,omitempty"`
+
+	// Responses smaller than MinPayloadSize aren't cached
+	// if omitted or zero - no limits would be applied
+	MinPayloadSize ByteSize `yaml:"min_payload_size,omitempty"`
+
+	// Responses bigger than MaxPayloadSize aren't cached.
+	// They are streamed to clients instead of buffering
+	// if omitted or zero - no limits would be applied
+	MaxPayloadSize ByteSize `yaml:"max_payload_size,omitempty"`
+
+	// Responses fetched from ClickHouse faster than MinQueryDuration
+	// aren't cached
+	// if omitted or zero - no limits would be applied
+	MinQueryDuration Duration `yaml:"min_query_duration,omitempty"`
+
+	// Duration for keeping error responses with CachedErrorCodes
+	// if omitted or zero - error responses aren't cached
+	ErrorTTL Duration `yaml:"error_ttl,omitempty"`
+
+	// ClickHouse exception codes of deterministic errors, which are cached
+	// for ErrorTTL
+	// if omitted - defaultCachedErrorCodes are used
+	CachedErrorCodes []int `yaml:"cached_error_codes,omitempty"`
+
+	// Whether the end of successful responses is checked for ClickHouse
+	// exceptions, which are written after the response status is sent
+	// when the query fails in the middle of streaming.
+	// Such truncated responses aren't cached and are sent
+	// with 500 status code
+	DetectStreamExceptions bool `yaml:"detect_stream_exceptions,omitempty"`
+
+	// Whether cached responses are shared among all the users of the cache
+	// if false - users with distinct `cache_key_namespace`
+	// don't share responses
+	SharedWithAllUsers bool `yaml:"shared_with_all_users,omitempty"`
+
+	// Whether cached responses are purged when INSERT, ALTER, TRUNCATE
+	// or DELETE queries for the tables read by them pass through chproxy
+	// if false - cached responses live until they expire
+	InvalidateOnWrites bool `yaml:"invalidate_on_writes,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *Cache) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Cache
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Name) == 0 {
+		return fmt.Errorf("`cache.name` must be specified")
+	}
+	if len(c.Dir) == 0 {
+		return fmt.Errorf("`cache.dir` must be specified for %q", c.Name)
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("`cache.max_size` must be specified for %q", c.Name)
+	}
+	switch c.EvictionPolicy {
+	case "", "lru", "lfu":
+	default:
+		return fmt.Errorf("unknown `cache.eviction_policy` %q for %q; expecting \"lru\" or \"lfu\"", c.EvictionPolicy, c.Name)
+	}
+	if c.HighWatermark < 0 || c.HighWatermark > 1 {
+		return fmt.Errorf("`cache.high_watermark` must be in the range (0, 1] for %q", c.Name)
+	}
+	if c.LowWatermark < 0 || c.LowWatermark >= 1 {
+		return fmt.Errorf("`cache.low_watermark` must be in the range (0, 1) for %q", c.Name)
+	}
+	if c.HighWatermark > 0 && c.LowWatermark >= c.HighWatermark {
+		return fmt.Errorf("`cache.low_watermark` must be lower than `cache.high_watermark` for %q", c.Name)
+	}
+	if c.MaxPayloadSize > 0 && c.MinPayloadSize > c.MaxPayloadSize {
+		return fmt.Errorf("`cache.min_payload_size` cannot exceed `cache.max_payload_size` for %q", c.Name)
+	}
+	if c.ErrorTTL > 0 && len(c.CachedErrorCodes) == 0 {
+		c.CachedErrorCodes = defaultCachedErrorCodes
+	}
+	if c.Expire > 0 && c.ErrorTTL > c.Expire {
+		return fmt.Errorf("`cache.error_ttl` cannot exceed `cache.expire` for %q", c.Name)
+	}
+	return checkOverflow(c.XXX, fmt.Sprintf("cache %q", c.Name))
+}
+
+// defaultCachedErrorCodes contains ClickHouse exception codes of errors,
+// which don't go away until the query is changed:
+// NO_SUCH_COLUMN_IN_TABLE, ILLEGAL_TYPE_OF_ARGUMENT, UNKNOWN_FUNCTION,
+// UNKNOWN_IDENTIFIER, UNKNOWN_TABLE, SYNTAX_ERROR and UNKNOWN_DATABASE.
+var defaultCachedErrorCodes = []int{16, 43, 46, 47, 60, 62, 81}
+
+// CacheKey describes request parts included into cache keys
+// in addition to the query and the params affecting the response format
+type CacheKey struct {
+	// Query string params included into cache keys
+	// A trailing `*` matches params with the given prefix
+	IncludeParams []string `yaml:"include_params,omitempty"`
+
+	// Params excluded from IncludeParams
+	// A trailing `*` matches params with the given prefix
+	ExcludeParams []string `yaml:"exclude_params,omitempty"`
+
+	// Request headers included into cache keys
+	IncludeHeaders []string `yaml:"include_headers,omitempty"`
+
+	// Whether comments, whitespace and the case of SQL keywords
+	// are ignored in the query when building cache keys
+	NormalizeQuery bool `yaml:"normalize_query,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ck *CacheKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CacheKey
+	if err := unmarshal((*plain)(ck)); err != nil {
+		return err
+	}
+	for _, patterns := range [][]string{ck.IncludeParams, ck.ExcludeParams} {
+		for _, p := range patterns {
+			if len(p) == 0 || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+				return fmt.Errorf("invalid param pattern %q in `cache.key`; only a trailing `*` is supported", p)
+			}
+		}
+	}
+	for _, h := range ck.IncludeHeaders {
+		if strings.EqualFold(h, "Authorization") || strings.EqualFold(h, "X-ClickHouse-Key") {
+			return fmt.Errorf("credentials header %q cannot be included into `cache.key`", h)
+		}
+	}
+	return checkOverflow(ck.XXX, "cache.key")
+}
+
+// CacheWarmup describes queries executed in order to fill the cache
+// before users request them
+type CacheWarmup struct {
+	// Name of the user executing queries
+	// The user must use the cache
+	User string `yaml:"user,omitempty"`
+
+	// Queries to execute
+	Queries []string `yaml:"queries,omitempty"`
+
+	// Path to the file with queries separated by `;` at the end of line
+	// The file is re-read before each warmup
+	File string `yaml:"file,omitempty"`
+
+	// Query string params sent with each query such as `default_format`
+	Params map[string]string `yaml:"params,omitempty"`
+
+	// Headers sent with each query such as `Accept-Encoding`
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Schedule for repeating warmup in the crontab format
+	// if omitted - queries are executed only on start and config reload
+	Schedule Schedule `yaml:"schedule,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cw *CacheWarmup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CacheWarmup
+	if err := unmarshal((*plain)(cw)); err != nil {
+		return err
+	}
+	if len(cw.User) == 0 {
+		return fmt.Errorf("`cache.warmup.user` must be specified")
+	}
+	if len(cw.Queries) == 0 && len(cw.File) == 0 {
+		return fmt.Errorf("either `cache.warmup.queries` or `cache.warmup.file` must be specified")
+	}
+	for k := range cw.Params {
+		if k == "user" || k == "password" || k == "query" {
+			return fmt.Errorf("param %q cannot be set in `cache.warmup.params`", k)
+		}
+	}
+	for k := range cw.Headers {
+		switch {
+		case strings.EqualFold(k, "Authorization"), strings.EqualFold(k, "X-ClickHouse-User"), strings.EqualFold(k, "X-ClickHouse-Key"):
+			return fmt.Errorf("credentials header %q cannot be set in `cache.warmup.headers`", k)
+		}
+	}
+	return checkOverflow(cw.XXX, "cache.warmup")
+}
+
+// CachePeers describes peering between caches with the same name
+// on distinct chproxy instances.
+//
+// Cache keys are consistently hashed among peers, so each entry
+// is owned by a single peer. Missing entries are fetched
+// from the owning peer before sending the query to ClickHouse.
+type CachePeers struct {
+	// URL of the current chproxy instance as it is seen by other peers,
+	// for example `http://10.0.0.1:9090`
+	Self string `yaml:"self"`
+
+	// URLs of all the peers including `self`
+	URLs []string `yaml:"urls"`
+
+	// Secret shared among peers for authenticating peer requests.
+	// `${VAR}` references are substituted with environment variable values
+	Secret string `yaml:"secret"`
+
+	// Timeout for requests to peers. The query is sent to ClickHouse
+	// if the owning peer doesn't respond in time
+	// if omitted or zero - 5s is used
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// Secret value from the config file
+	rawSecret string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cp *CachePeers) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CachePeers
+	if err := unmarshal((*plain)(cp)); err != nil {
+		return err
+	}
+	if len(cp.URLs) == 0 {
+		return fmt.Errorf("`cache.peers.urls` must contain at least one url")
+	}
+	hasSelf := false
+	for _, u := range cp.URLs {
+		pu, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("cannot parse `cache.peers.urls` item %q: %s", u, err)
+		}
+		if pu.Scheme != "http" && pu.Scheme != "https" {
+			return fmt.Errorf("`cache.peers.urls` item %q must have `http` or `https` scheme", u)
+		}
+		if u == cp.Self {
+			hasSelf = true
+		}
+	}
+	if !hasSelf {
+		return fmt.Errorf("`cache.peers.self` %q must be listed in `cache.peers.urls`", cp.Self)
+	}
+	if len(cp.Secret) == 0 {
+		return fmt.Errorf("`cache.peers.secret` must be specified")
+	}
+	if cp.Timeout == 0 {
+		cp.Timeout = Duration(5 * time.Second)
+	}
+	return checkOverflow(cp.XXX, "cache.peers")
+}
+
+// CacheS3 describes S3-compatible object storage for cached responses,
+// which don't fit local disk.
+//
+// Responses are streamed to and from the storage, so memory usage
+// doesn't depend on response sizes.
+type CacheS3 struct {
+	// URL of the storage, for example `https://s3.us-east-1.amazonaws.com`
+	// or `http://minio:9000`.
+	// if omitted - `https://s3.<region>.amazonaws.com` is used
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Region of the bucket
+	// if omitted - `us-east-1` is used
+	Region string `yaml:"region,omitempty"`
+
+	// Bucket for cached responses
+	Bucket string `yaml:"bucket"`
+
+	// Optional prefix for names of cached objects
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Credentials for the storage.
+	// `${VAR}` references in `secret_access_key` are substituted
+	// with environment variable values
+	AccessKeyID     string `yaml:"access_key_id,omitempty"`
+	SecretAccessKey string `yaml:"secret_access_key,omitempty"`
+
+	// Size of parts for multipart uploads. Responses exceeding
+	// the part size are uploaded in multiple parts
+	// if omitted or zero - 64Mb is used
+	PartSize ByteSize `yaml:"part_size,omitempty"`
+
+	// Secret access key from the config file
+	rawSecretAccessKey string
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// minS3PartSize is the minimum size of multipart upload parts
+// except the last one supported by S3.
+const minS3PartSize = 5 << 20
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *CacheS3) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CacheS3
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if len(c.Bucket) == 0 {
+		return fmt.Errorf("`cache.s3.bucket` must be specified")
+	}
+	if len(c.Region) == 0 {
+		c.Region = "us-east-1"
+	}
+	if len(c.Endpoint) == 0 {
+		c.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", c.Region)
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return fmt.Errorf("cannot parse `cache.s3.endpoint` %q: %s", c.Endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("`cache.s3.endpoint` %q must have `http` or `https` scheme", c.Endpoint)
+	}
+	if (len(c.AccessKeyID) > 0) != (len(c.SecretAccessKey) > 0) {
+		return fmt.Errorf("`cache.s3.access_key_id` and `cache.s3.secret_access_key` must be set together")
+	}
+	if c.PartSize == 0 {
+		c.PartSize = 64 << 20
+	}
+	if c.PartSize < minS3PartSize {
+		return fmt.Errorf("`cache.s3.part_size` cannot be less than 5Mb")
+	}
+	return checkOverflow(c.XXX, "cache.s3")
+}
+
+// ParamGroup describes named group of GET params
+// for sending with each query
+type ParamGroup struct {
+	// Name of configuration for further assign
+	Name string `yaml:"name"`
+
+	// Params contains a list of GET params
+	Params []Param `yaml:"params"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (pg *ParamGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ParamGroup
+	if err := unmarshal((*plain)(pg)); err != nil {
+		return err
+	}
+	if len(pg.Name) == 0 {
+		return fmt.Errorf("`param_group.name` must be specified")
+	}
+	if len(pg.Params) == 0 {
+		return fmt.Errorf("`param_group.params` must contain at least one param")
+	}
+	return checkOverflow(pg.XXX, fmt.Sprintf("param_group %q", pg.Name))
+}
+
+// Param describes URL param value
+type Param struct {
+	// Key is a name of params
+	Key string `yaml:"key"`
+	// Value is a value of param
+	Value string `yaml:"value"`
+}
+
+// JWT describes verification of JWT bearer tokens
+type JWT struct {
+	// URL of JWKS document with keys for verifying token signatures
+	JWKSURL string `yaml:"jwks_url,omitempty"`
+
+	// Path to PEM file with RSA or ECDSA public key for verifying
+	// token signatures. Cannot be set together with JWKSURL
+	KeyFile string `yaml:"key_file,omitempty"`
+
+	// Expected `iss` claim
+	// if omitted - the claim isn't checked
+	Issuer string `yaml:"issuer,omitempty"`
+
+	// Expected `aud` claim
+	// if omitted - the claim isn't checked
+	Audience string `yaml:"audience,omitempty"`
+
+	// Claim containing the name of chproxy user
+	// if omitted - `sub` is used
+	UserClaim string `yaml:"user_claim,omitempty"`
+
+	// Interval for re-fetching keys from JWKSURL
+	// if omitted or zero - interval will be set to 1h
+	RefreshInterval Duration `yaml:"refresh_interval,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (j *JWT) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain JWT
+	if err := unmarshal((*plain)(j)); err != nil {
+		return err
+	}
+	if len(j.JWKSURL) == 0 && len(j.KeyFile) == 0 {
+		return fmt.Errorf("either `jwt.jwks_url` or `jwt.key_file` must be specified")
+	}
+	if len(j.JWKSURL) > 0 && len(j.KeyFile) > 0 {
+		return fmt.Errorf("`jwt.jwks_url` and `jwt.key_file` cannot be set simultaneously")
+	}
+	if len(j.UserClaim) == 0 {
+		j.UserClaim = "sub"
+	}
+	if j.RefreshInterval == 0 {
+		j.RefreshInterval = Duration(time.Hour)
+	}
+	return checkOverflow(j.XXX, "jwt")
+}
 
-	// ToCluster is the name of cluster where requests
-	// will be proxied
-	ToCluster string `yaml:"to_cluster"`
+// Auth describes external backends for authenticating users
+type Auth struct {
+	// LDAP or Active Directory server validating user credentials
+	LDAP LDAP `yaml:"ldap,omitempty"`
 
-	// ToUser is the name of cluster_user from cluster's ToCluster
-	// whom credentials will be used for proxying request to CH
-	ToUser string `yaml:"to_user"`
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
 
-	// Maximum number of concurrently running queries for user
-	// if omitted or zero - no limits would be applied
-	MaxConcurrentQueries uint32 `yaml:"max_concurrent_queries,omitempty"`
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (a *Auth) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Auth
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+	return checkOverflow(a.XXX, "auth")
+}
 
-	// Maximum duration of query execution for user
-	// if omitted or zero - no limits would be applied
-	MaxExecutionTime Duration `yaml:"max_execution_time,omitempty"`
+// LDAP describes LDAP server validating credentials of users,
+// which are missing in `users`
+type LDAP struct {
+	// LDAP server URL, for example `ldaps://ldap.local:636`
+	URL string `yaml:"url"`
 
-	// Maximum number of requests per minute for user
-	// if omitted or zero - no limits would be applied
-	ReqPerMin uint32 `yaml:"requests_per_minute,omitempty"`
+	// Whether to upgrade `ldap://` connections to TLS via StartTLS
+	StartTLS bool `yaml:"start_tls,omitempty"`
 
-	// Maximum number of queries waiting for execution in the queue
-	// if omitted or zero - queries are executed without waiting
-	// in the queue
-	MaxQueueSize uint32 `yaml:"max_queue_size,omitempty"`
+	// Path to PEM file with CA certificates for verifying LDAP server
+	// if omitted - system CA certificates are used
+	CAFile string `yaml:"ca_file,omitempty"`
 
-	// Maximum duration the query may wait in the queue
-	// if omitted or zero - 10s duration is used
-	MaxQueueTime Duration `yaml:"max_queue_time,omitempty"`
+	// DN for searching users
+	// if omitted - users are searched anonymously
+	BindDN string `yaml:"bind_dn,omitempty"`
 
-	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
+	// Password for BindDN.
+	// `${VAR}` references are substituted with environment variable values
+	BindPassword string `yaml:"bind_password,omitempty"`
 
-	// List of networks that access is allowed from
-	// Each list item could be IP address or subnet mask
-	// if omitted or zero - no limits would be applied
-	AllowedNetworks Networks `yaml:"-"`
+	// DN of the subtree containing users
+	BaseDN string `yaml:"base_dn"`
 
-	// Whether to deny http connections for this user
-	DenyHTTP bool `yaml:"deny_http,omitempty"`
+	// Filter for searching the user entry.
+	// `{username}` is substituted with the name from request
+	// if omitted - `(uid={username})` is used
+	UserFilter string `yaml:"user_filter,omitempty"`
 
-	// Whether to deny https connections for this user
-	DenyHTTPS bool `yaml:"deny_https,omitempty"`
+	// User entry attribute containing DNs of groups the user belongs to
+	// if omitted - `memberOf` is used
+	GroupAttribute string `yaml:"group_attribute,omitempty"`
 
-	// Whether to allow CORS requests for this user
-	AllowCORS bool `yaml:"allow_cors,omitempty"`
+	// Mappings of LDAP groups to chproxy users.
+	// The first mapping matching user groups is used
+	GroupMappings []LDAPGroupMapping `yaml:"group_mappings"`
 
-	// Name of Cache configuration to use for responses of this user
-	Cache string `yaml:"cache,omitempty"`
+	// Timeout for requests to LDAP server
+	// if omitted or zero - timeout will be set to 10s
+	Timeout Duration `yaml:"timeout,omitempty"`
 
-	// Name of ParamGroup to use
-	Params string `yaml:"params,omitempty"`
+	// BindPassword value from the config file
+	rawBindPassword string
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (u *User) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain User
-	if err := unmarshal((*plain)(u)); err != nil {
+func (l *LDAP) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LDAP
+	if err := unmarshal((*plain)(l)); err != nil {
 		return err
 	}
-
-	if len(u.Name) == 0 {
-		return fmt.Errorf("`user.name` cannot be empty")
+	if len(l.URL) == 0 {
+		return fmt.Errorf("`auth.ldap.url` must be specified")
 	}
-
-	if len(u.ToUser) == 0 {
-		return fmt.Errorf("`user.to_user` cannot be empty for %q", u.Name)
+	if !strings.HasPrefix(l.URL, "ldap://") && !strings.HasPrefix(l.URL, "ldaps://") {
+		return fmt.Errorf("`auth.ldap.url` must start with `ldap://` or `ldaps://`; got %q", l.URL)
 	}
-
-	if len(u.ToCluster) == 0 {
-		return fmt.Errorf("`user.to_cluster` cannot be empty for %q", u.Name)
+	if l.StartTLS && strings.HasPrefix(l.URL, "ldaps://") {
+		return fmt.Errorf("`auth.ldap.start_tls` cannot be set for `ldaps://` url")
 	}
-
-	if u.DenyHTTP && u.DenyHTTPS {
-		return fmt.Errorf("`deny_http` and `deny_https` cannot be simultaneously set to `true` for %q", u.Name)
+	if len(l.BaseDN) == 0 {
+		return fmt.Errorf("`auth.ldap.base_dn` must be specified")
 	}
-
-	if u.MaxQueueTime > 0 && u.MaxQueueSize == 0 {
-		return fmt.Errorf("`max_queue_size` must be set if `max_queue_time` is set for %q", u.Name)
+	if len(l.GroupMappings) == 0 {
+		return fmt.Errorf("`auth.ldap.group_mappings` must contain at least 1 mapping")
 	}
-
-	return checkOverflow(u.XXX, fmt.Sprintf("user %q", u.Name))
+	if len(l.UserFilter) == 0 {
+		l.UserFilter = "(uid={username})"
+	}
+	if !strings.Contains(l.UserFilter, "{username}") {
+		return fmt.Errorf("`auth.ldap.user_filter` must contain `{username}`")
+	}
+	if len(l.GroupAttribute) == 0 {
+		l.GroupAttribute = "memberOf"
+	}
+	if l.Timeout == 0 {
+		l.Timeout = Duration(10 * time.Second)
+	}
+	return checkOverflow(l.XXX, "auth.ldap")
 }
 
-// NetworkGroups describes a named Networks lists
-type NetworkGroups struct {
-	// Name of the group
-	Name string `yaml:"name"`
+// LDAPGroupMapping maps LDAP group to chproxy user
+type LDAPGroupMapping struct {
+	// DN of LDAP group
+	Group string `yaml:"group"`
 
-	// List of networks
-	// Each list item could be IP address or subnet mask
-	Networks Networks `yaml:"networks"`
+	// Name of chproxy user, whose settings are applied to requests
+	// of group members
+	User string `yaml:"user"`
 
-	// Catches all undefined fields and must be empty after parsing.
+	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (ng *NetworkGroups) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain NetworkGroups
-	if err := unmarshal((*plain)(ng)); err != nil {
+func (m *LDAPGroupMapping) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LDAPGroupMapping
+	if err := unmarshal((*plain)(m)); err != nil {
 		return err
 	}
-	if len(ng.Name) == 0 {
-		return fmt.Errorf("`network_group.name` must be specified")
+	if len(m.Group) == 0 {
+		return fmt.Errorf("`auth.ldap.group_mappings.group` must be specified")
 	}
-	if len(ng.Networks) == 0 {
-		return fmt.Errorf("`network_group.networks` must contain at least one network")
+	if len(m.User) == 0 {
+		return fmt.Errorf("`auth.ldap.group_mappings.user` must be specified for group %q", m.Group)
 	}
-	return checkOverflow(ng.XXX, fmt.Sprintf("network_group %q", ng.Name))
+	return checkOverflow(m.XXX, "auth.ldap.group_mappings")
 }
 
-// NetworksOrGroups is a list of strings with names of NetworkGroups
-// or just Networks
-type NetworksOrGroups []string
-
-// Cache describes configuration options for caching
-// responses from CH clusters
-type Cache struct {
-	// Name of configuration for further assign
-	Name string `yaml:"name"`
-
-	// Path to directory where cached files will be saved
-	Dir string `yaml:"dir"`
-
-	// Maximum total size of all cached to Dir files
-	// If size is exceeded - the oldest files in Dir will be deleted
-	// until total size becomes normal
-	MaxSize ByteSize `yaml:"max_size"`
-
-	// Expiration period for cached response
-	// Files which are older than expiration period will be deleted
-	// on new request and re-cached
-	Expire Duration `yaml:"expire,omitempty"`
+// Sessions describes session tokens, which are issued by `/session`
+// endpoint in exchange for valid credentials
+type Sessions struct {
+	// Lifetime of session tokens
+	TTL Duration `yaml:"ttl"`
 
-	// Grace duration before the expired entry is deleted from the cache.
-	GraceTime Duration `yaml:"grace_time,omitempty"`
+	// Maximum number of active sessions
+	// if omitted or zero - 100000 sessions are allowed
+	MaxSessions int `yaml:"max_sessions,omitempty"`
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (c *Cache) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain Cache
-	if err := unmarshal((*plain)(c)); err != nil {
+func (s *Sessions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Sessions
+	if err := unmarshal((*plain)(s)); err != nil {
 		return err
 	}
-	if len(c.Name) == 0 {
-		return fmt.Errorf("`cache.name` must be specified")
+	if s.TTL <= 0 {
+		return fmt.Errorf("`sessions.ttl` must be positive")
 	}
-	if len(c.Dir) == 0 {
-		return fmt.Errorf("`cache.dir` must be specified for %q", c.Name)
+	if s.MaxSessions < 0 {
+		return fmt.Errorf("`sessions.max_sessions` cannot be negative")
 	}
-	if c.MaxSize <= 0 {
-		return fmt.Errorf("`cache.max_size` must be specified for %q", c.Name)
+	if s.MaxSessions == 0 {
+		s.MaxSessions = 100000
 	}
-	return checkOverflow(c.XXX, fmt.Sprintf("cache %q", c.Name))
+	return checkOverflow(s.XXX, "sessions")
 }
 
-// ParamGroup describes named group of GET params
-// for sending with each query
-type ParamGroup struct {
-	// Name of configuration for further assign
+// Extensions describes configuration for Go extensions registered
+// via extension package
+type Extensions struct {
+	// Paths to Go plugins registering extensions.
+	// Plugins cannot be unloaded, so plugins removed from the list
+	// remain loaded until restart
+	Plugins []string `yaml:"plugins,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (e *Extensions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Extensions
+	if err := unmarshal((*plain)(e)); err != nil {
+		return err
+	}
+	return checkOverflow(e.XXX, "extensions")
+}
+
+// Hook describes an external process, which may inspect and modify
+// proxied requests.
+//
+// Hooks written in Lua or compiled to WASM are run with the corresponding
+// interpreter, for example `["lua", "policy.lua"]`
+// or `["wasmtime", "policy.wasm"]`.
+type Hook struct {
+	// Hook name used in logs and errors
 	Name string `yaml:"name"`
 
-	// Params contains a list of GET params
-	Params []Param `yaml:"params"`
+	// Command with args starting the hook process
+	Command []string `yaml:"command"`
+
+	// Maximum duration for the hook reply
+	// if omitted or zero - 1s is used
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// Number of hook processes serving requests concurrently
+	// if omitted or zero - 4 is used
+	Processes int `yaml:"processes,omitempty"`
+
+	// Whether to notify the hook about response status
+	OnResponse bool `yaml:"on_response,omitempty"`
 
 	// Catches all undefined fields
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
-func (pg *ParamGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	type plain ParamGroup
-	if err := unmarshal((*plain)(pg)); err != nil {
+func (h *Hook) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Hook
+	if err := unmarshal((*plain)(h)); err != nil {
 		return err
 	}
-	if len(pg.Name) == 0 {
-		return fmt.Errorf("`param_group.name` must be specified")
+	if len(h.Name) == 0 {
+		return fmt.Errorf("`hook.name` must be specified")
 	}
-	if len(pg.Params) == 0 {
-		return fmt.Errorf("`param_group.params` must contain at least one param")
+	if len(h.Command) == 0 {
+		return fmt.Errorf("`hook.command` must be specified for %q", h.Name)
 	}
-	return checkOverflow(pg.XXX, fmt.Sprintf("param_group %q", pg.Name))
-}
-
-// Param describes URL param value
-type Param struct {
-	// Key is a name of params
-	Key string `yaml:"key"`
-	// Value is a value of param
-	Value string `yaml:"value"`
+	if h.Timeout == 0 {
+		h.Timeout = Duration(time.Second)
+	}
+	if h.Processes < 0 {
+		return fmt.Errorf("`hook.processes` cannot be negative for %q", h.Name)
+	}
+	if h.Processes == 0 {
+		h.Processes = 4
+	}
+	return checkOverflow(h.XXX, fmt.Sprintf("hook %q", h.Name))
 }
 
 // ClusterUser describes simplest <users> configuration
@@ -602,6 +3241,17 @@ type ClusterUser struct {
 	// User password in ClickHouse users.xml config
 	Password string `yaml:"password,omitempty"`
 
+	// Path to file containing the password.
+	// Cannot be set together with Password
+	PasswordFile string `yaml:"password_file,omitempty"`
+
+	// Path to Vault secret containing `password` and optional `username`
+	// for the user. Cannot be set together with Password or PasswordFile
+	VaultSecret string `yaml:"vault_secret,omitempty"`
+
+	// Password value from the config file
+	rawPassword string
+
 	// Maximum number of concurrently running queries for user
 	// if omitted or zero - no limits would be applied
 	MaxConcurrentQueries uint32 `yaml:"max_concurrent_queries,omitempty"`
@@ -610,6 +3260,11 @@ type ClusterUser struct {
 	// if omitted or zero - no limits would be applied
 	MaxExecutionTime Duration `yaml:"max_execution_time,omitempty"`
 
+	// Maximum duration without new response bytes from ClickHouse.
+	// The query is killed when the limit is exceeded
+	// if omitted or zero - no limits would be applied
+	MaxIdleTime Duration `yaml:"max_idle_time,omitempty"`
+
 	// Maximum number of requests per minute for user
 	// if omitted or zero - no limits would be applied
 	ReqPerMin uint32 `yaml:"requests_per_minute,omitempty"`
@@ -623,6 +3278,11 @@ type ClusterUser struct {
 	// if omitted or zero - 10s duration is used
 	MaxQueueTime Duration `yaml:"max_queue_time,omitempty"`
 
+	// Maximum size of the request body proxied via the cluster user.
+	// Larger requests are rejected with `413 Request Entity Too Large`
+	// if omitted or zero - no limits would be applied
+	MaxRequestBodySize ByteSize `yaml:"max_request_body_size,omitempty"`
+
 	NetworksOrGroups NetworksOrGroups `yaml:"allowed_networks,omitempty"`
 
 	// List of networks that access is allowed from
@@ -645,23 +3305,84 @@ func (cu *ClusterUser) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("`cluster.user.name` cannot be empty")
 	}
 
-	if cu.MaxQueueTime > 0 && cu.MaxQueueSize == 0 {
-		return fmt.Errorf("`max_queue_size` must be set if `max_queue_time` is set for %q", cu.Name)
+	if len(cu.Password) > 0 && len(cu.PasswordFile) > 0 {
+		return fmt.Errorf("`cluster.user.password` and `cluster.user.password_file` cannot be set simultaneously for %q", cu.Name)
+	}
+
+	if len(cu.VaultSecret) > 0 && (len(cu.Password) > 0 || len(cu.PasswordFile) > 0) {
+		return fmt.Errorf("`cluster.user.vault_secret` cannot be set together with `password` or `password_file` for %q", cu.Name)
 	}
 
 	return checkOverflow(cu.XXX, fmt.Sprintf("cluster.user %q", cu.Name))
 }
 
+// setWriteTimeout derives `write_timeout` of the given listener from
+// its `max_response_time` or from limits of users and cluster users
+// if it isn't set explicitly.
+//
+// Warnings are recorded for users, which limits exceed `write_timeout`,
+// since their responses may be cut off.
+func (c *Config) setWriteTimeout(listener string, tc *TimeoutCfg) {
+	if tc.WriteTimeout == 0 {
+		maxResponseTime := c.maxResponseTime
+		if tc.MaxResponseTime > 0 {
+			maxResponseTime = time.Duration(tc.MaxResponseTime)
+		}
+		// Give an additional minute for the maximum response time,
+		// so the response body may be sent to the requester.
+		tc.WriteTimeout = Duration(maxResponseTime + time.Minute)
+	}
+	wt := time.Duration(tc.WriteTimeout)
+	queueTime := time.Duration(c.Server.MaxQueueTime)
+	for _, u := range c.Users {
+		if d := time.Duration(u.MaxExecutionTime+u.MaxQueueTime) + queueTime; d > wt {
+			c.warnings = append(c.warnings, fmt.Sprintf("`max_execution_time` and `max_queue_time` of user %q sum up to %s, "+
+				"which exceeds `%s.write_timeout` %s", u.Name, d, listener, wt))
+		}
+	}
+	for _, cl := range c.Clusters {
+		for _, cu := range cl.ClusterUsers {
+			if d := time.Duration(cu.MaxExecutionTime+cu.MaxQueueTime) + queueTime; d > wt {
+				c.warnings = append(c.warnings, fmt.Sprintf("`max_execution_time` and `max_queue_time` of cluster %q user %q sum up to %s, "+
+					"which exceeds `%s.write_timeout` %s", cl.Name, cu.Name, d, listener, wt))
+			}
+		}
+	}
+}
+
+// MaxResponseTime returns the maximum response time derived from
+// `max_execution_time` and `max_queue_time` of users and cluster users.
+func (c *Config) MaxResponseTime() time.Duration {
+	return c.maxResponseTime
+}
+
+// Warnings returns non-fatal problems found in the config.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
 // LoadFile loads and validates configuration from provided .yml file
 func LoadFile(filename string) (*Config, error) {
 	content, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
 	}
+	return Load(content)
+}
+
+// Load loads and validates configuration from the given .yml content
+func Load(content []byte) (*Config, error) {
+	var err error
+	if content, err = expandConfigEnv(content); err != nil {
+		return nil, err
+	}
 	cfg := &Config{}
 	if err := yaml.Unmarshal([]byte(content), cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.resolvePasswords(); err != nil {
+		return nil, err
+	}
 	cfg.networkReg = make(map[string]Networks, len(cfg.NetworkGroups))
 	for _, ng := range cfg.NetworkGroups {
 		if _, ok := cfg.networkReg[ng.Name]; ok {
@@ -672,12 +3393,24 @@ func LoadFile(filename string) (*Config, error) {
 	if cfg.Server.HTTP.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.HTTP.NetworksOrGroups); err != nil {
 		return nil, err
 	}
+	for i := range cfg.Server.HTTP.ExtraListeners {
+		l := &cfg.Server.HTTP.ExtraListeners[i]
+		if l.AllowedNetworks, err = cfg.groupToNetwork(l.NetworksOrGroups); err != nil {
+			return nil, err
+		}
+	}
 	if cfg.Server.HTTPS.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.HTTPS.NetworksOrGroups); err != nil {
 		return nil, err
 	}
 	if cfg.Server.Metrics.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.Metrics.NetworksOrGroups); err != nil {
 		return nil, err
 	}
+	if cfg.Server.Admin.AllowedNetworks, err = cfg.groupToNetwork(cfg.Server.Admin.NetworksOrGroups); err != nil {
+		return nil, err
+	}
+	if cfg.Server.ProxyHeaders.TrustedProxies, err = cfg.groupToNetwork(cfg.Server.ProxyHeaders.NetworksOrGroups); err != nil {
+		return nil, err
+	}
 	var maxResponseTime time.Duration
 	for i := range cfg.Clusters {
 		c := &cfg.Clusters[i]
@@ -706,15 +3439,22 @@ func LoadFile(filename string) (*Config, error) {
 	if maxResponseTime < 0 {
 		maxResponseTime = 0
 	}
-	// Give an additional minute for the maximum response time,
-	// so the response body may be sent to the requester.
-	maxResponseTime += time.Minute
-	if len(cfg.Server.HTTP.ListenAddr) > 0 && cfg.Server.HTTP.WriteTimeout == 0 {
-		cfg.Server.HTTP.WriteTimeout = Duration(maxResponseTime)
+	// Requests may additionally wait in the server-level queue.
+	maxResponseTime += time.Duration(cfg.Server.MaxQueueTime)
+	cfg.maxResponseTime = maxResponseTime
+	if len(cfg.Server.HTTP.ListenAddr) > 0 {
+		cfg.setWriteTimeout("server.http", &cfg.Server.HTTP.TimeoutCfg)
+	}
+	for i := range cfg.Server.HTTP.ExtraListeners {
+		l := &cfg.Server.HTTP.ExtraListeners[i]
+		cfg.setWriteTimeout(fmt.Sprintf("server.http[%d]", i+1), &l.TimeoutCfg)
+	}
+	if len(cfg.Server.HTTPS.ListenAddr) > 0 {
+		cfg.setWriteTimeout("server.https", &cfg.Server.HTTPS.TimeoutCfg)
 	}
 
-	if len(cfg.Server.HTTPS.ListenAddr) > 0 && cfg.Server.HTTPS.WriteTimeout == 0 {
-		cfg.Server.HTTPS.WriteTimeout = Duration(maxResponseTime)
+	if err := cfg.checkReferences(); err != nil {
+		return nil, err
 	}
 
 	if err := cfg.checkVulnerabilities(); err != nil {
@@ -723,6 +3463,155 @@ func LoadFile(filename string) (*Config, error) {
 	return cfg, nil
 }
 
+// checkReferences verifies names are unique and references between users,
+// clusters, cluster users, caches and param groups are valid.
+//
+// All the found problems are listed in the returned error.
+func (c Config) checkReferences() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	clusterUsers := make(map[string]map[string]bool, len(c.Clusters))
+	for _, cl := range c.Clusters {
+		if _, ok := clusterUsers[cl.Name]; ok {
+			addProblem("duplicate `clusters.name` %q", cl.Name)
+			continue
+		}
+		users := make(map[string]bool, len(cl.ClusterUsers))
+		for _, cu := range cl.ClusterUsers {
+			if users[cu.Name] {
+				addProblem("duplicate `cluster.users.name` %q in cluster %q", cu.Name, cl.Name)
+			}
+			users[cu.Name] = true
+		}
+		clusterUsers[cl.Name] = users
+	}
+
+	caches := make(map[string]bool, len(c.Caches))
+	for _, cc := range c.Caches {
+		if caches[cc.Name] {
+			addProblem("duplicate `caches.name` %q", cc.Name)
+		}
+		caches[cc.Name] = true
+	}
+
+	params := make(map[string]bool, len(c.ParamGroups))
+	for _, pg := range c.ParamGroups {
+		if params[pg.Name] {
+			addProblem("duplicate `param_groups.name` %q", pg.Name)
+		}
+		params[pg.Name] = true
+	}
+
+	users := make(map[string]bool, len(c.Users))
+	for _, u := range c.Users {
+		if users[u.Name] {
+			addProblem("duplicate `users.name` %q", u.Name)
+		}
+		users[u.Name] = true
+
+		targets := u.ToClusters
+		if len(u.ToCluster) > 0 {
+			targets = []ClusterTarget{{Name: u.ToCluster}}
+		}
+		for _, ct := range targets {
+			cus, ok := clusterUsers[ct.Name]
+			if !ok {
+				addProblem("unknown cluster %q in `to_cluster` for %q", ct.Name, u.Name)
+				continue
+			}
+			if !cus[u.ToUser] {
+				addProblem("unknown cluster user %q in `to_user` for %q: cluster %q has no such user", u.ToUser, u.Name, ct.Name)
+			}
+		}
+		for _, class := range []string{"select", "insert", "ddl", "other"} {
+			name, ok := u.Route[class]
+			if !ok {
+				continue
+			}
+			cus, ok := clusterUsers[name]
+			if !ok {
+				addProblem("unknown cluster %q in `route.%s` for %q", name, class, u.Name)
+				continue
+			}
+			if !cus[u.ToUser] {
+				addProblem("unknown cluster user %q in `to_user` for %q: cluster %q has no such user", u.ToUser, u.Name, name)
+			}
+		}
+		for _, name := range u.AllowedClusters {
+			cus, ok := clusterUsers[name]
+			if !ok {
+				addProblem("unknown cluster %q in `allowed_clusters` for %q", name, u.Name)
+				continue
+			}
+			if !cus[u.ToUser] {
+				addProblem("unknown cluster user %q in `to_user` for %q: cluster %q has no such user", u.ToUser, u.Name, name)
+			}
+		}
+		if len(u.MirrorToCluster) > 0 {
+			cus, ok := clusterUsers[u.MirrorToCluster]
+			if !ok {
+				addProblem("unknown cluster %q in `mirror_to_cluster` for %q", u.MirrorToCluster, u.Name)
+			} else if !cus[u.ToUser] {
+				addProblem("unknown cluster user %q in `to_user` for %q: cluster %q has no such user", u.ToUser, u.Name, u.MirrorToCluster)
+			}
+		}
+		if len(u.Cache) > 0 && !caches[u.Cache] {
+			addProblem("unknown `cache` %q for %q", u.Cache, u.Name)
+		}
+		if len(u.Params) > 0 && !params[u.Params] {
+			addProblem("unknown `params` %q for %q", u.Params, u.Name)
+		}
+	}
+
+	for _, cc := range c.Caches {
+		name := cc.Warmup.User
+		if len(name) == 0 {
+			continue
+		}
+		if !users[name] {
+			addProblem("unknown `warmup.user` %q for cache %q", name, cc.Name)
+			continue
+		}
+		for _, u := range c.Users {
+			if u.Name != name {
+				continue
+			}
+			if u.IsWildcarded {
+				addProblem("wildcarded user %q cannot be used in `warmup.user` for cache %q", name, cc.Name)
+			}
+			if u.Cache != cc.Name {
+				addProblem("`warmup.user` %q must use cache %q", name, cc.Name)
+			}
+		}
+	}
+
+	for _, l := range c.Server.HTTP.AllListeners() {
+		if len(l.DefaultUser) == 0 {
+			continue
+		}
+		if !users[l.DefaultUser] {
+			addProblem("unknown `default_user` %q for http listener on %q", l.DefaultUser, l.ListenAddr)
+		}
+		for _, u := range c.Users {
+			if u.Name == l.DefaultUser && u.IsWildcarded {
+				addProblem("wildcarded user %q cannot be used in `default_user` for http listener on %q", u.Name, l.ListenAddr)
+			}
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s", problems[0])
+	default:
+		return fmt.Errorf("found %d problems in config:\n\t%s", len(problems), strings.Join(problems, "\n\t"))
+	}
+}
+
 func (c Config) groupToNetwork(src NetworksOrGroups) (Networks, error) {
 	if len(src) == 0 {
 		return nil, nil
@@ -748,12 +3637,27 @@ func (c Config) checkVulnerabilities() error {
 		return nil
 	}
 	httpsVulnerability := len(c.Server.HTTPS.ListenAddr) > 0 && len(c.Server.HTTPS.NetworksOrGroups) == 0
-	httpVulnerability := len(c.Server.HTTP.ListenAddr) > 0 && len(c.Server.HTTP.NetworksOrGroups) == 0
+	httpVulnerability := false
+	for _, l := range c.Server.HTTP.AllListeners() {
+		if len(l.ListenAddr) == 0 || len(l.NetworksOrGroups) > 0 {
+			continue
+		}
+		if len(l.DefaultUser) > 0 {
+			return fmt.Errorf("http: listener on %q authorizes requests without credentials as `default_user` %q, "+
+				"but isn't limited by `allowed_networks`", l.ListenAddr, l.DefaultUser)
+		}
+		httpVulnerability = true
+	}
+	ldapUsers := make(map[string]bool)
+	for _, m := range c.Auth.LDAP.GroupMappings {
+		ldapUsers[m.User] = true
+	}
 	for _, u := range c.Users {
 		if len(u.NetworksOrGroups) != 0 {
 			continue
 		}
-		if len(u.Password) == 0 {
+		hasCredentials := len(u.Password) > 0 || len(u.Authenticator) > 0 || u.AllowJWT || ldapUsers[u.Name] || u.IsWildcarded
+		if !hasCredentials {
 			if !u.DenyHTTPS && httpsVulnerability {
 				return fmt.Errorf("https: user %q has neither password nor `allowed_networks` on `user` or `server.http` level", u.Name)
 			}
@@ -761,10 +3665,15 @@ func (c Config) checkVulnerabilities() error {
 				return fmt.Errorf("http: user %q has neither password nor `allowed_networks` on `user` or `server.http` level", u.Name)
 			}
 		}
-		if len(u.Password) > 0 && httpVulnerability {
+		if hasCredentials && httpVulnerability {
 			return fmt.Errorf("http: user %q is allowed to connect via http, but not limited by `allowed_networks` "+
 				"on `user` or `server.http` level - password could be stolen", u.Name)
 		}
 	}
+	admin := c.Server.Admin
+	if len(admin.User) > 0 && len(admin.NetworksOrGroups) == 0 && (len(admin.ListenAddr) > 0 || httpVulnerability) {
+		return fmt.Errorf("admin endpoints are accessible via http, but not limited by `allowed_networks` " +
+			"on `server.admin` level - password could be stolen")
+	}
 	return nil
 }
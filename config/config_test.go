@@ -2,8 +2,12 @@ package config
 
 import (
 	"bytes"
+	"crypto/tls"
 	"gopkg.in/yaml.v2"
 	"net"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,17 +24,30 @@ func TestLoadConfig(t *testing.T) {
 			Config{
 				Caches: []Cache{
 					{
-						Name:      "longterm",
-						Dir:       "/path/to/longterm/cachedir",
-						MaxSize:   ByteSize(100 << 30),
-						Expire:    Duration(time.Hour),
-						GraceTime: Duration(20 * time.Second),
+						Name:         "longterm",
+						Dir:          "/path/to/longterm/cachedir",
+						MaxSize:      ByteSize(100 << 30),
+						Expire:       Duration(time.Hour),
+						GraceTime:    Duration(20 * time.Second),
+						StaleIfError: Duration(6 * time.Hour),
 					},
 					{
 						Name:    "shortterm",
 						Dir:     "/path/to/shortterm/cachedir",
 						MaxSize: ByteSize(100 << 20),
 						Expire:  Duration(10 * time.Second),
+						Peers: CachePeers{
+							Self:    "http://10.0.0.1:9090",
+							URLs:    []string{"http://10.0.0.1:9090", "http://10.0.0.2:9090"},
+							Secret:  "peers-secret",
+							Timeout: Duration(2 * time.Second),
+						},
+						Key: CacheKey{
+							IncludeParams:  []string{"param_*", "max_threads"},
+							ExcludeParams:  []string{"param_request_id"},
+							IncludeHeaders: []string{"X-Tenant"},
+							NormalizeQuery: true,
+						},
 					},
 				},
 				HackMePlease: true,
@@ -51,17 +68,110 @@ func TestLoadConfig(t *testing.T) {
 							CacheDir:     "certs_dir",
 							AllowedHosts: []string{"example.com"},
 						},
+						TLS: TLS{
+							MinVersion: "1.2",
+							MaxVersion: "1.2",
+							CipherSuites: []string{
+								"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+								"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+							},
+							CurvePreferences: []string{"P384", "P256"},
+							MinVersionID:     tls.VersionTLS12,
+							MaxVersionID:     tls.VersionTLS12,
+							CipherSuiteIDs: []uint16{
+								tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+								tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+							},
+							CurvePreferenceIDs: []tls.CurveID{tls.CurveP384, tls.CurveP256},
+						},
 						TimeoutCfg: TimeoutCfg{
 							ReadTimeout:  Duration(time.Minute),
-							WriteTimeout: Duration(140 * time.Second),
+							WriteTimeout: Duration(220 * time.Second),
 							IdleTimeout:  Duration(10 * time.Minute),
 						},
 					},
 					Metrics: Metrics{
 						NetworksOrGroups: []string{"office"},
 					},
+					Admin: Admin{
+						ListenAddr:       ":9091",
+						NetworksOrGroups: []string{"office"},
+						User:             "admin",
+						Password:         "****",
+						QueryHistory: QueryHistory{
+							Size: 50,
+							File: "/var/lib/chproxy/query_history.json",
+						},
+					},
+					MaxConcurrentRequests: 1000,
+					MaxQueueSize:          5000,
+					MaxQueueTime:          Duration(5 * time.Second),
+					MaxMemoryUsage:        ByteSize(2 << 30),
+					ProxyHeaders: ProxyHeaders{
+						NetworksOrGroups: []string{"10.0.0.0/8"},
+					},
 				},
 				LogDebug: true,
+				ErrorLogSampling: ErrorLogSampling{
+					Burst:    5,
+					Interval: Duration(30 * time.Second),
+				},
+
+				Profiling: Profiling{
+					Interval:    Duration(5 * time.Minute),
+					CPUDuration: Duration(30 * time.Second),
+					Dir:         "/path/to/profiles",
+					Retention:   Duration(72 * time.Hour),
+					PushURL:     "http://pyroscope.local:4040",
+					AppName:     "chproxy-prod",
+				},
+
+				Recording: Recording{
+					File:         "/path/to/requests.log",
+					MaxQuerySize: ByteSize(1 << 20),
+				},
+				SPIFFE: SPIFFE{
+					CertFile:        "/run/spiffe/svid.pem",
+					KeyFile:         "/run/spiffe/svid_key.pem",
+					BundleFile:      "/run/spiffe/bundle.pem",
+					RefreshInterval: Duration(30 * time.Second),
+				},
+				AuthCache: AuthCache{
+					PositiveTTL: Duration(5 * time.Minute),
+					NegativeTTL: Duration(30 * time.Second),
+					MaxEntries:  1000,
+				},
+				SharedLimiter: SharedLimiter{
+					RedisAddr:     "redis.local:6379",
+					RedisPassword: "***",
+					RedisDB:       1,
+					KeyPrefix:     "chproxy-prod:",
+					Timeout:       Duration(200 * time.Millisecond),
+
+					CoordinateConcurrentQueries: true,
+					QueryLease:                  Duration(30 * time.Minute),
+				},
+				Defaults: Defaults{
+					User: UserDefaults{
+						MaxExecutionTime: Duration(2 * time.Minute),
+					},
+					Cluster: ClusterDefaults{
+						HeartBeatInterval: Duration(10 * time.Second),
+					},
+					ClusterUser: ClusterUserDefaults{
+						ReqPerMin: 100,
+					},
+				},
+				Profiles: []Profile{
+					{
+						Name: "reporting",
+						Settings: UserDefaults{
+							MaxConcurrentQueries: 8,
+							MaxQueueSize:         10,
+							MaxQueueTime:         Duration(20 * time.Second),
+						},
+					},
+				},
 
 				Clusters: []Cluster{
 					{
@@ -72,19 +182,35 @@ func TestLoadConfig(t *testing.T) {
 							Name:     "default",
 							Password: "***",
 						},
+						Proxy: Proxy{
+							URL: "http://proxy.local:3128",
+						},
 						ClusterUsers: []ClusterUser{
 							{
 								Name:                 "web",
 								Password:             "password",
 								MaxConcurrentQueries: 4,
 								MaxExecutionTime:     Duration(time.Minute),
+								ReqPerMin:            100,
 							},
 						},
 						HeartBeatInterval: Duration(time.Minute),
+						DNSCacheTTL:       Duration(30 * time.Second),
+						SourceAddr:        "10.0.0.5",
 					},
 					{
 						Name:   "second cluster",
 						Scheme: "https",
+						SPIFFE: true,
+						TLS: TLS{
+							MinVersion:   "1.2",
+							MinVersionID: tls.VersionTLS12,
+						},
+						Proxy: Proxy{
+							URL:      "socks5://bastion.local:1080",
+							User:     "tunnel",
+							Password: "***",
+						},
 						Replicas: []Replica{
 							{
 								Name:  "replica1",
@@ -100,6 +226,7 @@ func TestLoadConfig(t *testing.T) {
 								Name:                 "default",
 								MaxConcurrentQueries: 4,
 								MaxExecutionTime:     Duration(time.Minute),
+								ReqPerMin:            100,
 							},
 							{
 								Name:                 "web",
@@ -111,7 +238,7 @@ func TestLoadConfig(t *testing.T) {
 								MaxQueueTime:         Duration(70 * time.Second),
 							},
 						},
-						HeartBeatInterval: Duration(5 * time.Second),
+						HeartBeatInterval: Duration(10 * time.Second),
 					},
 				},
 
@@ -150,17 +277,19 @@ func TestLoadConfig(t *testing.T) {
 
 				Users: []User{
 					{
-						Name:         "web",
-						Password:     "****",
-						ToCluster:    "first cluster",
-						ToUser:       "web",
-						DenyHTTP:     true,
-						AllowCORS:    true,
-						ReqPerMin:    4,
-						MaxQueueSize: 100,
-						MaxQueueTime: Duration(35 * time.Second),
-						Cache:        "longterm",
-						Params:       "web",
+						Name:              "web",
+						Password:          "****",
+						PreviousPasswords: []string{"***"},
+						ToCluster:         "first cluster",
+						ToUser:            "web",
+						DenyHTTP:          true,
+						AllowCORS:         true,
+						ReqPerMin:         4,
+						MaxExecutionTime:  Duration(2 * time.Minute),
+						MaxQueueSize:      100,
+						MaxQueueTime:      Duration(35 * time.Second),
+						Cache:             "longterm",
+						Params:            "web",
 					},
 					{
 						Name:                 "default",
@@ -168,8 +297,19 @@ func TestLoadConfig(t *testing.T) {
 						ToUser:               "default",
 						MaxConcurrentQueries: 4,
 						MaxExecutionTime:     Duration(time.Minute),
+						MaxIdleTime:          Duration(30 * time.Second),
+						MaxQueueSize:         10,
+						MaxQueueTime:         Duration(20 * time.Second),
+						Profile:              "reporting",
 						DenyHTTPS:            true,
 						NetworksOrGroups:     []string{"office", "1.2.3.0/24"},
+						FaultInjection: FaultInjection{
+							DelayPercent:    10,
+							Delay:           Duration(2 * time.Second),
+							ErrorPercent:    5,
+							ErrorStatusCode: 502,
+							DropPercent:     1.5,
+						},
 					},
 				},
 				NetworkGroups: []NetworkGroups{
@@ -302,7 +442,7 @@ func TestBadConfig(t *testing.T) {
 		{
 			"empty https",
 			"testdata/bad.empty_https.yml",
-			"configuration `https` is missing. Must be specified `https.cache_dir` for autocert OR `https.key_file` and `https.cert_file` for already existing certs",
+			"configuration `https` is missing. Must be specified `https.cache_dir` for autocert OR `https.key_file` and `https.cert_file` for already existing certs OR `https.spiffe` for SPIFFE workload identity",
 		},
 		{
 			"empty https cert key",
@@ -327,6 +467,13 @@ func TestBadConfig(t *testing.T) {
 				"on `user` or `server.http` level - password could be stolen" +
 				"\nSet option `hack_me_please=true` to disable security errors",
 		},
+		{
+			"security admin no allowed networks",
+			"testdata/bad.security_admin_no_an.yml",
+			"security breach: admin endpoints are accessible via http, but not limited by `allowed_networks` " +
+				"on `server.admin` level - password could be stolen" +
+				"\nSet option `hack_me_please=true` to disable security errors",
+		},
 		{
 			"allow all",
 			"testdata/bad.allow_all.yml",
@@ -389,6 +536,341 @@ func TestBadConfig(t *testing.T) {
 			"testdata/bad.param_groups.params.yml",
 			"`param_group.params` must contain at least one param",
 		},
+		{
+			"server queue size without concurrency limit",
+			"testdata/bad.server_queue_size.yml",
+			"`server.max_concurrent_requests` must be set if `server.max_queue_size` is set",
+		},
+		{
+			"profiling without destination",
+			"testdata/bad.profiling.yml",
+			"either `profiling.dir` or `profiling.push_url` must be set",
+		},
+		{
+			"fault injection percent",
+			"testdata/bad.fault_injection.yml",
+			"`fault_injection.error_percent` must be in the range [0..100], got 120 instead",
+		},
+		{
+			"spiffe ids without https spiffe",
+			"testdata/bad.spiffe_ids.yml",
+			"`https.spiffe` must be set if `user.spiffe_ids` is set for \"default\"",
+		},
+		{
+			"spiffe with client ca file",
+			"testdata/bad.spiffe_client_ca.yml",
+			"`https.client_ca_file` cannot be set together with `https.spiffe`, since client SVIDs are verified against the SPIFFE trust bundle",
+		},
+		{
+			"tls min version greater than max version",
+			"testdata/bad.tls_versions.yml",
+			"`tls.min_version` cannot be greater than `tls.max_version`",
+		},
+		{
+			"unknown tls cipher suite",
+			"testdata/bad.tls_cipher_suites.yml",
+			"unknown `tls.cipher_suites` item \"TLS_RSA_WITH_NULL_SHA\"",
+		},
+		{
+			"previous passwords without password",
+			"testdata/bad.previous_passwords.yml",
+			"`password` must be set if `previous_passwords` is set for \"default\"",
+		},
+		{
+			"negative auth cache max entries",
+			"testdata/bad.auth_cache.yml",
+			"`auth_cache.max_entries` cannot be negative",
+		},
+		{
+			"shared limiter without redis addr",
+			"testdata/bad.shared_limiter.yml",
+			"`shared_limiter.redis_addr` must be specified",
+		},
+		{
+			"cache pubsub without redis addr",
+			"testdata/bad.cache_pubsub.yml",
+			"`cache_pubsub.redis_addr` must be specified",
+		},
+		{
+			"cache peers without self",
+			"testdata/bad.cache_peers.yml",
+			"`cache.peers.self` \"http://10.0.0.3:9090\" must be listed in `cache.peers.urls`",
+		},
+		{
+			"cache s3 with small part size",
+			"testdata/bad.cache_s3.yml",
+			"`cache.s3.part_size` cannot be less than 5Mb",
+		},
+		{
+			"cache min payload size exceeding max payload size",
+			"testdata/bad.cache_payload_size.yml",
+			"`cache.min_payload_size` cannot exceed `cache.max_payload_size` for \"reports\"",
+		},
+		{
+			"cache error ttl exceeding expire",
+			"testdata/bad.cache_error_ttl.yml",
+			"`cache.error_ttl` cannot exceed `cache.expire` for \"reports\"",
+		},
+		{
+			"cache key with invalid param pattern",
+			"testdata/bad.cache_key.yml",
+			"invalid param pattern \"param_*_id\" in `cache.key`; only a trailing `*` is supported",
+		},
+		{
+			"cache warmup user without cache",
+			"testdata/bad.cache_warmup_user.yml",
+			"`warmup.user` \"dummy\" must use cache \"reports\"",
+		},
+		{
+			"cache warmup invalid schedule",
+			"testdata/bad.cache_warmup_schedule.yml",
+			"cannot parse schedule \"0 25 * * *\": invalid hour: \"25\" must be in the range [0..23]",
+		},
+		{
+			"cache unknown eviction policy",
+			"testdata/bad.cache_eviction_policy.yml",
+			"unknown `cache.eviction_policy` \"fifo\" for \"reports\"; expecting \"lru\" or \"lfu\"",
+		},
+		{
+			"cache low watermark exceeding high watermark",
+			"testdata/bad.cache_watermark.yml",
+			"`cache.low_watermark` must be lower than `cache.high_watermark` for \"reports\"",
+		},
+		{
+			"unknown field in defaults",
+			"testdata/bad.defaults.yml",
+			"unknown fields in defaults.user: max_execution_tim",
+		},
+		{
+			"unknown profile",
+			"testdata/bad.profile.yml",
+			"unknown `profile` \"reporting\" for \"dummy\"",
+		},
+		{
+			"user group and profile",
+			"testdata/bad.user_group.yml",
+			"`user_group` \"analysts\" and `profile` \"reporting\" cannot be simultaneously set for \"dummy\"",
+		},
+		{
+			"invalid table pattern in profile",
+			"testdata/bad.profile_tables.yml",
+			"`denied_tables` pattern \"secrets\" must have the form `db.table` for profile \"analysts\"",
+		},
+		{
+			"invalid user name regexp",
+			"testdata/bad.user_name_regexp.yml",
+			"cannot parse `user.name` regexp \"team_a_(.*\": error parsing regexp: missing closing ): `team_a_(.*`",
+		},
+		{
+			"reserved allowed path",
+			"testdata/bad.allowed_paths.yml",
+			"`allowed_paths` cannot contain path \"/metrics\" reserved by chproxy for \"default\"",
+		},
+		{
+			"hook without command",
+			"testdata/bad.hook_command.yml",
+			"`hook.command` must be specified for \"policy\"",
+		},
+		{
+			"negative hook processes",
+			"testdata/bad.hook_processes.yml",
+			"`hook.processes` cannot be negative for \"policy\"",
+		},
+		{
+			"authenticator with password",
+			"testdata/bad.authenticator_password.yml",
+			"`password` and `authenticator` cannot be set simultaneously for \"default\"",
+		},
+		{
+			"retry budget ratio out of range",
+			"testdata/bad.retry_budget.yml",
+			"`retry.budget_ratio` must be in the range [0..1], got 1.5 instead",
+		},
+		{
+			"unknown compression policy",
+			"testdata/bad.compression.yml",
+			"`compression` must be one of `passthrough`, `upstream`, `proxy` or `disabled`, got \"brotli\" instead for \"default\"",
+		},
+		{
+			"to_cluster and to_clusters",
+			"testdata/bad.to_clusters.yml",
+			"`user.to_cluster` and `user.to_clusters` cannot be set simultaneously for \"default\"",
+		},
+		{
+			"only fallback to_clusters",
+			"testdata/bad.to_clusters_fallback.yml",
+			"`user.to_clusters` must contain at least a single cluster without `fallback` for \"default\"",
+		},
+		{
+			"unknown statement class in route",
+			"testdata/bad.user_route.yml",
+			"unknown statement class \"update\" in `user.route` for \"default\"; must be `select`, `insert`, `ddl` or `other`",
+		},
+		{
+			"mirror_percent without mirror_to_cluster",
+			"testdata/bad.user_mirror.yml",
+			"`user.mirror_percent` requires `user.mirror_to_cluster` for \"default\"",
+		},
+		{
+			"cert_names without client_ca_file",
+			"testdata/bad.cert_names.yml",
+			"`https.client_ca_file` must be set if `user.cert_names` is set for \"default\"",
+		},
+		{
+			"http2 without https scheme",
+			"testdata/bad.cluster_http2.yml",
+			"`cluster.scheme` must be `https` if `cluster.http2` is set for \"cluster\"",
+		},
+		{
+			"unknown load_balancing",
+			"testdata/bad.cluster_load_balancing.yml",
+			"`cluster.load_balancing` must be `least_loaded`, `round_robin`, `random` or `consistent_hash`, got \"fastest\" instead for \"cluster\"",
+		},
+		{
+			"unknown discovery",
+			"testdata/bad.cluster_discovery.yml",
+			"`cluster.discovery` must be `dns`, `consul`, `etcd` or `zookeeper`, got \"mdns\" instead for \"cluster\"",
+		},
+		{
+			"missing discovery server",
+			"testdata/bad.cluster_discovery_server.yml",
+			"`cluster.discovery_server.address` must be set for consul discovery for \"cluster\"",
+		},
+		{
+			"invalid zookeeper address",
+			"testdata/bad.cluster_discovery_zookeeper.yml",
+			"cannot parse `discovery_server.address` \"zk1:2181:2182\": address zk1:2181:2182: too many colons in address for \"cluster\"",
+		},
+		{
+			"unknown prefer_replica",
+			"testdata/bad.cluster_prefer_replica.yml",
+			"`cluster.prefer_replica` \"dc1\" must be one of `cluster.replicas` for \"cluster\"",
+		},
+		{
+			"client options in https tls",
+			"testdata/bad.https_tls_client.yml",
+			"`https.tls` may contain only protocol settings; `ca_file`, `cert_file`, `key_file`, `server_name` and `insecure_skip_verify` are allowed only for clusters",
+		},
+		{
+			"tls cert_file without key_file",
+			"testdata/bad.tls_key_file.yml",
+			"`tls.key_file` must be specified",
+		},
+		{
+			"cors credentials for all origins",
+			"testdata/bad.cors.yml",
+			"`cors.allow_credentials` cannot be set if `cors.allowed_origins` contains `*`",
+		},
+		{
+			"allow_cors with cors",
+			"testdata/bad.allow_cors_with_cors.yml",
+			"`allow_cors` and `cors` cannot be set simultaneously for \"default\"",
+		},
+		{
+			"hsts directives without max age",
+			"testdata/bad.security_headers.yml",
+			"`security_headers.hsts_max_age` must be set if `hsts_include_subdomains` or `hsts_preload` is set",
+		},
+		{
+			"missing env var",
+			"testdata/bad.env.yml",
+			"cannot expand `server.http.listen_addr`: environment variable \"CHPROXY_TEST_MISSING_LISTEN_ADDR\" is not set",
+		},
+		{
+			"duplicate http listeners",
+			"testdata/bad.listeners.yml",
+			"duplicate `http.listen_addr` \":9090\"",
+		},
+		{
+			"default_user of listener without allowed_networks",
+			"testdata/bad.listener_default_user.yml",
+			"security breach: http: listener on \":9091\" authorizes requests without credentials as `default_user` \"internal\", " +
+				"but isn't limited by `allowed_networks`\nSet option `hack_me_please=true` to disable security errors",
+		},
+		{
+			"missing password env var",
+			"testdata/bad.password_env.yml",
+			"user \"default\": cannot expand `password`: environment variable \"CHPROXY_TEST_MISSING_PASSWORD\" is not set",
+		},
+		{
+			"password with password_file",
+			"testdata/bad.password_file.yml",
+			"`password` and `password_file` cannot be set simultaneously for \"default\"",
+		},
+		{
+			"vault_secret without vault",
+			"testdata/bad.vault_secret.yml",
+			"`vault` section must be configured if `cluster.user.vault_secret` is set for \"web\"",
+		},
+		{
+			"allow_jwt without jwt",
+			"testdata/bad.allow_jwt.yml",
+			"`jwt` section must be configured if `user.allow_jwt` is set for \"default\"",
+		},
+		{
+			"unknown ldap group mapping user",
+			"testdata/bad.ldap_group_mapping.yml",
+			"unknown `auth.ldap.group_mappings.user` \"analysts\"",
+		},
+		{
+			"wildcarded user with password",
+			"testdata/bad.wildcarded_user.yml",
+			"wildcarded user \"team_*\" cannot have `password`, `password_file`, `authenticator` or `allow_jwt`, " +
+				"since its credentials are verified by ClickHouse",
+		},
+		{
+			"sessions without ttl",
+			"testdata/bad.sessions.yml",
+			"`sessions.ttl` must be positive",
+		},
+		{
+			"deny_http from profile with deny_https",
+			"testdata/bad.profile_deny.yml",
+			"`deny_http` and `deny_https` cannot be simultaneously set to `true` for \"default\"",
+		},
+		{
+			"database_prefix with allowed_databases",
+			"testdata/bad.allowed_databases.yml",
+			"`database_prefix` and `allowed_databases` cannot be set simultaneously for \"tenant1\"",
+		},
+		{
+			"allowed_tables pattern without database",
+			"testdata/bad.table_pattern.yml",
+			"`allowed_tables` pattern \"events\" must have the form `db.table` for \"analyst\"",
+		},
+		{
+			"unsupported denied statement",
+			"testdata/bad.denied_statements.yml",
+			"`denied_statements` contains unsupported statement \"SYSTM\" for \"adhoc\"",
+		},
+		{
+			"invalid query pattern",
+			"testdata/bad.query_pattern.yml",
+			"cannot parse query pattern \"(huge_table\" for \"adhoc\": error parsing regexp: missing closing ): `(huge_table`",
+		},
+		{
+			"invalid references",
+			"testdata/bad.references.yml",
+			"found 8 problems in config:\n" +
+				"\tunknown cluster \"clsuter\" in `to_cluster` for \"default\"\n" +
+				"\tunknown cluster \"ingest\" in `route.insert` for \"default\"\n" +
+				"\tunknown cluster \"standby\" in `allowed_clusters` for \"default\"\n" +
+				"\tunknown cluster \"canary\" in `mirror_to_cluster` for \"default\"\n" +
+				"\tunknown `cache` \"shorterm\" for \"default\"\n" +
+				"\tunknown cluster user \"reports\" in `to_user` for \"reporting\": cluster \"cluster\" has no such user\n" +
+				"\tunknown `params` \"cron\" for \"reporting\"\n" +
+				"\tduplicate `users.name` \"default\"",
+		},
+		{
+			"proxy password without user",
+			"testdata/bad.proxy_password.yml",
+			"`cluster.proxy.user` must be specified if `cluster.proxy.password` is set",
+		},
+		{
+			"proxy url scheme",
+			"testdata/bad.proxy_scheme.yml",
+			"`cluster.proxy.url` scheme must be `http`, `https` or `socks5`, got \"ftp\" instead",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -441,6 +923,198 @@ func TestExamples(t *testing.T) {
 	}
 }
 
+func TestPasswords(t *testing.T) {
+	os.Setenv("CHPROXY_TEST_PASSWORD", "env-secret")
+	defer os.Unsetenv("CHPROXY_TEST_PASSWORD")
+
+	cfg, err := LoadFile("testdata/passwords.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(name, got, expected string) {
+		t.Helper()
+		if got != expected {
+			t.Fatalf("unexpected %s: %q; expected: %q", name, got, expected)
+		}
+	}
+	f("user password", cfg.Users[0].Password, "env-secret")
+	f("user previous password", cfg.Users[0].PreviousPasswords[0], "old-env-secret")
+	f("user password from file", cfg.Users[1].Password, "file-secret")
+	f("cluster user password", cfg.Clusters[0].ClusterUsers[0].Password, "file-secret")
+	f("kill query user password", cfg.Clusters[0].KillQueryUser.Password, "kill-env-secret")
+
+	s := cfg.String()
+	if strings.Contains(s, "secret") {
+		t.Fatalf("secrets must not be shown in config:\n%s", s)
+	}
+	if !strings.Contains(s, "${CHPROXY_TEST_PASSWORD}") {
+		t.Fatalf("env var references must be shown in config:\n%s", s)
+	}
+
+	s = cfg.RedactedString()
+	if strings.Contains(s, "secret") || strings.Contains(s, "CHPROXY_TEST_PASSWORD") {
+		t.Fatalf("secrets must be redacted in config:\n%s", s)
+	}
+	if !strings.Contains(s, `password: '***'`) {
+		t.Fatalf("redacted passwords must be shown in config:\n%s", s)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	env := map[string]string{
+		"CHPROXY_TEST_PASSWORD":    "env-secret",
+		"CHPROXY_TEST_NETWORK":     "10.0.0.0/8",
+		"CHPROXY_TEST_MAX_QUERIES": "4",
+		"CHPROXY_TEST_DENY_HTTP":   "",
+		"CHPROXY_TEST_HOST":        "ch.local",
+		"CHPROXY_TEST_CACHE_SIZE":  "100Mb",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	cfg, err := LoadFile("testdata/env.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(name string, got, expected interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("unexpected %s: %v; expected: %v", name, got, expected)
+		}
+	}
+	f("listen_addr", cfg.Server.HTTP.ListenAddr, ":9090")
+	f("allowed_networks", cfg.Server.HTTP.NetworksOrGroups, NetworksOrGroups{"10.0.0.0/8"})
+	f("max_concurrent_queries", cfg.Users[0].MaxConcurrentQueries, uint32(4))
+	f("deny_http", cfg.Users[0].DenyHTTP, false)
+	f("nodes", cfg.Clusters[0].Nodes, []string{"ch.local:8123", "ch.local:8124"})
+	f("cache dir", cfg.Caches[0].Dir, "/tmp/chproxy/shortterm")
+	f("cache max_size", cfg.Caches[0].MaxSize, ByteSize(100<<20))
+	f("user password", cfg.Users[0].Password, "env-secret")
+	f("admin password", cfg.Server.Admin.Password, "env-secret")
+
+	s := cfg.String()
+	if strings.Contains(s, "secret") {
+		t.Fatalf("secrets must not be shown in config:\n%s", s)
+	}
+}
+
+func TestHTTPListeners(t *testing.T) {
+	cfg, err := LoadFile("testdata/listeners.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	listeners := cfg.Server.HTTP.AllListeners()
+	if len(listeners) != 2 {
+		t.Fatalf("unexpected number of listeners: %d; expected: 2", len(listeners))
+	}
+	f := func(name string, got, expected interface{}) {
+		t.Helper()
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("unexpected %s: %v; expected: %v", name, got, expected)
+		}
+	}
+	f("name", listeners[0].Name, "internal")
+	f("default_user", listeners[0].DefaultUser, "internal")
+	f("allowed_networks", listeners[0].AllowedNetworks.Contains("127.0.0.1:1234"), true)
+	f("name", listeners[1].Name, "public")
+	f("listen_addr", listeners[1].ListenAddr, ":9091")
+	f("require_auth", listeners[1].RequireAuth, true)
+	f("read_timeout", listeners[1].ReadTimeout, Duration(time.Minute))
+	f("write_timeout", listeners[1].WriteTimeout, Duration(5*time.Minute))
+
+	// The config must be loaded back from its string representation.
+	reloaded, err := Load([]byte(cfg.String()))
+	if err != nil {
+		t.Fatalf("cannot load config from its string representation: %s", err)
+	}
+	f("listeners", reloaded.Server.HTTP.AllListeners(), listeners)
+}
+
+func TestLoadConfigSource(t *testing.T) {
+	cs, err := LoadConfigSource("testdata/config_source.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cs.Consul.Key != "chproxy/config.yml" || cs.PollInterval != Duration(30*time.Second) || cs.Timeout != Duration(10*time.Second) {
+		t.Fatalf("unexpected config source: %+v", cs)
+	}
+	if cs, err = LoadConfigSource("testdata/full.yml"); err != nil || cs != nil {
+		t.Fatalf("unexpected config source %+v and error %v for the config without `config_source`", cs, err)
+	}
+
+	f := func(file, expectedErr string) {
+		t.Helper()
+		_, err := LoadConfigSource(file)
+		if err == nil {
+			t.Fatalf("expecting error for %q", file)
+		}
+		if err.Error() != expectedErr {
+			t.Fatalf("unexpected error for %q: %q; expecting %q", file, err, expectedErr)
+		}
+	}
+	f("testdata/bad.config_source.yml", "exactly one of `config_source.url`, `config_source.consul` or `config_source.etcd` must be specified")
+	f("testdata/bad.config_source_extra.yml", "`config_source` cannot be set together with other options")
+}
+
+func TestProfileACLs(t *testing.T) {
+	cfg, err := LoadFile("testdata/profiles.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	alice, bob := cfg.Users[0], cfg.Users[1]
+	if alice.MaxConcurrentQueries != 4 || !alice.DenyHTTP || alice.DenyHTTPS {
+		t.Fatalf("unexpected settings inherited from profile: %+v", alice)
+	}
+	if !alice.AllowedNetworks.Contains("10.1.2.3:1234") || alice.AllowedNetworks.Contains("127.0.0.1:1234") {
+		t.Fatalf("`allowed_networks` must be inherited from profile; got %s", alice.AllowedNetworks)
+	}
+	if len(alice.AllowedPaths) != 1 || alice.AllowedPaths[0] != "/ping" {
+		t.Fatalf("`allowed_paths` must be inherited from profile; got %q", alice.AllowedPaths)
+	}
+	if !bob.AllowedNetworks.Contains("127.0.0.1:1234") || bob.AllowedNetworks.Contains("10.1.2.3:1234") {
+		t.Fatalf("`allowed_networks` must be overridden on the user level; got %s", bob.AllowedNetworks)
+	}
+	if !bob.DenyHTTP {
+		t.Fatalf("`deny_http` must be inherited from profile")
+	}
+	if len(alice.DeniedStatements) != 2 || len(bob.DeniedStatements) != 1 {
+		t.Fatalf("`denied_statements` must be inherited from profile unless overridden; got %q and %q",
+			alice.DeniedStatements, bob.DeniedStatements)
+	}
+}
+
+func TestUserGroupACLs(t *testing.T) {
+	cfg, err := LoadFile("testdata/user_groups.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	alice, bob := cfg.Users[0], cfg.Users[1]
+	if alice.Profile != "analysts" || alice.MaxConcurrentQueries != 4 {
+		t.Fatalf("`user_group` must be an alias for `profile`; got %+v", alice)
+	}
+	if !alice.AllowedNetworks.Contains("10.1.2.3:1234") || alice.AllowedNetworks.Contains("127.0.0.1:1234") {
+		t.Fatalf("`allowed_networks` must be inherited from profile; got %s", alice.AllowedNetworks)
+	}
+	if !reflect.DeepEqual(alice.AllowedDatabases, []string{"analytics"}) ||
+		!reflect.DeepEqual(alice.AllowedTables, []string{"analytics.*"}) ||
+		!reflect.DeepEqual(alice.DeniedTables, []string{"analytics.salaries"}) ||
+		!reflect.DeepEqual(alice.DeniedStatements, []string{"DDL", "SYSTEM"}) ||
+		!reflect.DeepEqual(alice.AllowQueryPatterns, []string{"^SELECT"}) ||
+		!reflect.DeepEqual(alice.DenyQueryPatterns, []string{"system\\."}) {
+		t.Fatalf("ACLs must be inherited from profile; got %+v", alice)
+	}
+	if bob.DatabasePrefix != "bob_" || len(bob.AllowedDatabases) != 0 {
+		t.Fatalf("database ACL must be overridden on the user level; got prefix %q and databases %q",
+			bob.DatabasePrefix, bob.AllowedDatabases)
+	}
+	if !reflect.DeepEqual(bob.DeniedTables, []string{"bob_private.*"}) || !reflect.DeepEqual(bob.AllowedTables, []string{"analytics.*"}) {
+		t.Fatalf("table ACLs must be inherited from profile unless overridden; got %q and %q",
+			bob.AllowedTables, bob.DeniedTables)
+	}
+}
+
 func TestParseDuration(t *testing.T) {
 	var testCases = []struct {
 		value    string
@@ -536,9 +1210,10 @@ func TestParseDurationNegative(t *testing.T) {
 
 func TestConfigTimeouts(t *testing.T) {
 	var testCases = []struct {
-		name        string
-		file        string
-		expectedCfg TimeoutCfg
+		name             string
+		file             string
+		expectedCfg      TimeoutCfg
+		expectedWarnings []string
 	}{
 		{
 			"default",
@@ -548,6 +1223,7 @@ func TestConfigTimeouts(t *testing.T) {
 				WriteTimeout: Duration(time.Minute),
 				IdleTimeout:  Duration(10 * time.Minute),
 			},
+			nil,
 		},
 		{
 			"defined",
@@ -557,6 +1233,7 @@ func TestConfigTimeouts(t *testing.T) {
 				WriteTimeout: Duration(time.Hour),
 				IdleTimeout:  Duration(24 * time.Hour),
 			},
+			nil,
 		},
 		{
 			"calculated write 1",
@@ -567,6 +1244,7 @@ func TestConfigTimeouts(t *testing.T) {
 				WriteTimeout: Duration(11 * 60 * time.Second),
 				IdleTimeout:  Duration(10 * time.Minute),
 			},
+			nil,
 		},
 		{
 			"calculated write 2",
@@ -577,6 +1255,7 @@ func TestConfigTimeouts(t *testing.T) {
 				WriteTimeout: Duration(21 * 60 * time.Second),
 				IdleTimeout:  Duration(10 * time.Minute),
 			},
+			nil,
 		},
 		{
 			"calculated write 3",
@@ -587,6 +1266,21 @@ func TestConfigTimeouts(t *testing.T) {
 				WriteTimeout: Duration(51 * 60 * time.Second),
 				IdleTimeout:  Duration(10 * time.Minute),
 			},
+			nil,
+		},
+		{
+			"max response time",
+			"testdata/timeouts.max_response_time.yml",
+			TimeoutCfg{
+				ReadTimeout: Duration(time.Minute),
+				// 15 + 1 minute
+				WriteTimeout:    Duration(16 * 60 * time.Second),
+				IdleTimeout:     Duration(10 * time.Minute),
+				MaxResponseTime: Duration(15 * time.Minute),
+			},
+			[]string{
+				"`max_execution_time` and `max_queue_time` of user \"default2\" sum up to 20m0s, which exceeds `server.http.write_timeout` 16m0s",
+			},
 		},
 	}
 
@@ -606,6 +1300,48 @@ func TestConfigTimeouts(t *testing.T) {
 			if got.IdleTimeout != tc.expectedCfg.IdleTimeout {
 				t.Fatalf("got IdleTimeout %v; expected to have: %v", got.IdleTimeout, tc.expectedCfg.IdleTimeout)
 			}
+			if got.MaxResponseTime != tc.expectedCfg.MaxResponseTime {
+				t.Fatalf("got MaxResponseTime %v; expected to have: %v", got.MaxResponseTime, tc.expectedCfg.MaxResponseTime)
+			}
+			if !reflect.DeepEqual(cfg.Warnings(), tc.expectedWarnings) {
+				t.Fatalf("got warnings %q; expected to have: %q", cfg.Warnings(), tc.expectedWarnings)
+			}
 		})
 	}
 }
+
+func TestScheduleNext(t *testing.T) {
+	f := func(schedule, now, expected string) {
+		t.Helper()
+		n, err := time.Parse(time.RFC3339, now)
+		if err != nil {
+			t.Fatalf("cannot parse %q: %s", now, err)
+		}
+		var s Schedule
+		if err := yaml.Unmarshal([]byte(`"`+schedule+`"`), &s); err != nil {
+			t.Fatalf("cannot parse schedule %q: %s", schedule, err)
+		}
+		next := s.Next(n)
+		if got := next.Format(time.RFC3339); got != expected {
+			t.Fatalf("unexpected next time for %q after %s: %s; expecting %s", schedule, now, got, expected)
+		}
+	}
+	f("* * * * *", "2026-10-16T10:20:30Z", "2026-10-16T10:21:00Z")
+	f("*/15 * * * *", "2026-10-16T10:20:30Z", "2026-10-16T10:30:00Z")
+	f("0 6 * * *", "2026-10-16T06:00:00Z", "2026-10-17T06:00:00Z")
+	f("30 5 * * 1-5", "2026-10-16T10:00:00Z", "2026-10-19T05:30:00Z")
+	f("0 0 1,15 * *", "2026-10-16T10:00:00Z", "2026-11-01T00:00:00Z")
+	f("0 0 29 2 *", "2026-10-16T10:00:00Z", "2028-02-29T00:00:00Z")
+	f("0 12 * * 7", "2026-10-16T10:00:00Z", "2026-10-18T12:00:00Z")
+	// Restricted days and weekdays are matched by either of them.
+	f("0 0 20 * 6", "2026-10-16T10:00:00Z", "2026-10-17T00:00:00Z")
+
+	if next := Schedule("0 0 30 2 *").Next(time.Now()); !next.IsZero() {
+		t.Fatalf("unexpected next time for never matching schedule: %s", next)
+	}
+	for _, s := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseSchedule(s); err == nil {
+			t.Fatalf("expecting error for schedule %q", s)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// secretKeys contains config keys with secret values.
+//
+// Environment variables in these values are expanded by resolvePasswords,
+// so the original values may be shown in logs instead of secrets.
+var secretKeys = map[string]bool{
+	"password":           true,
+	"previous_passwords": true,
+	"token":              true,
+	"bind_password":      true,
+	"redis_password":     true,
+	"secret":             true,
+	"secret_access_key":  true,
+}
+
+// expandConfigEnv substitutes `${VAR}` and `${VAR:-default}` references
+// in config values with environment variable values, so the same config
+// may be used in multiple environments.
+//
+// Values of secretKeys are left intact.
+func expandConfigEnv(content []byte) ([]byte, error) {
+	if !envVarRe.Match(content) {
+		return content, nil
+	}
+	var root yaml.MapSlice
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return nil, err
+	}
+	v, err := expandEnvValue(root, "")
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// expandEnvValue expands environment variables in string values of v.
+//
+// path is used in error messages.
+func expandEnvValue(v interface{}, path string) (interface{}, error) {
+	var err error
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		for i := range t {
+			key := fmt.Sprint(t[i].Key)
+			if secretKeys[key] {
+				continue
+			}
+			if len(path) > 0 {
+				key = path + "." + key
+			}
+			if t[i].Value, err = expandEnvValue(t[i].Value, key); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	case []interface{}:
+		for i := range t {
+			if t[i], err = expandEnvValue(t[i], fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return nil, err
+			}
+		}
+		return t, nil
+	case string:
+		s, err := expandEnv(t)
+		if err != nil {
+			return nil, fmt.Errorf("cannot expand `%s`: %s", path, err)
+		}
+		if s == t || envVarRe.FindString(t) != t {
+			return s, nil
+		}
+		// The value consisting of a single reference may be of any type,
+		// for example `max_concurrent_queries: ${MAX_QUERIES}`.
+		var x interface{}
+		if err := yaml.Unmarshal([]byte(s), &x); err != nil {
+			return s, nil
+		}
+		switch x.(type) {
+		case int, int64, uint64, float64, bool:
+			return x, nil
+		}
+		return s, nil
+	default:
+		return v, nil
+	}
+}
+
+// redactSecrets substitutes non-empty values of secretKeys in v with `***`.
+func redactSecrets(v interface{}) {
+	switch t := v.(type) {
+	case yaml.MapSlice:
+		for i := range t {
+			if !secretKeys[fmt.Sprint(t[i].Key)] {
+				redactSecrets(t[i].Value)
+				continue
+			}
+			switch sv := t[i].Value.(type) {
+			case string:
+				if len(sv) > 0 {
+					t[i].Value = "***"
+				}
+			case []interface{}:
+				for j := range sv {
+					sv[j] = "***"
+				}
+			}
+		}
+	case []interface{}:
+		for _, x := range t {
+			redactSecrets(x)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a schedule in the crontab format: `minute hour day month weekday`.
+//
+// Each field may contain `*`, numbers, ranges such as `1-5`, steps such as
+// `*/15` or `0-30/10` and comma-separated lists of them.
+// Weekdays start from 0 for Sunday, while 7 is Sunday too.
+type Schedule string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Schedule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+	if _, err := parseSchedule(v); err != nil {
+		return fmt.Errorf("cannot parse schedule %q: %s", v, err)
+	}
+	*s = Schedule(v)
+	return nil
+}
+
+// Next returns the first time matching the schedule after t.
+//
+// Zero time is returned if the schedule is empty or invalid.
+func (s Schedule) Next(t time.Time) time.Time {
+	if len(s) == 0 {
+		return time.Time{}
+	}
+	ps, err := parseSchedule(string(s))
+	if err != nil {
+		return time.Time{}
+	}
+	return ps.next(t)
+}
+
+// parsedSchedule contains bitsets of matching values for schedule fields.
+type parsedSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// Restricted days and weekdays are matched by either of them
+	// as cron does.
+	anyDay     bool
+	anyWeekday bool
+}
+
+func parseSchedule(s string) (*parsedSchedule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expecting 5 fields: minute hour day month weekday; got %d fields", len(fields))
+	}
+	var ps parsedSchedule
+	var err error
+	if ps.minutes, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute: %s", err)
+	}
+	if ps.hours, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour: %s", err)
+	}
+	if ps.days, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day: %s", err)
+	}
+	if ps.months, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month: %s", err)
+	}
+	if ps.weekdays, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid weekday: %s", err)
+	}
+	if ps.weekdays&(1<<7) != 0 {
+		ps.weekdays |= 1
+	}
+	ps.anyDay = fields[2] == "*"
+	ps.anyWeekday = fields[4] == "*"
+	return &ps, nil
+}
+
+func parseScheduleField(s string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if n := strings.IndexByte(item, '/'); n >= 0 {
+			var err error
+			if step, err = strconv.Atoi(item[n+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", item)
+			}
+			item = item[:n]
+		}
+		from, to := min, max
+		if item != "*" {
+			n := strings.IndexByte(item, '-')
+			var err error
+			if n < 0 {
+				from, err = strconv.Atoi(item)
+				to = from
+			} else {
+				from, err = strconv.Atoi(item[:n])
+				if err == nil {
+					to, err = strconv.Atoi(item[n+1:])
+				}
+			}
+			if err != nil || from < min || to > max || from > to {
+				return 0, fmt.Errorf("%q must be in the range [%d..%d]", item, min, max)
+			}
+		}
+		for i := from; i <= to; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+func (ps *parsedSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Schedules such as `0 0 30 2 *` never match,
+	// so the search is limited.
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		if ps.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !ps.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if ps.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if ps.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (ps *parsedSchedule) matchDay(t time.Time) bool {
+	day := ps.days&(1<<uint(t.Day())) != 0
+	weekday := ps.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case ps.anyDay && ps.anyWeekday:
+		return true
+	case ps.anyDay:
+		return weekday
+	case ps.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
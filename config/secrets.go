@@ -0,0 +1,173 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var envVarRe = regexp.MustCompile(`\$\{([a-zA-Z_][a-zA-Z0-9_]*)(:-[^}]*)?\}`)
+
+// expandEnv substitutes `${VAR}` references in s with values
+// of the corresponding environment variables.
+//
+// `${VAR:-default}` references are substituted with default
+// if VAR is unset or empty.
+func expandEnv(s string) (string, error) {
+	var err error
+	res := envVarRe.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envVarRe.FindStringSubmatch(ref)
+		name := m[1]
+		v, ok := os.LookupEnv(name)
+		if len(m[2]) > 0 {
+			if len(v) == 0 {
+				return m[2][len(":-"):]
+			}
+			return v
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %q is not set", name)
+		}
+		return v
+	})
+	return res, err
+}
+
+// resolvePassword reads *password from the given file if it is set.
+// Otherwise environment variables are expanded in *password.
+//
+// The original value of *password is returned, so it may be shown
+// in logs instead of the secret.
+func resolvePassword(password *string, file string) (string, error) {
+	raw := *password
+	if len(file) > 0 {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return raw, fmt.Errorf("cannot read `password_file`: %s", err)
+		}
+		// Trailing newlines are usually added by editors and secret managers.
+		*password = strings.TrimRight(string(data), "\r\n")
+		return raw, nil
+	}
+	v, err := expandEnv(raw)
+	if err != nil {
+		return raw, fmt.Errorf("cannot expand `password`: %s", err)
+	}
+	*password = v
+	return raw, nil
+}
+
+// resolvePasswords loads passwords from files and environment variables
+// for users, cluster users and kill query users.
+//
+// Environment variables are expanded in the rest of secrets too.
+// See secretKeys.
+func (c *Config) resolvePasswords() error {
+	var err error
+	for i := range c.Users {
+		u := &c.Users[i]
+		if u.rawPassword, err = resolvePassword(&u.Password, u.PasswordFile); err != nil {
+			return fmt.Errorf("user %q: %s", u.Name, err)
+		}
+		u.rawPreviousPasswords = u.PreviousPasswords
+		u.PreviousPasswords = make([]string, len(u.rawPreviousPasswords))
+		for j, p := range u.rawPreviousPasswords {
+			if u.PreviousPasswords[j], err = expandEnv(p); err != nil {
+				return fmt.Errorf("user %q: cannot expand `previous_passwords`: %s", u.Name, err)
+			}
+		}
+	}
+	for i := range c.Clusters {
+		cl := &c.Clusters[i]
+		for j := range cl.ClusterUsers {
+			cu := &cl.ClusterUsers[j]
+			if cu.rawPassword, err = resolvePassword(&cu.Password, cu.PasswordFile); err != nil {
+				return fmt.Errorf("cluster %q user %q: %s", cl.Name, cu.Name, err)
+			}
+		}
+		ku := &cl.KillQueryUser
+		if ku.rawPassword, err = resolvePassword(&ku.Password, ku.PasswordFile); err != nil {
+			return fmt.Errorf("cluster %q `kill_query_user`: %s", cl.Name, err)
+		}
+		ds := &cl.DiscoveryServer
+		ds.rawToken = ds.Token
+		if ds.Token, err = expandEnv(ds.Token); err != nil {
+			return fmt.Errorf("cluster %q: cannot expand `discovery_server.token`: %s", cl.Name, err)
+		}
+	}
+	v := &c.Vault
+	v.rawToken = v.Token
+	if v.Token, err = expandEnv(v.Token); err != nil {
+		return fmt.Errorf("cannot expand `vault.token`: %s", err)
+	}
+	l := &c.Auth.LDAP
+	l.rawBindPassword = l.BindPassword
+	if l.BindPassword, err = expandEnv(l.BindPassword); err != nil {
+		return fmt.Errorf("cannot expand `auth.ldap.bind_password`: %s", err)
+	}
+	a := &c.Server.Admin
+	a.rawPassword = a.Password
+	if a.Password, err = expandEnv(a.Password); err != nil {
+		return fmt.Errorf("cannot expand `server.admin.password`: %s", err)
+	}
+	sl := &c.SharedLimiter
+	sl.rawRedisPassword = sl.RedisPassword
+	if sl.RedisPassword, err = expandEnv(sl.RedisPassword); err != nil {
+		return fmt.Errorf("cannot expand `shared_limiter.redis_password`: %s", err)
+	}
+	ps := &c.CachePubSub
+	ps.rawRedisPassword = ps.RedisPassword
+	if ps.RedisPassword, err = expandEnv(ps.RedisPassword); err != nil {
+		return fmt.Errorf("cannot expand `cache_pubsub.redis_password`: %s", err)
+	}
+	for i := range c.Caches {
+		cp := &c.Caches[i].Peers
+		cp.rawSecret = cp.Secret
+		if cp.Secret, err = expandEnv(cp.Secret); err != nil {
+			return fmt.Errorf("cache %q: cannot expand `peers.secret`: %s", c.Caches[i].Name, err)
+		}
+		s3 := &c.Caches[i].S3
+		s3.rawSecretAccessKey = s3.SecretAccessKey
+		if s3.SecretAccessKey, err = expandEnv(s3.SecretAccessKey); err != nil {
+			return fmt.Errorf("cache %q: cannot expand `s3.secret_access_key`: %s", c.Caches[i].Name, err)
+		}
+	}
+	return nil
+}
+
+// withRawPasswords returns a copy of c with passwords substituted
+// by their values from the config file, so secrets from files
+// and environment variables don't leak into logs.
+func (c *Config) withRawPasswords() *Config {
+	cc := *c
+	cc.Users = append([]User(nil), c.Users...)
+	for i := range cc.Users {
+		u := &cc.Users[i]
+		u.Password = u.rawPassword
+		u.PreviousPasswords = u.rawPreviousPasswords
+	}
+	cc.Clusters = append([]Cluster(nil), c.Clusters...)
+	for i := range cc.Clusters {
+		cl := &cc.Clusters[i]
+		cl.ClusterUsers = append([]ClusterUser(nil), cl.ClusterUsers...)
+		for j := range cl.ClusterUsers {
+			cu := &cl.ClusterUsers[j]
+			cu.Password = cu.rawPassword
+		}
+		cl.KillQueryUser.Password = cl.KillQueryUser.rawPassword
+		cl.DiscoveryServer.Token = cl.DiscoveryServer.rawToken
+	}
+	cc.Caches = append([]Cache(nil), c.Caches...)
+	for i := range cc.Caches {
+		cc.Caches[i].Peers.Secret = c.Caches[i].Peers.rawSecret
+		cc.Caches[i].S3.SecretAccessKey = c.Caches[i].S3.rawSecretAccessKey
+	}
+	cc.Server.Admin.Password = c.Server.Admin.rawPassword
+	cc.SharedLimiter.RedisPassword = c.SharedLimiter.rawRedisPassword
+	cc.CachePubSub.RedisPassword = c.CachePubSub.rawRedisPassword
+	cc.Vault.Token = c.Vault.rawToken
+	cc.Auth.LDAP.BindPassword = c.Auth.LDAP.rawBindPassword
+	return &cc
+}
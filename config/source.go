@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ConfigSource describes the location of the centrally managed config,
+// which is shared among chproxy instances.
+//
+// Exactly one of URL, Consul or Etcd must be set.
+type ConfigSource struct {
+	// URL for fetching the config via HTTP GET,
+	// for example `https://configs.local/chproxy.yml`
+	URL string `yaml:"url,omitempty"`
+
+	// Consul KV key containing the config
+	Consul ConsulSource `yaml:"consul,omitempty"`
+
+	// Etcd key containing the config
+	Etcd EtcdSource `yaml:"etcd,omitempty"`
+
+	// Interval for checking the source for config changes.
+	// The config is reloaded if it is changed
+	// if omitted or zero - the config is reloaded only on SIGHUP
+	PollInterval Duration `yaml:"poll_interval,omitempty"`
+
+	// Whether to watch Consul or Etcd key for changes instead of polling.
+	// Changes are applied immediately, while `poll_interval`
+	// limits the duration of a single watch request
+	Watch bool `yaml:"watch,omitempty"`
+
+	// Timeout for requests to the source
+	// if omitted or zero - timeout will be set to 10s
+	Timeout Duration `yaml:"timeout,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cs *ConfigSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ConfigSource
+	if err := unmarshal((*plain)(cs)); err != nil {
+		return err
+	}
+	n := 0
+	if len(cs.URL) > 0 {
+		pu, err := url.Parse(cs.URL)
+		if err != nil {
+			return fmt.Errorf("cannot parse `config_source.url` %q: %s", cs.URL, err)
+		}
+		if pu.Scheme != "http" && pu.Scheme != "https" {
+			return fmt.Errorf("`config_source.url` %q must have `http` or `https` scheme", cs.URL)
+		}
+		n++
+	}
+	if len(cs.Consul.Address) > 0 {
+		n++
+	}
+	if len(cs.Etcd.Endpoints) > 0 {
+		n++
+	}
+	if n != 1 {
+		return fmt.Errorf("exactly one of `config_source.url`, `config_source.consul` or `config_source.etcd` must be specified")
+	}
+	if cs.Watch && len(cs.URL) > 0 {
+		return fmt.Errorf("`config_source.watch` is supported only for `consul` and `etcd`")
+	}
+	if cs.Watch && cs.PollInterval == 0 {
+		cs.PollInterval = Duration(5 * time.Minute)
+	}
+	if cs.Timeout == 0 {
+		cs.Timeout = Duration(10 * time.Second)
+	}
+	return checkOverflow(cs.XXX, "config_source")
+}
+
+// ConsulSource describes Consul KV key containing the config
+type ConsulSource struct {
+	// Consul agent address, for example `http://consul.local:8500`
+	Address string `yaml:"address"`
+
+	// KV key containing the config, for example `chproxy/config.yml`
+	Key string `yaml:"key"`
+
+	// Optional ACL token.
+	// `${VAR}` references are substituted with environment variable values
+	Token string `yaml:"token,omitempty"`
+
+	// Optional datacenter to read the key from
+	Datacenter string `yaml:"datacenter,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (cs *ConsulSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ConsulSource
+	if err := unmarshal((*plain)(cs)); err != nil {
+		return err
+	}
+	if len(cs.Address) == 0 || len(cs.Key) == 0 {
+		return fmt.Errorf("`config_source.consul.address` and `config_source.consul.key` must be specified")
+	}
+	return checkOverflow(cs.XXX, "config_source.consul")
+}
+
+// EtcdSource describes etcd key containing the config
+type EtcdSource struct {
+	// Addresses of etcd members, for example `http://etcd1.local:2379`.
+	// Members are tried in order until the key is read
+	Endpoints []string `yaml:"endpoints"`
+
+	// Key containing the config, for example `/chproxy/config.yml`
+	Key string `yaml:"key"`
+
+	// Optional credentials for etcd authentication.
+	// `${VAR}` references in Password are substituted
+	// with environment variable values
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+
+	// Catches all undefined fields
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (es *EtcdSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain EtcdSource
+	if err := unmarshal((*plain)(es)); err != nil {
+		return err
+	}
+	if len(es.Endpoints) == 0 || len(es.Key) == 0 {
+		return fmt.Errorf("`config_source.etcd.endpoints` and `config_source.etcd.key` must be specified")
+	}
+	return checkOverflow(es.XXX, "config_source.etcd")
+}
+
+// LoadConfigSource returns `config_source` from the given .yml file.
+//
+// nil is returned if the file doesn't contain `config_source`,
+// i.e. it contains the config itself.
+func LoadConfigSource(filename string) (*ConfigSource, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var top map[string]interface{}
+	if err := yaml.Unmarshal(content, &top); err != nil {
+		return nil, err
+	}
+	if _, ok := top["config_source"]; !ok {
+		return nil, nil
+	}
+	if len(top) > 1 {
+		return nil, fmt.Errorf("`config_source` cannot be set together with other options")
+	}
+	if content, err = expandConfigEnv(content); err != nil {
+		return nil, err
+	}
+	var c struct {
+		ConfigSource ConfigSource `yaml:"config_source"`
+	}
+	if err := yaml.Unmarshal(content, &c); err != nil {
+		return nil, err
+	}
+	cs := &c.ConfigSource
+	if cs.Consul.Token, err = expandEnv(cs.Consul.Token); err != nil {
+		return nil, fmt.Errorf("cannot expand `config_source.consul.token`: %s", err)
+	}
+	if cs.Etcd.Password, err = expandEnv(cs.Etcd.Password); err != nil {
+		return nil, fmt.Errorf("cannot expand `config_source.etcd.password`: %s", err)
+	}
+	return cs, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// immutableOptions are config options, which are applied only on startup,
+// since listeners are created with them.
+var immutableOptions = []struct {
+	name  string
+	value func(cfg *config.Config) interface{}
+}{
+	{"server.http.listen_addr", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.ListenAddr }},
+	{"server.http.h2c", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.H2C }},
+	{"server.http.force_autocert_handler", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.ForceAutocertHandler }},
+	{"server.http.read_timeout", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.ReadTimeout }},
+	{"server.http.idle_timeout", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.IdleTimeout }},
+	{"server.http.max_response_time", func(cfg *config.Config) interface{} { return cfg.Server.HTTP.MaxResponseTime }},
+	{"server.http listeners", func(cfg *config.Config) interface{} {
+		var v []interface{}
+		for _, l := range cfg.Server.HTTP.ExtraListeners {
+			v = append(v, []interface{}{l.ListenAddr, l.H2C, l.ReadTimeout, l.IdleTimeout, l.MaxResponseTime})
+		}
+		return v
+	}},
+	{"server.https.listen_addr", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.ListenAddr }},
+	{"server.https.cert_file", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.CertFile }},
+	{"server.https.key_file", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.KeyFile }},
+	{"server.https.autocert", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.Autocert }},
+	{"server.https.spiffe", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.SPIFFE }},
+	{"server.https.http2", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.HTTP2 }},
+	{"server.https.client_ca_file", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.ClientCAFile }},
+	{"server.https.require_client_cert", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.RequireClientCert }},
+	{"server.https.tls", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.TLS }},
+	{"server.https.read_timeout", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.ReadTimeout }},
+	{"server.https.idle_timeout", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.IdleTimeout }},
+	{"server.https.max_response_time", func(cfg *config.Config) interface{} { return cfg.Server.HTTPS.MaxResponseTime }},
+	{"server.admin.listen_addr", func(cfg *config.Config) interface{} { return cfg.Server.Admin.ListenAddr }},
+	{"spiffe", func(cfg *config.Config) interface{} { return cfg.SPIFFE }},
+	{"profiling", func(cfg *config.Config) interface{} { return cfg.Profiling }},
+}
+
+// checkImmutableOptions returns an error if cfg changes options of prev,
+// which may be changed only by restart.
+func checkImmutableOptions(prev, cfg *config.Config) error {
+	var names []string
+	for _, opt := range immutableOptions {
+		if !reflect.DeepEqual(opt.value(prev), opt.value(cfg)) {
+			names = append(names, "`"+opt.name+"`")
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s cannot be changed without restart; send SIGUSR1 for zero-downtime upgrade with the new config",
+		strings.Join(names, ", "))
+}
+
+// writeTimeoutWarnings returns warnings about `write_timeout` changes
+// in cfg comparing to prev.
+//
+// `write_timeout` may be derived from limits of users, so its changes
+// aren't rejected. They are applied only after restart though.
+func writeTimeoutWarnings(prev, cfg *config.Config) []string {
+	var warnings []string
+	f := func(listener string, prev, cur config.Duration) {
+		if prev != cur {
+			warnings = append(warnings, fmt.Sprintf("`%s.write_timeout` is changed from %s to %s, "+
+				"but the change is applied only after restart", listener, prev, cur))
+		}
+	}
+	prevListeners := prev.Server.HTTP.AllListeners()
+	for i, l := range cfg.Server.HTTP.AllListeners() {
+		if i < len(prevListeners) {
+			f(httpListenerPath(i), prevListeners[i].WriteTimeout, l.WriteTimeout)
+		}
+	}
+	f("server.https", prev.Server.HTTPS.WriteTimeout, cfg.Server.HTTPS.WriteTimeout)
+	return warnings
+}
+
+// httpListenerPath returns the config path of the http listener
+// with the index i.
+func httpListenerPath(i int) string {
+	if i == 0 {
+		return "server.http"
+	}
+	return fmt.Sprintf("server.http[%d]", i)
+}
+
+// diffConfigs returns the summary of changes in cfg comparing to prev.
+//
+// Users, clusters and caches are compared by names, while
+// the rest of sections are compared as a whole.
+func diffConfigs(prev, cfg *config.Config) []string {
+	var changes []string
+	users := func(cfg *config.Config) map[string]interface{} {
+		m := make(map[string]interface{}, len(cfg.Users))
+		for _, u := range cfg.Users {
+			m[u.Name] = u
+		}
+		return m
+	}
+	changes = append(changes, diffNamed("user", users(prev), users(cfg))...)
+	clusters := func(cfg *config.Config) map[string]interface{} {
+		m := make(map[string]interface{}, len(cfg.Clusters))
+		for _, c := range cfg.Clusters {
+			m[c.Name] = c
+		}
+		return m
+	}
+	changes = append(changes, diffNamed("cluster", clusters(prev), clusters(cfg))...)
+	caches := func(cfg *config.Config) map[string]interface{} {
+		m := make(map[string]interface{}, len(cfg.Caches))
+		for _, c := range cfg.Caches {
+			m[c.Name] = c
+		}
+		return m
+	}
+	changes = append(changes, diffNamed("cache", caches(prev), caches(cfg))...)
+
+	pv, v := reflect.ValueOf(prev).Elem(), reflect.ValueOf(cfg).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if len(f.PkgPath) > 0 || len(name) == 0 || name == "-" {
+			continue
+		}
+		switch name {
+		case "users", "clusters", "caches":
+			continue
+		}
+		if !reflect.DeepEqual(pv.Field(i).Interface(), v.Field(i).Interface()) {
+			changes = append(changes, fmt.Sprintf("changed section `%s`", name))
+		}
+	}
+	return changes
+}
+
+// diffNamed returns added, removed and changed items of the given kind.
+func diffNamed(kind string, prev, cur map[string]interface{}) []string {
+	var changes []string
+	for name, v := range cur {
+		pv, ok := prev[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added %s %q", kind, name))
+		case !reflect.DeepEqual(pv, v):
+			changes = append(changes, fmt.Sprintf("changed %s %q", kind, name))
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			changes = append(changes, fmt.Sprintf("removed %s %q", kind, name))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
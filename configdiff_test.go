@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	newConfig := func() *config.Config {
+		return &config.Config{
+			Server: config.Server{
+				HTTP: config.HTTP{
+					ListenAddr: ":9090",
+				},
+			},
+			Clusters: []config.Cluster{
+				{
+					Name:         "cluster",
+					Nodes:        []string{"localhost:8123"},
+					ClusterUsers: []config.ClusterUser{{Name: "web"}},
+				},
+			},
+			Users: []config.User{
+				{Name: "default", ToCluster: "cluster", ToUser: "web"},
+				{Name: "reports", ToCluster: "cluster", ToUser: "web"},
+			},
+		}
+	}
+	prev := newConfig()
+	if changes := diffConfigs(prev, newConfig()); len(changes) > 0 {
+		t.Fatalf("unexpected changes for the same config: %q", changes)
+	}
+	if err := checkImmutableOptions(prev, newConfig()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg := newConfig()
+	cfg.Users[0].MaxConcurrentQueries = 4
+	cfg.Users = append(cfg.Users[:1], config.User{Name: "analysts", ToCluster: "cluster", ToUser: "web"})
+	cfg.Clusters[0].Nodes = append(cfg.Clusters[0].Nodes, "localhost:8124")
+	cfg.Caches = []config.Cache{{Name: "shortterm", Expire: config.Duration(time.Minute)}}
+	cfg.LogDebug = true
+	expected := []string{
+		`added user "analysts"`,
+		`changed user "default"`,
+		`removed user "reports"`,
+		`changed cluster "cluster"`,
+		`added cache "shortterm"`,
+		"changed section `log_debug`",
+	}
+	if changes := diffConfigs(prev, cfg); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("unexpected changes: %q; expecting %q", changes, expected)
+	}
+	if err := checkImmutableOptions(prev, cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	cfg.Server.HTTP.ListenAddr = ":9091"
+	cfg.Server.HTTPS.CertFile = "/etc/chproxy/cert.pem"
+	err := checkImmutableOptions(prev, cfg)
+	if err == nil {
+		t.Fatalf("expecting error for changed `listen_addr`")
+	}
+	if !strings.Contains(err.Error(), "`server.http.listen_addr`, `server.https.cert_file` cannot be changed without restart") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// configSourceRetryInterval is the interval between attempts to fetch
+// the config after failed requests to the source.
+const configSourceRetryInterval = 10 * time.Second
+
+// configSource fetches the config content.
+type configSource interface {
+	// fetch returns the current config content.
+	//
+	// If wait is positive, fetch waits for up to wait for changes
+	// since the previous fetch call before reading the content.
+	fetch(wait time.Duration) ([]byte, error)
+
+	String() string
+}
+
+// newConfigSource returns the source of the config
+// for the given `-config` flag value.
+//
+// filename may be either a path to the config file, a path to the file
+// with `config_source` or http(s) URL of the config. The returned
+// config.ConfigSource is nil unless the file contains `config_source`.
+func newConfigSource(filename string) (configSource, *config.ConfigSource, error) {
+	if strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://") {
+		return newURLSource(filename, 10*time.Second), nil, nil
+	}
+	cs, err := config.LoadConfigSource(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cs == nil {
+		return &fileSource{filename: filename}, nil, nil
+	}
+	// Watch requests are held by the source for up to poll interval.
+	timeout := time.Duration(cs.Timeout)
+	if cs.Watch {
+		timeout += time.Duration(cs.PollInterval) * 17 / 16
+	}
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	switch {
+	case len(cs.URL) > 0:
+		return newURLSource(cs.URL, timeout), cs, nil
+	case len(cs.Consul.Address) > 0:
+		return &consulSource{
+			addr:       strings.TrimRight(cs.Consul.Address, "/"),
+			key:        strings.TrimLeft(cs.Consul.Key, "/"),
+			token:      cs.Consul.Token,
+			datacenter: cs.Consul.Datacenter,
+			client:     client,
+		}, cs, nil
+	default:
+		endpoints := make([]string, len(cs.Etcd.Endpoints))
+		for i, ep := range cs.Etcd.Endpoints {
+			endpoints[i] = strings.TrimRight(ep, "/")
+		}
+		return &etcdSource{
+			endpoints: endpoints,
+			key:       cs.Etcd.Key,
+			username:  cs.Etcd.Username,
+			password:  cs.Etcd.Password,
+			client:    client,
+		}, cs, nil
+	}
+}
+
+// fetchConfig returns the config content for the given `-config` flag value.
+func fetchConfig(filename string) ([]byte, error) {
+	src, _, err := newConfigSource(filename)
+	if err != nil {
+		return nil, err
+	}
+	return src.fetch(0)
+}
+
+// fileSource reads the config from the local file.
+type fileSource struct {
+	filename string
+}
+
+func (fs *fileSource) fetch(time.Duration) ([]byte, error) {
+	return ioutil.ReadFile(fs.filename)
+}
+
+func (fs *fileSource) String() string {
+	return fs.filename
+}
+
+// urlSource fetches the config via HTTP GET.
+type urlSource struct {
+	url    string
+	client *http.Client
+}
+
+func newURLSource(u string, timeout time.Duration) *urlSource {
+	return &urlSource{
+		url: u,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+func (us *urlSource) fetch(time.Duration) ([]byte, error) {
+	resp, err := us.client.Get(us.url)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch config: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code for %q: %d; response: %q", us.url, resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+func (us *urlSource) String() string {
+	return us.url
+}
+
+// consulSource reads the config from Consul KV via HTTP API.
+//
+// Changes are awaited via blocking queries.
+type consulSource struct {
+	addr       string
+	key        string
+	token      string
+	datacenter string
+	client     *http.Client
+
+	mu sync.Mutex
+	// index is `X-Consul-Index` of the last response
+	index uint64
+}
+
+func (cs *consulSource) fetch(wait time.Duration) ([]byte, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	args := url.Values{}
+	args.Set("raw", "true")
+	if len(cs.datacenter) > 0 {
+		args.Set("dc", cs.datacenter)
+	}
+	if wait > 0 && cs.index > 0 {
+		args.Set("index", strconv.FormatUint(cs.index, 10))
+		args.Set("wait", fmt.Sprintf("%ds", int(wait/time.Second)))
+	}
+	req, err := http.NewRequest("GET", cs.addr+"/v1/kv/"+cs.key+"?"+args.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	if len(cs.token) > 0 {
+		req.Header.Set("X-Consul-Token", cs.token)
+	}
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send request to Consul: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response from Consul: %s", err)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("key %q is missing in Consul", cs.key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from Consul for key %q: %d; response: %q",
+			cs.key, resp.StatusCode, data)
+	}
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index < cs.index {
+		// The index must be reset if it goes backwards.
+		index = 0
+	}
+	cs.index = index
+	return data, nil
+}
+
+func (cs *consulSource) String() string {
+	return fmt.Sprintf("consul %s/%s", cs.addr, cs.key)
+}
+
+// etcdSource reads the config from etcd via v3 JSON API.
+//
+// Changes are awaited via watch requests.
+type etcdSource struct {
+	endpoints []string
+	key       string
+	username  string
+	password  string
+	client    *http.Client
+
+	mu sync.Mutex
+	// revision is the modification revision of the last read key
+	revision int64
+}
+
+type etcdKV struct {
+	Value       []byte `json:"value"`
+	ModRevision string `json:"mod_revision"`
+}
+
+func (es *etcdSource) fetch(wait time.Duration) ([]byte, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	var lastErr error
+	for _, ep := range es.endpoints {
+		data, err := es.fetchFrom(ep, wait)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = fmt.Errorf("etcd %q: %s", ep, err)
+	}
+	return nil, lastErr
+}
+
+func (es *etcdSource) fetchFrom(ep string, wait time.Duration) ([]byte, error) {
+	var token string
+	if len(es.username) > 0 {
+		var resp struct {
+			Token string `json:"token"`
+		}
+		err := es.do(ep, "/v3/auth/authenticate", "", map[string]interface{}{
+			"name":     es.username,
+			"password": es.password,
+		}, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("cannot authenticate: %s", err)
+		}
+		token = resp.Token
+	}
+	if wait > 0 && es.revision > 0 {
+		if err := es.watch(ep, token, wait); err != nil {
+			return nil, fmt.Errorf("cannot watch key %q: %s", es.key, err)
+		}
+	}
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	err := es.do(ep, "/v3/kv/range", token, map[string]interface{}{
+		"key": []byte(es.key),
+	}, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read key %q: %s", es.key, err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, fmt.Errorf("key %q is missing", es.key)
+	}
+	kv := resp.KVs[0]
+	if es.revision, err = strconv.ParseInt(kv.ModRevision, 10, 64); err != nil {
+		es.revision = 0
+	}
+	return kv.Value, nil
+}
+
+// watch waits for up to wait until the key is modified
+// after the last read revision.
+func (es *etcdSource) watch(ep, token string, wait time.Duration) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(es.key),
+			"start_revision": strconv.FormatInt(es.revision+1, 10),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot marshal request: %s", err)
+	}
+	req, err := http.NewRequest("POST", ep+"/v3/watch", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot create request: %s", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", token)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	resp, err := es.client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d; response: %q", resp.StatusCode, data)
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if len(msg.Result.Events) > 0 || msg.Result.Canceled {
+			return nil
+		}
+	}
+}
+
+func (es *etcdSource) do(ep, path, token string, args, dst interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return fmt.Errorf("cannot marshal request: %s", err)
+	}
+	req, err := http.NewRequest("POST", ep+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("cannot create request: %s", err)
+	}
+	if len(token) > 0 {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("cannot read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d; response: %q", resp.StatusCode, data)
+	}
+	if err := json.Unmarshal(data, dst); err != nil {
+		return fmt.Errorf("cannot parse response: %s", err)
+	}
+	return nil
+}
+
+func (es *etcdSource) String() string {
+	return fmt.Sprintf("etcd %s", es.key)
+}
+
+// watchConfigSource reloads the config when it is changed in src.
+//
+// The source is polled every cs.PollInterval or watched for changes
+// if cs.Watch is set.
+func watchConfigSource(src configSource, cs *config.ConfigSource) {
+	interval := time.Duration(cs.PollInterval)
+	for {
+		var wait time.Duration
+		if cs.Watch {
+			wait = interval
+		} else {
+			time.Sleep(interval)
+		}
+		content, err := src.fetch(wait)
+		if err != nil {
+			log.Errorf("error while fetching config from %s: %s", src, err)
+			time.Sleep(configSourceRetryInterval)
+			continue
+		}
+		if !isConfigChanged(content) {
+			continue
+		}
+		log.Infof("Config %s is changed. Going to reload it ...", src)
+		if err := reloadConfigContent(content); err != nil {
+			log.Errorf("error while reloading config: %s", err)
+			continue
+		}
+		log.Infof("Reloading config %s: successful", src)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestURLConfigSource(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/http.yml")
+	if err != nil {
+		t.Fatalf("cannot read config: %s", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/chproxy.yml" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write(content)
+	}))
+	defer srv.Close()
+
+	if err := validateConfigFile(srv.URL + "/chproxy.yml"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := validateConfigFile(srv.URL + "/missing.yml"); err == nil {
+		t.Fatalf("expecting error for missing config")
+	}
+}
+
+func TestConsulConfigSource(t *testing.T) {
+	var index uint64 = 10
+	value := "foo"
+	changed := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/kv/chproxy/config.yml" || req.URL.Query().Get("raw") != "true" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if req.Header.Get("X-Consul-Token") != "consul-secret" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+			// Blocking query waits for changes.
+			<-changed
+			index++
+			value = "bar"
+		}
+		rw.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		fmt.Fprint(rw, value)
+	}))
+	defer srv.Close()
+
+	src, cs := newTestConfigSource(t, fmt.Sprintf(`
+config_source:
+  consul:
+    address: %q
+    key: "/chproxy/config.yml"
+    token: "${CHPROXY_TEST_CONSUL_TOKEN}"
+  watch: true
+`, srv.URL))
+	if !cs.Watch || time.Duration(cs.PollInterval) != 5*time.Minute {
+		t.Fatalf("unexpected config source: %+v", cs)
+	}
+	checkFetch(t, src, 0, "foo")
+	close(changed)
+	checkFetch(t, src, time.Second, "bar")
+}
+
+func TestEtcdConfigSource(t *testing.T) {
+	var revision int64 = 5
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var args map[string]interface{}
+		if err := json.NewDecoder(req.Body).Decode(&args); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch req.URL.Path {
+		case "/v3/auth/authenticate":
+			if args["name"] != "chproxy" || args["password"] != "etcd-secret" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(rw, `{"token":"etcd-token"}`)
+		case "/v3/kv/range":
+			if req.Header.Get("Authorization") != "etcd-token" {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"kvs": []map[string]interface{}{{
+					"value":        []byte(fmt.Sprintf("rev%d", revision)),
+					"mod_revision": strconv.FormatInt(revision, 10),
+				}},
+			})
+		case "/v3/watch":
+			cr := args["create_request"].(map[string]interface{})
+			if cr["start_revision"] != "6" {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			revision++
+			fmt.Fprint(rw, `{"result":{"created":true}}`)
+			fmt.Fprint(rw, `{"result":{"events":[{"type":"PUT"}]}}`)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	src, _ := newTestConfigSource(t, fmt.Sprintf(`
+config_source:
+  etcd:
+    endpoints: ["http://127.0.0.1:1", %q]
+    key: "/chproxy/config.yml"
+    username: "chproxy"
+    password: "${CHPROXY_TEST_ETCD_PASSWORD}"
+  watch: true
+`, srv.URL))
+	checkFetch(t, src, 0, "rev5")
+	checkFetch(t, src, time.Second, "rev6")
+}
+
+func newTestConfigSource(t *testing.T, content string) (configSource, *config.ConfigSource) {
+	t.Helper()
+	os.Setenv("CHPROXY_TEST_CONSUL_TOKEN", "consul-secret")
+	os.Setenv("CHPROXY_TEST_ETCD_PASSWORD", "etcd-secret")
+	defer os.Unsetenv("CHPROXY_TEST_CONSUL_TOKEN")
+	defer os.Unsetenv("CHPROXY_TEST_ETCD_PASSWORD")
+
+	f, err := ioutil.TempFile("", "chproxy-config-source")
+	if err != nil {
+		t.Fatalf("cannot create file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatalf("cannot write file: %s", err)
+	}
+	f.Close()
+	src, cs, err := newConfigSource(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if cs == nil {
+		t.Fatalf("expecting config source in %q", content)
+	}
+	return src, cs
+}
+
+func checkFetch(t *testing.T, src configSource, wait time.Duration, expected string) {
+	t.Helper()
+	data, err := src.fetch(wait)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != expected {
+		t.Fatalf("unexpected config from %s: %q; expecting %q", src, data, expected)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// maxConsoleResponseSize is the maximum size of the response body
+// shown in admin console.
+const maxConsoleResponseSize = 64 << 10
+
+var consoleTemplate = template.Must(template.New("console").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>chproxy console</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+label { display: block; margin: 0.5em 0; }
+textarea { width: 100%; font-family: monospace; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>chproxy query console</h1>
+<form id="console">
+<label>User <select name="user">{{range .}}<option>{{.}}</option>{{end}}</select></label>
+<label>Database <input name="database"></label>
+<label><input type="checkbox" name="no_cache"> Bypass cache</label>
+<textarea name="query" rows="10">SELECT 1</textarea>
+<p><button type="submit">Run</button></p>
+</form>
+<pre id="result"></pre>
+<script>
+document.getElementById("console").onsubmit = function(e) {
+	e.preventDefault();
+	var result = document.getElementById("result");
+	result.textContent = "Running...";
+	fetch("/admin/console/run", {
+		method: "POST",
+		headers: {"Content-Type": "application/json"},
+		body: JSON.stringify({
+			user: this.user.value,
+			database: this.database.value,
+			no_cache: this.no_cache.checked,
+			query: this.query.value
+		}),
+		credentials: "same-origin"
+	}).then(function(resp) {
+		return resp.json();
+	}).then(function(data) {
+		result.textContent = JSON.stringify(data, null, 2);
+	}).catch(function(err) {
+		result.textContent = "Error: " + err;
+	});
+};
+</script>
+</body>
+</html>
+`))
+
+// serveConsole serves admin console page.
+func serveConsole(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := consoleTemplate.Execute(rw, proxy.userNames()); err != nil {
+		log.Errorf("cannot render admin console: %s", err)
+	}
+}
+
+type consoleTiming struct {
+	Queue    string `json:"queue"`
+	Upstream string `json:"upstream"`
+	Total    string `json:"total"`
+}
+
+type consoleResult struct {
+	Error      string        `json:"error,omitempty"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Response   string        `json:"response,omitempty"`
+	Truncated  bool          `json:"truncated,omitempty"`
+	Trace      *requestTrace `json:"trace,omitempty"`
+	Timing     consoleTiming `json:"timing"`
+}
+
+// consoleRequest is the body of `/admin/console/run` request.
+type consoleRequest struct {
+	User     string `json:"user"`
+	Database string `json:"database"`
+	NoCache  bool   `json:"no_cache"`
+	Query    string `json:"query"`
+}
+
+// maxConsoleRequestSize is the maximum size of `/admin/console/run` request body.
+const maxConsoleRequestSize = 1 << 20
+
+// serveConsoleRun runs the query from admin console as the selected user.
+//
+// Only JSON requests from the admin host are accepted. Browsers cannot send
+// such requests cross-site without CORS preflight, so other sites cannot
+// run queries with cached admin credentials.
+func serveConsoleRun(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	if err := checkSameOrigin(r); err != nil {
+		respondWith(rw, fmt.Errorf("%q: %s", r.RemoteAddr, err), http.StatusForbidden)
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct != "application/json" {
+		err := fmt.Errorf("%q: unsupported Content-Type %q; expecting %q", r.RemoteAddr, ct, "application/json")
+		respondWith(rw, err, http.StatusUnsupportedMediaType)
+		return
+	}
+	var cr consoleRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxConsoleRequestSize)).Decode(&cr); err != nil {
+		err = fmt.Errorf("%q: cannot parse request: %s", r.RemoteAddr, err)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	res := runConsoleQuery(rw, r, &cr)
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Errorf("cannot write admin console response: %s", err)
+	}
+}
+
+// checkSameOrigin returns an error if the request has been sent
+// by a page from a host other than the admin host.
+//
+// Requests without both Origin and Referer aren't sent by browsers,
+// so they are accepted.
+func checkSameOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = r.Header.Get("Referer")
+	}
+	if len(origin) == 0 {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("cross-origin request from %q is not allowed", origin)
+	}
+	return nil
+}
+
+func runConsoleQuery(rw http.ResponseWriter, r *http.Request, cr *consoleRequest) *consoleResult {
+	name := cr.User
+	password, ok := proxy.userPassword(name)
+	if !ok {
+		return &consoleResult{
+			Error: fmt.Sprintf("unknown user %q", name),
+		}
+	}
+
+	params := make(url.Values)
+	if len(cr.Database) > 0 {
+		params.Set("database", cr.Database)
+	}
+	if cr.NoCache {
+		params.Set("no_cache", "1")
+	}
+	req, err := http.NewRequest(http.MethodPost, "/?"+params.Encode(), strings.NewReader(cr.Query))
+	if err != nil {
+		return &consoleResult{
+			Error: fmt.Sprintf("cannot create request: %s", err),
+		}
+	}
+	// The query is executed with the operator's address,
+	// so network restrictions for the user are applied.
+	req.RemoteAddr = r.RemoteAddr
+	req.TLS = r.TLS
+	req.SetBasicAuth(name, password)
+
+	trace := &requestTrace{}
+	req = withTrace(req.WithContext(r.Context()), trace)
+	crw := &consoleResponseWriter{
+		parent: rw,
+		header: make(http.Header),
+	}
+	log.Debugf("%q: admin console runs query as user %q", r.RemoteAddr, name)
+	startTime := time.Now()
+	proxy.ServeHTTP(crw, req)
+
+	res := &consoleResult{
+		StatusCode: crw.statusCode,
+		Response:   crw.buf.String(),
+		Truncated:  crw.truncated,
+		Timing: consoleTiming{
+			Queue:    trace.QueueDuration.String(),
+			Upstream: trace.UpstreamDuration.String(),
+			Total:    time.Since(startTime).String(),
+		},
+	}
+	if len(trace.User) > 0 {
+		// The request has been routed to the cluster.
+		res.Trace = trace
+	}
+	return res
+}
+
+// consoleResponseWriter holds the response for admin console.
+type consoleResponseWriter struct {
+	parent http.ResponseWriter
+
+	header     http.Header
+	statusCode int
+	buf        bytes.Buffer
+	truncated  bool
+}
+
+func (crw *consoleResponseWriter) Header() http.Header { return crw.header }
+
+func (crw *consoleResponseWriter) WriteHeader(statusCode int) {
+	if crw.statusCode == 0 {
+		crw.statusCode = statusCode
+	}
+}
+
+func (crw *consoleResponseWriter) Write(b []byte) (int, error) {
+	if crw.statusCode == 0 {
+		crw.statusCode = http.StatusOK
+	}
+	if n := maxConsoleResponseSize - crw.buf.Len(); n < len(b) {
+		crw.truncated = true
+		if n > 0 {
+			crw.buf.Write(b[:n])
+		}
+		return len(b), nil
+	}
+	return crw.buf.Write(b)
+}
+
+// CloseNotify implements http.CloseNotifier
+func (crw *consoleResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := crw.parent.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// userNames returns sorted names of configured users.
+func (rp *reverseProxy) userNames() []string {
+	rp.lock.RLock()
+	names := make([]string, 0, len(rp.users))
+	for name := range rp.users {
+		names = append(names, name)
+	}
+	rp.lock.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// userPassword returns password for the user with the given name.
+func (rp *reverseProxy) userPassword(name string) (string, bool) {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+	u, ok := rp.users[name]
+	if !ok {
+		return "", false
+	}
+	return u.password, true
+}
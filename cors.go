@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// corsPolicy describes cross-origin requests allowed for the user.
+type corsPolicy struct {
+	origins  []string
+	allowAll bool
+
+	methods          string
+	headers          string
+	exposedHeaders   string
+	maxAge           string
+	allowCredentials bool
+}
+
+// newCORSPolicy returns CORS policy for the user with the given cfg.
+//
+// nil is returned if CORS requests aren't allowed for the user.
+func newCORSPolicy(cfg config.User) *corsPolicy {
+	if cfg.AllowCORS {
+		// Legacy `allow_cors` allows simple requests from all the origins.
+		return &corsPolicy{
+			allowAll: true,
+			methods:  "GET, POST",
+		}
+	}
+	c := cfg.CORS
+	if len(c.AllowedOrigins) == 0 {
+		return nil
+	}
+	cp := &corsPolicy{
+		methods:          "GET, POST",
+		headers:          strings.Join(c.AllowedHeaders, ", "),
+		exposedHeaders:   strings.Join(c.ExposedHeaders, ", "),
+		allowCredentials: c.AllowCredentials,
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			cp.allowAll = true
+			continue
+		}
+		cp.origins = append(cp.origins, o)
+	}
+	if len(c.AllowedMethods) > 0 {
+		cp.methods = strings.Join(c.AllowedMethods, ", ")
+	}
+	if c.MaxAge > 0 {
+		cp.maxAge = strconv.Itoa(int(time.Duration(c.MaxAge) / time.Second))
+	}
+	return cp
+}
+
+// allowOrigin returns true if requests from the given origin are allowed.
+func (cp *corsPolicy) allowOrigin(origin string) bool {
+	if cp.allowAll {
+		return true
+	}
+	for _, o := range cp.origins {
+		if ok, _ := path.Match(o, origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod returns true if the given method is allowed.
+func (cp *corsPolicy) allowMethod(method string) bool {
+	for _, m := range strings.Split(cp.methods, ", ") {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders sets CORS headers to h for the response to the request
+// from the given origin.
+//
+// false is returned if the origin isn't allowed.
+func (cp *corsPolicy) setHeaders(h http.Header, origin string) bool {
+	if !cp.allowOrigin(origin) {
+		return false
+	}
+	if len(origin) == 0 {
+		origin = "*"
+	} else {
+		h.Add("Vary", "Origin")
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if cp.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(cp.exposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", cp.exposedHeaders)
+	}
+	return true
+}
+
+// isPreflight returns true if r is CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		len(r.Header.Get("Origin")) > 0 &&
+		len(r.Header.Get("Access-Control-Request-Method")) > 0
+}
+
+// servePreflight responds to CORS preflight request according
+// to the policy of the user from the request.
+//
+// Preflight requests are sent by browsers without credentials,
+// so the user is determined by the name from `user` query arg.
+// The `default` user is used if the name is missing.
+func (rp *reverseProxy) servePreflight(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Allow", "GET,POST")
+
+	name, _ := getAuth(req)
+	rp.lock.RLock()
+	u := rp.users[name]
+	if u == nil {
+		u = rp.getRegexpUser(name)
+	}
+	rp.lock.RUnlock()
+
+	origin := req.Header.Get("Origin")
+	if u == nil || u.cors == nil {
+		log.Debugf("%q: CORS requests aren't allowed for user %q", req.RemoteAddr, name)
+		return
+	}
+	cp := u.cors
+	method := req.Header.Get("Access-Control-Request-Method")
+	if !cp.allowMethod(method) {
+		log.Debugf("%q: CORS method %q isn't allowed for user %q", req.RemoteAddr, method, name)
+		return
+	}
+	if !cp.setHeaders(rw.Header(), origin) {
+		log.Debugf("%q: CORS origin %q isn't allowed for user %q", req.RemoteAddr, origin, name)
+		return
+	}
+	h := rw.Header()
+	h.Set("Access-Control-Allow-Methods", cp.methods)
+	if len(cp.headers) > 0 {
+		h.Set("Access-Control-Allow-Headers", cp.headers)
+	}
+	if len(cp.maxAge) > 0 {
+		h.Set("Access-Control-Max-Age", cp.maxAge)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// newSecurityHeaders returns headers added to responses of https listener.
+func newSecurityHeaders(cfg config.SecurityHeaders) http.Header {
+	h := make(http.Header, len(cfg.Headers)+1)
+	for k, v := range cfg.Headers {
+		h.Set(k, v)
+	}
+	if cfg.HSTSMaxAge > 0 {
+		v := "max-age=" + strconv.Itoa(int(time.Duration(cfg.HSTSMaxAge)/time.Second))
+		if cfg.HSTSIncludeSubdomains {
+			v += "; includeSubDomains"
+		}
+		if cfg.HSTSPreload {
+			v += "; preload"
+		}
+		h.Set("Strict-Transport-Security", v)
+	}
+	return h
+}
+
+// setSecurityHeaders adds security headers to the response for r
+// received via https.
+func setSecurityHeaders(rw http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil {
+		return
+	}
+	v := securityHeaders.Load()
+	if v == nil {
+		return
+	}
+	h := rw.Header()
+	for k, vv := range v.(http.Header) {
+		h[k] = vv
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestServePreflight(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+		{
+			Name:      "tabix",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			AllowCORS: true,
+		},
+		{
+			Name:      "dashboards",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			CORS: config.CORS{
+				AllowedOrigins:   []string{"https://*.example.com"},
+				AllowedMethods:   []string{"POST"},
+				AllowedHeaders:   []string{"Authorization", "Content-Type"},
+				MaxAge:           config.Duration(time.Hour),
+				AllowCredentials: true,
+			},
+		},
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(user, origin, method string, expectedHeaders map[string]string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodOptions, "http://localhost/?user="+user, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if !isPreflight(req) {
+			t.Fatalf("expecting preflight request")
+		}
+		rw := httptest.NewRecorder()
+		p.servePreflight(rw, req)
+		for k, v := range expectedHeaders {
+			if got := rw.Header().Get(k); got != v {
+				t.Fatalf("unexpected header %q for user %q and origin %q: %q; expecting %q", k, user, origin, got, v)
+			}
+		}
+	}
+
+	denied := map[string]string{
+		"Allow":                       "GET,POST",
+		"Access-Control-Allow-Origin": "",
+	}
+	f("default", "https://app.example.com", "POST", denied)
+	f("unknown", "https://app.example.com", "POST", denied)
+	f("tabix", "https://tabix.io", "GET", map[string]string{
+		"Access-Control-Allow-Origin":      "https://tabix.io",
+		"Access-Control-Allow-Methods":     "GET, POST",
+		"Access-Control-Allow-Credentials": "",
+	})
+	f("dashboards", "https://app.example.com", "POST", map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "POST",
+		"Access-Control-Allow-Headers":     "Authorization, Content-Type",
+		"Access-Control-Max-Age":           "3600",
+		"Access-Control-Allow-Credentials": "true",
+		"Vary":                             "Origin",
+	})
+	f("dashboards", "https://example.org", "POST", denied)
+	f("dashboards", "https://app.example.com", "GET", denied)
+
+	// The actual request gets CORS headers too.
+	req := httptest.NewRequest("GET", "http://localhost/?query=SELECT%201&user=dashboards", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	resp := makeCustomRequest(p, req)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin: %q", got)
+	}
+	req = httptest.NewRequest("GET", "http://localhost/?query=SELECT%201&user=dashboards", nil)
+	req.Header.Set("Origin", "https://example.org")
+	resp = makeCustomRequest(p, req)
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin for denied origin: %q", got)
+	}
+}
+
+func TestNewSecurityHeaders(t *testing.T) {
+	h := newSecurityHeaders(config.SecurityHeaders{
+		HSTSMaxAge:            config.Duration(365 * 24 * time.Hour),
+		HSTSIncludeSubdomains: true,
+		Headers: map[string]string{
+			"x-content-type-options": "nosniff",
+		},
+	})
+	if got, expected := h.Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains"; got != expected {
+		t.Fatalf("unexpected Strict-Transport-Security: %q; expecting %q", got, expected)
+	}
+	if got := h.Get("X-Content-Type-Options"); got != "nosniff" {
+		t.Fatalf("unexpected X-Content-Type-Options: %q", got)
+	}
+	if h := newSecurityHeaders(config.SecurityHeaders{}); len(h) != 0 {
+		t.Fatalf("unexpected headers: %v", h)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// responseLimitWriter stops proxying responses crossing
+// `max_response_size` or `max_read_rows` limits of the user.
+//
+// Such limits cannot be bypassed by clients passing their own
+// ClickHouse settings.
+type responseLimitWriter struct {
+	http.ResponseWriter
+
+	maxSize     int64
+	maxReadRows uint64
+
+	bytesWritten int64
+	wroteHeader  bool
+
+	// err is set when the limit is crossed.
+	err error
+}
+
+// limitResponse returns rw wrapped into responseLimitWriter
+// if the user has response limits.
+//
+// nil is returned if the user has no response limits.
+func (s *scope) limitResponse(rw http.ResponseWriter) *responseLimitWriter {
+	if s.user.maxResponseSize == 0 && s.user.maxReadRows == 0 {
+		return nil
+	}
+	return &responseLimitWriter{
+		ResponseWriter: rw,
+		maxSize:        s.user.maxResponseSize,
+		maxReadRows:    s.user.maxReadRows,
+	}
+}
+
+func (rw *responseLimitWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader || rw.err != nil {
+		return
+	}
+	if rw.maxReadRows > 0 {
+		if n := getReadRows(rw.Header()); n > rw.maxReadRows {
+			rw.err = fmt.Errorf("`max_read_rows` limit is exceeded: %d rows read; limit: %d", n, rw.maxReadRows)
+			return
+		}
+	}
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rw *responseLimitWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	if rw.maxSize > 0 && rw.bytesWritten+int64(len(b)) > rw.maxSize {
+		rw.err = fmt.Errorf("`max_response_size` limit is exceeded: %d bytes", rw.maxSize)
+		return 0, rw.err
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytesWritten += int64(n)
+	return n, err
+}
+
+// CloseNotify implements http.CloseNotifier
+func (rw *responseLimitWriter) CloseNotify() <-chan bool {
+	// The rw.ResponseWriter must implement http.CloseNotifier
+	return rw.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// cutoffResponse finishes the response crossing the limit
+// and kills the corresponding query.
+func (s *scope) cutoffResponse(rw http.ResponseWriter, srw *statResponseWriter, req *http.Request, lrw *responseLimitWriter) {
+	responseCutoff.With(s.labels).Inc()
+	if err := s.killQuery(); err != nil {
+		log.Errorf("%s: cannot kill query: %s", s, err)
+	}
+	q := getQuerySnippet(req)
+	err := fmt.Errorf("%s: %s; query: %q", s, lrw.err, q)
+	if lrw.wroteHeader {
+		// The response status has been already sent, so append
+		// the error to the response body like ClickHouse does for errors
+		// occurred in the middle of the response.
+		log.ErrorWithCallDepth(err, 1)
+		fmt.Fprintf(rw, "\n%s\n", err)
+	} else {
+		respondWith(rw, err, http.StatusForbidden)
+	}
+	srw.statusCode = http.StatusForbidden
+}
+
+// getReadRows returns the number of rows read by the query according
+// to the last `X-ClickHouse-Progress` or `X-ClickHouse-Summary` header.
+func getReadRows(h http.Header) uint64 {
+	var n uint64
+	for _, k := range []string{"X-Clickhouse-Progress", "X-Clickhouse-Summary"} {
+		v := h[k]
+		if len(v) == 0 {
+			continue
+		}
+		var p struct {
+			ReadRows json.Number `json:"read_rows"`
+		}
+		if err := json.Unmarshal([]byte(v[len(v)-1]), &p); err != nil {
+			continue
+		}
+		rows, err := strconv.ParseUint(string(p.ReadRows), 10, 64)
+		if err == nil && rows > n {
+			n = rows
+		}
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestResponseCutoff(t *testing.T) {
+	var killed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if strings.Contains(string(body), killQueryPattern) {
+			atomic.AddInt32(&killed, 1)
+			return
+		}
+		if len(body) == 0 {
+			// health check
+			w.Write([]byte(okResponse))
+			return
+		}
+		w.Header().Add("X-ClickHouse-Progress", `{"read_rows":"10","read_bytes":"100"}`)
+		w.Header().Add("X-ClickHouse-Progress", `{"read_rows":"1000","read_bytes":"10000"}`)
+		w.Write(bytes.Repeat([]byte("x"), 1000))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(u config.User, expectedStatus int, expectedBody string) {
+		t.Helper()
+		u.Name = "default"
+		u.ToCluster = "cluster"
+		u.ToUser = "web"
+		p, err := newConfiguredProxy(&config.Config{
+			Clusters: []config.Cluster{
+				{
+					Name:   "cluster",
+					Scheme: "http",
+					Nodes:  []string{addr.Host},
+					ClusterUsers: []config.ClusterUser{
+						{
+							Name: "web",
+						},
+					},
+					HeartBeatInterval: config.Duration(time.Minute),
+				},
+			},
+			Users: []config.User{u},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		atomic.StoreInt32(&killed, 0)
+		req := httptest.NewRequest("POST", srv.URL, strings.NewReader("SELECT 1"))
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, expectedStatus)
+		}
+		body := bbToString(t, resp.Body)
+		if !strings.Contains(body, expectedBody) {
+			t.Fatalf("unexpected response body %q; expecting it to contain %q", body, expectedBody)
+		}
+		isKilled := atomic.LoadInt32(&killed) > 0
+		if isKilled != (expectedBody != "xxx") {
+			t.Fatalf("unexpected query kill state: %v", isKilled)
+		}
+	}
+
+	f(config.User{}, http.StatusOK, "xxx")
+	f(config.User{MaxReadRows: 1000, MaxResponseSize: 1000}, http.StatusOK, "xxx")
+	f(config.User{MaxReadRows: 999}, http.StatusForbidden, "`max_read_rows` limit is exceeded: 1000 rows read")
+	f(config.User{MaxResponseSize: 999}, http.StatusOK, "`max_response_size` limit is exceeded: 999 bytes")
+}
+
+func TestGetReadRows(t *testing.T) {
+	f := func(h http.Header, expected uint64) {
+		t.Helper()
+		if n := getReadRows(h); n != expected {
+			t.Fatalf("unexpected number of read rows: %d; expecting %d", n, expected)
+		}
+	}
+	f(http.Header{}, 0)
+	f(http.Header{"X-Clickhouse-Progress": {`{"read_rows":"5"}`, `{"read_rows":"7"}`}}, 7)
+	f(http.Header{"X-Clickhouse-Summary": {`{"read_rows":12}`}}, 12)
+	f(http.Header{"X-Clickhouse-Progress": {`invalid`}}, 0)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultDiscoveryInterval is used if `discovery_interval` is omitted.
+	defaultDiscoveryInterval = 30 * time.Second
+
+	// discoveryTimeout limits the duration of resolving a single node name.
+	discoveryTimeout = 10 * time.Second
+)
+
+// nodeResolver resolves node names from the config
+// into `host:port` addresses.
+type nodeResolver interface {
+	resolve(ctx context.Context, node string) ([]string, error)
+}
+
+// nodeDiscovery periodically resolves node names of the cluster
+// and updates replica hosts accordingly.
+type nodeDiscovery struct {
+	cluster  *cluster
+	scheme   string
+	interval time.Duration
+	resolver nodeResolver
+
+	// stopChs contains channels stopping heartbeats of hosts
+	// by host pointers. It is accessed only by run goroutine.
+	stopChs map[*host]chan struct{}
+}
+
+// newNodeDiscovery returns node discovery for the cluster c.
+//
+// nil is returned if discovery isn't configured.
+func newNodeDiscovery(c *cluster, cfg config.Cluster) *nodeDiscovery {
+	var resolver nodeResolver
+	switch cfg.Discovery {
+	case "dns":
+		resolver = newDNSResolver()
+	case "consul":
+		resolver = newConsulResolver(cfg.DiscoveryServer)
+	case "etcd":
+		resolver = newEtcdResolver(cfg.DiscoveryServer)
+	case "zookeeper":
+		resolver = newZookeeperResolver(cfg.DiscoveryServer, cfg.Scheme)
+	default:
+		return nil
+	}
+	interval := time.Duration(cfg.DiscoveryInterval)
+	if interval == 0 {
+		interval = defaultDiscoveryInterval
+	}
+	return &nodeDiscovery{
+		cluster:  c,
+		scheme:   cfg.Scheme,
+		interval: interval,
+		resolver: resolver,
+		stopChs:  make(map[*host]chan struct{}),
+	}
+}
+
+// run starts heartbeats for cluster hosts and updates them on each
+// discovery interval until stopCh is closed.
+//
+// Heartbeat goroutines are registered in wg.
+func (dd *nodeDiscovery) run(stopCh <-chan struct{}, wg *sync.WaitGroup) {
+	defer dd.stopHeartbeats()
+	for _, r := range dd.cluster.replicas {
+		for _, h := range r.getHosts() {
+			dd.startHeartbeat(h, wg)
+		}
+	}
+	for {
+		dd.discover(wg)
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(dd.interval):
+		}
+	}
+}
+
+// discover resolves node names of all the replicas and substitutes
+// replica hosts with the resolved hosts.
+//
+// Hosts are left intact for replicas with unresolved node names,
+// so resolving failures don't remove healthy hosts.
+func (dd *nodeDiscovery) discover(wg *sync.WaitGroup) {
+	for _, r := range dd.cluster.replicas {
+		var addrs []string
+		var err error
+		for _, node := range r.nodes {
+			var nodeAddrs []string
+			nodeAddrs, err = dd.resolve(node)
+			if err != nil {
+				err = fmt.Errorf("cannot resolve %q: %s", node, err)
+				break
+			}
+			addrs = append(addrs, nodeAddrs...)
+		}
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found for %q", r.nodes)
+		}
+		if err != nil {
+			log.Errorf("cluster %q: replica %q: discovery error: %s", dd.cluster.name, r.name, err)
+			discoveryErrors.With(prometheus.Labels{"cluster": dd.cluster.name}).Inc()
+			continue
+		}
+		dd.updateHosts(r, addrs, wg)
+	}
+}
+
+// updateHosts substitutes hosts of the replica r with hosts
+// for the given addrs.
+//
+// Existing hosts are kept, so their load, penalties and health
+// aren't reset.
+func (dd *nodeDiscovery) updateHosts(r *replica, addrs []string, wg *sync.WaitGroup) {
+	sort.Strings(addrs)
+	oldHosts := r.getHosts()
+	existing := make(map[string]*host, len(oldHosts))
+	for _, h := range oldHosts {
+		existing[h.addr.Host] = h
+	}
+
+	changed := false
+	hosts := make([]*host, 0, len(addrs))
+	for _, addr := range addrs {
+		if h, ok := existing[addr]; ok {
+			if h != nil {
+				hosts = append(hosts, h)
+				existing[addr] = nil
+			}
+			continue
+		}
+		u, err := url.Parse(fmt.Sprintf("%s://%s", dd.scheme, addr))
+		if err != nil {
+			log.Errorf("cluster %q: replica %q: cannot parse discovered node %q: %s", dd.cluster.name, r.name, addr, err)
+			continue
+		}
+		h := &host{
+			replica: r,
+			addr:    u,
+		}
+		hosts = append(hosts, h)
+		existing[addr] = nil
+		dd.startHeartbeat(h, wg)
+		changed = true
+	}
+	if len(hosts) == 0 {
+		return
+	}
+	for _, h := range existing {
+		if h != nil {
+			dd.stopHeartbeat(h)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	r.setHosts(hosts)
+	names := make([]string, len(hosts))
+	for i, h := range hosts {
+		names[i] = h.addr.Host
+	}
+	log.Infof("cluster %q: replica %q: discovered nodes %q", dd.cluster.name, r.name, names)
+}
+
+// resolve returns `host:port` addresses for the node name.
+func (dd *nodeDiscovery) resolve(node string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+	return dd.resolver.resolve(ctx, node)
+}
+
+type lookupSRVFunc func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+
+// dnsResolver resolves node names via DNS.
+//
+// Node names starting with `_` such as `_http._tcp.clickhouse.svc`
+// are resolved via SRV records, while other names in the `host:port`
+// form are resolved via A and AAAA records.
+type dnsResolver struct {
+	lookupHost lookupFunc
+	lookupSRV  lookupSRVFunc
+}
+
+func newDNSResolver() *dnsResolver {
+	return &dnsResolver{
+		lookupHost: net.DefaultResolver.LookupHost,
+		lookupSRV:  net.DefaultResolver.LookupSRV,
+	}
+}
+
+func (dr *dnsResolver) resolve(ctx context.Context, node string) ([]string, error) {
+	if strings.HasPrefix(node, "_") {
+		_, srvs, err := dr.lookupSRV(ctx, "", "", node)
+		if err != nil {
+			return nil, err
+		}
+		addrs := make([]string, len(srvs))
+		for i, srv := range srvs {
+			target := strings.TrimSuffix(srv.Target, ".")
+			addrs[i] = net.JoinHostPort(target, strconv.Itoa(int(srv.Port)))
+		}
+		return addrs, nil
+	}
+
+	name, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := dr.lookupHost(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+func (dd *nodeDiscovery) startHeartbeat(h *host, wg *sync.WaitGroup) {
+	stopCh := make(chan struct{})
+	dd.stopChs[h] = stopCh
+	wg.Add(1)
+	go func() {
+		h.runHeartbeat(stopCh)
+		wg.Done()
+	}()
+}
+
+// stopHeartbeat stops the heartbeat of the removed host h
+// and drops its health metric.
+func (dd *nodeDiscovery) stopHeartbeat(h *host) {
+	if stopCh, ok := dd.stopChs[h]; ok {
+		close(stopCh)
+		delete(dd.stopChs, h)
+	}
+	hostHealth.Delete(prometheus.Labels{
+		"cluster":      dd.cluster.name,
+		"replica":      h.replica.name,
+		"cluster_node": h.addr.Host,
+	})
+}
+
+func (dd *nodeDiscovery) stopHeartbeats() {
+	for h, stopCh := range dd.stopChs {
+		close(stopCh)
+		delete(dd.stopChs, h)
+	}
+}
+
+// registryClient is used for requests to Consul and etcd.
+var registryClient = &http.Client{
+	Timeout: discoveryTimeout,
+}
+
+// consulResolver resolves node names as Consul service names.
+//
+// Only instances passing all the health checks are returned.
+type consulResolver struct {
+	address    string
+	token      string
+	datacenter string
+}
+
+func newConsulResolver(cfg config.DiscoveryServer) *consulResolver {
+	return &consulResolver{
+		address:    strings.TrimSuffix(cfg.Address, "/"),
+		token:      cfg.Token,
+		datacenter: cfg.Datacenter,
+	}
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+func (cr *consulResolver) resolve(ctx context.Context, node string) ([]string, error) {
+	params := make(url.Values)
+	params.Set("passing", "1")
+	if len(cr.datacenter) > 0 {
+		params.Set("dc", cr.datacenter)
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", cr.address, url.PathEscape(node), params.Encode())
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(cr.token) > 0 {
+		req.Header.Set("X-Consul-Token", cr.token)
+	}
+	var entries []consulServiceEntry
+	if err := doRegistryRequest(ctx, req, &entries); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(entries))
+	for _, e := range entries {
+		addr := e.Service.Address
+		if len(addr) == 0 {
+			addr = e.Node.Address
+		}
+		addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(e.Service.Port)))
+	}
+	return addrs, nil
+}
+
+// etcdResolver resolves node names as etcd key prefixes.
+//
+// Values of all the keys with the prefix must contain
+// node addresses in the `host:port` form.
+type etcdResolver struct {
+	address string
+	token   string
+}
+
+func newEtcdResolver(cfg config.DiscoveryServer) *etcdResolver {
+	return &etcdResolver{
+		address: strings.TrimSuffix(cfg.Address, "/"),
+		token:   cfg.Token,
+	}
+}
+
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+func (er *etcdResolver) resolve(ctx context.Context, node string) ([]string, error) {
+	// etcd gRPC gateway expects base64-encoded keys,
+	// which is the default JSON encoding for []byte.
+	body, err := json.Marshal(map[string][]byte{
+		"key":       []byte(node),
+		"range_end": etcdPrefixEnd(node),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", er.address+"/v3/kv/range", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(er.token) > 0 {
+		req.Header.Set("Authorization", er.token)
+	}
+	var resp etcdRangeResponse
+	if err := doRegistryRequest(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		addr := strings.TrimSpace(string(kv.Value))
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q in key %q: %s", addr, kv.Key, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// etcdPrefixEnd returns the range end for fetching
+// all the keys with the given prefix.
+func etcdPrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// The prefix consists of 0xff bytes, so fetch all the keys after it.
+	return []byte{0}
+}
+
+// doRegistryRequest executes req and decodes JSON response into v.
+func doRegistryRequest(ctx context.Context, req *http.Request, v interface{}) error {
+	resp, err := registryClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d from %s: %s", resp.StatusCode, req.URL.Host, bytes.TrimSpace(b))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("cannot decode response from %s: %s", req.URL.Host, err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestDNSDiscovery(t *testing.T) {
+	c, err := newCluster(config.Cluster{
+		Name:      "cluster",
+		Scheme:    "http",
+		Nodes:     []string{"clickhouse.local:1"},
+		Discovery: "dns",
+		ClusterUsers: []config.ClusterUser{
+			{
+				Name: "web",
+			},
+		},
+		HeartBeatInterval: config.Duration(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dd := c.discovery
+	if dd == nil {
+		t.Fatalf("expecting non-nil discovery")
+	}
+	var ips []string
+	var lookupErr error
+	dd.resolver.(*dnsResolver).lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if host != "clickhouse.local" {
+			return nil, fmt.Errorf("unexpected host %q", host)
+		}
+		return ips, lookupErr
+	}
+
+	var wg sync.WaitGroup
+	defer func() {
+		dd.stopHeartbeats()
+		wg.Wait()
+	}()
+	r := c.replicas[0]
+	hostAddrs := func() []string {
+		var addrs []string
+		for _, h := range r.getHosts() {
+			addrs = append(addrs, h.addr.Host)
+		}
+		return addrs
+	}
+	f := func(expected ...string) {
+		t.Helper()
+		dd.discover(&wg)
+		if addrs := hostAddrs(); !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("unexpected hosts %q; expecting %q", addrs, expected)
+		}
+		if len(dd.stopChs) != len(expected) {
+			t.Fatalf("unexpected number of heartbeats: %d; expecting %d", len(dd.stopChs), len(expected))
+		}
+	}
+
+	ips = []string{"127.0.0.3", "127.0.0.2"}
+	f("127.0.0.2:1", "127.0.0.3:1")
+
+	// Hosts present in both lists must be kept.
+	h := r.getHosts()[1]
+	ips = []string{"127.0.0.3", "127.0.0.4"}
+	f("127.0.0.3:1", "127.0.0.4:1")
+	if r.getHosts()[0] != h {
+		t.Fatalf("existing host must be kept")
+	}
+
+	// Hosts mustn't be removed on DNS errors and empty responses.
+	lookupErr = fmt.Errorf("temporary failure")
+	f("127.0.0.3:1", "127.0.0.4:1")
+	lookupErr = nil
+	ips = nil
+	f("127.0.0.3:1", "127.0.0.4:1")
+}
+
+func TestDNSDiscoveryResolveSRV(t *testing.T) {
+	dr := &dnsResolver{
+		lookupSRV: func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+			if name != "_http._tcp.clickhouse.svc" {
+				return "", nil, fmt.Errorf("unexpected name %q", name)
+			}
+			return "", []*net.SRV{
+				{Target: "ch-0.clickhouse.svc.", Port: 8123},
+				{Target: "ch-1.clickhouse.svc.", Port: 8123},
+			}, nil
+		},
+	}
+	addrs, err := dr.resolve(context.Background(), "_http._tcp.clickhouse.svc")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"ch-0.clickhouse.svc:8123", "ch-1.clickhouse.svc:8123"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("unexpected addresses %q; expecting %q", addrs, expected)
+	}
+}
+
+func TestConsulResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/clickhouse" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("passing") != "1" || r.URL.Query().Get("dc") != "dc1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `[
+			{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": "", "Port": 8123}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "10.0.1.2", "Port": 8124}}
+		]`)
+	}))
+	defer srv.Close()
+
+	cr := newConsulResolver(config.DiscoveryServer{
+		Address:    srv.URL,
+		Token:      "secret",
+		Datacenter: "dc1",
+	})
+	addrs, err := cr.resolve(context.Background(), "clickhouse")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"10.0.0.1:8123", "10.0.1.2:8124"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("unexpected addresses %q; expecting %q", addrs, expected)
+	}
+
+	if _, err := cr.resolve(context.Background(), "unknown"); err == nil {
+		t.Fatalf("expecting non-nil error for unknown service")
+	}
+}
+
+func TestEtcdResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v3/kv/range" || r.Header.Get("Authorization") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if string(req.Key) != "/clickhouse/nodes/" || string(req.RangeEnd) != "/clickhouse/nodes0" {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		resp := etcdRangeResponse{}
+		for _, addr := range []string{"10.0.0.1:8123", "10.0.0.2:8123"} {
+			resp.Kvs = append(resp.Kvs, struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			}{
+				Key:   []byte("/clickhouse/nodes/" + addr),
+				Value: []byte(addr),
+			})
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			panic(err)
+		}
+	}))
+	defer srv.Close()
+
+	er := newEtcdResolver(config.DiscoveryServer{
+		Address: srv.URL,
+		Token:   "secret",
+	})
+	addrs, err := er.resolve(context.Background(), "/clickhouse/nodes/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"10.0.0.1:8123", "10.0.0.2:8123"}
+	if !reflect.DeepEqual(addrs, expected) {
+		t.Fatalf("unexpected addresses %q; expecting %q", addrs, expected)
+	}
+
+	addrs, err = er.resolve(context.Background(), "/unknown/")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(addrs) != 0 {
+		t.Fatalf("unexpected addresses %q; expecting none", addrs)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+type lookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// dnsCache caches resolved addresses for node host names.
+//
+// Addresses are resolved by the standard resolver, so `/etc/hosts`
+// and resolver options are respected the same way as without the cache.
+// Cached addresses are kept for the configured ttl.
+// Cached addresses are dropped and the host name is resolved again
+// as soon as connections to all of them fail, so DNS-based failovers
+// are picked up without waiting for the ttl expiration.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup lookupFunc
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// resolve returns addresses for the given host.
+//
+// Cached addresses are returned if they aren't expired yet.
+func (dc *dnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	dc.mu.Lock()
+	e, ok := dc.entries[host]
+	dc.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := dc.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dc.mu.Lock()
+	dc.entries[host] = &dnsEntry{
+		addrs:   addrs,
+		expires: time.Now().Add(dc.ttl),
+	}
+	dc.mu.Unlock()
+	return addrs, nil
+}
+
+// invalidate drops cached addresses for the given host.
+func (dc *dnsCache) invalidate(host string) {
+	dc.mu.Lock()
+	delete(dc.entries, host)
+	dc.mu.Unlock()
+}
+
+// dialContext wraps the given dial, so it connects to cached addresses
+// instead of resolving host names on each connection.
+func (dc *dnsCache) dialContext(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+
+		addrs, err := dc.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialAny(ctx, dial, network, addrs, port)
+		if err == nil {
+			return conn, nil
+		}
+
+		// Cached addresses may be outdated, so resolve the host again.
+		dc.invalidate(host)
+		freshAddrs, lookupErr := dc.resolve(ctx, host)
+		if lookupErr != nil || equalStrings(addrs, freshAddrs) {
+			return nil, err
+		}
+		log.Debugf("addresses for host %q changed from %v to %v", host, addrs, freshAddrs)
+		return dialAny(ctx, dial, network, freshAddrs, port)
+	}
+}
+
+func dialAny(ctx context.Context, dial dialFunc, network string, addrs []string, port string) (net.Conn, error) {
+	lastErr := fmt.Errorf("no addresses to dial")
+	for _, a := range addrs {
+		conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
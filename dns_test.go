@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDNSCacheResolve(t *testing.T) {
+	var lookups int
+	dc := newDNSCache(time.Minute)
+	dc.lookup = func(ctx context.Context, host string) ([]string, error) {
+		lookups++
+		return []string{"127.0.0.1"}, nil
+	}
+	for i := 0; i < 3; i++ {
+		addrs, err := dc.resolve(context.Background(), "node.local")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatalf("unexpected addrs: %v", addrs)
+		}
+	}
+	if lookups != 1 {
+		t.Fatalf("unexpected number of lookups: %d; expected: %d", lookups, 1)
+	}
+
+	dc.ttl = 0
+	dc.invalidate("node.local")
+	for i := 0; i < 2; i++ {
+		if _, err := dc.resolve(context.Background(), "node.local"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if lookups != 3 {
+		t.Fatalf("unexpected number of lookups: %d; expected: %d", lookups, 3)
+	}
+}
+
+func TestDNSCacheReresolveOnFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// The first lookup returns an address nobody listens on,
+	// which emulates DNS-based failover to another node.
+	addrs := [][]string{{"127.0.0.2"}, {"127.0.0.1"}}
+	var lookups int
+	dc := newDNSCache(time.Hour)
+	dc.lookup = func(ctx context.Context, host string) ([]string, error) {
+		a := addrs[lookups]
+		lookups++
+		return a, nil
+	}
+	var dialed []string
+	dial := dc.dialContext(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		host, _, _ := net.SplitHostPort(addr)
+		if host != "127.0.0.1" {
+			return nil, fmt.Errorf("cannot connect to %s", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+
+	conn, err := dial(context.Background(), "tcp", net.JoinHostPort("node.local", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if lookups != 2 {
+		t.Fatalf("unexpected number of lookups: %d; expected: %d", lookups, 2)
+	}
+	expected := []string{net.JoinHostPort("127.0.0.2", port), net.JoinHostPort("127.0.0.1", port)}
+	if !equalStrings(dialed, expected) {
+		t.Fatalf("unexpected dialed addrs: %v; expected: %v", dialed, expected)
+	}
+
+	// Fresh addresses must be cached.
+	conn, err = dial(context.Background(), "tcp", net.JoinHostPort("node.local", port))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.Close()
+	if lookups != 2 {
+		t.Fatalf("unexpected number of lookups: %d; expected: %d", lookups, 2)
+	}
+}
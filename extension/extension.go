@@ -0,0 +1,194 @@
+// Package extension defines stable interfaces for extending chproxy
+// with custom authentication, routing and cache keying.
+//
+// Extensions are registered under unique names from init functions of
+// packages compiled into chproxy or of Go plugins listed in
+// `extensions.plugins` config section. Registered extensions are referred
+// by their names from the config.
+//
+// Extensions are compiled into chproxy by adding a file with blank imports
+// of extension packages to the chproxy source tree, for example:
+//
+//	package main
+//
+//	import _ "example.com/corp/chproxy-iam"
+//
+// Go plugins must be built with `-buildmode=plugin` by the same Go version
+// and against the same version of this package as chproxy.
+package extension
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"plugin"
+	"sync"
+)
+
+// Authenticator verifies credentials of users with `authenticator` set.
+//
+// Authenticate is called concurrently. Its decisions are cached
+// according to `auth_cache` config section.
+type Authenticator interface {
+	// Authenticate returns true if password is valid for the user name.
+	//
+	// The name is the incoming user name, which may differ from the configured
+	// one for users with `name_is_regexp`.
+	// The request is rejected if an error is returned.
+	Authenticate(name, password string) (bool, error)
+}
+
+// Node describes a cluster node.
+type Node struct {
+	// Addr is the node address in the form `host:port`.
+	Addr string
+
+	// Replica is the name of the node replica.
+	Replica string
+
+	// Active is set if the node passes health checks.
+	Active bool
+}
+
+// RouteRequest describes the request routed by Router.
+type RouteRequest struct {
+	// User is the name of chproxy user.
+	User string
+
+	// Identity is the incoming user name for users with `name_is_regexp`.
+	Identity string
+
+	Cluster     string
+	ClusterUser string
+
+	// Params contains query args of the incoming request.
+	Params url.Values
+
+	// Header contains headers of the incoming request without credentials.
+	Header http.Header
+
+	// Nodes contains all the cluster nodes in config order.
+	Nodes []Node
+}
+
+// Router chooses nodes for requests to clusters with `router` set.
+//
+// Route is called concurrently.
+type Router interface {
+	// Route returns the address of the node from r.Nodes for the request.
+	//
+	// Default load balancing is used if an empty string is returned.
+	// The request is rejected if an error is returned.
+	Route(r *RouteRequest) (string, error)
+}
+
+// CacheKeyRequest describes the request, which may be served
+// from the cache.
+type CacheKeyRequest struct {
+	// User is the name of chproxy user.
+	User string
+
+	// Identity is the incoming user name for users with `name_is_regexp`.
+	Identity string
+
+	// Query contains the full query.
+	Query []byte
+
+	// Params contains query args of the incoming request.
+	Params url.Values
+
+	// Header contains headers of the incoming request without credentials.
+	Header http.Header
+}
+
+// CacheKeyer extends cache keys for caches with `keyer` set.
+//
+// CacheKey is called concurrently.
+type CacheKeyer interface {
+	// CacheKey returns a string added to the cache key of the request.
+	//
+	// Responses for requests with distinct strings are cached separately.
+	// The request is proxied without caching if an error is returned.
+	CacheKey(r *CacheKeyRequest) (string, error)
+}
+
+var (
+	mu             sync.Mutex
+	authenticators = make(map[string]Authenticator)
+	routers        = make(map[string]Router)
+	cacheKeyers    = make(map[string]CacheKeyer)
+)
+
+// RegisterAuthenticator registers a under the given name.
+//
+// It panics if the name is already registered.
+func RegisterAuthenticator(name string, a Authenticator) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := authenticators[name]; ok {
+		panic(fmt.Sprintf("BUG: authenticator %q is already registered", name))
+	}
+	authenticators[name] = a
+}
+
+// RegisterRouter registers r under the given name.
+//
+// It panics if the name is already registered.
+func RegisterRouter(name string, r Router) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := routers[name]; ok {
+		panic(fmt.Sprintf("BUG: router %q is already registered", name))
+	}
+	routers[name] = r
+}
+
+// RegisterCacheKeyer registers k under the given name.
+//
+// It panics if the name is already registered.
+func RegisterCacheKeyer(name string, k CacheKeyer) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := cacheKeyers[name]; ok {
+		panic(fmt.Sprintf("BUG: cache keyer %q is already registered", name))
+	}
+	cacheKeyers[name] = k
+}
+
+// GetAuthenticator returns authenticator registered under the given name.
+//
+// nil is returned if there is no such authenticator.
+func GetAuthenticator(name string) Authenticator {
+	mu.Lock()
+	defer mu.Unlock()
+	return authenticators[name]
+}
+
+// GetRouter returns router registered under the given name.
+//
+// nil is returned if there is no such router.
+func GetRouter(name string) Router {
+	mu.Lock()
+	defer mu.Unlock()
+	return routers[name]
+}
+
+// GetCacheKeyer returns cache keyer registered under the given name.
+//
+// nil is returned if there is no such cache keyer.
+func GetCacheKeyer(name string) CacheKeyer {
+	mu.Lock()
+	defer mu.Unlock()
+	return cacheKeyers[name]
+}
+
+// LoadPlugin loads Go plugin from the given path.
+//
+// The plugin must register its extensions from init functions.
+// Loading the same plugin multiple times has no effect.
+func LoadPlugin(path string) error {
+	if _, err := plugin.Open(path); err != nil {
+		return fmt.Errorf("cannot load plugin %q: %s", path, err)
+	}
+	return nil
+}
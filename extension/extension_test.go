@@ -0,0 +1,43 @@
+package extension
+
+import (
+	"strings"
+	"testing"
+)
+
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(name, password string) (bool, error) {
+	return password == "secret", nil
+}
+
+func TestRegisterAuthenticator(t *testing.T) {
+	if a := GetAuthenticator("test"); a != nil {
+		t.Fatalf("unexpected authenticator %#v", a)
+	}
+	RegisterAuthenticator("test", testAuthenticator{})
+	a := GetAuthenticator("test")
+	if a == nil {
+		t.Fatalf("expecting registered authenticator")
+	}
+	if ok, err := a.Authenticate("foo", "secret"); !ok || err != nil {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("expecting panic on duplicate registration")
+		}
+	}()
+	RegisterAuthenticator("test", testAuthenticator{})
+}
+
+func TestLoadPluginMissing(t *testing.T) {
+	err := LoadPlugin("testdata/missing.so")
+	if err == nil {
+		t.Fatalf("expecting error for missing plugin")
+	}
+	if !strings.Contains(err.Error(), "testdata/missing.so") {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Vertamedia/chproxy/extension"
+)
+
+// extensionAuthenticator verifies user credentials via the registered
+// authenticator extension.
+type extensionAuthenticator struct {
+	extension.Authenticator
+}
+
+func (ea extensionAuthenticator) authenticate(name, password string) (bool, error) {
+	return ea.Authenticate(name, password)
+}
+
+// route routes the request to the node chosen by the cluster router if set.
+//
+// Otherwise the node is chosen according to `consistent_hash` policy
+// if the cluster uses it.
+func (s *scope) route(req *http.Request) error {
+	r := s.cluster.router
+	if r == nil {
+		return s.routeByAffinity(req)
+	}
+	var nodes []extension.Node
+	for _, rep := range s.cluster.replicas {
+		for _, h := range rep.getHosts() {
+			nodes = append(nodes, extension.Node{
+				Addr:    h.addr.Host,
+				Replica: rep.name,
+				Active:  h.isActive(),
+			})
+		}
+	}
+	addr, err := r.Route(&extension.RouteRequest{
+		User:        s.user.name,
+		Identity:    s.identity,
+		Cluster:     s.cluster.name,
+		ClusterUser: s.clusterUser.name,
+		Params:      extensionParams(req.URL.Query()),
+		Header:      extensionHeader(req.Header),
+		Nodes:       nodes,
+	})
+	if err != nil {
+		return fmt.Errorf("router %q: %s", s.cluster.routerName, err)
+	}
+	if len(addr) == 0 || addr == s.host.addr.Host {
+		return nil
+	}
+	h := s.cluster.getHostByAddr(addr)
+	if h == nil {
+		return fmt.Errorf("router %q returned unknown node %q", s.cluster.routerName, addr)
+	}
+	s.setHost(h)
+	return nil
+}
+
+// extensionParams returns a copy of params without credentials.
+func extensionParams(params url.Values) url.Values {
+	p := make(url.Values, len(params))
+	for k, v := range params {
+		if k != "user" && k != "password" {
+			p[k] = v
+		}
+	}
+	return p
+}
+
+// extensionHeader returns a copy of header without credentials.
+func extensionHeader(header http.Header) http.Header {
+	h := make(http.Header, len(header))
+	for k, v := range header {
+		if k != "Authorization" && k != "X-Clickhouse-Key" {
+			h[k] = v
+		}
+	}
+	return h
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/extension"
+)
+
+type testExtensionAuthenticator struct{}
+
+func (testExtensionAuthenticator) Authenticate(name, password string) (bool, error) {
+	if password == "fail" {
+		return false, fmt.Errorf("backend is unavailable")
+	}
+	return password == name+"_secret", nil
+}
+
+type testExtensionRouter struct{}
+
+// Route routes requests to the node passed in `X-Node` header.
+func (testExtensionRouter) Route(r *extension.RouteRequest) (string, error) {
+	if len(r.Header.Get("Authorization")) > 0 || len(r.Params.Get("password")) > 0 {
+		return "", fmt.Errorf("credentials mustn't be passed to routers")
+	}
+	return r.Header.Get("X-Node"), nil
+}
+
+func init() {
+	extension.RegisterAuthenticator("test", testExtensionAuthenticator{})
+	extension.RegisterRouter("test", testExtensionRouter{})
+}
+
+func newExtensionsConfig() *config.Config {
+	return &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{"127.0.0.1:8123", "127.0.0.2:8123"},
+				Router: "test",
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:          "iam_.*",
+				NameIsRegexp:  true,
+				Authenticator: "test",
+				ToCluster:     "cluster",
+				ToUser:        "web",
+			},
+		},
+	}
+}
+
+func TestExtensionAuthenticator(t *testing.T) {
+	p, err := newConfiguredProxy(newExtensionsConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(name, password string, expectedStatus int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://localhost", nil)
+		req.SetBasicAuth(name, password)
+		_, status, err := p.getScope(req)
+		if status != expectedStatus {
+			t.Fatalf("unexpected status %d for %q; expecting %d; error: %v", status, name, expectedStatus, err)
+		}
+	}
+	f("iam_alice", "iam_alice_secret", 0)
+	f("iam_alice", "iam_bob_secret", 401)
+	f("iam_alice", "fail", 500)
+
+	cfg := newExtensionsConfig()
+	cfg.Users[0].Authenticator = "missing"
+	if _, err := newConfiguredProxy(cfg); err == nil {
+		t.Fatalf("expecting error for unknown authenticator")
+	}
+}
+
+func TestExtensionRouter(t *testing.T) {
+	p, err := newConfiguredProxy(newExtensionsConfig())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f := func(node, expectedNode string, expectedErr bool) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://localhost?password=iam_alice_secret&user=iam_alice", nil)
+		req.Header.Set("X-Node", node)
+		s, _, err := p.getScope(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := s.incQueued(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer s.dec()
+		err = s.route(req)
+		if expectedErr {
+			if err == nil {
+				t.Fatalf("expecting error for node %q", node)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(expectedNode) > 0 && s.host.addr.Host != expectedNode {
+			t.Fatalf("unexpected node %q; expecting %q", s.host.addr.Host, expectedNode)
+		}
+	}
+	f("", "", false)
+	f("127.0.0.2:8123", "127.0.0.2:8123", false)
+	f("127.0.0.1:8123", "127.0.0.1:8123", false)
+	f("127.0.0.3:8123", "", true)
+
+	cfg := newExtensionsConfig()
+	cfg.Clusters[0].Router = "missing"
+	if _, err := newConfiguredProxy(cfg); err == nil {
+		t.Fatalf("expecting error for unknown router")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// faultInjector injects artificial faults into requests.
+type faultInjector struct {
+	delayPercent float64
+	delay        time.Duration
+
+	errorPercent    float64
+	errorStatusCode int
+
+	dropPercent float64
+}
+
+// newFaultInjector returns injector for the given cfg.
+//
+// nil is returned if no faults are configured.
+func newFaultInjector(cfg config.FaultInjection) *faultInjector {
+	if cfg.DelayPercent == 0 && cfg.ErrorPercent == 0 && cfg.DropPercent == 0 {
+		return nil
+	}
+	return &faultInjector{
+		delayPercent:    cfg.DelayPercent,
+		delay:           time.Duration(cfg.Delay),
+		errorPercent:    cfg.ErrorPercent,
+		errorStatusCode: cfg.ErrorStatusCode,
+		dropPercent:     cfg.DropPercent,
+	}
+}
+
+func hitPercent(p float64) bool {
+	return p > 0 && rand.Float64()*100 < p
+}
+
+// inject injects faults into the given request.
+//
+// Returns true if the response has been already sent to rw.
+func (fi *faultInjector) inject(s *scope, rw http.ResponseWriter, req *http.Request) bool {
+	if fi == nil {
+		return false
+	}
+	if hitPercent(fi.delayPercent) {
+		faultInjected.With(s.faultLabels("delay")).Inc()
+		t := time.NewTimer(fi.delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+		}
+	}
+	if hitPercent(fi.dropPercent) {
+		faultInjected.With(s.faultLabels("drop")).Inc()
+		// Abort the handler, so the connection is closed
+		// without sending the response.
+		panic(http.ErrAbortHandler)
+	}
+	if hitPercent(fi.errorPercent) {
+		faultInjected.With(s.faultLabels("error")).Inc()
+		err := fmt.Errorf("%s: injected fault", s)
+		respondWith(rw, err, fi.errorStatusCode)
+		return true
+	}
+	return false
+}
+
+// injectFaults injects faults configured for the scope's user and cluster.
+//
+// Returns true if the response has been already sent to rw.
+func (s *scope) injectFaults(rw http.ResponseWriter, req *http.Request) bool {
+	if s.user.faults.inject(s, rw, req) {
+		return true
+	}
+	return s.cluster.faults.inject(s, rw, req)
+}
+
+func (s *scope) faultLabels(fault string) prometheus.Labels {
+	return prometheus.Labels{
+		"user":         s.user.name,
+		"cluster":      s.cluster.name,
+		"cluster_user": s.clusterUser.name,
+		"fault":        fault,
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorDisabled(t *testing.T) {
+	var fi *faultInjector
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	if fi.inject(&scope{}, rw, req) {
+		t.Fatalf("nil injector mustn't inject faults")
+	}
+}
+
+func TestFaultInjectorDelay(t *testing.T) {
+	p, err := getProxy(goodCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s, _, err := p.getScope(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi := &faultInjector{
+		delayPercent: 100,
+		delay:        50 * time.Millisecond,
+	}
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	if fi.inject(s, rw, httptest.NewRequest("GET", "/", nil)) {
+		t.Fatalf("delayed request must be proxied")
+	}
+	if d := time.Since(start); d < fi.delay {
+		t.Fatalf("request was delayed for %s; expected at least %s", d, fi.delay)
+	}
+}
+
+func TestFaultInjectorDrop(t *testing.T) {
+	p, err := getProxy(goodCfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s, _, err := p.getScope(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi := &faultInjector{
+		dropPercent: 100,
+	}
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Fatalf("unexpected panic: %v; expected: %v", r, http.ErrAbortHandler)
+		}
+	}()
+	fi.inject(s, httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	t.Fatalf("dropped request must abort the handler")
+}
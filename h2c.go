@@ -0,0 +1,17 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "net/http"
+
+// enableH2C allows unencrypted HTTP/2 connections with prior knowledge on s.
+func enableH2C(s *http.Server) error {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	p.SetUnencryptedHTTP2(true)
+	s.Protocols = &p
+	// The server must configure HTTP/2 itself.
+	s.TLSNextProto = nil
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// enableH2C allows unencrypted HTTP/2 connections with prior knowledge on s.
+func enableH2C(s *http.Server) error {
+	return fmt.Errorf("h2c requires chproxy built with Go 1.24 or newer")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// queryHistoryFlushInterval is the interval for persisting query history
+// to the file.
+const queryHistoryFlushInterval = 10 * time.Second
+
+// maxHistoryQueryLength is the maximum length of queries kept in the history.
+const maxHistoryQueryLength = 1024
+
+// queryHistoryEntry describes the query proxied on behalf of the user.
+type queryHistoryEntry struct {
+	Time        time.Time `json:"time"`
+	QueryID     string    `json:"query_id"`
+	User        string    `json:"user"`
+	Cluster     string    `json:"cluster"`
+	ClusterUser string    `json:"cluster_user"`
+	Node        string    `json:"cluster_node"`
+	RemoteAddr  string    `json:"remote_addr"`
+	StatusCode  int       `json:"status_code"`
+	Duration    float64   `json:"duration_seconds"`
+	Query       string    `json:"query"`
+}
+
+// queryHistory keeps recent queries per user.
+type queryHistory struct {
+	cfg config.QueryHistory
+
+	// mu protects users and dirty.
+	mu    sync.Mutex
+	users map[string]*queryRing
+	dirty bool
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newQueryHistory returns query history for the given cfg.
+//
+// nil is returned if query history isn't configured.
+// The history is loaded from cfg.File if it exists.
+func newQueryHistory(cfg config.QueryHistory) (*queryHistory, error) {
+	if cfg.Size == 0 {
+		return nil, nil
+	}
+	qh := &queryHistory{
+		cfg:    cfg,
+		users:  make(map[string]*queryRing),
+		stopCh: make(chan struct{}),
+	}
+	if len(cfg.File) == 0 {
+		return qh, nil
+	}
+	if err := qh.load(); err != nil {
+		return nil, err
+	}
+	qh.wg.Add(1)
+	go func() {
+		defer qh.wg.Done()
+		t := time.NewTicker(queryHistoryFlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := qh.save(); err != nil {
+					log.Errorf("cannot save query history: %s", err)
+				}
+			case <-qh.stopCh:
+				return
+			}
+		}
+	}()
+	return qh, nil
+}
+
+// Close stops the history and persists it to the file if configured.
+func (qh *queryHistory) Close() {
+	close(qh.stopCh)
+	qh.wg.Wait()
+	if len(qh.cfg.File) == 0 {
+		return
+	}
+	if err := qh.save(); err != nil {
+		log.Errorf("cannot save query history: %s", err)
+	}
+}
+
+// setSize sets the number of recent queries kept per user.
+func (qh *queryHistory) setSize(size int) {
+	qh.mu.Lock()
+	qh.cfg.Size = size
+	qh.mu.Unlock()
+}
+
+// add adds the query from s to the history.
+func (qh *queryHistory) add(s *scope, statusCode int, query string) {
+	if len(query) > maxHistoryQueryLength {
+		query = query[:maxHistoryQueryLength] + "..."
+	}
+	name := s.user.name
+	if len(s.identity) > 0 {
+		name = s.identity
+	}
+	e := queryHistoryEntry{
+		Time:        s.startTime,
+		QueryID:     s.id.String(),
+		User:        name,
+		Cluster:     s.cluster.name,
+		ClusterUser: s.clusterUser.name,
+		Node:        s.host.addr.Host,
+		RemoteAddr:  s.remoteAddr,
+		StatusCode:  statusCode,
+		Duration:    time.Since(s.startTime).Seconds(),
+		Query:       query,
+	}
+
+	qh.mu.Lock()
+	r := qh.users[name]
+	if r == nil {
+		r = &queryRing{}
+		qh.users[name] = r
+	}
+	r.add(e, qh.cfg.Size)
+	qh.dirty = true
+	qh.mu.Unlock()
+}
+
+// get returns up to limit recent queries of the given user
+// starting from the most recent one.
+func (qh *queryHistory) get(name string, limit int) []queryHistoryEntry {
+	qh.mu.Lock()
+	defer qh.mu.Unlock()
+
+	entries := []queryHistoryEntry{}
+	r := qh.users[name]
+	if r == nil {
+		return entries
+	}
+	for _, e := range r.list() {
+		if limit > 0 && len(entries) >= limit {
+			break
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func (qh *queryHistory) load() error {
+	data, err := ioutil.ReadFile(qh.cfg.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read query history: %s", err)
+	}
+	var users map[string][]queryHistoryEntry
+	if err := json.Unmarshal(data, &users); err != nil {
+		return fmt.Errorf("cannot parse query history from %q: %s", qh.cfg.File, err)
+	}
+	for name, entries := range users {
+		r := &queryRing{}
+		// Entries are stored starting from the most recent one.
+		for i := len(entries) - 1; i >= 0; i-- {
+			r.add(entries[i], qh.cfg.Size)
+		}
+		qh.users[name] = r
+	}
+	return nil
+}
+
+// save persists the history to the file if it has been changed.
+func (qh *queryHistory) save() error {
+	qh.mu.Lock()
+	if !qh.dirty {
+		qh.mu.Unlock()
+		return nil
+	}
+	users := make(map[string][]queryHistoryEntry, len(qh.users))
+	for name, r := range qh.users {
+		users[name] = r.list()
+	}
+	qh.dirty = false
+	qh.mu.Unlock()
+
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	tmp := qh.cfg.File + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, qh.cfg.File)
+}
+
+// queryRing is a bounded ring of recent queries.
+type queryRing struct {
+	entries []queryHistoryEntry
+	next    int
+}
+
+func (r *queryRing) add(e queryHistoryEntry, size int) {
+	if len(r.entries) > size {
+		// The size has been decreased. Keep the most recent entries.
+		r.entries = r.list()[:size]
+		reverseEntries(r.entries)
+		r.next = 0
+	}
+	if len(r.entries) < size {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % size
+}
+
+// list returns entries starting from the most recent one.
+func (r *queryRing) list() []queryHistoryEntry {
+	entries := make([]queryHistoryEntry, 0, len(r.entries))
+	entries = append(entries, r.entries[r.next:]...)
+	entries = append(entries, r.entries[:r.next]...)
+	reverseEntries(entries)
+	return entries
+}
+
+func reverseEntries(entries []queryHistoryEntry) {
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+}
+
+// serveUserQueries serves recent queries of the user
+// at `/admin/users/<name>/queries`.
+//
+// Optional `limit` query arg limits the number of returned queries.
+func serveUserQueries(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/users/")
+	if !strings.HasSuffix(name, "/queries") {
+		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+	name = strings.TrimSuffix(name, "/queries")
+
+	var limit int
+	if s := r.URL.Query().Get("limit"); len(s) > 0 {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			err := fmt.Errorf("%q: invalid `limit` %q", r.RemoteAddr, s)
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	proxy.lock.RLock()
+	qh := proxy.history
+	proxy.lock.RUnlock()
+	if qh == nil {
+		err := fmt.Errorf("%q: query history is disabled", r.RemoteAddr)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(qh.get(name, limit)); err != nil {
+		log.Errorf("cannot write user queries response: %s", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestQueryRing(t *testing.T) {
+	r := &queryRing{}
+	add := func(size int, queries ...string) {
+		for _, q := range queries {
+			r.add(queryHistoryEntry{Query: q}, size)
+		}
+	}
+	check := func(expected ...string) {
+		t.Helper()
+		entries := r.list()
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Query)
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("unexpected entries %q; expecting %q", got, expected)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("unexpected entries %q; expecting %q", got, expected)
+			}
+		}
+	}
+
+	add(3, "1", "2")
+	check("2", "1")
+	add(3, "3", "4", "5")
+	check("5", "4", "3")
+
+	// Decreased size must keep the most recent entries.
+	add(2, "6")
+	check("6", "5")
+	add(2, "7")
+	check("7", "6")
+}
+
+func TestQueryHistoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-query-history")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.QueryHistory{
+		Size: 5,
+		File: filepath.Join(dir, "history.json"),
+	}
+	qh, err := newQueryHistory(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &scope{
+		startTime:   time.Now(),
+		user:        &user{name: "default"},
+		cluster:     &cluster{name: "cluster"},
+		clusterUser: &clusterUser{name: "web"},
+		host:        &host{addr: &url.URL{Host: "127.0.0.1:8123"}},
+	}
+	for i := 0; i < 7; i++ {
+		qh.add(s, 200, "SELECT "+strconv.Itoa(i))
+	}
+	s.identity = "team_a_alice"
+	qh.add(s, 500, "SELECT 42")
+	qh.Close()
+
+	qh, err = newQueryHistory(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer qh.Close()
+
+	entries := qh.get("default", 0)
+	if len(entries) != 5 || entries[0].Query != "SELECT 6" || entries[4].Query != "SELECT 2" {
+		t.Fatalf("unexpected entries after reload: %+v", entries)
+	}
+	entries = qh.get("team_a_alice", 0)
+	if len(entries) != 1 || entries[0].StatusCode != 500 || entries[0].Node != "127.0.0.1:8123" {
+		t.Fatalf("unexpected entries for user matched by regexp: %+v", entries)
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxHookQuerySize is the maximum size of the query passed to hooks.
+const maxHookQuerySize = 256 * 1024
+
+// hookRequest is sent to hooks before proxying the request to ClickHouse.
+type hookRequest struct {
+	Type        string `json:"type"`
+	QueryID     string `json:"query_id"`
+	User        string `json:"user"`
+	Cluster     string `json:"cluster"`
+	ClusterUser string `json:"cluster_user"`
+	Node        string `json:"cluster_node"`
+	RemoteAddr  string `json:"remote_addr"`
+	Method      string `json:"method"`
+	Query       string `json:"query"`
+
+	// QueryTruncated is set if the query exceeds maxHookQuerySize,
+	// is compressed or is sent with external data. Such queries
+	// cannot be modified by hooks.
+	QueryTruncated bool `json:"query_truncated,omitempty"`
+
+	Params  url.Values  `json:"params"`
+	Headers http.Header `json:"headers"`
+}
+
+// hookReply is the hook reply to hookRequest.
+//
+// Omitted fields leave the request unchanged.
+type hookReply struct {
+	// The request is rejected if StatusCode is set.
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+
+	Query   *string     `json:"query"`
+	Params  url.Values  `json:"params"`
+	Headers http.Header `json:"headers"`
+
+	// Node routes the request to another node of the cluster.
+	Node string `json:"cluster_node"`
+}
+
+// hookResponse notifies hooks with `on_response` about the response status.
+//
+// Hooks mustn't reply to hookResponse.
+type hookResponse struct {
+	Type        string  `json:"type"`
+	QueryID     string  `json:"query_id"`
+	User        string  `json:"user"`
+	Cluster     string  `json:"cluster"`
+	ClusterUser string  `json:"cluster_user"`
+	Node        string  `json:"cluster_node"`
+	StatusCode  int     `json:"status_code"`
+	Duration    float64 `json:"duration_seconds"`
+}
+
+// hookProcess exchanges JSON lines with the external hook process
+// via its stdin and stdout.
+type hookProcess struct {
+	cfg config.Hook
+
+	// mu serializes messages to the process.
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	closed bool
+}
+
+func newHookProcess(cfg config.Hook) (*hookProcess, error) {
+	hp := &hookProcess{
+		cfg: cfg,
+	}
+	if err := hp.start(); err != nil {
+		return nil, err
+	}
+	return hp, nil
+}
+
+// start starts the hook process.
+//
+// hp.mu must be held by the caller if hp is shared.
+func (hp *hookProcess) start() error {
+	cmd := exec.Command(hp.cfg.Command[0], hp.cfg.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start hook %q: %s", hp.cfg.Name, err)
+	}
+	hp.cmd = cmd
+	hp.stdin = stdin
+	hp.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+// stop stops the hook process. The process is killed if it doesn't exit
+// during the hook timeout after closing its stdin.
+//
+// hp.mu must be held by the caller.
+func (hp *hookProcess) stop() {
+	if hp.cmd == nil {
+		return
+	}
+	hp.stdin.Close()
+	doneCh := make(chan struct{})
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		close(doneCh)
+	}(hp.cmd)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Duration(hp.cfg.Timeout)):
+		hp.cmd.Process.Kill()
+		<-doneCh
+	}
+	hp.cmd = nil
+}
+
+// Close stops the hook process.
+func (hp *hookProcess) Close() {
+	hp.mu.Lock()
+	hp.stop()
+	hp.closed = true
+	hp.mu.Unlock()
+}
+
+// call sends msg to the hook process and reads the reply into reply.
+//
+// The reply isn't read if reply is nil. The process is restarted
+// on the next call after a failure.
+func (hp *hookProcess) call(msg, reply interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+	if hp.closed {
+		return fmt.Errorf("hook %q is closed", hp.cfg.Name)
+	}
+	if hp.cmd == nil {
+		if err := hp.start(); err != nil {
+			return err
+		}
+	}
+	if err := hp.roundTrip(data, reply); err != nil {
+		hp.stop()
+		return fmt.Errorf("hook %q: %s", hp.cfg.Name, err)
+	}
+	return nil
+}
+
+// roundTrip must be called under hp.mu.
+func (hp *hookProcess) roundTrip(data []byte, reply interface{}) error {
+	stdin, stdout := hp.stdin, hp.stdout
+	errCh := make(chan error, 1)
+	go func() {
+		if _, err := stdin.Write(data); err != nil {
+			errCh <- fmt.Errorf("cannot send message: %s", err)
+			return
+		}
+		if reply == nil {
+			errCh <- nil
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		if err != nil {
+			errCh <- fmt.Errorf("cannot read reply: %s", err)
+			return
+		}
+		if err := json.Unmarshal(line, reply); err != nil {
+			errCh <- fmt.Errorf("cannot parse reply %q: %s", line, err)
+			return
+		}
+		errCh <- nil
+	}()
+
+	t := time.NewTimer(time.Duration(hp.cfg.Timeout))
+	defer t.Stop()
+	select {
+	case err := <-errCh:
+		return err
+	case <-t.C:
+		// The goroutine above is unblocked when the caller stops the process.
+		return fmt.Errorf("no reply during %s", hp.cfg.Timeout)
+	}
+}
+
+// hookPool passes messages to a pool of hook processes,
+// so a slow reply of a single process doesn't delay other requests.
+type hookPool struct {
+	cfg config.Hook
+
+	procs []*hookProcess
+
+	// idle holds processes ready for the next message.
+	idle chan *hookProcess
+}
+
+func newHookPool(cfg config.Hook) (*hookPool, error) {
+	n := cfg.Processes
+	if n <= 0 {
+		n = 1
+	}
+	hp := &hookPool{
+		cfg:  cfg,
+		idle: make(chan *hookProcess, n),
+	}
+	for i := 0; i < n; i++ {
+		p, err := newHookProcess(cfg)
+		if err != nil {
+			hp.Close()
+			return nil, err
+		}
+		hp.procs = append(hp.procs, p)
+		hp.idle <- p
+	}
+	return hp, nil
+}
+
+// call passes msg to an idle hook process and reads the reply into reply.
+//
+// The time spent waiting for an idle process counts towards the hook timeout.
+func (hp *hookPool) call(msg, reply interface{}) error {
+	t := time.NewTimer(time.Duration(hp.cfg.Timeout))
+	defer t.Stop()
+	var p *hookProcess
+	select {
+	case p = <-hp.idle:
+	case <-t.C:
+		return fmt.Errorf("hook %q: no idle process during %s", hp.cfg.Name, hp.cfg.Timeout)
+	}
+	defer func() { hp.idle <- p }()
+	return p.call(msg, reply)
+}
+
+// Close stops all the hook processes.
+func (hp *hookPool) Close() {
+	for _, p := range hp.procs {
+		p.Close()
+	}
+}
+
+// requestHooks passes proxied requests to hooks in the configured order.
+type requestHooks []*hookPool
+
+// newRequestHooks returns hooks for the given cfg.
+//
+// Processes of hooks from prev with unchanged config are reused,
+// so they aren't restarted on config reload.
+func newRequestHooks(cfg []config.Hook, prev requestHooks) (requestHooks, error) {
+	var hs requestHooks
+	names := make(map[string]bool, len(cfg))
+	for _, hc := range cfg {
+		if names[hc.Name] {
+			hs.closeExcept(prev)
+			return nil, fmt.Errorf("duplicate config for hook %q", hc.Name)
+		}
+		names[hc.Name] = true
+		if hp := prev.find(hc); hp != nil {
+			hs = append(hs, hp)
+			continue
+		}
+		hp, err := newHookPool(hc)
+		if err != nil {
+			hs.closeExcept(prev)
+			return nil, err
+		}
+		hs = append(hs, hp)
+	}
+	return hs, nil
+}
+
+// find returns the hook with the same config as hc.
+func (hs requestHooks) find(hc config.Hook) *hookPool {
+	for _, hp := range hs {
+		if reflect.DeepEqual(hp.cfg, hc) {
+			return hp
+		}
+	}
+	return nil
+}
+
+// closeExcept closes hooks missing in other.
+func (hs requestHooks) closeExcept(other requestHooks) {
+	for _, hp := range hs {
+		if other.find(hp.cfg) == nil {
+			hp.Close()
+		}
+	}
+}
+
+// onRequest passes the request to hooks, which may modify or reject it.
+//
+// The returned status code must be used for responding on error.
+func (hs requestHooks) onRequest(s *scope, req *http.Request) (int, error) {
+	if len(hs) == 0 {
+		return 0, nil
+	}
+	q, truncated, err := peekHookQuery(req)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("cannot read query: %s", err)
+	}
+	hr := &hookRequest{
+		Type:           "request",
+		QueryID:        s.id.String(),
+		User:           s.user.name,
+		Cluster:        s.cluster.name,
+		ClusterUser:    s.clusterUser.name,
+		RemoteAddr:     s.remoteAddr,
+		Method:         req.Method,
+		Query:          string(q),
+		QueryTruncated: truncated,
+		Headers:        extensionHeader(req.Header),
+	}
+	for _, hp := range hs {
+		hr.Node = s.host.addr.Host
+		hr.Params = req.URL.Query()
+
+		var reply hookReply
+		if err := hp.call(hr, &reply); err != nil {
+			hookErrors.With(prometheus.Labels{"hook": hp.cfg.Name}).Inc()
+			return http.StatusInternalServerError, err
+		}
+		if reply.StatusCode != 0 {
+			if reply.StatusCode < 400 || reply.StatusCode > 599 {
+				hookErrors.With(prometheus.Labels{"hook": hp.cfg.Name}).Inc()
+				return http.StatusInternalServerError, fmt.Errorf("hook %q replied with invalid status_code %d", hp.cfg.Name, reply.StatusCode)
+			}
+			return reply.StatusCode, fmt.Errorf("request denied by hook %q: %s", hp.cfg.Name, reply.Message)
+		}
+		if err := applyHookReply(s, req, hr, &reply); err != nil {
+			hookErrors.With(prometheus.Labels{"hook": hp.cfg.Name}).Inc()
+			return http.StatusInternalServerError, fmt.Errorf("hook %q: %s", hp.cfg.Name, err)
+		}
+	}
+	return 0, nil
+}
+
+// applyHookReply applies changes from reply to req and s.
+//
+// hr is updated, so the next hooks see the changes.
+func applyHookReply(s *scope, req *http.Request, hr *hookRequest, reply *hookReply) error {
+	if len(reply.Node) > 0 && reply.Node != s.host.addr.Host {
+		h := s.cluster.getHostByAddr(reply.Node)
+		if h == nil {
+			return fmt.Errorf("unknown cluster_node %q for cluster %q", reply.Node, s.cluster.name)
+		}
+		s.setHost(h)
+		req.URL.Scheme = h.addr.Scheme
+		req.URL.Host = h.addr.Host
+	}
+	if reply.Params != nil {
+		// query_id is used for killing the query, so it must be kept.
+		reply.Params.Set("query_id", s.id.String())
+		req.URL.RawQuery = reply.Params.Encode()
+	}
+	for k, v := range reply.Headers {
+		k = http.CanonicalHeaderKey(k)
+		if k == "Authorization" || k == "X-Clickhouse-User" || k == "X-Clickhouse-Key" {
+			return fmt.Errorf("cannot modify %q header", k)
+		}
+		req.Header[k] = v
+		hr.Headers[k] = v
+	}
+	if reply.Query != nil && *reply.Query != hr.Query {
+		if hr.QueryTruncated {
+			return fmt.Errorf("cannot modify truncated query")
+		}
+		q := *reply.Query
+		params := req.URL.Query()
+		if len(params.Get("query")) > 0 || req.Method == http.MethodGet {
+			params.Set("query", q)
+			req.URL.RawQuery = params.Encode()
+		} else {
+			req.Body = &peekedReadCloser{
+				Reader: strings.NewReader(q),
+				Closer: req.Body,
+			}
+			req.ContentLength = int64(len(q))
+		}
+		hr.Query = q
+	}
+	return nil
+}
+
+// peekHookQuery returns the query passed to hooks without consuming
+// the request body.
+//
+// The query is obtained either from `query` param or from the request body.
+// The returned bool is set if the query cannot be passed in full.
+func peekHookQuery(req *http.Request) ([]byte, bool, error) {
+	if q := req.URL.Query().Get("query"); len(q) > 0 || req.Method == http.MethodGet {
+		if len(q) > maxHookQuerySize {
+			return []byte(q[:maxHookQuerySize]), true, nil
+		}
+		return []byte(q), false, nil
+	}
+	if strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") || getDecompressor(req) != nil {
+		return nil, true, nil
+	}
+	body, err := peekBody(req, maxHookQuerySize+1)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxHookQuerySize {
+		return body[:maxHookQuerySize], true, nil
+	}
+	return body, false, nil
+}
+
+// onResponse notifies hooks with `on_response` about the response status.
+func (hs requestHooks) onResponse(s *scope, statusCode int) {
+	for _, hp := range hs {
+		if !hp.cfg.OnResponse {
+			continue
+		}
+		hr := &hookResponse{
+			Type:        "response",
+			QueryID:     s.id.String(),
+			User:        s.user.name,
+			Cluster:     s.cluster.name,
+			ClusterUser: s.clusterUser.name,
+			Node:        s.host.addr.Host,
+			StatusCode:  statusCode,
+			Duration:    time.Since(s.startTime).Seconds(),
+		}
+		if err := hp.call(hr, nil); err != nil {
+			hookErrors.With(prometheus.Labels{"hook": hp.cfg.Name}).Inc()
+			log.Errorf("%s: %s", s, err)
+		}
+	}
+}
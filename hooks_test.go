@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// TestHookHelperProcess isn't a real test. It is started as a hook process
+// by TestRequestHooks.
+func TestHookHelperProcess(t *testing.T) {
+	if os.Getenv("CHPROXY_TEST_HOOK") != "1" {
+		return
+	}
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(nil, 1<<20)
+	enc := json.NewEncoder(os.Stdout)
+	for sc.Scan() {
+		var hr hookRequest
+		if err := json.Unmarshal(sc.Bytes(), &hr); err != nil {
+			os.Exit(1)
+		}
+		if hr.Type != "request" {
+			continue
+		}
+		var reply hookReply
+		switch {
+		case strings.Contains(hr.Query, "forbidden"):
+			reply.StatusCode = http.StatusForbidden
+			reply.Message = "forbidden table"
+		case strings.Contains(hr.Query, "crash"):
+			os.Exit(1)
+		case strings.Contains(hr.Query, "sleep"):
+			time.Sleep(time.Second)
+		default:
+			q := strings.Replace(hr.Query, "SELECT 1", "SELECT 2", 1)
+			reply.Query = &q
+			reply.Params = hr.Params
+			reply.Params.Set("max_threads", "1")
+			reply.Headers = http.Header{"X-Hook": []string{hr.User}}
+		}
+		enc.Encode(reply)
+	}
+	os.Exit(0)
+}
+
+func TestRequestHooks(t *testing.T) {
+	os.Setenv("CHPROXY_TEST_HOOK", "1")
+	defer os.Unsetenv("CHPROXY_TEST_HOOK")
+
+	hs, err := newRequestHooks([]config.Hook{
+		{
+			Name:    "test",
+			Command: []string{os.Args[0], "-test.run=TestHookHelperProcess"},
+			Timeout: config.Duration(200 * time.Millisecond),
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer hs.closeExcept(nil)
+
+	s := &scope{
+		id:          newScopeID(),
+		user:        &user{name: "default"},
+		clusterUser: &clusterUser{name: "web"},
+		cluster:     &cluster{name: "cluster"},
+		host: &host{
+			addr: &url.URL{Host: "127.0.0.1:8123"},
+		},
+	}
+	f := func(req *http.Request, expectedStatus int) {
+		t.Helper()
+		status, err := hs.onRequest(s, req)
+		if status != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d; error: %v", status, expectedStatus, err)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "http://127.0.0.1?query_id=foo", strings.NewReader("SELECT 1"))
+	f(req, 0)
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(b) != "SELECT 2" || req.ContentLength != int64(len(b)) {
+		t.Fatalf("unexpected query %q with content length %d", b, req.ContentLength)
+	}
+	params := req.URL.Query()
+	if params.Get("max_threads") != "1" || params.Get("query_id") != s.id.String() {
+		t.Fatalf("unexpected params %q", req.URL.RawQuery)
+	}
+	if h := req.Header.Get("X-Hook"); h != "default" {
+		t.Fatalf("unexpected X-Hook header %q", h)
+	}
+
+	req = httptest.NewRequest("GET", "http://127.0.0.1?query=SELECT+1", nil)
+	f(req, 0)
+	if q := req.URL.Query().Get("query"); q != "SELECT 2" {
+		t.Fatalf("unexpected query %q", q)
+	}
+
+	f(httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT * FROM forbidden")), http.StatusForbidden)
+
+	// The hook must be restarted after failures.
+	f(httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT crash")), http.StatusInternalServerError)
+	f(httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT 1")), 0)
+	f(httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT sleep")), http.StatusInternalServerError)
+	f(httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT 1")), 0)
+}
+
+func TestRequestHooksConcurrency(t *testing.T) {
+	os.Setenv("CHPROXY_TEST_HOOK", "1")
+	defer os.Unsetenv("CHPROXY_TEST_HOOK")
+
+	hs, err := newRequestHooks([]config.Hook{
+		{
+			Name:      "test",
+			Command:   []string{os.Args[0], "-test.run=TestHookHelperProcess"},
+			Timeout:   config.Duration(3 * time.Second),
+			Processes: 2,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer hs.closeExcept(nil)
+
+	s := &scope{
+		id:          newScopeID(),
+		user:        &user{name: "default"},
+		clusterUser: &clusterUser{name: "web"},
+		cluster:     &cluster{name: "cluster"},
+		host: &host{
+			addr: &url.URL{Host: "127.0.0.1:8123"},
+		},
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "http://127.0.0.1", strings.NewReader("SELECT sleep"))
+			if status, err := hs.onRequest(s, req); err != nil {
+				t.Errorf("unexpected error with status code %d: %s", status, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// Each request takes a second in the hook.
+	if d := time.Since(start); d > 1900*time.Millisecond {
+		t.Fatalf("requests must be passed to hook processes concurrently; took %s", d)
+	}
+}
+
+func TestNewRequestHooksReuse(t *testing.T) {
+	cfg := []config.Hook{
+		{
+			Name:    "cat",
+			Command: []string{"cat"},
+			Timeout: config.Duration(time.Second),
+		},
+	}
+	hs, err := newRequestHooks(cfg, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	hs2, err := newRequestHooks(cfg, hs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if hs2[0] != hs[0] {
+		t.Fatalf("hook with unchanged config must be reused")
+	}
+	hs.closeExcept(hs2)
+	if hs2[0].procs[0].closed {
+		t.Fatalf("reused hook mustn't be closed")
+	}
+
+	cfg = append(cfg, cfg[0])
+	if _, err := newRequestHooks(cfg, hs2); err == nil {
+		t.Fatalf("expecting error for duplicate hooks")
+	}
+	if hs2[0].procs[0].closed {
+		t.Fatalf("hook from the previous config mustn't be closed on error")
+	}
+	hs2.closeExcept(nil)
+}
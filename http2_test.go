@@ -0,0 +1,110 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestServerHTTP2(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", r.ProtoMajor)
+	})
+	f := func(client *http.Client, url, expectedProto string) {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		if proto := bbToString(t, resp.Body); proto != expectedProto {
+			t.Fatalf("unexpected HTTP protocol version %s; expecting %s", proto, expectedProto)
+		}
+	}
+
+	// HTTP/2 via ALPN.
+	for _, http2 := range []bool{false, true} {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("cannot listen: %s", err)
+		}
+		tlsCfg := newTLSConfig(config.HTTPS{
+			CertFile: "testdata/example.com.cert",
+			KeyFile:  "testdata/example.com.key",
+			HTTP2:    http2,
+		})
+		s := newServer(h, config.TimeoutCfg{})
+		if http2 {
+			s.TLSNextProto = nil
+		}
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		expectedProto := "1"
+		if http2 {
+			expectedProto = "2"
+		}
+		go runServer(s, tls.NewListener(ln, tlsCfg))
+		f(client, "https://"+ln.Addr().String(), expectedProto)
+		s.Close()
+	}
+
+	// h2c.
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	s := newServer(h, config.TimeoutCfg{})
+	if err := enableH2C(s); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var p http.Protocols
+	p.SetUnencryptedHTTP2(true)
+	client := &http.Client{Transport: &http.Transport{Protocols: &p}}
+	go runServer(s, ln)
+	defer s.Close()
+	f(client, "http://"+ln.Addr().String(), "2")
+
+	// HTTP/1.1 clients must be served too.
+	f(http.DefaultClient, "http://"+ln.Addr().String(), "1")
+}
+
+func TestTransportHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d", r.ProtoMajor)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	f := func(http2 bool, expectedProto string) {
+		t.Helper()
+		tr, err := newTransport(config.Cluster{
+			Scheme: "https",
+			HTTP2:  http2,
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		tr.TLSClientConfig.InsecureSkipVerify = true
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer resp.Body.Close()
+		if proto := bbToString(t, resp.Body); proto != expectedProto {
+			t.Fatalf("unexpected HTTP protocol version %s; expecting %s", proto, expectedProto)
+		}
+	}
+	f(false, "1")
+	f(true, "2")
+}
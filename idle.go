@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatchWriter tracks the time of the last response write,
+// so queries stuck on dead shards or network black holes may be killed
+// without waiting for max_execution_time.
+type idleWatchWriter struct {
+	http.ResponseWriter
+
+	// lastWrite holds the time of the last write in nanoseconds.
+	lastWrite int64
+
+	// idle is set to 1 if the request has been canceled by the watchdog.
+	idle int32
+}
+
+// newIdleWatchWriter returns rw wrapped into idleWatchWriter.
+//
+// The watchdog calls cancel if no response bytes are written
+// during idleTime. The watchdog stops when ctx is done.
+func newIdleWatchWriter(ctx context.Context, rw http.ResponseWriter, idleTime time.Duration, cancel context.CancelFunc) *idleWatchWriter {
+	iw := &idleWatchWriter{
+		ResponseWriter: rw,
+		lastWrite:      time.Now().UnixNano(),
+	}
+	go iw.watch(ctx, idleTime, cancel)
+	return iw
+}
+
+func (iw *idleWatchWriter) watch(ctx context.Context, idleTime time.Duration, cancel context.CancelFunc) {
+	t := time.NewTimer(idleTime)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			last := time.Unix(0, atomic.LoadInt64(&iw.lastWrite))
+			since := time.Since(last)
+			if since >= idleTime {
+				atomic.StoreInt32(&iw.idle, 1)
+				cancel()
+				return
+			}
+			t.Reset(idleTime - since)
+		}
+	}
+}
+
+func (iw *idleWatchWriter) Write(b []byte) (int, error) {
+	n, err := iw.ResponseWriter.Write(b)
+	atomic.StoreInt64(&iw.lastWrite, time.Now().UnixNano())
+	return n, err
+}
+
+// isIdle returns true if the request has been canceled by the watchdog.
+func (iw *idleWatchWriter) isIdle() bool {
+	return atomic.LoadInt32(&iw.idle) == 1
+}
+
+// CloseNotify implements http.CloseNotifier
+func (iw *idleWatchWriter) CloseNotify() <-chan bool {
+	// The iw.ResponseWriter must implement http.CloseNotifier
+	return iw.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
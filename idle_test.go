@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestIdleTimeout(t *testing.T) {
+	var killed int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		b := string(body)
+		if strings.Contains(b, killQueryPattern) {
+			atomic.AddInt32(&killed, 1)
+			return
+		}
+		if len(b) == 0 {
+			// health check
+			w.Write([]byte(okResponse))
+			return
+		}
+		// The body contains delays between response chunks.
+		for _, s := range strings.Split(b, ",") {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				panic(err)
+			}
+			select {
+			case <-time.After(d):
+			case <-r.Context().Done():
+				return
+			}
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(maxIdleTime time.Duration, body string, expectedStatus int, expectedKilled bool) {
+		t.Helper()
+		p, err := newConfiguredProxy(&config.Config{
+			Clusters: []config.Cluster{
+				{
+					Name:   "cluster",
+					Scheme: "http",
+					Nodes:  []string{addr.Host},
+					ClusterUsers: []config.ClusterUser{
+						{
+							Name:        "web",
+							MaxIdleTime: config.Duration(maxIdleTime),
+						},
+					},
+					HeartBeatInterval: config.Duration(time.Minute),
+				},
+			},
+			Users: []config.User{
+				{
+					Name:      "default",
+					ToCluster: "cluster",
+					ToUser:    "web",
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		atomic.StoreInt32(&killed, 0)
+		req := httptest.NewRequest("POST", srv.URL, strings.NewReader(body))
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, expectedStatus)
+		}
+		respBody := bbToString(t, resp.Body)
+		if isKilled := atomic.LoadInt32(&killed) > 0; isKilled != expectedKilled {
+			t.Fatalf("unexpected query kill state: %v; response: %q", isKilled, respBody)
+		}
+		if expectedKilled && !strings.Contains(respBody, "idle timeout for cluster user \"web\" exceeded") {
+			t.Fatalf("unexpected response: %q", respBody)
+		}
+	}
+
+	// Chunks are sent more frequently than the idle timeout.
+	f(100*time.Millisecond, "50ms,50ms,50ms,50ms", http.StatusOK, false)
+	f(0, "50ms,200ms", http.StatusOK, false)
+
+	// The query is stuck before the response.
+	f(100*time.Millisecond, "1s", http.StatusGatewayTimeout, true)
+
+	// The query is stuck in the middle of the response.
+	f(100*time.Millisecond, "1ms,1s", http.StatusOK, true)
+}
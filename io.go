@@ -69,18 +69,22 @@ type cachedReadCloser struct {
 	// are called from concurrent goroutines.
 	bLock sync.Mutex
 
-	// b holds up to 1Kb of the initial data read from ReadCloser.
+	// b holds up to maxQuerySnippetSize of the initial data read from ReadCloser.
 	b []byte
 }
 
+// maxQuerySnippetSize is the maximum size of the query snippet
+// held by cachedReadCloser.
+const maxQuerySnippetSize = 1024
+
 func (crc *cachedReadCloser) Read(p []byte) (int, error) {
 	n, err := crc.ReadCloser.Read(p)
 
 	crc.bLock.Lock()
-	if len(crc.b) < 1024 {
+	if len(crc.b) < maxQuerySnippetSize {
 		crc.b = append(crc.b, p[:n]...)
-		if len(crc.b) >= 1024 {
-			crc.b = append(crc.b[:1024], "..."...)
+		if len(crc.b) >= maxQuerySnippetSize {
+			crc.b = append(crc.b[:maxQuerySnippetSize], "..."...)
 		}
 	}
 	crc.bLock.Unlock()
@@ -96,3 +100,9 @@ func (crc *cachedReadCloser) String() string {
 	crc.bLock.Unlock()
 	return s
 }
+
+// peekedReadCloser returns the peeked data before the rest of the body.
+type peekedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+const (
+	// jwtLeeway is the allowed clock skew for `exp` and `nbf` claims.
+	jwtLeeway = time.Minute
+
+	// jwksMinRefreshInterval limits re-fetching JWKS on tokens
+	// signed by unknown keys.
+	jwksMinRefreshInterval = time.Minute
+)
+
+// jwtVerifier verifies JWT bearer tokens and extracts user names from them.
+type jwtVerifier struct {
+	jwksURL         string
+	issuer          string
+	audience        string
+	userClaim       string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	// mu protects the fields below.
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+}
+
+// newJWTVerifier returns JWT verifier for the given cfg.
+//
+// nil is returned if JWT authentication isn't configured.
+// Keys from cfg.JWKSURL must be fetched via fetchKeys.
+func newJWTVerifier(cfg config.JWT) (*jwtVerifier, error) {
+	if len(cfg.JWKSURL) == 0 && len(cfg.KeyFile) == 0 {
+		return nil, nil
+	}
+	v := &jwtVerifier{
+		jwksURL:         cfg.JWKSURL,
+		issuer:          cfg.Issuer,
+		audience:        cfg.Audience,
+		userClaim:       cfg.UserClaim,
+		refreshInterval: time.Duration(cfg.RefreshInterval),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+	if len(cfg.KeyFile) > 0 {
+		key, err := loadPublicKey(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load `jwt.key_file`: %s", err)
+		}
+		// The static key verifies tokens regardless of their `kid`.
+		v.keys = map[string]crypto.PublicKey{"": key}
+	}
+	return v, nil
+}
+
+// loadPublicKey returns public key from PEM file containing either
+// the key or the certificate.
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", file, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("cannot find PEM block in %q", file)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse certificate from %q: %s", file, err)
+		}
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key from %q: %s", file, err)
+	}
+	return key, nil
+}
+
+// jwk is a key from JWKS document.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys fetches signing keys from JWKS URL.
+func (v *jwtVerifier) fetchKeys() error {
+	v.mu.Lock()
+	v.lastFetch = time.Now()
+	v.mu.Unlock()
+
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return fmt.Errorf("cannot fetch JWKS from %q: %s", v.jwksURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code while fetching JWKS from %q: %d", v.jwksURL, resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("cannot parse JWKS from %q: %s", v.jwksURL, err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Errorf("skipping JWKS key %q from %q: %s", k.Kid, v.jwksURL, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode `n`: %s", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode `e`: %s", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("too big `e`")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode `x`: %s", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode `y`: %s", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("the point isn't on curve %q", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// run periodically re-fetches JWKS until done is closed.
+func (v *jwtVerifier) run(done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(v.refreshInterval):
+		}
+		if err := v.fetchKeys(); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+}
+
+// getKey returns the key with the given id.
+//
+// JWKS is re-fetched for unknown ids, since keys may be rotated
+// before the next scheduled refresh.
+func (v *jwtVerifier) getKey(kid string) (crypto.PublicKey, error) {
+	v.mu.RLock()
+	if len(v.jwksURL) == 0 {
+		kid = ""
+	}
+	key, ok := v.keys[kid]
+	mayRefresh := len(v.jwksURL) > 0 && time.Since(v.lastFetch) > jwksMinRefreshInterval
+	v.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if mayRefresh {
+		if err := v.fetchKeys(); err != nil {
+			return nil, err
+		}
+		v.mu.RLock()
+		key, ok = v.keys[kid]
+		v.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// verify verifies the given token and returns the user name
+// from its claims.
+func (v *jwtVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("cannot parse header: %s", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("cannot decode signature: %s", err)
+	}
+	key, err := v.getKey(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("cannot parse claims: %s", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", fmt.Errorf("token must contain `exp` claim")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(exp), 0)) {
+		return "", fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", fmt.Errorf("token is not valid yet")
+	}
+	if len(v.issuer) > 0 && claims["iss"] != v.issuer {
+		return "", fmt.Errorf("unexpected `iss` claim %q", claims["iss"])
+	}
+	if len(v.audience) > 0 && !hasAudience(claims["aud"], v.audience) {
+		return "", fmt.Errorf("token isn't issued for audience %q", v.audience)
+	}
+	name, ok := claims[v.userClaim].(string)
+	if !ok || len(name) == 0 {
+		return "", fmt.Errorf("token must contain `%s` claim", v.userClaim)
+	}
+	return name, nil
+}
+
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasAudience returns true if `aud` claim contains the given audience.
+//
+// The claim may be either a string or a list of strings.
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature verifies signature of the signed JWT part
+// with the given algorithm and key.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	var h []byte
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256([]byte(signed))
+		h = sum[:]
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		h = sum[:]
+	default:
+		sum := sha512.Sum512([]byte(signed))
+		h = sum[:]
+	}
+
+	switch alg[:2] {
+	case "RS", "PS":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %q requires RSA key", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(k, hash, h, sig)
+		} else {
+			err = rsa.VerifyPSS(k, hash, h, sig, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("algorithm %q requires ECDSA key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, h, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+// getBearerToken returns bearer token from Authorization header of req.
+func getBearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// newTestJWT returns token signed by key with the given kid and claims.
+func newTestJWT(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	enc := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("cannot marshal %v: %s", v, err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := enc(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + enc(claims)
+	h := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:]); err != nil {
+			t.Fatalf("cannot sign token: %s", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, h[:])
+		if err != nil {
+			t.Fatalf("cannot sign token: %s", err)
+		}
+		sig = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(sig[32-len(rb):32], rb)
+		copy(sig[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifier(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	b64 := func(i *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(i.Bytes())
+	}
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"RSA","kid":"rsa","use":"sig","n":%q,"e":%q},
+		{"kty":"EC","kid":"ec","crv":"P-256","x":%q,"y":%q},
+		{"kty":"oct","kid":"hmac","k":"c2VjcmV0"}
+	]}`, b64(rsaKey.N), b64(big.NewInt(int64(rsaKey.E))), b64(ecKey.X), b64(ecKey.Y))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, jwks)
+	}))
+	defer srv.Close()
+
+	v, err := newJWTVerifier(config.JWT{
+		JWKSURL:   srv.URL,
+		Issuer:    "https://sso.example.com",
+		Audience:  "chproxy",
+		UserClaim: "preferred_username",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := v.fetchKeys(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":                "https://sso.example.com",
+			"aud":                []string{"grafana", "chproxy"},
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"preferred_username": "analyst",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+	f := func(token string, expectedErr bool) {
+		t.Helper()
+		name, err := v.verify(token)
+		if expectedErr {
+			if err == nil {
+				t.Fatalf("expecting error for token %q", token)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if name != "analyst" {
+			t.Fatalf("unexpected user name %q; expecting %q", name, "analyst")
+		}
+	}
+
+	f(newTestJWT(t, rsaKey, "rsa", claims(nil)), false)
+	f(newTestJWT(t, ecKey, "ec", claims(nil)), false)
+	f(newTestJWT(t, rsaKey, "ec", claims(nil)), true)
+	f(newTestJWT(t, rsaKey, "unknown", claims(nil)), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": nil})), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": "grafana"})), true)
+	f(newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"preferred_username": ""})), true)
+	f("foo.bar.baz", true)
+
+	// Tampered claims.
+	token := newTestJWT(t, rsaKey, "rsa", claims(nil))
+	other := newTestJWT(t, rsaKey, "rsa", claims(map[string]interface{}{"preferred_username": "admin"}))
+	parts, otherParts := strings.Split(token, "."), strings.Split(other, ".")
+	f(parts[0]+"."+otherParts[1]+"."+parts[2], true)
+
+	// Unsigned token.
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	f(none+"."+parts[1]+".", true)
+}
+
+func TestJWTAuth(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chproxy-jwt")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", keyFile, err)
+	}
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "analyst",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			AllowJWT:  true,
+		},
+		{
+			Name:      "default",
+			Password:  "secret",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	cfg.JWT = config.JWT{
+		KeyFile:   keyFile,
+		UserClaim: "sub",
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(sub string, expectedCode int) {
+		t.Helper()
+		req := httptest.NewRequest("POST", fakeServer.URL, nil)
+		if len(sub) > 0 {
+			token := newTestJWT(t, key, "", map[string]interface{}{
+				"sub": sub,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else {
+			req.SetBasicAuth("analyst", "")
+		}
+		s, code, err := p.getScope(req)
+		if expectedCode != 0 {
+			if err == nil || code != expectedCode {
+				t.Fatalf("expecting error with code %d; got code %d, err %v", expectedCode, code, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if s.user.name != sub {
+			t.Fatalf("unexpected user %q; expected %q", s.user.name, sub)
+		}
+	}
+	f("analyst", 0)
+	f("default", http.StatusUnauthorized)
+	f("unknown", http.StatusUnauthorized)
+
+	// Users without password may authenticate only via JWT.
+	f("", http.StatusUnauthorized)
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// ldapAuthenticator validates user credentials against LDAP server
+// and maps the groups of the LDAP user to chproxy user.
+//
+// It contains a minimal LDAPv3 client supporting only the operations
+// required by chproxy: simple bind, search and StartTLS.
+type ldapAuthenticator struct {
+	addr      string
+	tlsConfig *tls.Config
+	useTLS    bool
+	startTLS  bool
+
+	bindDN       string
+	bindPassword string
+
+	baseDN    string
+	filter    *ldapFilter
+	groupAttr string
+	mappings  []config.LDAPGroupMapping
+
+	timeout time.Duration
+}
+
+// newLDAPAuthenticator returns LDAP authenticator for the given cfg.
+//
+// nil is returned if LDAP isn't configured.
+func newLDAPAuthenticator(cfg config.LDAP) (*ldapAuthenticator, error) {
+	if len(cfg.URL) == 0 {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse `auth.ldap.url` %q: %s", cfg.URL, err)
+	}
+	la := &ldapAuthenticator{
+		addr:         u.Host,
+		useTLS:       u.Scheme == "ldaps",
+		startTLS:     cfg.StartTLS,
+		bindDN:       cfg.BindDN,
+		bindPassword: cfg.BindPassword,
+		baseDN:       cfg.BaseDN,
+		groupAttr:    cfg.GroupAttribute,
+		mappings:     cfg.GroupMappings,
+		timeout:      time.Duration(cfg.Timeout),
+	}
+	if len(u.Port()) == 0 {
+		port := "389"
+		if la.useTLS {
+			port = "636"
+		}
+		la.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if la.useTLS || la.startTLS {
+		la.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		if len(cfg.CAFile) > 0 {
+			pool, err := loadCertPool(cfg.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load `auth.ldap.ca_file`: %s", err)
+			}
+			la.tlsConfig.RootCAs = pool
+		}
+	}
+	if la.filter, err = parseLDAPFilter(cfg.UserFilter); err != nil {
+		return nil, fmt.Errorf("cannot parse `auth.ldap.user_filter` %q: %s", cfg.UserFilter, err)
+	}
+	return la, nil
+}
+
+// LDAP result codes used by chproxy.
+const (
+	ldapSuccess            = 0
+	ldapSizeLimitExceeded  = 4
+	ldapInvalidCredentials = 49
+)
+
+// ldapStartTLSRequestName is the OID of StartTLS extended operation.
+const ldapStartTLSRequestName = "1.3.6.1.4.1.1466.20037"
+
+// resolve returns the name of chproxy user for the LDAP user
+// with the given credentials.
+//
+// Empty name is returned if the credentials are invalid or the user
+// doesn't belong to mapped groups.
+func (la *ldapAuthenticator) resolve(name, password string) (string, error) {
+	if len(name) == 0 || len(password) == 0 {
+		// LDAP servers treat bind with empty password as anonymous bind,
+		// which succeeds for any DN.
+		return "", nil
+	}
+	conn, err := la.dial()
+	if err != nil {
+		return "", err
+	}
+	defer conn.close()
+
+	if len(la.bindDN) > 0 {
+		code, msg, err := conn.bind(la.bindDN, la.bindPassword)
+		if err != nil {
+			return "", err
+		}
+		if code != ldapSuccess {
+			return "", fmt.Errorf("cannot bind as `auth.ldap.bind_dn`: result code %d: %s", code, msg)
+		}
+	}
+	entries, err := conn.search(la.baseDN, la.filter.encode(name), la.groupAttr)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		// Either the user is missing or the filter is ambiguous.
+		return "", nil
+	}
+	e := entries[0]
+	code, msg, err := conn.bind(e.dn, password)
+	if err != nil {
+		return "", err
+	}
+	if code == ldapInvalidCredentials {
+		return "", nil
+	}
+	if code != ldapSuccess {
+		return "", fmt.Errorf("cannot bind as %q: result code %d: %s", e.dn, code, msg)
+	}
+	for _, m := range la.mappings {
+		for _, g := range e.attrs[strings.ToLower(la.groupAttr)] {
+			if equalDN(g, m.Group) {
+				return m.User, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// equalDN returns true if DNs a and b are equal up to letter case
+// and spaces around separators.
+func equalDN(a, b string) bool {
+	return strings.EqualFold(normalizeDN(a), normalizeDN(b))
+}
+
+func normalizeDN(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		kv := strings.SplitN(p, "=", 2)
+		for j := range kv {
+			kv[j] = strings.TrimSpace(kv[j])
+		}
+		parts[i] = strings.Join(kv, "=")
+	}
+	return strings.Join(parts, ",")
+}
+
+type ldapConn struct {
+	net.Conn
+	br    *bufio.Reader
+	msgID int
+}
+
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+func (la *ldapAuthenticator) dial() (*ldapConn, error) {
+	d := &net.Dialer{Timeout: la.timeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if la.useTLS {
+		conn, err = tls.DialWithDialer(d, "tcp", la.addr, la.tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", la.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to LDAP server %q: %s", la.addr, err)
+	}
+	// The deadline limits the whole authentication.
+	if err := conn.SetDeadline(time.Now().Add(la.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	lc := &ldapConn{
+		Conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+	if la.startTLS {
+		if err := lc.startTLS(la.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return lc, nil
+}
+
+// close sends unbind request and closes the connection.
+func (lc *ldapConn) close() {
+	lc.send(berTLV(0x42, nil))
+	lc.Close()
+}
+
+func (lc *ldapConn) startTLS(cfg *tls.Config) error {
+	req := berTLV(0x77, berString(0x80, ldapStartTLSRequestName))
+	if err := lc.send(req); err != nil {
+		return err
+	}
+	code, msg, err := lc.readResult(0x78)
+	if err != nil {
+		return err
+	}
+	if code != ldapSuccess {
+		return fmt.Errorf("cannot start TLS: result code %d: %s", code, msg)
+	}
+	tc := tls.Client(lc.Conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("cannot start TLS: %s", err)
+	}
+	lc.Conn = tc
+	lc.br = bufio.NewReader(tc)
+	return nil
+}
+
+// bind performs simple bind and returns its result code.
+func (lc *ldapConn) bind(dn, password string) (int, string, error) {
+	req := berTLV(0x60, concat(
+		berInt(0x02, 3),
+		berString(0x04, dn),
+		berString(0x80, password),
+	))
+	if err := lc.send(req); err != nil {
+		return 0, "", err
+	}
+	return lc.readResult(0x61)
+}
+
+// search returns entries matching the given filter in the subtree
+// of baseDN. At most two entries are returned, which is enough
+// for detecting ambiguous filters.
+func (lc *ldapConn) search(baseDN string, filter []byte, attrs ...string) ([]ldapEntry, error) {
+	var attrList []byte
+	for _, a := range attrs {
+		attrList = append(attrList, berString(0x04, a)...)
+	}
+	req := berTLV(0x63, concat(
+		berString(0x04, baseDN),
+		berInt(0x0a, 2), // wholeSubtree
+		berInt(0x0a, 0), // neverDerefAliases
+		berInt(0x02, 2), // sizeLimit
+		berInt(0x02, 0), // timeLimit
+		berTLV(0x01, []byte{0}),
+		filter,
+		berTLV(0x30, attrList),
+	))
+	if err := lc.send(req); err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		tag, op, err := lc.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case 0x64:
+			e, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case 0x73:
+			// Skip search result references.
+		case 0x65:
+			code, msg, err := parseLDAPResult(op)
+			if err != nil {
+				return nil, err
+			}
+			if code != ldapSuccess && code != ldapSizeLimitExceeded {
+				return nil, fmt.Errorf("cannot search LDAP users: result code %d: %s", code, msg)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response with tag 0x%x", tag)
+		}
+	}
+}
+
+func (lc *ldapConn) send(op []byte) error {
+	lc.msgID++
+	msg := berTLV(0x30, concat(berInt(0x02, lc.msgID), op))
+	if _, err := lc.Write(msg); err != nil {
+		return fmt.Errorf("cannot send request to LDAP server: %s", err)
+	}
+	return nil
+}
+
+// readMessage reads the response to the last request and returns
+// its protocol operation.
+func (lc *ldapConn) readMessage() (byte, []byte, error) {
+	for {
+		tag, msg, err := readBER(lc.br)
+		if err != nil {
+			return 0, nil, fmt.Errorf("cannot read response from LDAP server: %s", err)
+		}
+		if tag != 0x30 {
+			return 0, nil, fmt.Errorf("unexpected LDAP message tag 0x%x", tag)
+		}
+		_, id, msg, err := parseBER(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		opTag, op, _, err := parseBER(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		if berToInt(id) != lc.msgID {
+			// Unsolicited notifications have zero id.
+			if berToInt(id) == 0 {
+				_, msg, _ := parseLDAPResult(op)
+				return 0, nil, fmt.Errorf("LDAP server closed the connection: %s", msg)
+			}
+			continue
+		}
+		return opTag, op, nil
+	}
+}
+
+func (lc *ldapConn) readResult(expectedTag byte) (int, string, error) {
+	tag, op, err := lc.readMessage()
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != expectedTag {
+		return 0, "", fmt.Errorf("unexpected LDAP response with tag 0x%x; expecting 0x%x", tag, expectedTag)
+	}
+	return parseLDAPResult(op)
+}
+
+// parseLDAPResult parses LDAPResult and returns its result code
+// with diagnostic message.
+func parseLDAPResult(b []byte) (int, string, error) {
+	_, code, b, err := parseBER(b)
+	if err != nil {
+		return 0, "", err
+	}
+	// Skip matchedDN.
+	_, _, b, err = parseBER(b)
+	if err != nil {
+		return 0, "", err
+	}
+	_, msg, _, err := parseBER(b)
+	if err != nil {
+		return 0, "", err
+	}
+	return berToInt(code), string(msg), nil
+}
+
+func parseLDAPEntry(b []byte) (ldapEntry, error) {
+	_, dn, b, err := parseBER(b)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	e := ldapEntry{
+		dn:    string(dn),
+		attrs: make(map[string][]string),
+	}
+	_, attrs, _, err := parseBER(b)
+	if err != nil {
+		return e, err
+	}
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = parseBER(attrs); err != nil {
+			return e, err
+		}
+		_, typ, vals, err := parseBER(attr)
+		if err != nil {
+			return e, err
+		}
+		if _, vals, _, err = parseBER(vals); err != nil {
+			return e, err
+		}
+		name := strings.ToLower(string(typ))
+		for len(vals) > 0 {
+			var v []byte
+			if _, v, vals, err = parseBER(vals); err != nil {
+				return e, err
+			}
+			e.attrs[name] = append(e.attrs[name], string(v))
+		}
+	}
+	return e, nil
+}
+
+// ldapFilter is a parsed search filter.
+//
+// Only `&`, `|`, `!`, equality and presence filters are supported.
+type ldapFilter struct {
+	op       byte
+	attr     string
+	value    string
+	children []*ldapFilter
+}
+
+// parseLDAPFilter parses filter in the string representation from RFC 4515.
+func parseLDAPFilter(s string) (*ldapFilter, error) {
+	f, rest, err := parseLDAPFilterPrefix(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected tail %q", rest)
+	}
+	return f, nil
+}
+
+func parseLDAPFilterPrefix(s string) (*ldapFilter, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, s, fmt.Errorf("missing `(` at %q", s)
+	}
+	s = s[1:]
+	f := &ldapFilter{op: s[0]}
+	switch f.op {
+	case '&', '|', '!':
+		s = s[1:]
+		for len(s) > 0 && s[0] == '(' {
+			child, rest, err := parseLDAPFilterPrefix(s)
+			if err != nil {
+				return nil, s, err
+			}
+			f.children = append(f.children, child)
+			s = rest
+		}
+		if len(f.children) == 0 || (f.op == '!' && len(f.children) > 1) {
+			return nil, s, fmt.Errorf("invalid number of operands for %q", f.op)
+		}
+	default:
+		n := strings.IndexByte(s, ')')
+		if n < 0 {
+			return nil, s, fmt.Errorf("missing `)` at %q", s)
+		}
+		item := s[:n]
+		s = s[n:]
+		n = strings.IndexByte(item, '=')
+		if n <= 0 {
+			return nil, s, fmt.Errorf("missing attribute in %q", item)
+		}
+		f.op = '='
+		f.attr = item[:n]
+		value := item[n+1:]
+		if strings.ContainsAny(f.attr, "~<>:") {
+			return nil, s, fmt.Errorf("unsupported filter %q", item)
+		}
+		if value == "*" {
+			f.op = '*'
+			break
+		}
+		if strings.Contains(value, "*") {
+			return nil, s, fmt.Errorf("substring filters aren't supported: %q", item)
+		}
+		v, err := unescapeLDAPValue(value)
+		if err != nil {
+			return nil, s, err
+		}
+		f.value = v
+	}
+	if len(s) == 0 || s[0] != ')' {
+		return nil, s, fmt.Errorf("missing `)` at %q", s)
+	}
+	return f, s[1:], nil
+}
+
+// unescapeLDAPValue decodes `\XX` escapes in filter value.
+func unescapeLDAPValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		b = append(b, c...)
+		i += 2
+	}
+	return string(b), nil
+}
+
+// encode returns BER encoding of f with `{username}` substituted
+// by the given name.
+//
+// The name is substituted into the encoded values, so it cannot
+// alter the filter structure.
+func (f *ldapFilter) encode(name string) []byte {
+	switch f.op {
+	case '&', '|', '!':
+		var b []byte
+		for _, c := range f.children {
+			b = append(b, c.encode(name)...)
+		}
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[f.op]
+		return berTLV(tag, b)
+	case '*':
+		return berString(0x87, f.attr)
+	default:
+		v := strings.Replace(f.value, "{username}", name, -1)
+		return berTLV(0xa3, concat(berString(0x04, f.attr), berString(0x04, v)))
+	}
+}
+
+// berTLV returns BER encoding of the element with the given tag
+// and content.
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	n := len(content)
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+// berInt returns BER encoding of non-negative integer n.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n > 0x7f {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return berTLV(tag, b)
+}
+
+func berToInt(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
+
+func concat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// maxLDAPMessageSize limits the size of messages from LDAP server.
+const maxLDAPMessageSize = 1 << 20
+
+// parseBER parses the first element in b and returns its tag,
+// content and the remaining bytes.
+func parseBER(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+	tag, n := b[0], int(b[1])
+	b = b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, fmt.Errorf("invalid BER length")
+		}
+		n = berToInt(b[:size])
+		b = b[size:]
+	}
+	if n > len(b) {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+	return tag, b[:n], b[n:], nil
+}
+
+// readBER reads a single BER element from r.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, fmt.Errorf("invalid BER length")
+		}
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, nil, err
+		}
+		n = berToInt(buf)
+	}
+	if n > maxLDAPMessageSize {
+		return 0, nil, fmt.Errorf("too big LDAP message: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], b, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// fakeLDAPUser is an entry served by fakeLDAPServer.
+type fakeLDAPUser struct {
+	dn       string
+	password string
+	groups   []string
+}
+
+// startFakeLDAPServer starts LDAP server authenticating the given users
+// found by `uid` and returns its address.
+func startFakeLDAPServer(t *testing.T, users map[string]fakeLDAPUser) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeLDAP(conn, users)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveFakeLDAP(conn net.Conn, users map[string]fakeLDAPUser) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for {
+		_, msg, err := readBER(br)
+		if err != nil {
+			return
+		}
+		_, id, msg, _ := parseBER(msg)
+		tag, op, _, _ := parseBER(msg)
+		reply := func(tag byte, content []byte) {
+			conn.Write(berTLV(0x30, concat(berTLV(0x02, id), berTLV(tag, content))))
+		}
+		result := func(code int) []byte {
+			return concat(berInt(0x0a, code), berString(0x04, ""), berString(0x04, ""))
+		}
+		switch tag {
+		case 0x42:
+			return
+		case 0x60:
+			_, _, op, _ = parseBER(op)
+			_, dn, op, _ := parseBER(op)
+			_, password, _, _ := parseBER(op)
+			code := ldapInvalidCredentials
+			if string(dn) == "cn=admin,dc=example,dc=com" && string(password) == "admin" {
+				code = ldapSuccess
+			}
+			for _, u := range users {
+				if u.dn == string(dn) && u.password == string(password) {
+					code = ldapSuccess
+				}
+			}
+			reply(0x61, result(code))
+		case 0x63:
+			for i := 0; i < 6; i++ {
+				_, _, op, _ = parseBER(op)
+			}
+			_, filter, _, _ := parseBER(op)
+			if u, ok := users[findFakeLDAPUID(filter)]; ok {
+				var groups []byte
+				for _, g := range u.groups {
+					groups = append(groups, berString(0x04, g)...)
+				}
+				attr := berTLV(0x30, concat(berString(0x04, "memberOf"), berTLV(0x31, groups)))
+				reply(0x64, concat(berString(0x04, u.dn), berTLV(0x30, attr)))
+			}
+			reply(0x65, result(ldapSuccess))
+		}
+	}
+}
+
+// findFakeLDAPUID returns the value of `uid` equality match in filter.
+func findFakeLDAPUID(filter []byte) string {
+	for len(filter) > 0 {
+		tag, content, rest, err := parseBER(filter)
+		if err != nil {
+			return ""
+		}
+		filter = rest
+		switch tag {
+		case 0xa0, 0xa1:
+			if uid := findFakeLDAPUID(content); len(uid) > 0 {
+				return uid
+			}
+		case 0xa3:
+			_, attr, content, _ := parseBER(content)
+			_, value, _, _ := parseBER(content)
+			if string(attr) == "uid" {
+				return string(value)
+			}
+		}
+	}
+	return ""
+}
+
+func TestParseLDAPFilter(t *testing.T) {
+	f := func(s string, expectedErr bool) {
+		t.Helper()
+		_, err := parseLDAPFilter(s)
+		if expectedErr && err == nil {
+			t.Fatalf("expecting error for %q", s)
+		}
+		if !expectedErr && err != nil {
+			t.Fatalf("unexpected error for %q: %s", s, err)
+		}
+	}
+	f("(uid={username})", false)
+	f("(&(objectClass=person)(sAMAccountName={username}))", false)
+	f("(&(|(objectClass=person)(objectClass=user))(!(disabled=*))(cn={username}))", false)
+	f(`(cn=John \28Doe\29)`, false)
+	f("uid={username}", true)
+	f("(uid={username}", true)
+	f("(uid={username}))", true)
+	f("(uid=a*)", true)
+	f("(uid~=a)", true)
+	f("(!(a=b)(c=d))", true)
+	f("(&)", true)
+	f(`(cn=\2)`, true)
+
+	// The user name must not alter the filter structure.
+	flt, err := parseLDAPFilter("(&(objectClass=person)(uid={username}))")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if uid := findFakeLDAPUID(flt.encode("*)(uid=admin")); uid != "*)(uid=admin" {
+		t.Fatalf("unexpected uid in filter: %q", uid)
+	}
+}
+
+func TestLDAPAuth(t *testing.T) {
+	addr := startFakeLDAPServer(t, map[string]fakeLDAPUser{
+		"alice": {
+			dn:       "uid=alice,ou=people,dc=example,dc=com",
+			password: "alice-secret",
+			groups:   []string{"cn=staff,ou=groups,dc=example,dc=com", "cn=Analysts, ou=groups, dc=example, dc=com"},
+		},
+		"bob": {
+			dn:       "uid=bob,ou=people,dc=example,dc=com",
+			password: "bob-secret",
+			groups:   []string{"cn=staff,ou=groups,dc=example,dc=com"},
+		},
+	})
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}, {Name: "readonly"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "analysts",
+			ToCluster: "cluster",
+			ToUser:    "readonly",
+		},
+		{
+			Name:      "default",
+			Password:  "secret",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	cfg.Auth.LDAP = config.LDAP{
+		URL:            "ldap://" + addr,
+		BindDN:         "cn=admin,dc=example,dc=com",
+		BindPassword:   "admin",
+		BaseDN:         "dc=example,dc=com",
+		UserFilter:     "(&(objectClass=person)(uid={username}))",
+		GroupAttribute: "memberOf",
+		GroupMappings: []config.LDAPGroupMapping{
+			{Group: "cn=analysts,ou=groups,dc=example,dc=com", User: "analysts"},
+		},
+		Timeout: config.Duration(time.Second),
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(name, password, expectedUser string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", fakeServer.URL, nil)
+		req.SetBasicAuth(name, password)
+		s, code, err := p.getScope(req)
+		if len(expectedUser) == 0 {
+			if err == nil || code != http.StatusUnauthorized {
+				t.Fatalf("expecting unauthorized error for %q; got code %d, err %v", name, code, err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", name, err)
+		}
+		if s.user.name != expectedUser {
+			t.Fatalf("unexpected user %q for %q; expecting %q", s.user.name, name, expectedUser)
+		}
+		if s.clusterUser.name != "readonly" && expectedUser == "analysts" {
+			t.Fatalf("unexpected cluster user %q for %q", s.clusterUser.name, name)
+		}
+	}
+	f("alice", "alice-secret", "analysts")
+	f("alice", "wrong", "")
+	f("alice", "", "")
+	f("bob", "bob-secret", "")
+	f("carol", "carol-secret", "")
+	f("default", "secret", "default")
+
+	// Mapped users without password may be accessed only via LDAP.
+	f("analysts", "", "")
+}
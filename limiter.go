@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// requestLimiter limits the number of concurrently proxied requests
+// on the server level.
+//
+// Excess requests may wait in the bounded queue for their chance
+// to be proxied.
+type requestLimiter struct {
+	sem          chan struct{}
+	queueCh      chan struct{}
+	maxQueueTime time.Duration
+}
+
+// newRequestLimiter returns limiter for the given cfg.
+//
+// nil is returned if concurrency limit isn't configured.
+func newRequestLimiter(cfg config.Server) *requestLimiter {
+	if cfg.MaxConcurrentRequests == 0 {
+		return nil
+	}
+	rl := &requestLimiter{
+		sem:          make(chan struct{}, cfg.MaxConcurrentRequests),
+		maxQueueTime: time.Duration(cfg.MaxQueueTime),
+	}
+	if cfg.MaxQueueSize > 0 {
+		rl.queueCh = make(chan struct{}, cfg.MaxQueueSize)
+	}
+	if rl.maxQueueTime <= 0 {
+		rl.maxQueueTime = 10 * time.Second
+	}
+	return rl
+}
+
+// reuseRequestLimiter returns prev if it has the same limits as rl.
+//
+// This keeps slots of in-flight requests accounted across config
+// reloads, since requests release slots into the limiter they
+// acquired them from.
+func reuseRequestLimiter(prev, rl *requestLimiter) *requestLimiter {
+	if prev == nil || rl == nil {
+		return rl
+	}
+	if cap(prev.sem) != cap(rl.sem) || cap(prev.queueCh) != cap(rl.queueCh) || prev.maxQueueTime != rl.maxQueueTime {
+		return rl
+	}
+	return prev
+}
+
+// acquire reserves a slot for the request.
+//
+// release must be called after the request is proxied
+// if acquire returns nil.
+func (rl *requestLimiter) acquire(ctx context.Context) error {
+	select {
+	case rl.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	limit := cap(rl.sem)
+	if rl.queueCh == nil {
+		return fmt.Errorf("limits for server concurrent requests exceeded: %d", limit)
+	}
+	if err := checkMemoryUsage(); err != nil {
+		return err
+	}
+	select {
+	case rl.queueCh <- struct{}{}:
+		defer func() {
+			<-rl.queueCh
+		}()
+	default:
+		return fmt.Errorf("server request queue is full: %d", cap(rl.queueCh))
+	}
+
+	t := time.NewTimer(rl.maxQueueTime)
+	defer t.Stop()
+	select {
+	case rl.sem <- struct{}{}:
+		return nil
+	case <-t.C:
+		return fmt.Errorf("limits for server concurrent requests exceeded: %d; request waited in the queue for %s", limit, rl.maxQueueTime)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the slot reserved by acquire.
+func (rl *requestLimiter) release() {
+	<-rl.sem
+}
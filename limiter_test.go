@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestRequestLimiterDisabled(t *testing.T) {
+	if rl := newRequestLimiter(config.Server{}); rl != nil {
+		t.Fatalf("expected nil limiter for empty config")
+	}
+}
+
+func TestRequestLimiterNoQueue(t *testing.T) {
+	rl := newRequestLimiter(config.Server{MaxConcurrentRequests: 1})
+	ctx := context.Background()
+	if err := rl.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := rl.acquire(ctx); err == nil {
+		t.Fatalf("expected error when concurrency limit is exceeded")
+	}
+	rl.release()
+	if err := rl.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	rl.release()
+}
+
+func TestRequestLimiterQueue(t *testing.T) {
+	rl := newRequestLimiter(config.Server{
+		MaxConcurrentRequests: 1,
+		MaxQueueSize:          1,
+		MaxQueueTime:          config.Duration(time.Second),
+	})
+	ctx := context.Background()
+	if err := rl.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- rl.acquire(ctx)
+	}()
+	// wait until the request gets into the queue
+	for len(rl.queueCh) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := rl.acquire(ctx); err == nil {
+		t.Fatalf("expected error when the queue is full")
+	}
+
+	rl.release()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error for queued request: %s", err)
+	}
+	rl.release()
+}
+
+func TestRequestLimiterQueueTimeout(t *testing.T) {
+	rl := newRequestLimiter(config.Server{
+		MaxConcurrentRequests: 1,
+		MaxQueueSize:          1,
+		MaxQueueTime:          config.Duration(50 * time.Millisecond),
+	})
+	ctx := context.Background()
+	if err := rl.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer rl.release()
+
+	start := time.Now()
+	if err := rl.acquire(ctx); err == nil {
+		t.Fatalf("expected error when the request waits in the queue for too long")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("request left the queue too early: %s", d)
+	}
+}
+
+func TestReuseRequestLimiter(t *testing.T) {
+	cfg := config.Server{MaxConcurrentRequests: 1, MaxQueueSize: 2}
+	prev := newRequestLimiter(cfg)
+	if rl := reuseRequestLimiter(prev, newRequestLimiter(cfg)); rl != prev {
+		t.Fatalf("limiter with unchanged limits must be reused")
+	}
+	cfg.MaxQueueSize = 3
+	if rl := reuseRequestLimiter(prev, newRequestLimiter(cfg)); rl == prev {
+		t.Fatalf("limiter with changed limits mustn't be reused")
+	}
+	if rl := reuseRequestLimiter(prev, nil); rl != nil {
+		t.Fatalf("expected nil limiter for disabled limits")
+	}
+}
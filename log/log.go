@@ -5,7 +5,11 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"runtime"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var (
@@ -35,6 +39,52 @@ func SuppressOutput(suppress bool) {
 	}
 }
 
+var (
+	// outputFileLock protects outputFile and outputFilePath.
+	outputFileLock sync.Mutex
+	outputFile     *os.File
+	outputFilePath string
+)
+
+// SetOutputFile redirects all the log output into the file at the given path.
+func SetOutputFile(path string) error {
+	outputFileLock.Lock()
+	defer outputFileLock.Unlock()
+	outputFilePath = path
+	return reopenOutputFile()
+}
+
+// ReopenOutputFile reopens the file passed to SetOutputFile,
+// so logs are written into a new file after external log rotation.
+//
+// It does nothing if logs aren't written into a file.
+func ReopenOutputFile() error {
+	outputFileLock.Lock()
+	defer outputFileLock.Unlock()
+	if len(outputFilePath) == 0 {
+		return nil
+	}
+	return reopenOutputFile()
+}
+
+// outputFileLock must be held by the caller.
+func reopenOutputFile() error {
+	f, err := os.OpenFile(outputFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open log file %q: %s", outputFilePath, err)
+	}
+	debugLogger.SetOutput(f)
+	infoLogger.SetOutput(f)
+	errorLogger.SetOutput(f)
+	fatalLogger.SetOutput(f)
+	if outputFile != nil {
+		// Loggers don't write into the old file after SetOutput returns.
+		outputFile.Close()
+	}
+	outputFile = f
+	return nil
+}
+
 var debug uint32
 
 // SetDebug sets output into debug mode if true passed
@@ -64,15 +114,157 @@ func Infof(format string, args ...interface{}) {
 // Errorf prints warning message according to a format
 func Errorf(format string, args ...interface{}) {
 	s := fmt.Sprintf(format, args...)
+	if !allowError(outputCallDepth, s) {
+		return
+	}
 	errorLogger.Output(outputCallDepth, s)
 }
 
 // ErrorWithCallDepth prints err into error log using the given callDepth.
 func ErrorWithCallDepth(err error, callDepth int) {
 	s := err.Error()
+	if !allowError(outputCallDepth+callDepth, s) {
+		return
+	}
 	errorLogger.Output(outputCallDepth+callDepth, s)
 }
 
+// errorSampler limits the number of error messages per error class,
+// so repetitive errors don't drown real anomalies and don't fill disks
+// during outages.
+//
+// Error class is the place in the code where the error is logged.
+// Suppressed messages are summarized at the end of each interval.
+type errorSampler struct {
+	burst    int
+	interval time.Duration
+
+	// mu protects classes.
+	mu      sync.Mutex
+	classes map[string]*errorClass
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+type errorClass struct {
+	logged     int
+	suppressed int
+	last       string
+}
+
+var (
+	samplerLock sync.Mutex
+	sampler     atomic.Value
+)
+
+func init() {
+	sampler.Store((*errorSampler)(nil))
+}
+
+// SetErrorSampling limits the number of logged errors per error class
+// to burst during the given interval. Suppressed errors are summarized
+// at the end of each interval.
+//
+// Sampling is disabled if burst is zero.
+func SetErrorSampling(burst int, interval time.Duration) {
+	samplerLock.Lock()
+	defer samplerLock.Unlock()
+
+	if es := sampler.Load().(*errorSampler); es != nil {
+		if es.burst == burst && es.interval == interval {
+			return
+		}
+		es.stop()
+	}
+	if burst <= 0 {
+		sampler.Store((*errorSampler)(nil))
+		return
+	}
+	es := &errorSampler{
+		burst:    burst,
+		interval: interval,
+		classes:  make(map[string]*errorClass),
+		stopCh:   make(chan struct{}),
+	}
+	es.wg.Add(1)
+	go func() {
+		defer es.wg.Done()
+		es.run()
+	}()
+	sampler.Store(es)
+}
+
+// allowError returns true if the error message s logged at the given
+// callDepth must be printed.
+func allowError(callDepth int, s string) bool {
+	es := sampler.Load().(*errorSampler)
+	if es == nil {
+		return true
+	}
+	_, file, line, ok := runtime.Caller(callDepth)
+	if !ok {
+		return true
+	}
+	key := fmt.Sprintf("%s:%d", file, line)
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	c := es.classes[key]
+	if c == nil {
+		c = &errorClass{}
+		es.classes[key] = c
+	}
+	if c.logged < es.burst {
+		c.logged++
+		return true
+	}
+	c.suppressed++
+	c.last = s
+	return false
+}
+
+func (es *errorSampler) run() {
+	t := time.NewTicker(es.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			es.flush()
+		case <-es.stopCh:
+			es.flush()
+			return
+		}
+	}
+}
+
+func (es *errorSampler) stop() {
+	close(es.stopCh)
+	es.wg.Wait()
+}
+
+// flush prints summaries for suppressed errors and starts new interval.
+func (es *errorSampler) flush() {
+	es.mu.Lock()
+	classes := es.classes
+	es.classes = make(map[string]*errorClass, len(classes))
+	es.mu.Unlock()
+
+	keys := make([]string, 0, len(classes))
+	for key, c := range classes {
+		if c.suppressed > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := classes[key]
+		s := fmt.Sprintf("%d similar errors logged at %s were suppressed during the last %s; the last one: %s",
+			c.suppressed, key, es.interval, c.last)
+		errorLogger.Output(1, s)
+	}
+}
+
 // Fatalf prints fatal message according to a format and exits program
 func Fatalf(format string, args ...interface{}) {
 	s := fmt.Sprintf(format, args...)
@@ -0,0 +1,89 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorSampling(t *testing.T) {
+	var buf bytes.Buffer
+	errorLogger.SetOutput(&buf)
+	defer SuppressOutput(false)
+
+	SetErrorSampling(2, time.Hour)
+	defer SetErrorSampling(0, 0)
+
+	for i := 0; i < 5; i++ {
+		Errorf("repetitive error %d", i)
+	}
+	Errorf("another error")
+	if n := strings.Count(buf.String(), "repetitive error"); n != 2 {
+		t.Fatalf("unexpected number of logged errors: %d; expecting 2; log:\n%s", n, buf.String())
+	}
+	if !strings.Contains(buf.String(), "another error") {
+		t.Fatalf("errors logged at other places must not be suppressed; log:\n%s", buf.String())
+	}
+
+	// Stopping the sampler must flush the summary.
+	buf.Reset()
+	SetErrorSampling(0, 0)
+	summary := buf.String()
+	if !strings.Contains(summary, "3 similar errors logged at") {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+	if !strings.Contains(summary, "the last one: repetitive error 4") {
+		t.Fatalf("summary must contain the last suppressed error: %q", summary)
+	}
+
+	buf.Reset()
+	for i := 0; i < 5; i++ {
+		ErrorWithCallDepth(fmt.Errorf("unsampled error"), 0)
+	}
+	if n := strings.Count(buf.String(), "unsampled error"); n != 5 {
+		t.Fatalf("all the errors must be logged without sampling; got %d", n)
+	}
+}
+
+func TestReopenOutputFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-log")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer SuppressOutput(false)
+
+	path := filepath.Join(dir, "chproxy.log")
+	if err := SetOutputFile(path); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	Infof("before rotation")
+
+	// Emulate logrotate.
+	rotated := path + ".1"
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ReopenOutputFile(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	Infof("after rotation")
+
+	f := func(path, expected string) {
+		t.Helper()
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if n := strings.Count(string(data), "INFO:"); n != 1 || !strings.Contains(string(data), expected) {
+			t.Fatalf("unexpected contents of %q: %q; expecting a single %q message", path, data, expected)
+		}
+	}
+	f(rotated, "before rotation")
+	f(path, "after rotation")
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -21,25 +24,98 @@ import (
 )
 
 var (
-	configFile = flag.String("config", "", "Proxy configuration filename")
+	configFile = flag.String("config", "", "Proxy configuration filename or http(s) URL")
 	version    = flag.Bool("version", false, "Prints current version and exits")
+	logFile    = flag.String("logFile", "", "Optional file for logs. Logs are written to stderr by default. "+
+		"The file is reopened on SIGUSR2, so it may be rotated by external tools")
+	pidFile  = flag.String("pidFile", "", "Optional file for writing the process id, so signals may be sent by external tools")
+	validate = flag.Bool("validate", false, "Validates the config from -config flag and exits. "+
+		"The exit code is non-zero if the config is invalid")
 )
 
 var (
 	proxy = newReverseProxy()
 
+	// configs of http listeners
+	httpListeners atomic.Value
+
 	// networks allow lists
-	allowedNetworksHTTP    atomic.Value
 	allowedNetworksHTTPS   atomic.Value
 	allowedNetworksMetrics atomic.Value
+
+	// networks of proxies trusted to pass client addresses
+	trustedProxies atomic.Value
+
+	// server-level concurrency limiter
+	serverLimiter atomic.Value
+
+	// headers added to responses of https listener
+	securityHeaders atomic.Value
+)
+
+var (
+	// configLock serializes config reloads
+	configLock sync.Mutex
+
+	// lastConfigContent is the last loaded config content.
+	// It is guarded by configLock
+	lastConfigContent []byte
+
+	// runningConfig is the config applied on startup or the last reload.
+	// It is guarded by configLock
+	runningConfig *config.Config
+
+	// configAppliedTime is the time when runningConfig has been applied.
+	// It is guarded by configLock
+	configAppliedTime time.Time
+
+	// lastReloadTime and lastReloadErr describe the last reload attempt.
+	// They are guarded by configLock
+	lastReloadTime time.Time
+	lastReloadErr  error
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			if err := runReplay(os.Args[2:]); err != nil {
+				log.Fatalf("error while replaying requests: %s", err)
+			}
+			return
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				log.Fatalf("error while running benchmark: %s", err)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 	if *version {
 		fmt.Printf("%s\n", versionString())
 		os.Exit(0)
 	}
+	if *validate {
+		if err := validateConfigFile(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("config %q is valid\n", *configFile)
+		os.Exit(0)
+	}
+
+	if len(*logFile) > 0 {
+		if err := log.SetOutputFile(*logFile); err != nil {
+			log.Fatalf("%s", err)
+		}
+	}
+	if len(*pidFile) > 0 {
+		pid := fmt.Sprintf("%d\n", os.Getpid())
+		if err := ioutil.WriteFile(*pidFile, []byte(pid), 0644); err != nil {
+			log.Fatalf("cannot write pid file %q: %s", *pidFile, err)
+		}
+	}
 
 	log.Infof("%s", versionString())
 	log.Infof("Loading config: %s", *configFile)
@@ -47,13 +123,27 @@ func main() {
 	if err != nil {
 		log.Fatalf("error while loading config: %s", err)
 	}
+	if len(cfg.SPIFFE.CertFile) > 0 {
+		if svidSrc, err = newSVIDSource(cfg.SPIFFE); err != nil {
+			log.Fatalf("error while loading SPIFFE SVID: %s", err)
+		}
+	}
 	if err = applyConfig(cfg); err != nil {
 		log.Fatalf("error while applying config: %s", err)
 	}
+	runningConfig = cfg
+	configAppliedTime = time.Now()
 	log.Infof("Loading config %q: successful", *configFile)
+	src, srcCfg, err := newConfigSource(*configFile)
+	if err != nil {
+		log.Fatalf("error while loading config source: %s", err)
+	}
+	if srcCfg != nil && srcCfg.PollInterval > 0 {
+		go watchConfigSource(src, srcCfg)
+	}
 
 	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for {
 			switch <-c {
@@ -64,14 +154,44 @@ func main() {
 					continue
 				}
 				log.Infof("Reloading config %s: successful", *configFile)
+			case syscall.SIGUSR2:
+				log.Infof("SIGUSR2 received. Going to reopen log files ...")
+				if err := reopenLogFiles(); err != nil {
+					log.Errorf("error while reopening log files: %s", err)
+					continue
+				}
+				log.Infof("Reopening log files: successful")
+			case syscall.SIGUSR1:
+				log.Infof("SIGUSR1 received. Going to start the new process ...")
+				if err := upgrade(); err != nil {
+					log.Errorf("error while starting the new process: %s", err)
+					continue
+				}
+				log.Infof("Waiting for in-flight requests before exit ...")
+				shutdownServers()
+				log.Infof("Exiting after upgrade")
+				os.Exit(0)
 			}
 		}
 	}()
 
+	go monitorMemory(time.Second)
+
+	if len(cfg.Profiling.Dir) > 0 || len(cfg.Profiling.PushURL) > 0 {
+		go newProfiler(cfg.Profiling).run()
+	}
+
 	server := cfg.Server
 	if len(server.HTTP.ListenAddr) == 0 && len(server.HTTPS.ListenAddr) == 0 {
 		panic("BUG: broken config validation - `listen_addr` is not configured")
 	}
+	addrs := []string{server.HTTPS.ListenAddr, server.Admin.ListenAddr}
+	for _, l := range server.HTTP.AllListeners() {
+		addrs = append(addrs, l.ListenAddr)
+	}
+	if err := inheritListeners(addrs...); err != nil {
+		log.Fatalf("error while inheriting listeners: %s", err)
+	}
 
 	if server.HTTP.ForceAutocertHandler {
 		autocertManager = newAutocertManager(server.HTTPS.Autocert)
@@ -79,8 +199,13 @@ func main() {
 	if len(server.HTTPS.ListenAddr) != 0 {
 		go serveTLS(server.HTTPS)
 	}
-	if len(server.HTTP.ListenAddr) != 0 {
-		go serve(server.HTTP)
+	for i, l := range server.HTTP.AllListeners() {
+		if len(l.ListenAddr) != 0 {
+			go serve(i, l)
+		}
+	}
+	if len(server.Admin.ListenAddr) != 0 {
+		go serveAdminListener(server.Admin)
 	}
 
 	select {}
@@ -115,7 +240,7 @@ func newAutocertManager(cfg config.Autocert) *autocert.Manager {
 }
 
 func newListener(listenAddr string) net.Listener {
-	ln, err := net.Listen("tcp4", listenAddr)
+	ln, err := getListener(listenAddr)
 	if err != nil {
 		log.Fatalf("cannot listen for %q: %s", listenAddr, err)
 	}
@@ -127,16 +252,23 @@ func serveTLS(cfg config.HTTPS) {
 	h := http.HandlerFunc(serveHTTP)
 	tlsCfg := newTLSConfig(cfg)
 	tln := tls.NewListener(ln, tlsCfg)
+	s := newServer(h, cfg.TimeoutCfg)
+	if cfg.HTTP2 {
+		// Let the server configure HTTP/2 for connections negotiated
+		// via ALPN in tlsCfg.
+		s.TLSNextProto = nil
+	}
 	log.Infof("Serving https on %q", cfg.ListenAddr)
-	if err := listenAndServe(tln, h, cfg.TimeoutCfg); err != nil {
+	if err := runServer(s, tln); err != nil {
 		log.Fatalf("TLS server error on %q: %s", cfg.ListenAddr, err)
 	}
 }
 
-func serve(cfg config.HTTP) {
+// serve serves the http listener with the index i in `server.http` list.
+func serve(i int, cfg config.HTTP) {
 	var h http.Handler
 	ln := newListener(cfg.ListenAddr)
-	h = http.HandlerFunc(serveHTTP)
+	h = newListenerHandler(i)
 	if cfg.ForceAutocertHandler {
 		if autocertManager == nil {
 			panic("BUG: autocertManager is not inited")
@@ -149,12 +281,46 @@ func serve(cfg config.HTTP) {
 		}
 		h = autocertManager.HTTPHandler(h)
 	}
-	log.Infof("Serving http on %q", cfg.ListenAddr)
-	if err := listenAndServe(ln, h, cfg.TimeoutCfg); err != nil {
+	s := newServer(h, cfg.TimeoutCfg)
+	if cfg.H2C {
+		if err := enableH2C(s); err != nil {
+			log.Fatalf("cannot enable `h2c` on %q: %s", cfg.ListenAddr, err)
+		}
+	}
+	if len(cfg.Name) > 0 {
+		log.Infof("Serving http listener %q on %q", cfg.Name, cfg.ListenAddr)
+	} else {
+		log.Infof("Serving http on %q", cfg.ListenAddr)
+	}
+	if err := runServer(s, ln); err != nil {
 		log.Fatalf("HTTP server error on %q: %s", cfg.ListenAddr, err)
 	}
 }
 
+type listenerContextKey struct{}
+
+// newListenerHandler returns handler for the http listener with the index i.
+//
+// The handler passes the current config of the listener to serveHTTP
+// via request context, so the listener config may be changed on reload.
+func newListenerHandler(i int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if listeners, _ := httpListeners.Load().([]config.HTTP); i < len(listeners) {
+			ctx := context.WithValue(r.Context(), listenerContextKey{}, &listeners[i])
+			r = r.WithContext(ctx)
+		}
+		serveHTTP(rw, r)
+	})
+}
+
+// getListenerConfig returns config of the http listener, which accepted req.
+//
+// nil is returned for requests accepted outside of http listeners.
+func getListenerConfig(req *http.Request) *config.HTTP {
+	l, _ := req.Context().Value(listenerContextKey{}).(*config.HTTP)
+	return l
+}
+
 func newTLSConfig(cfg config.HTTPS) *tls.Config {
 	tlsCfg := tls.Config{
 		PreferServerCipherSuites: true,
@@ -163,24 +329,72 @@ func newTLSConfig(cfg config.HTTPS) *tls.Config {
 			tls.X25519,
 		},
 	}
-	if len(cfg.KeyFile) > 0 && len(cfg.CertFile) > 0 {
+	switch {
+	case cfg.SPIFFE:
+		if svidSrc == nil {
+			panic("BUG: svidSrc is not inited")
+		}
+		tlsCfg.GetCertificate = svidSrc.getCertificate
+		// Client SVIDs are optional, since clients may authorize
+		// via credentials as usual.
+		tlsCfg.ClientAuth = tls.RequestClientCert
+		tlsCfg.VerifyPeerCertificate = svidSrc.verifyPeerCertificate
+	case len(cfg.KeyFile) > 0 && len(cfg.CertFile) > 0:
 		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 		if err != nil {
 			log.Fatalf("cannot load cert for `https.cert_file`=%q, `https.key_file`=%q: %s",
 				cfg.CertFile, cfg.KeyFile, err)
 		}
 		tlsCfg.Certificates = []tls.Certificate{cert}
-	} else {
+	default:
 		if autocertManager == nil {
 			panic("BUG: autocertManager is not inited")
 		}
 		tlsCfg.GetCertificate = autocertManager.GetCertificate
 	}
+	if len(cfg.ClientCAFile) > 0 {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			log.Fatalf("cannot load `https.client_ca_file`: %s", err)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	if cfg.HTTP2 {
+		tlsCfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	applyTLSSettings(&tlsCfg, cfg.TLS)
 	return &tlsCfg
 }
 
+// applyTLSSettings overrides protocol settings in tlsCfg with the given cfg.
+func applyTLSSettings(tlsCfg *tls.Config, cfg config.TLS) {
+	if cfg.MinVersionID > 0 {
+		tlsCfg.MinVersion = cfg.MinVersionID
+	}
+	if cfg.MaxVersionID > 0 {
+		tlsCfg.MaxVersion = cfg.MaxVersionID
+	}
+	if len(cfg.CipherSuiteIDs) > 0 {
+		tlsCfg.CipherSuites = cfg.CipherSuiteIDs
+	}
+	if len(cfg.CurvePreferenceIDs) > 0 {
+		tlsCfg.CurvePreferences = cfg.CurvePreferenceIDs
+	}
+}
+
 func listenAndServe(ln net.Listener, h http.Handler, cfg config.TimeoutCfg) error {
-	s := &http.Server{
+	return runServer(newServer(h, cfg), ln)
+}
+
+// newServer returns http server with the given handler and timeouts.
+//
+// HTTP/2 is disabled by default.
+func newServer(h http.Handler, cfg config.TimeoutCfg) *http.Server {
+	return &http.Server{
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
 		Handler:      h,
 		ReadTimeout:  time.Duration(cfg.ReadTimeout),
@@ -191,19 +405,41 @@ func listenAndServe(ln net.Listener, h http.Handler, cfg config.TimeoutCfg) erro
 		// must handle all these errors in the code.
 		ErrorLog: log.NilLogger,
 	}
-	return s.Serve(ln)
+}
+
+// runServer serves connections from ln by s until s is gracefully stopped.
+func runServer(s *http.Server, ln net.Listener) error {
+	registerServer(s)
+	if err := s.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	// The server is gracefully stopped during zero-downtime upgrade.
+	return nil
 }
 
 var promHandler = promhttp.Handler()
 
 func serveHTTP(rw http.ResponseWriter, r *http.Request) {
+	setClientAddr(r)
+	setSecurityHeaders(rw, r)
+
 	switch r.Method {
 	case http.MethodGet, http.MethodPost:
-		// Only GET and POST methods are supported.
+		// Only GET and POST methods are supported by proxied endpoints.
 	case http.MethodOptions:
+		if isPreflight(r) {
+			proxy.servePreflight(rw, r)
+			return
+		}
 		// This is required for CORS shit :)
 		rw.Header().Set("Allow", "GET,POST")
 		return
+	case http.MethodDelete:
+		// Admin endpoints served by this listener may remove resources.
+		if isAdminPath(r.URL.Path) && len(adminConfig.Load().(*config.Admin).ListenAddr) == 0 {
+			break
+		}
+		fallthrough
 	default:
 		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
 		rw.Header().Set("Connection", "close")
@@ -211,6 +447,20 @@ func serveHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isAdminPath(r.URL.Path) {
+		cfg := adminConfig.Load().(*config.Admin)
+		// Admin endpoints are served only by the dedicated listener if it is configured.
+		if len(cfg.ListenAddr) == 0 {
+			// Admin endpoints on the shared listener mustn't be
+			// reachable from networks the listener doesn't allow.
+			if !checkListenerNetworks(rw, r) {
+				return
+			}
+			serveAdmin(rw, r)
+			return
+		}
+	}
+
 	switch r.URL.Path {
 	case "/favicon.ico":
 	case "/metrics":
@@ -223,35 +473,112 @@ func serveHTTP(rw http.ResponseWriter, r *http.Request) {
 		}
 		proxy.refreshCacheMetrics()
 		promHandler.ServeHTTP(rw, r)
-	case "/":
-		var err error
-		var an *config.Networks
-		if r.TLS != nil {
-			an = allowedNetworksHTTPS.Load().(*config.Networks)
-			err = fmt.Errorf("https connections are not allowed from %s", r.RemoteAddr)
-		} else {
-			an = allowedNetworksHTTP.Load().(*config.Networks)
-			err = fmt.Errorf("http connections are not allowed from %s", r.RemoteAddr)
+	case cachePeerPath:
+		if !checkListenerNetworks(rw, r) {
+			return
 		}
+		proxy.serveCachePeer(rw, r)
+	case cacheStatsPath:
+		an := allowedNetworksMetrics.Load().(*config.Networks)
 		if !an.Contains(r.RemoteAddr) {
+			err := fmt.Errorf("connections to %s are not allowed from %s", cacheStatsPath, r.RemoteAddr)
 			rw.Header().Set("Connection", "close")
 			respondWith(rw, err, http.StatusForbidden)
 			return
 		}
-		proxy.ServeHTTP(rw, r)
+		proxy.serveCacheStats(rw, r)
+	case "/", validatePath, sessionPath:
+		serveProxy(rw, r)
 	default:
-		badRequest.Inc()
-		err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+		if !proxy.isPassthroughPath(r.URL.Path) {
+			badRequest.Inc()
+			err := fmt.Errorf("%q: unsupported path: %q", r.RemoteAddr, r.URL.Path)
+			rw.Header().Set("Connection", "close")
+			respondWith(rw, err, http.StatusBadRequest)
+			return
+		}
+		serveProxy(rw, r)
+	}
+}
+
+// checkListenerNetworks returns false and responds with an error
+// if r isn't allowed by `allowed_networks` of the listener it came to.
+func checkListenerNetworks(rw http.ResponseWriter, r *http.Request) bool {
+	var err error
+	var an *config.Networks
+	if r.TLS != nil {
+		an = allowedNetworksHTTPS.Load().(*config.Networks)
+		err = fmt.Errorf("https connections are not allowed from %s", r.RemoteAddr)
+	} else {
+		an = &config.Networks{}
+		if l := getListenerConfig(r); l != nil {
+			an = &l.AllowedNetworks
+		}
+		err = fmt.Errorf("http connections are not allowed from %s", r.RemoteAddr)
+	}
+	if !an.Contains(r.RemoteAddr) {
 		rw.Header().Set("Connection", "close")
-		respondWith(rw, err, http.StatusBadRequest)
+		respondWith(rw, err, http.StatusForbidden)
+		return false
 	}
+	return true
 }
 
+// serveProxy checks server-level restrictions and proxies r to ClickHouse.
+func serveProxy(rw http.ResponseWriter, r *http.Request) {
+	if !checkListenerNetworks(rw, r) {
+		return
+	}
+	l := getListenerConfig(r)
+	if l == nil {
+		l = &config.HTTP{}
+	}
+	if l.RequireAuth && !hasAuth(r) {
+		err := fmt.Errorf("%q: http listener on %q requires credentials", r.RemoteAddr, l.ListenAddr)
+		respondWith(rw, err, http.StatusUnauthorized)
+		return
+	}
+	if rl := serverLimiter.Load().(*requestLimiter); rl != nil {
+		if err := rl.acquire(r.Context()); err != nil {
+			if _, ok := err.(*memoryLimitError); ok {
+				memoryLimitExcess.Inc()
+			} else {
+				serverLimitExcess.Inc()
+			}
+			err = fmt.Errorf("%q: %s", r.RemoteAddr, err)
+			respondWith(rw, err, http.StatusServiceUnavailable)
+			return
+		}
+		defer rl.release()
+	}
+	if r.URL.Path == validatePath {
+		proxy.serveValidate(rw, r)
+		return
+	}
+	if r.URL.Path == sessionPath {
+		proxy.serveSession(rw, r)
+		return
+	}
+	proxy.ServeHTTP(rw, r)
+}
+
+// loadConfig fetches the config set via -config flag and loads it.
 func loadConfig() (*config.Config, error) {
 	if *configFile == "" {
 		log.Fatalf("Missing -config flag")
 	}
-	cfg, err := config.LoadFile(*configFile)
+	content, err := fetchConfig(*configFile)
+	if err != nil {
+		configSuccess.Set(0)
+		return nil, fmt.Errorf("can't load config %q: %s", *configFile, err)
+	}
+	return parseConfig(content)
+}
+
+// parseConfig loads the config from content.
+func parseConfig(content []byte) (*config.Config, error) {
+	lastConfigContent = content
+	cfg, err := config.Load(content)
 	if err != nil {
 		configSuccess.Set(0)
 		return nil, fmt.Errorf("can't load config %q: %s", *configFile, err)
@@ -261,25 +588,141 @@ func loadConfig() (*config.Config, error) {
 	return cfg, nil
 }
 
+// validateConfigFile loads and checks the config from filename
+// without applying it.
+func validateConfigFile(filename string) error {
+	if len(filename) == 0 {
+		return fmt.Errorf("missing -config flag")
+	}
+	content, err := fetchConfig(filename)
+	if err != nil {
+		return fmt.Errorf("can't load config %q: %s", filename, err)
+	}
+	cfg, err := config.Load(content)
+	if err != nil {
+		return fmt.Errorf("can't load config %q: %s", filename, err)
+	}
+	if err := checkConfig(cfg); err != nil {
+		return fmt.Errorf("invalid config %q: %s", filename, err)
+	}
+	return nil
+}
+
 func applyConfig(cfg *config.Config) error {
 	if err := proxy.applyConfig(cfg); err != nil {
 		return err
 	}
-	allowedNetworksHTTP.Store(&cfg.Server.HTTP.AllowedNetworks)
+	httpListeners.Store(cfg.Server.HTTP.AllListeners())
 	allowedNetworksHTTPS.Store(&cfg.Server.HTTPS.AllowedNetworks)
 	allowedNetworksMetrics.Store(&cfg.Server.Metrics.AllowedNetworks)
+	trustedProxies.Store(&cfg.Server.ProxyHeaders.TrustedProxies)
+	securityHeaders.Store(newSecurityHeaders(cfg.Server.HTTPS.SecurityHeaders))
+	prevLimiter, _ := serverLimiter.Load().(*requestLimiter)
+	serverLimiter.Store(reuseRequestLimiter(prevLimiter, newRequestLimiter(cfg.Server)))
+	atomic.StoreUint64(&maxMemoryUsage, uint64(cfg.Server.MaxMemoryUsage))
+	adminConfig.Store(&cfg.Server.Admin)
 	log.SetDebug(cfg.LogDebug)
+	log.SetErrorSampling(cfg.ErrorLogSampling.Burst, time.Duration(cfg.ErrorLogSampling.Interval))
 	log.Infof("Loaded config:\n%s", cfg)
+	logWriteTimeouts(cfg)
+	for _, w := range cfg.Warnings() {
+		log.Errorf("config warning: %s", w)
+	}
 
 	return nil
 }
 
+// logWriteTimeouts logs `write_timeout` of listeners, so it is clear
+// how long responses may be sent.
+func logWriteTimeouts(cfg *config.Config) {
+	for i, l := range cfg.Server.HTTP.AllListeners() {
+		if len(l.ListenAddr) > 0 {
+			log.Infof("`%s.write_timeout` is %s", httpListenerPath(i), l.WriteTimeout)
+		}
+	}
+	if len(cfg.Server.HTTPS.ListenAddr) > 0 {
+		log.Infof("`server.https.write_timeout` is %s", cfg.Server.HTTPS.WriteTimeout)
+	}
+	log.Infof("max response time derived from `max_execution_time` and `max_queue_time` is %s", cfg.MaxResponseTime())
+}
+
+// reopenLogFiles reopens the log file and the file for recording requests,
+// so they may be rotated by external tools.
+func reopenLogFiles() error {
+	if err := log.ReopenOutputFile(); err != nil {
+		return err
+	}
+	proxy.lock.RLock()
+	recorder := proxy.recorder
+	proxy.lock.RUnlock()
+	if recorder != nil {
+		if err := recorder.reopen(); err != nil {
+			return fmt.Errorf("cannot reopen recording file: %s", err)
+		}
+	}
+	return nil
+}
+
 func reloadConfig() error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
 	cfg, err := loadConfig()
-	if err != nil {
+	if err == nil {
+		err = applyReloadedConfig(cfg)
+	}
+	lastReloadTime, lastReloadErr = time.Now(), err
+	return err
+}
+
+// reloadConfigContent loads and applies the config from content.
+func reloadConfigContent(content []byte) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	cfg, err := parseConfig(content)
+	if err == nil {
+		err = applyReloadedConfig(cfg)
+	}
+	lastReloadTime, lastReloadErr = time.Now(), err
+	return err
+}
+
+// applyReloadedConfig applies cfg instead of runningConfig
+// and logs the summary of changes.
+//
+// cfg is rejected if it changes options applied only on startup.
+func applyReloadedConfig(cfg *config.Config) error {
+	prev := runningConfig
+	if prev == nil {
+		return applyConfig(cfg)
+	}
+	if err := checkImmutableOptions(prev, cfg); err != nil {
+		return err
+	}
+	changes := diffConfigs(prev, cfg)
+	if err := applyConfig(cfg); err != nil {
 		return err
 	}
-	return applyConfig(cfg)
+	for _, w := range writeTimeoutWarnings(prev, cfg) {
+		log.Errorf("config warning: %s", w)
+	}
+	runningConfig = cfg
+	configAppliedTime = time.Now()
+	if len(changes) == 0 {
+		log.Infof("Config isn't changed")
+	} else {
+		log.Infof("Config changes:\n\t%s", strings.Join(changes, "\n\t"))
+	}
+	return nil
+}
+
+// isConfigChanged returns true if content differs from the last
+// loaded config content.
+func isConfigChanged(content []byte) bool {
+	configLock.Lock()
+	defer configLock.Unlock()
+	return !bytes.Equal(content, lastConfigContent)
 }
 
 var (
@@ -255,6 +255,41 @@ func TestServe(t *testing.T) {
 			},
 			startHTTP,
 		},
+		{
+			"http listeners",
+			"testdata/http.listeners.yml",
+			func(t *testing.T) {
+				// Requests without credentials are trusted by the first listener.
+				httpGet(t, "http://127.0.0.1:9090?query=asd", http.StatusOK)
+
+				ln, err := net.Listen("tcp4", ":9091")
+				checkErr(t, err)
+				done := make(chan struct{})
+				go func() {
+					listenAndServe(ln, newListenerHandler(1), config.TimeoutCfg{})
+					close(done)
+				}()
+				defer func() {
+					ln.Close()
+					<-done
+				}()
+
+				resp := httpGet(t, "http://127.0.0.1:9091?query=asd", http.StatusUnauthorized)
+				checkResponse(t, resp.Body, "http listener on \":9091\" requires credentials")
+				resp.Body.Close()
+
+				req, err := http.NewRequest("GET", "http://127.0.0.1:9091?query=asd", nil)
+				checkErr(t, err)
+				req.SetBasicAuth("default", "qwerty")
+				resp, err = http.DefaultClient.Do(req)
+				checkErr(t, err)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("unexpected status code: %d; expected: %d", resp.StatusCode, http.StatusOK)
+				}
+				resp.Body.Close()
+			},
+			startHTTP,
+		},
 		{
 			"http gzipped POST request",
 			"testdata/http.cache.yml",
@@ -387,6 +422,23 @@ func TestServe(t *testing.T) {
 			},
 			startHTTP,
 		},
+		{
+			"http isolated cache",
+			"testdata/http.isolated.cache.yml",
+			func(t *testing.T) {
+				cacheDir := "temp-test-data/isolated_cache"
+				checkFilesCount(t, cacheDir, 0)
+				httpGet(t, "http://127.0.0.1:9090?query=SELECT&user=user1", http.StatusOK)
+				checkFilesCount(t, cacheDir, 1)
+				// user2 has a distinct namespace
+				httpGet(t, "http://127.0.0.1:9090?query=SELECT&user=user2", http.StatusOK)
+				checkFilesCount(t, cacheDir, 2)
+				// user3 shares the namespace with user2
+				httpGet(t, "http://127.0.0.1:9090?query=SELECT&user=user3", http.StatusOK)
+				checkFilesCount(t, cacheDir, 2)
+			},
+			startHTTP,
+		},
 		{
 			"http cached gzipped deadline",
 			"testdata/http.cache.deadline.yml",
@@ -522,7 +574,7 @@ func startHTTP() (net.Listener, chan struct{}) {
 	if err != nil {
 		panic(fmt.Sprintf("cannot listen for %q: %s", cfg.Server.HTTP.ListenAddr, err))
 	}
-	h := http.HandlerFunc(serveHTTP)
+	h := newListenerHandler(0)
 	go func() {
 		listenAndServe(ln, h, config.TimeoutCfg{})
 		close(done)
@@ -642,6 +694,26 @@ func TestReloadConfig(t *testing.T) {
 	}
 }
 
+func TestValidateConfigFile(t *testing.T) {
+	if err := validateConfigFile("testdata/http.yml"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(filename, expectedErr string) {
+		t.Helper()
+		err := validateConfigFile(filename)
+		if err == nil {
+			t.Fatalf("expecting error for %q", filename)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("unexpected error for %q: %q; expecting %q", filename, err, expectedErr)
+		}
+	}
+	f("", "missing -config flag")
+	f("testdata/foobar.yml", "can't load config")
+	f("testdata/http.unknown.cache.yml", "unknown `cache` \"shortterm\" for \"default\"")
+}
+
 func checkErr(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("unexpected erorr: %s", err)
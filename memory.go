@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// memoryUsage holds the amount of memory obtained by the process
+	// from the OS. It is updated by monitorMemory.
+	memoryUsage uint64
+
+	// maxMemoryUsage holds `server.max_memory_usage` from the config.
+	maxMemoryUsage uint64
+)
+
+// monitorMemory periodically updates memory usage until the process exits.
+func monitorMemory(interval time.Duration) {
+	var ms runtime.MemStats
+	for {
+		runtime.ReadMemStats(&ms)
+		// Released heap memory may be reclaimed by the OS at any time.
+		usage := ms.Sys - ms.HeapReleased
+		atomic.StoreUint64(&memoryUsage, usage)
+		memoryUsageBytes.Set(float64(usage))
+		time.Sleep(interval)
+	}
+}
+
+// memoryGuardRatio is the share of `server.max_memory_usage`,
+// after which requests aren't queued anymore.
+const memoryGuardRatio = 0.9
+
+// memoryLimitError is returned by checkMemoryUsage.
+type memoryLimitError struct {
+	usage uint64
+	limit uint64
+}
+
+func (e *memoryLimitError) Error() string {
+	return fmt.Sprintf("proxy memory usage %d bytes approaches `server.max_memory_usage` %d bytes; queued requests are rejected",
+		e.usage, e.limit)
+}
+
+// checkMemoryUsage returns *memoryLimitError if the memory usage
+// approaches `server.max_memory_usage`.
+//
+// It must be called only before queueing requests, so requests,
+// which may run immediately, aren't rejected.
+func checkMemoryUsage() error {
+	limit := atomic.LoadUint64(&maxMemoryUsage)
+	if limit == 0 {
+		return nil
+	}
+	usage := atomic.LoadUint64(&memoryUsage)
+	if float64(usage) < float64(limit)*memoryGuardRatio {
+		return nil
+	}
+	return &memoryLimitError{
+		usage: usage,
+		limit: limit,
+	}
+}
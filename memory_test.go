@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestCheckMemoryUsage(t *testing.T) {
+	defer atomic.StoreUint64(&maxMemoryUsage, 0)
+	defer atomic.StoreUint64(&memoryUsage, 0)
+
+	atomic.StoreUint64(&memoryUsage, 170)
+	if err := checkMemoryUsage(); err != nil {
+		t.Fatalf("unexpected error without limit: %s", err)
+	}
+	atomic.StoreUint64(&maxMemoryUsage, 200)
+	if err := checkMemoryUsage(); err != nil {
+		t.Fatalf("unexpected error below the guard threshold: %s", err)
+	}
+
+	// Requests are rejected before the limit is reached.
+	atomic.StoreUint64(&memoryUsage, 180)
+	if _, ok := checkMemoryUsage().(*memoryLimitError); !ok {
+		t.Fatalf("expecting memoryLimitError when the guard threshold is reached")
+	}
+}
+
+func TestRequestLimiterMemoryGuard(t *testing.T) {
+	defer atomic.StoreUint64(&maxMemoryUsage, 0)
+	defer atomic.StoreUint64(&memoryUsage, 0)
+	atomic.StoreUint64(&maxMemoryUsage, 200)
+	atomic.StoreUint64(&memoryUsage, 200)
+
+	rl := newRequestLimiter(config.Server{
+		MaxConcurrentRequests: 1,
+		MaxQueueSize:          1,
+	})
+	ctx := context.Background()
+	// Requests, which don't have to be queued, aren't rejected.
+	if err := rl.acquire(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer rl.release()
+	if _, ok := rl.acquire(ctx).(*memoryLimitError); !ok {
+		t.Fatalf("expecting memoryLimitError for queued request")
+	}
+}
+
+func TestIncQueuedMemoryGuard(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name:                 "web",
+						MaxConcurrentQueries: 1,
+						MaxQueueSize:         10,
+						MaxQueueTime:         config.Duration(10 * time.Second),
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer close(p.reloadSignal)
+	getScope := func() *scope {
+		t.Helper()
+		s, _, err := p.getScope(httptest.NewRequest("POST", "http://localhost", strings.NewReader("SELECT 1")))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return s
+	}
+
+	defer atomic.StoreUint64(&maxMemoryUsage, 0)
+	defer atomic.StoreUint64(&memoryUsage, 0)
+	atomic.StoreUint64(&maxMemoryUsage, 200)
+	atomic.StoreUint64(&memoryUsage, 200)
+
+	// Requests, which don't have to be queued, aren't rejected.
+	s := getScope()
+	if err := s.incQueued(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer s.dec()
+	if _, ok := getScope().incQueued().(*memoryLimitError); !ok {
+		t.Fatalf("expecting memoryLimitError for queued request")
+	}
+}
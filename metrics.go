@@ -101,6 +101,34 @@ var (
 		},
 		[]string{"cache", "user", "cluster", "cluster_user"},
 	)
+	cachePeerHit = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_peer_hits_total",
+			Help: "The amount of cache entries fetched from peers",
+		},
+		[]string{"cache"},
+	)
+	cachePeerMiss = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_peer_miss_total",
+			Help: "The amount of cache entries missing on owning peers",
+		},
+		[]string{"cache"},
+	)
+	cachePeerErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_peer_errors_total",
+			Help: "The amount of failed requests to cache peers",
+		},
+		[]string{"cache"},
+	)
+	cacheWarmupQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_warmup_queries_total",
+			Help: "The amount of executed cache warmup queries",
+		},
+		[]string{"cache", "result"},
+	)
 	cacheSize = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "cache_size",
@@ -115,6 +143,20 @@ var (
 		},
 		[]string{"cache"},
 	)
+	cacheMaxSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_max_size",
+			Help: "The maximum cache size",
+		},
+		[]string{"cache"},
+	)
+	cacheOldestItemAge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_oldest_item_age_seconds",
+			Help: "The age of the oldest cache item found during the last cache cleaning",
+		},
+		[]string{"cache"},
+	)
 	requestDuration = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Name:       "request_duration_seconds",
@@ -172,6 +214,183 @@ var (
 		Name: "bad_requests_total",
 		Help: "Total number of unsupported requests",
 	})
+	faultInjected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "fault_injected_total",
+			Help: "Total number of artificial faults injected into requests",
+		},
+		[]string{"user", "cluster", "cluster_user", "fault"},
+	)
+	serverLimitExcess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "server_limit_excess_total",
+		Help: "Total number of requests rejected due to server max_concurrent_requests excess",
+	})
+	responseCutoff = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "response_cutoff_total",
+			Help: "Total number of responses aborted due to max_response_size or max_read_rows excess",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	cacheStale = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_stale_total",
+			Help: "The amount of expired cache entries served on errors due to stale_if_error",
+		},
+		[]string{"cache", "user", "cluster", "cluster_user"},
+	)
+	idleRequest = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "idle_request_total",
+			Help: "Total number of queries killed due to max_idle_time excess",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	memoryLimitExcess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "memory_limit_excess_total",
+		Help: "Total number of queued requests rejected as memory usage approaches server max_memory_usage",
+	})
+	memoryUsageBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "memory_usage_bytes",
+		Help: "The amount of memory obtained by the proxy from the OS",
+	})
+	previousPasswordAuth = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "previous_password_auth_total",
+			Help: "Total number of requests authorized with previous user passwords",
+		},
+		[]string{"user"},
+	)
+	sharedLimiterErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "shared_limiter_errors_total",
+		Help: "Total number of shared limiter errors, when local limits were applied instead",
+	})
+	cacheInvalidatedItems = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cache_invalidated_items_total",
+			Help: "The amount of cached responses purged after modification of the tables they read",
+		},
+		[]string{"cache"},
+	)
+	cachePubSubErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "cache_pubsub_errors_total",
+		Help: "Total number of errors while publishing or receiving cache purges via `cache_pubsub`",
+	})
+	authCacheHit = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_cache_hits_total",
+		Help: "Total number of authentication decisions served from auth cache",
+	})
+	authCacheMiss = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "auth_cache_miss_total",
+		Help: "Total number of authentication decisions missing in auth cache",
+	})
+	statementRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statement_requests_total",
+			Help: "Total number of requests split by statement class: select, insert, ddl or other",
+		},
+		[]string{"user", "cluster", "cluster_user", "statement"},
+	)
+	statementDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "statement_duration_seconds",
+			Help:    "Request duration split by statement class: select, insert, ddl or other",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 15),
+		},
+		[]string{"user", "cluster", "statement"},
+	)
+	tenantDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "tenant_denied_total",
+			Help: "Total number of queries denied due to access outside tenant databases",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	statementDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statement_denied_total",
+			Help: "Total number of queries denied due to statements from `denied_statements`",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	requestBodyTooLarge = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "request_body_too_large_total",
+			Help: "Total number of requests rejected due to `max_request_body_size`",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	queryPatternDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_pattern_denied_total",
+			Help: "Total number of queries denied by `allow_query_patterns` and `deny_query_patterns`",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	tableDenied = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "table_denied_total",
+			Help: "Total number of queries denied due to access to tables restricted by table ACLs",
+		},
+		[]string{"user", "cluster", "cluster_user", "replica", "cluster_node"},
+	)
+	retries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retries_total",
+			Help: "Total number of requests retried on other cluster nodes after connection errors",
+		},
+		[]string{"cluster"},
+	)
+	retryBudgetExhausted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "retry_budget_exhausted_total",
+			Help: "Total number of retries rejected due to exhausted retry budget",
+		},
+		[]string{"cluster"},
+	)
+	retryBudgetConsumption = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "retry_budget_consumption",
+			Help: "Ratio of retries to the retry budget of the cluster during the current interval",
+		},
+		[]string{"cluster"},
+	)
+	hookErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hook_errors_total",
+			Help: "Total number of failed calls to hooks",
+		},
+		[]string{"hook"},
+	)
+	discoveryErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "discovery_errors_total",
+			Help: "Total number of failed attempts to discover cluster nodes",
+		},
+		[]string{"cluster"},
+	)
+	mirroredRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mirrored_requests_total",
+			Help: "Total number of requests duplicated to `mirror_to_cluster` by result: success, error, dropped or skipped",
+		},
+		[]string{"user", "cluster", "result"},
+	)
+	mirroredRequestDuration = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Name:       "mirrored_request_duration_seconds",
+			Help:       "Duration of requests duplicated to `mirror_to_cluster`",
+			Objectives: map[float64]float64{0.5: 1e-1, 0.9: 1e-2, 0.99: 1e-3, 0.999: 1e-4, 1: 1e-5},
+		},
+		[]string{"user", "cluster"},
+	)
+	vaultErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vault_errors_total",
+			Help: "Total number of failed attempts to refresh cluster user credentials from Vault",
+		},
+		[]string{"cluster", "cluster_user"},
+	)
 )
 
 func init() {
@@ -179,8 +398,15 @@ func init() {
 		limitExcess, hostPenalties, hostHealth, concurrentQueries,
 		requestQueueSize, userQueueOverflow, clusterUserQueueOverflow,
 		requestBodyBytes, responseBodyBytes,
-		cacheHit, cacheMiss, cacheSize, cacheItems,
+		cacheHit, cacheMiss, cachePeerHit, cachePeerMiss, cachePeerErrors, cacheWarmupQueries, cachePubSubErrors, cacheInvalidatedItems,
+		cacheSize, cacheItems, cacheMaxSize, cacheOldestItemAge, cacheCollector{},
 		requestDuration, proxiedResponseDuration, cachedResponseDuration,
 		canceledRequest, timeoutRequest,
-		configSuccess, configSuccessTime, badRequest)
+		configSuccess, configSuccessTime, badRequest, serverLimitExcess,
+		faultInjected, previousPasswordAuth, authCacheHit, authCacheMiss,
+		sharedLimiterErrors, tenantDenied, tableDenied, statementDenied, queryPatternDenied, requestBodyTooLarge, statementRequests, statementDuration,
+		hookErrors, retries, retryBudgetExhausted, retryBudgetConsumption,
+		memoryLimitExcess, memoryUsageBytes, responseCutoff, idleRequest,
+		cacheStale, vaultErrors, mirroredRequests, mirroredRequestDuration,
+		discoveryErrors)
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxMirrorQuerySize is the maximum size of request body
+	// duplicated to the mirror cluster.
+	maxMirrorQuerySize = 1 << 20
+
+	// maxConcurrentMirrorRequests limits the number of in-flight
+	// mirrored requests per user, so a slow mirror cluster cannot
+	// exhaust chproxy resources.
+	maxConcurrentMirrorRequests = 16
+
+	// defaultMirrorTimeout is used for mirrored requests
+	// if the mirror cluster user has no `max_execution_time`.
+	defaultMirrorTimeout = time.Minute
+)
+
+// trafficMirror asynchronously duplicates user requests
+// to `mirror_to_cluster` and discards responses.
+type trafficMirror struct {
+	cluster     *cluster
+	clusterUser *clusterUser
+	percent     float64
+
+	// sem limits the number of in-flight mirrored requests.
+	sem chan struct{}
+}
+
+// newTrafficMirror returns traffic mirror for the user u.
+//
+// nil is returned if mirroring isn't configured.
+func (up usersProfile) newTrafficMirror(u config.User) (*trafficMirror, error) {
+	if len(u.MirrorToCluster) == 0 {
+		return nil, nil
+	}
+	c, ok := up.clusters[u.MirrorToCluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown `mirror_to_cluster` %q", u.MirrorToCluster)
+	}
+	cu, ok := c.users[u.ToUser]
+	if !ok {
+		return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, u.MirrorToCluster)
+	}
+	percent := u.MirrorPercent
+	if percent == 0 {
+		percent = 100
+	}
+	return &trafficMirror{
+		cluster:     c,
+		clusterUser: cu,
+		percent:     percent,
+		sem:         make(chan struct{}, maxConcurrentMirrorRequests),
+	}, nil
+}
+
+// sample returns true if the next request must be mirrored.
+func (tm *trafficMirror) sample() bool {
+	if tm == nil {
+		return false
+	}
+	return rand.Float64()*100 < tm.percent
+}
+
+// wrapBody wraps req.Body, so it may be duplicated after
+// the request is proxied.
+func (tm *trafficMirror) wrapBody(req *http.Request) *recordingReadCloser {
+	rrc := &recordingReadCloser{
+		ReadCloser: req.Body,
+		limit:      maxMirrorQuerySize,
+	}
+	req.Body = rrc
+	return rrc
+}
+
+// mirror sends the request with the given proxied query args
+// and body to the mirror cluster in background.
+func (tm *trafficMirror) mirror(s *scope, req *http.Request, rawQuery string, body *recordingReadCloser) {
+	countResult := func(result string) {
+		mirroredRequests.With(prometheus.Labels{
+			"user":    s.user.name,
+			"cluster": tm.cluster.name,
+			"result":  result,
+		}).Inc()
+	}
+	b, ok := body.bytes()
+	if !ok {
+		log.Debugf("%s: request isn't mirrored, since its body exceeds %d bytes", s, maxMirrorQuerySize)
+		countResult("skipped")
+		return
+	}
+	select {
+	case tm.sem <- struct{}{}:
+	default:
+		countResult("dropped")
+		return
+	}
+	method, path := req.Method, req.URL.Path
+	header := make(http.Header)
+	for _, k := range []string{"Content-Type", "Content-Encoding"} {
+		if v := req.Header.Get(k); len(v) > 0 {
+			header.Set(k, v)
+		}
+	}
+	go func() {
+		defer func() { <-tm.sem }()
+		startTime := time.Now()
+		err := tm.send(method, path, rawQuery, header, b)
+		mirroredRequestDuration.With(prometheus.Labels{
+			"user":    s.user.name,
+			"cluster": tm.cluster.name,
+		}).Observe(time.Since(startTime).Seconds())
+		if err != nil {
+			log.Debugf("%s: mirrored request to cluster %q failed: %s", s, tm.cluster.name, err)
+			countResult("error")
+			return
+		}
+		countResult("success")
+	}()
+}
+
+// send executes the request on the mirror cluster and discards
+// the response.
+func (tm *trafficMirror) send(method, path, rawQuery string, header http.Header, body []byte) error {
+	h := tm.cluster.getHost()
+	h.inc()
+	defer h.dec()
+
+	timeout := tm.clusterUser.maxExecutionTime
+	if timeout == 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u := *h.addr
+	u.Path = path
+	u.RawQuery = rawQuery
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header = header
+	req.SetBasicAuth(tm.clusterUser.name, tm.clusterUser.password)
+
+	resp, err := tm.cluster.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+		return fmt.Errorf("cannot read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
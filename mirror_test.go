@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestTrafficMirror(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, okResponse)
+	}))
+	defer primary.Close()
+
+	type mirroredRequest struct {
+		user     string
+		database string
+		body     string
+	}
+	mirroredCh := make(chan mirroredRequest, 10)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		user, _, _ := r.BasicAuth()
+		mirroredCh <- mirroredRequest{
+			user:     user,
+			database: r.URL.Query().Get("database"),
+			body:     string(body),
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, "Code: 60. DB::Exception: Table doesn't exist")
+	}))
+	defer canary.Close()
+
+	newCluster := func(name, srvURL string) config.Cluster {
+		addr, err := url.Parse(srvURL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return config.Cluster{
+			Name:   name,
+			Scheme: "http",
+			Nodes:  []string{addr.Host},
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name: "web",
+				},
+			},
+			HeartBeatInterval: config.Duration(time.Minute),
+		}
+	}
+	p, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			newCluster("primary", primary.URL),
+			newCluster("canary", canary.URL),
+		},
+		Users: []config.User{
+			{
+				Name:            "app",
+				ToCluster:       "primary",
+				ToUser:          "web",
+				MirrorToCluster: "canary",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer close(p.reloadSignal)
+
+	req := httptest.NewRequest("POST", "http://localhost/?user=app&database=db", strings.NewReader("SELECT * FROM t"))
+	resp := makeCustomRequest(p, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, http.StatusOK)
+	}
+	// Errors on the mirror cluster mustn't affect responses.
+	if body := bbToString(t, resp.Body); body != okResponse {
+		t.Fatalf("unexpected response %q; expecting %q", body, okResponse)
+	}
+
+	select {
+	case mr := <-mirroredCh:
+		expected := mirroredRequest{
+			user:     "web",
+			database: "db",
+			body:     "SELECT * FROM t",
+		}
+		if mr != expected {
+			t.Fatalf("unexpected mirrored request %+v; expecting %+v", mr, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the request hasn't been mirrored")
+	}
+}
+
+func TestTrafficMirrorSample(t *testing.T) {
+	var nilMirror *trafficMirror
+	if nilMirror.sample() {
+		t.Fatalf("nil mirror mustn't sample requests")
+	}
+	tm := &trafficMirror{percent: 10}
+	var n int
+	for i := 0; i < 10000; i++ {
+		if tm.sample() {
+			n++
+		}
+	}
+	if n < 800 || n > 1200 {
+		t.Fatalf("unexpected number of sampled requests: %d; expecting about 1000", n)
+	}
+}
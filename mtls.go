@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+)
+
+// loadCertPool returns the pool of CA certificates from the given PEM file.
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("cannot find PEM-encoded certificates in %q", file)
+	}
+	return pool, nil
+}
+
+// getRequestCertNames returns CN and DNS/email SANs of the client
+// certificate for req.
+//
+// nil is returned if the client didn't present certificate verified
+// against `https.client_ca_file`.
+func getRequestCertNames(req *http.Request) []string {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	var names []string
+	if len(cert.Subject.CommonName) > 0 {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	return names
+}
+
+// matchCertNames returns true if one of names matches one of patterns.
+func matchCertNames(patterns, names []string) bool {
+	for _, p := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getCertUser returns the first user with `cert_names` matching
+// the given client certificate names.
+//
+// rp.lock must be held by the caller.
+func (rp *reverseProxy) getCertUser(names []string) *user {
+	for _, u := range rp.certUsers {
+		if matchCertNames(u.certNames, names) {
+			return u
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestLoadClientCAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-mtls")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "", nil)
+	file := filepath.Join(dir, "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", file, err)
+	}
+	if _, err := loadCertPool(file); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("foobar"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", file, err)
+	}
+	if _, err := loadCertPool(file); err == nil {
+		t.Fatalf("expected error for file without certificates")
+	}
+	if _, err := loadCertPool(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Fatalf("expected error for missing file")
+	}
+}
+
+func TestCertUserAuth(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			Password:  "secret",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+		{
+			Name:      "reporter",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			CertNames: []string{"*.reports.example.org", "etl@example.org"},
+		},
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	newReq := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest("POST", fakeServer.URL, nil)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}
+		return req
+	}
+	f := func(req *http.Request, expectedUser string) {
+		t.Helper()
+		s, _, err := p.getScope(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if s.user.name != expectedUser {
+			t.Fatalf("unexpected user %q; expected %q", s.user.name, expectedUser)
+		}
+	}
+
+	f(newReq(&x509.Certificate{Subject: pkix.Name{CommonName: "app.reports.example.org"}}), "reporter")
+	f(newReq(&x509.Certificate{DNSNames: []string{"app.reports.example.org"}}), "reporter")
+	f(newReq(&x509.Certificate{EmailAddresses: []string{"etl@example.org"}}), "reporter")
+
+	unknown := newReq(&x509.Certificate{Subject: pkix.Name{CommonName: "app.web.example.org"}})
+	if _, code, err := p.getScope(unknown); err == nil || code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized error for unknown certificate; got code %d, err %v", code, err)
+	}
+
+	// Unverified certificates are ignored.
+	req := newReq(&x509.Certificate{Subject: pkix.Name{CommonName: "app.reports.example.org"}})
+	req.TLS.VerifiedChains = nil
+	req.SetBasicAuth("default", "secret")
+	f(req, "default")
+
+	// Explicit credentials take precedence over client certificate.
+	req = newReq(&x509.Certificate{Subject: pkix.Name{CommonName: "app.reports.example.org"}})
+	req.SetBasicAuth("default", "secret")
+	f(req, "default")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// clusterTarget is a weighted cluster for proxying user requests.
+type clusterTarget struct {
+	cluster *cluster
+	weight  uint32
+
+	// fallback clusters receive requests only if all the nodes
+	// of other clusters are unavailable.
+	fallback bool
+}
+
+// newClusterTargets returns clusters for proxying requests of the user u.
+func (up usersProfile) newClusterTargets(u config.User) ([]clusterTarget, error) {
+	cfg := u.ToClusters
+	if len(cfg) == 0 {
+		cfg = []config.ClusterTarget{
+			{
+				Name:   u.ToCluster,
+				Weight: 1,
+			},
+		}
+	}
+	targets := make([]clusterTarget, 0, len(cfg))
+	for _, ct := range cfg {
+		c, ok := up.clusters[ct.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown `to_cluster` %q", ct.Name)
+		}
+		if _, ok := c.users[u.ToUser]; !ok {
+			return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, ct.Name)
+		}
+		targets = append(targets, clusterTarget{
+			cluster:  c,
+			weight:   ct.Weight,
+			fallback: ct.Fallback,
+		})
+	}
+	return targets, nil
+}
+
+// newRoutes returns clusters from `route` of the user u
+// by statement classes.
+func (up usersProfile) newRoutes(u config.User) (map[string]*cluster, error) {
+	if len(u.Route) == 0 {
+		return nil, nil
+	}
+	routes := make(map[string]*cluster, len(u.Route))
+	for class, name := range u.Route {
+		c, ok := up.clusters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cluster %q in `route.%s`", name, class)
+		}
+		if _, ok := c.users[u.ToUser]; !ok {
+			return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, name)
+		}
+		routes[class] = c
+	}
+	return routes, nil
+}
+
+// newAllowedClusters returns clusters from `allowed_clusters`
+// of the user u by names.
+func (up usersProfile) newAllowedClusters(u config.User) (map[string]*cluster, error) {
+	if len(u.AllowedClusters) == 0 {
+		return nil, nil
+	}
+	clusters := make(map[string]*cluster, len(u.AllowedClusters))
+	for _, name := range u.AllowedClusters {
+		c, ok := up.clusters[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cluster %q in `allowed_clusters`", name)
+		}
+		if _, ok := c.users[u.ToUser]; !ok {
+			return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, name)
+		}
+		clusters[name] = c
+	}
+	return clusters, nil
+}
+
+// clusterHeader is the request header for choosing the cluster
+// among `allowed_clusters` of the user.
+const clusterHeader = "X-Chproxy-Cluster"
+
+// headerCluster returns the cluster chosen via clusterHeader.
+//
+// nil is returned if the header is missing.
+func (u *user) headerCluster(req *http.Request) (*cluster, error) {
+	name := req.Header.Get(clusterHeader)
+	if len(name) == 0 {
+		return nil, nil
+	}
+	c := u.allowedClusters[name]
+	if c == nil {
+		return nil, fmt.Errorf("cluster %q isn't allowed for user %q", name, u.name)
+	}
+	return c, nil
+}
+
+// routeCluster returns the cluster from `route` for the statement
+// class of the query from req.
+//
+// nil is returned if the class isn't routed.
+func (u *user) routeCluster(req *http.Request) *cluster {
+	if len(u.routes) == 0 {
+		return nil
+	}
+	return u.routes[getStatementClass(req)]
+}
+
+// getCluster returns the cluster for the next user request.
+//
+// Requests are spread among clusters proportionally to their weights
+// multiplied by the share of active hosts, so traffic is shifted
+// away from degraded clusters. Fallback clusters are used only
+// if all the other clusters are down. Configured weights of
+// non-fallback clusters are used if all the clusters are down.
+func (u *user) getCluster() *cluster {
+	if len(u.toClusters) == 1 {
+		return u.toClusters[0].cluster
+	}
+	if c := u.pickCluster(false, true); c != nil {
+		return c
+	}
+	if c := u.pickCluster(true, true); c != nil {
+		return c
+	}
+	return u.pickCluster(false, false)
+}
+
+// pickCluster returns a random cluster among targets with the given
+// fallback flag proportionally to their weights, which are multiplied
+// by the share of active hosts if byActiveShare is set.
+//
+// nil is returned if all the weights are zero.
+func (u *user) pickCluster(fallback, byActiveShare bool) *cluster {
+	var total float64
+	weights := make([]float64, len(u.toClusters))
+	for i, ct := range u.toClusters {
+		if ct.fallback != fallback {
+			continue
+		}
+		w := float64(ct.weight)
+		if byActiveShare {
+			w *= ct.cluster.activeShare()
+		}
+		weights[i] = w
+		total += w
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Float64() * total
+	var last *cluster
+	for i, w := range weights {
+		if w == 0 {
+			continue
+		}
+		if n < w {
+			return u.toClusters[i].cluster
+		}
+		n -= w
+		last = u.toClusters[i].cluster
+	}
+	return last
+}
+
+// activeShare returns the share of active hosts in the cluster.
+func (c *cluster) activeShare() float64 {
+	var active, total int
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			if h.isActive() {
+				active++
+			}
+			total++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(active) / float64(total)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestUserGetCluster(t *testing.T) {
+	newCluster := func(name string) *cluster {
+		c := &cluster{
+			name: name,
+		}
+		r := &replica{
+			cluster: c,
+			hosts:   []*host{{}, {}},
+		}
+		c.replicas = []*replica{r}
+		return c
+	}
+	first, second := newCluster("first"), newCluster("second")
+	u := &user{
+		toClusters: []clusterTarget{
+			{
+				cluster: first,
+				weight:  3,
+			},
+			{
+				cluster: second,
+				weight:  1,
+			},
+		},
+	}
+	setActive := func(c *cluster, active ...uint32) {
+		for i, h := range c.replicas[0].hosts {
+			h.active = active[i]
+		}
+	}
+
+	f := func(expectedFirstShare float64) {
+		t.Helper()
+		const n = 10000
+		var firstCount int
+		for i := 0; i < n; i++ {
+			if u.getCluster() == first {
+				firstCount++
+			}
+		}
+		share := float64(firstCount) / n
+		if share < expectedFirstShare-0.05 || share > expectedFirstShare+0.05 {
+			t.Fatalf("unexpected share of requests to the first cluster: %.2f; expecting %.2f", share, expectedFirstShare)
+		}
+	}
+
+	setActive(first, 1, 1)
+	setActive(second, 1, 1)
+	f(0.75)
+
+	// The weight of the degraded cluster is scaled by the share of active nodes.
+	setActive(first, 1, 0)
+	f(0.6)
+
+	setActive(first, 0, 0)
+	f(0)
+
+	// Configured weights are used if all the clusters are down.
+	setActive(second, 0, 0)
+	f(0.75)
+}
+
+func TestUserGetClusterFallback(t *testing.T) {
+	newCluster := func(name string) *cluster {
+		c := &cluster{
+			name: name,
+		}
+		r := &replica{
+			cluster: c,
+			hosts:   []*host{{active: 1}},
+		}
+		c.replicas = []*replica{r}
+		return c
+	}
+	primary, standby := newCluster("primary"), newCluster("standby")
+	u := &user{
+		toClusters: []clusterTarget{
+			{
+				cluster: primary,
+				weight:  1,
+			},
+			{
+				cluster:  standby,
+				weight:   1,
+				fallback: true,
+			},
+		},
+	}
+
+	f := func(expected *cluster) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if c := u.getCluster(); c != expected {
+				t.Fatalf("got cluster %q; expecting %q", c.name, expected.name)
+			}
+		}
+	}
+
+	f(primary)
+
+	primary.replicas[0].hosts[0].active = 0
+	f(standby)
+
+	// The primary cluster is used if all the clusters are down.
+	standby.replicas[0].hosts[0].active = 0
+	f(primary)
+}
+
+func TestUserRoute(t *testing.T) {
+	newServer := func(name string) (*httptest.Server, string) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				panic(err)
+			}
+			if len(body) == 0 && len(r.URL.Query().Get("query")) == 0 {
+				// health check
+				fmt.Fprint(w, okResponse)
+				return
+			}
+			fmt.Fprint(w, name)
+		}))
+		addr, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return srv, addr.Host
+	}
+	reporting, reportingAddr := newServer("reporting")
+	defer reporting.Close()
+	ingest, ingestAddr := newServer("ingest")
+	defer ingest.Close()
+
+	newCluster := func(name, addr string) config.Cluster {
+		return config.Cluster{
+			Name:   name,
+			Scheme: "http",
+			Nodes:  []string{addr},
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name: "web",
+				},
+			},
+			HeartBeatInterval: config.Duration(time.Minute),
+		}
+	}
+	p, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			newCluster("reporting", reportingAddr),
+			newCluster("ingest", ingestAddr),
+		},
+		Users: []config.User{
+			{
+				Name:      "app",
+				ToCluster: "reporting",
+				ToUser:    "web",
+				Route: map[string]string{
+					"insert": "ingest",
+				},
+				AllowedClusters: []string{"ingest"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer close(p.reloadSignal)
+
+	f := func(query, header string, expectedStatus int, expected string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://localhost/?user=app", strings.NewReader(query))
+		if len(header) > 0 {
+			req.Header.Set("X-Chproxy-Cluster", header)
+		}
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, expectedStatus)
+		}
+		if body := bbToString(t, resp.Body); !strings.Contains(body, expected) {
+			t.Fatalf("query %q proxied to %q; expecting %q", query, body, expected)
+		}
+	}
+	f("SELECT 1", "", http.StatusOK, "reporting")
+	f("INSERT INTO t VALUES (1)", "", http.StatusOK, "ingest")
+	f("/* batch */ insert into t format TSV\n1", "", http.StatusOK, "ingest")
+	f("SHOW TABLES", "", http.StatusOK, "reporting")
+
+	// X-Chproxy-Cluster header overrides routes.
+	f("SELECT 1", "ingest", http.StatusOK, "ingest")
+	f("SELECT 1", "reporting", http.StatusForbidden, `cluster "reporting" isn't allowed for user "app"`)
+}
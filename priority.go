@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// getPriority returns the priority of req for the user u.
+//
+// Clients may pass the priority via `priority` query arg, but they
+// cannot raise it above the priority from the user config.
+// 1 is the highest priority, while 0 means no priority.
+func getPriority(req *http.Request, u *user) (uint64, error) {
+	s := req.URL.Query().Get("priority")
+	if len(s) == 0 {
+		return u.priority, nil
+	}
+	p, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse `priority` query arg %q: %s", s, err)
+	}
+	if u.priority > 0 && (p == 0 || p < u.priority) {
+		return 0, fmt.Errorf("`priority` %d exceeds the priority %d allowed for user %q", p, u.priority, u.name)
+	}
+	return p, nil
+}
+
+// priorityRank returns the rank of priority p for ordering queued requests.
+//
+// Requests with lower ranks are started first.
+func priorityRank(p uint64) uint64 {
+	if p == 0 {
+		// Requests without priority are started last.
+		return ^uint64(0)
+	}
+	return p
+}
+
+// priorityWaiters tracks the number of queued requests per priority,
+// so requests with higher priority are started first.
+type priorityWaiters struct {
+	mu     sync.Mutex
+	counts map[uint64]int
+}
+
+func (pw *priorityWaiters) add(p uint64) {
+	pw.mu.Lock()
+	if pw.counts == nil {
+		pw.counts = make(map[uint64]int)
+	}
+	pw.counts[priorityRank(p)]++
+	pw.mu.Unlock()
+}
+
+func (pw *priorityWaiters) remove(p uint64) {
+	r := priorityRank(p)
+	pw.mu.Lock()
+	pw.counts[r]--
+	if pw.counts[r] == 0 {
+		delete(pw.counts, r)
+	}
+	pw.mu.Unlock()
+}
+
+// hasHigher returns true if requests with higher priority than p are waiting.
+func (pw *priorityWaiters) hasHigher(p uint64) bool {
+	r := priorityRank(p)
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	for rank := range pw.counts {
+		if rank < r {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestGetPriority(t *testing.T) {
+	f := func(userPriority uint64, uri string, expectedPriority uint64, expectedErr bool) {
+		t.Helper()
+		u := &user{
+			name:     "default",
+			priority: userPriority,
+		}
+		req := httptest.NewRequest("POST", uri, nil)
+		p, err := getPriority(req, u)
+		if expectedErr {
+			if err == nil {
+				t.Fatalf("expecting non-nil error for %q", uri)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if p != expectedPriority {
+			t.Fatalf("unexpected priority %d; expecting %d", p, expectedPriority)
+		}
+	}
+
+	f(0, "http://localhost", 0, false)
+	f(3, "http://localhost", 3, false)
+	f(0, "http://localhost?priority=2", 2, false)
+	f(3, "http://localhost?priority=5", 5, false)
+	f(3, "http://localhost?priority=3", 3, false)
+
+	// The priority cannot be raised above the configured one.
+	f(3, "http://localhost?priority=1", 0, true)
+	f(3, "http://localhost?priority=0", 0, true)
+
+	f(0, "http://localhost?priority=foo", 0, true)
+	f(0, "http://localhost?priority=-1", 0, true)
+}
+
+func TestPriorityWaiters(t *testing.T) {
+	var pw priorityWaiters
+	if pw.hasHigher(0) {
+		t.Fatalf("no waiters expected")
+	}
+	pw.add(0)
+	pw.add(2)
+	if pw.hasHigher(2) {
+		t.Fatalf("waiters with the same priority mustn't take precedence")
+	}
+	if !pw.hasHigher(0) {
+		t.Fatalf("waiters with priority must take precedence over requests without priority")
+	}
+	if !pw.hasHigher(3) {
+		t.Fatalf("waiters with priority 2 must take precedence over priority 3")
+	}
+	if pw.hasHigher(1) {
+		t.Fatalf("priority 1 must be the highest")
+	}
+	pw.remove(2)
+	if pw.hasHigher(0) || pw.hasHigher(3) {
+		t.Fatalf("only waiters without priority expected")
+	}
+	pw.remove(0)
+	if len(pw.counts) != 0 {
+		t.Fatalf("no waiters expected; got %v", pw.counts)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	addr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name:                 "web",
+						MaxConcurrentQueries: 1,
+						MaxQueueSize:         10,
+						MaxQueueTime:         config.Duration(10 * time.Second),
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Priority:  2,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	getScope := func(uri string) *scope {
+		t.Helper()
+		req := httptest.NewRequest("POST", uri, strings.NewReader("SELECT 1"))
+		s, _, err := p.getScope(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return s
+	}
+
+	s := getScope("http://localhost")
+	req := httptest.NewRequest("POST", "http://localhost?priority=1", nil)
+	req, _ = s.decorateRequest(req)
+	if v := req.URL.Query().Get("priority"); v != "2" {
+		t.Fatalf("unexpected `priority` passed to ClickHouse: %q; expecting %q", v, "2")
+	}
+
+	// Occupy the only concurrency slot.
+	if err := s.incQueued(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	started := make(chan uint64, 2)
+	run := func(s *scope) {
+		if err := s.incQueued(); err != nil {
+			panic(err)
+		}
+		started <- s.priority
+		s.dec()
+	}
+	low := getScope("http://localhost?priority=5")
+	go run(low)
+	// Wait until the low priority request is queued.
+	time.Sleep(200 * time.Millisecond)
+	high := getScope("http://localhost")
+	go run(high)
+	time.Sleep(200 * time.Millisecond)
+
+	s.dec()
+	if p := <-started; p != 2 {
+		t.Fatalf("the request with the highest priority must start first; got priority %d", p)
+	}
+	if p := <-started; p != 5 {
+		t.Fatalf("unexpected priority %d; expecting 5", p)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// processesTimeout is the timeout for querying system.processes
+// on cluster nodes.
+const processesTimeout = 10 * time.Second
+
+// processesQuery is sent to cluster nodes for obtaining running queries.
+const processesQuery = `SELECT query_id, user, address, elapsed, read_rows, read_bytes, written_rows, memory_usage, query
+FROM system.processes
+WHERE query_id != {query_id}
+FORMAT JSON`
+
+// nodeProcesses contains queries running on the cluster node.
+type nodeProcesses struct {
+	Cluster   string                   `json:"cluster"`
+	Replica   string                   `json:"replica"`
+	Node      string                   `json:"cluster_node"`
+	Error     string                   `json:"error,omitempty"`
+	Processes []map[string]interface{} `json:"processes"`
+}
+
+// serveProcesses serves queries running on cluster nodes.
+//
+// Queries are obtained from system.processes of every cluster node
+// with kill_query_user credentials. Optional `cluster` query arg limits
+// the response to the given cluster.
+func serveProcesses(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	clusterName := r.URL.Query().Get("cluster")
+	clusters := proxy.getClusters(clusterName)
+	if len(clusterName) > 0 && len(clusters) == 0 {
+		err := fmt.Errorf("%q: unknown cluster %q", r.RemoteAddr, clusterName)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), processesTimeout)
+	defer cancel()
+
+	var hosts []*host
+	for _, c := range clusters {
+		for _, rep := range c.replicas {
+			hosts = append(hosts, rep.getHosts()...)
+		}
+	}
+	res := make([]nodeProcesses, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(np *nodeProcesses, h *host) {
+			defer wg.Done()
+			np.Cluster = h.replica.cluster.name
+			np.Replica = h.replica.name
+			np.Node = h.addr.Host
+			processes, err := h.getProcesses(ctx)
+			if err != nil {
+				log.Errorf("cannot obtain processes from %q: %s", h.addr.Host, err)
+				np.Error = err.Error()
+				return
+			}
+			np.Processes = processes
+		}(&res[i], h)
+	}
+	wg.Wait()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Errorf("cannot write processes response: %s", err)
+	}
+}
+
+// getProcesses returns queries running on h.
+func (h *host) getProcesses(ctx context.Context) ([]map[string]interface{}, error) {
+	c := h.replica.cluster
+	queryID := newInstanceID()
+	query := strings.Replace(processesQuery, "{query_id}", "'"+queryID+"'", 1)
+	params := url.Values{}
+	params.Set("query_id", queryID)
+	addr := h.addr.String()
+	req, err := http.NewRequest("POST", addr+"?"+params.Encode(), strings.NewReader(query))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	c.setKillQueryUserAuth(req)
+
+	resp, err := c.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query system.processes: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		responseBody, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status code %d from system.processes query; response body: %q",
+			resp.StatusCode, responseBody)
+	}
+	var data struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	d := json.NewDecoder(resp.Body)
+	d.UseNumber()
+	if err := d.Decode(&data); err != nil {
+		return nil, fmt.Errorf("cannot parse system.processes response: %s", err)
+	}
+	if data.Data == nil {
+		data.Data = []map[string]interface{}{}
+	}
+	return data.Data, nil
+}
+
+// getClusters returns clusters sorted by name.
+//
+// Only the cluster with the given name is returned if name isn't empty.
+func (rp *reverseProxy) getClusters(name string) []*cluster {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+
+	if len(name) > 0 {
+		if c, ok := rp.clusters[name]; ok {
+			return []*cluster{c}
+		}
+		return nil
+	}
+	clusters := make([]*cluster, 0, len(rp.clusters))
+	for _, c := range rp.clusters {
+		clusters = append(clusters, c)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].name < clusters[j].name
+	})
+	return clusters
+}
+
+// runningQueries tracks cluster nodes of queries proxied by chproxy,
+// so they may be killed via `/admin/kill`.
+type runningQueries struct {
+	mu    sync.Mutex
+	hosts map[string]*host
+}
+
+func newRunningQueries() *runningQueries {
+	return &runningQueries{
+		hosts: make(map[string]*host),
+	}
+}
+
+func (rq *runningQueries) register(s *scope) {
+	rq.mu.Lock()
+	rq.hosts[s.id.String()] = s.host
+	rq.mu.Unlock()
+}
+
+func (rq *runningQueries) unregister(s *scope) {
+	rq.mu.Lock()
+	delete(rq.hosts, s.id.String())
+	rq.mu.Unlock()
+}
+
+// get returns the node running the query with the given queryID.
+func (rq *runningQueries) get(queryID string) *host {
+	rq.mu.Lock()
+	defer rq.mu.Unlock()
+	return rq.hosts[queryID]
+}
+
+// nodeKill contains result of killing the query on the cluster node.
+type nodeKill struct {
+	Cluster string `json:"cluster"`
+	Replica string `json:"replica"`
+	Node    string `json:"cluster_node"`
+	Error   string `json:"error,omitempty"`
+}
+
+// serveKill kills the query with the given `query_id`.
+//
+// The query is killed on the node it has been proxied to if it is running
+// behind chproxy. Otherwise the query is killed on all the nodes
+// of the given `cluster`.
+func serveKill(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		err := fmt.Errorf("%q: unsupported method %q", r.RemoteAddr, r.Method)
+		respondWith(rw, err, http.StatusMethodNotAllowed)
+		return
+	}
+	queryID := r.FormValue("query_id")
+	if len(queryID) == 0 {
+		err := fmt.Errorf("%q: missing `query_id`", r.RemoteAddr)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	clusterName := r.FormValue("cluster")
+
+	var hosts []*host
+	if h := proxy.running.get(queryID); h != nil && (len(clusterName) == 0 || h.replica.cluster.name == clusterName) {
+		hosts = append(hosts, h)
+	} else if len(clusterName) == 0 {
+		err := fmt.Errorf("%q: query_id %q isn't running behind chproxy; pass `cluster` for killing it on all the cluster nodes",
+			r.RemoteAddr, queryID)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	} else {
+		clusters := proxy.getClusters(clusterName)
+		if len(clusters) == 0 {
+			err := fmt.Errorf("%q: unknown cluster %q", r.RemoteAddr, clusterName)
+			respondWith(rw, err, http.StatusNotFound)
+			return
+		}
+		for _, rep := range clusters[0].replicas {
+			hosts = append(hosts, rep.getHosts()...)
+		}
+	}
+
+	log.Infof("%q: admin kills the query with query_id=%s on %d node(s)", r.RemoteAddr, queryID, len(hosts))
+	res := make([]nodeKill, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(nk *nodeKill, h *host) {
+			defer wg.Done()
+			nk.Cluster = h.replica.cluster.name
+			nk.Replica = h.replica.name
+			nk.Node = h.addr.Host
+			if err := h.killQuery(queryID); err != nil {
+				log.Errorf("cannot kill the query with query_id=%s: %s", queryID, err)
+				nk.Error = err.Error()
+			}
+		}(&res[i], h)
+	}
+	wg.Wait()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		log.Errorf("cannot write kill response: %s", err)
+	}
+}
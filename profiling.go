@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// profiler periodically collects CPU and heap profiles
+// and writes them to the directory and/or pushes them to Pyroscope.
+type profiler struct {
+	cfg    config.Profiling
+	client *http.Client
+}
+
+func newProfiler(cfg config.Profiling) *profiler {
+	return &profiler{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// run collects profiles until the process exits.
+func (p *profiler) run() {
+	if len(p.cfg.Dir) > 0 {
+		if err := os.MkdirAll(p.cfg.Dir, 0700); err != nil {
+			log.Errorf("cannot create profiling dir %q: %s", p.cfg.Dir, err)
+			return
+		}
+	}
+	interval := time.Duration(p.cfg.Interval)
+	for {
+		start := time.Now()
+		p.collect()
+		if d := interval - time.Since(start); d > 0 {
+			time.Sleep(d)
+		}
+	}
+}
+
+func (p *profiler) collect() {
+	from := time.Now()
+	var cpu bytes.Buffer
+	if err := pprof.StartCPUProfile(&cpu); err != nil {
+		log.Errorf("cannot start CPU profile: %s", err)
+	} else {
+		time.Sleep(time.Duration(p.cfg.CPUDuration))
+		pprof.StopCPUProfile()
+		p.store("cpu", cpu.Bytes(), from, time.Now())
+	}
+
+	from = time.Now()
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		log.Errorf("cannot collect heap profile: %s", err)
+	} else {
+		p.store("heap", heap.Bytes(), from, from)
+	}
+
+	if len(p.cfg.Dir) > 0 {
+		p.removeExpired()
+	}
+}
+
+func (p *profiler) store(kind string, data []byte, from, until time.Time) {
+	if len(p.cfg.Dir) > 0 {
+		if err := p.write(kind, data, from); err != nil {
+			log.Errorf("cannot write %s profile: %s", kind, err)
+		}
+	}
+	if len(p.cfg.PushURL) > 0 {
+		if err := p.push(kind, data, from, until); err != nil {
+			log.Errorf("cannot push %s profile to %q: %s", kind, p.cfg.PushURL, err)
+		}
+	}
+}
+
+func (p *profiler) write(kind string, data []byte, t time.Time) error {
+	name := fmt.Sprintf("%s-%s.pprof", kind, t.UTC().Format("20060102T150405"))
+	return ioutil.WriteFile(filepath.Join(p.cfg.Dir, name), data, 0600)
+}
+
+// push sends profile to Pyroscope `/ingest` API.
+func (p *profiler) push(kind string, data []byte, from, until time.Time) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(data); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Set("name", fmt.Sprintf("%s.%s{}", p.cfg.AppName, kind))
+	params.Set("from", fmt.Sprintf("%d", from.Unix()))
+	params.Set("until", fmt.Sprintf("%d", until.Unix()))
+	params.Set("format", "pprof")
+	params.Set("spyName", "gospy")
+	u := strings.TrimRight(p.cfg.PushURL, "/") + "/ingest?" + params.Encode()
+	req, err := http.NewRequest("POST", u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d; response: %q", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+func (p *profiler) removeExpired() {
+	files, err := ioutil.ReadDir(p.cfg.Dir)
+	if err != nil {
+		log.Errorf("cannot read profiling dir %q: %s", p.cfg.Dir, err)
+		return
+	}
+	deadline := time.Now().Add(-time.Duration(p.cfg.Retention))
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".pprof" {
+			continue
+		}
+		if fi.ModTime().After(deadline) {
+			continue
+		}
+		fn := filepath.Join(p.cfg.Dir, fi.Name())
+		if err := os.Remove(fn); err != nil {
+			log.Errorf("cannot remove expired profile %q: %s", fn, err)
+		}
+	}
+}
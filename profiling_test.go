@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestProfilerCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-profiles")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	expired := filepath.Join(dir, "cpu-expired.pprof")
+	if err := ioutil.WriteFile(expired, []byte("foo"), 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pushed := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest" {
+			t.Errorf("unexpected path: %q", r.URL.Path)
+		}
+		if r.URL.Query().Get("format") != "pprof" {
+			t.Errorf("unexpected format: %q", r.URL.Query().Get("format"))
+		}
+		f, _, err := r.FormFile("profile")
+		if err != nil {
+			t.Errorf("cannot read profile: %s", err)
+			return
+		}
+		data, _ := ioutil.ReadAll(f)
+		pushed[r.URL.Query().Get("name")] = len(data)
+	}))
+	defer s.Close()
+
+	p := newProfiler(config.Profiling{
+		CPUDuration: config.Duration(10 * time.Millisecond),
+		Dir:         dir,
+		Retention:   config.Duration(time.Hour),
+		PushURL:     s.URL,
+		AppName:     "test",
+	})
+	p.collect()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected number of profiles in dir: %d; expected: %d", len(files), 2)
+	}
+	for _, fi := range files {
+		if fi.Name() == "cpu-expired.pprof" {
+			t.Fatalf("expired profile must be removed")
+		}
+	}
+	for _, name := range []string{"test.cpu{}", "test.heap{}"} {
+		if pushed[name] == 0 {
+			t.Fatalf("profile %q wasn't pushed", name)
+		}
+	}
+}
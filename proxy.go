@@ -2,23 +2,24 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Vertamedia/chproxy/cache"
 	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/extension"
 	"github.com/Vertamedia/chproxy/log"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type reverseProxy struct {
-	rp *httputil.ReverseProxy
-
 	// configLock serializes access to applyConfig.
 	// It protects reload* fields.
 	configLock sync.Mutex
@@ -26,26 +27,70 @@ type reverseProxy struct {
 	reloadSignal chan struct{}
 	reloadWG     sync.WaitGroup
 
-	// lock protects users, clusters and caches.
+	// lock protects users, clusters, caches, cachePeers, cachePubSub,
+	// invalidateOnWrites, recorder, authCache, sharedLimiter, history and hooks.
 	// RWMutex enables concurrent access to getScope.
 	lock sync.RWMutex
 
 	users    map[string]*user
 	clusters map[string]*cluster
 	caches   map[string]*cache.Cache
+
+	// cachePeers contains peers of caches with configured peering.
+	cachePeers map[string]*cachePeers
+
+	// cachePubSub broadcasts cache purges among instances if set.
+	cachePubSub *cachePubSub
+
+	// invalidateOnWrites is set if at least a single cache
+	// has `invalidate_on_writes`.
+	invalidateOnWrites bool
+
+	// spiffeUsers contains users with `spiffe_ids` in config order.
+	spiffeUsers []*user
+
+	// certUsers contains users with `cert_names` in config order.
+	certUsers []*user
+
+	// regexpUsers contains users with `name_is_regexp` in config order.
+	regexpUsers []*user
+
+	// passthroughPaths contains paths from `allowed_paths` of all the users.
+	passthroughPaths map[string]bool
+
+	// recorder records proxied requests if set.
+	recorder *requestRecorder
+
+	// authCache caches decisions of external auth backends if set.
+	authCache *authCache
+
+	// jwt verifies JWT bearer tokens if set.
+	jwt *jwtVerifier
+
+	// ldap authenticates users missing in config via LDAP if set.
+	ldap *ldapAuthenticator
+
+	// sessions keeps sessions issued by `/session` endpoint if set.
+	sessions *sessionStore
+
+	// sharedLimiter enforces limits across chproxy instances if set.
+	sharedLimiter *sharedLimiter
+
+	// running tracks nodes of the currently proxied queries.
+	running *runningQueries
+
+	// history keeps recent queries per user if set.
+	history *queryHistory
+
+	// hooks inspect and modify proxied requests.
+	hooks requestHooks
 }
 
 func newReverseProxy() *reverseProxy {
 	return &reverseProxy{
-		rp: &httputil.ReverseProxy{
-			Director: func(*http.Request) {},
-
-			// Suppress error logging in ReverseProxy, since all the errors
-			// are handled and logged in the code below.
-			ErrorLog: log.NilLogger,
-		},
 		reloadSignal: make(chan struct{}),
 		reloadWG:     sync.WaitGroup{},
+		running:      newRunningQueries(),
 	}
 }
 
@@ -63,23 +108,43 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// WARNING: don't use s.labels before s.incQueued,
 	// since `replica` and `cluster_node` may change inside incQueued.
 	if err := s.incQueued(); err != nil {
-		limitExcess.With(s.labels).Inc()
+		status := http.StatusTooManyRequests
+		if _, ok := err.(*memoryLimitError); ok {
+			memoryLimitExcess.Inc()
+			status = http.StatusServiceUnavailable
+		} else {
+			limitExcess.With(s.labels).Inc()
+		}
 		q := getQuerySnippet(req)
 		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
-		respondWith(rw, err, http.StatusTooManyRequests)
+		respondWith(rw, err, status)
 		return
 	}
 	defer s.dec()
 
+	if err := s.route(req); err != nil {
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(rw, err, http.StatusInternalServerError)
+		return
+	}
+
+	rp.running.register(s)
+	defer rp.running.unregister(s)
+	getTrace(req).setScope(s, time.Since(startTime))
+
 	log.Debugf("%s: request start", s)
 	requestSum.With(s.labels).Inc()
 
-	if s.user.allowCORS {
-		origin := req.Header.Get("Origin")
-		if len(origin) == 0 {
-			origin = "*"
-		}
-		rw.Header().Set("Access-Control-Allow-Origin", origin)
+	if s.user.cors != nil {
+		s.user.cors.setHeaders(rw.Header(), req.Header.Get("Origin"))
+	}
+
+	if err := s.limitRequestBody(req); err != nil {
+		requestBodyTooLarge.With(s.labels).Inc()
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusRequestEntityTooLarge)
+		return
 	}
 
 	req.Body = &statReadCloser{
@@ -93,21 +158,114 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	req, origParams := s.decorateRequest(req)
 
+	rp.lock.RLock()
+	recorder := rp.recorder
+	history := rp.history
+	hooks := rp.hooks
+	invalidateOnWrites := rp.invalidateOnWrites
+	ps := rp.cachePubSub
+	rp.lock.RUnlock()
+
+	if status, err := hooks.onRequest(s, req); err != nil {
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(srw, err, status)
+		return
+	}
+
+	statement := getStatementClass(req)
+
+	if err := s.checkStatement(req); err != nil {
+		statementDenied.With(s.labels).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(srw, err, http.StatusForbidden)
+		return
+	}
+
+	if err := s.checkQueryPatterns(req); err != nil {
+		queryPatternDenied.With(s.labels).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(srw, err, http.StatusForbidden)
+		return
+	}
+
+	if err := s.checkTenantQuery(req); err != nil {
+		tenantDenied.With(s.labels).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(srw, err, http.StatusForbidden)
+		return
+	}
+
+	if err := s.checkTableQuery(req); err != nil {
+		tableDenied.With(s.labels).Inc()
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+		respondWith(srw, err, http.StatusForbidden)
+		return
+	}
+
+	var writtenTables []string
+	if invalidateOnWrites {
+		var err error
+		writtenTables, err = getWrittenTables(req)
+		if err != nil {
+			log.Errorf("%s: cannot determine modified tables: %s; cached responses won't be invalidated", s, err)
+		}
+	}
+
+	var recordedBody *recordingReadCloser
+	if recorder != nil {
+		recordedBody = recorder.wrapBody(req)
+	}
+
+	var mirroredBody *recordingReadCloser
+	var mirrorQuery string
+	mirror := s.user.mirror
+	mirrored := mirror.sample()
+	if mirrored {
+		mirroredBody = mirror.wrapBody(req)
+		mirrorQuery = req.URL.RawQuery
+	}
+
 	// wrap body into cachedReadCloser, so we could obtain the original
 	// request on error.
 	req.Body = &cachedReadCloser{
 		ReadCloser: req.Body,
 	}
 
-	if s.user.cache == nil {
+	switch {
+	case s.injectFaults(srw, req):
+		// The response has been already sent by the injected fault.
+	case s.user.cache == nil:
 		rp.proxyRequest(s, srw, srw, req)
-	} else {
+	default:
 		rp.serveFromCache(s, srw, req, origParams)
 	}
 
 	// It is safe calling getQuerySnippet here, since the request
 	// has been already read in proxyRequest or serveFromCache.
 	q := getQuerySnippet(req)
+	if recorder != nil {
+		recorder.record(s, req, origParams, recordedBody)
+	}
+	if mirrored {
+		mirror.mirror(s, req, mirrorQuery, mirroredBody)
+	}
+	if history != nil {
+		history.add(s, srw.statusCode, q)
+	}
+	hooks.onResponse(s, srw.statusCode)
+	if len(writtenTables) > 0 && srw.statusCode == http.StatusOK {
+		// Purge cached responses after the modification succeeds,
+		// so responses cached during the modification are purged too.
+		rp.invalidateCaches(writtenTables)
+		ps.publish(&cachePurgeEvent{
+			Tables: writtenTables,
+		})
+	}
 	if srw.statusCode == http.StatusOK {
 		requestSuccess.With(s.labels).Inc()
 		log.Debugf("%s: request success; query: %q; URL: %q", s, q, req.URL.String())
@@ -127,6 +285,18 @@ func (rp *reverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	).Inc()
 	since := float64(time.Since(startTime).Seconds())
 	requestDuration.With(s.labels).Observe(since)
+
+	statementRequests.With(prometheus.Labels{
+		"user":         s.user.name,
+		"cluster":      s.cluster.name,
+		"cluster_user": s.clusterUser.name,
+		"statement":    statement,
+	}).Inc()
+	statementDuration.With(prometheus.Labels{
+		"user":      s.user.name,
+		"cluster":   s.cluster.name,
+		"statement": statement,
+	}).Observe(since)
 }
 
 // proxyRequest proxies the given request to clickhouse and sends response
@@ -165,10 +335,55 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw http.ResponseWriter, srw *stat
 		}
 	}()
 
+	trace := getTrace(req)
 	req = req.WithContext(ctx)
 
+	w := rw
+	lrw := s.limitResponse(w)
+	if lrw != nil {
+		w = lrw
+	}
+	idleTimeout, idleErrMsg := s.getIdleTimeoutWithErrMsg()
+	var iw *idleWatchWriter
+	if idleTimeout > 0 {
+		iw = newIdleWatchWriter(ctx, w, idleTimeout, ctxCancel)
+		w = iw
+	}
+	var gw *gzipResponseWriter
+	if s.compressResponse {
+		gw = &gzipResponseWriter{ResponseWriter: w}
+		w = gw
+	}
+
 	startTime := time.Now()
-	rp.rp.ServeHTTP(rw, req)
+	s.serveWithRetries(w, req)
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			log.Debugf("%s: cannot compress response: %s", s, err)
+		}
+	}
+	trace.setUpstreamDuration(time.Since(startTime))
+
+	if lrw != nil && lrw.err != nil {
+		s.cutoffResponse(rw, srw, req, lrw)
+		return
+	}
+	if iw != nil && iw.isIdle() {
+		idleRequest.With(s.labels).Inc()
+
+		// Penalize host with the stuck query, because it may be unhealthy.
+		s.host.penalize()
+		if err := s.killQuery(); err != nil {
+			log.Errorf("%s: cannot kill query: %s", s, err)
+		}
+
+		q := getQuerySnippet(req)
+		log.Debugf("%s: query idle timeout in %s; query: %q", s, time.Since(startTime), q)
+		err := fmt.Errorf("%s: %s; query: %q", s, idleErrMsg, q)
+		respondWith(rw, err, http.StatusGatewayTimeout)
+		srw.statusCode = http.StatusGatewayTimeout
+		return
+	}
 
 	err := ctx.Err()
 	switch err {
@@ -183,13 +398,19 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw http.ResponseWriter, srw *stat
 			srw.statusCode = crw.StatusCode()
 		}
 
+		if srw.statusCode == http.StatusRequestEntityTooLarge {
+			requestBodyTooLarge.With(s.labels).Inc()
+			_, err := s.getMaxRequestBodySizeWithErrMsg()
+			respondWith(rw, fmt.Errorf("%s: %s", s, err), srw.statusCode)
+		}
+
 		// StatusBadGateway response is returned by http.ReverseProxy when
 		// it cannot establish connection to remote host.
 		if srw.statusCode == http.StatusBadGateway {
 			s.host.penalize()
 			q := getQuerySnippet(req)
 			err := fmt.Errorf("%s: cannot reach %s; query: %q", s, s.host.addr.Host, q)
-			respondWith(srw, err, srw.statusCode)
+			respondWith(rw, err, srw.statusCode)
 		}
 
 	case context.Canceled:
@@ -217,14 +438,26 @@ func (rp *reverseProxy) proxyRequest(s *scope, rw http.ResponseWriter, srw *stat
 }
 
 func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *http.Request, origParams url.Values) {
-	noCache := origParams.Get("no_cache")
-	if noCache == "1" || noCache == "true" {
+	mode, err := getCacheMode(s, req, origParams)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(srw, err, http.StatusBadRequest)
+		return
+	}
+	if mode == "bypass" {
 		// The response caching is disabled.
+		getTrace(req).setCache("bypass")
 		rp.proxyRequest(s, srw, srw, req)
 		return
 	}
 
 	q, err := getFullQuery(req)
+	if err == errRequestBodyTooLarge {
+		requestBodyTooLarge.With(s.labels).Inc()
+		_, err := s.getMaxRequestBodySizeWithErrMsg()
+		respondWith(srw, fmt.Errorf("%s: %s", s, err), http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		err = fmt.Errorf("%s: cannot read query: %s", s, err)
 		respondWith(srw, err, http.StatusBadRequest)
@@ -232,6 +465,7 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 	}
 	if !canCacheQuery(q) {
 		// The query cannot be cached, so just proxy it.
+		getTrace(req).setCache("uncacheable")
 		rp.proxyRequest(s, srw, srw, req)
 		return
 	}
@@ -250,7 +484,7 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		paramsHash = s.user.params.key
 	}
 	key := &cache.Key{
-		Query: skipLeadingComments(q),
+		Query: s.user.cacheKeyPolicy.query(q),
 		// sort `Accept-Encoding` header to get the same combination for different browsers
 		AcceptEncoding:        sortHeader(req.Header.Get("Accept-Encoding")),
 		DefaultFormat:         origParams.Get("default_format"),
@@ -262,28 +496,80 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		MaxResultRows:         origParams.Get("max_result_rows"),
 		ResultOverflowMode:    origParams.Get("result_overflow_mode"),
 		UserParamsHash:        paramsHash,
+		QuotaKey:              req.URL.Query().Get("quota_key"),
+		Params:                s.user.cacheKeyPolicy.params(origParams, req.Header),
 	}
-
-	startTime := time.Now()
-	err = s.user.cache.WriteTo(srw, key)
-	if err == nil {
-		// The response has been successfully served from cache.
-		cacheHit.With(labels).Inc()
-		since := float64(time.Since(startTime).Seconds())
-		cachedResponseDuration.With(labels).Observe(since)
-		log.Debugf("%s: cache hit", s)
-		return
+	if !s.user.cache.SharedWithAllUsers {
+		key.UserNamespace = s.user.cacheKeyNamespace
 	}
-	if err != cache.ErrMissing {
-		// Unexpected error while serving the response.
-		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
-		log.ErrorWithCallDepth(err, 1)
+	if pc := s.passthrough; pc != nil {
+		h := sha256.Sum256([]byte(pc.name + "\x00" + pc.password))
+		key.CredentialsHash = hex.EncodeToString(h[:])
+	}
+	if k := s.user.cacheKeyer; k != nil {
+		extra, err := k.CacheKey(&extension.CacheKeyRequest{
+			User:     s.user.name,
+			Identity: s.identity,
+			Query:    q,
+			Params:   extensionParams(origParams),
+			Header:   extensionHeader(req.Header),
+		})
+		if err != nil {
+			log.Errorf("%s: cannot obtain cache key: %s; proxying the request without caching", s, err)
+			getTrace(req).setCache("uncacheable")
+			rp.proxyRequest(s, srw, srw, req)
+			return
+		}
+		key.Extra = extra
+	}
+
+	if mode == "refresh" {
+		// Skip the cached response, so it is substituted
+		// with the fresh one.
+		log.Debugf("%s: cache refresh", s)
+		getTrace(req).setCache("refresh")
+	} else {
+		startTime := time.Now()
+		err = s.user.cache.WriteTo(srw, key)
+		if err == nil {
+			// The response has been successfully served from cache.
+			cacheHit.With(labels).Inc()
+			since := float64(time.Since(startTime).Seconds())
+			cachedResponseDuration.With(labels).Observe(since)
+			log.Debugf("%s: cache hit", s)
+			getTrace(req).setCache("hit")
+			return
+		}
+		if err != cache.ErrMissing {
+			// Unexpected error while serving the response.
+			err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+			log.ErrorWithCallDepth(err, 1)
+		}
+
+		// The response wasn't found in the cache.
+		cacheMiss.With(labels).Inc()
+		log.Debugf("%s: cache miss", s)
+
+		// Try fetching the response from the owning peer.
+		if cp := s.user.cachePeers; cp != nil {
+			err = cp.fetch(s.user.cache, key.String())
+			if err == nil {
+				err = s.user.cache.WriteTo(srw, key)
+				if err == nil {
+					log.Debugf("%s: cache peer hit", s)
+					getTrace(req).setCache("peer_hit")
+					return
+				}
+			}
+			if err != cache.ErrMissing {
+				err = fmt.Errorf("%s: %s; query: %q", s, err, q)
+				log.ErrorWithCallDepth(err, 1)
+			}
+		}
+		getTrace(req).setCache("miss")
 	}
 
-	// The response wasn't found in the cache.
-	// Request it from clickhouse.
-	cacheMiss.With(labels).Inc()
-	log.Debugf("%s: cache miss", s)
+	// Request the response from clickhouse.
 	crw, err := s.user.cache.NewResponseWriter(srw, key)
 	if err != nil {
 		err = fmt.Errorf("%s: %s; query: %q", s, err, q)
@@ -298,9 +584,21 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 		if srw.statusCode != 0 {
 			crw.WriteHeader(srw.statusCode)
 		}
+		if crw.StatusCode() >= http.StatusInternalServerError && s.serveStale(srw, req, key, labels) {
+			if err := crw.Discard(); err != nil {
+				log.Errorf("%s: %s", s, err)
+			}
+			return
+		}
 		err = crw.Rollback()
 	} else {
+		if s.user.cache.InvalidateOnWrites {
+			crw.SetTags(getReadTables(q, origParams.Get("database")))
+		}
 		err = crw.Commit()
+		if err == nil && s.user.cachePeers != nil {
+			go s.user.cachePeers.push(s.user.cache, key.String())
+		}
 	}
 
 	if err != nil {
@@ -310,6 +608,64 @@ func (rp *reverseProxy) serveFromCache(s *scope, srw *statResponseWriter, req *h
 	}
 }
 
+// getCacheMode returns `bypass` if the response mustn't be cached
+// and `refresh` if the cached response must be substituted with the fresh one.
+//
+// `no_cache` query arg is honored for all the users, while `Cache-Control`
+// and `X-Chproxy-Cache` headers are honored only for users
+// with `allow_cache_control`.
+func getCacheMode(s *scope, req *http.Request, origParams url.Values) (string, error) {
+	noCache := origParams.Get("no_cache")
+	if noCache == "1" || noCache == "true" {
+		return "bypass", nil
+	}
+	if !s.user.allowCacheControl {
+		return "", nil
+	}
+	switch mode := req.Header.Get("X-Chproxy-Cache"); mode {
+	case "bypass", "refresh":
+		return mode, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported X-Chproxy-Cache header value %q; expecting `refresh` or `bypass`", mode)
+	}
+	for _, v := range strings.Split(req.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "no-store":
+			return "bypass", nil
+		case "no-cache":
+			return "refresh", nil
+		}
+	}
+	return "", nil
+}
+
+// serveStale serves the expired cached response for the given key
+// instead of the failed response if the cache has `stale_if_error` set.
+//
+// Returns true if the stale response has been served.
+func (s *scope) serveStale(srw *statResponseWriter, req *http.Request, key *cache.Key, labels prometheus.Labels) bool {
+	// Drop headers of the failed response.
+	h := srw.Header()
+	for k := range h {
+		if strings.HasPrefix(k, "X-Clickhouse-") || k == "Content-Encoding" {
+			h.Del(k)
+		}
+	}
+	h.Set("X-Cache", "STALE")
+	if err := s.user.cache.WriteStaleTo(srw, key); err != nil {
+		h.Del("X-Cache")
+		if err != cache.ErrMissing {
+			log.Errorf("%s: %s", s, err)
+		}
+		return false
+	}
+	cacheStale.With(labels).Inc()
+	log.Debugf("%s: stale cache entry served on error", s)
+	getTrace(req).setCache("stale")
+	return true
+}
+
 // applyConfig applies the given cfg to reverseProxy.
 //
 // New config is applied only if non-nil error returned.
@@ -321,12 +677,60 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 	rp.configLock.Lock()
 	defer rp.configLock.Unlock()
 
+	// Plugins must be loaded before the initialization of users
+	// and clusters referring extensions registered by plugins.
+	for _, path := range cfg.Extensions.Plugins {
+		if err := extension.LoadPlugin(path); err != nil {
+			return err
+		}
+	}
+
 	clusters, err := newClusters(cfg.Clusters)
 	if err != nil {
 		return err
 	}
 
+	// Credentials are read from Vault before applying the config,
+	// so requests aren't sent without them.
+	vault, err := newVaultClient(cfg.Vault)
+	if err != nil {
+		return err
+	}
+	jv, err := newJWTVerifier(cfg.JWT)
+	if err != nil {
+		return err
+	}
+	la, err := newLDAPAuthenticator(cfg.Auth.LDAP)
+	if err != nil {
+		return err
+	}
+	if jv != nil && len(jv.jwksURL) > 0 {
+		// Tokens are verified after JWKS is fetched on the first request
+		// if it is unavailable now.
+		if err := jv.fetchKeys(); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+
+	vaultSecrets := make(map[*clusterUser]*vaultSecret)
+	for _, c := range clusters {
+		for _, cu := range c.users {
+			if len(cu.vaultSecret) == 0 {
+				continue
+			}
+			s, err := cu.loadVaultCredentials(vault)
+			if err != nil {
+				return fmt.Errorf("cannot load credentials for cluster user %q: %s", cu.name, err)
+			}
+			vaultSecrets[cu] = s
+		}
+	}
+
 	caches := make(map[string]*cache.Cache, len(cfg.Caches))
+	cachePeersMap := make(map[string]*cachePeers)
+	cacheKeyers := make(map[string]extension.CacheKeyer)
+	cacheKeyPolicies := make(map[string]*cacheKeyPolicy)
+	var invalidateOnWrites bool
 	defer func() {
 		// caches is swapped with old caches from rp.caches
 		// on successful config reload - see the end of reloadConfig.
@@ -346,6 +750,22 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 			return fmt.Errorf("cannot initialize cache %q: %s", cc.Name, err)
 		}
 		caches[cc.Name] = tmpCache
+		if cp := newCachePeers(cc.Peers); cp != nil {
+			cachePeersMap[cc.Name] = cp
+		}
+		if len(cc.Keyer) > 0 {
+			k := extension.GetCacheKeyer(cc.Keyer)
+			if k == nil {
+				return fmt.Errorf("unknown `keyer` %q for cache %q", cc.Keyer, cc.Name)
+			}
+			cacheKeyers[cc.Name] = k
+		}
+		if ckp := newCacheKeyPolicy(cc.Key); ckp != nil {
+			cacheKeyPolicies[cc.Name] = ckp
+		}
+		if cc.InvalidateOnWrites {
+			invalidateOnWrites = true
+		}
 	}
 
 	params := make(map[string]*paramsRegistry, len(cfg.ParamGroups))
@@ -359,16 +779,117 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 		}
 	}
 
+	var recorder *requestRecorder
+	if len(cfg.Recording.File) > 0 {
+		recorder, err = newRequestRecorder(cfg.Recording)
+		if err != nil {
+			return fmt.Errorf("cannot initialize recorder: %s", err)
+		}
+	}
+	defer func() {
+		// recorder is swapped with the old recorder from rp.recorder
+		// on successful config reload - see the end of applyConfig.
+		if recorder != nil {
+			recorder.Close()
+		}
+	}()
+
+	// Query history is re-created only if its file changes,
+	// so recent queries survive config reloads.
+	hcfg := cfg.Server.Admin.QueryHistory
+	history := rp.history
+	reuseHistory := history != nil && hcfg.Size > 0 && history.cfg.File == hcfg.File
+	if !reuseHistory {
+		history, err = newQueryHistory(hcfg)
+		if err != nil {
+			return fmt.Errorf("cannot initialize query history: %s", err)
+		}
+	}
+	defer func() {
+		// history is swapped with the old history from rp.history
+		// on successful config reload - see the end of applyConfig.
+		if history != nil && !reuseHistory {
+			history.Close()
+		}
+	}()
+
+	hooks, err := newRequestHooks(cfg.Hooks, rp.hooks)
+	if err != nil {
+		return fmt.Errorf("cannot initialize hooks: %s", err)
+	}
+	defer func() {
+		// hooks is swapped with the old hooks from rp.hooks
+		// on successful config reload - see the end of applyConfig.
+		// Hooks shared by the old and the new configs are kept running.
+		hooks.closeExcept(rp.hooks)
+	}()
+
 	profile := &usersProfile{
-		cfg:      cfg.Users,
-		clusters: clusters,
-		caches:   caches,
-		params:   params,
+		cfg:              cfg.Users,
+		clusters:         clusters,
+		caches:           caches,
+		cachePeers:       cachePeersMap,
+		params:           params,
+		cacheKeyers:      cacheKeyers,
+		cacheKeyPolicies: cacheKeyPolicies,
 	}
 	users, err := profile.newUsers()
 	if err != nil {
 		return err
 	}
+	sl := newSharedLimiter(cfg.SharedLimiter)
+	defer func() {
+		// sl is swapped with the old shared limiter from rp.sharedLimiter
+		// on successful config reload - see the end of applyConfig.
+		if sl != nil {
+			sl.Close()
+		}
+	}()
+	if sl != nil {
+		for _, c := range clusters {
+			for _, cu := range c.users {
+				cu.rateLimiter.shared = sl
+				cu.rateLimiter.name = "cluster_user:" + c.name + ":" + cu.name
+				if sl.coordinateConcurrency {
+					cu.sharedLimiter = sl
+					cu.sharedName = cu.rateLimiter.name
+				}
+			}
+		}
+		for _, u := range users {
+			u.rateLimiter.shared = sl
+			u.rateLimiter.name = "user:" + u.name
+		}
+	}
+
+	ps := newCachePubSub(cfg.CachePubSub)
+	defer func() {
+		// ps is swapped with the old cache pubsub from rp.cachePubSub
+		// on successful config reload - see the end of applyConfig.
+		if ps != nil {
+			ps.Close()
+		}
+	}()
+
+	var spiffeUsers, certUsers, regexpUsers []*user
+	passthroughPaths := make(map[string]bool)
+	for _, u := range cfg.Users {
+		for _, p := range u.AllowedPaths {
+			passthroughPaths[p] = true
+		}
+		if len(u.SPIFFEIDs) > 0 {
+			spiffeUsers = append(spiffeUsers, users[u.Name])
+		}
+		if len(u.CertNames) > 0 {
+			certUsers = append(certUsers, users[u.Name])
+		}
+		if u.NameIsRegexp || u.IsWildcarded {
+			regexpUsers = append(regexpUsers, users[u.Name])
+		}
+	}
+	for _, m := range cfg.Auth.LDAP.GroupMappings {
+		users[m.User].ldapGroup = true
+	}
 
 	// New configs have been successfully prepared.
 	// Restart service goroutines with new configs.
@@ -386,16 +907,28 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 	hostHealth.Reset()
 	cacheSize.Reset()
 	cacheItems.Reset()
+	cacheMaxSize.Reset()
+	cacheOldestItemAge.Reset()
+	retryBudgetConsumption.Reset()
 
 	// Start service goroutines with new configs.
 	for _, c := range clusters {
-		for _, r := range c.replicas {
-			for _, h := range r.hosts {
-				rp.reloadWG.Add(1)
-				go func(h *host) {
-					h.runHeartbeat(rp.reloadSignal)
-					rp.reloadWG.Done()
-				}(h)
+		if c.discovery != nil {
+			// Heartbeats for discovered hosts are managed by discovery.
+			rp.reloadWG.Add(1)
+			go func(dd *nodeDiscovery) {
+				dd.run(rp.reloadSignal, &rp.reloadWG)
+				rp.reloadWG.Done()
+			}(c.discovery)
+		} else {
+			for _, r := range c.replicas {
+				for _, h := range r.getHosts() {
+					rp.reloadWG.Add(1)
+					go func(h *host) {
+						h.runHeartbeat(rp.reloadSignal)
+						rp.reloadWG.Done()
+					}(h)
+				}
 			}
 		}
 		for _, cu := range c.users {
@@ -404,6 +937,13 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 				cu.rateLimiter.run(rp.reloadSignal)
 				rp.reloadWG.Done()
 			}(cu)
+			if s := vaultSecrets[cu]; s != nil {
+				rp.reloadWG.Add(1)
+				go func(cu *clusterUser, cluster string) {
+					cu.runVaultRefresher(vault, cluster, s, rp.reloadSignal)
+					rp.reloadWG.Done()
+				}(cu, c.name)
+			}
 		}
 	}
 	for _, u := range users {
@@ -413,22 +953,126 @@ func (rp *reverseProxy) applyConfig(cfg *config.Config) error {
 			rp.reloadWG.Done()
 		}(u)
 	}
+	if jv != nil && len(jv.jwksURL) > 0 {
+		rp.reloadWG.Add(1)
+		go func() {
+			jv.run(rp.reloadSignal)
+			rp.reloadWG.Done()
+		}()
+	}
+	if svidSrc != nil {
+		rp.reloadWG.Add(1)
+		go func() {
+			svidSrc.run(rp.reloadSignal)
+			rp.reloadWG.Done()
+		}()
+	}
+	if ps != nil {
+		rp.reloadWG.Add(1)
+		go func(ps *cachePubSub) {
+			ps.run(rp.reloadSignal, rp.applyCachePurge)
+			rp.reloadWG.Done()
+		}(ps)
+	}
 
 	// Substitute old configs with the new configs in rp.
 	// All the currently running requests will continue with old configs,
 	// while all the new requests will use new configs.
 	rp.lock.Lock()
+	oldClusters := rp.clusters
 	rp.clusters = clusters
 	rp.users = users
+	rp.spiffeUsers = spiffeUsers
+	rp.certUsers = certUsers
+	rp.regexpUsers = regexpUsers
+	rp.passthroughPaths = passthroughPaths
 	// Swap is needed for deferred closing of old caches.
 	// See the code above where new caches are created.
 	caches, rp.caches = rp.caches, caches
+	rp.cachePeers = cachePeersMap
+	rp.invalidateOnWrites = invalidateOnWrites
+	recorder, rp.recorder = rp.recorder, recorder
+	sl, rp.sharedLimiter = rp.sharedLimiter, sl
+	ps, rp.cachePubSub = rp.cachePubSub, ps
+	hooks, rp.hooks = rp.hooks, hooks
+	if reuseHistory {
+		history.setSize(hcfg.Size)
+	} else {
+		history, rp.history = rp.history, history
+	}
+	// Cached decisions may become stale after config reload,
+	// so the cache is re-created.
+	rp.authCache = newAuthCache(cfg.AuthCache)
+	rp.jwt = jv
+	rp.ldap = la
+	// Sessions are kept across config reloads.
+	switch {
+	case cfg.Sessions.TTL == 0:
+		rp.sessions = nil
+	case rp.sessions == nil:
+		rp.sessions = newSessionStore(cfg.Sessions)
+	default:
+		rp.sessions.setConfig(cfg.Sessions)
+	}
 	rp.lock.Unlock()
 
+	// Old transports aren't used by new requests, so their idle
+	// connections are closed instead of leaking until IdleConnTimeout.
+	// Requests running with old configs keep their connections.
+	for _, c := range oldClusters {
+		c.transport.CloseIdleConnections()
+	}
+
+	// Caches are warmed up after the new configs are applied,
+	// so warmup queries are proxied with the new configs.
+	for _, cc := range cfg.Caches {
+		if cw := newCacheWarmer(cc.Name, cc.Warmup, rp); cw != nil {
+			rp.reloadWG.Add(1)
+			go func(stopCh <-chan struct{}) {
+				cw.run(stopCh)
+				rp.reloadWG.Done()
+			}(rp.reloadSignal)
+		}
+	}
+
 	return nil
 }
 
-// refreshCacheMetrics refresehs cacheSize and cacheItems metrics.
+// isPassthroughPath returns true if the given path may be proxied
+// to ClickHouse for at least a single user.
+func (rp *reverseProxy) isPassthroughPath(path string) bool {
+	rp.lock.RLock()
+	defer rp.lock.RUnlock()
+	return rp.passthroughPaths[path]
+}
+
+// getRegexpUser returns the first user with `name_is_regexp`
+// or `is_wildcarded` matching the given name.
+//
+// rp.lock must be held by the caller.
+func (rp *reverseProxy) getRegexpUser(name string) *user {
+	for _, u := range rp.regexpUsers {
+		if u.nameRegexp.MatchString(name) {
+			return u
+		}
+	}
+	return nil
+}
+
+// getSPIFFEUser returns the first user with `spiffe_ids` matching id.
+//
+// rp.lock must be held by the caller.
+func (rp *reverseProxy) getSPIFFEUser(id string) *user {
+	for _, u := range rp.spiffeUsers {
+		if matchSPIFFEID(u.spiffeIDs, id) {
+			return u
+		}
+	}
+	return nil
+}
+
+// refreshCacheMetrics refresehs cacheSize, cacheItems, cacheMaxSize
+// and cacheOldestItemAge metrics.
 func (rp *reverseProxy) refreshCacheMetrics() {
 	rp.lock.RLock()
 	defer rp.lock.RUnlock()
@@ -440,34 +1084,175 @@ func (rp *reverseProxy) refreshCacheMetrics() {
 		}
 		cacheSize.With(labels).Set(float64(stats.Size))
 		cacheItems.With(labels).Set(float64(stats.Items))
+		cacheMaxSize.With(labels).Set(float64(stats.MaxSize))
+		cacheOldestItemAge.With(labels).Set(stats.OldestItemAge.Seconds())
 	}
 }
 
 func (rp *reverseProxy) getScope(req *http.Request) (*scope, int, error) {
 	name, password := getAuth(req)
 
+	// Requests with bearer token are authorized by the user name
+	// from the token claims.
+	token := getBearerToken(req)
+	// Requests with session token are authorized as the client,
+	// which the session was issued for.
+	var sess *session
+	if isSessionToken(token) {
+		rp.lock.RLock()
+		ss := rp.sessions
+		rp.lock.RUnlock()
+		if ss != nil {
+			sess = ss.get(token)
+		}
+		if sess == nil {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid or expired session token")
+		}
+		name = sess.user
+		token = ""
+	} else if len(token) > 0 {
+		rp.lock.RLock()
+		jv := rp.jwt
+		rp.lock.RUnlock()
+		if jv == nil {
+			return nil, http.StatusUnauthorized, fmt.Errorf("JWT authentication isn't configured")
+		}
+		var err error
+		if name, err = jv.verify(token); err != nil {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid JWT: %s", err)
+		}
+	}
+
+	// Requests without credentials to the listener with `default_user`
+	// are trusted, so the password isn't checked.
+	var trusted bool
+	if l := getListenerConfig(req); l != nil && len(l.DefaultUser) > 0 && !hasAuth(req) {
+		trusted = true
+	}
+
+	// Requests without credentials may be authorized by client SVID
+	// or by client certificate.
+	var (
+		spiffeID  string
+		certNames []string
+	)
+	if !hasAuth(req) && !trusted {
+		spiffeID = getRequestSPIFFEID(req)
+		if len(spiffeID) == 0 {
+			certNames = getRequestCertNames(req)
+		}
+	}
+
 	var (
 		u  *user
 		c  *cluster
 		cu *clusterUser
+
+		identity string
+		ac       *authCache
+		la       *ldapAuthenticator
 	)
 
 	rp.lock.RLock()
-	u = rp.users[name]
+	if sess != nil {
+		u = rp.users[sess.user]
+		identity = sess.identity
+	} else if len(spiffeID) > 0 {
+		u = rp.getSPIFFEUser(spiffeID)
+	} else if len(certNames) > 0 {
+		u = rp.getCertUser(certNames)
+	} else {
+		u = rp.users[name]
+		if u == nil {
+			u = rp.getRegexpUser(name)
+			if u != nil {
+				identity = name
+			}
+		}
+	}
 	if u != nil {
-		// c and cu for toCluster and toUser must exist if applyConfig
+		// c and cu for toClusters and toUser must exist if applyConfig
 		// is correct.
 		// Fix applyConfig if c or cu equal to nil.
-		c = rp.clusters[u.toCluster]
+		c = u.getCluster()
 		cu = c.users[u.toUser]
 	}
+	ac = rp.authCache
+	la = rp.ldap
 	rp.lock.RUnlock()
 
+	// Users missing in config may be authenticated via LDAP
+	// as members of groups mapped to config users.
+	ldapAuthenticated := false
+	if u == nil && la != nil && sess == nil && len(token) == 0 && len(spiffeID) == 0 && len(certNames) == 0 && !trusted {
+		mapped, err := ac.resolve(la, name, password)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("cannot authenticate user %q via LDAP: %s", name, err)
+		}
+		if len(mapped) > 0 {
+			rp.lock.RLock()
+			u = rp.users[mapped]
+			if u != nil {
+				c = u.getCluster()
+				cu = c.users[u.toUser]
+			}
+			rp.lock.RUnlock()
+			identity = name
+			ldapAuthenticated = true
+		}
+	}
+
+	if u != nil {
+		// Statement routes override to_cluster, so the same credentials
+		// may write to ingestion cluster and read from reporting cluster.
+		if rc := u.routeCluster(req); rc != nil {
+			c = rc
+			cu = c.users[u.toUser]
+		}
+	}
+
+	if u == nil && len(spiffeID) > 0 {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no user matches SPIFFE ID %q", spiffeID)
+	}
+	if u == nil && len(certNames) > 0 {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no user matches client certificate names %q", certNames)
+	}
 	if u == nil {
 		return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", name)
 	}
-	if u.password != password {
-		return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", name)
+	var passthrough *credentials
+	if sess != nil {
+		passthrough = sess.passthrough
+	} else if len(token) > 0 {
+		if !u.allowJWT {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user %q is not allowed to authenticate via JWT", name)
+		}
+	} else if u.isWildcarded {
+		// Credentials of wildcarded users are verified by ClickHouse.
+		passthrough = &credentials{
+			name:     name,
+			password: password,
+		}
+	} else if len(spiffeID) == 0 && len(certNames) == 0 && !ldapAuthenticated && !trusted {
+		ok := false
+		if u.allowJWT && u.authenticator == nil && len(u.password) == 0 {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user %q must authenticate via JWT", name)
+		}
+		if u.ldapGroup && u.authenticator == nil && len(u.password) == 0 {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user %q must authenticate via LDAP", name)
+		}
+		if u.authenticator != nil {
+			var err error
+			ok, err = ac.authenticate(u.authenticator, name, password)
+			if err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("cannot authenticate user %q: %s", name, err)
+			}
+		} else {
+			ok = u.checkPassword(password)
+		}
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("invalid username or password for user %q", name)
+		}
 	}
 	if u.denyHTTP && req.TLS == nil {
 		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access via http", u.name)
@@ -478,10 +1263,29 @@ func (rp *reverseProxy) getScope(req *http.Request) (*scope, int, error) {
 	if !u.allowedNetworks.Contains(req.RemoteAddr) {
 		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access", u.name)
 	}
+	if p := req.URL.Path; p != "/" && p != "" && p != validatePath && p != sessionPath && !u.allowedPaths[p] {
+		return nil, http.StatusForbidden, fmt.Errorf("user %q is not allowed to access path %q", u.name, p)
+	}
+	hc, err := u.headerCluster(req)
+	if err != nil {
+		return nil, http.StatusForbidden, err
+	}
+	if hc != nil {
+		c = hc
+		cu = c.users[u.toUser]
+	}
 	if !cu.allowedNetworks.Contains(req.RemoteAddr) {
 		return nil, http.StatusForbidden, fmt.Errorf("cluster user %q is not allowed to access", cu.name)
 	}
 
+	priority, err := getPriority(req, u)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
 	s := newScope(req, u, c, cu)
+	s.identity = identity
+	s.passthrough = passthrough
+	s.priority = priority
 	return s, 0, nil
 }
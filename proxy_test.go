@@ -8,9 +8,12 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -253,6 +256,32 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 				return makeHeavyRequest(p, time.Millisecond*20)
 			},
 		},
+		{
+			cfg:           goodCfg,
+			name:          "injected error for user",
+			expResponse:   "injected fault",
+			expStatusCode: http.StatusBadGateway,
+			f: func(p *reverseProxy) *http.Response {
+				p.users["default"].faults = &faultInjector{
+					errorPercent:    100,
+					errorStatusCode: http.StatusBadGateway,
+				}
+				return makeRequest(p)
+			},
+		},
+		{
+			cfg:           goodCfg,
+			name:          "injected error for cluster",
+			expResponse:   "injected fault",
+			expStatusCode: http.StatusServiceUnavailable,
+			f: func(p *reverseProxy) *http.Response {
+				p.clusters["cluster"].faults = &faultInjector{
+					errorPercent:    100,
+					errorStatusCode: http.StatusServiceUnavailable,
+				}
+				return makeRequest(p)
+			},
+		},
 		{
 			cfg:           authCfg,
 			name:          "disallow https",
@@ -415,6 +444,32 @@ func TestReverseProxy_ServeHTTP1(t *testing.T) {
 			t.Fatalf("user password expected to be %q; got %q", authCfg.Clusters[0].ClusterUsers[0].Password, pass)
 		}
 	})
+
+	t.Run("header auth success", func(t *testing.T) {
+		proxy, err := getProxy(authCfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		req := httptest.NewRequest("POST", fakeServer.URL, nil)
+		req.Header.Set("X-ClickHouse-User", "foo")
+		req.Header.Set("X-ClickHouse-Key", "bar")
+		resp := makeCustomRequest(proxy, req)
+
+		expected := okResponse
+		b := bbToString(t, resp.Body)
+		if !strings.Contains(b, expected) {
+			t.Fatalf("expected response: %q; got: %q", expected, b)
+		}
+		resp.Body.Close()
+
+		user, pass := getAuth(req)
+		if user != authCfg.Clusters[0].ClusterUsers[0].Name {
+			t.Fatalf("user name expected to be %q; got %q", authCfg.Clusters[0].ClusterUsers[0].Name, user)
+		}
+		if pass != authCfg.Clusters[0].ClusterUsers[0].Password {
+			t.Fatalf("user password expected to be %q; got %q", authCfg.Clusters[0].ClusterUsers[0].Password, pass)
+		}
+	})
 }
 
 func TestKillQuery(t *testing.T) {
@@ -721,3 +776,407 @@ func (r *requestRegistry) get(key string) (bool, error) {
 	}
 	return v, nil
 }
+
+func TestRegexpUser(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{"localhost:8123"},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "team_a",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+			{
+				Name:         "team_a_.*",
+				NameIsRegexp: true,
+				Password:     "qwerty",
+				ToCluster:    "cluster",
+				ToUser:       "web",
+			},
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	getScope := func(name, password string) (*scope, error) {
+		req := httptest.NewRequest("POST", "http://localhost", nil)
+		req.SetBasicAuth(name, password)
+		s, _, err := p.getScope(req)
+		return s, err
+	}
+
+	s, err := getScope("team_a", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.user.name != "team_a" || len(s.identity) > 0 {
+		t.Fatalf("exact user name match must take precedence; got user %q with identity %q", s.user.name, s.identity)
+	}
+
+	s, err = getScope("team_a_alice", "qwerty")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.user.name != "team_a_.*" {
+		t.Fatalf("unexpected user %q; expecting %q", s.user.name, "team_a_.*")
+	}
+	if s.identity != "team_a_alice" {
+		t.Fatalf("unexpected identity %q; expecting %q", s.identity, "team_a_alice")
+	}
+	req := httptest.NewRequest("POST", "http://localhost", nil)
+	req, _ = s.decorateRequest(req)
+	if qk := req.URL.Query().Get("quota_key"); qk != "team_a_alice" {
+		t.Fatalf("unexpected quota_key %q; expecting %q", qk, "team_a_alice")
+	}
+
+	if _, err := getScope("team_a_alice", "invalid"); err == nil {
+		t.Fatalf("expected error for invalid password")
+	}
+	if _, err := getScope("xteam_a_alice", "qwerty"); err == nil {
+		t.Fatalf("regexp must match the whole user name")
+	}
+}
+
+func TestWildcardedUsers(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{"localhost:8123"},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name:     "web",
+						Password: "web-secret",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:         "team_*",
+				IsWildcarded: true,
+				ToCluster:    "cluster",
+				ToUser:       "web",
+			},
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(name, password, expectedUser, expectedCHUser, expectedCHPassword string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://localhost", nil)
+		req.SetBasicAuth(name, password)
+		s, _, err := p.getScope(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if s.user.name != expectedUser {
+			t.Fatalf("unexpected user %q; expecting %q", s.user.name, expectedUser)
+		}
+		req, _ = s.decorateRequest(req)
+		chUser, chPassword, _ := req.BasicAuth()
+		if chUser != expectedCHUser || chPassword != expectedCHPassword {
+			t.Fatalf("unexpected ClickHouse credentials %q:%q; expecting %q:%q",
+				chUser, chPassword, expectedCHUser, expectedCHPassword)
+		}
+	}
+	f("team_alice", "alice-secret", "team_*", "team_alice", "alice-secret")
+	f("team_bob", "", "team_*", "team_bob", "")
+	f("default", "", "default", "web", "web-secret")
+
+	req := httptest.NewRequest("POST", "http://localhost", nil)
+	req.SetBasicAuth("xteam_alice", "alice-secret")
+	if _, _, err := p.getScope(req); err == nil {
+		t.Fatalf("pattern must match the whole user name")
+	}
+}
+
+func TestAllowedPaths(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{"localhost:8123"},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:         "monitoring",
+				ToCluster:    "cluster",
+				ToUser:       "web",
+				AllowedPaths: []string{"/ping", "/replicas_status"},
+			},
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+		},
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !p.isPassthroughPath("/ping") || p.isPassthroughPath("/play") {
+		t.Fatalf("passthrough paths must contain only `allowed_paths` of users")
+	}
+
+	f := func(user, path string, expectedStatusCode int) {
+		t.Helper()
+		req := httptest.NewRequest("GET", fakeServer.URL+path, nil)
+		req.SetBasicAuth(user, "")
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatusCode {
+			t.Fatalf("unexpected status code %d for user %q and path %q; expected %d",
+				resp.StatusCode, user, path, expectedStatusCode)
+		}
+	}
+	f("monitoring", "/ping", http.StatusOK)
+	f("monitoring", "/", http.StatusOK)
+	f("monitoring", "/play", http.StatusForbidden)
+	f("default", "/ping", http.StatusForbidden)
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	var fail int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			w.Header().Set("X-ClickHouse-Exception-Code", "1")
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "Code: 1. DB::Exception")
+			return
+		}
+		fmt.Fprint(w, "fresh data")
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chproxy-stale")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newConfiguredProxy(&config.Config{
+		Caches: []config.Cache{
+			{
+				Name:         "stale",
+				Dir:          dir,
+				MaxSize:      config.ByteSize(1 << 20),
+				Expire:       config.Duration(time.Minute),
+				GraceTime:    config.Duration(-1),
+				StaleIfError: config.Duration(time.Hour),
+			},
+		},
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "default",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Cache:     "stale",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(expectedStatus int, expectedBody, expectedXCache string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", srv.URL, strings.NewReader("SELECT 1"))
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, expectedStatus)
+		}
+		if body := bbToString(t, resp.Body); !strings.Contains(body, expectedBody) {
+			t.Fatalf("unexpected response body %q; expecting it to contain %q", body, expectedBody)
+		}
+		if xc := resp.Header.Get("X-Cache"); xc != expectedXCache {
+			t.Fatalf("unexpected X-Cache header %q; expecting %q", xc, expectedXCache)
+		}
+	}
+	expireAll := func(age time.Duration) {
+		t.Helper()
+		mt := time.Now().Add(-age)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			return os.Chtimes(path, mt, mt)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	f(http.StatusOK, "fresh data", "")
+
+	atomic.StoreInt32(&fail, 1)
+	expireAll(10 * time.Minute)
+	f(http.StatusOK, "fresh data", "STALE")
+
+	expireAll(2 * time.Hour)
+	f(http.StatusInternalServerError, "DB::Exception", "")
+}
+
+func TestCacheControl(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		fmt.Fprintf(w, "response %d", atomic.AddInt32(&n, 1))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chproxy-cache-control")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newConfiguredProxy(&config.Config{
+		Caches: []config.Cache{
+			{
+				Name:      "shared",
+				Dir:       dir,
+				MaxSize:   config.ByteSize(1 << 20),
+				Expire:    config.Duration(time.Minute),
+				GraceTime: config.Duration(-1),
+			},
+		},
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:              "default",
+				ToCluster:         "cluster",
+				ToUser:            "web",
+				Cache:             "shared",
+				AllowCacheControl: true,
+			},
+			{
+				Name:      "dashboard",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Cache:     "shared",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(user, query, header, value string, expectedStatus int, expectedBody string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", srv.URL+"?user="+user+query, strings.NewReader("SELECT 1"))
+		if len(header) > 0 {
+			req.Header.Set(header, value)
+		}
+		resp := makeCustomRequest(p, req)
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, expectedStatus)
+		}
+		if body := bbToString(t, resp.Body); !strings.Contains(body, expectedBody) {
+			t.Fatalf("unexpected response body %q; expecting it to contain %q", body, expectedBody)
+		}
+	}
+
+	f("default", "", "", "", http.StatusOK, "response 1")
+	f("default", "", "", "", http.StatusOK, "response 1")
+
+	// Refreshed responses substitute cached responses.
+	f("default", "", "X-Chproxy-Cache", "refresh", http.StatusOK, "response 2")
+	f("default", "", "", "", http.StatusOK, "response 2")
+	f("default", "", "Cache-Control", "max-age=0, no-cache", http.StatusOK, "response 3")
+	f("dashboard", "", "", "", http.StatusOK, "response 3")
+
+	// Bypassed responses aren't cached.
+	f("default", "", "X-Chproxy-Cache", "bypass", http.StatusOK, "response 4")
+	f("default", "", "Cache-Control", "no-store", http.StatusOK, "response 5")
+	f("default", "", "", "", http.StatusOK, "response 3")
+
+	// Headers are ignored for users without `allow_cache_control`.
+	f("dashboard", "", "X-Chproxy-Cache", "refresh", http.StatusOK, "response 3")
+	f("dashboard", "", "Cache-Control", "no-cache", http.StatusOK, "response 3")
+
+	// `no_cache` is honored for all the users.
+	f("dashboard", "&no_cache=1", "", "", http.StatusOK, "response 6")
+
+	f("default", "", "X-Chproxy-Cache", "flush", http.StatusBadRequest, "unsupported X-Chproxy-Cache header value")
+}
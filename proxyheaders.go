@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// setClientAddr substitutes r.RemoteAddr with the client address passed
+// via `X-Forwarded-For` or `X-Real-IP` headers by trusted proxies.
+//
+// The port of the connection from the proxy is kept, since
+// r.RemoteAddr must contain a port.
+func setClientAddr(r *http.Request) {
+	v := trustedProxies.Load()
+	if v == nil {
+		return
+	}
+	trusted := *v.(*config.Networks)
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return
+	}
+	if ip := getClientIP(r.Header, host, trusted); ip != host {
+		r.RemoteAddr = net.JoinHostPort(ip, port)
+	}
+}
+
+// getClientIP returns the client IP for the request from peerIP
+// with the given header.
+//
+// `X-Forwarded-For` is traversed from right to left while addresses
+// belong to trusted proxies, so clients cannot spoof their addresses
+// by passing the header. peerIP is returned if it isn't trusted.
+func getClientIP(header http.Header, peerIP string, trusted config.Networks) string {
+	if !isTrustedProxy(peerIP, trusted) {
+		return peerIP
+	}
+	var ips []string
+	for _, v := range header["X-Forwarded-For"] {
+		for _, ip := range strings.Split(v, ",") {
+			ips = append(ips, strings.TrimSpace(ip))
+		}
+	}
+	if len(ips) == 0 {
+		if ip := strings.TrimSpace(header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+			return ip
+		}
+		return peerIP
+	}
+	clientIP := peerIP
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip := ips[i]
+		if net.ParseIP(ip) == nil {
+			// Stop at malformed addresses.
+			break
+		}
+		clientIP = ip
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return clientIP
+}
+
+// isTrustedProxy returns true if ip belongs to trusted networks.
+func isTrustedProxy(ip string, trusted config.Networks) bool {
+	if len(trusted) == 0 {
+		// Networks.Contains returns true for empty networks.
+		return false
+	}
+	return trusted.Contains(net.JoinHostPort(ip, "0"))
+}
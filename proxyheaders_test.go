@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestGetClientIP(t *testing.T) {
+	var trusted config.Networks
+	for _, s := range []string{"10.0.0.0/8", "192.168.1.1/32"} {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		trusted = append(trusted, ipnet)
+	}
+
+	f := func(peerIP, xff, xRealIP, expectedIP string) {
+		t.Helper()
+		header := make(http.Header)
+		if len(xff) > 0 {
+			header.Set("X-Forwarded-For", xff)
+		}
+		if len(xRealIP) > 0 {
+			header.Set("X-Real-IP", xRealIP)
+		}
+		ip := getClientIP(header, peerIP, trusted)
+		if ip != expectedIP {
+			t.Fatalf("unexpected client IP %q; expecting %q", ip, expectedIP)
+		}
+	}
+
+	// Headers from untrusted peers are ignored.
+	f("1.2.3.4", "5.6.7.8", "", "1.2.3.4")
+	f("1.2.3.4", "", "5.6.7.8", "1.2.3.4")
+
+	f("10.0.0.1", "", "", "10.0.0.1")
+	f("10.0.0.1", "5.6.7.8", "", "5.6.7.8")
+	f("10.0.0.1", "", "5.6.7.8", "5.6.7.8")
+	f("10.0.0.1", "", "foobar", "10.0.0.1")
+
+	// Spoofed addresses before the last untrusted address are ignored.
+	f("10.0.0.1", "9.9.9.9, 5.6.7.8, 192.168.1.1", "", "5.6.7.8")
+
+	// The leftmost address is used if all the addresses are trusted.
+	f("10.0.0.1", "10.1.1.1, 10.2.2.2", "", "10.1.1.1")
+
+	// Malformed addresses stop the traversal.
+	f("10.0.0.1", "5.6.7.8, foobar", "", "10.0.0.1")
+
+	// No trusted proxies.
+	trusted = nil
+	f("10.0.0.1", "5.6.7.8", "", "10.0.0.1")
+}
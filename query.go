@@ -0,0 +1,769 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// queryTokenKind is the kind of the query token.
+type queryTokenKind int
+
+const (
+	tokenIdent queryTokenKind = iota
+	tokenQuotedIdent
+	tokenLiteral
+	tokenNumber
+	tokenPunct
+)
+
+// queryToken is a lexical token of ClickHouse query.
+type queryToken struct {
+	kind queryTokenKind
+
+	// value contains unquoted value for identifiers and string literals.
+	value string
+}
+
+// isKeyword returns true if t is unquoted identifier equal to kw.
+//
+// kw must be in upper case.
+func (t queryToken) isKeyword(kw string) bool {
+	return t.kind == tokenIdent && strings.ToUpper(t.value) == kw
+}
+
+func (t queryToken) isPunct(p string) bool {
+	return t.kind == tokenPunct && t.value == p
+}
+
+func (t queryToken) isName() bool {
+	return t.kind == tokenQuotedIdent || (t.kind == tokenIdent && !reservedKeywords[strings.ToUpper(t.value)])
+}
+
+// reservedKeywords cannot be used as table names or aliases
+// without quoting in the queries recognized by the analyzer.
+var reservedKeywords = map[string]bool{
+	"ALL": true, "AND": true, "ANTI": true, "ANY": true, "ARRAY": true, "AS": true,
+	"ASOF": true, "CROSS": true, "EXCEPT": true, "FINAL": true, "FORMAT": true,
+	"FROM": true, "FULL": true, "GLOBAL": true, "GROUP": true, "HAVING": true,
+	"IN": true, "INNER": true, "INTERSECT": true, "INTO": true, "JOIN": true,
+	"LEFT": true, "LIMIT": true, "OFFSET": true, "ON": true, "ORDER": true,
+	"OUTER": true, "OUTFILE": true, "PREWHERE": true, "RIGHT": true, "SAMPLE": true,
+	"SELECT": true, "SEMI": true, "SETTINGS": true, "UNION": true, "USING": true,
+	"VALUES": true, "WHERE": true, "WINDOW": true, "WITH": true,
+}
+
+// queryLexer splits ClickHouse query into tokens.
+type queryLexer struct {
+	q []byte
+}
+
+// next returns the next token from the query.
+//
+// false is returned at the end of the query.
+func (l *queryLexer) next() (queryToken, bool) {
+	l.q = skipLeadingComments(l.q)
+	for len(l.q) > 0 && l.q[0] == '#' {
+		// skip `# comment`
+		n := bytes.IndexByte(l.q, '\n')
+		if n < 0 {
+			l.q = nil
+			break
+		}
+		l.q = skipLeadingComments(l.q[n+1:])
+	}
+	if len(l.q) == 0 {
+		return queryToken{}, false
+	}
+
+	c := l.q[0]
+	switch {
+	case c == '\'':
+		return queryToken{kind: tokenLiteral, value: l.quoted('\'')}, true
+	case c == '`' || c == '"':
+		return queryToken{kind: tokenQuotedIdent, value: l.quoted(c)}, true
+	case isIdentStart(c):
+		n := 1
+		for n < len(l.q) && (isIdentStart(l.q[n]) || isDigit(l.q[n]) || l.q[n] == '$') {
+			n++
+		}
+		t := queryToken{kind: tokenIdent, value: string(l.q[:n])}
+		l.q = l.q[n:]
+		return t, true
+	case isDigit(c):
+		n := 1
+		for n < len(l.q) && (isIdentStart(l.q[n]) || isDigit(l.q[n]) || l.q[n] == '.') {
+			n++
+		}
+		t := queryToken{kind: tokenNumber, value: string(l.q[:n])}
+		l.q = l.q[n:]
+		return t, true
+	default:
+		t := queryToken{kind: tokenPunct, value: string(c)}
+		l.q = l.q[1:]
+		return t, true
+	}
+}
+
+// quoted reads the value quoted with q.
+func (l *queryLexer) quoted(q byte) string {
+	var b []byte
+	i := 1
+	for i < len(l.q) {
+		c := l.q[i]
+		switch {
+		case c == '\\' && i+1 < len(l.q):
+			b = append(b, l.q[i+1])
+			i += 2
+		case c == q && i+1 < len(l.q) && l.q[i+1] == q:
+			b = append(b, q)
+			i += 2
+		case c == q:
+			l.q = l.q[i+1:]
+			return string(b)
+		default:
+			b = append(b, c)
+			i++
+		}
+	}
+	l.q = nil
+	return string(b)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// normalizeQuery returns the query part of q in the normalized form.
+//
+// Comments are removed, tokens are separated by single spaces, keywords
+// are upper-cased, identifiers are unquoted and string literals are
+// quoted with single quotes. INSERT data isn't included.
+//
+// truncated must be set if q is the prefix of the query. The returned
+// bool is false if the query part of truncated q is incomplete.
+func normalizeQuery(q []byte, truncated bool) (string, bool) {
+	complete := !truncated
+	var b bytes.Buffer
+	l := &queryLexer{q: q}
+	var prev queryToken
+	var stmt string
+	depth := 0
+	for {
+		t, ok := l.next()
+		if !ok {
+			break
+		}
+		if len(stmt) == 0 && t.kind == tokenIdent {
+			stmt = strings.ToUpper(t.value)
+		}
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		}
+		if b.Len() > 0 && needsSpace(prev, t) {
+			b.WriteByte(' ')
+		}
+		switch t.kind {
+		case tokenIdent:
+			if kw := strings.ToUpper(t.value); reservedKeywords[kw] || queryStatements[kw] {
+				b.WriteString(kw)
+			} else {
+				b.WriteString(t.value)
+			}
+		case tokenLiteral:
+			b.WriteByte('\'')
+			b.WriteString(strings.Replace(strings.Replace(t.value, `\`, `\\`, -1), "'", `\'`, -1))
+			b.WriteByte('\'')
+		default:
+			b.WriteString(t.value)
+		}
+		if stmt == "INSERT" && depth == 0 && (t.isKeyword("VALUES") || t.isKeyword("FORMAT")) {
+			// The rest of the query contains INSERT data. Keep the format name.
+			if t.isKeyword("FORMAT") {
+				if f, ok := l.next(); ok {
+					b.WriteByte(' ')
+					b.WriteString(f.value)
+				}
+			}
+			complete = true
+			break
+		}
+		prev = t
+	}
+	return b.String(), complete
+}
+
+// needsSpace returns true if the normalized query must contain
+// a space between tokens a and b.
+func needsSpace(a, b queryToken) bool {
+	switch {
+	case a.isPunct(".") || b.isPunct("."):
+		return false
+	case a.isPunct("(") || b.isPunct(")") || b.isPunct(","):
+		return false
+	case b.isPunct("(") && (a.kind == tokenIdent || a.kind == tokenQuotedIdent):
+		return false
+	case a.kind == tokenPunct && b.kind == tokenPunct && isOperator(a.value) && isOperator(b.value):
+		return false
+	}
+	return true
+}
+
+func isOperator(s string) bool {
+	return strings.Contains("<>=!|-+*/%:?", s)
+}
+
+// maxStatementPeekSize is the maximum number of leading request body bytes
+// inspected for the query statement.
+const maxStatementPeekSize = 4096
+
+// getStatementClass returns the class of the query from req.
+//
+// See statementClass for the list of classes.
+func getStatementClass(req *http.Request) string {
+	stmt := queryStatement([]byte(req.URL.Query().Get("query")))
+	if len(stmt) == 0 && req.Method == http.MethodPost && getDecompressor(req) == nil &&
+		!strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
+		body, err := peekBody(req, maxStatementPeekSize)
+		if err == nil {
+			stmt = queryStatement(body)
+		}
+	}
+	return statementClass(stmt)
+}
+
+// queryStatement returns the upper-cased first keyword of q.
+func queryStatement(q []byte) string {
+	l := &queryLexer{q: q}
+	for {
+		t, ok := l.next()
+		if !ok {
+			return ""
+		}
+		if t.kind == tokenIdent {
+			return strings.ToUpper(t.value)
+		}
+		if !t.isPunct("(") {
+			return ""
+		}
+	}
+}
+
+// statementClass returns the class of the given statement:
+// `select`, `insert`, `ddl` or `other`.
+func statementClass(stmt string) string {
+	switch stmt {
+	case "SELECT", "WITH":
+		return "select"
+	case "INSERT":
+		return "insert"
+	case "CREATE", "DROP", "ALTER", "RENAME", "TRUNCATE", "ATTACH", "DETACH", "EXCHANGE":
+		return "ddl"
+	default:
+		return "other"
+	}
+}
+
+// queryRefs contains objects referenced by the query.
+type queryRefs struct {
+	// statement is the upper-cased first keyword of the query.
+	statement string
+
+	// databases contains explicitly referenced databases.
+	databases []string
+
+	// tables contains tables referenced without database,
+	// i.e. tables from the default database.
+	tables []string
+
+	// objects contains referenced tables and dictionaries.
+	objects []queryObject
+
+	// tableFunctions contains table functions used by the query.
+	tableFunctions []string
+
+	// unresolved contains descriptions of objects, which may reference
+	// databases in a way the analyzer cannot follow.
+	unresolved []string
+
+	// complete is false if the analyzed query has been truncated
+	// before INSERT data.
+	complete bool
+}
+
+// queryObject is a table or dictionary referenced by the query.
+type queryObject struct {
+	// database is empty if the object is referenced without database.
+	database string
+
+	// name is empty if the object cannot be determined,
+	// for example, for Merge table engine.
+	name string
+}
+
+// String returns the name of o qualified with the database if known.
+func (o queryObject) String() string {
+	if len(o.database) == 0 {
+		return o.name
+	}
+	return o.database + "." + o.name
+}
+
+// queryStatements contains statements recognized by analyzeQuery.
+var queryStatements = map[string]bool{
+	"SELECT": true, "WITH": true, "INSERT": true, "CREATE": true, "DROP": true,
+	"ALTER": true, "RENAME": true, "EXCHANGE": true, "TRUNCATE": true,
+	"OPTIMIZE": true, "CHECK": true, "DESCRIBE": true, "DESC": true,
+	"EXISTS": true, "SHOW": true, "USE": true, "DETACH": true, "ATTACH": true,
+	"SET": true, "EXPLAIN": true, "WATCH": true, "DELETE": true,
+}
+
+// accessEntities are managed by CREATE, ALTER and DROP
+// statements not recognized by analyzeQuery.
+var accessEntities = map[string]bool{
+	"USER": true, "ROLE": true, "QUOTA": true, "ROW": true, "POLICY": true,
+	"PROFILE": true, "SETTINGS": true,
+}
+
+// analyzeQuery returns objects referenced by q.
+//
+// Only the query part is analyzed for INSERT queries, so q may contain
+// arbitrary INSERT data. truncated must be set if q is the prefix
+// of the query.
+func analyzeQuery(q []byte, truncated bool) *queryRefs {
+	refs := &queryRefs{}
+
+	l := &queryLexer{q: q}
+	var toks []queryToken
+	depth := 0
+	for {
+		t, ok := l.next()
+		if !ok {
+			refs.complete = !truncated
+			break
+		}
+		if len(refs.statement) == 0 && t.kind == tokenIdent {
+			refs.statement = strings.ToUpper(t.value)
+		}
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		}
+		if refs.statement == "INSERT" && depth == 0 && (t.isKeyword("VALUES") || t.isKeyword("FORMAT")) {
+			// The rest of the query contains INSERT data.
+			refs.complete = true
+			break
+		}
+		toks = append(toks, t)
+	}
+
+	if !queryStatements[refs.statement] {
+		return refs
+	}
+	if len(toks) > 1 && accessEntities[strings.ToUpper(toks[1].value)] && toks[1].kind == tokenIdent {
+		// Access management queries aren't supported.
+		refs.statement += " " + strings.ToUpper(toks[1].value)
+		return refs
+	}
+
+	a := &queryAnalyzer{
+		toks: toks,
+		refs: refs,
+	}
+	a.analyze()
+	return refs
+}
+
+// queryAnalyzer collects objects referenced by query tokens.
+type queryAnalyzer struct {
+	toks []queryToken
+	refs *queryRefs
+
+	// subqueries contains flags for the currently open parens
+	// indicating whether the paren starts a subquery.
+	subqueries []bool
+
+	// showTables is set for SHOW TABLES and SHOW DICTIONARIES queries.
+	showTables bool
+
+	// selected is set after the first SELECT keyword.
+	selected bool
+}
+
+func (a *queryAnalyzer) tok(i int) queryToken {
+	if i < 0 || i >= len(a.toks) {
+		return queryToken{kind: tokenPunct}
+	}
+	return a.toks[i]
+}
+
+// inQuery returns true if the current position is at the top level
+// of the query or subquery.
+func (a *queryAnalyzer) inQuery() bool {
+	return len(a.subqueries) == 0 || a.subqueries[len(a.subqueries)-1]
+}
+
+func (a *queryAnalyzer) analyze() {
+	stmt := a.refs.statement
+	for i := 0; i < len(a.toks); i++ {
+		t := a.toks[i]
+		switch t.kind {
+		case tokenPunct:
+			switch t.value {
+			case "(":
+				next := a.tok(i + 1)
+				a.subqueries = append(a.subqueries, next.isKeyword("SELECT") || next.isKeyword("WITH"))
+			case ")":
+				if len(a.subqueries) > 0 {
+					a.subqueries = a.subqueries[:len(a.subqueries)-1]
+				}
+			}
+			continue
+		case tokenIdent:
+		default:
+			continue
+		}
+
+		if a.tok(i + 1).isPunct("(") {
+			a.function(i)
+			continue
+		}
+
+		kw := strings.ToUpper(t.value)
+		switch kw {
+		case "SELECT":
+			a.selected = true
+		case "TABLES", "DICTIONARIES":
+			if stmt == "SHOW" {
+				a.showTables = true
+			}
+			if stmt == "EXCHANGE" {
+				a.names(i+1, true, false)
+			}
+		case "FROM", "IN":
+			if stmt == "SHOW" && a.showTables {
+				a.database(i + 1)
+				continue
+			}
+			if kw == "IN" {
+				a.names(i+1, false, false)
+				continue
+			}
+			if a.inQuery() {
+				a.names(i+1, true, true)
+			}
+		case "JOIN":
+			if a.inQuery() && !a.tok(i-1).isKeyword("ARRAY") {
+				a.names(i+1, false, true)
+			}
+		case "INTO", "TABLE", "VIEW", "DICTIONARY":
+			a.names(i+1, true, false)
+		case "DATABASE", "USE":
+			a.database(i + 1)
+		case "TO":
+			if stmt == "RENAME" || stmt == "CREATE" {
+				a.names(i+1, false, false)
+			}
+		case "AND":
+			if stmt == "EXCHANGE" {
+				a.names(i+1, false, false)
+			}
+		case "AS":
+			if stmt == "CREATE" && len(a.subqueries) == 0 && !a.selected {
+				a.names(i+1, false, true)
+			}
+		case "ENGINE":
+			if a.tok(i+1).isPunct("=") && a.tok(i+3).isPunct("(") {
+				a.engine(i + 2)
+				i += 2
+			}
+		case "DESCRIBE", "DESC", "EXISTS", "TRUNCATE", "WATCH", "CREATE":
+			// These keywords may be directly followed by the table name
+			// only at the beginning of the query. Names following modifiers
+			// such as TABLE are collected on the modifier.
+			if j, _ := a.skipModifiers(i + 1); j != i+1 {
+				continue
+			}
+			if (i == 0 && kw != "CREATE") || (stmt == "SHOW" && kw == "CREATE") {
+				a.names(i+1, false, false)
+			}
+		}
+	}
+}
+
+// names collects object names starting at the token i.
+//
+// Modifiers such as `IF NOT EXISTS` are skipped. Comma-separated names
+// are collected if list is set. Names followed by paren are treated
+// as table functions if funcs is set or the name follows FUNCTION modifier.
+func (a *queryAnalyzer) names(i int, list, funcs bool) {
+	for {
+		var fn bool
+		i, fn = a.skipModifiers(i)
+		t := a.tok(i)
+		if t.isPunct("{") {
+			a.param(i)
+			return
+		}
+		if !t.isName() || t.isKeyword("DATABASE") {
+			return
+		}
+		if a.tok(i+1).isPunct("(") && (funcs || fn) {
+			// Table functions are processed by the main loop.
+			return
+		}
+		if a.tok(i+1).isPunct(".") && a.tok(i+2).isPunct("{") {
+			a.param(i + 2)
+			return
+		}
+		if a.tok(i+1).isPunct(".") && a.tok(i+2).isName() {
+			a.refs.databases = append(a.refs.databases, t.value)
+			a.object(t.value, a.tok(i+2).value)
+			i += 3
+		} else {
+			a.refs.tables = append(a.refs.tables, t.value)
+			a.object("", t.value)
+			i++
+		}
+		if !list {
+			return
+		}
+
+		// Skip alias and FINAL modifier.
+		if a.tok(i).isKeyword("AS") {
+			i += 2
+		} else if a.tok(i).isName() {
+			i++
+		}
+		if a.tok(i).isKeyword("FINAL") {
+			i++
+		}
+		if !a.tok(i).isPunct(",") {
+			return
+		}
+		i++
+	}
+}
+
+// object collects the table or dictionary name in the database.
+func (a *queryAnalyzer) object(database, name string) {
+	a.refs.objects = append(a.refs.objects, queryObject{
+		database: database,
+		name:     name,
+	})
+}
+
+// skipModifiers returns the index of the first token after modifiers
+// starting at the token i and whether FUNCTION modifier has been skipped.
+func (a *queryAnalyzer) skipModifiers(i int) (int, bool) {
+	var fn bool
+	for {
+		t := a.tok(i)
+		if t.kind != tokenIdent {
+			return i, fn
+		}
+		switch strings.ToUpper(t.value) {
+		case "FUNCTION":
+			fn = true
+			i++
+		case "IF", "NOT", "EXISTS", "TEMPORARY", "TABLE", "VIEW", "DICTIONARY",
+			"MATERIALIZED", "LIVE", "ONLY", "OR", "REPLACE":
+			i++
+		default:
+			return i, fn
+		}
+	}
+}
+
+// database collects the database name at the token i.
+func (a *queryAnalyzer) database(i int) {
+	i, _ = a.skipModifiers(i)
+	t := a.tok(i)
+	if t.isPunct("{") {
+		a.param(i)
+		return
+	}
+	if t.isName() {
+		a.refs.databases = append(a.refs.databases, t.value)
+	}
+}
+
+// param processes the query parameter placeholder `{name:Type}`
+// at the token i in the place of a database or table name.
+//
+// Identifier parameters substitute arbitrary names from `param_<name>`
+// request args, so such references cannot be checked.
+func (a *queryAnalyzer) param(i int) {
+	var toks []string
+	for j := i + 1; j < len(a.toks) && !a.toks[j].isPunct("}"); j++ {
+		toks = append(toks, a.toks[j].value)
+	}
+	if len(toks) != 3 || toks[1] != ":" || !strings.EqualFold(toks[2], "Identifier") {
+		return
+	}
+	a.refs.unresolved = append(a.refs.unresolved, "the query parameter {"+strings.Join(toks, "")+"}")
+}
+
+// function processes the function call at the token i.
+func (a *queryAnalyzer) function(i int) {
+	name := a.toks[i].value
+	lname := strings.ToLower(name)
+
+	// Dictionaries and Join tables are referenced by string literals.
+	if strings.HasPrefix(lname, "dict") || strings.HasPrefix(lname, "joinget") {
+		if arg := a.tok(i + 2); arg.kind == tokenLiteral {
+			a.qualifiedName(arg.value)
+		} else {
+			a.refs.unresolved = append(a.refs.unresolved, "the first argument of "+name)
+		}
+		return
+	}
+
+	// External ClickHouse dictionary source.
+	if strings.ToUpper(name) == "CLICKHOUSE" && a.refs.statement == "CREATE" {
+		a.dictionarySource(i + 1)
+		return
+	}
+
+	// Table functions follow FROM, JOIN, INTO FUNCTION or AS
+	// with optional modifiers.
+	j := i - 1
+	var fn bool
+	for ; j >= 0 && a.toks[j].kind == tokenIdent; j-- {
+		t := a.toks[j]
+		if t.isKeyword("FUNCTION") {
+			fn = true
+		} else if !t.isKeyword("TABLE") {
+			break
+		}
+	}
+	prev := a.tok(j)
+	if (a.inQuery() && (prev.isKeyword("FROM") || prev.isKeyword("JOIN"))) ||
+		(prev.isKeyword("INTO") && fn) ||
+		(prev.isKeyword("AS") && a.refs.statement == "CREATE" && !a.selected) {
+		a.refs.tableFunctions = append(a.refs.tableFunctions, name)
+	}
+}
+
+// dictionarySource processes the source of ClickHouse dictionary
+// with the open paren at the token i.
+func (a *queryAnalyzer) dictionarySource(i int) {
+	args := a.args(i)
+	if len(args) == 0 {
+		return
+	}
+	var db, table string
+	arg := args[0]
+	for j := 0; j+1 < len(arg); j++ {
+		switch {
+		case arg[j].isKeyword("DB"):
+			db = arg[j+1].value
+		case arg[j].isKeyword("TABLE"):
+			table = arg[j+1].value
+		case arg[j].isKeyword("QUERY"):
+			a.refs.unresolved = append(a.refs.unresolved, "QUERY of CLICKHOUSE dictionary source")
+		}
+	}
+	switch {
+	case len(db) > 0:
+		a.refs.databases = append(a.refs.databases, db)
+	case len(table) > 0:
+		a.refs.tables = append(a.refs.tables, table)
+	}
+	if len(db) > 0 || len(table) > 0 {
+		a.object(db, table)
+	}
+}
+
+// engine processes the table engine at the token i.
+func (a *queryAnalyzer) engine(i int) {
+	name := a.toks[i].value
+	args := a.args(i + 1)
+	value := func(n int) (string, bool) {
+		if n >= len(args) || len(args[n]) != 1 || (!args[n][0].isName() && args[n][0].kind != tokenLiteral) {
+			return "", false
+		}
+		return args[n][0].value, true
+	}
+	// arg collects the database from the argument n and the table
+	// from the argument n+1 if table is set.
+	arg := func(n int, table bool) {
+		db, ok := value(n)
+		if !ok {
+			a.refs.unresolved = append(a.refs.unresolved, "the database of "+name+" table engine")
+			return
+		}
+		a.refs.databases = append(a.refs.databases, db)
+		var t string
+		if table {
+			t, _ = value(n + 1)
+		}
+		a.object(db, t)
+	}
+	switch name {
+	case "Distributed":
+		arg(1, true)
+	case "Buffer":
+		arg(0, true)
+	case "Merge":
+		// Merge tables are matched by regexp.
+		arg(0, false)
+	case "Dictionary":
+		switch {
+		case len(args) > 0 && len(args[0]) == 1:
+			a.qualifiedName(args[0][0].value)
+		case len(args) > 0 && len(args[0]) == 3 && args[0][1].isPunct("."):
+			a.refs.databases = append(a.refs.databases, args[0][0].value)
+			a.object(args[0][0].value, args[0][2].value)
+		default:
+			a.refs.unresolved = append(a.refs.unresolved, "the database of "+name+" table engine")
+		}
+	}
+}
+
+// args returns top-level arguments of the call with the open paren
+// at the token i.
+func (a *queryAnalyzer) args(i int) [][]queryToken {
+	var args [][]queryToken
+	var arg []queryToken
+	depth := 0
+	for i++; i < len(a.toks); i++ {
+		t := a.toks[i]
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			if depth == 0 {
+				if len(arg) > 0 {
+					args = append(args, arg)
+				}
+				return args
+			}
+			depth--
+		case t.isPunct(",") && depth == 0:
+			args = append(args, arg)
+			arg = nil
+			continue
+		}
+		arg = append(arg, t)
+	}
+	return append(args, arg)
+}
+
+// qualifiedName collects the object referenced by `db.name` or `name` string.
+func (a *queryAnalyzer) qualifiedName(s string) {
+	if n := strings.IndexByte(s, '.'); n >= 0 {
+		a.refs.databases = append(a.refs.databases, s[:n])
+		a.object(s[:n], s[n+1:])
+		return
+	}
+	a.refs.tables = append(a.refs.tables, s)
+	a.object("", s)
+}
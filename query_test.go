@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeQuery(t *testing.T) {
+	f := func(q string, databases, tables, tableFunctions []string) {
+		t.Helper()
+		refs := analyzeQuery([]byte(q), false)
+		if !refs.complete {
+			t.Fatalf("expecting complete analysis for %q", q)
+		}
+		if !reflect.DeepEqual(refs.databases, databases) {
+			t.Fatalf("unexpected databases for %q: %q; expecting %q", q, refs.databases, databases)
+		}
+		if !reflect.DeepEqual(refs.tables, tables) {
+			t.Fatalf("unexpected tables for %q: %q; expecting %q", q, refs.tables, tables)
+		}
+		if !reflect.DeepEqual(refs.tableFunctions, tableFunctions) {
+			t.Fatalf("unexpected table functions for %q: %q; expecting %q", q, refs.tableFunctions, tableFunctions)
+		}
+	}
+
+	f("SELECT 1", nil, nil, nil)
+	f("select * from db.t", []string{"db"}, nil, nil)
+	f("SELECT * FROM t WHERE x = 'FROM db.t' -- FROM other.t", nil, []string{"t"}, nil)
+	f("/* FROM other.t */ SELECT * FROM `db`.\"t\" AS a, db2.t2 b FINAL, t3", []string{"db", "db2"}, []string{"t3"}, nil)
+	f("SELECT * FROM db.t1 LEFT JOIN db2.t2 USING x ARRAY JOIN arr", []string{"db", "db2"}, nil, nil)
+	f("SELECT * FROM (SELECT x FROM db.t) WHERE x IN (SELECT x FROM db2.t) AND y IN db3.t",
+		[]string{"db", "db2", "db3"}, nil, nil)
+	f("SELECT extract(s FROM 'x'), substring(s FROM 2) FROM db.t", []string{"db"}, nil, nil)
+	f("SELECT dictGet('db.dict', 'attr', x) FROM numbers(10)", []string{"db"}, nil, []string{"numbers"})
+	f("SELECT * FROM remote('host', db.t)", nil, nil, []string{"remote"})
+	f("WITH x AS (SELECT 1) SELECT * FROM x", nil, []string{"x"}, nil)
+	f("INSERT INTO db.t (a, b) VALUES ('FROM other.t', 1)", []string{"db"}, nil, nil)
+	f("INSERT INTO t FORMAT TSV\nFROM other.t", nil, []string{"t"}, nil)
+	f("INSERT INTO FUNCTION remote('host', db.t) SELECT 1", nil, nil, []string{"remote"})
+	f("INSERT INTO db.t SELECT * FROM db2.t", []string{"db", "db2"}, nil, nil)
+	f("CREATE TABLE IF NOT EXISTS db.t (x UInt8) ENGINE = Distributed(c, db2, t)", []string{"db", "db2"}, nil, nil)
+	f("CREATE TABLE t(x UInt8) ENGINE = Merge('db', '^t')", []string{"db"}, []string{"t"}, nil)
+	f("CREATE TABLE db.t AS db2.t", []string{"db", "db2"}, nil, nil)
+	f("CREATE MATERIALIZED VIEW db.v TO db2.t AS SELECT x AS y FROM db3.t", []string{"db", "db2", "db3"}, nil, nil)
+	f("CREATE DATABASE db", []string{"db"}, nil, nil)
+	f("DROP TABLE IF EXISTS db.t", []string{"db"}, nil, nil)
+	f("RENAME TABLE db.a TO db2.b", []string{"db", "db2"}, nil, nil)
+	f("EXCHANGE TABLES db.a AND db2.b", []string{"db", "db2"}, nil, nil)
+	f("ALTER TABLE db.t MOVE PARTITION 1 TO TABLE db2.t", []string{"db", "db2"}, nil, nil)
+	f("DESCRIBE db.t", []string{"db"}, nil, nil)
+	f("SHOW TABLES FROM db", []string{"db"}, nil, nil)
+	f("SHOW CREATE TABLE db.t", []string{"db"}, nil, nil)
+	f("USE db", []string{"db"}, nil, nil)
+}
+
+func TestAnalyzeQueryObjects(t *testing.T) {
+	f := func(q string, objects ...string) {
+		t.Helper()
+		refs := analyzeQuery([]byte(q), false)
+		var got []string
+		for _, o := range refs.objects {
+			got = append(got, o.String())
+		}
+		if !reflect.DeepEqual(got, objects) {
+			t.Fatalf("unexpected objects for %q: %q; expecting %q", q, got, objects)
+		}
+	}
+
+	f("SELECT 1")
+	f("SELECT * FROM db.t1 a JOIN t2 USING x", "db.t1", "t2")
+	f("SELECT dictGet('db.dict', 'attr', x) FROM numbers(10)", "db.dict")
+	f("INSERT INTO db.t SELECT * FROM db2.t WHERE x IN (SELECT x FROM db3.t)", "db.t", "db2.t", "db3.t")
+	f("CREATE TABLE db.t (x UInt8) ENGINE = Distributed(c, db2, t2)", "db.t", "db2.t2")
+	f("CREATE TABLE db.t (x UInt8) ENGINE = Merge(db2, '^t')", "db.t", "db2.")
+	f("CREATE DATABASE db")
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	f := func(q, expected string) {
+		t.Helper()
+		s, complete := normalizeQuery([]byte(q), false)
+		if !complete {
+			t.Fatalf("expecting complete query for %q", q)
+		}
+		if s != expected {
+			t.Fatalf("unexpected normalized query for %q: %q; expecting %q", q, s, expected)
+		}
+	}
+
+	f("", "")
+	f("select 1", "SELECT 1")
+	f("/* c */ select *\n\tfrom `db`.\"t\"  where x >= 1 -- c\n limit 10", "SELECT * FROM db.t WHERE x >= 1 LIMIT 10")
+	f("SELECT count( * ), sum(x) FROM t WHERE s = 'it''s'", `SELECT count(*), sum(x) FROM t WHERE s = 'it\'s'`)
+	f("insert into t (a, b) format CSV\n1,2", "INSERT INTO t(a, b) FORMAT CSV")
+	f("INSERT INTO t VALUES (1, 'a')", "INSERT INTO t VALUES")
+}
+
+func TestAnalyzeQueryStatement(t *testing.T) {
+	f := func(q, statement string) {
+		t.Helper()
+		refs := analyzeQuery([]byte(q), false)
+		if refs.statement != statement {
+			t.Fatalf("unexpected statement for %q: %q; expecting %q", q, refs.statement, statement)
+		}
+	}
+	f("  -- comment\n select 1", "SELECT")
+	f("(SELECT 1) UNION ALL (SELECT 2)", "SELECT")
+	f("system drop dns cache", "SYSTEM")
+	f("CREATE USER foo", "CREATE USER")
+	f("KILL QUERY WHERE 1", "KILL")
+}
+
+func TestAnalyzeQueryTruncated(t *testing.T) {
+	refs := analyzeQuery([]byte("SELECT * FROM db.t WHERE x IN (SELECT"), true)
+	if refs.complete {
+		t.Fatalf("truncated query must be incomplete")
+	}
+	refs = analyzeQuery([]byte("INSERT INTO db.t FORMAT CSV\n1,2\n3,"), true)
+	if !refs.complete {
+		t.Fatalf("truncated INSERT data mustn't prevent complete analysis")
+	}
+}
+
+func TestGetStatementClass(t *testing.T) {
+	f := func(method, url, body, expected string) {
+		t.Helper()
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if class := getStatementClass(req); class != expected {
+			t.Fatalf("unexpected class for %s %q with body %q: %q; expecting %q", method, url, body, class, expected)
+		}
+		b, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if string(b) != body {
+			t.Fatalf("the request body must be preserved; got %q; expecting %q", b, body)
+		}
+	}
+
+	f("GET", "http://localhost?query=SELECT+1", "", "select")
+	f("POST", "http://localhost", "/* comment */ (select 1)", "select")
+	f("POST", "http://localhost", "WITH 1 AS x SELECT x", "select")
+	f("POST", "http://localhost?query=INSERT+INTO+t+FORMAT+TSV", "1\t2", "insert")
+	f("POST", "http://localhost", "insert into t values (1)", "insert")
+	f("POST", "http://localhost", "CREATE TABLE t (x UInt8) ENGINE = Memory", "ddl")
+	f("POST", "http://localhost", "ALTER TABLE t DELETE WHERE 1", "ddl")
+	f("POST", "http://localhost", "SYSTEM DROP DNS CACHE", "other")
+	f("POST", "http://localhost", "", "other")
+}
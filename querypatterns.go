@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// compileQueryPatterns compiles the given query patterns.
+func compileQueryPatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse query pattern %q: %s", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// checkQueryPatterns verifies the normalized query from req matches
+// `allow_query_patterns` and doesn't match `deny_query_patterns`
+// of the user.
+//
+// See normalizeQuery for the normalized query format.
+func (s *scope) checkQueryPatterns(req *http.Request) error {
+	u := s.user
+	if len(u.allowQueryPatterns) == 0 && len(u.denyQueryPatterns) == 0 {
+		return nil
+	}
+	b, truncated, err := peekQuery(req, maxTenantQuerySize)
+	if err != nil {
+		return fmt.Errorf("cannot read query: %s", err)
+	}
+	q, complete := normalizeQuery(b, truncated)
+	if !complete {
+		return fmt.Errorf("queries exceeding %d bytes cannot be checked for query patterns", maxTenantQuerySize)
+	}
+	if len(q) == 0 {
+		// Requests without query such as `/ping` aren't checked.
+		return nil
+	}
+	return u.checkNormalizedQuery(q)
+}
+
+// checkNormalizedQuery verifies the normalized query q is allowed for u.
+func (u *user) checkNormalizedQuery(q string) error {
+	for _, re := range u.denyQueryPatterns {
+		if re.MatchString(q) {
+			return fmt.Errorf("query is denied by `deny_query_patterns` regexp %q", re)
+		}
+	}
+	if len(u.allowQueryPatterns) == 0 {
+		return nil
+	}
+	for _, re := range u.allowQueryPatterns {
+		if re.MatchString(q) {
+			return nil
+		}
+	}
+	return fmt.Errorf("query doesn't match `allow_query_patterns`")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckQueryPatterns(t *testing.T) {
+	deny, err := compileQueryPatterns([]string{`^SELECT \* FROM huge_table$`, `(?i)\bsleep\(`})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	allow, err := compileQueryPatterns([]string{`^(SELECT|INSERT|WITH) `})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s := &scope{
+		user: &user{
+			allowQueryPatterns: allow,
+			denyQueryPatterns:  deny,
+		},
+	}
+	f := func(req *http.Request, expectedErr string) {
+		t.Helper()
+		err := s.checkQueryPatterns(req)
+		if len(expectedErr) == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting error %q", expectedErr)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("unexpected error %q; expecting %q", err, expectedErr)
+		}
+	}
+	post := func(q string) *http.Request {
+		return httptest.NewRequest("POST", "http://localhost", strings.NewReader(q))
+	}
+
+	f(post("SELECT * FROM huge_table LIMIT 10"), "")
+	f(post(""), "")
+	f(post("select *\n  from `huge_table` -- full scan"), "denied by `deny_query_patterns`")
+	f(post("SELECT SLEEP(3)"), "denied by `deny_query_patterns`")
+	f(post("DROP TABLE t"), "doesn't match `allow_query_patterns`")
+	f(httptest.NewRequest(http.MethodGet, "http://localhost?query=select+*+from+huge_table", nil), "denied by `deny_query_patterns`")
+
+	// INSERT data mustn't be checked.
+	data := bytes.Repeat([]byte("SELECT * FROM huge_table\n"), maxTenantQuerySize)
+	f(post("INSERT INTO t FORMAT TSV\n"+string(data)), "")
+
+	// Long queries cannot be checked.
+	f(post("SELECT * FROM t WHERE x IN ("+strings.Repeat("1,", maxTenantQuerySize)+"1)"), "cannot be checked")
+}
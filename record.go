@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// recordedRequest is a sanitized proxied request.
+type recordedRequest struct {
+	Time    time.Time         `json:"time"`
+	User    string            `json:"user"`
+	Cluster string            `json:"cluster"`
+	Params  map[string]string `json:"params,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// requestRecorder records proxied requests to the file.
+type requestRecorder struct {
+	path         string
+	maxQuerySize int
+
+	// mu protects f from concurrent access.
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newRequestRecorder(cfg config.Recording) (*requestRecorder, error) {
+	f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRecorder{
+		path:         cfg.File,
+		maxQuerySize: int(cfg.MaxQuerySize),
+		f:            f,
+	}, nil
+}
+
+// wrapBody wraps req.Body, so its start may be recorded after
+// the request is proxied.
+func (rr *requestRecorder) wrapBody(req *http.Request) *recordingReadCloser {
+	rrc := &recordingReadCloser{
+		ReadCloser: req.Body,
+		limit:      rr.maxQuerySize,
+	}
+	req.Body = rrc
+	return rrc
+}
+
+// record writes sanitized request to the file.
+//
+// Requests with truncated or compressed bodies aren't recorded,
+// since they cannot be replayed.
+func (rr *requestRecorder) record(s *scope, req *http.Request, origParams url.Values, body *recordingReadCloser) {
+	if req.Method == http.MethodPost {
+		if strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") || getDecompressor(req) != nil {
+			log.Debugf("%s: request isn't recorded, since its body is compressed or contains external data", s)
+			return
+		}
+	}
+	b, ok := body.bytes()
+	if !ok {
+		log.Debugf("%s: request isn't recorded, since its body exceeds %d bytes", s, rr.maxQuerySize)
+		return
+	}
+
+	r := recordedRequest{
+		Time:    s.startTime,
+		User:    s.user.name,
+		Cluster: s.cluster.name,
+		Body:    string(b),
+	}
+	// Keep only params, which are proxied to ClickHouse.
+	for _, param := range allowedParams {
+		if val := origParams.Get(param); len(val) > 0 {
+			if r.Params == nil {
+				r.Params = make(map[string]string)
+			}
+			r.Params[param] = val
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("%s: cannot marshal recorded request: %s", s, err)
+		return
+	}
+	data = append(data, '\n')
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.f == nil {
+		// The recorder has been closed on config reload.
+		return
+	}
+	if _, err := rr.f.Write(data); err != nil {
+		log.Errorf("%s: cannot record request: %s", s, err)
+	}
+}
+
+func (rr *requestRecorder) Close() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.f == nil {
+		return nil
+	}
+	err := rr.f.Close()
+	rr.f = nil
+	return err
+}
+
+// reopen reopens the file, so requests are recorded into a new file
+// after external rotation.
+func (rr *requestRecorder) reopen() error {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	if rr.f == nil {
+		// The recorder has been closed on config reload.
+		return nil
+	}
+	f, err := os.OpenFile(rr.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	rr.f.Close()
+	rr.f = f
+	return nil
+}
+
+// recordingReadCloser holds up to limit bytes read from the wrapped
+// ReadCloser.
+type recordingReadCloser struct {
+	io.ReadCloser
+
+	limit int
+
+	// bLock protects b and truncated from concurrent access.
+	bLock     sync.Mutex
+	b         bytes.Buffer
+	truncated bool
+}
+
+func (rrc *recordingReadCloser) Read(p []byte) (int, error) {
+	n, err := rrc.ReadCloser.Read(p)
+
+	rrc.bLock.Lock()
+	if !rrc.truncated {
+		if rrc.b.Len()+n > rrc.limit {
+			rrc.truncated = true
+			rrc.b.Reset()
+		} else {
+			rrc.b.Write(p[:n])
+		}
+	}
+	rrc.bLock.Unlock()
+
+	return n, err
+}
+
+// bytes returns the read data.
+//
+// false is returned if the data exceeds the limit.
+func (rrc *recordingReadCloser) bytes() ([]byte, bool) {
+	rrc.bLock.Lock()
+	defer rrc.bLock.Unlock()
+	if rrc.truncated {
+		return nil, false
+	}
+	return append([]byte(nil), rrc.b.Bytes()...), true
+}
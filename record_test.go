@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestRequestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-recording")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := *authCfg
+	cfg.Recording = config.Recording{
+		File:         filepath.Join(dir, "requests.log"),
+		MaxQuerySize: 16,
+	}
+	p, err := getProxy(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	uri := fmt.Sprintf("%s?user=foo&password=bar&database=db&no_cache=1", fakeServer.URL)
+	// fakeServer treats request body as response delay.
+	req := httptest.NewRequest("POST", uri, bytes.NewBufferString("1ms"))
+	makeCustomRequest(p, req).Body.Close()
+
+	// Too long query mustn't be recorded.
+	req = httptest.NewRequest("POST", uri, bytes.NewBufferString("0.00000000000001s"))
+	makeCustomRequest(p, req).Body.Close()
+
+	// Close the recorder by applying config without recording.
+	if err := p.applyConfig(authCfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(cfg.Recording.File)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected number of recorded requests: %d; expected: %d; recorded: %q", len(lines), 1, data)
+	}
+	var rr recordedRequest
+	if err := json.Unmarshal([]byte(lines[0]), &rr); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if rr.User != "foo" || rr.Cluster != "cluster" || rr.Body != "1ms" {
+		t.Fatalf("unexpected recorded request: %+v", rr)
+	}
+	if len(rr.Params) != 1 || rr.Params["database"] != "db" {
+		t.Fatalf("unexpected recorded params: %v; expected only `database`", rr.Params)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		passwords := map[string]string{"default": "qwerty", "reports": "secret"}
+		if p, ok := passwords[user]; !ok || p != pass {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		queries = append(queries, user+":"+r.URL.Query().Get("database")+":"+string(b))
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	now := time.Now()
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	users := []string{"web", "analyst"}
+	for i := 0; i < 3; i++ {
+		data, err := json.Marshal(recordedRequest{
+			Time:   now.Add(time.Duration(i) * 50 * time.Millisecond),
+			User:   users[i%2],
+			Params: map[string]string{"database": "db"},
+			Body:   fmt.Sprintf("SELECT %d", i),
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		fmt.Fprintf(w, "%s\n", data)
+	}
+	w.Flush()
+
+	target, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	r := &replayer{
+		target:   target,
+		user:     "default",
+		password: "qwerty",
+		users: map[string]replayCredentials{
+			"analyst": {User: "reports", Password: "secret"},
+		},
+		speed:       2,
+		concurrency: 1,
+		client:      &http.Client{},
+	}
+	start := time.Now()
+	if err := r.replay(&buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Fatalf("requests were replayed too fast: %s", d)
+	}
+	if r.sent != 3 || r.failed != 0 {
+		t.Fatalf("unexpected replay stats: sent %d; failed %d", r.sent, r.failed)
+	}
+	expected := []string{"default:db:SELECT 0", "reports:db:SELECT 1", "default:db:SELECT 2"}
+	if strings.Join(queries, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected replayed queries: %q; expected: %q", queries, expected)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal Redis client speaking RESP protocol.
+//
+// It supports only the commands required by chproxy.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu     sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+// maxIdleRedisConns is the maximum number of idle connections
+// kept by redisClient.
+const maxIdleRedisConns = 16
+
+type redisConn struct {
+	net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+// redisError is an error returned by Redis server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func newRedisClient(addr, password string, db int, timeout time.Duration) *redisClient {
+	return &redisClient{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+	}
+}
+
+// do executes the given command and returns its reply.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(c.timeout, args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// The connection may be in inconsistent state.
+			conn.Close()
+			return nil, err
+		}
+	}
+	c.putConn(conn)
+	return reply, err
+}
+
+// doInt executes the given command with integer reply.
+func (c *redisClient) doInt(args ...string) (int64, error) {
+	reply, err := c.do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply for %q: %v", args[0], reply)
+	}
+	return n, nil
+}
+
+func (c *redisClient) getConn() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+	return c.dial()
+}
+
+// dial establishes new authenticated connection to Redis.
+func (c *redisClient) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{
+		Conn: nc,
+		br:   bufio.NewReader(nc),
+		bw:   bufio.NewWriter(nc),
+	}
+	if len(c.password) > 0 {
+		if _, err := conn.do(c.timeout, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot authenticate in redis: %s", err)
+		}
+	}
+	if c.db > 0 {
+		if _, err := conn.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("cannot select redis db %d: %s", c.db, err)
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisClient) putConn(conn *redisConn) {
+	c.mu.Lock()
+	if c.closed || len(c.idle) >= maxIdleRedisConns {
+		c.mu.Unlock()
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+	c.mu.Unlock()
+}
+
+// Close closes idle connections. Connections in use are closed
+// as soon as they are returned.
+func (c *redisClient) Close() {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.closed = true
+	c.mu.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+}
+
+// subscribe subscribes to the given channel on a dedicated connection
+// and calls f for each received message.
+//
+// It returns nil when stopCh is closed and an error
+// if the connection fails.
+func (c *redisClient) subscribe(channel string, stopCh <-chan struct{}, f func(msg []byte)) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.do(c.timeout, "SUBSCRIBE", channel); err != nil {
+		return fmt.Errorf("cannot subscribe to redis channel %q: %s", channel, err)
+	}
+	// Messages may arrive at any time.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	go func() {
+		select {
+		case <-stopCh:
+			// Interrupt blocked read.
+			conn.Close()
+		case <-doneCh:
+		}
+	}()
+	for {
+		reply, err := readRedisReply(conn.br)
+		if err != nil {
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				return err
+			}
+		}
+		a, ok := reply.([]interface{})
+		if !ok || len(a) != 3 {
+			return fmt.Errorf("unexpected redis message: %v", reply)
+		}
+		if kind, _ := a[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		msg, _ := a[2].([]byte)
+		f(msg)
+	}
+}
+
+func (conn *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conn.bw, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(conn.bw, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := conn.bw.Flush(); err != nil {
+		return nil, err
+	}
+	return readRedisReply(conn.br)
+}
+
+// readRedisReply reads RESP reply from br.
+//
+// Bulk strings are returned as []byte, integers as int64,
+// arrays as []interface{} and nil bulk strings as nil.
+func readRedisReply(br *bufio.Reader) (interface{}, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	payload := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return nil, redisError(payload)
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis bulk string length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis array length %q", payload)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readRedisReply(br); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vertamedia/chproxy/log"
+	"gopkg.in/yaml.v2"
+)
+
+// replayCredentials are credentials on the target for a recorded user.
+type replayCredentials struct {
+	User     string `yaml:"user"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// replayer re-executes recorded requests against the target.
+type replayer struct {
+	target   *url.URL
+	user     string
+	password string
+
+	// users maps recorded user names to credentials on the target.
+	// Requests of users missing in the map are sent with user and password.
+	users map[string]replayCredentials
+
+	// speed is a multiplier for the original pace of requests.
+	// Requests are replayed as fast as possible if speed is zero.
+	speed float64
+
+	concurrency int
+
+	client *http.Client
+
+	sent   uint64
+	failed uint64
+}
+
+// runReplay implements `chproxy replay` command.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "File with recorded requests")
+	target := fs.String("target", "", "Target URL to send requests to, for example http://clickhouse:8123")
+	user := fs.String("user", "", "User name for the target")
+	password := fs.String("password", "", "User password for the target")
+	usersFile := fs.String("users", "", "Optional YAML file mapping recorded user names to `user` and `password` on the target. "+
+		"Requests of users missing in the file are sent with -user and -password")
+	speed := fs.Float64("speed", 1, "Multiplier for the original pace of requests. Zero means as fast as possible")
+	concurrency := fs.Int("concurrency", 100, "Maximum number of concurrently replayed requests")
+	fs.Parse(args)
+
+	if len(*file) == 0 || len(*target) == 0 {
+		return fmt.Errorf("both -file and -target must be set")
+	}
+	u, err := url.Parse(*target)
+	if err != nil {
+		return fmt.Errorf("cannot parse -target %q: %s", *target, err)
+	}
+	if *speed < 0 {
+		return fmt.Errorf("-speed cannot be negative")
+	}
+	if *concurrency <= 0 {
+		return fmt.Errorf("-concurrency must be positive")
+	}
+	var users map[string]replayCredentials
+	if len(*usersFile) > 0 {
+		if users, err = loadReplayUsers(*usersFile); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := &replayer{
+		target:      u,
+		user:        *user,
+		password:    *password,
+		users:       users,
+		speed:       *speed,
+		concurrency: *concurrency,
+		client:      &http.Client{},
+	}
+	startTime := time.Now()
+	if err := r.replay(f); err != nil {
+		return err
+	}
+	log.Infof("Replayed %d requests in %s; failed: %d",
+		atomic.LoadUint64(&r.sent), time.Since(startTime), atomic.LoadUint64(&r.failed))
+	return nil
+}
+
+func loadReplayUsers(filename string) (map[string]replayCredentials, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]replayCredentials
+	if err := yaml.UnmarshalStrict(data, &users); err != nil {
+		return nil, fmt.Errorf("cannot parse -users file %q: %s", filename, err)
+	}
+	for name, c := range users {
+		if len(c.User) == 0 {
+			return nil, fmt.Errorf("`user` must be set for recorded user %q in %q", name, filename)
+		}
+	}
+	return users, nil
+}
+
+// replay sends recorded requests from rd to the target
+// preserving their relative timing.
+func (r *replayer) replay(rd io.Reader) error {
+	sem := make(chan struct{}, r.concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var firstTime time.Time
+	startTime := time.Now()
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(nil, 64<<20)
+	for sc.Scan() {
+		var rr recordedRequest
+		if err := json.Unmarshal(sc.Bytes(), &rr); err != nil {
+			return fmt.Errorf("cannot parse recorded request %q: %s", sc.Bytes(), err)
+		}
+		if firstTime.IsZero() {
+			firstTime = rr.Time
+		}
+		if r.speed > 0 {
+			offset := time.Duration(float64(rr.Time.Sub(firstTime)) / r.speed)
+			if d := time.Until(startTime.Add(offset)); d > 0 {
+				time.Sleep(d)
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			if err := r.send(rr); err != nil {
+				atomic.AddUint64(&r.failed, 1)
+				log.Errorf("error while replaying request of user %q: %s", rr.User, err)
+			}
+			atomic.AddUint64(&r.sent, 1)
+			<-sem
+			wg.Done()
+		}()
+	}
+	return sc.Err()
+}
+
+func (r *replayer) send(rr recordedRequest) error {
+	params := make(url.Values, len(rr.Params))
+	for k, v := range rr.Params {
+		params.Set(k, v)
+	}
+	u := *r.target
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(rr.Body))
+	if err != nil {
+		return err
+	}
+	if c, ok := r.users[rr.User]; ok {
+		req.SetBasicAuth(c.User, c.Password)
+	} else if len(r.user) > 0 {
+		req.SetBasicAuth(r.user, r.password)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code: %d; response: %q", resp.StatusCode, msg)
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// retryBudget limits the number of retries to the cluster,
+// so a degraded cluster isn't finished off by amplified retry traffic.
+//
+// Retries are allowed while their number during the current interval
+// doesn't exceed max(minRetries, ratio*requests).
+type retryBudget struct {
+	cluster    string
+	maxRetries int
+	ratio      float64
+	minRetries int
+	interval   time.Duration
+
+	// mu protects the fields below.
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	retries     int
+}
+
+// newRetryBudget returns retry budget for the cluster with the given name.
+//
+// nil is returned if retries are disabled.
+func newRetryBudget(cluster string, cfg config.Retry) *retryBudget {
+	if cfg.MaxRetries == 0 {
+		return nil
+	}
+	return &retryBudget{
+		cluster:     cluster,
+		maxRetries:  cfg.MaxRetries,
+		ratio:       cfg.BudgetRatio,
+		minRetries:  cfg.BudgetMinRetries,
+		interval:    time.Duration(cfg.BudgetInterval),
+		windowStart: time.Now(),
+	}
+}
+
+// onRequest registers the request to the cluster.
+func (rb *retryBudget) onRequest() {
+	if rb == nil {
+		return
+	}
+	rb.mu.Lock()
+	rb.advance(time.Now())
+	rb.requests++
+	rb.mu.Unlock()
+}
+
+// allowRetry returns true if the retry fits the budget.
+//
+// The allowed retry is registered in the budget.
+func (rb *retryBudget) allowRetry() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	rb.advance(time.Now())
+	limit := int(rb.ratio * float64(rb.requests))
+	if limit < rb.minRetries {
+		limit = rb.minRetries
+	}
+	labels := prometheus.Labels{"cluster": rb.cluster}
+	if rb.retries >= limit {
+		retryBudgetExhausted.With(labels).Inc()
+		return false
+	}
+	rb.retries++
+	retryBudgetConsumption.With(labels).Set(float64(rb.retries) / float64(limit))
+	return true
+}
+
+// advance starts new interval if the current one is over.
+//
+// rb.mu must be held by the caller.
+func (rb *retryBudget) advance(now time.Time) {
+	if now.Sub(rb.windowStart) < rb.interval {
+		return
+	}
+	rb.windowStart = now
+	rb.requests = 0
+	if rb.retries > 0 {
+		rb.retries = 0
+		retryBudgetConsumption.With(prometheus.Labels{"cluster": rb.cluster}).Set(0)
+	}
+}
+
+// serveWithRetries proxies req to s.host.
+//
+// Requests failed due to connection errors are retried on other
+// cluster nodes if the retry budget of the cluster allows it.
+func (s *scope) serveWithRetries(rw http.ResponseWriter, req *http.Request) {
+	rb := s.cluster.retryBudget
+	if rb == nil {
+		s.cluster.rp.ServeHTTP(rw, req)
+		return
+	}
+	rb.onRequest()
+	body := req.Body
+	for attempt := 0; ; attempt++ {
+		pe := &proxyError{
+			deferred: attempt < rb.maxRetries,
+		}
+		r := req.WithContext(withProxyError(req.Context(), pe))
+		var rBody *retryBody
+		if body != nil {
+			rBody = &retryBody{ReadCloser: body}
+			r.Body = rBody
+		}
+		s.cluster.rp.ServeHTTP(rw, r)
+		if pe.err == nil || !pe.deferred {
+			return
+		}
+		if !s.retry(req, pe.err, rBody) {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+	}
+}
+
+// retry switches s and req to another cluster node if the failed
+// attempt may be retried.
+func (s *scope) retry(req *http.Request, err error, body *retryBody) bool {
+	if !isDialError(err) || req.Context().Err() != nil {
+		return false
+	}
+	if body != nil && atomic.LoadInt64(&body.bytesRead) > 0 {
+		// The request body cannot be sent again.
+		return false
+	}
+	s.host.penalize()
+	h := s.cluster.getRetryHost(s.host)
+	if h == nil {
+		return false
+	}
+	if !s.cluster.retryBudget.allowRetry() {
+		log.Debugf("%s: retry budget is exhausted; error: %s", s, err)
+		return false
+	}
+	retries.With(prometheus.Labels{"cluster": s.cluster.name}).Inc()
+	log.Debugf("%s: retrying on %s after error: %s", s, h.addr.Host, err)
+	s.setHost(h)
+	req.URL.Scheme = h.addr.Scheme
+	req.URL.Host = h.addr.Host
+	return true
+}
+
+// getRetryHost returns the least loaded host except the failed one.
+//
+// Active hosts take precedence. nil is returned if the cluster
+// has no other hosts.
+func (c *cluster) getRetryHost(failed *host) *host {
+	var (
+		best       *host
+		bestLoad   uint32
+		bestActive bool
+	)
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			if h == failed {
+				continue
+			}
+			active, load := h.isActive(), h.load()
+			if best == nil || (active && !bestActive) || (active == bestActive && load < bestLoad) {
+				best, bestLoad, bestActive = h, load, active
+			}
+		}
+	}
+	return best
+}
+
+type proxyErrorKey struct{}
+
+// proxyError holds the error of the proxied request attempt.
+type proxyError struct {
+	err error
+
+	// deferred is set if the error response must be sent by the caller,
+	// so the request may be retried instead.
+	deferred bool
+}
+
+// withProxyError returns ctx, which collects errors of the request attempt.
+func withProxyError(ctx context.Context, pe *proxyError) context.Context {
+	return context.WithValue(ctx, proxyErrorKey{}, pe)
+}
+
+// handleProxyError is used as http.ReverseProxy.ErrorHandler for cluster nodes.
+//
+// It responds with StatusBadGateway like the default handler unless
+// the response is deferred by the caller. Requests with too large body
+// are responded with StatusRequestEntityTooLarge.
+func handleProxyError(rw http.ResponseWriter, req *http.Request, err error) {
+	pe, ok := req.Context().Value(proxyErrorKey{}).(*proxyError)
+	if err == errRequestBodyTooLarge {
+		// The request mustn't be retried.
+		if ok {
+			pe.err = err
+			pe.deferred = false
+		}
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if ok {
+		pe.err = err
+		if pe.deferred {
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusBadGateway)
+}
+
+// isDialError returns true if err occurred while connecting to the node,
+// so the request hasn't been sent and may be safely retried.
+func isDialError(err error) bool {
+	switch e := err.(type) {
+	case *net.OpError:
+		return e.Op == "dial"
+	case *net.DNSError:
+		return true
+	}
+	return false
+}
+
+// retryBody allows re-sending the request body if it hasn't been read
+// during the failed attempt.
+type retryBody struct {
+	// bytesRead must be the first field for atomic access on 32-bit platforms.
+	bytesRead int64
+
+	io.ReadCloser
+}
+
+func (rb *retryBody) Read(p []byte) (int, error) {
+	n, err := rb.ReadCloser.Read(p)
+	atomic.AddInt64(&rb.bytesRead, int64(n))
+	return n, err
+}
+
+// Close doesn't close the wrapped body, since http.Transport closes
+// the request body on connection errors. The wrapped body is closed
+// by the server.
+func (rb *retryBody) Close() error {
+	return nil
+}
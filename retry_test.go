@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestRetryBudget(t *testing.T) {
+	rb := newRetryBudget("cluster", config.Retry{
+		MaxRetries:       1,
+		BudgetRatio:      0.5,
+		BudgetMinRetries: 1,
+		BudgetInterval:   config.Duration(time.Hour),
+	})
+	if !rb.allowRetry() {
+		t.Fatalf("min retries must be allowed without requests")
+	}
+	if rb.allowRetry() {
+		t.Fatalf("retry must exceed min retries without requests")
+	}
+	for i := 0; i < 6; i++ {
+		rb.onRequest()
+	}
+	for i := 1; i < 3; i++ {
+		if !rb.allowRetry() {
+			t.Fatalf("retry #%d must fit the budget", i+1)
+		}
+	}
+	if rb.allowRetry() {
+		t.Fatalf("retry must exceed the budget")
+	}
+
+	// Emulate the next interval.
+	rb.windowStart = time.Now().Add(-2 * time.Hour)
+	if !rb.allowRetry() {
+		t.Fatalf("retry must fit the budget in the next interval")
+	}
+
+	if rb := newRetryBudget("cluster", config.Retry{}); rb != nil {
+		t.Fatalf("retry budget must be nil if retries are disabled")
+	}
+}
+
+func TestServeWithRetries(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+	fakeAddr, err := url.Parse(fakeServer.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(retry config.Retry, body string, expectedStatus int) {
+		t.Helper()
+		p, err := newConfiguredProxy(&config.Config{
+			Clusters: []config.Cluster{
+				{
+					Name:   "cluster",
+					Scheme: "http",
+					Nodes:  []string{deadAddr, fakeAddr.Host},
+					Retry:  retry,
+					ClusterUsers: []config.ClusterUser{
+						{
+							Name: "web",
+						},
+					},
+					HeartBeatInterval: config.Duration(time.Minute),
+				},
+			},
+			Users: []config.User{
+				{
+					Name:      "default",
+					ToCluster: "cluster",
+					ToUser:    "web",
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		req := httptest.NewRequest("POST", "http://localhost", strings.NewReader(body))
+		s, _, err := p.getScope(req)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := s.incQueued(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer s.dec()
+		s.setHost(s.cluster.getHostByAddr(deadAddr))
+		req, _ = s.decorateRequest(req)
+
+		rw := httptest.NewRecorder()
+		s.serveWithRetries(rw, req)
+		if rw.Code != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d", rw.Code, expectedStatus)
+		}
+		if expectedStatus == http.StatusOK && s.host.addr.Host != fakeAddr.Host {
+			t.Fatalf("the request must be retried on %q; got %q", fakeAddr.Host, s.host.addr.Host)
+		}
+	}
+
+	retry := config.Retry{
+		MaxRetries:       2,
+		BudgetRatio:      0.1,
+		BudgetMinRetries: 10,
+		BudgetInterval:   config.Duration(time.Minute),
+	}
+	f(retry, "1ms", http.StatusOK)
+	f(config.Retry{}, "1ms", http.StatusBadGateway)
+
+	// Exhausted budget.
+	retry.BudgetRatio = 0
+	retry.BudgetMinRetries = 0
+	f(retry, "1ms", http.StatusBadGateway)
+}
@@ -5,16 +5,21 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/Vertamedia/chproxy/cache"
 	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/extension"
 	"github.com/Vertamedia/chproxy/log"
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -43,9 +48,28 @@ type scope struct {
 	remoteAddr string
 	localAddr  string
 
+	// identity is the incoming user name for users with `name_is_regexp`
+	// or `is_wildcarded`.
+	identity string
+
+	// passthrough contains the incoming credentials, which are forwarded
+	// to ClickHouse instead of cluster user credentials, if set.
+	passthrough *credentials
+
 	// is true when KillQuery has been called
 	canceled bool
 
+	// is true when the slot in cluster user's max_concurrent_queries
+	// budget shared among chproxy instances has been acquired
+	sharedQuery bool
+
+	// priority of the request; 1 is the highest, 0 means no priority
+	priority uint64
+
+	// is true when the response must be compressed by the proxy
+	// according to `compression: proxy`
+	compressResponse bool
+
 	labels prometheus.Labels
 }
 
@@ -140,6 +164,10 @@ func (s *scope) incQueued() error {
 	queueSize.Inc()
 	defer queueSize.Dec()
 
+	waiters := &s.clusterUser.waiters
+	waiters.add(s.priority)
+	defer waiters.remove(s.priority)
+
 	// Try starting the request during the given duration.
 	d := s.maxQueueTime()
 	dSleep := d / 10
@@ -151,7 +179,13 @@ func (s *scope) incQueued() error {
 	}
 	deadline := time.Now().Add(d)
 	for {
-		err := s.inc()
+		var err error
+		if waiters.hasHigher(s.priority) {
+			// Let queued requests with higher priority start first.
+			err = fmt.Errorf("requests with higher priority are queued for cluster user %q", s.clusterUser.name)
+		} else {
+			err = s.inc()
+		}
 		if err == nil {
 			// The request is allowed to start.
 			return nil
@@ -163,6 +197,11 @@ func (s *scope) incQueued() error {
 			// in the queue :(
 			return err
 		}
+		if err := checkMemoryUsage(); err != nil {
+			// Queued requests are shed while the memory usage
+			// approaches the limit.
+			return err
+		}
 
 		// The request has dLeft remaining time to wait in the queue.
 		// Sleep for a bit and try starting it again.
@@ -195,6 +234,37 @@ func (s *scope) inc() error {
 			s.clusterUser.name, s.clusterUser.maxConcurrentQueries)
 	}
 
+	rateErr := s.incRate()
+	if rateErr != nil {
+		err = rateErr
+	}
+
+	if err == nil {
+		err = s.acquireSharedQuery()
+	}
+
+	if err != nil {
+		s.user.queryCounter.dec()
+		s.clusterUser.queryCounter.dec()
+
+		// Decrement rate limiter here, so it doesn't count requests
+		// that didn't start due to limits overflow.
+		if rateErr == nil {
+			s.decRate()
+		}
+		return err
+	}
+
+	s.host.inc()
+	concurrentQueries.With(s.labels).Inc()
+	return nil
+}
+
+// incRate counts the request towards `requests_per_minute` limits
+// of the user and the cluster user.
+//
+// The request isn't counted if the limits are exceeded.
+func (s *scope) incRate() error {
 	uRPM := s.user.rateLimiter.inc()
 	cRPM := s.clusterUser.rateLimiter.inc()
 
@@ -202,6 +272,7 @@ func (s *scope) inc() error {
 	// is decremented on error below after per-minute zeroing
 	// in rateLimiter.run.
 	// These races become innocent with the given check.
+	var err error
 	if s.user.reqPerMin > 0 && int32(uRPM) > 0 && uRPM > s.user.reqPerMin {
 		err = fmt.Errorf("rate limit for user %q is exceeded: requests_per_minute limit: %d",
 			s.user.name, s.user.reqPerMin)
@@ -210,21 +281,15 @@ func (s *scope) inc() error {
 		err = fmt.Errorf("rate limit for cluster user %q is exceeded: requests_per_minute limit: %d",
 			s.clusterUser.name, s.clusterUser.reqPerMin)
 	}
-
 	if err != nil {
-		s.user.queryCounter.dec()
-		s.clusterUser.queryCounter.dec()
-
-		// Decrement rate limiter here, so it doesn't count requests
-		// that didn't start due to limits overflow.
-		s.user.rateLimiter.dec()
-		s.clusterUser.rateLimiter.dec()
-		return err
+		s.decRate()
 	}
+	return err
+}
 
-	s.host.inc()
-	concurrentQueries.With(s.labels).Inc()
-	return nil
+func (s *scope) decRate() {
+	s.user.rateLimiter.dec()
+	s.clusterUser.rateLimiter.dec()
 }
 
 func (s *scope) dec() {
@@ -235,6 +300,50 @@ func (s *scope) dec() {
 	s.clusterUser.queryCounter.dec()
 	s.host.dec()
 	concurrentQueries.With(s.labels).Dec()
+
+	if s.sharedQuery {
+		cu := s.clusterUser
+		if err := cu.sharedLimiter.releaseQuery(cu.sharedName, s.id); err != nil {
+			onSharedLimiterError(err)
+		}
+		s.sharedQuery = false
+	}
+}
+
+// setHost moves the running request to h.
+func (s *scope) setHost(h *host) {
+	s.host.dec()
+	concurrentQueries.With(s.labels).Dec()
+	s.host = h
+	s.labels["replica"] = h.replica.name
+	s.labels["cluster_node"] = h.addr.Host
+	h.inc()
+	concurrentQueries.With(s.labels).Inc()
+}
+
+// acquireSharedQuery acquires the slot for the query in cluster user's
+// max_concurrent_queries budget shared among chproxy instances.
+//
+// Local limits are applied on shared limiter errors.
+func (s *scope) acquireSharedQuery() error {
+	cu := s.clusterUser
+	if cu.sharedLimiter == nil || cu.maxConcurrentQueries == 0 {
+		return nil
+	}
+	n, err := cu.sharedLimiter.acquireQuery(cu.sharedName, s.id)
+	if err != nil {
+		onSharedLimiterError(err)
+		return nil
+	}
+	if n > cu.maxConcurrentQueries {
+		if err := cu.sharedLimiter.releaseQuery(cu.sharedName, s.id); err != nil {
+			onSharedLimiterError(err)
+		}
+		return fmt.Errorf("limits for cluster user %q are exceeded: max_concurrent_queries limit across chproxy instances: %d",
+			cu.name, cu.maxConcurrentQueries)
+	}
+	s.sharedQuery = true
+	return nil
 }
 
 const killQueryTimeout = time.Second * 30
@@ -243,10 +352,15 @@ func (s *scope) killQuery() error {
 	log.Debugf("killing the query with query_id=%s", s.id)
 	killedRequests.With(s.labels).Inc()
 	s.canceled = true
+	return s.host.killQuery(s.id.String())
+}
 
-	query := fmt.Sprintf("KILL QUERY WHERE query_id = '%s'", s.id)
+// killQuery kills the query with the given queryID on h
+// as kill_query_user.
+func (h *host) killQuery(queryID string) error {
+	query := fmt.Sprintf("KILL QUERY WHERE query_id = '%s'", escapeString(queryID))
 	r := strings.NewReader(query)
-	addr := s.host.addr.String()
+	addr := h.addr.String()
 	req, err := http.NewRequest("POST", addr, r)
 	if err != nil {
 		return fmt.Errorf("error while creating kill query request to %s: %s", addr, err)
@@ -256,14 +370,10 @@ func (s *scope) killQuery() error {
 
 	req = req.WithContext(ctx)
 
-	// send request as kill_query_user
-	userName := s.cluster.killQueryUserName
-	if len(userName) == 0 {
-		userName = "default"
-	}
-	req.SetBasicAuth(userName, s.cluster.killQueryUserPassword)
+	c := h.replica.cluster
+	c.setKillQueryUserAuth(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.client().Do(req)
 	if err != nil {
 		return fmt.Errorf("error while executing clickhouse query %q at %q: %s", query, addr, err)
 	}
@@ -280,7 +390,7 @@ func (s *scope) killQuery() error {
 		return fmt.Errorf("cannot read response body for the query %q: %s", query, err)
 	}
 
-	log.Debugf("killed the query with query_id=%s; respBody: %q", s.id, respBody)
+	log.Debugf("killed the query with query_id=%s at %q; respBody: %q", queryID, addr, respBody)
 	return nil
 }
 
@@ -305,6 +415,17 @@ var allowedParams = []string{
 	"extremes",
 	// what to do if the volume of the result exceeds one of the limits
 	"result_overflow_mode",
+	// key for ClickHouse quotas keyed by client
+	"quota_key",
+}
+
+// clickhouseHeaderParams maps ClickHouse HTTP headers to the corresponding
+// query args. Headers are translated into query args, which are proxied
+// only if they are in allowedParams.
+var clickhouseHeaderParams = map[string]string{
+	"X-ClickHouse-Format":   "default_format",
+	"X-ClickHouse-Database": "database",
+	"X-ClickHouse-Quota":    "quota_key",
 }
 
 // This regexp must match params needed to describe a way to use external data
@@ -322,8 +443,24 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 		}
 	}
 
-	// Keep allowed params.
+	// Translate ClickHouse headers into query args. Query args take
+	// precedence over headers.
 	origParams := req.URL.Query()
+	for header, param := range clickhouseHeaderParams {
+		val := req.Header.Get(header)
+		if len(val) > 0 && len(origParams.Get(param)) == 0 {
+			origParams.Set(param, val)
+		}
+	}
+	// Drop all the ClickHouse headers, so they cannot bypass allowedParams
+	// or override cluster user credentials.
+	for header := range req.Header {
+		if strings.HasPrefix(header, "X-Clickhouse-") {
+			req.Header.Del(header)
+		}
+	}
+
+	// Keep allowed params.
 	for _, param := range allowedParams {
 		val := origParams.Get(param)
 		if len(val) > 0 {
@@ -347,14 +484,32 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 		}
 	}
 
+	s.applyCompression(req, params)
+
+	// Pass the priority to ClickHouse, so its scheduler honors it too.
+	if s.priority > 0 {
+		params.Set("priority", strconv.FormatUint(s.priority, 10))
+	}
+
 	// Set query_id as scope_id to have possibility to kill query if needed.
 	params.Set("query_id", s.id.String())
 
+	// Forward the identity of users matched by regexp, so it may be used
+	// for ClickHouse quotas and queried via system.query_log.quota_key.
+	// The identity overrides quota_key passed by the client.
+	if len(s.identity) > 0 {
+		params.Set("quota_key", s.identity)
+	}
+	// quota_key forced by the user config overrides all the other quota keys.
+	if len(s.user.quotaKey) > 0 {
+		params.Set("quota_key", s.user.quotaKey)
+	}
+
 	req.URL.RawQuery = params.Encode()
 
 	// Rewrite possible previous Basic Auth and send request
 	// as cluster user.
-	req.SetBasicAuth(s.clusterUser.name, s.clusterUser.password)
+	req.SetBasicAuth(s.getCredentials())
 
 	// Send request to the chosen host from cluster.
 	req.URL.Scheme = s.host.addr.Scheme
@@ -369,6 +524,15 @@ func (s *scope) decorateRequest(req *http.Request) (*http.Request, url.Values) {
 	return req, origParams
 }
 
+// getCredentials returns ClickHouse user name and password
+// for requests of s.
+func (s *scope) getCredentials() (string, string) {
+	if s.passthrough != nil {
+		return s.passthrough.name, s.passthrough.password
+	}
+	return s.clusterUser.getCredentials()
+}
+
 func (s *scope) getTimeoutWithErrMsg() (time.Duration, error) {
 	var (
 		timeout       time.Duration
@@ -385,6 +549,26 @@ func (s *scope) getTimeoutWithErrMsg() (time.Duration, error) {
 	return timeout, timeoutErrMsg
 }
 
+// getIdleTimeoutWithErrMsg returns the maximum duration without new
+// response bytes for the proxied query.
+//
+// Zero is returned if the duration isn't limited.
+func (s *scope) getIdleTimeoutWithErrMsg() (time.Duration, error) {
+	var (
+		timeout       time.Duration
+		timeoutErrMsg error
+	)
+	if s.user.maxIdleTime > 0 {
+		timeout = s.user.maxIdleTime
+		timeoutErrMsg = fmt.Errorf("idle timeout for user %q exceeded: no response bytes during %v", s.user.name, timeout)
+	}
+	if timeout == 0 || (s.clusterUser.maxIdleTime > 0 && s.clusterUser.maxIdleTime < timeout) {
+		timeout = s.clusterUser.maxIdleTime
+		timeoutErrMsg = fmt.Errorf("idle timeout for cluster user %q exceeded: no response bytes during %v", s.clusterUser.name, timeout)
+	}
+	return timeout, timeoutErrMsg
+}
+
 func (s *scope) maxQueueTime() time.Duration {
 	d := s.user.maxQueueTime
 	if d <= 0 || s.clusterUser.maxQueueTime > 0 && s.clusterUser.maxQueueTime < d {
@@ -423,13 +607,29 @@ type user struct {
 	name     string
 	password string
 
-	toCluster string
-	toUser    string
+	// previousPasswords are accepted along with password
+	// during credentials rotation.
+	previousPasswords []string
+
+	// toClusters contains clusters for proxying user requests.
+	toClusters []clusterTarget
+	toUser     string
+
+	// routes maps statement classes to clusters overriding toClusters.
+	routes map[string]*cluster
+
+	// allowedClusters contains clusters, which may be chosen
+	// via `X-Chproxy-Cluster` header.
+	allowedClusters map[string]*cluster
+
+	// mirror duplicates user requests to `mirror_to_cluster` if set.
+	mirror *trafficMirror
 
 	maxConcurrentQueries uint32
 	queryCounter         counter
 
 	maxExecutionTime time.Duration
+	maxIdleTime      time.Duration
 
 	reqPerMin   uint32
 	rateLimiter rateLimiter
@@ -441,17 +641,112 @@ type user struct {
 
 	denyHTTP  bool
 	denyHTTPS bool
-	allowCORS bool
+
+	// cors is set if CORS requests are allowed for the user.
+	cors *corsPolicy
 
 	cache  *cache.Cache
 	params *paramsRegistry
+
+	// cacheKeyNamespace isolates cached responses of the user
+	// from users with other namespaces.
+	// Users without namespace share cached responses.
+	cacheKeyNamespace string
+
+	// allowCacheControl is set if the user may refresh or bypass
+	// the cache via request headers.
+	allowCacheControl bool
+
+	// cachePeers distributes cache entries among chproxy instances if set.
+	cachePeers *cachePeers
+
+	// faults are injected into user requests if set.
+	faults *faultInjector
+
+	// spiffeIDs contains SPIFFE ID patterns of clients
+	// authorized as the user.
+	spiffeIDs []string
+
+	// certNames contains patterns of client certificate names
+	// authorized as the user.
+	certNames []string
+
+	// nameRegexp matches incoming user names if `name_is_regexp`
+	// or `is_wildcarded` is set.
+	nameRegexp *regexp.Regexp
+
+	// isWildcarded is set if incoming credentials are passed through
+	// to ClickHouse.
+	isWildcarded bool
+
+	// databasePrefix restricts databases accessible by the user if set.
+	databasePrefix string
+
+	// allowedDatabases restricts databases accessible by the user if set.
+	allowedDatabases map[string]bool
+
+	// allowedTables and deniedTables contain `db.table` patterns
+	// restricting tables accessible by the user if set.
+	allowedTables []string
+	deniedTables  []string
+
+	// deniedStatements contains upper-cased statements and statement
+	// classes the user cannot execute.
+	deniedStatements map[string]bool
+
+	// allowQueryPatterns and denyQueryPatterns are matched against
+	// the normalized query if set.
+	allowQueryPatterns []*regexp.Regexp
+	denyQueryPatterns  []*regexp.Regexp
+
+	// quotaKey is forwarded as `quota_key` instead of the client's one if set.
+	quotaKey string
+
+	// allowedPaths contains ClickHouse paths accessible by the user
+	// in addition to `/`.
+	allowedPaths map[string]bool
+
+	// authenticator verifies user credentials instead of password if set.
+	authenticator authenticator
+
+	// allowJWT is set if the user may authenticate via JWT bearer token.
+	allowJWT bool
+
+	// ldapGroup is set if members of LDAP groups are mapped to the user.
+	ldapGroup bool
+
+	// cacheKeyer extends cache keys if set.
+	cacheKeyer extension.CacheKeyer
+
+	// cacheKeyPolicy customizes cache keys if set.
+	cacheKeyPolicy *cacheKeyPolicy
+
+	// maxRequestBodySize limits request bodies if set.
+	maxRequestBodySize int64
+
+	// maxResponseSize and maxReadRows limit proxied responses if set.
+	maxResponseSize int64
+	maxReadRows     uint64
+
+	// compression is the policy for compressing responses.
+	compression string
+
+	// priority is the default priority of user requests.
+	priority uint64
 }
 
 type usersProfile struct {
-	cfg      []config.User
-	clusters map[string]*cluster
-	caches   map[string]*cache.Cache
-	params   map[string]*paramsRegistry
+	cfg        []config.User
+	clusters   map[string]*cluster
+	caches     map[string]*cache.Cache
+	cachePeers map[string]*cachePeers
+	params     map[string]*paramsRegistry
+
+	// cacheKeyers contains cache keyer extensions by cache names.
+	cacheKeyers map[string]extension.CacheKeyer
+
+	// cacheKeyPolicies contains cache key customizations by cache names.
+	cacheKeyPolicies map[string]*cacheKeyPolicy
 }
 
 func (up usersProfile) newUsers() (map[string]*user, error) {
@@ -470,12 +765,21 @@ func (up usersProfile) newUsers() (map[string]*user, error) {
 }
 
 func (up usersProfile) newUser(u config.User) (*user, error) {
-	c, ok := up.clusters[u.ToCluster]
-	if !ok {
-		return nil, fmt.Errorf("unknown `to_cluster` %q", u.ToCluster)
+	toClusters, err := up.newClusterTargets(u)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := up.newRoutes(u)
+	if err != nil {
+		return nil, err
 	}
-	if _, ok := c.users[u.ToUser]; !ok {
-		return nil, fmt.Errorf("unknown `to_user` %q in cluster %q", u.ToUser, u.ToCluster)
+	allowedClusters, err := up.newAllowedClusters(u)
+	if err != nil {
+		return nil, err
+	}
+	mirror, err := up.newTrafficMirror(u)
+	if err != nil {
+		return nil, err
 	}
 
 	var queueCh chan struct{}
@@ -490,7 +794,6 @@ func (up usersProfile) newUser(u config.User) (*user, error) {
 			return nil, fmt.Errorf("unknown `cache` %q", u.Cache)
 		}
 	}
-
 	var params *paramsRegistry
 	if len(u.Params) > 0 {
 		params = up.params[u.Params]
@@ -499,25 +802,131 @@ func (up usersProfile) newUser(u config.User) (*user, error) {
 		}
 	}
 
+	faults := newFaultInjector(u.FaultInjection)
+	if faults != nil {
+		log.Infof("WARNING: fault injection is enabled for user %q", u.Name)
+	}
+
+	var allowedPaths map[string]bool
+	if len(u.AllowedPaths) > 0 {
+		allowedPaths = make(map[string]bool, len(u.AllowedPaths))
+		for _, p := range u.AllowedPaths {
+			allowedPaths[p] = true
+		}
+	}
+
+	allowQueryPatterns, err := compileQueryPatterns(u.AllowQueryPatterns)
+	if err != nil {
+		return nil, err
+	}
+	denyQueryPatterns, err := compileQueryPatterns(u.DenyQueryPatterns)
+	if err != nil {
+		return nil, err
+	}
+
+	var deniedStatements map[string]bool
+	if len(u.DeniedStatements) > 0 {
+		deniedStatements = make(map[string]bool, len(u.DeniedStatements))
+		for _, stmt := range u.DeniedStatements {
+			deniedStatements[strings.ToUpper(stmt)] = true
+		}
+	}
+
+	var allowedDatabases map[string]bool
+	if len(u.AllowedDatabases) > 0 {
+		allowedDatabases = make(map[string]bool, len(u.AllowedDatabases))
+		for _, db := range u.AllowedDatabases {
+			allowedDatabases[db] = true
+		}
+	}
+
+	var auth authenticator
+	if len(u.Authenticator) > 0 {
+		a := extension.GetAuthenticator(u.Authenticator)
+		if a == nil {
+			return nil, fmt.Errorf("unknown `authenticator` %q", u.Authenticator)
+		}
+		auth = extensionAuthenticator{a}
+	}
+
+	var nameRegexp *regexp.Regexp
+	if u.NameIsRegexp {
+		re, err := regexp.Compile("^(?:" + u.Name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `name` regexp %q: %s", u.Name, err)
+		}
+		nameRegexp = re
+	}
+	if u.IsWildcarded {
+		pattern := strings.Replace(regexp.QuoteMeta(u.Name), `\*`, ".*", -1)
+		nameRegexp = regexp.MustCompile("^" + pattern + "$")
+	}
+
 	return &user{
 		name:                 u.Name,
 		password:             u.Password,
-		toCluster:            u.ToCluster,
+		previousPasswords:    u.PreviousPasswords,
+		toClusters:           toClusters,
+		routes:               routes,
+		allowedClusters:      allowedClusters,
+		mirror:               mirror,
 		toUser:               u.ToUser,
 		maxConcurrentQueries: u.MaxConcurrentQueries,
 		maxExecutionTime:     time.Duration(u.MaxExecutionTime),
+		maxIdleTime:          time.Duration(u.MaxIdleTime),
 		reqPerMin:            u.ReqPerMin,
 		queueCh:              queueCh,
 		maxQueueTime:         time.Duration(u.MaxQueueTime),
 		allowedNetworks:      u.AllowedNetworks,
 		denyHTTP:             u.DenyHTTP,
 		denyHTTPS:            u.DenyHTTPS,
-		allowCORS:            u.AllowCORS,
+		cors:                 newCORSPolicy(u),
 		cache:                cc,
+		cacheKeyNamespace:    u.CacheKeyNamespace,
+		allowCacheControl:    u.AllowCacheControl,
+		cachePeers:           up.cachePeers[u.Cache],
 		params:               params,
+		faults:               faults,
+		spiffeIDs:            u.SPIFFEIDs,
+		certNames:            u.CertNames,
+		nameRegexp:           nameRegexp,
+		isWildcarded:         u.IsWildcarded,
+		databasePrefix:       u.DatabasePrefix,
+		allowedDatabases:     allowedDatabases,
+		allowedTables:        u.AllowedTables,
+		deniedTables:         u.DeniedTables,
+		deniedStatements:     deniedStatements,
+		allowQueryPatterns:   allowQueryPatterns,
+		denyQueryPatterns:    denyQueryPatterns,
+		quotaKey:             u.QuotaKey,
+		allowedPaths:         allowedPaths,
+		authenticator:        auth,
+		allowJWT:             u.AllowJWT,
+		cacheKeyer:           up.cacheKeyers[u.Cache],
+		cacheKeyPolicy:       up.cacheKeyPolicies[u.Cache],
+		maxRequestBodySize:   int64(u.MaxRequestBodySize),
+		maxResponseSize:      int64(u.MaxResponseSize),
+		maxReadRows:          u.MaxReadRows,
+		compression:          u.Compression,
+		priority:             u.Priority,
 	}, nil
 }
 
+// checkPassword returns true if password matches the current
+// or one of the previous user passwords.
+func (u *user) checkPassword(password string) bool {
+	if u.password == password {
+		return true
+	}
+	for _, p := range u.previousPasswords {
+		if p == password {
+			previousPasswordAuth.With(prometheus.Labels{"user": u.name}).Inc()
+			return true
+		}
+	}
+	return false
+}
+
 type clusterUser struct {
 	name     string
 	password string
@@ -526,6 +935,7 @@ type clusterUser struct {
 	queryCounter         counter
 
 	maxExecutionTime time.Duration
+	maxIdleTime      time.Duration
 
 	reqPerMin   uint32
 	rateLimiter rateLimiter
@@ -534,6 +944,23 @@ type clusterUser struct {
 	maxQueueTime time.Duration
 
 	allowedNetworks config.Networks
+
+	// maxRequestBodySize limits request bodies if set.
+	maxRequestBodySize int64
+
+	// sharedLimiter coordinates max_concurrent_queries
+	// across chproxy instances if set.
+	sharedLimiter *sharedLimiter
+	sharedName    string
+
+	// waiters tracks priorities of queued requests.
+	waiters priorityWaiters
+
+	// vaultSecret is the path to Vault secret with credentials if set.
+	vaultSecret string
+
+	// vaultCreds holds *credentials read from vaultSecret.
+	vaultCreds atomic.Value
 }
 
 func newClusterUser(cu config.ClusterUser) *clusterUser {
@@ -546,10 +973,13 @@ func newClusterUser(cu config.ClusterUser) *clusterUser {
 		password:             cu.Password,
 		maxConcurrentQueries: cu.MaxConcurrentQueries,
 		maxExecutionTime:     time.Duration(cu.MaxExecutionTime),
+		maxIdleTime:          time.Duration(cu.MaxIdleTime),
 		reqPerMin:            cu.ReqPerMin,
 		queueCh:              queueCh,
 		maxQueueTime:         time.Duration(cu.MaxQueueTime),
 		allowedNetworks:      cu.AllowedNetworks,
+		maxRequestBodySize:   int64(cu.MaxRequestBodySize),
+		vaultSecret:          cu.VaultSecret,
 	}
 }
 
@@ -562,9 +992,18 @@ type host struct {
 	// Either the current host is alive.
 	active uint32
 
+	// Either the current host is drained via admin API,
+	// so it doesn't receive new queries.
+	draining uint32
+
 	// Host address.
 	addr *url.URL
 
+	// removeCh is closed when the host is removed via admin API,
+	// so its heartbeat stops. It is nil for discovered hosts,
+	// since they are managed by discovery.
+	removeCh chan struct{}
+
 	counter
 }
 
@@ -573,10 +1012,37 @@ type replica struct {
 
 	name string
 
+	// priority of the replica; replicas with lower values are preferred.
+	// `prefer_replica` has priority -1.
+	priority int
+
+	// nodes contains node addresses from the config. They are resolved
+	// into hosts periodically if the cluster uses `discovery`.
+	nodes []string
+
+	// hostsLock protects hosts, which may be updated by discovery.
+	hostsLock   sync.RWMutex
 	hosts       []*host
 	nextHostIdx uint32
 }
 
+// getHosts returns replica hosts.
+//
+// The returned slice mustn't be modified.
+func (r *replica) getHosts() []*host {
+	r.hostsLock.RLock()
+	hosts := r.hosts
+	r.hostsLock.RUnlock()
+	return hosts
+}
+
+// setHosts substitutes replica hosts.
+func (r *replica) setHosts(hosts []*host) {
+	r.hostsLock.Lock()
+	r.hosts = hosts
+	r.hostsLock.Unlock()
+}
+
 func newReplicas(replicasCfg []config.Replica, nodes []string, scheme string, c *cluster) ([]*replica, error) {
 	if len(nodes) > 0 {
 		// No replicas, just flat nodes. Create default replica
@@ -584,6 +1050,7 @@ func newReplicas(replicasCfg []config.Replica, nodes []string, scheme string, c
 		r := &replica{
 			cluster: c,
 			name:    "default",
+			nodes:   nodes,
 		}
 		hosts, err := newNodes(nodes, scheme, r)
 		if err != nil {
@@ -596,8 +1063,10 @@ func newReplicas(replicasCfg []config.Replica, nodes []string, scheme string, c
 	replicas := make([]*replica, len(replicasCfg))
 	for i, rCfg := range replicasCfg {
 		r := &replica{
-			cluster: c,
-			name:    rCfg.Name,
+			cluster:  c,
+			name:     rCfg.Name,
+			priority: rCfg.Priority,
+			nodes:    rCfg.Nodes,
 		}
 		hosts, err := newNodes(rCfg.Nodes, scheme, r)
 		if err != nil {
@@ -617,8 +1086,9 @@ func newNodes(nodes []string, scheme string, r *replica) ([]*host, error) {
 			return nil, fmt.Errorf("cannot parse `node` %q with `scheme` %q: %s", node, scheme, err)
 		}
 		hosts[i] = &host{
-			replica: r,
-			addr:    addr,
+			replica:  r,
+			addr:     addr,
+			removeCh: make(chan struct{}),
 		}
 	}
 	return hosts, nil
@@ -631,7 +1101,7 @@ func (h *host) runHeartbeat(done <-chan struct{}) {
 		"cluster_node": h.addr.Host,
 	}
 	heartbeat := func() {
-		if err := isHealthy(h.addr.String()); err == nil {
+		if err := isHealthy(h.replica.cluster.client(), h.addr.String()); err == nil {
 			atomic.StoreUint32(&h.active, uint32(1))
 			hostHealth.With(label).Set(1)
 		} else {
@@ -646,17 +1116,23 @@ func (h *host) runHeartbeat(done <-chan struct{}) {
 		select {
 		case <-done:
 			return
+		case <-h.removeCh:
+			return
 		case <-time.After(interval):
 			heartbeat()
 		}
 	}
 }
 
-func (h *host) isActive() bool { return atomic.LoadUint32(&h.active) == 1 }
+// isActive returns true if the host is alive and isn't drained,
+// so it may receive new queries.
+func (h *host) isActive() bool {
+	return atomic.LoadUint32(&h.active) == 1 && atomic.LoadUint32(&h.draining) == 0
+}
 
 func (r *replica) isActive() bool {
 	// The replica is active if at least a single host is active.
-	for _, h := range r.hosts {
+	for _, h := range r.getHosts() {
 		if h.isActive() {
 			return true
 		}
@@ -697,7 +1173,7 @@ func (h *host) load() uint32 {
 
 func (r *replica) load() uint32 {
 	var reqs uint32
-	for _, h := range r.hosts {
+	for _, h := range r.getHosts() {
 		reqs += h.load()
 	}
 	return reqs
@@ -715,6 +1191,30 @@ type cluster struct {
 	killQueryUserPassword string
 
 	heartBeatInterval time.Duration
+
+	// transport is used for all the requests to cluster nodes.
+	transport *http.Transport
+
+	// rp proxies requests to cluster nodes via transport.
+	rp *httputil.ReverseProxy
+
+	// faults are injected into requests to the cluster if set.
+	faults *faultInjector
+
+	// router chooses cluster nodes for requests if set.
+	router     extension.Router
+	routerName string
+
+	// discovery updates cluster hosts if set.
+	discovery *nodeDiscovery
+
+	// loadBalancing is the policy for choosing replicas and hosts.
+	// Empty value means `least_loaded`, which is also used for the initial
+	// choice with `consistent_hash`; see routeByAffinity.
+	loadBalancing string
+
+	// retryBudget limits retries of failed requests if set.
+	retryBudget *retryBudget
 }
 
 func newCluster(c config.Cluster) (*cluster, error) {
@@ -726,23 +1226,78 @@ func newCluster(c config.Cluster) (*cluster, error) {
 		clusterUsers[cu.Name] = newClusterUser(cu)
 	}
 
+	transport, err := newTransport(c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize transport: %s", err)
+	}
+
+	faults := newFaultInjector(c.FaultInjection)
+	if faults != nil {
+		log.Infof("WARNING: fault injection is enabled for cluster %q", c.Name)
+	}
+
+	var router extension.Router
+	if len(c.Router) > 0 {
+		router = extension.GetRouter(c.Router)
+		if router == nil {
+			return nil, fmt.Errorf("unknown `router` %q", c.Router)
+		}
+	}
+
 	newC := &cluster{
 		name:                  c.Name,
 		users:                 clusterUsers,
 		killQueryUserName:     c.KillQueryUser.Name,
 		killQueryUserPassword: c.KillQueryUser.Password,
 		heartBeatInterval:     time.Duration(c.HeartBeatInterval),
+		transport:             transport,
+		rp: &httputil.ReverseProxy{
+			Director:  func(*http.Request) {},
+			Transport: transport,
+
+			// Suppress error logging in ReverseProxy, since all the errors
+			// are handled and logged in the code below.
+			ErrorLog:     log.NilLogger,
+			ErrorHandler: handleProxyError,
+		},
+		faults:        faults,
+		router:        router,
+		routerName:    c.Router,
+		loadBalancing: c.LoadBalancing,
+		retryBudget:   newRetryBudget(c.Name, c.Retry),
 	}
 
 	replicas, err := newReplicas(c.Replicas, c.Nodes, c.Scheme, newC)
 	if err != nil {
 		return nil, fmt.Errorf("cannot initialize replicas: %s", err)
 	}
+	for _, r := range replicas {
+		if r.name == c.PreferReplica {
+			r.priority = -1
+		}
+	}
 	newC.replicas = replicas
+	newC.discovery = newNodeDiscovery(newC, c)
 
 	return newC, nil
 }
 
+// setKillQueryUserAuth sets credentials of kill_query_user to req.
+func (c *cluster) setKillQueryUserAuth(req *http.Request) {
+	userName := c.killQueryUserName
+	if len(userName) == 0 {
+		userName = "default"
+	}
+	req.SetBasicAuth(userName, c.killQueryUserPassword)
+}
+
+// client returns http client for requests to cluster nodes.
+func (c *cluster) client() *http.Client {
+	return &http.Client{
+		Transport: c.transport,
+	}
+}
+
 func newClusters(cfg []config.Cluster) (map[string]*cluster, error) {
 	clusters := make(map[string]*cluster, len(cfg))
 	for _, c := range cfg {
@@ -758,22 +1313,65 @@ func newClusters(cfg []config.Cluster) (map[string]*cluster, error) {
 	return clusters, nil
 }
 
-// getReplica returns least loaded + round-robin replica from the cluster.
+// nextIdx returns the index in the range [0..n) the search for a replica
+// or a host starts from.
+//
+// counter is used for round robin, while `random` policy ignores it.
+func nextIdx(policy string, counter *uint32, n uint32) uint32 {
+	if policy == "random" {
+		return uint32(rand.Intn(int(n)))
+	}
+	return atomic.AddUint32(counter, 1) % n
+}
+
+// activePriority returns the best priority among active replicas.
+//
+// Only replicas with this priority receive requests.
+func (c *cluster) activePriority() int {
+	prio := 0
+	found := false
+	for _, r := range c.replicas {
+		if r.isActive() && (!found || r.priority < prio) {
+			prio = r.priority
+			found = true
+		}
+	}
+	return prio
+}
+
+// getReplica returns a replica from the cluster according
+// to `load_balancing` policy: least loaded + round-robin by default.
+//
+// Only active replicas with the best priority are considered.
 //
 // Always returns non-nil.
 func (c *cluster) getReplica() *replica {
-	idx := atomic.AddUint32(&c.nextReplicaIdx, 1)
 	n := uint32(len(c.replicas))
 	if n == 1 {
 		return c.replicas[0]
 	}
 
-	idx %= n
+	prio := c.activePriority()
+	usable := func(r *replica) bool {
+		return r.priority == prio && r.isActive()
+	}
+
+	idx := nextIdx(c.loadBalancing, &c.nextReplicaIdx, n)
 	r := c.replicas[idx]
+	if c.loadBalancing == "round_robin" || c.loadBalancing == "random" {
+		// Skip inactive replicas regardless of their load.
+		for i := uint32(0); i < n; i++ {
+			tmpR := c.replicas[(idx+i)%n]
+			if usable(tmpR) {
+				return tmpR
+			}
+		}
+		return r
+	}
 	reqs := r.load()
 
-	// Set least priority to inactive replica.
-	if !r.isActive() {
+	// Set least priority to inactive and not preferred replica.
+	if !usable(r) {
 		reqs = ^uint32(0)
 	}
 
@@ -785,7 +1383,7 @@ func (c *cluster) getReplica() *replica {
 	for i := uint32(1); i < n; i++ {
 		tmpIdx := (idx + i) % n
 		tmpR := c.replicas[tmpIdx]
-		if !tmpR.isActive() {
+		if !usable(tmpR) {
 			continue
 		}
 		tmpReqs := tmpR.load()
@@ -804,18 +1402,33 @@ func (c *cluster) getReplica() *replica {
 	return r
 }
 
-// getHost returns least loaded + round-robin host from replica.
+// getHost returns a host from replica according to `load_balancing`
+// policy of the cluster: least loaded + round-robin by default.
 //
 // Always returns non-nil.
 func (r *replica) getHost() *host {
-	idx := atomic.AddUint32(&r.nextHostIdx, 1)
-	n := uint32(len(r.hosts))
+	hosts := r.getHosts()
+	n := uint32(len(hosts))
 	if n == 1 {
-		return r.hosts[0]
+		return hosts[0]
 	}
 
-	idx %= n
-	h := r.hosts[idx]
+	var policy string
+	if r.cluster != nil {
+		policy = r.cluster.loadBalancing
+	}
+	idx := nextIdx(policy, &r.nextHostIdx, n)
+	h := hosts[idx]
+	if policy == "round_robin" || policy == "random" {
+		// Skip inactive hosts regardless of their load.
+		for i := uint32(0); i < n; i++ {
+			tmpH := hosts[(idx+i)%n]
+			if tmpH.isActive() {
+				return tmpH
+			}
+		}
+		return h
+	}
 	reqs := h.load()
 
 	// Set least priority to inactive host.
@@ -830,7 +1443,7 @@ func (r *replica) getHost() *host {
 	// Scan all the hosts for the least loaded host.
 	for i := uint32(1); i < n; i++ {
 		tmpIdx := (idx + i) % n
-		tmpH := r.hosts[tmpIdx]
+		tmpH := hosts[tmpIdx]
 		if !tmpH.isActive() {
 			continue
 		}
@@ -850,7 +1463,7 @@ func (r *replica) getHost() *host {
 	return h
 }
 
-// getHost returns least loaded + round-robin host from cluster.
+// getHost returns a host from cluster according to `load_balancing` policy.
 //
 // Always returns non-nil.
 func (c *cluster) getHost() *host {
@@ -858,8 +1471,52 @@ func (c *cluster) getHost() *host {
 	return r.getHost()
 }
 
+// getHostByAddr returns the cluster host with the given `host:port` address.
+//
+// nil is returned if there is no such host.
+func (c *cluster) getHostByAddr(addr string) *host {
+	for _, r := range c.replicas {
+		for _, h := range r.getHosts() {
+			if h.addr.Host == addr {
+				return h
+			}
+		}
+	}
+	return nil
+}
+
 type rateLimiter struct {
 	counter
+
+	// shared enforces the limit across chproxy instances if set.
+	// The local counter is used as a fallback on shared limiter errors.
+	shared *sharedLimiter
+	name   string
+}
+
+// inc increments the number of requests during the current minute
+// and returns it.
+func (rl *rateLimiter) inc() uint32 {
+	n := rl.counter.inc()
+	if rl.shared == nil {
+		return n
+	}
+	sn, err := rl.shared.incRPM(rl.name)
+	if err != nil {
+		onSharedLimiterError(err)
+		return n
+	}
+	return sn
+}
+
+func (rl *rateLimiter) dec() {
+	rl.counter.dec()
+	if rl.shared == nil {
+		return
+	}
+	if err := rl.shared.decRPM(rl.name); err != nil {
+		onSharedLimiterError(err)
+	}
 }
 
 func (rl *rateLimiter) run(done <-chan struct{}) {
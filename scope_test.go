@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"reflect"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -214,6 +217,114 @@ func TestGetHost(t *testing.T) {
 	h.inc()
 }
 
+func TestGetHostLoadBalancing(t *testing.T) {
+	newTestCluster := func(policy string) *cluster {
+		c := &cluster{
+			name:          "default",
+			replicas:      []*replica{{}},
+			loadBalancing: policy,
+		}
+		r := c.replicas[0]
+		r.cluster = c
+		for _, addr := range []string{"127.0.0.1", "127.0.0.2", "127.0.0.3"} {
+			r.hosts = append(r.hosts, &host{
+				addr:    &url.URL{Host: addr},
+				active:  1,
+				replica: r,
+			})
+		}
+		return c
+	}
+
+	// round_robin ignores the load of hosts, but skips inactive hosts.
+	c := newTestCluster("round_robin")
+	r := c.replicas[0]
+	r.hosts[1].inc()
+	r.hosts[1].inc()
+	atomic.StoreUint32(&r.hosts[2].active, 0)
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, c.getHost().addr.Host)
+	}
+	expected := []string{"127.0.0.2", "127.0.0.1", "127.0.0.1", "127.0.0.2"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got hosts %q; expected %q", got, expected)
+	}
+
+	// random must return only active hosts.
+	c = newTestCluster("random")
+	r = c.replicas[0]
+	atomic.StoreUint32(&r.hosts[0].active, 0)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		seen[c.getHost().addr.Host] = true
+	}
+	if seen["127.0.0.1"] || !seen["127.0.0.2"] || !seen["127.0.0.3"] {
+		t.Fatalf("unexpected hosts chosen by random policy: %v", seen)
+	}
+
+	// least_loaded picks the host with the fewest running queries.
+	c = newTestCluster("least_loaded")
+	r = c.replicas[0]
+	r.hosts[0].inc()
+	r.hosts[1].inc()
+	for i := 0; i < 3; i++ {
+		if h := c.getHost(); h.addr.Host != "127.0.0.3" {
+			t.Fatalf("got host %q; expected %q", h.addr.Host, "127.0.0.3")
+		}
+	}
+}
+
+func TestGetReplicaPriority(t *testing.T) {
+	c := &cluster{name: "default"}
+	for i, name := range []string{"remote1", "local", "remote2", "backup"} {
+		r := &replica{
+			cluster:  c,
+			name:     name,
+			priority: []int{1, -1, 1, 2}[i],
+		}
+		r.hosts = []*host{
+			{
+				addr:    &url.URL{Host: fmt.Sprintf("127.0.0.%d", i+1)},
+				active:  1,
+				replica: r,
+			},
+		}
+		c.replicas = append(c.replicas, r)
+	}
+	f := func(expected ...string) {
+		t.Helper()
+		seen := make(map[string]bool)
+		for i := 0; i < 8; i++ {
+			r := c.getReplica()
+			// Load mustn't make less preferred replicas available.
+			r.hosts[0].inc()
+			seen[r.name] = true
+		}
+		var got []string
+		for name := range seen {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("got replicas %q; expected %q", got, expected)
+		}
+	}
+
+	f("local")
+
+	atomic.StoreUint32(&c.replicas[1].hosts[0].active, 0)
+	f("remote1", "remote2")
+
+	atomic.StoreUint32(&c.replicas[0].hosts[0].active, 0)
+	atomic.StoreUint32(&c.replicas[2].hosts[0].active, 0)
+	f("backup")
+
+	atomic.StoreUint32(&c.replicas[1].hosts[0].active, 1)
+	c.loadBalancing = "round_robin"
+	f("local")
+}
+
 func TestPenalize(t *testing.T) {
 	c := &cluster{name: "default"}
 	c.replicas = []*replica{
@@ -435,3 +546,90 @@ func TestDecorateRequest(t *testing.T) {
 		}
 	}
 }
+
+func TestDecorateRequestClickHouseHeaders(t *testing.T) {
+	s := &scope{
+		id:          newScopeID(),
+		clusterUser: &clusterUser{},
+		user:        &user{},
+		host: &host{
+			addr: &url.URL{Host: "127.0.0.1"},
+		},
+	}
+	req, err := http.NewRequest("POST", "http://127.0.0.1?database=db", nil)
+	if err != nil {
+		t.Fatalf("unexpected error while creating request: %s", err)
+	}
+	req.Header.Set("X-ClickHouse-Format", "JSON")
+	req.Header.Set("X-ClickHouse-Database", "other")
+	req.Header.Set("X-ClickHouse-Quota", "alice")
+	req.Header.Set("X-ClickHouse-User", "admin")
+	req, origParams := s.decorateRequest(req)
+
+	params := req.URL.Query()
+	if params.Get("default_format") != "JSON" {
+		t.Fatalf("unexpected default_format %q; expecting %q", params.Get("default_format"), "JSON")
+	}
+	if params.Get("database") != "db" {
+		t.Fatalf("query args must take precedence over headers; got database %q", params.Get("database"))
+	}
+	if params.Get("quota_key") != "alice" {
+		t.Fatalf("unexpected quota_key %q; expecting %q", params.Get("quota_key"), "alice")
+	}
+	if origParams.Get("default_format") != "JSON" {
+		t.Fatalf("translated headers must be present in the original params")
+	}
+	for header := range req.Header {
+		if strings.HasPrefix(header, "X-Clickhouse-") {
+			t.Fatalf("unexpected header %q in the proxied request", header)
+		}
+	}
+}
+
+func TestDecorateRequestQuotaKey(t *testing.T) {
+	f := func(identity, userQuotaKey, request, expected string) {
+		t.Helper()
+		s := &scope{
+			id:          newScopeID(),
+			clusterUser: &clusterUser{},
+			user: &user{
+				quotaKey: userQuotaKey,
+			},
+			host: &host{
+				addr: &url.URL{Host: "127.0.0.1"},
+			},
+			identity: identity,
+		}
+		req, err := http.NewRequest("GET", request, nil)
+		if err != nil {
+			t.Fatalf("unexpected error while creating request: %s", err)
+		}
+		req, _ = s.decorateRequest(req)
+		if qk := req.URL.Query().Get("quota_key"); qk != expected {
+			t.Fatalf("unexpected quota_key %q; expecting %q", qk, expected)
+		}
+	}
+
+	f("", "", "http://127.0.0.1?query=SELECT", "")
+	f("", "", "http://127.0.0.1?query=SELECT&quota_key=customer1", "customer1")
+	f("team_a_alice", "", "http://127.0.0.1?query=SELECT&quota_key=customer1", "team_a_alice")
+	f("team_a_alice", "team_a", "http://127.0.0.1?query=SELECT&quota_key=customer1", "team_a")
+}
+
+func TestUserCheckPassword(t *testing.T) {
+	u := &user{
+		name:              "foo",
+		password:          "new",
+		previousPasswords: []string{"old", "older"},
+	}
+	for _, p := range []string{"new", "old", "older"} {
+		if !u.checkPassword(p) {
+			t.Fatalf("password %q must be accepted", p)
+		}
+	}
+	for _, p := range []string{"", "oldest"} {
+		if u.checkPassword(p) {
+			t.Fatalf("password %q mustn't be accepted", p)
+		}
+	}
+}
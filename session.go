@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// sessionPath is the path for exchanging credentials for session tokens.
+const sessionPath = "/session"
+
+// sessionTokenPrefix distinguishes session tokens from JWT
+// in `Authorization: Bearer` header.
+const sessionTokenPrefix = "chs_"
+
+// session describes the authenticated client.
+type session struct {
+	// user is the name of the user from config.
+	user string
+
+	// identity and passthrough are copied from the scope,
+	// which the session was issued for.
+	identity    string
+	passthrough *credentials
+
+	deadline time.Time
+}
+
+// sessionStore keeps active sessions.
+//
+// Sessions are kept in memory, so they are valid only on the chproxy
+// instance, which issued them. Sessions survive config reloads,
+// while their users are checked on each request.
+type sessionStore struct {
+	mu          sync.Mutex
+	ttl         time.Duration
+	maxSessions int
+
+	// sessions are keyed by token hashes, so tokens cannot be
+	// obtained from memory.
+	sessions map[[sha256.Size]byte]*session
+}
+
+func newSessionStore(cfg config.Sessions) *sessionStore {
+	return &sessionStore{
+		ttl:         time.Duration(cfg.TTL),
+		maxSessions: cfg.MaxSessions,
+		sessions:    make(map[[sha256.Size]byte]*session),
+	}
+}
+
+// setConfig applies new cfg to ss. Already issued sessions keep
+// their deadlines.
+func (ss *sessionStore) setConfig(cfg config.Sessions) {
+	ss.mu.Lock()
+	ss.ttl = time.Duration(cfg.TTL)
+	ss.maxSessions = cfg.MaxSessions
+	ss.mu.Unlock()
+}
+
+// create issues token for the session of s.
+func (ss *sessionStore) create(s *scope) (string, time.Duration, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", 0, fmt.Errorf("cannot generate session token: %s", err)
+	}
+	token := sessionTokenPrefix + hex.EncodeToString(b[:])
+	now := time.Now()
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if len(ss.sessions) >= ss.maxSessions {
+		for k, sess := range ss.sessions {
+			if !now.Before(sess.deadline) {
+				delete(ss.sessions, k)
+			}
+		}
+		if len(ss.sessions) >= ss.maxSessions {
+			return "", 0, fmt.Errorf("too many active sessions: %d", len(ss.sessions))
+		}
+	}
+	ss.sessions[sha256.Sum256([]byte(token))] = &session{
+		user:        s.user.name,
+		identity:    s.identity,
+		passthrough: s.passthrough,
+		deadline:    now.Add(ss.ttl),
+	}
+	return token, ss.ttl, nil
+}
+
+// get returns the active session for the given token.
+//
+// nil is returned if the session is missing or expired.
+func (ss *sessionStore) get(token string) *session {
+	key := sha256.Sum256([]byte(token))
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sess := ss.sessions[key]
+	if sess == nil {
+		return nil
+	}
+	if !time.Now().Before(sess.deadline) {
+		delete(ss.sessions, key)
+		return nil
+	}
+	return sess
+}
+
+// isSessionToken returns true if token is a session token.
+func isSessionToken(token string) bool {
+	return strings.HasPrefix(token, sessionTokenPrefix)
+}
+
+// serveSession exchanges credentials from req for session token,
+// which may be passed in `Authorization: Bearer` header of subsequent
+// requests instead of the credentials.
+//
+// Requests with session tokens aren't verified by auth backends,
+// so this reduces the load on them for high-QPS workloads.
+func (rp *reverseProxy) serveSession(rw http.ResponseWriter, req *http.Request) {
+	rp.lock.RLock()
+	ss := rp.sessions
+	rp.lock.RUnlock()
+	if ss == nil {
+		err := fmt.Errorf("%q: sessions aren't configured", req.RemoteAddr)
+		respondWith(rw, err, http.StatusNotFound)
+		return
+	}
+
+	s, status, err := rp.getScope(req)
+	if err != nil {
+		err = fmt.Errorf("%q: %s", req.RemoteAddr, err)
+		respondWith(rw, err, status)
+		return
+	}
+	if err := s.limitRequestBody(req); err != nil {
+		requestBodyTooLarge.With(s.labels).Inc()
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	token, ttl, err := ss.create(s)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusServiceUnavailable)
+		return
+	}
+	log.Debugf("%s: session is created", s)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_in": int(ttl / time.Second),
+	})
+}
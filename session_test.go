@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestSessions(t *testing.T) {
+	cfg := &config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{"localhost:8123"},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Second * 5),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "default",
+				Password:  "qwerty",
+				ToCluster: "cluster",
+				ToUser:    "web",
+			},
+			{
+				Name:         "team_*",
+				IsWildcarded: true,
+				ToCluster:    "cluster",
+				ToUser:       "web",
+			},
+		},
+		Sessions: config.Sessions{
+			TTL:         config.Duration(time.Minute),
+			MaxSessions: 3,
+		},
+	}
+	p, err := newConfiguredProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	createSession := func(name, password string, expectedStatus int) string {
+		t.Helper()
+		req := httptest.NewRequest("POST", "http://localhost"+sessionPath, nil)
+		req.SetBasicAuth(name, password)
+		rw := httptest.NewRecorder()
+		p.serveSession(rw, req)
+		if rw.Code != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d; response: %q", rw.Code, expectedStatus, rw.Body.String())
+		}
+		if expectedStatus != http.StatusOK {
+			return ""
+		}
+		var resp struct {
+			Token     string `json:"token"`
+			ExpiresIn int    `json:"expires_in"`
+		}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("cannot parse response %q: %s", rw.Body.String(), err)
+		}
+		if resp.ExpiresIn != 60 {
+			t.Fatalf("unexpected expires_in %d; expecting %d", resp.ExpiresIn, 60)
+		}
+		return resp.Token
+	}
+	getScope := func(token string) (*scope, error) {
+		req := httptest.NewRequest("POST", "http://localhost", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		s, _, err := p.getScope(req)
+		return s, err
+	}
+
+	createSession("default", "invalid", http.StatusUnauthorized)
+	token := createSession("default", "qwerty", http.StatusOK)
+	s, err := getScope(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.user.name != "default" {
+		t.Fatalf("unexpected user %q; expecting %q", s.user.name, "default")
+	}
+	if _, err := getScope(token + "0"); err == nil {
+		t.Fatalf("expecting error for invalid session token")
+	}
+
+	// Passthrough credentials are kept in the session.
+	token = createSession("team_alice", "alice-secret", http.StatusOK)
+	s, err = getScope(token)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.identity != "team_alice" || s.passthrough == nil || s.passthrough.password != "alice-secret" {
+		t.Fatalf("unexpected session scope: identity %q, passthrough %+v", s.identity, s.passthrough)
+	}
+
+	createSession("default", "qwerty", http.StatusOK)
+	createSession("default", "qwerty", http.StatusServiceUnavailable)
+
+	// Expired sessions are rejected and evicted.
+	for _, sess := range p.sessions.sessions {
+		sess.deadline = time.Now().Add(-time.Second)
+	}
+	createSession("default", "qwerty", http.StatusOK)
+	if n := len(p.sessions.sessions); n != 1 {
+		t.Fatalf("expired sessions must be evicted; got %d sessions", n)
+	}
+	if _, err := getScope(token); err == nil {
+		t.Fatalf("expecting error for expired session token")
+	}
+
+	// Sessions are disabled after config reload without `sessions`.
+	cfg.Sessions = config.Sessions{}
+	if err := p.applyConfig(cfg); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	createSession("default", "qwerty", http.StatusNotFound)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// sharedLimiter enforces limits globally across chproxy instances
+// by keeping counters in Redis.
+type sharedLimiter struct {
+	client    *redisClient
+	keyPrefix string
+
+	// coordinateConcurrency enables coordination of cluster users'
+	// max_concurrent_queries across instances.
+	coordinateConcurrency bool
+
+	// queryLease is the duration after which query slots
+	// of crashed instances are released.
+	queryLease time.Duration
+
+	// instanceID distinguishes queries of this instance
+	// from queries of other instances.
+	instanceID string
+}
+
+// incrScript increments the counter and sets its expiration
+// for newly created counters.
+const incrScript = `local n = redis.call("INCR", KEYS[1])
+if n == 1 then redis.call("PEXPIRE", KEYS[1], ARGV[1]) end
+return n`
+
+// acquireScript releases expired query slots, acquires the slot
+// for the given query and returns the number of acquired slots.
+const acquireScript = `redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", ARGV[1])
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+return redis.call("ZCARD", KEYS[1])`
+
+// newSharedLimiter returns shared limiter for the given cfg.
+//
+// nil is returned if shared limiter isn't configured.
+func newSharedLimiter(cfg config.SharedLimiter) *sharedLimiter {
+	if len(cfg.RedisAddr) == 0 {
+		return nil
+	}
+	return &sharedLimiter{
+		client:                newRedisClient(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, time.Duration(cfg.Timeout)),
+		keyPrefix:             cfg.KeyPrefix,
+		coordinateConcurrency: cfg.CoordinateConcurrentQueries,
+		queryLease:            time.Duration(cfg.QueryLease),
+		instanceID:            newInstanceID(),
+	}
+}
+
+// newInstanceID returns random id for the current chproxy instance.
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("BUG: cannot generate random instance id: %s", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// rpmKey returns key for per-minute counter with the given name
+// for the current minute.
+func (sl *sharedLimiter) rpmKey(name string) string {
+	minute := time.Now().Unix() / 60
+	return sl.keyPrefix + "rpm:" + name + ":" + strconv.FormatInt(minute, 10)
+}
+
+// incRPM increments per-minute counter with the given name
+// and returns its value.
+func (sl *sharedLimiter) incRPM(name string) (uint32, error) {
+	// Counters are kept for two minutes, so they don't disappear
+	// while requests are in flight at the minute boundary.
+	n, err := sl.client.doInt("EVAL", incrScript, "1", sl.rpmKey(name), "120000")
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+// decRPM decrements per-minute counter with the given name.
+func (sl *sharedLimiter) decRPM(name string) error {
+	_, err := sl.client.doInt("DECR", sl.rpmKey(name))
+	return err
+}
+
+func (sl *sharedLimiter) queriesKey(name string) string {
+	return sl.keyPrefix + "queries:" + name
+}
+
+func (sl *sharedLimiter) queryMember(id scopeID) string {
+	return sl.instanceID + ":" + id.String()
+}
+
+// acquireQuery acquires the slot for the query with the given id
+// in the concurrent queries set with the given name.
+//
+// Returns the number of concurrently running queries in the set
+// including the given query.
+func (sl *sharedLimiter) acquireQuery(name string, id scopeID) (uint32, error) {
+	now := time.Now()
+	n, err := sl.client.doInt("EVAL", acquireScript, "1", sl.queriesKey(name),
+		strconv.FormatInt(unixMilli(now), 10),
+		strconv.FormatInt(unixMilli(now.Add(sl.queryLease)), 10),
+		sl.queryMember(id),
+		strconv.FormatInt(int64(sl.queryLease/time.Millisecond), 10))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(n), nil
+}
+
+// releaseQuery releases the slot acquired via acquireQuery.
+func (sl *sharedLimiter) releaseQuery(name string, id scopeID) error {
+	_, err := sl.client.doInt("ZREM", sl.queriesKey(name), sl.queryMember(id))
+	return err
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// Close releases resources occupied by sl.
+func (sl *sharedLimiter) Close() {
+	sl.client.Close()
+}
+
+// onSharedLimiterError logs err and updates the corresponding metric.
+func onSharedLimiterError(err error) {
+	sharedLimiterErrors.Inc()
+	log.Errorf("shared limiter error, falling back to local limits: %s", err)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// fakeRedis is a minimal Redis server for tests.
+//
+// It supports AUTH, SELECT, DECR, ZREM, SUBSCRIBE, PUBLISH and EVAL
+// with incrScript and acquireScript.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu          sync.Mutex
+	counters    map[string]int64
+	sets        map[string]map[string]int64
+	subscribers map[string][]net.Conn
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot start fake redis: %s", err)
+	}
+	fr := &fakeRedis{
+		ln:          ln,
+		password:    password,
+		counters:    make(map[string]int64),
+		sets:        make(map[string]map[string]int64),
+		subscribers: make(map[string][]net.Conn),
+	}
+	go fr.serve()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string { return fr.ln.Addr().String() }
+
+func (fr *fakeRedis) close() { fr.ln.Close() }
+
+func (fr *fakeRedis) serve() {
+	for {
+		conn, err := fr.ln.Accept()
+		if err != nil {
+			return
+		}
+		go fr.serveConn(conn)
+	}
+}
+
+func (fr *fakeRedis) serveConn(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authorized := len(fr.password) == 0
+	for {
+		reply, err := readRedisReply(br)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			b, _ := item.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		var resp string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			if args[1] != fr.password {
+				resp = "-ERR invalid password\r\n"
+				break
+			}
+			authorized = true
+			resp = "+OK\r\n"
+		case !authorized:
+			resp = "-NOAUTH Authentication required\r\n"
+		case cmd == "SELECT":
+			resp = "+OK\r\n"
+		case cmd == "EVAL" && args[1] == incrScript:
+			resp = fmt.Sprintf(":%d\r\n", fr.add(args[3], 1))
+		case cmd == "EVAL" && args[1] == acquireScript:
+			resp = fmt.Sprintf(":%d\r\n", fr.acquire(args[3], args[4], args[5], args[6]))
+		case cmd == "ZREM":
+			fr.mu.Lock()
+			delete(fr.sets[args[1]], args[2])
+			fr.mu.Unlock()
+			resp = ":1\r\n"
+		case cmd == "DECR":
+			resp = fmt.Sprintf(":%d\r\n", fr.add(args[1], -1))
+		case cmd == "SUBSCRIBE":
+			fr.mu.Lock()
+			resp = fmt.Sprintf("*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:1\r\n", len(args[1]), args[1])
+			_, err := conn.Write([]byte(resp))
+			fr.subscribers[args[1]] = append(fr.subscribers[args[1]], conn)
+			fr.mu.Unlock()
+			if err != nil {
+				return
+			}
+			continue
+		case cmd == "PUBLISH":
+			resp = fmt.Sprintf(":%d\r\n", fr.publish(args[1], args[2]))
+		default:
+			resp = fmt.Sprintf("-ERR unknown command %q\r\n", args[0])
+		}
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+	}
+}
+
+func (fr *fakeRedis) add(key string, delta int64) int64 {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.counters[key] += delta
+	return fr.counters[key]
+}
+
+// publish sends msg to subscribers of the channel
+// and returns the number of subscribers.
+func (fr *fakeRedis) publish(channel, msg string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var n int
+	for _, conn := range fr.subscribers[channel] {
+		_, err := fmt.Fprintf(conn, "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n",
+			len(channel), channel, len(msg), msg)
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (fr *fakeRedis) acquire(key, now, deadline, member string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	set := fr.sets[key]
+	if set == nil {
+		set = make(map[string]int64)
+		fr.sets[key] = set
+	}
+	n, _ := strconv.ParseInt(now, 10, 64)
+	for m, d := range set {
+		if d <= n {
+			delete(set, m)
+		}
+	}
+	set[member], _ = strconv.ParseInt(deadline, 10, 64)
+	return len(set)
+}
+
+func TestSharedLimiter(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+	defer fr.close()
+
+	cfg := config.SharedLimiter{
+		RedisAddr:     fr.addr(),
+		RedisPassword: "secret",
+		KeyPrefix:     "chproxy:",
+		Timeout:       config.Duration(time.Second),
+	}
+	// Two limiters emulate two chproxy instances.
+	sl1 := newSharedLimiter(cfg)
+	defer sl1.Close()
+	sl2 := newSharedLimiter(cfg)
+	defer sl2.Close()
+
+	rl1 := &rateLimiter{shared: sl1, name: "user:foo"}
+	rl2 := &rateLimiter{shared: sl2, name: "user:foo"}
+	for i := 1; i <= 3; i++ {
+		if n := rl1.inc(); n != uint32(2*i-1) {
+			t.Fatalf("unexpected counter value: %d; expected: %d", n, 2*i-1)
+		}
+		if n := rl2.inc(); n != uint32(2*i) {
+			t.Fatalf("unexpected counter value: %d; expected: %d", n, 2*i)
+		}
+	}
+	rl1.dec()
+	if n := rl2.inc(); n != 6 {
+		t.Fatalf("unexpected counter value: %d; expected: %d", n, 6)
+	}
+	// Local counters must be updated too.
+	if n := rl1.load(); n != 2 {
+		t.Fatalf("unexpected local counter value: %d; expected: %d", n, 2)
+	}
+}
+
+func TestSharedLimiterFallback(t *testing.T) {
+	fr := newFakeRedis(t, "secret")
+	defer fr.close()
+
+	sl := newSharedLimiter(config.SharedLimiter{
+		RedisAddr:     fr.addr(),
+		RedisPassword: "wrong password",
+		KeyPrefix:     "chproxy:",
+		Timeout:       config.Duration(time.Second),
+	})
+	defer sl.Close()
+
+	rl := &rateLimiter{shared: sl, name: "user:foo"}
+	for i := 1; i <= 3; i++ {
+		if n := rl.inc(); n != uint32(i) {
+			t.Fatalf("unexpected counter value: %d; expected local value: %d", n, i)
+		}
+	}
+}
+
+func TestNewSharedLimiterDisabled(t *testing.T) {
+	if sl := newSharedLimiter(config.SharedLimiter{}); sl != nil {
+		t.Fatalf("shared limiter must be disabled for empty config")
+	}
+}
+
+func TestSharedConcurrentQueries(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	defer fr.close()
+
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:   "cluster",
+			Scheme: "http",
+			ClusterUsers: []config.ClusterUser{
+				{
+					Name:                 "web",
+					MaxConcurrentQueries: 1,
+				},
+			},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+	}
+	cfg.SharedLimiter = config.SharedLimiter{
+		RedisAddr:                   fr.addr(),
+		KeyPrefix:                   "chproxy:",
+		Timeout:                     config.Duration(time.Second),
+		CoordinateConcurrentQueries: true,
+		QueryLease:                  config.Duration(time.Hour),
+	}
+	// Two proxies emulate two chproxy instances.
+	p1, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p2, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	getScope := func(p *reverseProxy) *scope {
+		s, _, err := p.getScope(httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return s
+	}
+
+	s1 := getScope(p1)
+	if err := s1.inc(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s2 := getScope(p2)
+	if err := s2.inc(); err == nil {
+		t.Fatalf("expected max_concurrent_queries limit error for the second instance")
+	}
+	s1.dec()
+	if err := s2.inc(); err != nil {
+		t.Fatalf("unexpected error after releasing the query on the first instance: %s", err)
+	}
+	s2.dec()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// svidSrc provides SPIFFE X.509-SVID and trust bundle.
+//
+// It is initialized on startup if `spiffe` section is configured.
+var svidSrc *svidSource
+
+// svidSource holds the current X.509-SVID and trust bundle
+// read from files maintained by SPIFFE helper.
+type svidSource struct {
+	cfg config.SPIFFE
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	id    string
+	roots *x509.CertPool
+}
+
+func newSVIDSource(cfg config.SPIFFE) (*svidSource, error) {
+	s := &svidSource{
+		cfg: cfg,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// run periodically re-reads SVID files, so rotated SVIDs are picked up.
+//
+// It stops when stopCh is closed.
+func (s *svidSource) run(stopCh <-chan struct{}) {
+	t := time.NewTicker(time.Duration(s.cfg.RefreshInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.load(); err != nil {
+				log.Errorf("cannot reload SPIFFE SVID: %s", err)
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (s *svidSource) load() error {
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load SVID from `spiffe.cert_file`=%q, `spiffe.key_file`=%q: %s",
+			s.cfg.CertFile, s.cfg.KeyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("cannot parse SVID from %q: %s", s.cfg.CertFile, err)
+	}
+	id, err := getSPIFFEID(leaf)
+	if err != nil {
+		return fmt.Errorf("invalid SVID in %q: %s", s.cfg.CertFile, err)
+	}
+	bundle, err := ioutil.ReadFile(s.cfg.BundleFile)
+	if err != nil {
+		return fmt.Errorf("cannot read `spiffe.bundle_file`: %s", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificates found in `spiffe.bundle_file` %q", s.cfg.BundleFile)
+	}
+
+	s.mu.Lock()
+	if s.id != id {
+		log.Infof("Loaded SPIFFE SVID for %q", id)
+	}
+	s.cert = &cert
+	s.id = id
+	s.roots = roots
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *svidSource) certificate() *tls.Certificate {
+	s.mu.RLock()
+	cert := s.cert
+	s.mu.RUnlock()
+	return cert
+}
+
+func (s *svidSource) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certificate(), nil
+}
+
+func (s *svidSource) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return s.certificate(), nil
+}
+
+// verifyPeerCertificate verifies the peer SVID against the trust bundle.
+//
+// The verification is performed manually, since the trust bundle
+// may be rotated at any time and SVIDs don't contain DNS names
+// for the standard hostname verification.
+func (s *svidSource) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		// The client didn't present the certificate.
+		// It must authorize via credentials then.
+		return nil
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("cannot parse peer certificate: %s", err)
+		}
+		certs[i] = cert
+	}
+	if _, err := getSPIFFEID(certs[0]); err != nil {
+		return fmt.Errorf("invalid peer SVID: %s", err)
+	}
+	s.mu.RLock()
+	roots := s.roots
+	s.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return fmt.Errorf("cannot verify peer SVID: %s", err)
+	}
+	return nil
+}
+
+// clientTLSConfig returns tls config for connections to cluster nodes.
+func (s *svidSource) clientTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: s.getClientCertificate,
+		// The standard verification is replaced by verifyPeerCertificate.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: s.verifyPeerCertificate,
+	}
+}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// getSPIFFEID returns SPIFFE ID from URI SAN of the given cert.
+//
+// SAN extension is parsed manually, since x509.Certificate
+// doesn't expose URI SANs in older Go versions.
+func getSPIFFEID(cert *x509.Certificate) (string, error) {
+	var ids []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		rest, err := asn1.Unmarshal(ext.Value, &seq)
+		if err != nil {
+			return "", fmt.Errorf("cannot parse SAN extension: %s", err)
+		}
+		if len(rest) > 0 || !seq.IsCompound || seq.Tag != asn1.TagSequence || seq.Class != asn1.ClassUniversal {
+			return "", fmt.Errorf("malformed SAN extension")
+		}
+		rest = seq.Bytes
+		for len(rest) > 0 {
+			var v asn1.RawValue
+			if rest, err = asn1.Unmarshal(rest, &v); err != nil {
+				return "", fmt.Errorf("cannot parse SAN extension: %s", err)
+			}
+			// uniformResourceIdentifier has tag 6.
+			if v.Class == asn1.ClassContextSpecific && v.Tag == 6 {
+				if uri := string(v.Bytes); strings.HasPrefix(uri, "spiffe://") {
+					ids = append(ids, uri)
+				}
+			}
+		}
+	}
+	if len(ids) != 1 {
+		return "", fmt.Errorf("certificate must contain exactly one SPIFFE ID; found %d", len(ids))
+	}
+	return ids[0], nil
+}
+
+// getRequestSPIFFEID returns SPIFFE ID of the client SVID for req.
+//
+// Empty string is returned if the client didn't present SVID.
+func getRequestSPIFFEID(req *http.Request) string {
+	if svidSrc == nil || req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	// Client certificates are requested only by https listener
+	// with `spiffe` enabled, so they are already verified.
+	id, err := getSPIFFEID(req.TLS.PeerCertificates[0])
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// matchSPIFFEID returns true if id matches one of patterns.
+func matchSPIFFEID(patterns []string, id string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
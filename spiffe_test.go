@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// testCert is a certificate with its private key for tests.
+type testCert struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates certificate with the given SPIFFE id signed by parent.
+//
+// Self-signed CA certificate is created if parent is nil.
+func newTestCert(t *testing.T, id string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"chproxy test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if len(id) > 0 {
+		san, err := asn1.Marshal([]asn1.RawValue{{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(id)}})
+		if err != nil {
+			t.Fatalf("cannot marshal SAN: %s", err)
+		}
+		tmpl.ExtraExtensions = []pkix.Extension{{Id: oidExtensionSubjectAltName, Value: san}}
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %s", err)
+	}
+	return &testCert{cert: cert, der: der, key: key}
+}
+
+// writeSVIDFiles writes svid and bundle into dir and returns config for them.
+func writeSVIDFiles(t *testing.T, dir string, svid, bundle *testCert) config.SPIFFE {
+	keyDER, err := x509.MarshalECPrivateKey(svid.key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	cfg := config.SPIFFE{
+		CertFile:   filepath.Join(dir, "svid.pem"),
+		KeyFile:    filepath.Join(dir, "svid_key.pem"),
+		BundleFile: filepath.Join(dir, "bundle.pem"),
+	}
+	files := map[string]*pem.Block{
+		cfg.CertFile:   {Type: "CERTIFICATE", Bytes: svid.der},
+		cfg.KeyFile:    {Type: "EC PRIVATE KEY", Bytes: keyDER},
+		cfg.BundleFile: {Type: "CERTIFICATE", Bytes: bundle.der},
+	}
+	for path, b := range files {
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatalf("cannot write %q: %s", path, err)
+		}
+	}
+	return cfg
+}
+
+func TestGetSPIFFEID(t *testing.T) {
+	ca := newTestCert(t, "", nil)
+	id, err := getSPIFFEID(newTestCert(t, "spiffe://example.org/reporter", ca).cert)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if id != "spiffe://example.org/reporter" {
+		t.Fatalf("unexpected SPIFFE ID: %q", id)
+	}
+	if _, err := getSPIFFEID(ca.cert); err == nil {
+		t.Fatalf("expected error for certificate without SPIFFE ID")
+	}
+}
+
+func TestSVIDSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chproxy-spiffe")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "", nil)
+	s, err := newSVIDSource(writeSVIDFiles(t, dir, newTestCert(t, "spiffe://example.org/chproxy", ca), ca))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.id != "spiffe://example.org/chproxy" {
+		t.Fatalf("unexpected SPIFFE ID: %q", s.id)
+	}
+
+	peer := newTestCert(t, "spiffe://example.org/reporter", ca)
+	if err := s.verifyPeerCertificate([][]byte{peer.der}, nil); err != nil {
+		t.Fatalf("unexpected error for trusted peer: %s", err)
+	}
+	untrusted := newTestCert(t, "spiffe://example.org/reporter", newTestCert(t, "", nil))
+	if err := s.verifyPeerCertificate([][]byte{untrusted.der}, nil); err == nil {
+		t.Fatalf("expected error for untrusted peer")
+	}
+	if err := s.verifyPeerCertificate(nil, nil); err != nil {
+		t.Fatalf("unexpected error for peer without certificate: %s", err)
+	}
+
+	// Rotated SVID must be picked up by run.
+	s.cfg.RefreshInterval = config.Duration(10 * time.Millisecond)
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		s.run(stopCh)
+		close(doneCh)
+	}()
+	writeSVIDFiles(t, dir, newTestCert(t, "spiffe://example.org/chproxy-new", ca), ca)
+	for i := 0; ; i++ {
+		s.mu.RLock()
+		id := s.id
+		s.mu.RUnlock()
+		if id == "spiffe://example.org/chproxy-new" {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("unexpected SPIFFE ID after reload: %q", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stopCh)
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("run must stop after stopCh is closed")
+	}
+}
+
+func TestSPIFFEUserAuth(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Clusters = []config.Cluster{
+		{
+			Name:              "cluster",
+			Scheme:            "http",
+			ClusterUsers:      []config.ClusterUser{{Name: "web"}},
+			HeartBeatInterval: config.Duration(5 * time.Second),
+		},
+	}
+	cfg.Users = []config.User{
+		{
+			Name:      "default",
+			Password:  "secret",
+			ToCluster: "cluster",
+			ToUser:    "web",
+		},
+		{
+			Name:      "reporter",
+			Password:  "secret",
+			ToCluster: "cluster",
+			ToUser:    "web",
+			SPIFFEIDs: []string{"spiffe://example.org/ns/reports/*"},
+		},
+	}
+	p, err := getProxy(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	prevSrc := svidSrc
+	svidSrc = &svidSource{}
+	defer func() { svidSrc = prevSrc }()
+
+	ca := newTestCert(t, "", nil)
+	newReq := func(id string) *http.Request {
+		req := httptest.NewRequest("POST", fakeServer.URL, nil)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{newTestCert(t, id, ca).cert},
+		}
+		return req
+	}
+
+	s, _, err := p.getScope(newReq("spiffe://example.org/ns/reports/app"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.user.name != "reporter" {
+		t.Fatalf("unexpected user %q; expected %q", s.user.name, "reporter")
+	}
+
+	if _, code, err := p.getScope(newReq("spiffe://example.org/ns/web/app")); err == nil || code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized error for unknown SPIFFE ID; got code %d, err %v", code, err)
+	}
+
+	// Explicit credentials take precedence over SVID.
+	req := newReq("spiffe://example.org/ns/reports/app")
+	req.SetBasicAuth("default", "secret")
+	s, _, err = p.getScope(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.user.name != "default" {
+		t.Fatalf("unexpected user %q; expected %q", s.user.name, "default")
+	}
+}
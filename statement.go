@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// checkStatement verifies the statement of the query from req
+// isn't listed in `denied_statements` of the user.
+func (s *scope) checkStatement(req *http.Request) error {
+	denied := s.user.deniedStatements
+	if len(denied) == 0 {
+		return nil
+	}
+	q, _, err := peekQuery(req, maxStatementPeekSize)
+	if err != nil {
+		return fmt.Errorf("cannot read query: %s", err)
+	}
+	if len(bytes.TrimSpace(q)) == 0 {
+		// Requests without query such as `/ping` don't execute statements.
+		return nil
+	}
+	stmt := queryStatement(q)
+	if len(stmt) == 0 {
+		return fmt.Errorf("cannot determine the statement of the query")
+	}
+	if denied[stmt] || denied[strings.ToUpper(statementClass(stmt))] {
+		return fmt.Errorf("%s queries are denied for the user", stmt)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckStatement(t *testing.T) {
+	s := &scope{
+		user: &user{
+			deniedStatements: map[string]bool{
+				"DDL":    true,
+				"SYSTEM": true,
+				"KILL":   true,
+			},
+		},
+	}
+	f := func(req *http.Request, expectedErr string) {
+		t.Helper()
+		err := s.checkStatement(req)
+		if len(expectedErr) == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting error %q", expectedErr)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("unexpected error %q; expecting %q", err, expectedErr)
+		}
+	}
+	post := func(q string) *http.Request {
+		return httptest.NewRequest("POST", "http://localhost", strings.NewReader(q))
+	}
+
+	f(post("SELECT 1"), "")
+	f(post("INSERT INTO t FORMAT TSV\n1"), "")
+	f(post("OPTIMIZE TABLE t"), "")
+	f(post(""), "")
+	f(post("DROP TABLE t"), "DROP queries are denied")
+	f(post("/* comment */ alter table t delete where 1"), "ALTER queries are denied")
+	f(post("system drop dns cache"), "SYSTEM queries are denied")
+	f(post("KILL QUERY WHERE 1"), "KILL queries are denied")
+	f(post("/* unterminated"), "cannot determine the statement")
+	f(httptest.NewRequest(http.MethodGet, "http://localhost?query=TRUNCATE+TABLE+t", nil), "TRUNCATE queries are denied")
+
+	// The query is obtained from both `query` param and the body.
+	f(httptest.NewRequest("POST", "http://localhost?query=/*", strings.NewReader("*/ DROP TABLE t")), "DROP queries are denied")
+
+	// Users without denied statements mustn't be checked.
+	s.user.deniedStatements = nil
+	f(post("DROP TABLE t"), "")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// checkTableQuery verifies the query from req references only tables
+// accessible by the user according to its `allowed_tables`
+// and `denied_tables`.
+func (s *scope) checkTableQuery(req *http.Request) error {
+	u := s.user
+	if len(u.allowedTables) == 0 && len(u.deniedTables) == 0 {
+		return nil
+	}
+	q, truncated, err := peekQuery(req, maxTenantQuerySize)
+	if err != nil {
+		return fmt.Errorf("cannot read query: %s", err)
+	}
+	refs := analyzeQuery(q, truncated)
+	return u.checkTableRefs(refs, req.URL.Query().Get("database"))
+}
+
+// checkTableRefs verifies refs contain only tables accessible by u.
+//
+// Tables without database belong to the given database.
+func (u *user) checkTableRefs(refs *queryRefs, database string) error {
+	if !refs.complete {
+		return fmt.Errorf("queries exceeding %d bytes cannot be checked for table access", maxTenantQuerySize)
+	}
+	if len(refs.statement) == 0 {
+		// Requests without query such as `/ping` don't access tables.
+		return nil
+	}
+	if !queryStatements[refs.statement] {
+		return fmt.Errorf("%s queries cannot be checked for table access", refs.statement)
+	}
+	if len(refs.unresolved) > 0 {
+		return fmt.Errorf("cannot check %s for table access", refs.unresolved[0])
+	}
+	for _, fn := range refs.tableFunctions {
+		if !tenantTableFunctions[strings.ToLower(fn)] {
+			return fmt.Errorf("table function %q is denied for users with table restrictions", fn)
+		}
+	}
+	for _, o := range refs.objects {
+		if len(o.database) == 0 {
+			if len(database) == 0 {
+				return fmt.Errorf("table %q must be qualified with the database or `database` param must be set", o.name)
+			}
+			o.database = database
+		}
+		if len(o.name) == 0 {
+			return fmt.Errorf("cannot check tables of database %q for table access", o.database)
+		}
+		if err := u.checkTable(o.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkTable returns an error if the table in the form `db.table`
+// isn't accessible by u.
+func (u *user) checkTable(table string) error {
+	for _, p := range u.deniedTables {
+		if ok, _ := path.Match(p, table); ok {
+			return fmt.Errorf("access to table %q is denied by `denied_tables` pattern %q", table, p)
+		}
+	}
+	if len(u.allowedTables) == 0 {
+		return nil
+	}
+	for _, p := range u.allowedTables {
+		if ok, _ := path.Match(p, table); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("access to table %q is denied; it doesn't match `allowed_tables`", table)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckTableRefs(t *testing.T) {
+	u := &user{
+		allowedTables: []string{"analytics.*", "reports.daily_*"},
+		deniedTables:  []string{"analytics.secret_*"},
+	}
+	f := func(q, database string, expectedErr string) {
+		t.Helper()
+		err := u.checkTableRefs(analyzeQuery([]byte(q), false), database)
+		if len(expectedErr) == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %s", q, err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting error for %q", q)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("unexpected error for %q: %q; expecting %q", q, err, expectedErr)
+		}
+	}
+
+	f("SELECT 1", "", "")
+	f("SELECT * FROM analytics.events JOIN reports.daily_sales USING x", "", "")
+	f("SELECT * FROM events", "analytics", "")
+	f("SELECT count() FROM numbers(10)", "", "")
+	f("SELECT * FROM reports.monthly_sales", "", `access to table "reports.monthly_sales" is denied; it doesn't match`)
+	f("SELECT * FROM analytics.secret_keys", "", `access to table "analytics.secret_keys" is denied by`)
+	f("SELECT * FROM secret_keys", "analytics", `access to table "analytics.secret_keys" is denied by`)
+	f("SELECT * FROM analytics.events WHERE x IN (SELECT x FROM system.tables)", "", `access to table "system.tables" is denied`)
+	f("SELECT dictGet('analytics.secret_dict', 'a', 1)", "", `access to table "analytics.secret_dict" is denied`)
+	f("SELECT * FROM events", "", `table "events" must be qualified`)
+	f("SELECT * FROM remote('127.0.0.1', system.tables)", "", `table function "remote" is denied`)
+	f("CREATE TABLE analytics.t (x UInt8) ENGINE = Merge(analytics, '^secret')", "", `cannot check tables of database "analytics"`)
+	f("SYSTEM RELOAD DICTIONARIES", "", "SYSTEM queries cannot be checked")
+	f("SELECT * FROM {t:Identifier}", "analytics", "cannot check the query parameter {t:Identifier}")
+	f("SELECT * FROM analytics.{t:Identifier}", "", "cannot check the query parameter {t:Identifier}")
+	f("SELECT * FROM {db:Identifier}.secret_keys", "", "cannot check the query parameter {db:Identifier}")
+
+	// Only denied tables are checked if `allowed_tables` isn't set.
+	u = &user{
+		deniedTables: []string{"*.secret_*"},
+	}
+	f("SELECT * FROM reports.monthly_sales", "", "")
+	f("SELECT * FROM reports.secret_sales", "", `access to table "reports.secret_sales" is denied`)
+	f("SELECT * FROM reports.{t:Identifier}", "", "cannot check the query parameter {t:Identifier}")
+}
+
+func TestCheckTableQuery(t *testing.T) {
+	s := &scope{
+		user: &user{
+			deniedTables: []string{"system.*"},
+		},
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://localhost?query=SELECT+*+FROM+processes&database=system", nil)
+	if err := s.checkTableQuery(req); err == nil {
+		t.Fatalf("expecting error for denied table")
+	}
+	req = httptest.NewRequest("POST", "http://localhost", strings.NewReader("SELECT * FROM default.t"))
+	if err := s.checkTableQuery(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Users without table ACLs mustn't be checked.
+	s.user.deniedTables = nil
+	req = httptest.NewRequest("POST", "http://localhost", strings.NewReader("SELECT * FROM system.processes"))
+	if err := s.checkTableQuery(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
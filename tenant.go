@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxTenantQuerySize is the maximum size of the query part, which may be
+// checked for tenant databases.
+//
+// INSERT data may exceed this size, since it isn't analyzed.
+const maxTenantQuerySize = 256 * 1024
+
+// tenantTableFunctions contains table functions, which don't access
+// tables and databases, so they are allowed for tenant users.
+var tenantTableFunctions = map[string]bool{
+	"numbers":        true,
+	"numbers_mt":     true,
+	"zeros":          true,
+	"zeros_mt":       true,
+	"generaterandom": true,
+	"values":         true,
+	"null":           true,
+	"input":          true,
+}
+
+// checkTenantQuery verifies the query from req references only databases
+// accessible by the user according to its `database_prefix`
+// or `allowed_databases`.
+func (s *scope) checkTenantQuery(req *http.Request) error {
+	u := s.user
+	if len(u.databasePrefix) == 0 && len(u.allowedDatabases) == 0 {
+		return nil
+	}
+	q, truncated, err := peekQuery(req, maxTenantQuerySize)
+	if err != nil {
+		return fmt.Errorf("cannot read query: %s", err)
+	}
+	refs := analyzeQuery(q, truncated)
+	return checkTenantRefs(refs, req.URL.Query().Get("database"), u.checkDatabase)
+}
+
+// checkDatabase returns an error if db isn't accessible by u.
+func (u *user) checkDatabase(db string) error {
+	if len(u.allowedDatabases) > 0 {
+		if !u.allowedDatabases[db] {
+			return fmt.Errorf("access to database %q is denied; allowed databases are %s", db, u.allowedDatabasesList())
+		}
+		return nil
+	}
+	if !strings.HasPrefix(db, u.databasePrefix) {
+		return fmt.Errorf("access to database %q is denied; tenant databases must start with %q", db, u.databasePrefix)
+	}
+	return nil
+}
+
+// allowedDatabasesList returns sorted comma-separated list
+// of databases accessible by u.
+func (u *user) allowedDatabasesList() string {
+	dbs := make([]string, 0, len(u.allowedDatabases))
+	for db := range u.allowedDatabases {
+		dbs = append(dbs, strconv.Quote(db))
+	}
+	sort.Strings(dbs)
+	return strings.Join(dbs, ", ")
+}
+
+// checkTenantRefs verifies refs contain only databases passing checkDatabase.
+//
+// Tables without database belong to the given database.
+func checkTenantRefs(refs *queryRefs, database string, checkDatabase func(db string) error) error {
+	if !refs.complete {
+		return fmt.Errorf("queries exceeding %d bytes cannot be checked for tenant databases", maxTenantQuerySize)
+	}
+	if len(refs.statement) == 0 {
+		// Requests without query such as `/ping` don't access databases.
+		return nil
+	}
+	if !queryStatements[refs.statement] {
+		return fmt.Errorf("%s queries are denied for tenant users", refs.statement)
+	}
+	if len(refs.unresolved) > 0 {
+		return fmt.Errorf("cannot check %s for tenant databases", refs.unresolved[0])
+	}
+	for _, fn := range refs.tableFunctions {
+		if !tenantTableFunctions[strings.ToLower(fn)] {
+			return fmt.Errorf("table function %q is denied for tenant users", fn)
+		}
+	}
+	for _, db := range refs.databases {
+		if err := checkDatabase(db); err != nil {
+			return err
+		}
+	}
+	if len(database) > 0 {
+		if err := checkDatabase(database); err != nil {
+			return err
+		}
+	}
+	if len(refs.tables) > 0 && len(database) == 0 {
+		return fmt.Errorf("table %q must be qualified with the database or `database` param must be set", refs.tables[0])
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckTenantRefs(t *testing.T) {
+	u := &user{
+		databasePrefix: "tenant1_",
+	}
+	f := func(q, database string, expectedErr string) {
+		t.Helper()
+		err := checkTenantRefs(analyzeQuery([]byte(q), false), database, u.checkDatabase)
+		if len(expectedErr) == 0 {
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %s", q, err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("expecting error for %q", q)
+		}
+		if !strings.Contains(err.Error(), expectedErr) {
+			t.Fatalf("unexpected error for %q: %q; expecting %q", q, err, expectedErr)
+		}
+	}
+
+	f("SELECT 1", "", "")
+	f("SELECT * FROM tenant1_db.t JOIN tenant1_logs.t USING x", "", "")
+	f("SELECT * FROM t", "tenant1_db", "")
+	f("SELECT count() FROM numbers(10)", "", "")
+	f("SELECT * FROM tenant2_db.t", "tenant1_db", `access to database "tenant2_db" is denied`)
+	f("SELECT * FROM tenant1_db.t WHERE x IN (SELECT x FROM system.processes)", "", `access to database "system" is denied`)
+	f("SELECT 1", "tenant2_db", `access to database "tenant2_db" is denied`)
+	f("SELECT * FROM t", "", "table \"t\" must be qualified with the database")
+	f("SELECT * FROM remote('127.0.0.1', tenant2_db.t)", "", `table function "remote" is denied`)
+	f("SELECT dictGet(concat('tenant2', '_db.d'), 'a', 1)", "", "cannot check the first argument of dictGet")
+	f("SYSTEM RELOAD DICTIONARIES", "", "SYSTEM queries are denied")
+	f("GRANT ALL ON *.* TO tenant1", "", "GRANT queries are denied")
+	f("CREATE USER tenant1_admin", "", "CREATE USER queries are denied")
+	f("SELECT * FROM {db:Identifier}.x", "", "cannot check the query parameter {db:Identifier}")
+	f("SELECT * FROM {t:Identifier}", "tenant1_db", "cannot check the query parameter {t:Identifier}")
+	f("SELECT * FROM tenant1_db.{t:Identifier}", "", "cannot check the query parameter {t:Identifier}")
+	f("SHOW TABLES FROM {db:Identifier}", "", "cannot check the query parameter {db:Identifier}")
+	f("SELECT * FROM tenant1_db.t WHERE x IN {ids:Array(UInt8)}", "", "")
+
+	u = &user{
+		allowedDatabases: map[string]bool{
+			"analytics": true,
+			"reports":   true,
+		},
+	}
+	f("SELECT * FROM analytics.t JOIN reports.t USING x", "", "")
+	f("SELECT * FROM t", "reports", "")
+	f("SELECT * FROM analytics_tmp.t", "", `access to database "analytics_tmp" is denied; allowed databases are "analytics", "reports"`)
+	f("SELECT * FROM t", "default", `access to database "default" is denied`)
+	f("SELECT * FROM analytics.t WHERE x IN (SELECT x FROM system.tables)", "", `access to database "system" is denied`)
+	f("SELECT * FROM remote('127.0.0.1', analytics.t)", "", `table function "remote" is denied`)
+	f("SELECT * FROM {db:Identifier}.t", "", "cannot check the query parameter {db:Identifier}")
+	f("SHOW TABLES FROM {db:Identifier}", "reports", "cannot check the query parameter {db:Identifier}")
+}
+
+func TestCheckTenantQuery(t *testing.T) {
+	s := &scope{
+		user: &user{
+			databasePrefix: "tenant1_",
+		},
+	}
+
+	// Large INSERT data mustn't be analyzed, but must be preserved.
+	data := bytes.Repeat([]byte("1,FROM tenant2_db.t\n"), maxTenantQuerySize)
+	body := append([]byte("INSERT INTO tenant1_db.t FORMAT CSV\n"), data...)
+	req := httptest.NewRequest("POST", "http://localhost", bytes.NewReader(body))
+	if err := s.checkTenantQuery(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Fatalf("the request body must be preserved")
+	}
+
+	req = httptest.NewRequest("POST", "http://localhost?query=INSERT+INTO+tenant2_db.t+FORMAT+CSV", strings.NewReader("1,2"))
+	if err := s.checkTenantQuery(req); err == nil {
+		t.Fatalf("expecting error for the query passed via `query` param")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://localhost?query=SELECT+*+FROM+t&database=tenant1_db", nil)
+	if err := s.checkTenantQuery(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Queries with long query part cannot be checked.
+	q := "SELECT * FROM tenant1_db.t WHERE x IN (" + strings.Repeat("1,", maxTenantQuerySize) + "1)"
+	req = httptest.NewRequest("POST", "http://localhost", strings.NewReader(q))
+	if err := s.checkTenantQuery(req); err == nil {
+		t.Fatalf("expecting error for too long query")
+	}
+
+	// Users without database prefix mustn't be checked.
+	s.user.databasePrefix = ""
+	req = httptest.NewRequest("POST", "http://localhost", strings.NewReader("SELECT * FROM tenant2_db.t"))
+	if err := s.checkTenantQuery(req); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
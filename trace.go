@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type traceContextKey struct{}
+
+// requestTrace collects routing decision, cache status and timings
+// for the request.
+//
+// It is collected only for requests with the trace in their context,
+// such as requests from admin console.
+type requestTrace struct {
+	User        string `json:"user"`
+	Cluster     string `json:"cluster"`
+	ClusterUser string `json:"cluster_user"`
+	Replica     string `json:"replica"`
+	Node        string `json:"cluster_node"`
+	QueryID     string `json:"query_id"`
+
+	// Cache status: `disabled`, `bypass`, `uncacheable`, `hit`, `peer_hit`,
+	// `refresh` or `miss`.
+	Cache string `json:"cache"`
+
+	QueueDuration    time.Duration `json:"-"`
+	UpstreamDuration time.Duration `json:"-"`
+}
+
+// withTrace returns req with the given t in the context.
+func withTrace(req *http.Request, t *requestTrace) *http.Request {
+	ctx := context.WithValue(req.Context(), traceContextKey{}, t)
+	return req.WithContext(ctx)
+}
+
+// getTrace returns trace for the given req.
+//
+// nil is returned if the trace isn't collected for req.
+func getTrace(req *http.Request) *requestTrace {
+	t, _ := req.Context().Value(traceContextKey{}).(*requestTrace)
+	return t
+}
+
+// setScope stores routing decision made for s.
+func (t *requestTrace) setScope(s *scope, queueDuration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.User = s.user.name
+	t.Cluster = s.cluster.name
+	t.ClusterUser = s.clusterUser.name
+	t.Replica = s.host.replica.name
+	t.Node = s.host.addr.Host
+	t.QueryID = s.id.String()
+	t.QueueDuration = queueDuration
+	if s.user.cache == nil {
+		t.Cache = "disabled"
+	}
+}
+
+func (t *requestTrace) setCache(status string) {
+	if t == nil {
+		return
+	}
+	t.Cache = status
+}
+
+func (t *requestTrace) setUpstreamDuration(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.UpstreamDuration = d
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// newTransport returns transport for requests to nodes of the cluster
+// with the given cfg.
+func newTransport(cfg config.Cluster) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if len(cfg.Proxy.URL) > 0 {
+		u, err := url.Parse(cfg.Proxy.URL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse `proxy.url` %q: %s", cfg.Proxy.URL, err)
+		}
+		// Credentials are sent in Proxy-Authorization header for http(s)
+		// proxies and during the handshake for socks5 proxies.
+		if len(cfg.Proxy.User) > 0 {
+			u.User = url.UserPassword(cfg.Proxy.User, cfg.Proxy.Password)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if len(cfg.SourceAddr) > 0 {
+		ip, err := getSourceIP(cfg.SourceAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `source_addr` %q: %s", cfg.SourceAddr, err)
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	dial := dialer.DialContext
+	if cfg.DNSCacheTTL > 0 {
+		dial = newDNSCache(time.Duration(cfg.DNSCacheTTL)).dialContext(dial)
+	}
+	tr := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.SPIFFE {
+		if svidSrc == nil {
+			return nil, fmt.Errorf("`spiffe` section must be configured on startup for `cluster.spiffe`")
+		}
+		tr.TLSClientConfig = svidSrc.clientTLSConfig()
+	}
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	applyTLSSettings(tr.TLSClientConfig, cfg.TLS)
+	if err := applyClientTLSSettings(tr.TLSClientConfig, cfg.TLS); err != nil {
+		return nil, err
+	}
+	if cfg.HTTP2 {
+		if err := enableHTTP2(tr); err != nil {
+			return nil, fmt.Errorf("cannot enable `http2`: %s", err)
+		}
+	}
+	return tr, nil
+}
+
+// applyClientTLSSettings applies settings from cfg specific
+// to connections to cluster nodes to tlsCfg.
+func applyClientTLSSettings(tlsCfg *tls.Config, cfg config.TLS) error {
+	if len(cfg.CAFile) > 0 {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("cannot load `tls.ca_file`: %s", err)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if len(cfg.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load `tls.cert_file` and `tls.key_file`: %s", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(cfg.ServerName) > 0 {
+		tlsCfg.ServerName = cfg.ServerName
+	}
+	if cfg.InsecureSkipVerify {
+		tlsCfg.InsecureSkipVerify = true
+	}
+	return nil
+}
+
+// getSourceIP returns IP for the given addr, which may be either
+// IP address or network interface name.
+func getSourceIP(addr string) (net.IP, error) {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip, nil
+	}
+	iface, err := net.InterfaceByName(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP, nil
+		}
+	}
+	return nil, fmt.Errorf("no IPv4 address found on interface %q", addr)
+}
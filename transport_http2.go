@@ -0,0 +1,15 @@
+//go:build go1.13
+// +build go1.13
+
+package main
+
+import "net/http"
+
+// enableHTTP2 enables HTTP/2 negotiation via ALPN for tr.
+//
+// HTTP/2 must be forced, since the transport has custom dialer
+// and TLS config.
+func enableHTTP2(tr *http.Transport) error {
+	tr.ForceAttemptHTTP2 = true
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !go1.13
+// +build !go1.13
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// enableHTTP2 enables HTTP/2 negotiation via ALPN for tr.
+func enableHTTP2(tr *http.Transport) error {
+	return fmt.Errorf("HTTP/2 to cluster nodes requires chproxy built with Go 1.13 or newer")
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+)
+
+// inheritedListenersEnv contains listen addresses of listeners passed
+// to the new process during zero-downtime upgrade.
+//
+// File descriptors of the listeners start from 3 in the order of addresses.
+const inheritedListenersEnv = "CHPROXY_INHERITED_LISTENERS"
+
+// minShutdownTimeout is the minimum duration for finishing in-flight
+// requests during zero-downtime upgrade.
+const minShutdownTimeout = time.Minute
+
+var (
+	// listenersLock protects the variables below.
+	listenersLock sync.Mutex
+
+	// inheritedListeners contains listeners inherited from the parent
+	// process by their addresses.
+	inheritedListeners map[string]*net.TCPListener
+
+	// listeners contains active listeners by their addresses.
+	listeners = make(map[string]*net.TCPListener)
+
+	// servers contains running http servers.
+	servers []*http.Server
+)
+
+// inheritListeners takes listeners passed by the parent process
+// for the given addresses.
+//
+// Inherited listeners for other addresses are closed, so connections
+// to them aren't stuck.
+func inheritListeners(addrs ...string) error {
+	v := os.Getenv(inheritedListenersEnv)
+	if len(v) == 0 {
+		return nil
+	}
+	os.Unsetenv(inheritedListenersEnv)
+
+	used := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		used[addr] = true
+	}
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+	inheritedListeners = make(map[string]*net.TCPListener)
+	for i, addr := range strings.Split(v, ",") {
+		f := os.NewFile(uintptr(3+i), addr)
+		if !used[addr] {
+			log.Infof("closing inherited listener for %q missing in the config", addr)
+			f.Close()
+			continue
+		}
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("cannot use inherited listener for %q: %s", addr, err)
+		}
+		tln, ok := ln.(*net.TCPListener)
+		if !ok {
+			ln.Close()
+			return fmt.Errorf("inherited listener for %q isn't a TCP listener", addr)
+		}
+		inheritedListeners[addr] = tln
+	}
+	return nil
+}
+
+// getListener returns the listener for addr.
+//
+// The listener inherited from the parent process is used if it exists.
+// The listener is registered, so it may be passed to the new process
+// during zero-downtime upgrade.
+func getListener(addr string) (*net.TCPListener, error) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	ln := inheritedListeners[addr]
+	if ln != nil {
+		delete(inheritedListeners, addr)
+		log.Infof("using inherited listener for %q", addr)
+	} else {
+		l, err := net.Listen("tcp4", addr)
+		if err != nil {
+			return nil, err
+		}
+		ln = l.(*net.TCPListener)
+	}
+	listeners[addr] = ln
+	return ln, nil
+}
+
+// registerServer registers s, so it may be gracefully stopped
+// during zero-downtime upgrade.
+func registerServer(s *http.Server) {
+	listenersLock.Lock()
+	servers = append(servers, s)
+	listenersLock.Unlock()
+}
+
+// upgrade starts the new process from the current executable,
+// which inherits all the listeners of the current process.
+//
+// The config is validated beforehand, so the listeners aren't left
+// without a process serving them.
+func upgrade() error {
+	content, err := fetchConfig(*configFile)
+	if err == nil {
+		_, err = config.Load(content)
+	}
+	if err != nil {
+		return fmt.Errorf("the new process cannot load config %q: %s", *configFile, err)
+	}
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot obtain the executable path: %s", err)
+	}
+
+	var (
+		addrs []string
+		files []*os.File
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	listenersLock.Lock()
+	for addr, ln := range listeners {
+		f, err := ln.File()
+		if err != nil {
+			listenersLock.Unlock()
+			return fmt.Errorf("cannot obtain file for listener %q: %s", addr, err)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
+	}
+	listenersLock.Unlock()
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, inheritedListenersEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, inheritedListenersEnv+"="+strings.Join(addrs, ","))
+	p, err := os.StartProcess(path, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot start the new process %q: %s", path, err)
+	}
+	log.Infof("the new process is started with pid %d", p.Pid)
+	return nil
+}
+
+// shutdownServers stops accepting new connections and waits until
+// in-flight requests are finished.
+//
+// Requests cannot last longer than the maximum `write_timeout`
+// of the servers, so the waiting is limited by it.
+func shutdownServers() {
+	listenersLock.Lock()
+	ss := servers
+	listenersLock.Unlock()
+
+	timeout := minShutdownTimeout
+	for _, s := range ss {
+		if s.WriteTimeout > timeout {
+			timeout = s.WriteTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range ss {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Errorf("error while waiting for in-flight requests: %s", err)
+			}
+		}(s)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestShutdownServers(t *testing.T) {
+	defer func() {
+		listeners = make(map[string]*net.TCPListener)
+		servers = nil
+	}()
+
+	ln, err := getListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if listeners["127.0.0.1:0"] != ln {
+		t.Fatalf("the listener must be registered")
+	}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServe(ln, h, config.TimeoutCfg{})
+	}()
+
+	// Wait until the server is registered.
+	for i := 0; ; i++ {
+		listenersLock.Lock()
+		n := len(servers)
+		listenersLock.Unlock()
+		if n > 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("the server isn't registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	respBody := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			respBody <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		respBody <- string(b)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// In-flight requests must be finished before shutdownServers returns.
+	shutdownServers()
+	if err := <-serveErr; err != nil {
+		t.Fatalf("unexpected error after graceful shutdown: %s", err)
+	}
+	if b := <-respBody; b != "done" {
+		t.Fatalf("unexpected response %q; expecting %q", b, "done")
+	}
+}
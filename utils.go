@@ -28,22 +28,45 @@ func getAuth(req *http.Request) (string, string) {
 	if name, pass, ok := req.BasicAuth(); ok {
 		return name, pass
 	}
-	// if basicAuth is empty - check URL params `user` and `password`
+	// if basicAuth is empty - check ClickHouse headers, which are sent
+	// by many ClickHouse client libraries
+	if name := req.Header.Get("X-ClickHouse-User"); name != "" {
+		return name, req.Header.Get("X-ClickHouse-Key")
+	}
+	// if still no credentials - check URL params `user` and `password`
 	params := req.URL.Query()
 	if name := params.Get("user"); name != "" {
 		pass := params.Get("password")
 		return name, pass
 	}
-	// if still no credentials - treat it as `default` user request
+	// if still no credentials - treat it as a request of `default_user`
+	// of the listener or as `default` user request
+	if l := getListenerConfig(req); l != nil && len(l.DefaultUser) > 0 {
+		return l.DefaultUser, ""
+	}
 	return "default", ""
 }
 
+// hasAuth returns true if req contains credentials.
+func hasAuth(req *http.Request) bool {
+	if _, _, ok := req.BasicAuth(); ok {
+		return true
+	}
+	if len(getBearerToken(req)) > 0 {
+		return true
+	}
+	if len(req.Header.Get("X-ClickHouse-User")) > 0 {
+		return true
+	}
+	return len(req.URL.Query().Get("user")) > 0
+}
+
 const (
 	okResponse       = "Ok.\n"
 	isHealthyTimeout = 3 * time.Second
 )
 
-func isHealthy(addr string) error {
+func isHealthy(client *http.Client, addr string) error {
 	req, err := http.NewRequest("GET", addr, nil)
 	if err != nil {
 		return err
@@ -53,7 +76,7 @@ func isHealthy(addr string) error {
 	req = req.WithContext(ctx)
 
 	startTime := time.Now()
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("cannot send request in %s: %s", time.Since(startTime), err)
 	}
@@ -90,8 +113,10 @@ func getQuerySnippet(req *http.Request) string {
 
 	// 'read' request body, so it traps into to crc.
 	// Ignore any errors, since getQuerySnippet is called only
-	// during error reporting.
-	io.Copy(ioutil.Discard, crc)
+	// during error reporting. There is no need in reading more
+	// than crc holds, so the body isn't read in full for requests
+	// rejected before applying `max_request_body_size`.
+	io.Copy(ioutil.Discard, io.LimitReader(crc, maxQuerySnippetSize))
 	data := crc.String()
 
 	u := getDecompressor(req)
@@ -135,6 +160,99 @@ func getFullQuery(req *http.Request) ([]byte, error) {
 	return b, nil
 }
 
+// peekQuery returns up to n bytes of the query from req without consuming
+// the request body.
+//
+// The query is obtained from `query` param and from the request body
+// as ClickHouse does. The returned bool is set if the query exceeds n bytes.
+//
+// Compressed bodies are decompressed only up to n+1 bytes. The peeked body
+// is kept in req.Body, so subsequent calls don't read it again.
+func peekQuery(req *http.Request, n int) ([]byte, bool, error) {
+	param := req.URL.Query().Get("query")
+	if req.Method == http.MethodGet || strings.Contains(req.Header.Get("Content-Type"), "multipart/form-data") {
+		// The request body doesn't contain the query.
+		return []byte(param), len(param) > n, nil
+	}
+
+	qb, ok := req.Body.(*queryBody)
+	if !ok || qb.n < n {
+		qb = peekQueryBody(req, n)
+	}
+	if qb.err != nil {
+		return nil, false, qb.err
+	}
+	if qb.query == nil || qb.param != param {
+		// The `query` param may be modified after the body has been peeked.
+		q := []byte(param)
+		if len(q) > 0 {
+			q = append(q, '\n')
+		}
+		qb.query = append(q, qb.body...)
+		qb.param = param
+	}
+	return qb.query, len(qb.body) > n, nil
+}
+
+// queryBody is the request body with the peeked query.
+type queryBody struct {
+	peekedReadCloser
+
+	// n is the number of bytes requested from peekQueryBody.
+	n int
+
+	// body contains up to n+1 decompressed bytes of the body.
+	body []byte
+
+	// query is body prepended with param.
+	query []byte
+	param string
+
+	// err is the error occurred while peeking the body.
+	err error
+}
+
+// peekQueryBody reads up to n+1 bytes of the decompressed request body
+// and restores req.Body for further reading.
+func peekQueryBody(req *http.Request, n int) *queryBody {
+	var buf bytes.Buffer
+	var r io.Reader = io.TeeReader(req.Body, &buf)
+	qb := &queryBody{
+		peekedReadCloser: peekedReadCloser{
+			Reader: io.MultiReader(&buf, req.Body),
+			Closer: req.Body,
+		},
+		n: n,
+	}
+	// Restore the body for further reading even on errors.
+	req.Body = qb
+
+	if u := getDecompressor(req); u != nil {
+		dr, err := u.reader(r)
+		if err != nil {
+			qb.err = err
+			return qb
+		}
+		r = dr
+	}
+	qb.body, qb.err = ioutil.ReadAll(io.LimitReader(r, int64(n)+1))
+	return qb
+}
+
+// peekBody returns up to n bytes from req.Body without consuming it.
+func peekBody(req *http.Request, n int) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	// Restore the body for further reading.
+	req.Body = &peekedReadCloser{
+		Reader: io.MultiReader(bytes.NewReader(body), req.Body),
+		Closer: req.Body,
+	}
+	return body, nil
+}
+
 // canCacheQuery returns true if q can be cached.
 func canCacheQuery(q []byte) bool {
 	q = skipLeadingComments(q)
@@ -200,6 +318,14 @@ func sortHeader(header string) string {
 	return strings.Join(h, ",")
 }
 
+// stringEscaper escapes special chars in ClickHouse string literals.
+var stringEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// escapeString escapes s for use inside single-quoted ClickHouse string literal.
+func escapeString(s string) string {
+	return stringEscaper.Replace(s)
+}
+
 func getDecompressor(req *http.Request) decompressor {
 	if req.Header.Get("Content-Encoding") == "gzip" {
 		return gzipDecompressor{}
@@ -212,21 +338,36 @@ func getDecompressor(req *http.Request) decompressor {
 
 type decompressor interface {
 	decompress(r io.Reader) ([]byte, error)
+
+	// reader returns a reader decompressing data from r on the fly.
+	reader(r io.Reader) (io.Reader, error)
 }
 
 type gzipDecompressor struct{}
 
 func (dc gzipDecompressor) decompress(r io.Reader) ([]byte, error) {
+	gr, err := dc.reader(r)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gr)
+}
+
+func (dc gzipDecompressor) reader(r io.Reader) (io.Reader, error) {
 	gr, err := gzip.NewReader(r)
 	if err != nil {
 		return nil, fmt.Errorf("cannot ungzip query: %s", err)
 	}
-	return ioutil.ReadAll(gr)
+	return gr, nil
 }
 
 type chDecompressor struct{}
 
 func (dc chDecompressor) decompress(r io.Reader) ([]byte, error) {
-	lr := chdecompressor.NewReader(r)
+	lr, _ := dc.reader(r)
 	return ioutil.ReadAll(lr)
 }
+
+func (dc chDecompressor) reader(r io.Reader) (io.Reader, error) {
+	return chdecompressor.NewReader(r), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// validatePath is the path for checking query syntax without executing queries.
+const validatePath = "/validate"
+
+const validateQueryTimeout = time.Second * 10
+
+// maxValidateQuerySize is the maximum size of the query to validate.
+// It matches the default `max_query_size` in ClickHouse.
+const maxValidateQuerySize = 256 * 1024
+
+// maxValidateResponseSize is the maximum size of the validation response
+// read from ClickHouse.
+const maxValidateResponseSize = 4 << 20
+
+// serveValidate checks syntax of the query from req without executing it.
+//
+// The query is checked via `EXPLAIN AST` on a cluster node, so it doesn't
+// consume execution slots of the user and the cluster user. The request
+// is still subject to `requests_per_minute` and `max_request_body_size`.
+// The response from ClickHouse is passed to the client: the AST for valid
+// queries and the syntax error otherwise.
+func (rp *reverseProxy) serveValidate(rw http.ResponseWriter, req *http.Request) {
+	s, status, err := rp.getScope(req)
+	if err != nil {
+		q := getQuerySnippet(req)
+		err = fmt.Errorf("%q: %s; query: %q", req.RemoteAddr, err, q)
+		respondWith(rw, err, status)
+		return
+	}
+
+	if err := s.incRate(); err != nil {
+		limitExcess.With(s.labels).Inc()
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusTooManyRequests)
+		return
+	}
+	if err := s.limitRequestBody(req); err != nil {
+		requestBodyTooLarge.With(s.labels).Inc()
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	query, truncated, err := peekQuery(req, maxValidateQuerySize)
+	if err == errRequestBodyTooLarge {
+		requestBodyTooLarge.With(s.labels).Inc()
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("%s: cannot read query: %s", s, err)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+	if truncated {
+		err = fmt.Errorf("%s: the query to validate exceeds %d bytes", s, maxValidateQuerySize)
+		respondWith(rw, err, http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(bytes.TrimSpace(query)) == 0 {
+		err = fmt.Errorf("%s: the query to validate cannot be empty", s)
+		respondWith(rw, err, http.StatusBadRequest)
+		return
+	}
+
+	status, body, err := s.validateQuery(req.Context(), query)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", s, err)
+		respondWith(rw, err, http.StatusBadGateway)
+		return
+	}
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// validateQuery sends `EXPLAIN AST` for the query to s.host.
+//
+// It returns the response status code and body from ClickHouse.
+func (s *scope) validateQuery(ctx context.Context, query []byte) (int, []byte, error) {
+	body := io.MultiReader(strings.NewReader("EXPLAIN AST "), bytes.NewReader(query))
+	addr := s.host.addr.String()
+	req, err := http.NewRequest("POST", addr, body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while creating validation request to %s: %s", addr, err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, validateQueryTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.SetBasicAuth(s.getCredentials())
+
+	resp, err := s.cluster.client().Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while validating query at %q: %s", addr, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxValidateResponseSize+1))
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot read validation response from %q: %s", addr, err)
+	}
+	if len(respBody) > maxValidateResponseSize {
+		return 0, nil, fmt.Errorf("validation response from %q exceeds %d bytes", addr, maxValidateResponseSize)
+	}
+	return resp.StatusCode, respBody, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestServeValidate(t *testing.T) {
+	// The server emulates ClickHouse accepting only SELECT queries.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		query := string(body)
+		if !strings.HasPrefix(query, "EXPLAIN AST ") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "unexpected query %q", query)
+			return
+		}
+		if !strings.HasPrefix(query, "EXPLAIN AST SELECT") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Code: 62, e.displayText() = DB::Exception: Syntax error")
+			return
+		}
+		fmt.Fprint(w, "SelectWithUnionQuery")
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p, err := newConfiguredProxy(&config.Config{
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:                 "default",
+				ToCluster:            "cluster",
+				ToUser:               "web",
+				MaxConcurrentQueries: 1,
+				ReqPerMin:            6,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Occupy the only execution slot of the user.
+	s, _, err := p.getScope(httptest.NewRequest("POST", "http://localhost", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.incQueued(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer s.dec()
+
+	f := func(req *http.Request, expectedStatus int, expectedBody string) {
+		t.Helper()
+		rw := httptest.NewRecorder()
+		p.serveValidate(rw, req)
+		if rw.Code != expectedStatus {
+			t.Fatalf("unexpected status code %d; expecting %d; body: %q", rw.Code, expectedStatus, rw.Body.String())
+		}
+		if !strings.Contains(rw.Body.String(), expectedBody) {
+			t.Fatalf("unexpected response body %q; expecting %q", rw.Body.String(), expectedBody)
+		}
+	}
+
+	f(httptest.NewRequest("POST", "http://localhost/validate", strings.NewReader("SELECT 1")),
+		http.StatusOK, "SelectWithUnionQuery")
+	f(httptest.NewRequest("GET", "http://localhost/validate?query=SELECT%201", nil),
+		http.StatusOK, "SelectWithUnionQuery")
+	f(httptest.NewRequest("POST", "http://localhost/validate", strings.NewReader("SELEC 1")),
+		http.StatusBadRequest, "Syntax error")
+	f(httptest.NewRequest("POST", "http://localhost/validate", strings.NewReader(" ")),
+		http.StatusBadRequest, "the query to validate cannot be empty")
+	f(httptest.NewRequest("POST", "http://localhost/validate?user=foo", strings.NewReader("SELECT 1")),
+		http.StatusUnauthorized, "invalid username or password")
+	f(httptest.NewRequest("POST", "http://localhost/validate", strings.NewReader("SELECT "+strings.Repeat("1", maxValidateQuerySize))),
+		http.StatusRequestEntityTooLarge, "the query to validate exceeds")
+
+	// Validation requests are counted towards requests_per_minute.
+	f(httptest.NewRequest("POST", "http://localhost/validate", strings.NewReader("SELECT 1")),
+		http.StatusTooManyRequests, "requests_per_minute limit: 6")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// vaultRetryInterval is the interval between attempts to refresh
+// credentials after failed requests to Vault.
+const vaultRetryInterval = 10 * time.Second
+
+// vaultClient reads secrets from Vault via HTTP API.
+type vaultClient struct {
+	addr            string
+	token           string
+	tokenFile       string
+	namespace       string
+	refreshInterval time.Duration
+	client          *http.Client
+}
+
+// newVaultClient returns Vault client for the given cfg.
+//
+// nil is returned if Vault isn't configured.
+func newVaultClient(cfg config.Vault) (*vaultClient, error) {
+	if len(cfg.Address) == 0 {
+		return nil, nil
+	}
+	tr := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if len(cfg.CAFile) > 0 {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load `vault.ca_file`: %s", err)
+		}
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &vaultClient{
+		addr:            strings.TrimRight(cfg.Address, "/"),
+		token:           cfg.Token,
+		tokenFile:       cfg.TokenFile,
+		namespace:       cfg.Namespace,
+		refreshInterval: time.Duration(cfg.RefreshInterval),
+		client: &http.Client{
+			Transport: tr,
+			Timeout:   time.Duration(cfg.Timeout),
+		},
+	}, nil
+}
+
+// vaultSecret is a secret read from Vault.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+// read returns the secret at the given path.
+//
+// Secrets of KV version 2 engine are unwrapped, so their data
+// may be accessed the same way as for other engines.
+func (vc *vaultClient) read(path string) (*vaultSecret, error) {
+	s, err := vc.do("GET", "/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if data, ok := s.Data["data"].(map[string]interface{}); ok {
+		if _, ok := s.Data["metadata"]; ok {
+			s.Data = data
+		}
+	}
+	return s, nil
+}
+
+// renew extends the lease with the given id by increment
+// and returns the renewed lease.
+func (vc *vaultClient) renew(leaseID string, increment int) (*vaultSecret, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": increment,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal request: %s", err)
+	}
+	return vc.do("PUT", "/v1/sys/leases/renew", body)
+}
+
+func (vc *vaultClient) do(method, path string, body []byte) (*vaultSecret, error) {
+	token := vc.token
+	if len(vc.tokenFile) > 0 {
+		// The token file may be updated by Vault agent at any time.
+		data, err := ioutil.ReadFile(vc.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read `vault.token_file`: %s", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	req, err := http.NewRequest(method, vc.addr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if len(vc.namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot send request to Vault: %s", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response from Vault: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from Vault for %s %q: %d; response: %q",
+			method, path, resp.StatusCode, data)
+	}
+	var s vaultSecret
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("cannot parse response from Vault: %s", err)
+	}
+	return &s, nil
+}
+
+// credentials are ClickHouse credentials of the cluster user.
+type credentials struct {
+	name     string
+	password string
+}
+
+// getCredentials returns ClickHouse user name and password
+// for requests of cu.
+func (cu *clusterUser) getCredentials() (string, string) {
+	if c, ok := cu.vaultCreds.Load().(*credentials); ok {
+		return c.name, c.password
+	}
+	return cu.name, cu.password
+}
+
+// loadVaultCredentials reads credentials of cu from Vault.
+//
+// Secrets must contain `password`. `username` is optional, so secrets
+// of database engine with dynamic user names may be used.
+// The read secret is returned for tracking its lease.
+func (cu *clusterUser) loadVaultCredentials(vc *vaultClient) (*vaultSecret, error) {
+	s, err := vc.read(cu.vaultSecret)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read `vault_secret` %q: %s", cu.vaultSecret, err)
+	}
+	password, ok := s.Data["password"].(string)
+	if !ok {
+		return nil, fmt.Errorf("`vault_secret` %q must contain `password` string", cu.vaultSecret)
+	}
+	c := &credentials{
+		name:     cu.name,
+		password: password,
+	}
+	if name, ok := s.Data["username"].(string); ok && len(name) > 0 {
+		c.name = name
+	}
+	cu.vaultCreds.Store(c)
+	return s, nil
+}
+
+// runVaultRefresher keeps credentials of cu up to date until done is closed.
+//
+// Renewable leases are renewed before their expiration. New credentials
+// are read when the lease cannot be renewed for its full duration anymore,
+// and every refresh interval for secrets without leases.
+func (cu *clusterUser) runVaultRefresher(vc *vaultClient, cluster string, s *vaultSecret, done <-chan struct{}) {
+	labels := prometheus.Labels{
+		"cluster":      cluster,
+		"cluster_user": cu.name,
+	}
+	lease := time.Duration(s.LeaseDuration) * time.Second
+	interval := vc.refreshInterval
+	for {
+		d := interval
+		if lease > 0 && lease*2/3 < d {
+			d = lease * 2 / 3
+		}
+		select {
+		case <-done:
+			return
+		case <-time.After(d):
+		}
+
+		if s.Renewable && len(s.LeaseID) > 0 {
+			rs, err := vc.renew(s.LeaseID, s.LeaseDuration)
+			if err == nil && rs.LeaseDuration >= s.LeaseDuration {
+				interval = vc.refreshInterval
+				continue
+			}
+			if err != nil {
+				log.Errorf("cannot renew Vault lease for cluster user %q: %s", cu.name, err)
+			}
+		}
+		ns, err := cu.loadVaultCredentials(vc)
+		if err != nil {
+			vaultErrors.With(labels).Inc()
+			log.Errorf("cannot refresh credentials for cluster user %q: %s", cu.name, err)
+			// Keep the current credentials and retry soon,
+			// since their lease may expire.
+			interval = vaultRetryInterval
+			lease = 0
+			continue
+		}
+		s = ns
+		lease = time.Duration(s.LeaseDuration) * time.Second
+		interval = vc.refreshInterval
+	}
+}
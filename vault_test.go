@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func newFakeVault(t *testing.T) (*httptest.Server, *uint32) {
+	var dbCreds uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/clickhouse/web":
+			fmt.Fprint(w, `{"data":{"data":{"password":"kv-secret"},"metadata":{"version":1}}}`)
+		case "/v1/database/creds/web":
+			n := atomic.AddUint32(&dbCreds, 1)
+			fmt.Fprintf(w, `{"lease_id":"database/creds/web/%d","lease_duration":1,"renewable":true,`+
+				`"data":{"username":"v-web-%d","password":"db-secret-%d"}}`, n, n, n)
+		case "/v1/sys/leases/renew":
+			// The lease reached its max TTL.
+			fmt.Fprint(w, `{"lease_id":"database/creds/web/1","lease_duration":0,"renewable":true}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}
+	}))
+	return srv, &dbCreds
+}
+
+func TestVaultCredentials(t *testing.T) {
+	srv, dbCreds := newFakeVault(t)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "chproxy-vault")
+	if err != nil {
+		t.Fatalf("cannot create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("vault-token\n"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", tokenFile, err)
+	}
+	vc, err := newVaultClient(config.Vault{
+		Address:         srv.URL,
+		TokenFile:       tokenFile,
+		RefreshInterval: config.Duration(time.Hour),
+		Timeout:         config.Duration(time.Second),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f := func(cu *clusterUser, expectedName, expectedPassword string) {
+		t.Helper()
+		name, password := cu.getCredentials()
+		if name != expectedName || password != expectedPassword {
+			t.Fatalf("unexpected credentials %q:%q; expected %q:%q", name, password, expectedName, expectedPassword)
+		}
+	}
+
+	cu := newClusterUser(config.ClusterUser{Name: "web", VaultSecret: "secret/data/clickhouse/web"})
+	if _, err := cu.loadVaultCredentials(vc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f(cu, "web", "kv-secret")
+
+	cu = newClusterUser(config.ClusterUser{Name: "web", VaultSecret: "database/creds/web"})
+	s, err := cu.loadVaultCredentials(vc)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	f(cu, "v-web-1", "db-secret-1")
+
+	// New credentials must be read before the lease expiration,
+	// since the lease cannot be renewed.
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		cu.runVaultRefresher(vc, "cluster", s, done)
+		close(finished)
+	}()
+	for i := 0; atomic.LoadUint32(dbCreds) < 2; i++ {
+		if i > 100 {
+			t.Fatalf("credentials haven't been refreshed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(done)
+	<-finished
+	f(cu, "v-web-2", "db-secret-2")
+
+	cu = newClusterUser(config.ClusterUser{Name: "web", VaultSecret: "secret/data/clickhouse/missing"})
+	if _, err := cu.loadVaultCredentials(vc); err == nil {
+		t.Fatalf("expecting error for missing secret")
+	}
+	f(cu, "web", "")
+}
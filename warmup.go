@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+	"github.com/Vertamedia/chproxy/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// warmupRemoteAddr is the address warmup requests are sent from.
+//
+// `allowed_networks` of the warmup user must contain it.
+const warmupRemoteAddr = "127.0.0.1:0"
+
+// cacheWarmer fills the cache by executing queries on start
+// and on schedule, so users don't wait for cold cache.
+type cacheWarmer struct {
+	cache string
+	cfg   config.CacheWarmup
+
+	// handler proxies warmup requests.
+	handler http.Handler
+}
+
+// newCacheWarmer returns cache warmer for the cache with the given name.
+//
+// nil is returned if warmup isn't configured.
+func newCacheWarmer(cache string, cfg config.CacheWarmup, handler http.Handler) *cacheWarmer {
+	if len(cfg.User) == 0 {
+		return nil
+	}
+	return &cacheWarmer{
+		cache:   cache,
+		cfg:     cfg,
+		handler: handler,
+	}
+}
+
+// run executes warmup queries until stopCh is closed.
+func (cw *cacheWarmer) run(stopCh <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	cw.warmup(ctx)
+	for {
+		next := cw.cfg.Schedule.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		select {
+		case <-time.After(time.Until(next)):
+			cw.warmup(ctx)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// warmup executes all the warmup queries one by one.
+func (cw *cacheWarmer) warmup(ctx context.Context) {
+	queries, err := cw.queries()
+	if err != nil {
+		log.Errorf("cache %q: cannot obtain warmup queries: %s", cw.cache, err)
+		return
+	}
+	startTime := time.Now()
+	var failed int
+	for _, q := range queries {
+		err := cw.execute(ctx, q)
+		if ctx.Err() != nil {
+			// chproxy is stopped or config is reloaded.
+			return
+		}
+		result := "success"
+		if err != nil {
+			log.Errorf("cache %q: warmup query failed: %s; query: %q", cw.cache, err, q)
+			result = "failure"
+			failed++
+		}
+		cacheWarmupQueries.With(prometheus.Labels{
+			"cache":  cw.cache,
+			"result": result,
+		}).Inc()
+	}
+	log.Infof("cache %q: executed %d warmup queries in %s; failed queries: %d",
+		cw.cache, len(queries), time.Since(startTime), failed)
+}
+
+// queries returns queries from `queries` and `file`.
+//
+// The file is re-read on each call, so it may be updated
+// without config reload.
+func (cw *cacheWarmer) queries() ([]string, error) {
+	queries := append([]string{}, cw.cfg.Queries...)
+	if len(cw.cfg.File) == 0 {
+		return queries, nil
+	}
+	f, err := os.Open(cw.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fq, err := readWarmupQueries(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %s", cw.cfg.File, err)
+	}
+	return append(queries, fq...), nil
+}
+
+// readWarmupQueries reads queries separated by `;` at the end of line.
+func readWarmupQueries(r io.Reader) ([]string, error) {
+	var queries []string
+	var buf bytes.Buffer
+	flush := func() {
+		if q := strings.TrimSpace(buf.String()); len(q) > 0 {
+			queries = append(queries, q)
+		}
+		buf.Reset()
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		if strings.HasSuffix(line, ";") {
+			buf.WriteString(strings.TrimSuffix(line, ";"))
+			flush()
+			continue
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return queries, nil
+}
+
+// execute proxies q on behalf of the warmup user.
+//
+// Warmup requests are authorized like requests without credentials
+// to the listener with `default_user`.
+func (cw *cacheWarmer) execute(ctx context.Context, q string) error {
+	params := make(url.Values, len(cw.cfg.Params))
+	for k, v := range cw.cfg.Params {
+		params.Set(k, v)
+	}
+	req, err := http.NewRequest(http.MethodPost, "http://chproxy-warmup/?"+params.Encode(), strings.NewReader(q))
+	if err != nil {
+		return err
+	}
+	for k, v := range cw.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	l := &config.HTTP{
+		DefaultUser: cw.cfg.User,
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req = req.WithContext(context.WithValue(ctx, listenerContextKey{}, l))
+	req.RemoteAddr = warmupRemoteAddr
+
+	rw := &warmupResponseWriter{
+		ctx:        ctx,
+		header:     make(http.Header),
+		statusCode: http.StatusOK,
+	}
+	cw.handler.ServeHTTP(rw, req)
+	if rw.statusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d: %s", rw.statusCode, bytes.TrimSpace(rw.errBody.Bytes()))
+	}
+	return nil
+}
+
+// warmupResponseWriter discards response body, since warmup is needed
+// only for caching responses.
+type warmupResponseWriter struct {
+	ctx        context.Context
+	header     http.Header
+	statusCode int
+
+	// errBody contains the beginning of error response.
+	errBody bytes.Buffer
+}
+
+// CloseNotify implements http.CloseNotifier
+//
+// The returned channel is notified when the warmup request is finished
+// or canceled.
+func (rw *warmupResponseWriter) CloseNotify() <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		<-rw.ctx.Done()
+		ch <- true
+	}()
+	return ch
+}
+
+func (rw *warmupResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *warmupResponseWriter) WriteHeader(statusCode int) {
+	rw.statusCode = statusCode
+}
+
+func (rw *warmupResponseWriter) Write(p []byte) (int, error) {
+	if rw.statusCode != http.StatusOK && rw.errBody.Len() < 1024 {
+		rw.errBody.Write(p)
+	}
+	return len(p), nil
+}
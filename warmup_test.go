@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+func TestReadWarmupQueries(t *testing.T) {
+	queries, err := readWarmupQueries(strings.NewReader(`
+SELECT 1;
+
+SELECT count()
+FROM hits
+WHERE s = 'a;b';
+SELECT 3`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"SELECT 1", "SELECT count()\nFROM hits\nWHERE s = 'a;b'", "SELECT 3"}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("unexpected queries: %q; expecting %q", queries, expected)
+	}
+}
+
+func TestCacheWarmup(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		if len(body) == 0 {
+			// health check
+			fmt.Fprint(w, okResponse)
+			return
+		}
+		if string(body) == "SELECT broken" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "Code: 62. DB::Exception: Syntax error")
+			return
+		}
+		fmt.Fprintf(w, "response %d", atomic.AddInt32(&n, 1))
+	}))
+	defer srv.Close()
+	addr, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	dir, err := ioutil.TempDir("", "chproxy-cache-warmup")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newConfiguredProxy(&config.Config{
+		Caches: []config.Cache{
+			{
+				Name:      "dashboards",
+				Dir:       dir,
+				MaxSize:   config.ByteSize(1 << 20),
+				Expire:    config.Duration(time.Minute),
+				GraceTime: config.Duration(-1),
+				Warmup: config.CacheWarmup{
+					User:    "dashboard",
+					Queries: []string{"SELECT broken", "SELECT 1"},
+					Params: map[string]string{
+						"default_format": "TSV",
+					},
+				},
+			},
+		},
+		Clusters: []config.Cluster{
+			{
+				Name:   "cluster",
+				Scheme: "http",
+				Nodes:  []string{addr.Host},
+				ClusterUsers: []config.ClusterUser{
+					{
+						Name: "web",
+					},
+				},
+				HeartBeatInterval: config.Duration(time.Minute),
+			},
+		},
+		Users: []config.User{
+			{
+				Name:      "dashboard",
+				ToCluster: "cluster",
+				ToUser:    "web",
+				Cache:     "dashboards",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.caches["dashboards"].Stats().Items == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("warmup response hasn't been cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The warmed up response must be served from the cache.
+	req := httptest.NewRequest("POST", srv.URL+"?user=dashboard&default_format=TSV", strings.NewReader("SELECT 1"))
+	resp := makeCustomRequest(p, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code %d; expecting %d", resp.StatusCode, http.StatusOK)
+	}
+	if body := bbToString(t, resp.Body); body != "response 1" {
+		t.Fatalf("unexpected response body %q; expecting %q", body, "response 1")
+	}
+	if n := atomic.LoadInt32(&n); n != 1 {
+		t.Fatalf("unexpected number of executed queries: %d; expecting 1", n)
+	}
+}
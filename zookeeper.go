@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// zkClient is a minimal ZooKeeper client.
+//
+// It supports only the read operations required by chproxy.
+// A new session is opened for each batch of operations,
+// so the client needs neither pings nor reconnects.
+type zkClient struct {
+	addrs []string
+
+	// auth contains digest credentials in the `user:password` form.
+	auth string
+}
+
+const (
+	zkOpGetData     = 4
+	zkOpGetChildren = 8
+	zkOpClose       = -11
+	zkOpAuth        = 100
+
+	zkAuthXid = -4
+
+	// zkSessionTimeout is the session timeout requested from ZooKeeper.
+	zkSessionTimeout = 10 * time.Second
+
+	// maxZKPacketSize limits the size of ZooKeeper responses.
+	maxZKPacketSize = 16 << 20
+)
+
+// zkError is an error code returned by ZooKeeper server.
+type zkError int32
+
+const (
+	zkErrNoNode     zkError = -101
+	zkErrNoAuth     zkError = -102
+	zkErrAuthFailed zkError = -115
+)
+
+func (e zkError) Error() string {
+	switch e {
+	case zkErrNoNode:
+		return "node does not exist"
+	case zkErrNoAuth:
+		return "not authenticated"
+	case zkErrAuthFailed:
+		return "authentication failed"
+	}
+	return fmt.Sprintf("zookeeper error %d", int32(e))
+}
+
+func newZKClient(addrs, auth string) *zkClient {
+	c := &zkClient{
+		auth: auth,
+	}
+	for _, addr := range strings.Split(addrs, ",") {
+		c.addrs = append(c.addrs, strings.TrimSpace(addr))
+	}
+	return c
+}
+
+// connect opens a session on the first available server.
+//
+// The session must be closed after use.
+func (c *zkClient) connect(ctx context.Context) (*zkConn, error) {
+	var lastErr error
+	for _, addr := range c.addrs {
+		zc, err := c.connectTo(ctx, addr)
+		if err == nil {
+			return zc, nil
+		}
+		lastErr = fmt.Errorf("cannot connect to %q: %s", addr, err)
+	}
+	return nil, lastErr
+}
+
+func (c *zkClient) connectTo(ctx context.Context, addr string) (*zkConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	zc := &zkConn{
+		Conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+
+	var e zkEncoder
+	e.int32(0) // protocol version
+	e.int64(0) // last seen zxid
+	e.int32(int32(zkSessionTimeout / time.Millisecond))
+	e.int64(0) // session id
+	e.bytes(make([]byte, 16))
+	if err := zc.writePacket(e.b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := zc.readPacket()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	d := zkDecoder{b: resp}
+	d.int32() // protocol version
+	timeout := d.int32()
+	d.int64() // session id
+	if d.err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot parse connect response: %s", d.err)
+	}
+	if timeout <= 0 {
+		conn.Close()
+		return nil, fmt.Errorf("session has been refused")
+	}
+
+	if len(c.auth) > 0 {
+		var e zkEncoder
+		e.int32(0) // auth type
+		e.string("digest")
+		e.bytes([]byte(c.auth))
+		if _, err := zc.call(zkAuthXid, zkOpAuth, e.b); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return zc, nil
+}
+
+// zkConn is a connection with an open ZooKeeper session.
+type zkConn struct {
+	net.Conn
+	br  *bufio.Reader
+	xid int32
+}
+
+// getChildren returns names of children of the node at p.
+func (zc *zkConn) getChildren(p string) ([]string, error) {
+	var e zkEncoder
+	e.string(p)
+	e.bool(false) // watch
+	zc.xid++
+	d, err := zc.call(zc.xid, zkOpGetChildren, e.b)
+	if err != nil {
+		return nil, err
+	}
+	n := d.int32()
+	var children []string
+	for i := int32(0); i < n && d.err == nil; i++ {
+		children = append(children, d.string())
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("cannot parse children of %q: %s", p, d.err)
+	}
+	return children, nil
+}
+
+// getData returns data of the node at p.
+func (zc *zkConn) getData(p string) ([]byte, error) {
+	var e zkEncoder
+	e.string(p)
+	e.bool(false) // watch
+	zc.xid++
+	d, err := zc.call(zc.xid, zkOpGetData, e.b)
+	if err != nil {
+		return nil, err
+	}
+	data := d.bytes()
+	if d.err != nil {
+		return nil, fmt.Errorf("cannot parse data of %q: %s", p, d.err)
+	}
+	return data, nil
+}
+
+// close closes the session and the connection.
+func (zc *zkConn) close() {
+	zc.xid++
+	zc.call(zc.xid, zkOpClose, nil)
+	zc.Close()
+}
+
+// call sends the request and returns decoder for its response.
+func (zc *zkConn) call(xid, op int32, body []byte) (*zkDecoder, error) {
+	var e zkEncoder
+	e.int32(xid)
+	e.int32(op)
+	e.b = append(e.b, body...)
+	if err := zc.writePacket(e.b); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := zc.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		d := &zkDecoder{b: resp}
+		respXid := d.int32()
+		d.int64() // zxid
+		code := d.int32()
+		if d.err != nil {
+			return nil, fmt.Errorf("cannot parse response header: %s", d.err)
+		}
+		if respXid != xid {
+			// Skip watch notifications and pings.
+			continue
+		}
+		if code != 0 {
+			return nil, zkError(code)
+		}
+		return d, nil
+	}
+}
+
+func (zc *zkConn) writePacket(b []byte) error {
+	packet := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(packet, uint32(len(b)))
+	copy(packet[4:], b)
+	_, err := zc.Write(packet)
+	return err
+}
+
+func (zc *zkConn) readPacket() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(zc.br, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxZKPacketSize {
+		return nil, fmt.Errorf("too big packet: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(zc.br, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// zkEncoder encodes values in ZooKeeper jute format.
+type zkEncoder struct {
+	b []byte
+}
+
+func (e *zkEncoder) int32(n int32) {
+	e.b = append(e.b, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func (e *zkEncoder) int64(n int64) {
+	e.int32(int32(n >> 32))
+	e.int32(int32(n))
+}
+
+func (e *zkEncoder) bool(v bool) {
+	if v {
+		e.b = append(e.b, 1)
+		return
+	}
+	e.b = append(e.b, 0)
+}
+
+func (e *zkEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *zkEncoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+// zkDecoder decodes values in ZooKeeper jute format.
+//
+// The first decoding error is stored in err and subsequent
+// calls return zero values.
+type zkDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *zkDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *zkDecoder) int32() int32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (d *zkDecoder) int64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *zkDecoder) bytes() []byte {
+	n := d.int32()
+	if n == -1 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *zkDecoder) string() string {
+	return string(d.bytes())
+}
+
+// zookeeperResolver resolves node names as ZooKeeper paths
+// of ClickHouse cluster discovery, i.e. `<discovery><path>`
+// from ClickHouse server config.
+//
+// ClickHouse registers each node as an ephemeral child of `<path>/shards`,
+// so nodes of added shards are discovered automatically.
+type zookeeperResolver struct {
+	client *zkClient
+
+	// port is HTTP port of ClickHouse nodes, since ClickHouse
+	// registers nodes with their native protocol port.
+	port string
+}
+
+func newZookeeperResolver(cfg config.DiscoveryServer, scheme string) *zookeeperResolver {
+	port := cfg.NodePort
+	if port == 0 {
+		port = 8123
+		if scheme == "https" {
+			port = 8443
+		}
+	}
+	return &zookeeperResolver{
+		client: newZKClient(cfg.Address, cfg.Token),
+		port:   strconv.Itoa(port),
+	}
+}
+
+// zkNodeInfo is the node info registered by ClickHouse cluster discovery.
+type zkNodeInfo struct {
+	Address string `json:"address"`
+}
+
+func (zr *zookeeperResolver) resolve(ctx context.Context, node string) ([]string, error) {
+	zc, err := zr.client.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer zc.close()
+
+	shardsPath := path.Join(node, "shards")
+	names, err := zc.getChildren(shardsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %q: %s", shardsPath, err)
+	}
+	addrs := make([]string, 0, len(names))
+	for _, name := range names {
+		p := path.Join(shardsPath, name)
+		data, err := zc.getData(p)
+		if err == zkErrNoNode {
+			// The node has gone after listing.
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %q: %s", p, err)
+		}
+		// Older ClickHouse versions register nodes by address
+		// without data.
+		address := name
+		if len(data) > 0 {
+			var info zkNodeInfo
+			if err := json.Unmarshal(data, &info); err != nil {
+				return nil, fmt.Errorf("cannot parse %q: %s", p, err)
+			}
+			address = info.Address
+		}
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q in %q: %s", address, p, err)
+		}
+		addrs = append(addrs, net.JoinHostPort(host, zr.port))
+	}
+	return addrs, nil
+}
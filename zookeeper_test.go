@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Vertamedia/chproxy/config"
+)
+
+// fakeZooKeeper serves read requests for the given nodes
+// by their paths.
+type fakeZooKeeper struct {
+	ln    net.Listener
+	auth  string
+	nodes map[string]string
+}
+
+func newFakeZooKeeper(t *testing.T, auth string, nodes map[string]string) *fakeZooKeeper {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	zk := &fakeZooKeeper{
+		ln:    ln,
+		auth:  auth,
+		nodes: nodes,
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go zk.serve(conn)
+		}
+	}()
+	return zk
+}
+
+func (zk *fakeZooKeeper) serve(conn net.Conn) {
+	defer conn.Close()
+	zc := &zkConn{
+		Conn: conn,
+		br:   bufio.NewReader(conn),
+	}
+	if _, err := zc.readPacket(); err != nil {
+		return
+	}
+	var e zkEncoder
+	e.int32(0)
+	e.int32(int32(zkSessionTimeout / time.Millisecond))
+	e.int64(1)
+	e.bytes(make([]byte, 16))
+	if err := zc.writePacket(e.b); err != nil {
+		return
+	}
+
+	authenticated := len(zk.auth) == 0
+	for {
+		req, err := zc.readPacket()
+		if err != nil {
+			return
+		}
+		d := zkDecoder{b: req}
+		xid := d.int32()
+		op := d.int32()
+		var code zkError
+		var resp zkEncoder
+		switch op {
+		case zkOpAuth:
+			d.int32()
+			if d.string() == "digest" && d.string() == zk.auth {
+				authenticated = true
+			} else {
+				code = zkErrAuthFailed
+			}
+		case zkOpGetChildren, zkOpGetData:
+			p := d.string()
+			if !authenticated {
+				code = zkErrNoAuth
+				break
+			}
+			if op == zkOpGetData {
+				data, ok := zk.nodes[p]
+				if !ok {
+					code = zkErrNoNode
+					break
+				}
+				resp.string(data)
+				break
+			}
+			var children []string
+			for np := range zk.nodes {
+				if strings.HasPrefix(np, p+"/") && !strings.Contains(np[len(p)+1:], "/") {
+					children = append(children, np[len(p)+1:])
+				}
+			}
+			if len(children) == 0 {
+				code = zkErrNoNode
+				break
+			}
+			resp.int32(int32(len(children)))
+			for _, c := range children {
+				resp.string(c)
+			}
+		}
+		var h zkEncoder
+		h.int32(xid)
+		h.int64(0)
+		h.int32(int32(code))
+		if err := zc.writePacket(append(h.b, resp.b...)); err != nil {
+			return
+		}
+		if op == zkOpClose {
+			return
+		}
+	}
+}
+
+func TestZookeeperResolver(t *testing.T) {
+	zk := newFakeZooKeeper(t, "chproxy:secret", map[string]string{
+		"/clickhouse/discovery/analytics/shards/uuid-1":       `{"version":1,"address":"ch-1.local:9000","shard_id":1}`,
+		"/clickhouse/discovery/analytics/shards/uuid-2":       `{"version":1,"address":"ch-2.local:9000","shard_id":2}`,
+		"/clickhouse/discovery/legacy/shards/ch-3.local:9000": "",
+	})
+	defer zk.ln.Close()
+
+	zr := newZookeeperResolver(config.DiscoveryServer{
+		Address: "127.0.0.1:1," + zk.ln.Addr().String(),
+		Token:   "chproxy:secret",
+	}, "http")
+	f := func(node string, expected ...string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		addrs, err := zr.resolve(ctx, node)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// Children order isn't guaranteed.
+		if len(addrs) == 2 && addrs[0] > addrs[1] {
+			addrs[0], addrs[1] = addrs[1], addrs[0]
+		}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Fatalf("unexpected addresses %q; expecting %q", addrs, expected)
+		}
+	}
+	f("/clickhouse/discovery/analytics", "ch-1.local:8123", "ch-2.local:8123")
+	f("/clickhouse/discovery/legacy/", "ch-3.local:8123")
+
+	if _, err := zr.resolve(context.Background(), "/clickhouse/discovery/unknown"); err == nil {
+		t.Fatalf("expecting non-nil error for unknown path")
+	}
+
+	zr = newZookeeperResolver(config.DiscoveryServer{
+		Address: zk.ln.Addr().String(),
+		Token:   "chproxy:wrong",
+	}, "http")
+	_, err := zr.resolve(context.Background(), "/clickhouse/discovery/analytics")
+	if err == nil || !strings.Contains(err.Error(), zkErrAuthFailed.Error()) {
+		t.Fatalf("unexpected error: %v; expecting %q", err, zkErrAuthFailed)
+	}
+}